@@ -62,6 +62,15 @@ type HandleRequest struct {
 	// MaxDR defines the max. allowed data-rate.
 	MaxDR int
 
+	// TargetPER defines the target packet-error rate in percent (as configured
+	// by the service-profile). When set to 0, no target is configured.
+	TargetPER int
+
+	// MinGWDiversity defines the min. number of gateways that must receive
+	// each uplink (as configured by the service-profile). When set to 0, no
+	// min. gateway diversity is configured.
+	MinGWDiversity int
+
 	// UplinkHistory contains the meta-data of the last uplinks.
 	// Note: this table is for the current data-date only!
 	UplinkHistory []UplinkMetaData
@@ -335,6 +335,18 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
   # on every downlink in case of a malfunctioning device.
   max_mac_command_error_count={{ .NetworkServer.NetworkSettings.MaxMACCommandErrorCount }}
 
+  # Reject uplinks below the min. gateway diversity.
+  #
+  # Uplinks received by fewer gateways than the min. gateway diversity
+  # configured by the service-profile are flagged in the frame-log and in the
+  # uplink sent to the application-server. When set to true, these uplinks
+  # are rejected instead.
+  #
+  # Note that the gateway diversity Prometheus metrics are global (over all
+  # devices). The gateway diversity of a single device (averaged over its
+  # uplink history) is returned by the GetDeviceActivation API.
+  reject_below_min_gw_diversity={{ .NetworkServer.NetworkSettings.RejectBelowMinGWDiversity }}
+
   # Enable only a given sub-set of channels
   #
   # Use this when ony a sub-set of the by default enabled channels are being
@@ -434,6 +446,42 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
   max_time_n={{ .NetworkServer.NetworkSettings.RejoinRequest.MaxTimeN }}
 
 
+  # Downlink duty-cycle settings
+  #
+  # When enabled, ChirpStack Network Server keeps track of the time-on-air of
+  # the downlinks transmitted by each gateway, per sub-band. Before sending a
+  # downlink, the remaining budget is checked. When exhausted, another
+  # RX window or gateway is used, or the downlink is deferred.
+  #
+  # The max_duty_cycle of the device-profile (when set) further limits the
+  # gateway duty-cycle which can be used by downlinks to these devices.
+  [network_server.network_settings.duty_cycle]
+  # Enable duty-cycle accounting.
+  enabled={{ .NetworkServer.NetworkSettings.DutyCycle.Enabled }}
+
+  # Window over which the duty-cycle is calculated.
+  window="{{ .NetworkServer.NetworkSettings.DutyCycle.Window }}"
+
+  # Sub-bands and their max. duty-cycle (%).
+  #
+  # When left blank, the EU868 sub-bands (ETSI EN 300 220) will be used when
+  # the EU868 band is configured.
+  #
+  # Example:
+  # [[network_server.network_settings.duty_cycle.sub_bands]]
+  # name="g1"
+  # min_frequency=868000000
+  # max_frequency=868600000
+  # max_duty_cycle=1.0
+{{ range $index, $element := .NetworkServer.NetworkSettings.DutyCycle.SubBands }}
+  [[network_server.network_settings.duty_cycle.sub_bands]]
+  name="{{ $element.Name }}"
+  min_frequency={{ $element.MinFrequency }}
+  max_frequency={{ $element.MaxFrequency }}
+  max_duty_cycle={{ $element.MaxDutyCycle }}
+{{ end }}
+
+
   # Scheduler settings
   #
   # These settings affect the multicast, Class-B and Class-C downlink queue
@@ -471,6 +519,55 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
     multicast_gateway_delay="{{ .NetworkServer.Scheduler.ClassC.MulticastGatewayDelay }}"
 
 
+  # Uplink settings.
+  #
+  # These settings define how the uplink frames received from the gateway
+  # backend are handled.
+  [network_server.uplink]
+  # Worker count.
+  #
+  # The number of workers handling the uplink frames. This bounds the number
+  # of uplink frames that are handled concurrently and thus the number of
+  # concurrent Redis and PostgreSQL operations. Workers do not wait the
+  # de-duplication delay, the collected frames are handled by one of the
+  # workers once this delay has expired. When set to 0, each uplink frame
+  # is handled in a separate go-routine (no limit).
+  worker_count={{ .NetworkServer.Uplink.WorkerCount }}
+
+  # Queue size.
+  #
+  # The max. number of uplink frames waiting for a worker. Frames are
+  # queued per gateway and are handled round-robin over the gateways.
+  queue_size={{ .NetworkServer.Uplink.QueueSize }}
+
+  # Overload policy.
+  #
+  # The policy to apply when the queue is full. Valid options are:
+  #  * drop_oldest: drop the oldest frame of the gateway with the most queued frames
+  #  * drop_newest: drop the received frame
+  #  * block: stop reading from the gateway backend until there is space
+  overload_policy="{{ .NetworkServer.Uplink.OverloadPolicy }}"
+
+
+  # Geolocation settings.
+  #
+  # These settings are used for the network-side geolocation of devices for
+  # which the service-profile has network geolocation enabled. The resolved
+  # location is sent to the application-server.
+  [network_server.geolocation]
+  # Geolocation resolver.
+  #
+  # Valid options are:
+  #  * local: TDOA (when fine-timestamps are available) with RSSI fallback
+  resolver="{{ .NetworkServer.Geolocation.Resolver }}"
+
+  # Min. gateway count.
+  #
+  # The min. number of gateways that must receive an uplink in order to
+  # resolve the location of the device (min. 3).
+  min_gateway_count={{ .NetworkServer.Geolocation.MinGatewayCount }}
+
+
   # Network-server API
   #
   # This is the network-server API that is used by ChirpStack Application Server or other
@@ -523,6 +620,133 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
   downlink_timeout="{{ .NetworkServer.Gateway.DownlinkTimeout }}"
 
 
+  # Gateway presence settings.
+  #
+  # The network-server keeps track of the last time a gateway was seen (stats,
+  # uplinks and downlink acknowledgements). A gateway is marked offline when it
+  # has not been seen for offline_multiplier x the stats interval of the
+  # gateway-profile (or the default_stats_interval when no gateway-profile
+  # is assigned).
+  [network_server.gateway.presence]
+  # Offline multiplier.
+  offline_multiplier={{ .NetworkServer.Gateway.Presence.OfflineMultiplier }}
+
+  # Default stats interval.
+  #
+  # This interval is used for gateways without gateway-profile.
+  default_stats_interval="{{ .NetworkServer.Gateway.Presence.DefaultStatsInterval }}"
+
+  # Check interval.
+  #
+  # This defines the interval in which the network-server checks for gateways
+  # that went offline.
+  check_interval="{{ .NetworkServer.Gateway.Presence.CheckInterval }}"
+
+  # Exclude offline gateways.
+  #
+  # When set, gateways that are offline are not used for Class-B, Class-C
+  # and multicast downlinks.
+  exclude_offline={{ .NetworkServer.Gateway.Presence.ExcludeOffline }}
+
+    # Event sink.
+    #
+    # The online / offline events are sent to the configured sink.
+    [network_server.gateway.presence.event_sink]
+    # Type.
+    #
+    # Valid options are:
+    #  * log   logs the events
+    #  * http  posts the events as JSON to the configured URL
+    type="{{ .NetworkServer.Gateway.Presence.EventSink.Type }}"
+
+      # HTTP event sink.
+      [network_server.gateway.presence.event_sink.http]
+      # Endpoint URL.
+      url="{{ .NetworkServer.Gateway.Presence.EventSink.HTTP.URL }}"
+
+      # Request timeout.
+      timeout="{{ .NetworkServer.Gateway.Presence.EventSink.HTTP.Timeout }}"
+
+
+  # Downlink fallback settings.
+  #
+  # When a gateway rejects all the items of a downlink (e.g. TOO_LATE or
+  # COLLISION_PACKET), the network-server re-plans the downlink using an
+  # other gateway that received the last uplink of the device, as long as
+  # the receive window can still be reached.
+  [network_server.gateway.downlink_fallback]
+  # Enable downlink fallback.
+  enabled={{ .NetworkServer.Gateway.DownlinkFallback.Enabled }}
+
+  # Margin.
+  #
+  # The minimum time between re-planning the downlink and the start of the
+  # receive window.
+  margin="{{ .NetworkServer.Gateway.DownlinkFallback.Margin }}"
+
+  # Max. attempts.
+  #
+  # The max. number of gateways used for a single downlink (including the
+  # initially selected gateway).
+  max_attempts={{ .NetworkServer.Gateway.DownlinkFallback.MaxAttempts }}
+
+    # Gateway blacklist.
+    #
+    # A gateway returning error_count tx ack errors within the error_window
+    # is not used for downlinks during the configured duration (unless there
+    # is no other gateway). Set error_count to 0 to disable.
+    [network_server.gateway.downlink_fallback.blacklist]
+    error_count={{ .NetworkServer.Gateway.DownlinkFallback.Blacklist.ErrorCount }}
+    error_window="{{ .NetworkServer.Gateway.DownlinkFallback.Blacklist.ErrorWindow }}"
+    duration="{{ .NetworkServer.Gateway.DownlinkFallback.Blacklist.Duration }}"
+
+
+  # Gateway radio metrics.
+  #
+  # When enabled, the rx / tx counters per frequency, data-rate and tx status
+  # reported in the gateway stats are aggregated in Redis (see the
+  # metrics.redis section) and returned by the GetGatewayStats API.
+  [network_server.gateway.radio_metrics]
+  # Store radio metrics.
+  enabled={{ .NetworkServer.Gateway.RadioMetrics.Enabled }}
+
+  # Prometheus gateway IDs.
+  #
+  # The per gateway radio counters of the given gateway IDs are also exposed
+  # as Prometheus metrics. As the number of label combinations grows with
+  # every gateway, only the listed gateways are exported. Frequencies outside
+  # the configured band and unknown tx statuses are never stored or exported.
+  #
+  # Example:
+  # prometheus_gateway_ids=["0102030405060708", "0807060504030201"]
+  prometheus_gateway_ids=[{{ range $index, $element := .NetworkServer.Gateway.RadioMetrics.PrometheusGatewayIDs }}{{ if $index }}, {{ end }}"{{ $element }}"{{ end }}]
+
+
+  # Gateway configuration push.
+  #
+  # When a gateway has a gateway-profile, the network-server compares the
+  # configuration version of the gateway-profile with the version reported
+  # in the gateway stats. On a mismatch, the configuration is sent to the
+  # gateway if it supports this. This is the case for Concentratord based
+  # gateways (announced by the concentratord_version meta-data) and for
+  # gateways connected to a backend which is able to push the configuration
+  # (e.g. the Basics Station backend, using router_config). The Semtech UDP
+  # protocol does not support configuration updates, for these gateways the
+  # configuration status is set to NOT_SUPPORTED and a warning is logged.
+  [network_server.gateway.config_push]
+  # Retry interval.
+  #
+  # The minimum interval between sending the same configuration version.
+  retry_interval="{{ .NetworkServer.Gateway.ConfigPush.RetryInterval }}"
+
+  # Max. attempts.
+  #
+  # After sending the same configuration version max_attempts times without
+  # the gateway reporting it, the configuration status is set to FAILED and
+  # the configuration is no longer sent until the gateway-profile changes.
+  max_attempts={{ .NetworkServer.Gateway.ConfigPush.MaxAttempts }}
+
+
   # Backend defines the gateway backend settings.
   #
   # The gateway backend handles the communication with the gateway(s) part of
@@ -537,8 +761,31 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
     #  * amqp
     #  * gcp_pub_sub
     #  * azure_iot_hub
+    #  * kafka
+    #  * semtech_udp
+    #  * basic_station
     type="{{ .NetworkServer.Gateway.Backend.Type }}"
 
+    # Multiple backends.
+    #
+    # When set, the backends in this list are used simultaneously (and the
+    # above type is ignored). This makes it possible to migrate gateways
+    # from one backend to an other. Downlink and gateway configuration
+    # commands are routed to the backend on which the gateway was last seen,
+    # unless a static route has been configured for the gateway.
+    #
+    # Example:
+    # types=["mqtt", "basic_station"]
+    types=[{{ range $index, $element := .NetworkServer.Gateway.Backend.Types }}{{ if $index }}, {{ end }}"{{ $element }}"{{ end }}]
+
+    # Route TTL.
+    #
+    # The backend on which a gateway was last seen is stored in Redis (and
+    # shared by all Network Server instances) for this duration. It is
+    # refreshed by the gateway events, this value must therefore be greater
+    # than the stats interval of the gateways.
+    route_ttl="{{ .NetworkServer.Gateway.Backend.RouteTTL }}"
+
     # Multi-downlink feature flag.
     #
     # This controls the new multi downlink feature, in which the Chirpstack
@@ -561,6 +808,21 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
     # legacy: Will send a downlink command only in the old format.
     multi_downlink_feature="{{ .NetworkServer.Gateway.Backend.MultiDownlinkFeature }}"
 
+    # Static gateway routes.
+    #
+    # This overrides the backend to which the commands of the given gateway
+    # are routed. This only has effect when multiple backends are configured.
+    #
+    # Example (the [[network_server.gateway.backend.routes]] can be repeated):
+    # [[network_server.gateway.backend.routes]]
+    # gateway_id="0102030405060708"
+    # backend="basic_station"
+    {{ range $index, $element := .NetworkServer.Gateway.Backend.Routes }}
+    [[network_server.gateway.backend.routes]]
+    gateway_id="{{ $element.GatewayID }}"
+    backend="{{ $element.Backend }}"
+    {{ end }}
+
 
     # MQTT gateway backend settings.
     #
@@ -711,6 +973,167 @@ get_downlink_data_delay="{{ .NetworkServer.GetDownlinkDataDelay }}"
     commands_connection_string="{{ .NetworkServer.Gateway.Backend.AzureIoTHub.CommandsConnectionString }}"
 
 
+    # Kafka backend.
+    #
+    # Use this backend when the gateway events are ingested into Kafka and the
+    # gateway commands are consumed from Kafka. The message key must contain
+    # the Gateway ID (HEX encoded), the message value must contain the event
+    # or command, using the JSON or Protobuf format.
+    [network_server.gateway.backend.kafka]
+    # Kafka brokers (host:port).
+    brokers=[{{ range $index, $element := .NetworkServer.Gateway.Backend.Kafka.Brokers }}{{ if $index }}, {{ end }}"{{ $element }}"{{ end }}]
+
+    # Connect using TLS.
+    tls={{ .NetworkServer.Gateway.Backend.Kafka.TLS }}
+
+    # CA certificate (optional).
+    #
+    # When configured, this is used to validate the broker certificate.
+    ca_cert="{{ .NetworkServer.Gateway.Backend.Kafka.CACert }}"
+
+    # TLS client certificate (optional).
+    #
+    # When configured, this will be used to authenticate the client.
+    # This must be configured together with the tls_key.
+    tls_cert="{{ .NetworkServer.Gateway.Backend.Kafka.TLSCert }}"
+
+    # TLS key for client certificate (optional).
+    tls_key="{{ .NetworkServer.Gateway.Backend.Kafka.TLSKey }}"
+
+    # SASL/PLAIN username (optional).
+    username="{{ .NetworkServer.Gateway.Backend.Kafka.Username }}"
+
+    # SASL/PLAIN password (optional).
+    password="{{ .NetworkServer.Gateway.Backend.Kafka.Password }}"
+
+    # Consumer group.
+    #
+    # All ChirpStack Network Server instances of the same deployment must use
+    # the same consumer group, so that each gateway event is handled by only
+    # one of the instances.
+    consumer_group="{{ .NetworkServer.Gateway.Backend.Kafka.ConsumerGroup }}"
+
+    # Commit interval.
+    #
+    # The offsets of the consumed gateway events are committed to the brokers
+    # at this interval. On a restart of ChirpStack Network Server, the events
+    # consumed within the last interval might be consumed again. When set to
+    # 0, the offset of each event is committed synchronously, which limits
+    # the throughput to the commit latency of the brokers.
+    commit_interval="{{ .NetworkServer.Gateway.Backend.Kafka.CommitInterval }}"
+
+    # Event topic template.
+    #
+    # This template is used to determine the topics from which the gateway
+    # events are consumed. The .EventType is one of up, stats or ack.
+    event_topic_template="{{ .NetworkServer.Gateway.Backend.Kafka.EventTopicTemplate }}"
+
+    # Command topic template.
+    #
+    # This is the topic template used when publishing gateway commands.
+    # Available are the .GatewayID and .CommandType (down or config).
+    command_topic_template="{{ .NetworkServer.Gateway.Backend.Kafka.CommandTopicTemplate }}"
+
+
+    # Semtech UDP packet-forwarder backend.
+    #
+    # Use this backend to connect gateways running the Semtech UDP
+    # packet-forwarder directly to ChirpStack Network Server, without
+    # ChirpStack Gateway Bridge. Note that with this backend, ChirpStack
+    # Network Server can not be scaled horizontally and that gateway
+    # configuration (gateway-profiles) is not supported.
+    [network_server.gateway.backend.semtech_udp]
+    # ip:port to bind the UDP listener to.
+    #
+    # Example: 0.0.0.0:1700 to listen on port 1700 for all network interfaces.
+    # This is the listener to which the packet-forwarder forwards its data
+    # so make sure the 'serv_port_up' and 'serv_port_down' from your
+    # packet-forwarder matches this port.
+    udp_bind="{{ .NetworkServer.Gateway.Backend.SemtechUDP.UDPBind }}"
+
+    # Skip the CRC status-check of received packets.
+    #
+    # This is only has effect when the packet-forwarder is configured to forward
+    # LoRa frames with CRC errors.
+    skip_crc_check={{ .NetworkServer.Gateway.Backend.SemtechUDP.SkipCRCCheck }}
+
+    # Fake RX timestamp.
+    #
+    # Fake the RX time when the gateway does not have GPS, in which case
+    # the time would otherwise be unset.
+    fake_rx_time={{ .NetworkServer.Gateway.Backend.SemtechUDP.FakeRxTime }}
+
+
+    # LoRa Basics Station backend.
+    #
+    # Use this backend to connect gateways running LoRa Basics Station
+    # (LNS protocol) directly to ChirpStack Network Server. The channel-plan
+    # (router_config) is generated from the gateway-profile of the gateway,
+    # or from the enabled uplink channels of the band when no gateway-profile
+    # is set.
+    [network_server.gateway.backend.basic_station]
+    # ip:port to bind the websocket listener to.
+    bind="{{ .NetworkServer.Gateway.Backend.BasicStation.Bind }}"
+
+    # TLS certificate and key files.
+    #
+    # When set, the websocket listener will use TLS.
+    tls_cert="{{ .NetworkServer.Gateway.Backend.BasicStation.TLSCert }}"
+    tls_key="{{ .NetworkServer.Gateway.Backend.BasicStation.TLSKey }}"
+
+    # TLS CA certificate.
+    #
+    # When configured, the gateways must authenticate using a client-certificate
+    # signed by this CA, of which the common name must match the gateway ID.
+    # When not set, the network_server.gateway.ca_cert is used, so that the
+    # client-certificates generated by ChirpStack Network Server can be used.
+    ca_cert="{{ .NetworkServer.Gateway.Backend.BasicStation.CACert }}"
+
+    # Stats interval.
+    #
+    # This defines the interval in which the gateway stats are generated
+    # for each connected gateway.
+    stats_interval="{{ .NetworkServer.Gateway.Backend.BasicStation.StatsInterval }}"
+
+    # Ping interval.
+    ping_interval="{{ .NetworkServer.Gateway.Backend.BasicStation.PingInterval }}"
+
+    # Read timeout.
+    #
+    # This interval must be greater than the configured ping interval.
+    read_timeout="{{ .NetworkServer.Gateway.Backend.BasicStation.ReadTimeout }}"
+
+    # Write timeout.
+    write_timeout="{{ .NetworkServer.Gateway.Backend.BasicStation.WriteTimeout }}"
+
+    # Region.
+    #
+    # The Basics Station region name. When left blank, this is derived from
+    # the configured band (e.g. EU868 => EU863, US915 => US902).
+    region="{{ .NetworkServer.Gateway.Backend.BasicStation.Region }}"
+
+    # Minimal and maximum frequency (Hz) allowed for transmissions.
+    frequency_min={{ .NetworkServer.Gateway.Backend.BasicStation.FrequencyMin }}
+    frequency_max={{ .NetworkServer.Gateway.Backend.BasicStation.FrequencyMax }}
+
+
+  # Metrics aggregation settings.
+  [metrics.redis]
+  # Aggregation intervals.
+  #
+  # The intervals (MINUTE, HOUR, DAY, MONTH) in which metrics (e.g. the
+  # gateway radio metrics) are aggregated in Redis.
+  aggregation_intervals=[{{ range $index, $elm := .Metrics.Redis.AggregationIntervals }}{{ if $index }}, {{ end }}"{{ $elm }}"{{ end }}]
+
+  # Aggregation TTLs.
+  #
+  # These define how long the aggregated metrics are kept per interval.
+  minute_aggregation_ttl="{{ .Metrics.Redis.MinuteAggregationTTL }}"
+  hour_aggregation_ttl="{{ .Metrics.Redis.HourAggregationTTL }}"
+  day_aggregation_ttl="{{ .Metrics.Redis.DayAggregationTTL }}"
+  month_aggregation_ttl="{{ .Metrics.Redis.MonthAggregationTTL }}"
+
+
   # Monitoring settings.
   #
   # Note that this replaces the metrics configuration. If a metrics section is
@@ -836,6 +1259,18 @@ resolve_domain_suffix="{{ .JoinServer.ResolveDomainSuffix }}"
   # #
   # # Set this to enable client-certificate authentication with the join-server.
   # tls_key="/path/to/tls_key.pem"
+
+  # # Inbound Authorization header (optional).
+  # #
+  # # When set, requests sent by the join-server to the roaming API (e.g.
+  # # the async HomeNSAns) must contain this Authorization header value.
+  # inbound_authorization=""
+
+  # # Inbound rate-limit (optional).
+  # #
+  # # The max. number of requests per second accepted from the join-server.
+  # # Set to 0 to disable.
+  # inbound_rate_limit=0
   {{ range $index, $element := .JoinServer.Servers }}
   [[join_server.servers]]
   server="{{ $element.Server }}"
@@ -845,6 +1280,8 @@ resolve_domain_suffix="{{ .JoinServer.ResolveDomainSuffix }}"
   ca_cert="{{ $element.CACert }}"
   tls_cert="{{ $element.TLSCert }}"
   tls_key="{{ $element.TLSKey }}"
+  inbound_authorization="{{ $element.InboundAuthorization }}"
+  inbound_rate_limit={{ $element.InboundRateLimit }}
   {{ end }}
 
   # Default join-server settings.
@@ -872,6 +1309,14 @@ resolve_domain_suffix="{{ .JoinServer.ResolveDomainSuffix }}"
   # tls key used by the default join-server client (optional)
   tls_key="{{ .JoinServer.Default.TLSKey }}"
 
+  # Authorization header value which must be sent by the default join-server
+  # when making requests to the roaming API (optional).
+  inbound_authorization="{{ .JoinServer.Default.InboundAuthorization }}"
+
+  # Max. number of requests per second accepted from the default join-server
+  # by the roaming API (0 = disabled).
+  inbound_rate_limit={{ .JoinServer.Default.InboundRateLimit }}
+
 
   # Join-server KEK set.
   #
@@ -917,6 +1362,16 @@ resolve_domain_suffix="{{ .JoinServer.ResolveDomainSuffix }}"
 # using its NetID.
 resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
 
+# Roaming agreements reload interval.
+#
+# Roaming agreements can be managed using the API, in which case these are
+# stored in the database. This defines the interval at which each Network
+# Server instance checks if the roaming agreements have been changed by one
+# of the other instances. A roaming agreement stored in the database takes
+# precedence over the roaming agreement (with the same NetID) configured in
+# this file. Set this to 0 to disable reloading.
+agreements_reload_interval="{{ .Roaming.AgreementsReloadInterval }}"
+
   # Roaming API settings.
   [roaming.api]
   # Interface to bind the API to (ip:port).
@@ -936,6 +1391,14 @@ resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
   # TLS key (optional).
   tls_key="{{ .Roaming.API.TLSKey }}"
 
+  # Require authentication.
+  #
+  # When enabled, requests from roaming partners for which no inbound
+  # credentials (inbound_authorization and / or inbound_client_cert_subject)
+  # are configured are rejected. This includes the partners handled by the
+  # default roaming server. Requests sent by a Join Server are not affected.
+  require_authentication={{ .Roaming.API.RequireAuthentication }}
+
   # Per roaming-agreement server configuration.
   #
   # Example:
@@ -963,6 +1426,45 @@ resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
   # # are exchanged.
   # passive_roaming_kek_label=""
   #
+  # # Allow handover-roaming.
+  # #
+  # # When enabled, the MAC-layer control of the devices of the roaming partner
+  # # is taken over by this Network Server (sNS) when these devices join
+  # # through the gateways of this Network Server and the roaming partner
+  # # (hNS) returns Handover as roaming activation type. Application payloads
+  # # are forwarded to the hNS. As hNS, the MAC-layer control of the devices
+  # # of which the service-profile allows handover-roaming is handed over to
+  # # the roaming partner.
+  # handover_roaming=false
+  #
+  # # Handover-roaming session lifetime.
+  # #
+  # # As hNS, this defines the lifetime of the session which is handed over to
+  # # the sNS. As sNS, this caps the lifetime returned by the hNS. When set to
+  # # 0s, the lifetime is not limited.
+  # handover_roaming_lifetime="24h"
+  #
+  # # Handover-roaming KEK label (optional).
+  # #
+  # # When set, the session-keys will be encrypted using the given KEK when these
+  # # are handed over to the sNS.
+  # handover_roaming_kek_label=""
+  #
+  # # Profile disclosure.
+  # #
+  # # This defines which device-profile fields are disclosed to the roaming
+  # # partner when it requests the profile of a device using a ProfileReq.
+  # # When empty, ProfileReq requests from this partner are rejected.
+  # # Valid options are:
+  # #   * mac:     MAC version, regional parameters revision, RF region,
+  # #              join and 32bit frame-counter support
+  # #   * class_b: Class-B support and ping-slot settings
+  # #   * class_c: Class-C support and timeout
+  # #   * rx:      RX1 / RX2 settings (from the active device-session)
+  # #   * radio:   factory-preset frequencies, max. EIRP and max. duty-cycle
+  # #   * all:     all of the above
+  # profile_disclosure=["mac", "rx"]
+  #
   # # Server (optional).
   # #
   # # When set, this will bypass the DNS resolving of the Network Server.
@@ -981,6 +1483,31 @@ resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
   #
   # TLS key for client certificate (optional).
   # tls_key=""
+  #
+  # # Authorization header (optional).
+  # #
+  # # When set, this value is used as Authorization header for the requests
+  # # made to the roaming partner.
+  # authorization=""
+  #
+  # # Inbound Authorization header (optional).
+  # #
+  # # When set, requests from this roaming partner must contain this exact
+  # # Authorization header value (e.g. "Bearer secret-token").
+  # inbound_authorization=""
+  #
+  # # Inbound client-certificate subject (optional).
+  # #
+  # # When set, requests from this roaming partner must be made using a
+  # # client-certificate with this subject (e.g. "CN=010203,O=Example").
+  # # This requires the roaming API to be configured with a ca_cert.
+  # inbound_client_cert_subject=""
+  #
+  # # Inbound rate limit (optional).
+  # #
+  # # The max. number of requests per second accepted from this roaming
+  # # partner. When set to 0, requests are not rate-limited.
+  # inbound_rate_limit=0
   {{ range $index, $element := .Roaming.Servers }}
   [[roaming.servers]]
   net_id="{{ $element.NetIDString }}"
@@ -989,11 +1516,18 @@ resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
   passive_roaming={{ $element.PassiveRoaming }}
   passive_roaming_lifetime="{{ $element.PassiveRoamingLifetime }}"
   passive_roaming_kek_label="{{ $element.PassiveRoamingKEKLabel }}"
+  handover_roaming={{ $element.HandoverRoaming }}
+  handover_roaming_lifetime="{{ $element.HandoverRoamingLifetime }}"
+  handover_roaming_kek_label="{{ $element.HandoverRoamingKEKLabel }}"
+  profile_disclosure=[{{ range $i, $e := $element.ProfileDisclosure }}{{ if $i }}, {{ end }}"{{ $e }}"{{ end }}]
   server="{{ $element.Server }}"
   ca_cert="{{ $element.CACert }}"
   tls_cert="{{ $element.TLSCert }}"
   tls_key="{{ $element.TLSKey }}"
   authorization="{{ $element.Authorization }}"
+  inbound_authorization="{{ $element.InboundAuthorization }}"
+  inbound_client_cert_subject="{{ $element.InboundClientCertSubject }}"
+  inbound_rate_limit={{ $element.InboundRateLimit }}
   {{ end }}
 
   # Default roaming server.
@@ -1001,7 +1535,8 @@ resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
   # When this is configured and non of the configured servers are matching the
   # NetID, then the default roaming server will be used. The same configuration
   # parameters apply as to each roaming server, except that no NetID needs to
-  # be set.
+  # be set and that no inbound credentials can be set. The inbound_rate_limit
+  # applies to each roaming partner individually.
   [roaming.default]
   enabled={{ .Roaming.Default.Enabled }}
   server="{{ .Roaming.Default.Server }}"
@@ -1010,10 +1545,15 @@ resolve_netid_domain_suffix="{{ .Roaming.ResolveNetIDDomainSuffix }}"
   passive_roaming={{ .Roaming.Default.PassiveRoaming }}
   passive_roaming_lifetime="{{ .Roaming.Default.PassiveRoamingLifetime }}"
   passive_roaming_kek_label="{{ .Roaming.Default.PassiveRoamingKEKLabel }}"
+  handover_roaming={{ .Roaming.Default.HandoverRoaming }}
+  handover_roaming_lifetime="{{ .Roaming.Default.HandoverRoamingLifetime }}"
+  handover_roaming_kek_label="{{ .Roaming.Default.HandoverRoamingKEKLabel }}"
+  profile_disclosure=[{{ range $index, $element := .Roaming.Default.ProfileDisclosure }}{{ if $index }}, {{ end }}"{{ $element }}"{{ end }}]
   ca_cert="{{ .Roaming.Default.CACert }}"
   tls_cert="{{ .Roaming.Default.TLSCert }}"
   tls_key="{{ .Roaming.Default.TLSKey }}"
   authorization="{{ .Roaming.Default.Authorization }}"
+  inbound_rate_limit={{ .Roaming.Default.InboundRateLimit }}
 
   # Roaming KEK set.
   #
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+var exportRoamingCDRFlags struct {
+	netID    string
+	role     string
+	interval string
+	start    string
+	end      string
+	format   string
+}
+
+var exportRoamingCDRCmd = &cobra.Command{
+	Use:     "export-roaming-cdr",
+	Short:   "Export the aggregated roaming usage records (CDRs) as CSV or JSON",
+	Example: `chirpstack-network-server export-roaming-cdr --net-id 000013 --interval DAY --start 2022-01-01T00:00:00Z --end 2022-02-01T00:00:00Z --format csv`,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := exportRoamingCDRFlags
+
+		if err := storage.Setup(config.C); err != nil {
+			log.Fatal(err)
+		}
+
+		filters := storage.RoamingCDRFilters{
+			Role:        storage.RoamingRole(strings.ToUpper(flags.role)),
+			Aggregation: storage.AggregationInterval(strings.ToUpper(flags.interval)),
+			End:         time.Now(),
+		}
+		filters.Start = filters.End.Add(-24 * time.Hour)
+
+		switch filters.Role {
+		case "", storage.RoamingRoleFNS, storage.RoamingRoleHNS:
+		default:
+			log.Fatalf("invalid role: %s", flags.role)
+		}
+
+		if flags.netID != "" {
+			var netID lorawan.NetID
+			if err := netID.UnmarshalText([]byte(flags.netID)); err != nil {
+				log.WithError(err).Fatal("decode NetID error")
+			}
+			filters.NetID = &netID
+		}
+
+		if flags.start != "" {
+			t, err := time.Parse(time.RFC3339, flags.start)
+			if err != nil {
+				log.WithError(err).Fatal("parse start error")
+			}
+			filters.Start = t
+		}
+
+		if flags.end != "" {
+			t, err := time.Parse(time.RFC3339, flags.end)
+			if err != nil {
+				log.WithError(err).Fatal("parse end error")
+			}
+			filters.End = t
+		}
+
+		cdrs, err := storage.GetRoamingCDRs(context.Background(), storage.DB(), filters)
+		if err != nil {
+			log.WithError(err).Fatal("get roaming cdrs error")
+		}
+
+		if err := roaming.ExportCDRs(os.Stdout, strings.ToLower(flags.format), cdrs); err != nil {
+			log.WithError(err).Fatal("export roaming cdrs error")
+		}
+	},
+}
+
+func init() {
+	exportRoamingCDRCmd.Flags().StringVar(&exportRoamingCDRFlags.netID, "net-id", "", "NetID of the roaming partner (default all)")
+	exportRoamingCDRCmd.Flags().StringVar(&exportRoamingCDRFlags.role, "role", "", "role of this Network Server, FNS or HNS (default all)")
+	exportRoamingCDRCmd.Flags().StringVar(&exportRoamingCDRFlags.interval, "interval", "HOUR", "aggregation interval, HOUR or DAY")
+	exportRoamingCDRCmd.Flags().StringVar(&exportRoamingCDRFlags.start, "start", "", "start timestamp (RFC3339, default 24 hours ago)")
+	exportRoamingCDRCmd.Flags().StringVar(&exportRoamingCDRFlags.end, "end", "", "end timestamp (RFC3339, default now)")
+	exportRoamingCDRCmd.Flags().StringVar(&exportRoamingCDRFlags.format, "format", roaming.CDRFormatCSV, "export format, csv or json")
+}
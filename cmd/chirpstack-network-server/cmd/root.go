@@ -63,6 +63,7 @@ func init() {
 	viper.SetDefault("network_server.gateway.stats.create_gateway_on_stats", true)
 	viper.SetDefault("network_server.gateway.downlink_timeout", time.Second)
 	viper.SetDefault("network_server.gateway.backend.multi_downlink_feature", "hybrid")
+	viper.SetDefault("network_server.gateway.backend.route_ttl", time.Hour)
 	viper.SetDefault("network_server.gateway.backend.mqtt.server", "tcp://localhost:1883")
 	viper.SetDefault("network_server.gateway.backend.mqtt.max_reconnect_interval", time.Minute)
 
@@ -76,14 +77,35 @@ func init() {
 	viper.SetDefault("network_server.network_settings.downlink_tx_power", -1)
 	viper.SetDefault("network_server.network_settings.disable_adr", false)
 	viper.SetDefault("network_server.network_settings.max_mac_command_error_count", 3)
+	viper.SetDefault("network_server.network_settings.duty_cycle.window", time.Hour)
 
 	viper.SetDefault("network_server.gateway.backend.type", "mqtt")
 
 	viper.SetDefault("network_server.scheduler.scheduler_interval", 1*time.Second)
 	viper.SetDefault("network_server.scheduler.class_c.device_downlink_lock_duration", 2*time.Second)
 	viper.SetDefault("network_server.scheduler.class_c.multicast_gateway_delay", 2*time.Second)
+	viper.SetDefault("network_server.uplink.worker_count", 100)
+	viper.SetDefault("network_server.uplink.queue_size", 10000)
+	viper.SetDefault("network_server.uplink.overload_policy", "drop_oldest")
+	viper.SetDefault("network_server.geolocation.resolver", "local")
+	viper.SetDefault("network_server.geolocation.min_gateway_count", 3)
 
 	viper.SetDefault("network_server.gateway.client_cert_lifetime", time.Hour*24*365)
+	viper.SetDefault("network_server.gateway.presence.offline_multiplier", 3)
+	viper.SetDefault("network_server.gateway.presence.default_stats_interval", time.Second*30)
+	viper.SetDefault("network_server.gateway.presence.check_interval", time.Second*10)
+	viper.SetDefault("network_server.gateway.presence.exclude_offline", true)
+	viper.SetDefault("network_server.gateway.presence.event_sink.type", "log")
+	viper.SetDefault("network_server.gateway.presence.event_sink.http.timeout", time.Second*5)
+	viper.SetDefault("network_server.gateway.downlink_fallback.enabled", true)
+	viper.SetDefault("network_server.gateway.downlink_fallback.margin", time.Millisecond*300)
+	viper.SetDefault("network_server.gateway.downlink_fallback.max_attempts", 2)
+	viper.SetDefault("network_server.gateway.downlink_fallback.blacklist.error_count", 5)
+	viper.SetDefault("network_server.gateway.downlink_fallback.blacklist.error_window", time.Minute)
+	viper.SetDefault("network_server.gateway.downlink_fallback.blacklist.duration", time.Minute*5)
+	viper.SetDefault("network_server.gateway.radio_metrics.enabled", true)
+	viper.SetDefault("network_server.gateway.config_push.retry_interval", time.Minute)
+	viper.SetDefault("network_server.gateway.config_push.max_attempts", 5)
 	viper.SetDefault("network_server.gateway.backend.mqtt.event_topic", "gateway/+/event/+")
 	viper.SetDefault("network_server.gateway.backend.mqtt.command_topic_template", "gateway/{{ .GatewayID }}/command/{{ .CommandType }}")
 	viper.SetDefault("network_server.gateway.backend.mqtt.clean_session", true)
@@ -97,8 +119,22 @@ func init() {
 	viper.SetDefault("join_server.default.server", "http://localhost:8003")
 
 	viper.SetDefault("roaming.resolve_netid_domain_suffix", ".netids.lora-alliance.org")
+	viper.SetDefault("roaming.agreements_reload_interval", time.Second*10)
 
 	viper.SetDefault("network_server.gateway.backend.gcp_pub_sub.uplink_retention_duration", time.Hour*24)
+	viper.SetDefault("network_server.gateway.backend.kafka.brokers", []string{"localhost:9092"})
+	viper.SetDefault("network_server.gateway.backend.kafka.consumer_group", "chirpstack-network-server")
+	viper.SetDefault("network_server.gateway.backend.kafka.commit_interval", time.Second)
+	viper.SetDefault("network_server.gateway.backend.kafka.event_topic_template", "gateway.event.{{ .EventType }}")
+	viper.SetDefault("network_server.gateway.backend.kafka.command_topic_template", "gateway.command.{{ .CommandType }}")
+	viper.SetDefault("network_server.gateway.backend.semtech_udp.udp_bind", "0.0.0.0:1700")
+	viper.SetDefault("network_server.gateway.backend.basic_station.bind", ":3001")
+	viper.SetDefault("network_server.gateway.backend.basic_station.stats_interval", time.Second*30)
+	viper.SetDefault("network_server.gateway.backend.basic_station.ping_interval", time.Minute)
+	viper.SetDefault("network_server.gateway.backend.basic_station.read_timeout", time.Minute+(5*time.Second))
+	viper.SetDefault("network_server.gateway.backend.basic_station.write_timeout", time.Second)
+	viper.SetDefault("network_server.gateway.backend.basic_station.frequency_min", 863000000)
+	viper.SetDefault("network_server.gateway.backend.basic_station.frequency_max", 870000000)
 
 	viper.SetDefault("metrics.timezone", "Local")
 	viper.SetDefault("metrics.redis.aggregation_intervals", []string{"MINUTE", "HOUR", "DAY", "MONTH"})
@@ -112,6 +148,7 @@ func init() {
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(printDSCmd)
+	rootCmd.AddCommand(exportRoamingCDRCmd)
 }
 
 // Execute executes the root command.
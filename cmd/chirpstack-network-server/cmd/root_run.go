@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
@@ -27,13 +28,19 @@ import (
 	gwbackend "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/amqp"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/azureiothub"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/basicstation"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/gcppubsub"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/kafka"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/mqtt"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/multi"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/semtechudp"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/joinserver"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/channels"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/presence"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/monitoring"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -75,9 +82,11 @@ func run(cmd *cobra.Command, args []string) error {
 		setupDownlink,
 		setupNetworkServerAPI,
 		setupRoaming,
+		setupGatewayPresence,
 		setupGateways,
 		startLoRaServer(server),
 		startQueueScheduler,
+		startDeviceChannelsJobCheck,
 	}
 
 	for _, t := range tasks {
@@ -98,6 +107,9 @@ func run(cmd *cobra.Command, args []string) error {
 		if err := gateway.Stop(); err != nil {
 			log.Fatal(err)
 		}
+		if err := roaming.FlushUsage(context.Background()); err != nil {
+			log.WithError(err).Error("flush roaming usage error")
+		}
 		exitChan <- struct{}{}
 	}()
 	select {
@@ -208,24 +220,32 @@ func setupADR() error {
 }
 
 func setGatewayBackend() error {
-	var err error
-	var gw gwbackend.Gateway
+	conf := config.C.NetworkServer.Gateway.Backend
 
-	switch config.C.NetworkServer.Gateway.Backend.Type {
-	case "mqtt":
-		gw, err = mqtt.NewBackend(
-			config.C,
-		)
-	case "amqp":
-		gw, err = amqp.NewBackend(config.C)
-	case "gcp_pub_sub":
-		gw, err = gcppubsub.NewBackend(config.C)
-	case "azure_iot_hub":
-		gw, err = azureiothub.NewBackend(config.C)
-	default:
-		return fmt.Errorf("unexpected gateway backend type: %s", config.C.NetworkServer.Gateway.Backend.Type)
+	if len(conf.Types) == 0 {
+		gw, err := newGatewayBackend(conf.Type)
+		if err != nil {
+			return errors.Wrap(err, "gateway-backend setup failed")
+		}
+
+		gwbackend.SetBackend(gw)
+		return nil
 	}
 
+	backends := make(map[string]gwbackend.Gateway)
+	for _, t := range conf.Types {
+		if _, ok := backends[t]; ok {
+			return fmt.Errorf("duplicate gateway backend type: %s", t)
+		}
+
+		gw, err := newGatewayBackend(t)
+		if err != nil {
+			return errors.Wrapf(err, "gateway-backend %s setup failed", t)
+		}
+		backends[t] = gw
+	}
+
+	gw, err := multi.NewBackend(backends, conf.Routes, conf.RouteTTL)
 	if err != nil {
 		return errors.Wrap(err, "gateway-backend setup failed")
 	}
@@ -234,6 +254,29 @@ func setGatewayBackend() error {
 	return nil
 }
 
+func newGatewayBackend(t string) (gwbackend.Gateway, error) {
+	switch t {
+	case "mqtt":
+		return mqtt.NewBackend(
+			config.C,
+		)
+	case "amqp":
+		return amqp.NewBackend(config.C)
+	case "gcp_pub_sub":
+		return gcppubsub.NewBackend(config.C)
+	case "azure_iot_hub":
+		return azureiothub.NewBackend(config.C)
+	case "kafka":
+		return kafka.NewBackend(config.C)
+	case "semtech_udp":
+		return semtechudp.NewBackend(config.C)
+	case "basic_station":
+		return basicstation.NewBackend(config.C)
+	default:
+		return nil, fmt.Errorf("unexpected gateway backend type: %s", t)
+	}
+}
+
 func setupApplicationServer() error {
 	if err := applicationserver.Setup(); err != nil {
 		return errors.Wrap(err, "application-server setup error")
@@ -310,6 +353,18 @@ func setupRoaming() error {
 		return errors.Wrap(err, "setup roaming error")
 	}
 
+	if err := roaming.LoadAgreements(context.Background()); err != nil {
+		return errors.Wrap(err, "load roaming agreements error")
+	}
+
+	if config.C.Roaming.AgreementsReloadInterval > 0 {
+		log.Info("starting roaming agreements reload loop")
+		go roaming.AgreementsReloadLoop()
+	}
+
+	log.Info("starting roaming usage flush loop")
+	go roaming.UsageFlushLoop()
+
 	return nil
 }
 
@@ -320,6 +375,17 @@ func startLoRaServer(server *uplink.Server) func() error {
 	}
 }
 
+func setupGatewayPresence() error {
+	if err := presence.Setup(config.C); err != nil {
+		return errors.Wrap(err, "setup gateway presence error")
+	}
+
+	log.Info("starting gateway presence check loop")
+	go presence.CheckLoop()
+
+	return nil
+}
+
 func setupGateways() error {
 	if err := gateway.Setup(config.C); err != nil {
 		return errors.Wrap(err, "setup gateway error")
@@ -337,6 +403,13 @@ func startQueueScheduler() error {
 	return nil
 }
 
+func startDeviceChannelsJobCheck() error {
+	log.Info("starting device-channels stale job check loop")
+	go channels.StaleJobsLoop()
+
+	return nil
+}
+
 func mustGetTransportCredentials(tlsCert, tlsKey, caCert string, verifyClientCert bool) credentials.TransportCredentials {
 	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
 	if err != nil {
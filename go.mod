@@ -15,6 +15,7 @@ require (
 	github.com/golang/protobuf v1.5.2
 	github.com/goreleaser/goreleaser v0.106.0
 	github.com/goreleaser/nfpm v0.11.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/grpc-ecosystem/go-grpc-middleware v1.0.0
 	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0
 	github.com/hashicorp/go-plugin v1.4.0
@@ -24,6 +25,7 @@ require (
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.14.0
+	github.com/segmentio/kafka-go v0.4.29
 	github.com/sirupsen/logrus v1.7.0
 	github.com/smartystreets/goconvey v0.0.0-20190330032615-68dc04aab96a
 	github.com/spf13/cobra v0.0.5
@@ -39,6 +41,17 @@ require (
 	pack.ag/amqp v0.12.1
 )
 
+// The following parts of the network-server API (package ns) are not part of
+// a published chirpstack-api version yet, therefore the API must be checked
+// out next to this repository:
+//   - device channels: DeviceExtraChannel, DeviceChannelsStatus (including
+//     NewChannelAnsStatus and LinkADRAnsStatus), the Get/Delete/BulkSet
+//     device channels and device channels job RPCs
+//   - channel plans: ChannelPlan and the Create/Get/Update/Delete RPCs
+//   - roaming: RoamingAgreement, the roaming agreement RPCs and
+//     ExportRoamingCDRs
+//   - gateways: GatewayState, GatewayConfigStatus and ListGatewayStates
+// Replace this by a require of the published version once it has been tagged.
 replace github.com/kamicuu/chirpstack-api/go/v3 v3.0.0-20230711205638-77ccbd7d9f90 => ../chirpstack-api/go
 
 require (
@@ -70,7 +83,6 @@ require (
 	github.com/google/go-querystring v1.0.0 // indirect
 	github.com/googleapis/gax-go/v2 v2.0.5 // indirect
 	github.com/gopherjs/gopherjs v0.0.0-20190430165422-3e4dfb77656c // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/grpc-ecosystem/grpc-gateway v1.11.3 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-hclog v0.14.1 // indirect
@@ -84,6 +96,7 @@ require (
 	github.com/jstemmer/go-junit-report v0.9.1 // indirect
 	github.com/jtolds/gls v4.20.0+incompatible // indirect
 	github.com/kamilsk/retry/v4 v4.0.0 // indirect
+	github.com/klauspost/compress v1.14.2 // indirect
 	github.com/magiconair/properties v1.8.0 // indirect
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mattn/go-isatty v0.0.10 // indirect
@@ -93,6 +106,7 @@ require (
 	github.com/mitchellh/go-testing-interface v0.0.0-20171004221916-a61a99592b77 // indirect
 	github.com/oklog/run v1.0.0 // indirect
 	github.com/pelletier/go-toml v1.2.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.14 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/prometheus/client_model v0.3.0 // indirect
 	github.com/prometheus/common v0.37.0 // indirect
@@ -1,11 +1,16 @@
 package adr
 
 import (
+	"math"
+
 	loraband "github.com/brocaar/lorawan/band"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/adr"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
 )
 
+// maxNbTrans defines the max. number of transmissions of an uplink.
+const maxNbTrans = 3
+
 // DefaultHandler implements the default ADR handler.
 type DefaultHandler struct{}
 
@@ -61,14 +66,26 @@ func (h *DefaultHandler) Handle(req adr.HandleRequest) (adr.HandleResponse, erro
 		resp.DR = maxDR
 	}
 
-	// Set the new NbTrans.
-	resp.NbTrans = h.getNbTrans(req.NbTrans, h.getPacketLossPercentage(req))
+	// Set the new NbTrans. When the service-profile defines a target PER,
+	// the NbTrans is derived from the measured packet-loss and the target PER.
+	if req.TargetPER > 0 {
+		resp.NbTrans = h.getNbTransForTargetPER(req)
+	} else {
+		resp.NbTrans = h.getNbTrans(req.NbTrans, h.getPacketLossPercentage(req))
+	}
 
 	// Calculate the number of 'steps'.
 	snrM := h.getMaxSNR(req)
 	snrMargin := snrM - req.RequiredSNRForDR - req.InstallationMargin
 	nStep := int(snrMargin / 3)
 
+	// Increasing the DR or decreasing the TxPower reduces the range of the
+	// device and thus the number of receiving gateways. Do not do this when
+	// the gateway diversity is at (or below) the configured minimum.
+	if nStep > 0 && req.MinGWDiversity > 0 && h.getMinGatewayCount(req) <= req.MinGWDiversity {
+		nStep = 0
+	}
+
 	// In case of negative steps the ADR algorithm will increase the TxPower
 	// if possible. To avoid up / down / up / down TxPower changes, wait until
 	// we have at least the required number of uplink history elements.
@@ -100,6 +117,22 @@ func (h *DefaultHandler) getMaxSNR(req adr.HandleRequest) float32 {
 	return snrM
 }
 
+// getMinGatewayCount returns the min. number of receiving gateways over the
+// uplink history.
+func (h *DefaultHandler) getMinGatewayCount(req adr.HandleRequest) int {
+	if len(req.UplinkHistory) == 0 {
+		return 0
+	}
+
+	minCount := req.UplinkHistory[0].GatewayCount
+	for _, uh := range req.UplinkHistory {
+		if uh.GatewayCount < minCount {
+			minCount = uh.GatewayCount
+		}
+	}
+	return minCount
+}
+
 // getHistoryCount returns the history count with equal TxPowerIndex.
 func (h *DefaultHandler) getHistoryCount(req adr.HandleRequest) int {
 	var count int
@@ -160,6 +193,41 @@ func (h *DefaultHandler) getNbTrans(currentNbTrans int, pktLossRate float32) int
 	return h.pktLossRateTable()[3][currentNbTrans-1]
 }
 
+// getNbTransForTargetPER returns the NbTrans needed to keep the packet-error
+// rate below the target PER. The measured packet-loss is the loss after
+// NbTrans transmissions, thus the per-transmission error rate is derived
+// from it first. The NbTrans is increased directly to the required value,
+// but decreased by one step at the time to avoid oscillation.
+func (h *DefaultHandler) getNbTransForTargetPER(req adr.HandleRequest) int {
+	currentNbTrans := req.NbTrans
+	if currentNbTrans < 1 {
+		currentNbTrans = 1
+	}
+	if currentNbTrans > maxNbTrans {
+		currentNbTrans = maxNbTrans
+	}
+
+	// Wait until we have enough history to measure the packet-loss.
+	if len(req.UplinkHistory) < h.requiredHistoryCount() {
+		return currentNbTrans
+	}
+
+	pktLoss := float64(h.getPacketLossPercentage(req)) / 100
+	targetPER := float64(req.TargetPER) / 100
+	singlePER := math.Pow(pktLoss, 1/float64(currentNbTrans))
+
+	nbTrans := 1
+	for nbTrans < maxNbTrans && math.Pow(singlePER, float64(nbTrans)) > targetPER {
+		nbTrans++
+	}
+
+	if nbTrans < currentNbTrans {
+		return currentNbTrans - 1
+	}
+
+	return nbTrans
+}
+
 func (h *DefaultHandler) getPacketLossPercentage(req adr.HandleRequest) float32 {
 	if len(req.UplinkHistory) < h.requiredHistoryCount() {
 		return 0
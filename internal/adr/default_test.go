@@ -67,6 +67,76 @@ func TestDefaultHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("getNbTransForTargetPER", func(t *testing.T) {
+		// uplinkHistory returns 20 uplinks of which lost uplinks are missing
+		uplinkHistory := func(lost int) []adr.UplinkMetaData {
+			var out []adr.UplinkMetaData
+			for i := uint32(0); len(out) < 20; i++ {
+				if i > 0 && int(i) <= lost {
+					continue
+				}
+				out = append(out, adr.UplinkMetaData{FCnt: i})
+			}
+			return out
+		}
+
+		tests := []struct {
+			name            string
+			currentNbTrans  int
+			targetPER       int
+			uplinkHistory   []adr.UplinkMetaData
+			expectedNbTrans int
+		}{
+			{
+				name:            "history not complete",
+				currentNbTrans:  2,
+				targetPER:       1,
+				uplinkHistory:   uplinkHistory(0)[:10],
+				expectedNbTrans: 2,
+			},
+			{
+				name:            "below target",
+				currentNbTrans:  1,
+				targetPER:       10,
+				uplinkHistory:   uplinkHistory(1),
+				expectedNbTrans: 1,
+			},
+			{
+				name:            "above target, increase",
+				currentNbTrans:  1,
+				targetPER:       5,
+				uplinkHistory:   uplinkHistory(4),
+				expectedNbTrans: 2,
+			},
+			{
+				name:            "above target, increase to max",
+				currentNbTrans:  1,
+				targetPER:       1,
+				uplinkHistory:   uplinkHistory(10),
+				expectedNbTrans: 3,
+			},
+			{
+				name:            "no packet-loss, decrease one step",
+				currentNbTrans:  3,
+				targetPER:       1,
+				uplinkHistory:   uplinkHistory(0),
+				expectedNbTrans: 2,
+			},
+		}
+
+		for _, tst := range tests {
+			t.Run(tst.name, func(t *testing.T) {
+				assert := require.New(t)
+				req := adr.HandleRequest{
+					NbTrans:       tst.currentNbTrans,
+					TargetPER:     tst.targetPER,
+					UplinkHistory: tst.uplinkHistory,
+				}
+				assert.Equal(tst.expectedNbTrans, h.getNbTransForTargetPER(req))
+			})
+		}
+	})
+
 	t.Run("getIdealTxPowerIndexAndDR", func(t *testing.T) {
 		tests := []struct {
 			name                 string
@@ -274,6 +344,58 @@ func TestDefaultHandler(t *testing.T) {
 					NbTrans:      1,
 				},
 			},
+			{
+				name: "increase dr, min gateway diversity exceeded",
+				request: adr.HandleRequest{
+					ADR:              true,
+					DR:               0,
+					TxPowerIndex:     0,
+					NbTrans:          1,
+					MaxDR:            5,
+					MaxTxPowerIndex:  5,
+					RequiredSNRForDR: -20,
+					MinGWDiversity:   2,
+					UplinkHistory: []adr.UplinkMetaData{
+						{
+							MaxSNR:       -15,
+							GatewayCount: 3,
+						},
+					},
+				},
+				response: adr.HandleResponse{
+					DR:           1,
+					TxPowerIndex: 0,
+					NbTrans:      1,
+				},
+			},
+			{
+				name: "do not increase dr, at min gateway diversity",
+				request: adr.HandleRequest{
+					ADR:              true,
+					DR:               0,
+					TxPowerIndex:     0,
+					NbTrans:          1,
+					MaxDR:            5,
+					MaxTxPowerIndex:  5,
+					RequiredSNRForDR: -20,
+					MinGWDiversity:   2,
+					UplinkHistory: []adr.UplinkMetaData{
+						{
+							MaxSNR:       -15,
+							GatewayCount: 3,
+						},
+						{
+							MaxSNR:       -15,
+							GatewayCount: 2,
+						},
+					},
+				},
+				response: adr.HandleResponse{
+					DR:           0,
+					TxPowerIndex: 0,
+					NbTrans:      1,
+				},
+			},
 		}
 
 		for _, tst := range tests {
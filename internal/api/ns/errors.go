@@ -5,9 +5,11 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/channels"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/data"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/multicast"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/proprietary"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/ratelimit"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
@@ -27,6 +29,11 @@ var errToCode = map[error]codes.Code{
 	storage.ErrInvalidName:                codes.InvalidArgument,
 	storage.ErrInvalidAggregationInterval: codes.InvalidArgument,
 	storage.ErrInvalidFPort:               codes.InvalidArgument,
+	storage.ErrInvalidChannel:             codes.InvalidArgument,
+
+	channels.ErrNoDevicesSelected: codes.InvalidArgument,
+
+	ratelimit.ErrDownlinkRateExceeded: codes.ResourceExhausted,
 }
 
 func errToRPCError(err error) error {
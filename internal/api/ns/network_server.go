@@ -1,7 +1,9 @@
 package ns
 
 import (
+	"bytes"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,16 +18,20 @@ import (
 
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/backend"
+	loraband "github.com/brocaar/lorawan/band"
 	"github.com/kamicuu/chirpstack-api/go/v3/common"
 	"github.com/kamicuu/chirpstack-api/go/v3/ns"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/adr"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/channels"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/multicast"
 	proprietarydown "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/proprietary"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/framelog"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/ratelimit"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
@@ -89,6 +95,12 @@ func (n *NetworkServerAPI) CreateServiceProfile(ctx context.Context, req *ns.Cre
 		sp.DLRatePolicy = storage.Drop
 	}
 
+	if b := req.ServiceProfile.ChannelPlanId; len(b) != 0 {
+		var cpID uuid.UUID
+		copy(cpID[:], b)
+		sp.ChannelPlanID = &cpID
+	}
+
 	if err := storage.CreateServiceProfile(ctx, storage.DB(), &sp); err != nil {
 		return nil, errToRPCError(err)
 	}
@@ -156,6 +168,10 @@ func (n *NetworkServerAPI) GetServiceProfile(ctx context.Context, req *ns.GetSer
 		resp.ServiceProfile.DlRatePolicy = ns.RatePolicy_DROP
 	}
 
+	if sp.ChannelPlanID != nil {
+		resp.ServiceProfile.ChannelPlanId = sp.ChannelPlanID.Bytes()
+	}
+
 	return &resp, nil
 }
 
@@ -206,11 +222,37 @@ func (n *NetworkServerAPI) UpdateServiceProfile(ctx context.Context, req *ns.Upd
 		sp.DLRatePolicy = storage.Drop
 	}
 
+	oldChannelPlanID := sp.ChannelPlanID
+	sp.ChannelPlanID = nil
+	if b := req.ServiceProfile.ChannelPlanId; len(b) != 0 {
+		var cpID uuid.UUID
+		copy(cpID[:], b)
+		sp.ChannelPlanID = &cpID
+	}
+
 	if err := storage.FlushServiceProfileCache(ctx, sp.ID); err != nil {
 		return nil, errToRPCError(err)
 	}
 
-	if err := storage.UpdateServiceProfile(ctx, storage.DB(), &sp); err != nil {
+	var devEUIs []lorawan.EUI64
+	err = storage.Transaction(func(tx sqlx.Ext) error {
+		if err := storage.UpdateServiceProfile(ctx, tx, &sp); err != nil {
+			return err
+		}
+
+		if !uuidPtrEqual(oldChannelPlanID, sp.ChannelPlanID) {
+			var err error
+			devEUIs, err = storage.ApplyChannelPlanForServiceProfile(ctx, tx, sp.ID)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, devEUIs...); err != nil {
 		return nil, errToRPCError(err)
 	}
 
@@ -369,6 +411,12 @@ func (n *NetworkServerAPI) CreateDeviceProfile(ctx context.Context, req *ns.Crea
 		ADRAlgorithmID:     req.DeviceProfile.AdrAlgorithmId,
 	}
 
+	if b := req.DeviceProfile.ChannelPlanId; len(b) != 0 {
+		var cpID uuid.UUID
+		copy(cpID[:], b)
+		dp.ChannelPlanID = &cpID
+	}
+
 	if err := storage.CreateDeviceProfile(ctx, storage.DB(), &dp); err != nil {
 		return nil, errToRPCError(err)
 	}
@@ -419,6 +467,10 @@ func (n *NetworkServerAPI) GetDeviceProfile(ctx context.Context, req *ns.GetDevi
 		},
 	}
 
+	if dp.ChannelPlanID != nil {
+		resp.DeviceProfile.ChannelPlanId = dp.ChannelPlanID.Bytes()
+	}
+
 	resp.CreatedAt, err = ptypes.TimestampProto(dp.CreatedAt)
 	if err != nil {
 		return nil, errToRPCError(err)
@@ -468,11 +520,37 @@ func (n *NetworkServerAPI) UpdateDeviceProfile(ctx context.Context, req *ns.Upda
 	dp.RFRegion = band.Band().Name()
 	dp.ADRAlgorithmID = req.DeviceProfile.AdrAlgorithmId
 
+	oldChannelPlanID := dp.ChannelPlanID
+	dp.ChannelPlanID = nil
+	if b := req.DeviceProfile.ChannelPlanId; len(b) != 0 {
+		var cpID uuid.UUID
+		copy(cpID[:], b)
+		dp.ChannelPlanID = &cpID
+	}
+
 	if err := storage.FlushDeviceProfileCache(ctx, dp.ID); err != nil {
 		return nil, errToRPCError(err)
 	}
 
-	if err := storage.UpdateDeviceProfile(ctx, storage.DB(), &dp); err != nil {
+	var devEUIs []lorawan.EUI64
+	err = storage.Transaction(func(tx sqlx.Ext) error {
+		if err := storage.UpdateDeviceProfile(ctx, tx, &dp); err != nil {
+			return err
+		}
+
+		if !uuidPtrEqual(oldChannelPlanID, dp.ChannelPlanID) {
+			var err error
+			devEUIs, err = storage.ApplyChannelPlanForDeviceProfile(ctx, tx, dp.ID)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, devEUIs...); err != nil {
 		return nil, errToRPCError(err)
 	}
 
@@ -579,6 +657,8 @@ func (n *NetworkServerAPI) UpdateDevice(ctx context.Context, req *ns.UpdateDevic
 		return nil, errToRPCError(err)
 	}
 
+	profilesChanged := d.DeviceProfileID != dpID || d.ServiceProfileID != spID
+
 	d.DeviceProfileID = dpID
 	d.ServiceProfileID = spID
 	d.RoutingProfileID = rpID
@@ -591,6 +671,14 @@ func (n *NetworkServerAPI) UpdateDevice(ctx context.Context, req *ns.UpdateDevic
 			return err
 		}
 
+		// The new device-profile or service-profile might use a different
+		// channel-plan.
+		if profilesChanged {
+			if err := storage.ApplyChannelPlanForDevice(ctx, tx, devEUI); err != nil {
+				return err
+			}
+		}
+
 		// if there is a device-session, set the is disabled field
 		ds, err := storage.GetDeviceSession(ctx, devEUI)
 		if err == nil {
@@ -606,6 +694,12 @@ func (n *NetworkServerAPI) UpdateDevice(ctx context.Context, req *ns.UpdateDevic
 		return nil, errToRPCError(err)
 	}
 
+	if profilesChanged {
+		if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, devEUI); err != nil {
+			return nil, errToRPCError(err)
+		}
+	}
+
 	return &empty.Empty{}, nil
 }
 
@@ -629,6 +723,14 @@ func (n *NetworkServerAPI) DeleteDevice(ctx context.Context, req *ns.DeleteDevic
 		return nil, err
 	}
 
+	if err := roaming.StopPassiveRoaming(ctx, devEUI); err != nil {
+		log.WithError(err).WithField("dev_eui", devEUI).Error("api/ns: stop passive-roaming sessions error")
+	}
+
+	if err := roaming.StopHandoverRoamingHNS(ctx, devEUI); err != nil {
+		log.WithError(err).WithField("dev_eui", devEUI).Error("api/ns: stop handover-roaming session error")
+	}
+
 	return &empty.Empty{}, nil
 }
 
@@ -722,6 +824,14 @@ func (n *NetworkServerAPI) DeactivateDevice(ctx context.Context, req *ns.Deactiv
 		return nil, errToRPCError(err)
 	}
 
+	if err := roaming.StopPassiveRoaming(ctx, devEUI); err != nil {
+		log.WithError(err).WithField("dev_eui", devEUI).Error("api/ns: stop passive-roaming sessions error")
+	}
+
+	if err := roaming.StopHandoverRoamingHNS(ctx, devEUI); err != nil {
+		log.WithError(err).WithField("dev_eui", devEUI).Error("api/ns: stop handover-roaming session error")
+	}
+
 	return &empty.Empty{}, nil
 }
 
@@ -747,6 +857,9 @@ func (n *NetworkServerAPI) GetDeviceActivation(ctx context.Context, req *ns.GetD
 			AFCntDown:     ds.AFCntDown,
 			SkipFCntCheck: ds.SkipFCntValidation,
 		},
+		PacketErrorRate:  float32(ds.GetPacketLossPercentage()),
+		NbTrans:          uint32(ds.NbTrans),
+		GatewayDiversity: float32(ds.GetGatewayDiversity()),
 	}, nil
 }
 
@@ -917,8 +1030,25 @@ func (n *NetworkServerAPI) GetGateway(ctx context.Context, req *ns.GetGatewayReq
 		resp.FirstSeenAt, _ = ptypes.TimestampProto(*gw.FirstSeenAt)
 	}
 
-	if gw.LastSeenAt != nil {
-		resp.LastSeenAt, _ = ptypes.TimestampProto(*gw.LastSeenAt)
+	// The presence is stored in Redis, an error must not fail the request
+	// as the gateway itself has been retrieved.
+	p, err := storage.GetGatewayPresence(ctx, id)
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", id).Error("api/ns: get gateway presence error")
+	} else {
+		resp.State = gatewayStateToPB(p.State)
+
+		if lastSeenAt := gatewayLastSeenAt(gw, p); lastSeenAt != nil {
+			resp.LastSeenAt, _ = ptypes.TimestampProto(*lastSeenAt)
+		}
+	}
+
+	cs, err := storage.GetGatewayConfigState(ctx, id)
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", id).Error("api/ns: get gateway configuration state error")
+	} else {
+		resp.ConfigStatus = gatewayConfigStatusToPB(cs.Status)
+		resp.ConfigVersion = cs.AppliedVersion
 	}
 
 	for i := range gw.Boards {
@@ -937,6 +1067,49 @@ func (n *NetworkServerAPI) GetGateway(ctx context.Context, req *ns.GetGatewayReq
 	return &resp, nil
 }
 
+// ListGatewayStates returns the online / offline state of the gateways.
+func (n *NetworkServerAPI) ListGatewayStates(ctx context.Context, req *ns.ListGatewayStatesRequest) (*ns.ListGatewayStatesResponse, error) {
+	count, err := storage.GetGatewayCount(ctx, storage.DB())
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	gws, err := storage.GetGateways(ctx, storage.DB(), int(req.Limit), int(req.Offset))
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	var ids []lorawan.EUI64
+	for _, gw := range gws {
+		ids = append(ids, gw.GatewayID)
+	}
+
+	items, err := storage.GetGatewaysPresence(ctx, ids)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out := ns.ListGatewayStatesResponse{
+		TotalCount: uint32(count),
+	}
+
+	for _, gw := range gws {
+		p := items[gw.GatewayID]
+		item := ns.GatewayStateItem{
+			GatewayId: gw.GatewayID[:],
+			State:     gatewayStateToPB(p.State),
+		}
+
+		if lastSeenAt := gatewayLastSeenAt(gw, p); lastSeenAt != nil {
+			item.LastSeenAt, _ = ptypes.TimestampProto(*lastSeenAt)
+		}
+
+		out.Result = append(out.Result, &item)
+	}
+
+	return &out, nil
+}
+
 // UpdateGateway updates an existing gateway.
 func (n *NetworkServerAPI) UpdateGateway(ctx context.Context, req *ns.UpdateGatewayRequest) (*empty.Empty, error) {
 	if req.Gateway == nil {
@@ -1094,6 +1267,8 @@ func (n *NetworkServerAPI) GetGatewayStats(ctx context.Context, req *ns.GetGatew
 			TxPacketsEmitted:    int32(m.Metrics["tx_ok_count"]),
 		}
 
+		setGatewayRadioStats(&row, m.Metrics)
+
 		row.Timestamp, err = ptypes.TimestampProto(m.Time)
 		if err != nil {
 			return nil, errToRPCError(err)
@@ -1105,6 +1280,44 @@ func (n *NetworkServerAPI) GetGatewayStats(ctx context.Context, req *ns.GetGatew
 	return &resp, nil
 }
 
+// setGatewayRadioStats sets the per frequency, data-rate and tx status
+// counters of the given gateway stats row.
+func setGatewayRadioStats(row *ns.GatewayStats, metrics map[string]float64) {
+	row.RxPacketsPerFrequency = make(map[uint32]uint32)
+	row.TxPacketsPerFrequency = make(map[uint32]uint32)
+	row.RxPacketsPerDr = make(map[uint32]uint32)
+	row.TxPacketsPerDr = make(map[uint32]uint32)
+	row.TxPacketsPerStatus = make(map[string]uint32)
+
+	for k, v := range metrics {
+		var out map[uint32]uint32
+		var prefix string
+
+		switch {
+		case strings.HasPrefix(k, storage.MetricsRXPerFrequencyPrefix):
+			out, prefix = row.RxPacketsPerFrequency, storage.MetricsRXPerFrequencyPrefix
+		case strings.HasPrefix(k, storage.MetricsTXPerFrequencyPrefix):
+			out, prefix = row.TxPacketsPerFrequency, storage.MetricsTXPerFrequencyPrefix
+		case strings.HasPrefix(k, storage.MetricsRXPerDRPrefix):
+			out, prefix = row.RxPacketsPerDr, storage.MetricsRXPerDRPrefix
+		case strings.HasPrefix(k, storage.MetricsTXPerDRPrefix):
+			out, prefix = row.TxPacketsPerDr, storage.MetricsTXPerDRPrefix
+		case strings.HasPrefix(k, storage.MetricsTXPerStatusPrefix):
+			row.TxPacketsPerStatus[strings.TrimPrefix(k, storage.MetricsTXPerStatusPrefix)] = uint32(v)
+			continue
+		default:
+			continue
+		}
+
+		i, err := strconv.ParseUint(strings.TrimPrefix(k, prefix), 10, 32)
+		if err != nil {
+			log.WithError(err).WithField("key", k).Warning("api/ns: parse gateway metrics key error")
+			continue
+		}
+		out[uint32(i)] = uint32(v)
+	}
+}
+
 // StreamFrameLogsForGateway returns a stream of frames seen by the given gateway.
 func (n *NetworkServerAPI) StreamFrameLogsForGateway(req *ns.StreamFrameLogsForGatewayRequest, srv ns.NetworkServerService_StreamFrameLogsForGatewayServer) error {
 	frameLogChan := make(chan framelog.FrameLog)
@@ -1394,6 +1607,15 @@ func (n *NetworkServerAPI) CreateDeviceQueueItem(ctx context.Context, req *ns.Cr
 		return nil, grpc.Errorf(codes.InvalidArgument, "device security-context out of sync")
 	}
 
+	sp, err := storage.GetAndCacheServiceProfile(ctx, storage.DB(), d.ServiceProfileID)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := ratelimit.CheckDownlinkEnqueue(ctx, sp, d.DevEUI); err != nil {
+		return nil, errToRPCError(err)
+	}
+
 	qi := storage.DeviceQueueItem{
 		DevAddr:    devAddr,
 		DevEUI:     d.DevEUI,
@@ -1802,49 +2024,657 @@ func (n *NetworkServerAPI) ClearDeviceNonces(ctx context.Context, req *ns.ClearD
 	return &empty.Empty{}, nil
 }
 
+// GetDeviceChannels returns the enabled channels and the per-device extra
+// channels of the given device.
 func (n *NetworkServerAPI) GetDeviceChannels(ctx context.Context, req *ns.GetDeviceChannelsRequest) (*ns.GetDeviceChannelsResponse, error) {
 	var devEUI lorawan.EUI64
 	copy(devEUI[:], req.DevEui)
 
-	channels, err := storage.GetAvailableChannels(ctx, storage.DB(), devEUI)
+	ec, err := storage.GetDeviceExtraConfigurations(ctx, storage.DB(), devEUI)
 	if err != nil {
 		return nil, errToRPCError(err)
 	}
 
 	return &ns.GetDeviceChannelsResponse{
-		DevEui:   devEUI[:],
-		Channels: channels,
+		DevEui:        devEUI[:],
+		Channels:      ec.EnabledChannels,
+		ExtraChannels: deviceExtraChannelsToPB(ec.ExtraChannels),
+		Override:      ec.ChannelsOverride,
 	}, nil
 }
 
+// SetDeviceChannels sets the enabled channels and the per-device extra
+// channels of the given device. The per-device extra channels are configured
+// using the NewChannelReq mac-command on the next downlink opportunity.
 func (n *NetworkServerAPI) SetDeviceChannels(ctx context.Context, req *ns.SetDeviceChannelsRequest) (*ns.SetDeviceChannelsResponse, error) {
 	var devEUI lorawan.EUI64
 	copy(devEUI[:], req.DevEui)
 
-	tErr := storage.Transaction(func(tx sqlx.Ext) error {
-		if err := storage.SetAvailableChannels(ctx, tx, devEUI, req.Channels); err != nil {
-			return errToRPCError(err)
+	extraChannels := deviceExtraChannelsFromPB(req.ExtraChannels)
+
+	var ec storage.DeviceExtraConfigurations
+	err := storage.Transaction(func(tx sqlx.Ext) error {
+		var err error
+		ec, err = storage.GetDeviceExtraConfigurations(ctx, tx, devEUI)
+		if err != nil {
+			return err
 		}
-		return nil
+
+		if err := ec.SetChannels(req.Channels, extraChannels); err != nil {
+			return err
+		}
+		ec.ChannelsOverride = true
+		ec.ChannelsStatus.SetPending()
+
+		return storage.UpdateDeviceExtraConfigurations(ctx, tx, ec)
 	})
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := storage.SetDeviceExtraConfigurationsCache(ctx, ec); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &ns.SetDeviceChannelsResponse{
+		DevEui:        devEUI[:],
+		Channels:      ec.EnabledChannels,
+		ExtraChannels: deviceExtraChannelsToPB(ec.ExtraChannels),
+		Override:      ec.ChannelsOverride,
+	}, nil
+}
+
+// GetDeviceChannelsStatus returns the status of the channel reconfiguration
+// of the given device.
+func (n *NetworkServerAPI) GetDeviceChannelsStatus(ctx context.Context, req *ns.GetDeviceChannelsStatusRequest) (*ns.GetDeviceChannelsStatusResponse, error) {
+	var devEUI lorawan.EUI64
+	copy(devEUI[:], req.DevEui)
+
+	ec, err := storage.GetDeviceExtraConfigurations(ctx, storage.DB(), devEUI)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
 
-	if tErr != nil {
-		return nil, tErr
+	status, err := framelog.CreateDeviceChannelsStatus(ec.ChannelsStatus)
+	if err != nil {
+		return nil, errToRPCError(err)
 	}
 
-	config, err := storage.GetDeviceExtraConfigurations(ctx, storage.DB(), devEUI)
+	return &ns.GetDeviceChannelsStatusResponse{
+		DevEui:        devEUI[:],
+		Channels:      ec.EnabledChannels,
+		ExtraChannels: deviceExtraChannelsToPB(ec.ExtraChannels),
+		Status:        status,
+	}, nil
+}
+
+// DeleteDeviceChannels removes the channels configured for the given device.
+// The device falls back to the channel-plan of its device-profile or
+// service-profile, or to the default channels.
+func (n *NetworkServerAPI) DeleteDeviceChannels(ctx context.Context, req *ns.DeleteDeviceChannelsRequest) (*empty.Empty, error) {
+	var devEUI lorawan.EUI64
+	copy(devEUI[:], req.DevEui)
+
+	err := storage.Transaction(func(tx sqlx.Ext) error {
+		ec, err := storage.GetDeviceExtraConfigurations(ctx, tx, devEUI)
+		if err != nil {
+			return err
+		}
+
+		ec.ChannelsOverride = false
+		if err := storage.UpdateDeviceExtraConfigurations(ctx, tx, ec); err != nil {
+			return err
+		}
+
+		return storage.ApplyChannelPlanForDevice(ctx, tx, devEUI)
+	})
 	if err != nil {
 		return nil, errToRPCError(err)
 	}
 
-	cErr := storage.SetDeviceExtraConfigurationsCache(ctx, config)
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, devEUI); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &empty.Empty{}, nil
+}
 
-	if cErr != nil {
-		return nil, tErr
+// CreateChannelPlan creates the given channel-plan.
+func (n *NetworkServerAPI) CreateChannelPlan(ctx context.Context, req *ns.CreateChannelPlanRequest) (*ns.CreateChannelPlanResponse, error) {
+	if req.ChannelPlan == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "channel_plan must not be nil")
 	}
 
-	return &ns.SetDeviceChannelsResponse{
-		DevEui:   devEUI[:],
-		Channels: config.EnabledChannels,
+	var cpID uuid.UUID
+	copy(cpID[:], req.ChannelPlan.Id)
+
+	cp := storage.ChannelPlan{
+		ID:   cpID,
+		Name: req.ChannelPlan.Name,
+	}
+
+	if err := cp.SetChannels(req.ChannelPlan.Channels, deviceExtraChannelsFromPB(req.ChannelPlan.ExtraChannels)); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	err := storage.Transaction(func(tx sqlx.Ext) error {
+		return storage.CreateChannelPlan(ctx, tx, &cp)
+	})
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &ns.CreateChannelPlanResponse{Id: cp.ID.Bytes()}, nil
+}
+
+// GetChannelPlan returns the channel-plan matching the given id.
+func (n *NetworkServerAPI) GetChannelPlan(ctx context.Context, req *ns.GetChannelPlanRequest) (*ns.GetChannelPlanResponse, error) {
+	var cpID uuid.UUID
+	copy(cpID[:], req.Id)
+
+	cp, err := storage.GetChannelPlan(ctx, storage.DB(), cpID)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out := ns.GetChannelPlanResponse{
+		ChannelPlan: &ns.ChannelPlan{
+			Id:            cp.ID.Bytes(),
+			Name:          cp.Name,
+			Channels:      cp.EnabledChannels,
+			ExtraChannels: deviceExtraChannelsToPB(cp.ExtraChannels),
+		},
+	}
+
+	out.CreatedAt, err = ptypes.TimestampProto(cp.CreatedAt)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out.UpdatedAt, err = ptypes.TimestampProto(cp.UpdatedAt)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &out, nil
+}
+
+// UpdateChannelPlan updates the given channel-plan. The updated channels are
+// applied to all the devices using this channel-plan.
+func (n *NetworkServerAPI) UpdateChannelPlan(ctx context.Context, req *ns.UpdateChannelPlanRequest) (*empty.Empty, error) {
+	if req.ChannelPlan == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "channel_plan must not be nil")
+	}
+
+	var cpID uuid.UUID
+	copy(cpID[:], req.ChannelPlan.Id)
+
+	var devEUIs []lorawan.EUI64
+	err := storage.Transaction(func(tx sqlx.Ext) error {
+		cp, err := storage.GetChannelPlan(ctx, tx, cpID)
+		if err != nil {
+			return err
+		}
+
+		cp.Name = req.ChannelPlan.Name
+		if err := cp.SetChannels(req.ChannelPlan.Channels, deviceExtraChannelsFromPB(req.ChannelPlan.ExtraChannels)); err != nil {
+			return err
+		}
+
+		devEUIs, err = storage.UpdateChannelPlan(ctx, tx, &cp)
+		return err
+	})
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, devEUIs...); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// DeleteChannelPlan deletes the channel-plan matching the given id.
+func (n *NetworkServerAPI) DeleteChannelPlan(ctx context.Context, req *ns.DeleteChannelPlanRequest) (*empty.Empty, error) {
+	var cpID uuid.UUID
+	copy(cpID[:], req.Id)
+
+	var devEUIs []lorawan.EUI64
+	err := storage.Transaction(func(tx sqlx.Ext) error {
+		var err error
+		devEUIs, err = storage.DeleteChannelPlan(ctx, tx, cpID)
+		return err
+	})
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, devEUIs...); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// BulkSetDeviceChannels sets the channels for the given list of devices or
+// the devices matching the given filters. The devices are updated in the
+// background, the returned job ID can be used to poll the progress.
+func (n *NetworkServerAPI) BulkSetDeviceChannels(ctx context.Context, req *ns.BulkSetDeviceChannelsRequest) (*ns.BulkSetDeviceChannelsResponse, error) {
+	bulkReq := channels.BulkSetChannelsRequest{
+		EnabledChannels: req.Channels,
+		ExtraChannels:   deviceExtraChannelsFromPB(req.ExtraChannels),
+	}
+
+	for _, b := range req.DevEuis {
+		var devEUI lorawan.EUI64
+		copy(devEUI[:], b)
+		bulkReq.DevEUIs = append(bulkReq.DevEUIs, devEUI)
+	}
+
+	if len(req.DeviceProfileId) != 0 {
+		var dpID uuid.UUID
+		copy(dpID[:], req.DeviceProfileId)
+		bulkReq.Filters.DeviceProfileID = &dpID
+	}
+
+	if len(req.ServiceProfileId) != 0 {
+		var spID uuid.UUID
+		copy(spID[:], req.ServiceProfileId)
+		bulkReq.Filters.ServiceProfileID = &spID
+	}
+
+	if len(req.DevAddrPrefix) != 0 {
+		if req.DevAddrPrefixLength > 32 {
+			return nil, grpc.Errorf(codes.InvalidArgument, "dev_addr_prefix_length must be <= 32")
+		}
+
+		var prefix storage.DevAddrPrefix
+		copy(prefix.DevAddr[:], req.DevAddrPrefix)
+		prefix.Length = int(req.DevAddrPrefixLength)
+		bulkReq.DevAddrPrefix = &prefix
+	}
+
+	job, err := channels.BulkSetChannels(ctx, bulkReq)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &ns.BulkSetDeviceChannelsResponse{
+		JobId: job.ID.Bytes(),
 	}, nil
 }
+
+// GetDeviceChannelsJob returns the progress and the per-device failures of
+// the given bulk device-channels job.
+func (n *NetworkServerAPI) GetDeviceChannelsJob(ctx context.Context, req *ns.GetDeviceChannelsJobRequest) (*ns.GetDeviceChannelsJobResponse, error) {
+	var jobID uuid.UUID
+	copy(jobID[:], req.JobId)
+
+	job, err := storage.GetDeviceChannelsJob(ctx, storage.DB(), jobID)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = 100
+	}
+
+	jobErrors, err := storage.GetDeviceChannelsJobErrors(ctx, storage.DB(), jobID, limit, int(req.Offset))
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out := ns.GetDeviceChannelsJobResponse{
+		JobId:          job.ID.Bytes(),
+		State:          ns.DeviceChannelsJobState(ns.DeviceChannelsJobState_value[string(job.State)]),
+		DeviceCount:    uint32(job.DeviceCount),
+		ProcessedCount: uint32(job.ProcessedCount),
+		FailedCount:    uint32(job.FailedCount),
+		Error:          job.Error,
+	}
+
+	for _, e := range jobErrors {
+		out.Errors = append(out.Errors, &ns.DeviceChannelsJobError{
+			DevEui: e.DevEUI[:],
+			Error:  e.Error,
+		})
+	}
+
+	out.CreatedAt, err = ptypes.TimestampProto(job.CreatedAt)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out.UpdatedAt, err = ptypes.TimestampProto(job.UpdatedAt)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &out, nil
+}
+
+// CreateRoamingAgreement creates the given roaming agreement. The agreement
+// is reloaded by all Network Server instances.
+func (n *NetworkServerAPI) CreateRoamingAgreement(ctx context.Context, req *ns.CreateRoamingAgreementRequest) (*empty.Empty, error) {
+	if req.RoamingAgreement == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "roaming_agreement must not be nil")
+	}
+
+	ra, err := roamingAgreementFromPB(req.RoamingAgreement)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := roaming.ValidateAgreement(ra); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	if err := storage.CreateRoamingAgreement(ctx, storage.DB(), &ra); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := roaming.NotifyAgreementsChanged(ctx); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// GetRoamingAgreement returns the roaming agreement for the given NetID.
+func (n *NetworkServerAPI) GetRoamingAgreement(ctx context.Context, req *ns.GetRoamingAgreementRequest) (*ns.GetRoamingAgreementResponse, error) {
+	var netID lorawan.NetID
+	copy(netID[:], req.NetId)
+
+	ra, err := storage.GetRoamingAgreement(ctx, storage.DB(), netID)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out := ns.GetRoamingAgreementResponse{
+		RoamingAgreement: roamingAgreementToPB(ra),
+	}
+
+	out.CreatedAt, err = ptypes.TimestampProto(ra.CreatedAt)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	out.UpdatedAt, err = ptypes.TimestampProto(ra.UpdatedAt)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &out, nil
+}
+
+// UpdateRoamingAgreement updates the given roaming agreement. The agreement
+// is reloaded by all Network Server instances.
+func (n *NetworkServerAPI) UpdateRoamingAgreement(ctx context.Context, req *ns.UpdateRoamingAgreementRequest) (*empty.Empty, error) {
+	if req.RoamingAgreement == nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "roaming_agreement must not be nil")
+	}
+
+	ra, err := roamingAgreementFromPB(req.RoamingAgreement)
+	if err != nil {
+		return nil, err
+	}
+
+	// The secrets are never returned by the API, an empty value means that
+	// the stored value must be kept.
+	current, err := storage.GetRoamingAgreement(ctx, storage.DB(), ra.NetID)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+	if ra.TLSKey == "" {
+		ra.TLSKey = current.TLSKey
+	}
+	if ra.Authorization == "" {
+		ra.Authorization = current.Authorization
+	}
+	if ra.InboundAuthorization == "" {
+		ra.InboundAuthorization = current.InboundAuthorization
+	}
+
+	if err := roaming.ValidateAgreement(ra); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%s", err)
+	}
+
+	if err := storage.UpdateRoamingAgreement(ctx, storage.DB(), &ra); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := roaming.NotifyAgreementsChanged(ctx); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// DeleteRoamingAgreement deletes the roaming agreement for the given NetID.
+// The agreement is reloaded by all Network Server instances.
+func (n *NetworkServerAPI) DeleteRoamingAgreement(ctx context.Context, req *ns.DeleteRoamingAgreementRequest) (*empty.Empty, error) {
+	var netID lorawan.NetID
+	copy(netID[:], req.NetId)
+
+	if err := storage.DeleteRoamingAgreement(ctx, storage.DB(), netID); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	if err := roaming.NotifyAgreementsChanged(ctx); err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	return &empty.Empty{}, nil
+}
+
+// ListRoamingAgreements returns all the roaming agreements stored in the
+// database.
+func (n *NetworkServerAPI) ListRoamingAgreements(ctx context.Context, req *empty.Empty) (*ns.ListRoamingAgreementsResponse, error) {
+	items, err := storage.GetRoamingAgreements(ctx, storage.DB())
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	var out ns.ListRoamingAgreementsResponse
+	for _, ra := range items {
+		out.RoamingAgreements = append(out.RoamingAgreements, roamingAgreementToPB(ra))
+	}
+
+	return &out, nil
+}
+
+// ExportRoamingCDRs exports the aggregated roaming usage records (CDRs)
+// matching the given filters as CSV or JSON.
+func (n *NetworkServerAPI) ExportRoamingCDRs(ctx context.Context, req *ns.ExportRoamingCDRsRequest) (*ns.ExportRoamingCDRsResponse, error) {
+	filters := storage.RoamingCDRFilters{
+		Role:        storage.RoamingRole(req.Role),
+		Aggregation: storage.AggregationInterval(req.Interval.String()),
+	}
+
+	switch filters.Role {
+	case "", storage.RoamingRoleFNS, storage.RoamingRoleHNS:
+	default:
+		return nil, grpc.Errorf(codes.InvalidArgument, "invalid role: %s", req.Role)
+	}
+
+	if len(req.NetId) != 0 {
+		var netID lorawan.NetID
+		copy(netID[:], req.NetId)
+		filters.NetID = &netID
+	}
+
+	var err error
+	filters.Start, err = ptypes.Timestamp(req.StartTimestamp)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
+	}
+
+	filters.End, err = ptypes.Timestamp(req.EndTimestamp)
+	if err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, err.Error())
+	}
+
+	cdrs, err := storage.GetRoamingCDRs(ctx, storage.DB(), filters)
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	var resp ns.ExportRoamingCDRsResponse
+	var buf bytes.Buffer
+
+	switch req.Format {
+	case ns.RoamingCDRFormat_JSON:
+		resp.ContentType = "application/json"
+		err = roaming.ExportCDRs(&buf, roaming.CDRFormatJSON, cdrs)
+	default:
+		resp.ContentType = "text/csv"
+		err = roaming.ExportCDRs(&buf, roaming.CDRFormatCSV, cdrs)
+	}
+	if err != nil {
+		return nil, errToRPCError(err)
+	}
+
+	resp.Data = buf.Bytes()
+
+	return &resp, nil
+}
+
+func deviceExtraChannelsFromPB(channels []*ns.DeviceExtraChannel) []loraband.Channel {
+	var out []loraband.Channel
+	for _, c := range channels {
+		out = append(out, loraband.Channel{
+			Frequency: c.Frequency,
+			MinDR:     int(c.MinDr),
+			MaxDR:     int(c.MaxDr),
+		})
+	}
+	return out
+}
+
+func deviceExtraChannelsToPB(channels []storage.DeviceExtraChannel) []*ns.DeviceExtraChannel {
+	var out []*ns.DeviceExtraChannel
+	for _, c := range channels {
+		out = append(out, &ns.DeviceExtraChannel{
+			ChannelIndex: uint32(c.ChannelIndex),
+			Frequency:    c.Frequency,
+			MinDr:        uint32(c.MinDR),
+			MaxDr:        uint32(c.MaxDR),
+		})
+	}
+	return out
+}
+
+func roamingAgreementFromPB(pb *ns.RoamingAgreement) (storage.RoamingAgreement, error) {
+	ra := storage.RoamingAgreement{
+		Enabled:                 pb.Enabled,
+		PassiveRoaming:          pb.PassiveRoaming,
+		PassiveRoamingKEKLabel:  pb.PassiveRoamingKekLabel,
+		HandoverRoaming:         pb.HandoverRoaming,
+		HandoverRoamingKEKLabel: pb.HandoverRoamingKekLabel,
+		ProfileDisclosure:       pb.ProfileDisclosure,
+		Server:                  pb.Server,
+		Async:                   pb.Async,
+		CACert:                  pb.CaCert,
+		TLSCert:                 pb.TlsCert,
+		TLSKey:                  pb.TlsKey,
+		Authorization:           pb.Authorization,
+
+		InboundAuthorization:     pb.InboundAuthorization,
+		InboundClientCertSubject: pb.InboundClientCertSubject,
+		InboundRateLimit:         int(pb.InboundRateLimit),
+	}
+	copy(ra.NetID[:], pb.NetId)
+
+	var err error
+	if pb.PassiveRoamingLifetime != nil {
+		ra.PassiveRoamingLifetime, err = ptypes.Duration(pb.PassiveRoamingLifetime)
+		if err != nil {
+			return ra, grpc.Errorf(codes.InvalidArgument, "passive_roaming_lifetime: %s", err)
+		}
+	}
+
+	if pb.HandoverRoamingLifetime != nil {
+		ra.HandoverRoamingLifetime, err = ptypes.Duration(pb.HandoverRoamingLifetime)
+		if err != nil {
+			return ra, grpc.Errorf(codes.InvalidArgument, "handover_roaming_lifetime: %s", err)
+		}
+	}
+
+	if pb.AsyncTimeout != nil {
+		ra.AsyncTimeout, err = ptypes.Duration(pb.AsyncTimeout)
+		if err != nil {
+			return ra, grpc.Errorf(codes.InvalidArgument, "async_timeout: %s", err)
+		}
+	}
+
+	return ra, nil
+}
+
+// roamingAgreementToPB converts the given roaming agreement. The TLS key and
+// the (inbound) authorization are write-only and are never returned.
+func roamingAgreementToPB(ra storage.RoamingAgreement) *ns.RoamingAgreement {
+	return &ns.RoamingAgreement{
+		NetId:                   ra.NetID[:],
+		Enabled:                 ra.Enabled,
+		PassiveRoaming:          ra.PassiveRoaming,
+		PassiveRoamingLifetime:  ptypes.DurationProto(ra.PassiveRoamingLifetime),
+		PassiveRoamingKekLabel:  ra.PassiveRoamingKEKLabel,
+		HandoverRoaming:         ra.HandoverRoaming,
+		HandoverRoamingLifetime: ptypes.DurationProto(ra.HandoverRoamingLifetime),
+		HandoverRoamingKekLabel: ra.HandoverRoamingKEKLabel,
+		ProfileDisclosure:       ra.ProfileDisclosure,
+		Server:                  ra.Server,
+		Async:                   ra.Async,
+		AsyncTimeout:            ptypes.DurationProto(ra.AsyncTimeout),
+		CaCert:                  ra.CACert,
+		TlsCert:                 ra.TLSCert,
+
+		InboundClientCertSubject: ra.InboundClientCertSubject,
+		InboundRateLimit:         uint32(ra.InboundRateLimit),
+	}
+}
+
+func gatewayStateToPB(s storage.GatewayState) ns.GatewayState {
+	switch s {
+	case storage.GatewayStateOnline:
+		return ns.GatewayState_ONLINE
+	case storage.GatewayStateOffline:
+		return ns.GatewayState_OFFLINE
+	default:
+		return ns.GatewayState_UNKNOWN
+	}
+}
+
+func gatewayConfigStatusToPB(s storage.GatewayConfigStatus) ns.GatewayConfigStatus {
+	switch s {
+	case storage.GatewayConfigStatusNotSupported:
+		return ns.GatewayConfigStatus_NOT_SUPPORTED
+	case storage.GatewayConfigStatusPending:
+		return ns.GatewayConfigStatus_PENDING
+	case storage.GatewayConfigStatusApplied:
+		return ns.GatewayConfigStatus_APPLIED
+	case storage.GatewayConfigStatusFailed:
+		return ns.GatewayConfigStatus_FAILED
+	default:
+		return ns.GatewayConfigStatus_UNKNOWN_CONFIG_STATUS
+	}
+}
+
+// gatewayLastSeenAt returns the most recent last-seen timestamp. The
+// last-seen of the gateway is only updated on stats, the presence last-seen
+// is also updated on uplinks and downlink acknowledgements.
+func gatewayLastSeenAt(gw storage.Gateway, p storage.GatewayPresence) *time.Time {
+	if p.LastSeenAt != nil && (gw.LastSeenAt == nil || p.LastSeenAt.After(*gw.LastSeenAt)) {
+		return p.LastSeenAt
+	}
+	return gw.LastSeenAt
+}
+
+func uuidPtrEqual(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"google.golang.org/grpc"
@@ -23,6 +24,7 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers/classb"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
 )
@@ -874,6 +876,60 @@ func (ts *NetworkServerAPITestSuite) TestGateway() {
 			assert.NotEqual("", resp.CreatedAt.String())
 			assert.NotEqual("", resp.UpdatedAt.String())
 			assert.Nil(resp.LastSeenAt)
+			assert.Equal(ns.GatewayState_UNKNOWN, resp.State)
+		})
+
+		t.Run("State", func(t *testing.T) {
+			assert := require.New(t)
+			gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+			_, err := storage.SetGatewayLastSeen(context.Background(), gatewayID, time.Now(), time.Minute)
+			assert.NoError(err)
+
+			resp, err := ts.api.GetGateway(context.Background(), &ns.GetGatewayRequest{Id: gatewayID[:]})
+			assert.NoError(err)
+			assert.Equal(ns.GatewayState_ONLINE, resp.State)
+			assert.NotNil(resp.LastSeenAt)
+
+			listResp, err := ts.api.ListGatewayStates(context.Background(), &ns.ListGatewayStatesRequest{
+				Limit: 10,
+			})
+			assert.NoError(err)
+			assert.EqualValues(1, listResp.TotalCount)
+			assert.Len(listResp.Result, 1)
+			assert.Equal(gatewayID[:], listResp.Result[0].GatewayId)
+			assert.Equal(ns.GatewayState_ONLINE, listResp.Result[0].State)
+
+			_, err = storage.PopOfflineGateways(context.Background(), time.Now().Add(time.Minute))
+			assert.NoError(err)
+
+			resp, err = ts.api.GetGateway(context.Background(), &ns.GetGatewayRequest{Id: gatewayID[:]})
+			assert.NoError(err)
+			assert.Equal(ns.GatewayState_OFFLINE, resp.State)
+
+			assert.NoError(storage.DeleteGatewayPresence(context.Background(), gatewayID))
+		})
+
+		t.Run("Config status", func(t *testing.T) {
+			assert := require.New(t)
+			gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+			resp, err := ts.api.GetGateway(context.Background(), &ns.GetGatewayRequest{Id: gatewayID[:]})
+			assert.NoError(err)
+			assert.Equal(ns.GatewayConfigStatus_UNKNOWN_CONFIG_STATUS, resp.ConfigStatus)
+
+			assert.NoError(storage.SaveGatewayConfigState(context.Background(), gatewayID, storage.GatewayConfigState{
+				Status:         storage.GatewayConfigStatusApplied,
+				DesiredVersion: "1",
+				AppliedVersion: "1",
+			}))
+
+			resp, err = ts.api.GetGateway(context.Background(), &ns.GetGatewayRequest{Id: gatewayID[:]})
+			assert.NoError(err)
+			assert.Equal(ns.GatewayConfigStatus_APPLIED, resp.ConfigStatus)
+			assert.Equal("1", resp.ConfigVersion)
+
+			assert.NoError(storage.DeleteGatewayConfigState(context.Background(), gatewayID))
 		})
 
 		t.Run("Update", func(t *testing.T) {
@@ -1110,6 +1166,112 @@ func (ts *NetworkServerAPITestSuite) TestADR() {
 	})
 }
 
+func (ts *NetworkServerAPITestSuite) TestRoamingAgreement() {
+	assert := require.New(ts.T())
+	assert.NoError(roaming.Setup(test.GetConfig()))
+
+	netID := lorawan.NetID{6, 6, 6}
+	ra := ns.RoamingAgreement{
+		NetId:                  netID[:],
+		Enabled:                true,
+		PassiveRoaming:         true,
+		PassiveRoamingLifetime: ptypes.DurationProto(time.Minute),
+		ProfileDisclosure:      []string{"mac"},
+		Server:                 "http://localhost:1234",
+		InboundAuthorization:   "Bearer inbound",
+		InboundRateLimit:       10,
+	}
+
+	ts.T().Run("Create invalid", func(t *testing.T) {
+		assert := require.New(t)
+
+		invalid := proto.Clone(&ra).(*ns.RoamingAgreement)
+		invalid.ProfileDisclosure = []string{"foo"}
+		_, err := ts.api.CreateRoamingAgreement(context.Background(), &ns.CreateRoamingAgreementRequest{
+			RoamingAgreement: invalid,
+		})
+		assert.Equal(codes.InvalidArgument, grpc.Code(err))
+	})
+
+	ts.T().Run("Create", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := ts.api.CreateRoamingAgreement(context.Background(), &ns.CreateRoamingAgreementRequest{
+			RoamingAgreement: &ra,
+		})
+		assert.NoError(err)
+
+		_, err = roaming.GetClientForNetID(netID)
+		assert.NoError(err)
+		assert.Equal(time.Minute, roaming.GetPassiveRoamingLifetime(netID))
+		assert.Equal(10, roaming.GetInboundRateLimit(netID))
+		assert.NoError(roaming.AuthenticateInbound(netID, "Bearer inbound", nil))
+		assert.True(roaming.IsRoamingEnabled())
+	})
+
+	ts.T().Run("Get", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp, err := ts.api.GetRoamingAgreement(context.Background(), &ns.GetRoamingAgreementRequest{
+			NetId: netID[:],
+		})
+		assert.NoError(err)
+		assert.NotNil(resp.CreatedAt)
+		assert.NotNil(resp.UpdatedAt)
+		assert.Equal(ra.Server, resp.RoamingAgreement.Server)
+		assert.Equal(ra.ProfileDisclosure, resp.RoamingAgreement.ProfileDisclosure)
+		assert.Equal("", resp.RoamingAgreement.InboundAuthorization)
+		assert.Equal(ra.InboundRateLimit, resp.RoamingAgreement.InboundRateLimit)
+		assert.True(proto.Equal(ra.PassiveRoamingLifetime, resp.RoamingAgreement.PassiveRoamingLifetime))
+	})
+
+	ts.T().Run("Disable", func(t *testing.T) {
+		assert := require.New(t)
+
+		ra.Enabled = false
+		ra.InboundAuthorization = ""
+		_, err := ts.api.UpdateRoamingAgreement(context.Background(), &ns.UpdateRoamingAgreementRequest{
+			RoamingAgreement: &ra,
+		})
+		assert.NoError(err)
+
+		stored, err := storage.GetRoamingAgreement(context.Background(), storage.DB(), netID)
+		assert.NoError(err)
+		assert.Equal("Bearer inbound", stored.InboundAuthorization)
+
+		_, err = roaming.GetClientForNetID(netID)
+		assert.Equal(roaming.ErrNoAgreement, err)
+		assert.Equal(time.Duration(0), roaming.GetPassiveRoamingLifetime(netID))
+	})
+
+	ts.T().Run("List", func(t *testing.T) {
+		assert := require.New(t)
+
+		resp, err := ts.api.ListRoamingAgreements(context.Background(), &empty.Empty{})
+		assert.NoError(err)
+		assert.Len(resp.RoamingAgreements, 1)
+		assert.False(resp.RoamingAgreements[0].Enabled)
+	})
+
+	ts.T().Run("Delete", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := ts.api.DeleteRoamingAgreement(context.Background(), &ns.DeleteRoamingAgreementRequest{
+			NetId: netID[:],
+		})
+		assert.NoError(err)
+
+		_, err = ts.api.GetRoamingAgreement(context.Background(), &ns.GetRoamingAgreementRequest{
+			NetId: netID[:],
+		})
+		assert.Equal(codes.NotFound, grpc.Code(err))
+
+		_, err = roaming.GetClientForNetID(netID)
+		assert.Equal(roaming.ErrNoAgreement, err)
+		assert.False(roaming.IsRoamingEnabled())
+	})
+}
+
 func TestNetworkServerAPINew(t *testing.T) {
 	suite.Run(t, new(NetworkServerAPITestSuite))
 }
@@ -0,0 +1,17 @@
+package roaming
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "api_roaming_rejected_request_count",
+		Help: "The number of roaming API requests rejected because of authentication or rate limiting (per reason).",
+	}, []string{"reason"})
+)
+
+func rejectedRequestCounter(reason string) prometheus.Counter {
+	return rc.With(prometheus.Labels{"reason": reason})
+}
@@ -7,7 +7,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -28,6 +30,23 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/uplink/join"
 )
 
+// Reasons for rejecting a roaming API request.
+const (
+	rejectCommonNameMismatch = "common_name_mismatch"
+	rejectUnauthenticated    = "unauthenticated"
+	rejectSenderIDMismatch   = "sender_id_mismatch"
+	rejectRateLimited        = "rate_limited"
+	rejectUnexpectedMessage  = "unexpected_message_type"
+)
+
+// joinServerMessageTypes contains the message-types that can be sent by a
+// join-server (SenderID = JoinEUI) to the network-server.
+var joinServerMessageTypes = map[backend.MessageType]struct{}{
+	backend.JoinAns:   {},
+	backend.RejoinAns: {},
+	backend.HomeNSAns: {},
+}
+
 // Setup configures the roaming API.
 func Setup(c config.Config) error {
 	roamingConfig := c.Roaming
@@ -130,12 +149,9 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// validate SenderID
 	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 		if r.TLS.PeerCertificates[0].Subject.CommonName != basePL.SenderID {
-			log.WithFields(log.Fields{
-				"ctx_id":      ctx.Value(logging.ContextIDKey),
-				"sender_id":   basePL.SenderID,
+			a.reject(ctx, w, r, basePL, rejectCommonNameMismatch, http.StatusUnauthorized, log.Fields{
 				"common_name": r.TLS.PeerCertificates[0].Subject.CommonName,
-			}).Error("roaming: SenderID does not match client-certificate CommonName")
-			w.WriteHeader(http.StatusUnauthorized)
+			})
 			return
 		}
 	}
@@ -162,6 +178,11 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var cert *x509.Certificate
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert = r.TLS.PeerCertificates[0]
+	}
+
 	var client backend.Client
 	if len(basePL.SenderID) >= 16 {
 		// Parse Sender ID (NetID).
@@ -175,6 +196,33 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Only accept the messages a join-server can send.
+		if _, ok := joinServerMessageTypes[basePL.MessageType]; !ok {
+			a.reject(ctx, w, r, basePL, rejectUnexpectedMessage, http.StatusBadRequest, nil)
+			return
+		}
+
+		// Authenticate the join-server.
+		if err := joinserver.AuthenticateInbound(senderID, r.Header.Get("Authorization"), cert); err != nil {
+			a.reject(ctx, w, r, basePL, rejectUnauthenticated, http.StatusUnauthorized, nil)
+			return
+		}
+
+		// Rate-limit the join-server.
+		if rate := joinserver.GetInboundRateLimit(senderID); rate > 0 {
+			ok, wait, err := storage.TakeJoinServerRateLimitToken(ctx, senderID, rate, rate)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"ctx_id":    ctx.Value(logging.ContextIDKey),
+					"sender_id": basePL.SenderID,
+				}).WithError(err).Error("api/roaming: take rate-limit token error")
+			} else if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				a.reject(ctx, w, r, basePL, rejectRateLimited, http.StatusTooManyRequests, nil)
+				return
+			}
+		}
+
 		// Get ClientID for Sender ID (JoinEUI)
 		client, err = joinserver.GetClientForJoinEUI(senderID)
 		if err != nil {
@@ -197,6 +245,32 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Authenticate the roaming partner.
+		if err := roaming.AuthenticateInbound(senderID, r.Header.Get("Authorization"), cert); err != nil {
+			reason := rejectUnauthenticated
+			if err == roaming.ErrSenderIDMismatch {
+				reason = rejectSenderIDMismatch
+			}
+			a.reject(ctx, w, r, basePL, reason, http.StatusUnauthorized, nil)
+			return
+		}
+
+		// Rate-limit the roaming partner.
+		if rate := roaming.GetInboundRateLimit(senderID); rate > 0 {
+			ok, wait, err := storage.TakeRoamingRateLimitToken(ctx, senderID, rate, rate)
+			if err != nil {
+				// failing to rate-limit must not block the roaming traffic
+				log.WithFields(log.Fields{
+					"ctx_id":    ctx.Value(logging.ContextIDKey),
+					"sender_id": basePL.SenderID,
+				}).WithError(err).Error("api/roaming: take rate-limit token error")
+			} else if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				a.reject(ctx, w, r, basePL, rejectRateLimited, http.StatusTooManyRequests, nil)
+				return
+			}
+		}
+
 		// Get ClientID for Sender ID (NetID)
 		client, err = roaming.GetClientForNetID(senderID)
 		if err != nil {
@@ -230,6 +304,24 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// reject writes the given status code and audit-logs the rejected request.
+func (a *API) reject(ctx context.Context, w http.ResponseWriter, r *http.Request, basePL backend.BasePayload, reason string, status int, fields log.Fields) {
+	rejectedRequestCounter(reason).Inc()
+
+	log.WithFields(log.Fields{
+		"ctx_id":         ctx.Value(logging.ContextIDKey),
+		"audit":          true,
+		"reason":         reason,
+		"remote_addr":    r.RemoteAddr,
+		"message_type":   basePL.MessageType,
+		"sender_id":      basePL.SenderID,
+		"receiver_id":    basePL.ReceiverID,
+		"transaction_id": basePL.TransactionID,
+	}).WithFields(fields).Warning("api/roaming: roaming api request rejected")
+
+	w.WriteHeader(status)
+}
+
 func (a *API) handleAsync(ctx context.Context, client backend.Client, basePL backend.BasePayload, b []byte) {
 	ans, err := a.handleRequest(ctx, client, basePL, b)
 	if err != nil {
@@ -318,6 +410,14 @@ func (a *API) handleRequest(ctx context.Context, client backend.Client, basePL b
 		ans, err = a.handlePRStopReq(ctx, basePL, b)
 	case backend.PRStopAns:
 		err = a.handlePRStopAns(ctx, client, basePL, b)
+	case backend.HRStartReq:
+		ans, err = a.handleHRStartReq(ctx, basePL, b)
+	case backend.HRStartAns:
+		err = a.handleHRStartAns(ctx, client, basePL, b)
+	case backend.HRStopReq:
+		ans, err = a.handleHRStopReq(ctx, basePL, b)
+	case backend.HRStopAns:
+		err = a.handleHRStopAns(ctx, client, basePL, b)
 	case backend.ProfileReq:
 		ans, err = a.handleProfileReq(ctx, basePL, b)
 	case backend.ProfileAns:
@@ -405,6 +505,11 @@ func (a *API) handlePRStartReqData(ctx context.Context, basePL backend.BasePaylo
 	var nwkSKey *backend.KeyEnvelope
 
 	if lifetime != 0 {
+		// keep track of the fNS, so that the session can be stopped
+		if err := storage.AddPassiveRoamingNetIDForDevEUI(ctx, ds.DevEUI, netID, time.Duration(lifetime)*time.Second); err != nil {
+			return nil, errors.Wrap(err, "add passive-roaming netid error")
+		}
+
 		// sess keys
 		kekLabel := roaming.GetPassiveRoamingKEKLabel(netID)
 		var kekKey []byte
@@ -489,8 +594,188 @@ func (a *API) handlePRStopAns(ctx context.Context, client backend.Client, basePL
 	return nil
 }
 
-func (a *API) handlePRStopReq(ctx context.Context, basePL backend.BasePayload, pl []byte) (backend.Answer, error) {
-	return nil, nil
+// prStopReqPayload extends the backend.PRStopReqPayload with the optional
+// DevAddr, which the hNS can include to identify the session when the fNS
+// does not know the DevEUI of the device.
+type prStopReqPayload struct {
+	backend.PRStopReqPayload
+	DevAddr *lorawan.DevAddr `json:"DevAddr,omitempty"`
+}
+
+func (a *API) handlePRStopReq(ctx context.Context, basePL backend.BasePayload, b []byte) (backend.Answer, error) {
+	var pl prStopReqPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json error")
+	}
+
+	// decode requester netid
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(basePL.SenderID)); err != nil {
+		return nil, errors.Wrap(err, "unmarshal netid error")
+	}
+
+	sessions, err := storage.GetPassiveRoamingDeviceSessionsForDevEUI(ctx, pl.DevEUI)
+	if err != nil {
+		return nil, errors.Wrap(err, "get passive-roaming device-sessions error")
+	}
+
+	// In case no sessions are found by DevEUI, fallback to the DevAddr.
+	// The ULFreq can not be used to narrow down the sessions as it is not
+	// stored as part of the passive-roaming session.
+	if len(sessions) == 0 && pl.DevAddr != nil {
+		devAddrSessions, err := storage.GetPassiveRoamingDeviceSessionsForDevAddr(ctx, *pl.DevAddr)
+		if err != nil {
+			return nil, errors.Wrap(err, "get passive-roaming device-sessions error")
+		}
+
+		for _, ds := range devAddrSessions {
+			// the DevEUI is not known when the session was started by a data uplink
+			if ds.DevEUI == pl.DevEUI || ds.DevEUI == (lorawan.EUI64{}) {
+				sessions = append(sessions, ds)
+			}
+		}
+	}
+
+	var count int
+	for _, ds := range sessions {
+		// only the hNS that started the session is allowed to stop it
+		if ds.NetID != netID {
+			continue
+		}
+		count++
+
+		// In case a lifetime is given, the session is kept for the given
+		// lifetime (in seconds), else it is deleted immediately.
+		if pl.Lifetime != nil && *pl.Lifetime > 0 {
+			ds.Lifetime = time.Now().Add(time.Duration(*pl.Lifetime) * time.Second)
+			if err := storage.SavePassiveRoamingDeviceSession(ctx, &ds); err != nil {
+				return nil, errors.Wrap(err, "save passive-roaming device-session error")
+			}
+		} else {
+			if err := storage.DeletePassiveRoamingDeviceSession(ctx, ds); err != nil {
+				return nil, errors.Wrap(err, "delete passive-roaming device-session error")
+			}
+		}
+	}
+
+	if count == 0 {
+		return backend.PRStopAnsPayload{
+			BasePayloadResult: a.getBasePayloadResult(basePL, backend.UnknownDevEUI, fmt.Sprintf("no passive-roaming session for DevEUI %s", pl.DevEUI)),
+		}, nil
+	}
+
+	return backend.PRStopAnsPayload{
+		BasePayloadResult: a.getBasePayloadResult(basePL, backend.Success, ""),
+	}, nil
+}
+
+func (a *API) handleHRStartAns(ctx context.Context, client backend.Client, basePL backend.BasePayload, b []byte) error {
+	var pl backend.HRStartAnsPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+
+	if err := client.HandleAnswer(ctx, pl); err != nil {
+		return errors.Wrap(err, "handle answer error")
+	}
+
+	return nil
+}
+
+func (a *API) handleHRStartReq(ctx context.Context, basePL backend.BasePayload, b []byte) (backend.Answer, error) {
+	var pl backend.HRStartReqPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json error")
+	}
+
+	// decode requester netid
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(basePL.SenderID)); err != nil {
+		return nil, errors.Wrap(err, "unmarshal netid error")
+	}
+
+	if !roaming.IsHandoverRoamingAllowed(netID) {
+		return backend.HRStartAnsPayload{
+			BasePayloadResult: a.getBasePayloadResult(basePL, backend.NoRoamingAgreement, fmt.Sprintf("handover-roaming is not allowed for NetID %s", netID)),
+		}, nil
+	}
+
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(pl.PHYPayload[:]); err != nil {
+		return nil, errors.Wrap(err, "unmarshal phypayload error")
+	}
+
+	if phy.MHDR.MType != lorawan.JoinRequest {
+		return nil, errors.Wrap(roaming.ErrMalformedRequest, "PHYPayload must be a join-request")
+	}
+
+	rxInfo, err := roaming.ULMetaDataToRXInfo(pl.ULMetaData)
+	if err != nil {
+		return nil, errors.Wrap(err, "ULMetaData to RXInfo error")
+	}
+
+	txInfo, err := roaming.ULMetaDataToTXInfo(pl.ULMetaData)
+	if err != nil {
+		return nil, errors.Wrap(err, "ULMetaData to TXInfo error")
+	}
+
+	rxPacket := models.RXPacket{
+		PHYPayload: phy,
+		TXInfo:     txInfo,
+		RXInfoSet:  rxInfo,
+	}
+	if pl.ULMetaData.DataRate != nil {
+		rxPacket.DR = *pl.ULMetaData.DataRate
+	}
+
+	ans, err := join.HandleStartHRHNS(ctx, pl, rxPacket)
+	if err != nil {
+		return nil, errors.Wrap(err, "handle otaa error")
+	}
+
+	bpl := a.getBasePayloadResult(basePL, backend.Success, "")
+	ans.BasePayload = bpl.BasePayload
+	ans.Result = bpl.Result
+	return ans, nil
+}
+
+func (a *API) handleHRStopAns(ctx context.Context, client backend.Client, basePL backend.BasePayload, b []byte) error {
+	var pl backend.HRStopAnsPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+
+	if err := client.HandleAnswer(ctx, pl); err != nil {
+		return errors.Wrap(err, "handle answer error")
+	}
+
+	return nil
+}
+
+func (a *API) handleHRStopReq(ctx context.Context, basePL backend.BasePayload, b []byte) (backend.Answer, error) {
+	var pl backend.HRStopReqPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json error")
+	}
+
+	// decode requester netid
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(basePL.SenderID)); err != nil {
+		return nil, errors.Wrap(err, "unmarshal netid error")
+	}
+
+	if err := roaming.StopHandoverRoaming(ctx, netID, pl.DevEUI); err != nil {
+		if errors.Is(err, storage.ErrDoesNotExist) {
+			return backend.HRStopAnsPayload{
+				BasePayloadResult: a.getBasePayloadResult(basePL, backend.UnknownDevEUI, fmt.Sprintf("no handover-roaming session for DevEUI %s", pl.DevEUI)),
+			}, nil
+		}
+		return nil, errors.Wrap(err, "stop handover-roaming error")
+	}
+
+	return backend.HRStopAnsPayload{
+		BasePayloadResult: a.getBasePayloadResult(basePL, backend.Success, ""),
+	}, nil
 }
 
 func (a *API) handleProfileAns(ctx context.Context, client backend.Client, basePL backend.BasePayload, b []byte) error {
@@ -506,8 +791,79 @@ func (a *API) handleProfileAns(ctx context.Context, client backend.Client, baseP
 	return nil
 }
 
-func (a *API) handleProfileReq(ctx context.Context, basePL backend.BasePayload, pl []byte) (backend.Answer, error) {
-	return nil, nil
+func (a *API) handleProfileReq(ctx context.Context, basePL backend.BasePayload, b []byte) (backend.Answer, error) {
+	var pl backend.ProfileReqPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return nil, errors.Wrap(err, "unmarshal json error")
+	}
+
+	// decode requester netid
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(basePL.SenderID)); err != nil {
+		return nil, errors.Wrap(err, "unmarshal netid error")
+	}
+
+	d, err := storage.GetDevice(ctx, storage.DB(), pl.DevEUI, false)
+	if err != nil {
+		if errors.Is(err, storage.ErrDoesNotExist) {
+			return backend.ProfileAnsPayload{
+				BasePayloadResult: a.getBasePayloadResult(basePL, backend.UnknownDevEUI, fmt.Sprintf("unknown DevEUI %s", pl.DevEUI)),
+			}, nil
+		}
+		return nil, errors.Wrap(err, "get device error")
+	}
+
+	sp, err := storage.GetServiceProfile(ctx, storage.DB(), d.ServiceProfileID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get service-profile error")
+	}
+
+	// Handover-roaming must be allowed by both the service-profile and the
+	// roaming agreement with the requester.
+	var roamingType backend.RoamingType
+	if sp.HRAllowed && roaming.IsHandoverRoamingAllowed(netID) {
+		roamingType = backend.Handover
+	} else if sp.PRAllowed {
+		roamingType = backend.Passive
+	} else {
+		return backend.ProfileAnsPayload{
+			BasePayloadResult: a.getBasePayloadResult(basePL, backend.DevRoamingDisallowed, "roaming is not allowed for this device"),
+		}, nil
+	}
+
+	dp, err := storage.GetDeviceProfile(ctx, storage.DB(), d.DeviceProfileID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get device-profile error")
+	}
+
+	// the device-session is optional, e.g. the device might not have been
+	// activated yet
+	var dsPtr *storage.DeviceSession
+	ds, err := storage.GetDeviceSession(ctx, pl.DevEUI)
+	if err == nil {
+		dsPtr = &ds
+	} else if !errors.Is(err, storage.ErrDoesNotExist) {
+		return nil, errors.Wrap(err, "get device-session error")
+	}
+
+	devProfile, err := roaming.GetDeviceProfileForNetID(netID, dp, dsPtr)
+	if err != nil {
+		if errors.Is(err, roaming.ErrProfileDisclosureDisabled) {
+			return backend.ProfileAnsPayload{
+				BasePayloadResult: a.getBasePayloadResult(basePL, backend.NoRoamingAgreement, fmt.Sprintf("profile disclosure is not allowed for NetID %s", netID)),
+			}, nil
+		}
+		return nil, errors.Wrap(err, "get device-profile for netid error")
+	}
+
+	dpTimestamp := backend.ISO8601Time(dp.UpdatedAt)
+
+	return backend.ProfileAnsPayload{
+		BasePayloadResult:      a.getBasePayloadResult(basePL, backend.Success, ""),
+		DeviceProfile:          &devProfile,
+		DeviceProfileTimestamp: &dpTimestamp,
+		RoamingActivationType:  &roamingType,
+	}, nil
 }
 
 func (a *API) handleXmitDataAns(ctx context.Context, client backend.Client, basePL backend.BasePayload, b []byte) error {
@@ -542,7 +898,18 @@ func (a *API) handleXmitDataReq(ctx context.Context, basePL backend.BasePayload,
 		return nil, errors.Wrap(err, "unmarshal json error")
 	}
 
-	if len(pl.PHYPayload[:]) != 0 && pl.ULMetaData != nil {
+	if len(pl.FRMPayload[:]) != 0 && pl.ULMetaData != nil {
+		// decode requester netid
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(basePL.SenderID)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal netid error")
+		}
+
+		// Handover Roaming uplink (forwarded by the sNS)
+		if err := updata.HandleHandoverRoamingHNS(ctx, netID, pl.FRMPayload[:], *pl.ULMetaData); err != nil {
+			return nil, errors.Wrap(err, "handle handover-roaming uplink error")
+		}
+	} else if len(pl.PHYPayload[:]) != 0 && pl.ULMetaData != nil {
 		// Passive Roaming uplink
 		if err := updata.HandleRoamingHNS(ctx, pl.PHYPayload[:], pl.BasePayload, *pl.ULMetaData); err != nil {
 			return nil, errors.Wrap(err, "handle passive-roaming uplink error")
@@ -567,6 +934,10 @@ func (a *API) getBasePayloadResult(basePLReq backend.BasePayload, resCode backen
 		mType = backend.PRStartAns
 	case backend.PRStopReq:
 		mType = backend.PRStopAns
+	case backend.HRStartReq:
+		mType = backend.HRStartAns
+	case backend.HRStopReq:
+		mType = backend.HRStopAns
 	case backend.ProfileReq:
 		mType = backend.ProfileAns
 	case backend.XmitDataReq:
@@ -592,6 +963,10 @@ func (a *API) errToResultCode(err error) backend.ResultCode {
 	switch {
 	case errors.Is(err, storage.ErrDoesNotExist):
 		return backend.UnknownDevAddr
+	case errors.Is(err, roaming.ErrNoAgreement):
+		return backend.NoRoamingAgreement
+	case errors.Is(err, roaming.ErrMalformedRequest):
+		return backend.MalformedRequest
 	case errors.Is(err, storage.ErrFrameCounterReset),
 		errors.Is(err, storage.ErrFrameCounterRetransmission),
 		errors.Is(err, storage.ErrInvalidMIC):
@@ -0,0 +1,771 @@
+// Package basicstation implements a gateway backend using the LoRa Basics
+// Station LNS protocol (websocket).
+package basicstation
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/stats"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// downlinkCleanupDuration defines the duration after which a pending
+// downlink is removed when no dntxed was received.
+const downlinkCleanupDuration = time.Minute
+
+// Errors
+var (
+	ErrGatewayNotConnected = errors.New("gateway is not connected")
+)
+
+// connection contains the websocket connection of a gateway and the
+// counters used for generating the gateway stats.
+type connection struct {
+	sync.Mutex
+
+	conn *websocket.Conn
+	ip   string
+
+	rxPacketsReceived   uint32
+	rxPacketsReceivedOK uint32
+	txPacketsReceived   uint32
+	txPacketsEmitted    uint32
+
+	// configVersion holds the version of the last router_config confirmed
+	// by the gateway. It is reported as config version in the gateway stats.
+	configVersion string
+
+	// pendingConfigVersion holds the version of the router_config sent to
+	// the gateway, which has not yet been confirmed.
+	pendingConfigVersion string
+	configPending        bool
+}
+
+// confirmConfigVersion confirms the pending router_config version. The
+// station does not acknowledge the router_config, but it processes the
+// messages in order and closes the connection when it rejects the
+// configuration. Therefore, the configuration is considered applied once
+// the station sends a message after the router_config.
+func (c *connection) confirmConfigVersion(gatewayID lorawan.EUI64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.configPending {
+		return
+	}
+
+	c.configVersion = c.pendingConfigVersion
+	c.configPending = false
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"version":    c.configVersion,
+	}).Info("gateway/basic_station: router_config confirmed")
+}
+
+func (c *connection) setPendingConfigVersion(version string) {
+	c.pendingConfigVersion = version
+	c.configPending = true
+}
+
+// pendingDownlink contains a downlink for which the dntxed is pending.
+type pendingDownlink struct {
+	gatewayID  lorawan.EUI64
+	downlinkID []byte
+	items      int
+	expiresAt  time.Time
+}
+
+// Backend implements a LoRa Basics Station backend.
+type Backend struct {
+	server   *http.Server
+	ln       net.Listener
+	scheme   string
+	upgrader websocket.Upgrader
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	uplinkFrameChan   chan gw.UplinkFrame
+	gatewayStatsChan  chan gw.GatewayStats
+	downlinkTXAckChan chan gw.DownlinkTXAck
+
+	gatewaysMux sync.RWMutex
+	gateways    map[lorawan.EUI64]*connection
+
+	downlinksMux sync.Mutex
+	downlinks    map[int64]pendingDownlink
+
+	region        string
+	frequencyMin  uint32
+	frequencyMax  uint32
+	statsInterval time.Duration
+	pingInterval  time.Duration
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+
+	// getConfiguration returns the gateway configuration for the given gateway.
+	getConfiguration func(context.Context, lorawan.EUI64) (gw.GatewayConfiguration, error)
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(c config.Config) (gateway.Gateway, error) {
+	conf := c.NetworkServer.Gateway.Backend.BasicStation
+
+	b := Backend{
+		scheme:            "ws",
+		done:              make(chan struct{}),
+		uplinkFrameChan:   make(chan gw.UplinkFrame),
+		gatewayStatsChan:  make(chan gw.GatewayStats),
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+		gateways:          make(map[lorawan.EUI64]*connection),
+		downlinks:         make(map[int64]pendingDownlink),
+		region:            conf.Region,
+		frequencyMin:      conf.FrequencyMin,
+		frequencyMax:      conf.FrequencyMax,
+		statsInterval:     conf.StatsInterval,
+		pingInterval:      conf.PingInterval,
+		readTimeout:       conf.ReadTimeout,
+		writeTimeout:      conf.WriteTimeout,
+		getConfiguration:  getConfiguration,
+	}
+
+	if b.region == "" {
+		b.region = getRegion(string(c.NetworkServer.Band.Name))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/router-info", b.handleRouterInfo)
+	mux.HandleFunc("/gateway/", b.handleGateway)
+
+	b.server = &http.Server{
+		Handler: mux,
+	}
+
+	// the gateway client-certificates are signed by the gateway ca
+	caCert := conf.CACert
+	if caCert == "" {
+		caCert = c.NetworkServer.Gateway.CACert
+	}
+
+	var err error
+	b.ln, err = net.Listen("tcp", conf.Bind)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway/basic_station: create listener error")
+	}
+
+	if conf.TLSCert != "" && conf.TLSKey != "" {
+		tlsConfig, err := newTLSConfig(conf.TLSCert, conf.TLSKey, caCert)
+		if err != nil {
+			b.ln.Close()
+			return nil, errors.Wrap(err, "gateway/basic_station: new tls config error")
+		}
+
+		b.scheme = "wss"
+		b.ln = tls.NewListener(b.ln, tlsConfig)
+	}
+
+	log.WithFields(log.Fields{
+		"bind":   conf.Bind,
+		"region": b.region,
+		"tls":    b.scheme == "wss",
+	}).Info("gateway/basic_station: starting websocket listener")
+
+	go func() {
+		if err := b.server.Serve(b.ln); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatal("gateway/basic_station: server error")
+		}
+	}()
+
+	b.wg.Add(1)
+	go b.cleanupLoop()
+
+	return &b, nil
+}
+
+// SendTXPacket sends the given downlink frame to the gateway.
+func (b *Backend) SendTXPacket(pl gw.DownlinkFrame) error {
+	gatewayID := helpers.GetGatewayID(&pl)
+
+	dnmsg, err := downlinkFrameFromDownlinkFrame(pl)
+	if err != nil {
+		return errors.Wrap(err, "get dnmsg error")
+	}
+
+	b.downlinksMux.Lock()
+	b.downlinks[dnmsg.DIID] = pendingDownlink{
+		gatewayID:  gatewayID,
+		downlinkID: pl.DownlinkId,
+		items:      len(pl.Items),
+		expiresAt:  time.Now().Add(downlinkCleanupDuration),
+	}
+	b.downlinksMux.Unlock()
+
+	if err := b.sendToGateway(gatewayID, dnmsg, func(c *connection) { c.txPacketsReceived++ }); err != nil {
+		b.downlinksMux.Lock()
+		delete(b.downlinks, dnmsg.DIID)
+		b.downlinksMux.Unlock()
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": helpers.GetDownlinkID(&pl),
+	}).Info("gateway/basic_station: downlink sent to gateway")
+
+	return nil
+}
+
+// SendGatewayConfigPacket sends the router_config for the given
+// configuration to the gateway.
+func (b *Backend) SendGatewayConfigPacket(pl gw.GatewayConfiguration) error {
+	gatewayID := helpers.GetGatewayID(&pl)
+
+	rc, err := getRouterConfig(b.region, b.frequencyMin, b.frequencyMax, pl.Channels)
+	if err != nil {
+		return errors.Wrap(err, "get router config error")
+	}
+
+	return b.sendToGateway(gatewayID, rc, func(c *connection) {
+		c.setPendingConfigVersion(pl.Version)
+	})
+}
+
+// SupportsGatewayConfiguration returns true when the gateway is connected, as
+// the gateway configuration is sent as router_config.
+func (b *Backend) SupportsGatewayConfiguration(gatewayID lorawan.EUI64) bool {
+	b.gatewaysMux.RLock()
+	defer b.gatewaysMux.RUnlock()
+
+	_, ok := b.gateways[gatewayID]
+	return ok
+}
+
+func (b *Backend) RXPacketChan() chan gw.UplinkFrame {
+	return b.uplinkFrameChan
+}
+
+func (b *Backend) StatsPacketChan() chan gw.GatewayStats {
+	return b.gatewayStatsChan
+}
+
+func (b *Backend) DownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+func (b *Backend) Close() error {
+	log.Info("gateway/basic_station: closing gateway backend")
+
+	close(b.done)
+
+	if err := b.server.Close(); err != nil {
+		return errors.Wrap(err, "close server error")
+	}
+
+	// the hijacked websocket connections are not closed by the server
+	b.gatewaysMux.Lock()
+	for _, c := range b.gateways {
+		c.conn.Close()
+	}
+	b.gatewaysMux.Unlock()
+
+	b.wg.Wait()
+
+	close(b.uplinkFrameChan)
+	close(b.gatewayStatsChan)
+	close(b.downlinkTXAckChan)
+
+	return nil
+}
+
+// handleRouterInfo implements the router-info endpoint, which returns the
+// websocket URI of the data endpoint.
+func (b *Backend) handleRouterInfo(w http.ResponseWriter, r *http.Request) {
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).Error("gateway/basic_station: websocket upgrade error")
+		return
+	}
+	defer conn.Close()
+
+	var req RouterInfoRequest
+	if err := conn.ReadJSON(&req); err != nil {
+		log.WithError(err).Error("gateway/basic_station: read router-info request error")
+		return
+	}
+
+	resp := RouterInfoResponse{
+		Router: req.Router,
+		URI:    fmt.Sprintf("%s://%s/gateway/%s", b.scheme, r.Host, lorawan.EUI64(req.Router)),
+	}
+
+	if err := conn.WriteJSON(resp); err != nil {
+		log.WithError(err).Error("gateway/basic_station: write router-info response error")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": lorawan.EUI64(req.Router),
+		"uri":        resp.URI,
+	}).Info("gateway/basic_station: router-info request handled")
+}
+
+// handleGateway implements the data endpoint of the gateway.
+func (b *Backend) handleGateway(w http.ResponseWriter, r *http.Request) {
+	var gatewayID lorawan.EUI64
+	if err := gatewayID.UnmarshalText([]byte(strings.TrimPrefix(r.URL.Path, "/gateway/"))); err != nil {
+		http.Error(w, "invalid gateway id", http.StatusBadRequest)
+		return
+	}
+
+	// validate that the client-certificate belongs to the gateway
+	if r.TLS != nil && len(r.TLS.PeerCertificates) != 0 {
+		if cn := r.TLS.PeerCertificates[0].Subject.CommonName; cn != gatewayID.String() {
+			log.WithFields(log.Fields{
+				"gateway_id":  gatewayID,
+				"common_name": cn,
+			}).Warning("gateway/basic_station: client-certificate does not match gateway id")
+			http.Error(w, "client-certificate does not match gateway id", http.StatusForbidden)
+			return
+		}
+	}
+
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("gateway/basic_station: websocket upgrade error")
+		return
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	c := &connection{
+		conn: conn,
+		ip:   ip,
+	}
+
+	b.gatewaysMux.Lock()
+	if prev, ok := b.gateways[gatewayID]; ok {
+		prev.conn.Close()
+	}
+	b.gateways[gatewayID] = c
+	b.gatewaysMux.Unlock()
+
+	connectCounter().Inc()
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"remote_addr": r.RemoteAddr,
+	}).Info("gateway/basic_station: gateway connected")
+
+	b.wg.Add(1)
+	defer b.wg.Done()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go b.pingAndStatsLoop(gatewayID, c, done)
+
+	b.readLoop(gatewayID, c)
+
+	b.gatewaysMux.Lock()
+	if b.gateways[gatewayID] == c {
+		delete(b.gateways, gatewayID)
+	}
+	b.gatewaysMux.Unlock()
+
+	conn.Close()
+
+	disconnectCounter().Inc()
+	log.WithField("gateway_id", gatewayID).Info("gateway/basic_station: gateway disconnected")
+}
+
+func (b *Backend) readLoop(gatewayID lorawan.EUI64, c *connection) {
+	c.conn.SetReadDeadline(time.Now().Add(b.readTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(b.readTimeout))
+		return nil
+	})
+
+	for {
+		mt, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-b.done:
+			default:
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					log.WithError(err).WithField("gateway_id", gatewayID).Error("gateway/basic_station: read message error")
+				}
+			}
+			return
+		}
+
+		c.conn.SetReadDeadline(time.Now().Add(b.readTimeout))
+
+		if mt != websocket.TextMessage {
+			continue
+		}
+
+		c.confirmConfigVersion(gatewayID)
+
+		if err := b.handleMessage(gatewayID, c, msg); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"message":    string(msg),
+			}).Error("gateway/basic_station: handle message error")
+		}
+	}
+}
+
+func (b *Backend) pingAndStatsLoop(gatewayID lorawan.EUI64, c *connection, done chan struct{}) {
+	pingTicker := time.NewTicker(b.pingInterval)
+	defer pingTicker.Stop()
+
+	statsTicker := time.NewTicker(b.statsInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-pingTicker.C:
+			c.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(b.writeTimeout))
+			c.Unlock()
+
+			if err != nil {
+				log.WithError(err).WithField("gateway_id", gatewayID).Error("gateway/basic_station: send ping error")
+			}
+		case <-statsTicker.C:
+			if err := b.sendGatewayStats(gatewayID, c); err != nil {
+				log.WithError(err).WithField("gateway_id", gatewayID).Error("gateway/basic_station: send gateway stats error")
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *Backend) handleMessage(gatewayID lorawan.EUI64, c *connection, msg []byte) error {
+	var h messageHeader
+	if err := json.Unmarshal(msg, &h); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+
+	messageCounter(string(h.MessageType)).Inc()
+
+	switch h.MessageType {
+	case VersionMessage:
+		return b.handleVersion(gatewayID, msg)
+	case UplinkDataFrameMessage:
+		var pl UplinkDataFrame
+		if err := json.Unmarshal(msg, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal json error")
+		}
+		frame, err := uplinkFrameFromUplinkDataFrame(gatewayID, pl)
+		if err != nil {
+			return errors.Wrap(err, "get uplink frame error")
+		}
+		b.handleUplinkFrame(c, frame)
+	case JoinRequestMessage:
+		var pl JoinRequest
+		if err := json.Unmarshal(msg, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal json error")
+		}
+		frame, err := uplinkFrameFromJoinRequest(gatewayID, pl)
+		if err != nil {
+			return errors.Wrap(err, "get uplink frame error")
+		}
+		b.handleUplinkFrame(c, frame)
+	case ProprietaryDataFrameMessage:
+		var pl ProprietaryDataFrame
+		if err := json.Unmarshal(msg, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal json error")
+		}
+		frame, err := uplinkFrameFromProprietaryDataFrame(gatewayID, pl)
+		if err != nil {
+			return errors.Wrap(err, "get uplink frame error")
+		}
+		b.handleUplinkFrame(c, frame)
+	case DownlinkTransmittedMessage:
+		var pl DownlinkTransmitted
+		if err := json.Unmarshal(msg, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal json error")
+		}
+		c.Lock()
+		c.txPacketsEmitted++
+		c.Unlock()
+		b.handleDownlinkTransmitted(gatewayID, pl)
+	case TimeSyncMessage:
+		var pl TimeSyncRequest
+		if err := json.Unmarshal(msg, &pl); err != nil {
+			return errors.Wrap(err, "unmarshal json error")
+		}
+		return b.sendToGateway(gatewayID, TimeSyncResponse{
+			MessageType: TimeSyncMessage,
+			TxTime:      pl.TxTime,
+			GPSTime:     int64(gps.Time(time.Now()).TimeSinceGPSEpoch() / time.Microsecond),
+		}, nil)
+	default:
+		log.WithFields(log.Fields{
+			"gateway_id":   gatewayID,
+			"message_type": h.MessageType,
+		}).Debug("gateway/basic_station: unexpected message-type")
+	}
+
+	return nil
+}
+
+func (b *Backend) handleVersion(gatewayID lorawan.EUI64, msg []byte) error {
+	var pl Version
+	if err := json.Unmarshal(msg, &pl); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"station":    pl.Station,
+		"firmware":   pl.Firmware,
+		"package":    pl.Package,
+		"model":      pl.Model,
+		"protocol":   pl.Protocol,
+	}).Info("gateway/basic_station: version received")
+
+	conf, err := b.getConfiguration(context.Background(), gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway configuration error")
+	}
+
+	rc, err := getRouterConfig(b.region, b.frequencyMin, b.frequencyMax, conf.Channels)
+	if err != nil {
+		return errors.Wrap(err, "get router config error")
+	}
+
+	return b.sendToGateway(gatewayID, rc, func(c *connection) {
+		c.setPendingConfigVersion(conf.Version)
+	})
+}
+
+func (b *Backend) handleUplinkFrame(c *connection, frame gw.UplinkFrame) {
+	c.Lock()
+	c.rxPacketsReceived++
+	c.rxPacketsReceivedOK++
+	c.Unlock()
+
+	log.WithFields(log.Fields{
+		"gateway_id": helpers.GetGatewayID(frame.RxInfo),
+		"uplink_id":  helpers.GetUplinkID(frame.RxInfo),
+	}).Info("gateway/basic_station: uplink frame received")
+
+	select {
+	case b.uplinkFrameChan <- frame:
+	case <-b.done:
+	}
+}
+
+func (b *Backend) handleDownlinkTransmitted(gatewayID lorawan.EUI64, pl DownlinkTransmitted) {
+	ack := gw.DownlinkTXAck{
+		GatewayId: gatewayID[:],
+		Token:     uint32(pl.DIID),
+	}
+
+	b.downlinksMux.Lock()
+	p, ok := b.downlinks[pl.DIID]
+	if ok {
+		delete(b.downlinks, pl.DIID)
+	}
+	b.downlinksMux.Unlock()
+
+	// The dntxed message does not indicate which receive-window was used,
+	// the first item is reported as emitted.
+	if ok {
+		ack.DownlinkId = p.downlinkID
+		for i := 0; i < p.items; i++ {
+			status := gw.TxAckStatus_IGNORED
+			if i == 0 {
+				status = gw.TxAckStatus_OK
+			}
+			ack.Items = append(ack.Items, &gw.DownlinkTXAckItem{Status: status})
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": helpers.GetDownlinkID(&ack),
+	}).Info("gateway/basic_station: downlink transmitted")
+
+	select {
+	case b.downlinkTXAckChan <- ack:
+	case <-b.done:
+	}
+}
+
+func (b *Backend) sendGatewayStats(gatewayID lorawan.EUI64, c *connection) error {
+	statsID, err := uuid.NewV4()
+	if err != nil {
+		return errors.Wrap(err, "get uuid error")
+	}
+
+	c.Lock()
+	stats := gw.GatewayStats{
+		GatewayId:           gatewayID[:],
+		Ip:                  c.ip,
+		Time:                ptypes.TimestampNow(),
+		StatsId:             statsID[:],
+		RxPacketsReceived:   c.rxPacketsReceived,
+		RxPacketsReceivedOk: c.rxPacketsReceivedOK,
+		TxPacketsReceived:   c.txPacketsReceived,
+		TxPacketsEmitted:    c.txPacketsEmitted,
+		ConfigVersion:       c.configVersion,
+	}
+	c.rxPacketsReceived = 0
+	c.rxPacketsReceivedOK = 0
+	c.txPacketsReceived = 0
+	c.txPacketsEmitted = 0
+	c.Unlock()
+
+	select {
+	case b.gatewayStatsChan <- stats:
+	case <-b.done:
+	}
+
+	return nil
+}
+
+// sendToGateway sends the given message as JSON to the gateway. When set,
+// the given function is called (with the connection locked) after the
+// message was sent.
+func (b *Backend) sendToGateway(gatewayID lorawan.EUI64, v interface{}, f func(*connection)) error {
+	b.gatewaysMux.RLock()
+	c, ok := b.gateways[gatewayID]
+	b.gatewaysMux.RUnlock()
+
+	if !ok {
+		return ErrGatewayNotConnected
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout)); err != nil {
+		return errors.Wrap(err, "set write deadline error")
+	}
+
+	if err := c.conn.WriteJSON(v); err != nil {
+		return errors.Wrap(err, "write json error")
+	}
+
+	if f != nil {
+		f(c)
+	}
+
+	return nil
+}
+
+func (b *Backend) cleanupLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(downlinkCleanupDuration / 6)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.cleanup(time.Now())
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// cleanup removes the downlinks for which no dntxed was received.
+func (b *Backend) cleanup(now time.Time) {
+	b.downlinksMux.Lock()
+	defer b.downlinksMux.Unlock()
+
+	for diid, p := range b.downlinks {
+		if now.After(p.expiresAt) {
+			delete(b.downlinks, diid)
+
+			log.WithFields(log.Fields{
+				"gateway_id": p.gatewayID,
+				"diid":       diid,
+			}).Warning("gateway/basic_station: no dntxed received for downlink")
+		}
+	}
+}
+
+// getConfiguration returns the configuration from the gateway-profile of the
+// gateway, or the enabled uplink channels of the band when the gateway does
+// not exist or has no gateway-profile.
+func getConfiguration(ctx context.Context, gatewayID lorawan.EUI64) (gw.GatewayConfiguration, error) {
+	var gwProfile storage.GatewayProfile
+
+	g, err := storage.GetGateway(ctx, storage.DB(), gatewayID)
+	if err != nil && errors.Cause(err) != storage.ErrDoesNotExist {
+		return gw.GatewayConfiguration{}, errors.Wrap(err, "get gateway error")
+	}
+
+	if err == nil && g.GatewayProfileID != nil {
+		gwProfile, err = storage.GetGatewayProfile(ctx, storage.DB(), *g.GatewayProfileID)
+		if err != nil {
+			return gw.GatewayConfiguration{}, errors.Wrap(err, "get gateway-profile error")
+		}
+	} else {
+		for _, i := range band.Band().GetEnabledUplinkChannelIndices() {
+			gwProfile.Channels = append(gwProfile.Channels, int64(i))
+		}
+	}
+
+	conf, err := stats.GetGatewayConfiguration(gatewayID, gwProfile)
+	if err != nil {
+		return conf, errors.Wrap(err, "get gateway configuration error")
+	}
+
+	return conf, nil
+}
+
+func newTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load x509 keypair error")
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca cert error")
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("append ca cert to pool error")
+		}
+
+		tlsConfig.ClientCAs = certPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
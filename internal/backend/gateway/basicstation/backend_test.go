@@ -0,0 +1,252 @@
+package basicstation
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	gatewayID lorawan.EUI64
+	backend   *Backend
+	wsConn    *websocket.Conn
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	conf := test.GetConfig()
+	assert.NoError(band.Setup(conf))
+
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	ts.backend = b.(*Backend)
+	ts.backend.getConfiguration = func(ctx context.Context, gatewayID lorawan.EUI64) (gw.GatewayConfiguration, error) {
+		return gw.GatewayConfiguration{
+			GatewayId: gatewayID[:],
+			Version:   "1",
+			Channels: []*gw.ChannelConfiguration{
+				{
+					Frequency:  868100000,
+					Modulation: common.Modulation_LORA,
+					ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+						LoraModulationConfig: &gw.LoRaModulationConfig{
+							Bandwidth:        125,
+							SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+						},
+					},
+				},
+			},
+		}, nil
+	}
+
+	// router-info
+	addr := ts.backend.ln.Addr().String()
+	riConn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/router-info", addr), nil)
+	assert.NoError(err)
+	assert.NoError(riConn.WriteJSON(RouterInfoRequest{Router: EUI64(ts.gatewayID)}))
+
+	var ri RouterInfoResponse
+	assert.NoError(riConn.ReadJSON(&ri))
+	assert.NoError(riConn.Close())
+	assert.Equal(fmt.Sprintf("ws://%s/gateway/0102030405060708", addr), ri.URI)
+
+	// connect and send version
+	ts.wsConn, _, err = websocket.DefaultDialer.Dial(ri.URI, nil)
+	assert.NoError(err)
+	assert.NoError(ts.wsConn.WriteJSON(Version{
+		MessageType: VersionMessage,
+		Station:     "2.0.6",
+		Protocol:    2,
+	}))
+
+	var rc RouterConfig
+	assert.NoError(ts.wsConn.ReadJSON(&rc))
+	assert.Equal(RouterConfigMessage, rc.MessageType)
+	assert.Equal("EU863", rc.Region)
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	assert := require.New(ts.T())
+	assert.NoError(ts.wsConn.Close())
+	assert.NoError(ts.backend.Close())
+}
+
+func (ts *BackendTestSuite) TestUplinkDataFrame() {
+	assert := require.New(ts.T())
+
+	assert.NoError(ts.wsConn.WriteMessage(websocket.TextMessage, []byte(`{"msgtype":"updf","MHdr":64,"DevAddr":16909060,"FCtrl":0,"FCnt":1,"FOpts":"","FPort":-1,"FRMPayload":"","MIC":0,"DR":5,"Freq":868100000,"upinfo":{"rctx":0,"xtime":1,"rssi":-50,"snr":9}}`)))
+
+	frame := <-ts.backend.RXPacketChan()
+	assert.Equal(ts.gatewayID[:], frame.RxInfo.GatewayId)
+	assert.Equal([]byte{64, 4, 3, 2, 1, 0, 1, 0, 0, 0, 0, 0}, frame.PhyPayload)
+}
+
+func (ts *BackendTestSuite) TestDownlink() {
+	assert := require.New(ts.T())
+
+	assert.NoError(ts.backend.SendTXPacket(gw.DownlinkFrame{
+		GatewayId:  ts.gatewayID[:],
+		Token:      1234,
+		DownlinkId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8},
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Modulation: common.Modulation_LORA,
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{
+							SpreadingFactor: 7,
+							Bandwidth:       125,
+						},
+					},
+					Timing: gw.DownlinkTiming_DELAY,
+					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+						DelayTimingInfo: &gw.DelayTimingInfo{
+							Delay: ptypes.DurationProto(time.Second),
+						},
+					},
+					Context: make([]byte, 16),
+				},
+			},
+		},
+	}))
+
+	var dnmsg DownlinkFrame
+	assert.NoError(ts.wsConn.ReadJSON(&dnmsg))
+	assert.Equal(DownlinkMessage, dnmsg.MessageType)
+	assert.Equal(int64(1234), dnmsg.DIID)
+	assert.Equal(HEXBytes{1, 2, 3}, dnmsg.PDU)
+
+	assert.NoError(ts.wsConn.WriteJSON(DownlinkTransmitted{
+		MessageType: DownlinkTransmittedMessage,
+		DIID:        1234,
+	}))
+
+	ack := <-ts.backend.DownlinkTXAckChan()
+	assert.Equal(ts.gatewayID[:], ack.GatewayId)
+	assert.Equal(uint32(1234), ack.Token)
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8}, ack.DownlinkId)
+	assert.Len(ack.Items, 1)
+	assert.Equal(gw.TxAckStatus_OK, ack.Items[0].Status)
+}
+
+func (ts *BackendTestSuite) TestTimeSync() {
+	assert := require.New(ts.T())
+
+	assert.NoError(ts.wsConn.WriteJSON(TimeSyncRequest{
+		MessageType: TimeSyncMessage,
+		TxTime:      12345,
+	}))
+
+	var resp TimeSyncResponse
+	assert.NoError(ts.wsConn.ReadJSON(&resp))
+	assert.Equal(int64(12345), resp.TxTime)
+	assert.NotEqual(int64(0), resp.GPSTime)
+}
+
+func (ts *BackendTestSuite) TestGatewayConfiguration() {
+	assert := require.New(ts.T())
+
+	assert.True(ts.backend.SupportsGatewayConfiguration(ts.gatewayID))
+	assert.False(ts.backend.SupportsGatewayConfiguration(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}))
+
+	ts.backend.gatewaysMux.RLock()
+	c := ts.backend.gateways[ts.gatewayID]
+	ts.backend.gatewaysMux.RUnlock()
+
+	// the router_config is confirmed by the next message of the station
+	confirm := func(assert *require.Assertions) {
+		assert.NoError(ts.wsConn.WriteJSON(TimeSyncRequest{
+			MessageType: TimeSyncMessage,
+			TxTime:      12345,
+		}))
+
+		var resp TimeSyncResponse
+		assert.NoError(ts.wsConn.ReadJSON(&resp))
+	}
+
+	ts.T().Run("Version on connect", func(t *testing.T) {
+		assert := require.New(t)
+
+		go ts.backend.sendGatewayStats(ts.gatewayID, c)
+		stats := <-ts.backend.StatsPacketChan()
+		assert.Equal("", stats.ConfigVersion)
+
+		confirm(assert)
+
+		go ts.backend.sendGatewayStats(ts.gatewayID, c)
+		stats = <-ts.backend.StatsPacketChan()
+		assert.Equal("1", stats.ConfigVersion)
+	})
+
+	ts.T().Run("Configuration update", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(ts.backend.SendGatewayConfigPacket(gw.GatewayConfiguration{
+			GatewayId: ts.gatewayID[:],
+			Version:   "2",
+			Channels: []*gw.ChannelConfiguration{
+				{
+					Frequency:  868300000,
+					Modulation: common.Modulation_LORA,
+					ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+						LoraModulationConfig: &gw.LoRaModulationConfig{
+							Bandwidth:        125,
+							SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+						},
+					},
+				},
+			},
+		}))
+
+		var rc RouterConfig
+		assert.NoError(ts.wsConn.ReadJSON(&rc))
+		assert.Equal(RouterConfigMessage, rc.MessageType)
+
+		go ts.backend.sendGatewayStats(ts.gatewayID, c)
+		stats := <-ts.backend.StatsPacketChan()
+		assert.Equal("1", stats.ConfigVersion)
+
+		confirm(assert)
+
+		go ts.backend.sendGatewayStats(ts.gatewayID, c)
+		stats = <-ts.backend.StatsPacketChan()
+		assert.Equal("2", stats.ConfigVersion)
+	})
+}
+
+func (ts *BackendTestSuite) TestGatewayNotConnected() {
+	assert := require.New(ts.T())
+
+	assert.Equal(ErrGatewayNotConnected, ts.backend.SendGatewayConfigPacket(gw.GatewayConfiguration{
+		GatewayId: []byte{8, 7, 6, 5, 4, 3, 2, 1},
+		Channels: []*gw.ChannelConfiguration{
+			{
+				Frequency:  868100000,
+				Modulation: common.Modulation_FSK,
+			},
+		},
+	}))
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
@@ -0,0 +1,440 @@
+package basicstation
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+)
+
+const (
+	// maxIFOffset defines the max. IF offset (Hz) of a channel relative to
+	// the radio center frequency.
+	maxIFOffset = 400000
+
+	// maxMultiSFChannels defines the max. number of multi-SF channels of the
+	// SX1301 concentrator.
+	maxMultiSFChannels = 8
+)
+
+// regions maps the band names to the Basics Station region names, band
+// names which are not in this map are used as-is.
+var regions = map[string]string{
+	"EU868": "EU863",
+	"US915": "US902",
+}
+
+// getRegion returns the Basics Station region name for the given band name.
+func getRegion(bandName string) string {
+	if r, ok := regions[bandName]; ok {
+		return r
+	}
+	return bandName
+}
+
+// uplinkFrameFromUplinkDataFrame returns the UplinkFrame for the given updf
+// message.
+func uplinkFrameFromUplinkDataFrame(gatewayID lorawan.EUI64, pl UplinkDataFrame) (gw.UplinkFrame, error) {
+	phy := []byte{pl.MHDR}
+
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(pl.DevAddr))
+	phy = append(phy, b...)
+	phy = append(phy, pl.FCtrl)
+
+	b = make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, pl.FCnt)
+	phy = append(phy, b...)
+	phy = append(phy, pl.FOpts...)
+
+	// FPort is -1 when not present
+	if pl.FPort != -1 {
+		phy = append(phy, uint8(pl.FPort))
+	}
+	phy = append(phy, pl.FRMPayload...)
+
+	b = make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(pl.MIC))
+	phy = append(phy, b...)
+
+	return uplinkFrameFromRadioMetaData(gatewayID, phy, pl.RadioMetaData)
+}
+
+// uplinkFrameFromJoinRequest returns the UplinkFrame for the given jreq
+// message.
+func uplinkFrameFromJoinRequest(gatewayID lorawan.EUI64, pl JoinRequest) (gw.UplinkFrame, error) {
+	phy := []byte{pl.MHDR}
+
+	// the EUIs are encoded as little-endian within the PHYPayload
+	for _, eui := range []EUI64{pl.JoinEUI, pl.DevEUI} {
+		for i := len(eui) - 1; i >= 0; i-- {
+			phy = append(phy, eui[i])
+		}
+	}
+
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, pl.DevNonce)
+	phy = append(phy, b...)
+
+	b = make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(pl.MIC))
+	phy = append(phy, b...)
+
+	return uplinkFrameFromRadioMetaData(gatewayID, phy, pl.RadioMetaData)
+}
+
+// uplinkFrameFromProprietaryDataFrame returns the UplinkFrame for the given
+// propdf message.
+func uplinkFrameFromProprietaryDataFrame(gatewayID lorawan.EUI64, pl ProprietaryDataFrame) (gw.UplinkFrame, error) {
+	return uplinkFrameFromRadioMetaData(gatewayID, pl.FRMPayload, pl.RadioMetaData)
+}
+
+func uplinkFrameFromRadioMetaData(gatewayID lorawan.EUI64, phy []byte, rmd RadioMetaData) (gw.UplinkFrame, error) {
+	uplinkID, err := uuid.NewV4()
+	if err != nil {
+		return gw.UplinkFrame{}, errors.Wrap(err, "get uuid error")
+	}
+
+	frame := gw.UplinkFrame{
+		PhyPayload: phy,
+		TxInfo: &gw.UplinkTXInfo{
+			Frequency: rmd.Frequency,
+		},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: gatewayID[:],
+			Rssi:      int32(rmd.UpInfo.RSSI),
+			LoraSnr:   rmd.UpInfo.SNR,
+			CrcStatus: gw.CRCStatus_CRC_OK,
+			Context:   contextFromUpInfo(rmd.UpInfo),
+			UplinkId:  uplinkID[:],
+		},
+	}
+
+	dr, err := band.Band().GetDataRate(rmd.DR)
+	if err != nil {
+		return frame, errors.Wrap(err, "get data-rate error")
+	}
+
+	switch dr.Modulation {
+	case loraband.LoRaModulation:
+		frame.TxInfo.Modulation = common.Modulation_LORA
+		frame.TxInfo.ModulationInfo = &gw.UplinkTXInfo_LoraModulationInfo{
+			LoraModulationInfo: &gw.LoRaModulationInfo{
+				Bandwidth:       uint32(dr.Bandwidth),
+				SpreadingFactor: uint32(dr.SpreadFactor),
+				CodeRate:        "4/5",
+			},
+		}
+	case loraband.FSKModulation:
+		frame.TxInfo.Modulation = common.Modulation_FSK
+		frame.TxInfo.ModulationInfo = &gw.UplinkTXInfo_FskModulationInfo{
+			FskModulationInfo: &gw.FSKModulationInfo{
+				Datarate: uint32(dr.BitRate),
+			},
+		}
+	default:
+		return frame, fmt.Errorf("unexpected modulation: %s", dr.Modulation)
+	}
+
+	if rmd.UpInfo.RxTime != 0 {
+		sec, nsec := math.Modf(rmd.UpInfo.RxTime)
+		frame.RxInfo.Time, err = ptypes.TimestampProto(time.Unix(int64(sec), int64(nsec*1e9)))
+		if err != nil {
+			return frame, errors.Wrap(err, "timestamp proto error")
+		}
+	}
+
+	if rmd.UpInfo.GPSTime != 0 {
+		frame.RxInfo.TimeSinceGpsEpoch = ptypes.DurationProto(time.Duration(rmd.UpInfo.GPSTime) * time.Microsecond)
+	}
+
+	return frame, nil
+}
+
+// contextFromUpInfo returns the context for the given uplink info. The
+// context contains the xtime and rctx, which are needed to schedule the
+// downlink relative to the uplink.
+func contextFromUpInfo(upInfo RadioMetaDataUpInfo) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[0:8], uint64(upInfo.XTime))
+	binary.BigEndian.PutUint64(b[8:16], uint64(upInfo.RCtx))
+	return b
+}
+
+// upInfoFromContext returns the xtime and rctx from the given context.
+func upInfoFromContext(b []byte) (int64, int64, error) {
+	if len(b) != 16 {
+		return 0, 0, errors.New("context must contain exactly 16 bytes")
+	}
+	return int64(binary.BigEndian.Uint64(b[0:8])), int64(binary.BigEndian.Uint64(b[8:16])), nil
+}
+
+// downlinkDataRate returns the downlink data-rate index for the given
+// downlink item.
+func downlinkDataRate(txInfo *gw.DownlinkTXInfo) (int, error) {
+	var dr loraband.DataRate
+
+	switch txInfo.GetModulation() {
+	case common.Modulation_LORA:
+		modInfo := txInfo.GetLoraModulationInfo()
+		if modInfo == nil {
+			return 0, errors.New("lora_modulation_info must not be nil")
+		}
+		dr = loraband.DataRate{
+			Modulation:   loraband.LoRaModulation,
+			SpreadFactor: int(modInfo.SpreadingFactor),
+			Bandwidth:    int(modInfo.Bandwidth),
+		}
+	case common.Modulation_FSK:
+		modInfo := txInfo.GetFskModulationInfo()
+		if modInfo == nil {
+			return 0, errors.New("fsk_modulation_info must not be nil")
+		}
+		dr = loraband.DataRate{
+			Modulation: loraband.FSKModulation,
+			BitRate:    int(modInfo.Datarate),
+		}
+	default:
+		return 0, fmt.Errorf("unexpected modulation: %s", txInfo.GetModulation())
+	}
+
+	i, err := band.Band().GetDataRateIndex(false, dr)
+	if err != nil {
+		return 0, errors.Wrap(err, "get data-rate index error")
+	}
+
+	return i, nil
+}
+
+// downlinkFrameFromDownlinkFrame returns the dnmsg message for the given
+// DownlinkFrame. For class-A downlinks, the first item is used for RX1 and
+// the (optional) second item for RX2.
+func downlinkFrameFromDownlinkFrame(pl gw.DownlinkFrame) (DownlinkFrame, error) {
+	if len(pl.Items) == 0 {
+		return DownlinkFrame{}, errors.New("items must contain at least one item")
+	}
+
+	item := pl.Items[0]
+	txInfo := item.GetTxInfo()
+	if txInfo == nil {
+		return DownlinkFrame{}, errors.New("tx_info must not be nil")
+	}
+
+	out := DownlinkFrame{
+		MessageType: DownlinkMessage,
+		DIID:        int64(pl.Token),
+		PDU:         HEXBytes(item.PhyPayload),
+	}
+
+	dr, err := downlinkDataRate(txInfo)
+	if err != nil {
+		return out, err
+	}
+	freq := txInfo.Frequency
+
+	switch txInfo.Timing {
+	case gw.DownlinkTiming_DELAY:
+		timingInfo := txInfo.GetDelayTimingInfo()
+		if timingInfo == nil {
+			return out, errors.New("delay_timing_info must not be nil")
+		}
+
+		delay, err := ptypes.Duration(timingInfo.Delay)
+		if err != nil {
+			return out, errors.Wrap(err, "parse delay error")
+		}
+
+		xtime, rctx, err := upInfoFromContext(txInfo.Context)
+		if err != nil {
+			return out, err
+		}
+
+		rxDelay := int(delay / time.Second)
+		out.DeviceClass = DeviceClassA
+		out.RxDelay = &rxDelay
+		out.RX1DR = &dr
+		out.RX1Freq = &freq
+		out.XTime = &xtime
+		out.RCtx = &rctx
+
+		if len(pl.Items) > 1 {
+			rx2TxInfo := pl.Items[1].GetTxInfo()
+			if rx2TxInfo == nil {
+				return out, errors.New("tx_info must not be nil")
+			}
+
+			rx2DR, err := downlinkDataRate(rx2TxInfo)
+			if err != nil {
+				return out, err
+			}
+			rx2Freq := rx2TxInfo.Frequency
+
+			out.RX2DR = &rx2DR
+			out.RX2Freq = &rx2Freq
+		}
+	case gw.DownlinkTiming_IMMEDIATELY:
+		out.DeviceClass = DeviceClassC
+		out.RX2DR = &dr
+		out.RX2Freq = &freq
+
+		// use the context of the last uplink (if available) to select
+		// the radio
+		if xtime, rctx, err := upInfoFromContext(txInfo.Context); err == nil {
+			out.XTime = &xtime
+			out.RCtx = &rctx
+		}
+	case gw.DownlinkTiming_GPS_EPOCH:
+		timingInfo := txInfo.GetGpsEpochTimingInfo()
+		if timingInfo == nil {
+			return out, errors.New("gps_epoch_timing_info must not be nil")
+		}
+
+		gpsTime, err := ptypes.Duration(timingInfo.TimeSinceGpsEpoch)
+		if err != nil {
+			return out, errors.Wrap(err, "parse time since gps epoch error")
+		}
+		gpsTimeUS := int64(gpsTime / time.Microsecond)
+
+		out.DeviceClass = DeviceClassB
+		out.DR = &dr
+		out.Freq = &freq
+		out.GPSTime = &gpsTimeUS
+	default:
+		return out, fmt.Errorf("unexpected timing: %s", txInfo.Timing)
+	}
+
+	return out, nil
+}
+
+// getRouterConfig returns the router_config message for the given channels.
+// The radio center frequencies are calculated from the channel frequencies.
+func getRouterConfig(region string, freqMin, freqMax uint32, channels []*gw.ChannelConfiguration) (RouterConfig, error) {
+	out := RouterConfig{
+		MessageType: RouterConfigMessage,
+		Region:      region,
+		HWSpec:      "sx1301/1",
+		FreqRange:   [2]uint32{freqMin, freqMax},
+		NoCCA:       true,
+		NoDC:        true,
+		NoDwell:     true,
+	}
+
+	// data-rates
+	b := band.Band()
+	for i := range out.DRs {
+		dr, err := b.GetDataRate(i)
+		if err != nil {
+			out.DRs[i] = [3]int{-1, 0, 0}
+			continue
+		}
+
+		switch dr.Modulation {
+		case loraband.LoRaModulation:
+			out.DRs[i] = [3]int{dr.SpreadFactor, dr.Bandwidth, 0}
+		case loraband.FSKModulation:
+			out.DRs[i] = [3]int{0, 0, 0}
+		default:
+			out.DRs[i] = [3]int{-1, 0, 0}
+			continue
+		}
+
+		// mark the data-rate as downlink only when it is not an uplink
+		// data-rate
+		if upI, err := b.GetDataRateIndex(true, dr); err != nil || upI != i {
+			out.DRs[i][2] = 1
+		}
+	}
+
+	// filter and sort the channels
+	var chans []*gw.ChannelConfiguration
+	for _, c := range channels {
+		if c.GetModulation() == common.Modulation_LORA && len(c.GetLoraModulationConfig().GetSpreadingFactors()) == 0 {
+			continue
+		}
+		chans = append(chans, c)
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		return chans[i].Frequency < chans[j].Frequency
+	})
+
+	if len(chans) == 0 {
+		return out, errors.New("no channels configured")
+	}
+
+	// group the channels per radio
+	var radios [][2]uint32
+	for _, c := range chans {
+		if n := len(radios); n != 0 && c.Frequency-radios[n-1][0] <= 2*maxIFOffset {
+			radios[n-1][1] = c.Frequency
+			continue
+		}
+		radios = append(radios, [2]uint32{c.Frequency, c.Frequency})
+	}
+	if len(radios) > 2 {
+		return out, fmt.Errorf("channels span more than 2 radios: %d", len(radios))
+	}
+
+	conf := SX1301Conf{}
+	centers := make([]uint32, len(radios))
+	for i := range radios {
+		centers[i] = radios[i][0] + (radios[i][1]-radios[i][0])/2
+	}
+	conf.Radio0 = SX1301ConfRadio{Enable: true, Freq: centers[0]}
+	conf.Radio1 = SX1301ConfRadio{Enable: len(centers) > 1, Freq: centers[len(centers)-1]}
+
+	var multiSF int
+	for _, c := range chans {
+		radio := 0
+		if len(centers) > 1 && c.Frequency > radios[0][1] {
+			radio = 1
+		}
+		ifOffset := int(c.Frequency) - int(centers[radio])
+
+		switch c.GetModulation() {
+		case common.Modulation_LORA:
+			modConfig := c.GetLoraModulationConfig()
+
+			if modConfig.Bandwidth == 125 && len(modConfig.SpreadingFactors) > 1 {
+				if multiSF == maxMultiSFChannels {
+					return out, fmt.Errorf("too many multi-sf channels, max %d is allowed", maxMultiSFChannels)
+				}
+				conf.ChanMultiSF[multiSF] = SX1301ConfChanMultiSF{Enable: true, Radio: radio, IF: ifOffset}
+				multiSF++
+				continue
+			}
+
+			if conf.ChanLoRaStd.Enable {
+				return out, errors.New("only one lora standard channel is allowed")
+			}
+			conf.ChanLoRaStd = SX1301ConfChanLoRaStd{
+				Enable:       true,
+				Radio:        radio,
+				IF:           ifOffset,
+				Bandwidth:    int(modConfig.Bandwidth) * 1000,
+				SpreadFactor: int(modConfig.SpreadingFactors[0]),
+			}
+		case common.Modulation_FSK:
+			if conf.ChanFSK.Enable {
+				return out, errors.New("only one fsk channel is allowed")
+			}
+			conf.ChanFSK = SX1301ConfChanFSK{Enable: true, Radio: radio, IF: ifOffset}
+		default:
+			return out, fmt.Errorf("unexpected modulation: %s", c.GetModulation())
+		}
+	}
+
+	out.SX1301Conf = []SX1301Conf{conf}
+
+	return out, nil
+}
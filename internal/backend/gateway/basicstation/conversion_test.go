@@ -0,0 +1,230 @@
+package basicstation
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+func TestEUI64(t *testing.T) {
+	tests := []struct {
+		json        string
+		expectedEUI EUI64
+		expectedErr bool
+	}{
+		{`"01-02-03-04-05-06-07-08"`, EUI64{1, 2, 3, 4, 5, 6, 7, 8}, false},
+		{`"0102030405060708"`, EUI64{1, 2, 3, 4, 5, 6, 7, 8}, false},
+		{`"102:304:506:708"`, EUI64{1, 2, 3, 4, 5, 6, 7, 8}, false},
+		{`"::1"`, EUI64{0, 0, 0, 0, 0, 0, 0, 1}, false},
+		{`"1::"`, EUI64{0, 1, 0, 0, 0, 0, 0, 0}, false},
+		{`"1::2"`, EUI64{0, 1, 0, 0, 0, 0, 0, 2}, false},
+		{`72623859790382856`, EUI64{1, 2, 3, 4, 5, 6, 7, 8}, false},
+		{`"01-02-03"`, EUI64{}, true},
+		{`"1:2:3:4:5"`, EUI64{}, true},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.json, func(t *testing.T) {
+			assert := require.New(t)
+
+			var eui EUI64
+			err := json.Unmarshal([]byte(tst.json), &eui)
+			if tst.expectedErr {
+				assert.Error(err)
+				return
+			}
+
+			assert.NoError(err)
+			assert.Equal(tst.expectedEUI, eui)
+		})
+	}
+
+	b, err := json.Marshal(EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+	require.NoError(t, err)
+	require.Equal(t, `"01-02-03-04-05-06-07-08"`, string(b))
+}
+
+func TestUplinkFrameFromUplinkDataFrame(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(band.Setup(test.GetConfig()))
+
+	var pl UplinkDataFrame
+	assert.NoError(json.Unmarshal([]byte(`{"msgtype":"updf","MHdr":64,"DevAddr":16909060,"FCtrl":128,"FCnt":10,"FOpts":"","FPort":1,"FRMPayload":"0506","MIC":-1,"DR":5,"Freq":868100000,"upinfo":{"rctx":1,"xtime":2,"gpstime":0,"rssi":-50,"snr":9.5,"rxtime":1600000000.5}}`), &pl))
+
+	frame, err := uplinkFrameFromUplinkDataFrame(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, pl)
+	assert.NoError(err)
+
+	assert.Equal([]byte{64, 4, 3, 2, 1, 128, 10, 0, 1, 5, 6, 255, 255, 255, 255}, frame.PhyPayload)
+	assert.Equal(uint32(868100000), frame.TxInfo.Frequency)
+	assert.Equal(common.Modulation_LORA, frame.TxInfo.Modulation)
+	assert.Equal(uint32(7), frame.TxInfo.GetLoraModulationInfo().SpreadingFactor)
+	assert.Equal(uint32(125), frame.TxInfo.GetLoraModulationInfo().Bandwidth)
+	assert.Equal([]byte{1, 2, 3, 4, 5, 6, 7, 8}, frame.RxInfo.GatewayId)
+	assert.Equal(int32(-50), frame.RxInfo.Rssi)
+	assert.Equal(9.5, frame.RxInfo.LoraSnr)
+	assert.Equal([]byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1}, frame.RxInfo.Context)
+
+	rxTime, err := ptypes.Timestamp(frame.RxInfo.Time)
+	assert.NoError(err)
+	assert.True(rxTime.Equal(time.Unix(1600000000, 500000000)))
+}
+
+func TestUplinkFrameFromJoinRequest(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(band.Setup(test.GetConfig()))
+
+	var pl JoinRequest
+	assert.NoError(json.Unmarshal([]byte(`{"msgtype":"jreq","MHdr":0,"JoinEui":"01-02-03-04-05-06-07-08","DevEui":"08-07-06-05-04-03-02-01","DevNonce":258,"MIC":16909060,"DR":0,"Freq":868300000,"upinfo":{"rctx":0,"xtime":0,"rssi":-100,"snr":-5}}`), &pl))
+
+	frame, err := uplinkFrameFromJoinRequest(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, pl)
+	assert.NoError(err)
+
+	var phy lorawan.PHYPayload
+	assert.NoError(phy.UnmarshalBinary(frame.PhyPayload))
+	assert.Equal(lorawan.JoinRequest, phy.MHDR.MType)
+
+	jrPL, ok := phy.MACPayload.(*lorawan.JoinRequestPayload)
+	assert.True(ok)
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, jrPL.JoinEUI)
+	assert.Equal(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, jrPL.DevEUI)
+	assert.Equal(lorawan.DevNonce(258), jrPL.DevNonce)
+	assert.Equal(lorawan.MIC{4, 3, 2, 1}, phy.MIC)
+	assert.Equal(uint32(12), frame.TxInfo.GetLoraModulationInfo().SpreadingFactor)
+}
+
+func TestDownlinkFrameFromDownlinkFrame(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(band.Setup(test.GetConfig()))
+
+	item := func(freq, sf uint32, delay time.Duration) *gw.DownlinkFrameItem {
+		return &gw.DownlinkFrameItem{
+			PhyPayload: []byte{1, 2, 3},
+			TxInfo: &gw.DownlinkTXInfo{
+				Frequency:  freq,
+				Modulation: common.Modulation_LORA,
+				ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						SpreadingFactor: sf,
+						Bandwidth:       125,
+					},
+				},
+				Timing: gw.DownlinkTiming_DELAY,
+				TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+					DelayTimingInfo: &gw.DelayTimingInfo{
+						Delay: ptypes.DurationProto(delay),
+					},
+				},
+				Context: []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1},
+			},
+		}
+	}
+
+	dnmsg, err := downlinkFrameFromDownlinkFrame(gw.DownlinkFrame{
+		Token: 1234,
+		Items: []*gw.DownlinkFrameItem{
+			item(868100000, 7, time.Second),
+			item(869525000, 12, 2*time.Second),
+		},
+	})
+	assert.NoError(err)
+
+	b, err := json.Marshal(dnmsg)
+	assert.NoError(err)
+	assert.JSONEq(`{"msgtype":"dnmsg","DevEui":"00-00-00-00-00-00-00-00","dC":0,"diid":1234,"pdu":"010203","priority":0,"rctx":1,"RxDelay":1,"RX1DR":5,"RX1Freq":868100000,"RX2DR":0,"RX2Freq":869525000,"xtime":2}`, string(b))
+}
+
+func TestGetRouterConfig(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(band.Setup(test.GetConfig()))
+
+	loraChannel := func(freq uint32) *gw.ChannelConfiguration {
+		return &gw.ChannelConfiguration{
+			Frequency:  freq,
+			Modulation: common.Modulation_LORA,
+			ModulationConfig: &gw.ChannelConfiguration_LoraModulationConfig{
+				LoraModulationConfig: &gw.LoRaModulationConfig{
+					Bandwidth:        125,
+					SpreadingFactors: []uint32{7, 8, 9, 10, 11, 12},
+				},
+			},
+		}
+	}
+
+	t.Run("two radios", func(t *testing.T) {
+		assert := require.New(t)
+
+		rc, err := getRouterConfig("EU863", 863000000, 870000000, []*gw.ChannelConfiguration{
+			loraChannel(868500000),
+			loraChannel(868100000),
+			loraChannel(868300000),
+			loraChannel(867100000),
+			loraChannel(867300000),
+			{
+				Frequency:  868800000,
+				Modulation: common.Modulation_FSK,
+				ModulationConfig: &gw.ChannelConfiguration_FskModulationConfig{
+					FskModulationConfig: &gw.FSKModulationConfig{
+						Bitrate: 50000,
+					},
+				},
+			},
+		})
+		assert.NoError(err)
+
+		assert.Equal("EU863", rc.Region)
+		assert.Equal([2]uint32{863000000, 870000000}, rc.FreqRange)
+		assert.Equal([3]int{12, 125, 0}, rc.DRs[0])
+		assert.Equal([3]int{7, 250, 0}, rc.DRs[6])
+		assert.Equal([3]int{0, 0, 0}, rc.DRs[7])
+		assert.Equal([3]int{-1, 0, 0}, rc.DRs[15])
+
+		assert.Len(rc.SX1301Conf, 1)
+		conf := rc.SX1301Conf[0]
+		assert.Equal(SX1301ConfRadio{Enable: true, Freq: 867200000}, conf.Radio0)
+		assert.Equal(SX1301ConfRadio{Enable: true, Freq: 868450000}, conf.Radio1)
+		assert.Equal([8]SX1301ConfChanMultiSF{
+			{Enable: true, Radio: 0, IF: -100000},
+			{Enable: true, Radio: 0, IF: 100000},
+			{Enable: true, Radio: 1, IF: -350000},
+			{Enable: true, Radio: 1, IF: -150000},
+			{Enable: true, Radio: 1, IF: 50000},
+		}, conf.ChanMultiSF)
+		assert.Equal(SX1301ConfChanFSK{Enable: true, Radio: 1, IF: 350000}, conf.ChanFSK)
+		assert.False(conf.ChanLoRaStd.Enable)
+	})
+
+	t.Run("too many radios", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := getRouterConfig("EU863", 863000000, 870000000, []*gw.ChannelConfiguration{
+			loraChannel(864100000),
+			loraChannel(866100000),
+			loraChannel(868100000),
+		})
+		assert.Error(err)
+	})
+
+	t.Run("no channels", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := getRouterConfig("EU863", 863000000, 870000000, nil)
+		assert.Error(err)
+	})
+}
+
+func TestGetRegion(t *testing.T) {
+	assert := require.New(t)
+
+	assert.Equal("EU863", getRegion("EU868"))
+	assert.Equal("US902", getRegion("US915"))
+	assert.Equal("AU915", getRegion("AU915"))
+}
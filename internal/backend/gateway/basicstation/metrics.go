@@ -0,0 +1,35 @@
+package basicstation
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	wsc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_basicstation_websocket_connect_count",
+		Help: "The number of gateway websocket connections.",
+	})
+
+	wsd = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_basicstation_websocket_disconnect_count",
+		Help: "The number of gateway websocket disconnections.",
+	})
+
+	wsm = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_basicstation_websocket_received_count",
+		Help: "The number of websocket messages received from the gateways (per message type).",
+	}, []string{"msgtype"})
+)
+
+func connectCounter() prometheus.Counter {
+	return wsc
+}
+
+func disconnectCounter() prometheus.Counter {
+	return wsd
+}
+
+func messageCounter(mt string) prometheus.Counter {
+	return wsm.With(prometheus.Labels{"msgtype": mt})
+}
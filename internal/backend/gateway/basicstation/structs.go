@@ -0,0 +1,339 @@
+package basicstation
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+// MessageType defines the LNS protocol message type.
+type MessageType string
+
+// Message types.
+const (
+	VersionMessage              MessageType = "version"
+	RouterConfigMessage         MessageType = "router_config"
+	UplinkDataFrameMessage      MessageType = "updf"
+	JoinRequestMessage          MessageType = "jreq"
+	ProprietaryDataFrameMessage MessageType = "propdf"
+	DownlinkMessage             MessageType = "dnmsg"
+	DownlinkTransmittedMessage  MessageType = "dntxed"
+	TimeSyncMessage             MessageType = "timesync"
+)
+
+// Device classes of the dnmsg message.
+const (
+	DeviceClassA = 0
+	DeviceClassB = 1
+	DeviceClassC = 2
+)
+
+// EUI64 implements the EUI64 / ID6 formats used by the LNS protocol. It
+// can be unmarshaled from an integer, from the EUI format (dash separated)
+// or from the ID6 format (colon separated).
+type EUI64 lorawan.EUI64
+
+// MarshalJSON implements json.Marshaler.
+func (e EUI64) MarshalJSON() ([]byte, error) {
+	b := make([]string, len(e))
+	for i := range e {
+		b[i] = hex.EncodeToString(e[i : i+1])
+	}
+	return json.Marshal(strings.Join(b, "-"))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *EUI64) UnmarshalJSON(data []byte) error {
+	// integer
+	if i, err := strconv.ParseUint(string(data), 10, 64); err == nil {
+		binary.BigEndian.PutUint64(e[:], i)
+		return nil
+	}
+
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+
+	// ID6
+	if strings.Contains(str, ":") {
+		return e.unmarshalID6(str)
+	}
+
+	// EUI
+	b, err := hex.DecodeString(strings.NewReplacer("-", "", ":", "").Replace(str))
+	if err != nil {
+		return errors.Wrap(err, "decode hex error")
+	}
+	if len(b) != len(e) {
+		return fmt.Errorf("eui64 must be exactly %d bytes", len(e))
+	}
+	copy(e[:], b)
+
+	return nil
+}
+
+// unmarshalID6 decodes the ID6 representation, e.g. "1:2:3:4" or "::1".
+func (e *EUI64) unmarshalID6(str string) error {
+	var groups []string
+
+	parts := strings.SplitN(str, "::", 2)
+	if len(parts) == 2 {
+		var head, tail []string
+		if parts[0] != "" {
+			head = strings.Split(parts[0], ":")
+		}
+		if parts[1] != "" {
+			tail = strings.Split(parts[1], ":")
+		}
+		if len(head)+len(tail) > 3 {
+			return fmt.Errorf("invalid id6: %s", str)
+		}
+
+		groups = append(groups, head...)
+		for i := len(head) + len(tail); i < 4; i++ {
+			groups = append(groups, "0")
+		}
+		groups = append(groups, tail...)
+	} else {
+		groups = strings.Split(str, ":")
+	}
+
+	if len(groups) != 4 {
+		return fmt.Errorf("invalid id6: %s", str)
+	}
+
+	for i, g := range groups {
+		v, err := strconv.ParseUint(g, 16, 16)
+		if err != nil {
+			return errors.Wrapf(err, "invalid id6: %s", str)
+		}
+		binary.BigEndian.PutUint16(e[i*2:], uint16(v))
+	}
+
+	return nil
+}
+
+// HEXBytes defines a type which represents bytes as HEX when marshaled to
+// text.
+type HEXBytes []byte
+
+// MarshalText implements encoding.TextMarshaler.
+func (hb HEXBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(hb)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (hb *HEXBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*hb = HEXBytes(b)
+	return nil
+}
+
+// RouterInfoRequest implements the router-info request.
+type RouterInfoRequest struct {
+	Router EUI64 `json:"router"`
+}
+
+// RouterInfoResponse implements the router-info response.
+type RouterInfoResponse struct {
+	Router EUI64  `json:"router"`
+	Muxs   EUI64  `json:"muxs"`
+	URI    string `json:"uri,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// messageHeader is used to decode the message type.
+type messageHeader struct {
+	MessageType MessageType `json:"msgtype"`
+}
+
+// Version implements the version message.
+type Version struct {
+	MessageType MessageType `json:"msgtype"`
+	Station     string      `json:"station"`
+	Firmware    string      `json:"firmware"`
+	Package     string      `json:"package"`
+	Model       string      `json:"model"`
+	Protocol    int         `json:"protocol"`
+	Features    string      `json:"features"`
+}
+
+// RouterConfig implements the router_config message.
+type RouterConfig struct {
+	MessageType MessageType  `json:"msgtype"`
+	NetID       []uint32     `json:"NetID"`
+	JoinEUI     [][2]uint64  `json:"JoinEui"`
+	Region      string       `json:"region"`
+	HWSpec      string       `json:"hwspec"`
+	FreqRange   [2]uint32    `json:"freq_range"`
+	DRs         [16][3]int   `json:"DRs"`
+	SX1301Conf  []SX1301Conf `json:"sx1301_conf"`
+	NoCCA       bool         `json:"nocca"`
+	NoDC        bool         `json:"nodc"`
+	NoDwell     bool         `json:"nodwell"`
+}
+
+// SX1301Conf implements the SX1301 concentrator configuration.
+type SX1301Conf struct {
+	Radio0      SX1301ConfRadio       `json:"radio_0"`
+	Radio1      SX1301ConfRadio       `json:"radio_1"`
+	ChanFSK     SX1301ConfChanFSK     `json:"chan_FSK"`
+	ChanLoRaStd SX1301ConfChanLoRaStd `json:"chan_Lora_std"`
+	ChanMultiSF [8]SX1301ConfChanMultiSF
+}
+
+// MarshalJSON implements json.Marshaler. The multi-SF channels are encoded
+// as chan_multiSF_0 - chan_multiSF_7.
+func (c SX1301Conf) MarshalJSON() ([]byte, error) {
+	out := map[string]interface{}{
+		"radio_0":       c.Radio0,
+		"radio_1":       c.Radio1,
+		"chan_FSK":      c.ChanFSK,
+		"chan_Lora_std": c.ChanLoRaStd,
+	}
+	for i := range c.ChanMultiSF {
+		out[fmt.Sprintf("chan_multiSF_%d", i)] = c.ChanMultiSF[i]
+	}
+	return json.Marshal(out)
+}
+
+// SX1301ConfRadio implements a SX1301 radio configuration.
+type SX1301ConfRadio struct {
+	Enable bool   `json:"enable"`
+	Freq   uint32 `json:"freq"`
+}
+
+// SX1301ConfChanMultiSF implements a SX1301 multi-SF channel configuration.
+type SX1301ConfChanMultiSF struct {
+	Enable bool `json:"enable"`
+	Radio  int  `json:"radio"`
+	IF     int  `json:"if"`
+}
+
+// SX1301ConfChanLoRaStd implements the SX1301 LoRa standard channel
+// configuration.
+type SX1301ConfChanLoRaStd struct {
+	Enable       bool `json:"enable"`
+	Radio        int  `json:"radio"`
+	IF           int  `json:"if"`
+	Bandwidth    int  `json:"bandwidth"`
+	SpreadFactor int  `json:"spread_factor"`
+}
+
+// SX1301ConfChanFSK implements the SX1301 FSK channel configuration.
+type SX1301ConfChanFSK struct {
+	Enable bool `json:"enable"`
+	Radio  int  `json:"radio"`
+	IF     int  `json:"if"`
+}
+
+// RadioMetaData contains the radio meta-data of an uplink.
+type RadioMetaData struct {
+	DR        int                 `json:"DR"`
+	Frequency uint32              `json:"Freq"`
+	UpInfo    RadioMetaDataUpInfo `json:"upinfo"`
+}
+
+// RadioMetaDataUpInfo contains the uplink info of the radio meta-data.
+type RadioMetaDataUpInfo struct {
+	RCtx    int64   `json:"rctx"`
+	XTime   int64   `json:"xtime"`
+	GPSTime int64   `json:"gpstime"`
+	RSSI    float64 `json:"rssi"`
+	SNR     float64 `json:"snr"`
+	RxTime  float64 `json:"rxtime"`
+}
+
+// UplinkDataFrame implements the updf message.
+type UplinkDataFrame struct {
+	RadioMetaData
+
+	MessageType MessageType `json:"msgtype"`
+	MHDR        uint8       `json:"MHdr"`
+	DevAddr     int32       `json:"DevAddr"`
+	FCtrl       uint8       `json:"FCtrl"`
+	FCnt        uint16      `json:"FCnt"`
+	FOpts       HEXBytes    `json:"FOpts"`
+	FPort       int         `json:"FPort"`
+	FRMPayload  HEXBytes    `json:"FRMPayload"`
+	MIC         int32       `json:"MIC"`
+}
+
+// JoinRequest implements the jreq message.
+type JoinRequest struct {
+	RadioMetaData
+
+	MessageType MessageType `json:"msgtype"`
+	MHDR        uint8       `json:"MHdr"`
+	JoinEUI     EUI64       `json:"JoinEui"`
+	DevEUI      EUI64       `json:"DevEui"`
+	DevNonce    uint16      `json:"DevNonce"`
+	MIC         int32       `json:"MIC"`
+}
+
+// ProprietaryDataFrame implements the propdf message.
+type ProprietaryDataFrame struct {
+	RadioMetaData
+
+	MessageType MessageType `json:"msgtype"`
+	FRMPayload  HEXBytes    `json:"FRMPayload"`
+}
+
+// DownlinkFrame implements the dnmsg message.
+type DownlinkFrame struct {
+	MessageType MessageType `json:"msgtype"`
+	DevEUI      EUI64       `json:"DevEui"`
+	DeviceClass uint8       `json:"dC"`
+	DIID        int64       `json:"diid"`
+	PDU         HEXBytes    `json:"pdu"`
+	Priority    int         `json:"priority"`
+	RCtx        *int64      `json:"rctx,omitempty"`
+
+	// Class A
+	RxDelay *int    `json:"RxDelay,omitempty"`
+	RX1DR   *int    `json:"RX1DR,omitempty"`
+	RX1Freq *uint32 `json:"RX1Freq,omitempty"`
+	RX2DR   *int    `json:"RX2DR,omitempty"`
+	RX2Freq *uint32 `json:"RX2Freq,omitempty"`
+	XTime   *int64  `json:"xtime,omitempty"`
+
+	// Class B
+	DR      *int    `json:"DR,omitempty"`
+	Freq    *uint32 `json:"Freq,omitempty"`
+	GPSTime *int64  `json:"gpstime,omitempty"`
+}
+
+// DownlinkTransmitted implements the dntxed message.
+type DownlinkTransmitted struct {
+	MessageType MessageType `json:"msgtype"`
+	DIID        int64       `json:"diid"`
+	DevEUI      EUI64       `json:"DevEui"`
+	RCtx        int64       `json:"rctx"`
+	XTime       int64       `json:"xtime"`
+	TxTime      float64     `json:"txtime"`
+	GPSTime     int64       `json:"gpstime"`
+}
+
+// TimeSyncRequest implements the timesync request message.
+type TimeSyncRequest struct {
+	MessageType MessageType `json:"msgtype"`
+	TxTime      int64       `json:"txtime"`
+}
+
+// TimeSyncResponse implements the timesync response message.
+type TimeSyncResponse struct {
+	MessageType MessageType `json:"msgtype"`
+	TxTime      int64       `json:"txtime"`
+	GPSTime     int64       `json:"gpstime"`
+}
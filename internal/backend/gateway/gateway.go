@@ -5,6 +5,8 @@ import (
 	"fmt"
 
 	"github.com/golang/protobuf/proto"
+
+	"github.com/brocaar/lorawan"
 	"github.com/kamicuu/chirpstack-api/go/v3/gw"
 )
 
@@ -31,6 +33,16 @@ type Gateway interface {
 	Close() error                                          // close the gateway backend.
 }
 
+// ConfigurationCapability is an optional interface which can be implemented
+// by a gateway backend which is able to push the gateway configuration to
+// gateways that do not announce this capability in their stats (e.g. through
+// the concentratord_version meta-data).
+type ConfigurationCapability interface {
+	// SupportsGatewayConfiguration returns true when the gateway configuration
+	// can be sent to the given gateway.
+	SupportsGatewayConfiguration(lorawan.EUI64) bool
+}
+
 // UpdateDownlinkFrame updates the downlink frame for backward compatibility.
 func UpdateDownlinkFrame(mode string, df *gw.DownlinkFrame) error {
 	if len(df.Items) == 0 {
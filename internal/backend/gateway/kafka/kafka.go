@@ -0,0 +1,502 @@
+// Package kafka implements a Kafka gateway backend. Gateway events are
+// consumed using a consumer group, so that multiple Network Server instances
+// can share the event topics. Gateway commands are published with the
+// Gateway ID as message key.
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/marshaler"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+)
+
+const publishTimeout = 5 * time.Second
+
+// eventTypes contains the event types consumed by the backend.
+var eventTypes = []string{"up", "stats", "ack"}
+
+// messageReader defines the interface for consuming the event messages.
+// This is implemented by *kafka.Reader.
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// messageWriter defines the interface for publishing the command messages.
+// This is implemented by *kafka.Writer.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Backend implements a Kafka backend.
+type Backend struct {
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	reader messageReader
+	writer messageWriter
+
+	// event topic to event type
+	eventTopics          map[string]string
+	commandTopicTemplate *template.Template
+
+	uplinkFrameChan   chan gw.UplinkFrame
+	gatewayStatsChan  chan gw.GatewayStats
+	downlinkTXAckChan chan gw.DownlinkTXAck
+
+	gatewayMarshalerMux sync.RWMutex
+	gatewayMarshaler    map[lorawan.EUI64]marshaler.Type
+	downMode            string
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(c config.Config) (gateway.Gateway, error) {
+	conf := c.NetworkServer.Gateway.Backend.Kafka
+
+	eventTopics, err := getEventTopics(conf.EventTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway/kafka: get event topics error")
+	}
+
+	var topics []string
+	for topic := range eventTopics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var tlsConfig *tls.Config
+	if conf.TLS {
+		tlsConfig, err = newTLSConfig(conf.CACert, conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "gateway/kafka: new tls config error")
+		}
+	}
+
+	dialer := kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+		TLS:       tlsConfig,
+	}
+	transport := kafka.Transport{
+		TLS: tlsConfig,
+	}
+	if conf.Username != "" {
+		mechanism := plain.Mechanism{
+			Username: conf.Username,
+			Password: conf.Password,
+		}
+		dialer.SASLMechanism = mechanism
+		transport.SASL = mechanism
+	}
+
+	log.WithFields(log.Fields{
+		"brokers":        conf.Brokers,
+		"consumer_group": conf.ConsumerGroup,
+		"event_topics":   topics,
+	}).Info("gateway/kafka: connecting to Kafka brokers")
+
+	// With a commit interval, CommitMessages only marks the messages as
+	// consumed and the offsets are committed in batches by the reader.
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:        conf.Brokers,
+		GroupID:        conf.ConsumerGroup,
+		GroupTopics:    topics,
+		Dialer:         &dialer,
+		CommitInterval: conf.CommitInterval,
+	})
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(conf.Brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireOne,
+		// Commands are written directly as these are time-critical.
+		BatchSize: 1,
+		Transport: &transport,
+	}
+
+	return newBackend(c, reader, writer)
+}
+
+func newBackend(c config.Config, reader messageReader, writer messageWriter) (*Backend, error) {
+	conf := c.NetworkServer.Gateway.Backend.Kafka
+	var err error
+
+	b := Backend{
+		reader:            reader,
+		writer:            writer,
+		uplinkFrameChan:   make(chan gw.UplinkFrame),
+		gatewayStatsChan:  make(chan gw.GatewayStats),
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+		gatewayMarshaler:  make(map[lorawan.EUI64]marshaler.Type),
+		downMode:          c.NetworkServer.Gateway.Backend.MultiDownlinkFeature,
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	b.eventTopics, err = getEventTopics(conf.EventTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway/kafka: get event topics error")
+	}
+
+	b.commandTopicTemplate, err = template.New("command").Parse(conf.CommandTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway/kafka: parse command topic template error")
+	}
+
+	b.wg.Add(1)
+	go b.eventLoop()
+
+	return &b, nil
+}
+
+func (b *Backend) SendTXPacket(pl gw.DownlinkFrame) error {
+	gatewayID := helpers.GetGatewayID(&pl)
+	downID := helpers.GetDownlinkID(&pl)
+	t := b.getGatewayMarshaler(gatewayID)
+
+	if err := gateway.UpdateDownlinkFrame(b.downMode, &pl); err != nil {
+		return errors.Wrap(err, "set downlink compatibility mode error")
+	}
+
+	bb, err := marshaler.MarshalDownlinkFrame(t, pl)
+	if err != nil {
+		return errors.Wrap(err, "gateway/kafka: marshal downlink frame error")
+	}
+
+	return b.publishCommand(log.Fields{
+		"downlink_id": downID,
+	}, gatewayID, "down", bb)
+}
+
+func (b *Backend) SendGatewayConfigPacket(pl gw.GatewayConfiguration) error {
+	gatewayID := helpers.GetGatewayID(&pl)
+	t := b.getGatewayMarshaler(gatewayID)
+
+	bb, err := marshaler.MarshalGatewayConfiguration(t, pl)
+	if err != nil {
+		return errors.Wrap(err, "gateway/kafka: marshal gateway configuration error")
+	}
+
+	return b.publishCommand(log.Fields{}, gatewayID, "config", bb)
+}
+
+func (b *Backend) RXPacketChan() chan gw.UplinkFrame {
+	return b.uplinkFrameChan
+}
+
+func (b *Backend) StatsPacketChan() chan gw.GatewayStats {
+	return b.gatewayStatsChan
+}
+
+func (b *Backend) DownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+func (b *Backend) Close() error {
+	log.Info("gateway/kafka: closing backend")
+
+	b.cancel()
+	if err := b.reader.Close(); err != nil {
+		return errors.Wrap(err, "close reader error")
+	}
+	b.wg.Wait()
+
+	if err := b.writer.Close(); err != nil {
+		return errors.Wrap(err, "close writer error")
+	}
+
+	close(b.uplinkFrameChan)
+	close(b.gatewayStatsChan)
+	close(b.downlinkTXAckChan)
+
+	return nil
+}
+
+func (b *Backend) publishCommand(fields log.Fields, gatewayID lorawan.EUI64, command string, data []byte) error {
+	templateCtx := struct {
+		GatewayID   lorawan.EUI64
+		CommandType string
+	}{gatewayID, command}
+	topic := bytes.NewBuffer(nil)
+	if err := b.commandTopicTemplate.Execute(topic, templateCtx); err != nil {
+		return errors.Wrap(err, "execute command topic error")
+	}
+
+	fields["gateway_id"] = gatewayID
+	fields["command"] = command
+	fields["topic"] = topic.String()
+
+	kafkaCommandCounter(command).Inc()
+
+	ctx, cancel := context.WithTimeout(b.ctx, publishTimeout)
+	defer cancel()
+
+	err := b.writer.WriteMessages(ctx, kafka.Message{
+		Topic: topic.String(),
+		Key:   []byte(gatewayID.String()),
+		Value: data,
+	})
+	if err != nil {
+		return errors.Wrap(err, "write message error")
+	}
+
+	log.WithFields(fields).Info("gateway/kafka: gateway command published")
+
+	return nil
+}
+
+func (b *Backend) eventLoop() {
+	defer b.wg.Done()
+
+	log.Info("gateway/kafka: start consuming gateway events")
+
+	for {
+		msg, err := b.reader.FetchMessage(b.ctx)
+		if err != nil {
+			// the backend is closing
+			if b.ctx.Err() != nil {
+				return
+			}
+
+			log.WithError(err).Error("gateway/kafka: fetch message error")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		b.handleMessage(msg)
+
+		// Messages that could not be handled are committed too, as
+		// consuming these again would result in the same error.
+		if err := b.reader.CommitMessages(b.ctx, msg); err != nil && b.ctx.Err() == nil {
+			log.WithError(err).WithFields(log.Fields{
+				"topic":     msg.Topic,
+				"partition": msg.Partition,
+				"offset":    msg.Offset,
+			}).Error("gateway/kafka: commit message error")
+		}
+	}
+}
+
+func (b *Backend) handleMessage(msg kafka.Message) {
+	var err error
+
+	typ := b.eventTopics[msg.Topic]
+
+	switch typ {
+	case "up":
+		kafkaEventCounter("up").Inc()
+		err = b.handleUplinkFrame(msg)
+	case "ack":
+		kafkaEventCounter("ack").Inc()
+		err = b.handleDownlinkTXAck(msg)
+	case "stats":
+		kafkaEventCounter("stats").Inc()
+		err = b.handleGatewayStats(msg)
+	default:
+		log.WithFields(log.Fields{
+			"topic": msg.Topic,
+		}).Warning("gateway/kafka: unexpected event topic")
+	}
+
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"type":  typ,
+			"topic": msg.Topic,
+		}).Error("gateway/kafka: handle event error")
+	}
+}
+
+func (b *Backend) handleUplinkFrame(msg kafka.Message) error {
+	var uplinkFrame gw.UplinkFrame
+	t, err := marshaler.UnmarshalUplinkFrame(msg.Value, &uplinkFrame)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	if uplinkFrame.RxInfo == nil {
+		return errors.New("rx_info must not be nil")
+	}
+
+	if uplinkFrame.TxInfo == nil {
+		return errors.New("tx_info must not be nil")
+	}
+
+	gatewayID := helpers.GetGatewayID(uplinkFrame.GetRxInfo())
+	if err := validateGatewayID(msg.Key, gatewayID); err != nil {
+		return errors.Wrap(err, "validate gateway ID error")
+	}
+
+	b.setGatewayMarshaler(gatewayID, t)
+
+	upID := helpers.GetUplinkID(uplinkFrame.GetRxInfo())
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"uplink_id":  upID,
+	}).Info("gateway/kafka: uplink event received")
+
+	select {
+	case b.uplinkFrameChan <- uplinkFrame:
+	case <-b.ctx.Done():
+	}
+
+	return nil
+}
+
+func (b *Backend) handleDownlinkTXAck(msg kafka.Message) error {
+	var downlinkTXAck gw.DownlinkTXAck
+	t, err := marshaler.UnmarshalDownlinkTXAck(msg.Value, &downlinkTXAck)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	gatewayID := helpers.GetGatewayID(&downlinkTXAck)
+	if err := validateGatewayID(msg.Key, gatewayID); err != nil {
+		return errors.Wrap(err, "validate gateway ID error")
+	}
+
+	b.setGatewayMarshaler(gatewayID, t)
+
+	downID := helpers.GetDownlinkID(&downlinkTXAck)
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": downID,
+	}).Info("gateway/kafka: ack event received")
+
+	select {
+	case b.downlinkTXAckChan <- downlinkTXAck:
+	case <-b.ctx.Done():
+	}
+
+	return nil
+}
+
+func (b *Backend) handleGatewayStats(msg kafka.Message) error {
+	var gatewayStats gw.GatewayStats
+	t, err := marshaler.UnmarshalGatewayStats(msg.Value, &gatewayStats)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal error")
+	}
+
+	gatewayID := helpers.GetGatewayID(&gatewayStats)
+	if err := validateGatewayID(msg.Key, gatewayID); err != nil {
+		return errors.Wrap(err, "validate gateway ID error")
+	}
+
+	b.setGatewayMarshaler(gatewayID, t)
+
+	statsID := helpers.GetStatsID(&gatewayStats)
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"stats_id":   statsID,
+	}).Info("gateway/kafka: stats event received")
+
+	select {
+	case b.gatewayStatsChan <- gatewayStats:
+	case <-b.ctx.Done():
+	}
+
+	return nil
+}
+
+func (b *Backend) setGatewayMarshaler(gatewayID lorawan.EUI64, t marshaler.Type) {
+	b.gatewayMarshalerMux.Lock()
+	defer b.gatewayMarshalerMux.Unlock()
+
+	b.gatewayMarshaler[gatewayID] = t
+}
+
+func (b *Backend) getGatewayMarshaler(gatewayID lorawan.EUI64) marshaler.Type {
+	b.gatewayMarshalerMux.RLock()
+	defer b.gatewayMarshalerMux.RUnlock()
+
+	return b.gatewayMarshaler[gatewayID]
+}
+
+// getEventTopics returns the event topics (mapped to the event type) for
+// the given event topic template.
+func getEventTopics(eventTopicTemplate string) (map[string]string, error) {
+	t, err := template.New("event").Parse(eventTopicTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse event topic template error")
+	}
+
+	out := make(map[string]string)
+	for _, typ := range eventTypes {
+		topic := bytes.NewBuffer(nil)
+		if err := t.Execute(topic, struct{ EventType string }{typ}); err != nil {
+			return nil, errors.Wrap(err, "execute event topic template error")
+		}
+
+		if _, ok := out[topic.String()]; ok {
+			return nil, errors.New("event topic template must result in a topic per event type")
+		}
+		out[topic.String()] = typ
+	}
+
+	return out, nil
+}
+
+// validateGatewayID validates that the message key, which contains the
+// Gateway ID, matches the Gateway ID of the event.
+func validateGatewayID(key []byte, gatewayID lorawan.EUI64) error {
+	var id lorawan.EUI64
+	if err := id.UnmarshalText(key); err != nil {
+		return errors.Wrap(err, "unmarshal gateway id error")
+	}
+
+	if gatewayID != id {
+		return errors.New("message gateway ID does not match key gateway ID")
+	}
+
+	return nil
+}
+
+func newTLSConfig(caCert, tlsCert, tlsKey string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if caCert != "" {
+		b, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca certificate error")
+		}
+
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(b) {
+			return nil, errors.New("append ca certificate error")
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if tlsCert != "" || tlsKey != "" {
+		kp, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "load tls key-pair error")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,256 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway/marshaler"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+// fakeBroker implements an in-process fake Kafka broker, implementing both
+// the messageReader and messageWriter interfaces.
+type fakeBroker struct {
+	mux       sync.Mutex
+	committed []kafka.Message
+
+	events   chan kafka.Message
+	commands chan kafka.Message
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{
+		events:   make(chan kafka.Message, 10),
+		commands: make(chan kafka.Message, 10),
+	}
+}
+
+func (f *fakeBroker) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case msg := <-f.events:
+		return msg, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (f *fakeBroker) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.committed = append(f.committed, msgs...)
+	return nil
+}
+
+func (f *fakeBroker) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	for _, msg := range msgs {
+		f.commands <- msg
+	}
+	return nil
+}
+
+func (f *fakeBroker) Close() error {
+	return nil
+}
+
+func (f *fakeBroker) committedCount() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return len(f.committed)
+}
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	gatewayID lorawan.EUI64
+	broker    *fakeBroker
+	backend   *Backend
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	var err error
+	assert := require.New(ts.T())
+
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	ts.broker = newFakeBroker()
+	ts.backend, err = newBackend(test.GetConfig(), ts.broker, ts.broker)
+	assert.NoError(err)
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	assert := require.New(ts.T())
+	assert.NoError(ts.backend.Close())
+}
+
+func (ts *BackendTestSuite) TestUplinkEvent() {
+	assert := require.New(ts.T())
+
+	up := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+		},
+		TxInfo: &gw.UplinkTXInfo{
+			Frequency: 868100000,
+		},
+	}
+	b, err := proto.Marshal(&up)
+	assert.NoError(err)
+
+	ts.broker.events <- kafka.Message{
+		Topic: "gateway.event.up",
+		Key:   []byte(ts.gatewayID.String()),
+		Value: b,
+	}
+
+	received := <-ts.backend.RXPacketChan()
+	assert.True(proto.Equal(&up, &received))
+	assert.Equal(marshaler.Protobuf, ts.backend.getGatewayMarshaler(ts.gatewayID))
+
+	assert.Eventually(func() bool {
+		return ts.broker.committedCount() == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (ts *BackendTestSuite) TestUplinkEventGatewayIDMismatch() {
+	assert := require.New(ts.T())
+
+	up := gw.UplinkFrame{
+		PhyPayload: []byte{1, 2, 3, 4},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: ts.gatewayID[:],
+		},
+		TxInfo: &gw.UplinkTXInfo{},
+	}
+	b, err := proto.Marshal(&up)
+	assert.NoError(err)
+
+	ts.broker.events <- kafka.Message{
+		Topic: "gateway.event.up",
+		Key:   []byte("0807060504030201"),
+		Value: b,
+	}
+
+	// the invalid message is committed, but not forwarded
+	assert.Eventually(func() bool {
+		return ts.broker.committedCount() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	select {
+	case <-ts.backend.RXPacketChan():
+		assert.Fail("unexpected uplink frame")
+	default:
+	}
+}
+
+func (ts *BackendTestSuite) TestGatewayStatsEvent() {
+	assert := require.New(ts.T())
+
+	stats := gw.GatewayStats{
+		GatewayId: ts.gatewayID[:],
+	}
+	var m jsonpb.Marshaler
+	str, err := m.MarshalToString(&stats)
+	assert.NoError(err)
+
+	ts.broker.events <- kafka.Message{
+		Topic: "gateway.event.stats",
+		Key:   []byte(ts.gatewayID.String()),
+		Value: []byte(str),
+	}
+
+	received := <-ts.backend.StatsPacketChan()
+	assert.True(proto.Equal(&stats, &received))
+	assert.Equal(marshaler.JSON, ts.backend.getGatewayMarshaler(ts.gatewayID))
+}
+
+func (ts *BackendTestSuite) TestDownlinkTXAckEvent() {
+	assert := require.New(ts.T())
+
+	ack := gw.DownlinkTXAck{
+		GatewayId: ts.gatewayID[:],
+		Token:     12345,
+	}
+	b, err := proto.Marshal(&ack)
+	assert.NoError(err)
+
+	ts.broker.events <- kafka.Message{
+		Topic: "gateway.event.ack",
+		Key:   []byte(ts.gatewayID.String()),
+		Value: b,
+	}
+
+	received := <-ts.backend.DownlinkTXAckChan()
+	assert.True(proto.Equal(&ack, &received))
+}
+
+func (ts *BackendTestSuite) TestDownlinkCommand() {
+	assert := require.New(ts.T())
+	ts.backend.setGatewayMarshaler(ts.gatewayID, marshaler.Protobuf)
+
+	pl := gw.DownlinkFrame{
+		GatewayId: ts.gatewayID[:],
+		Items: []*gw.DownlinkFrameItem{
+			{
+				PhyPayload: []byte{1, 2, 3, 4},
+				TxInfo:     &gw.DownlinkTXInfo{},
+			},
+		},
+	}
+	assert.NoError(ts.backend.SendTXPacket(pl))
+
+	received := <-ts.broker.commands
+	assert.Equal("gateway.command.down", received.Topic)
+	assert.Equal([]byte(ts.gatewayID.String()), received.Key)
+
+	var receivedPL gw.DownlinkFrame
+	assert.NoError(proto.Unmarshal(received.Value, &receivedPL))
+	assert.True(proto.Equal(&pl, &receivedPL))
+}
+
+func (ts *BackendTestSuite) TestGatewayConfigurationCommand() {
+	assert := require.New(ts.T())
+	ts.backend.setGatewayMarshaler(ts.gatewayID, marshaler.JSON)
+
+	pl := gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+		Version:   "1.2.3",
+	}
+	assert.NoError(ts.backend.SendGatewayConfigPacket(pl))
+
+	received := <-ts.broker.commands
+	assert.Equal("gateway.command.config", received.Topic)
+	assert.Equal([]byte(ts.gatewayID.String()), received.Key)
+
+	var receivedPL gw.GatewayConfiguration
+	assert.NoError(jsonpb.UnmarshalString(string(received.Value), &receivedPL))
+	assert.True(proto.Equal(&pl, &receivedPL))
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
+
+func TestGetEventTopics(t *testing.T) {
+	assert := require.New(t)
+
+	topics, err := getEventTopics("gateway.event.{{ .EventType }}")
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"gateway.event.up":    "up",
+		"gateway.event.stats": "stats",
+		"gateway.event.ack":   "ack",
+	}, topics)
+
+	_, err = getEventTopics("gateway.events")
+	assert.Error(err)
+}
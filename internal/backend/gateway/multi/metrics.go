@@ -0,0 +1,35 @@
+package multi
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_multi_event_count",
+		Help: "The number of received gateway events (per backend and event type).",
+	}, []string{"backend", "event"})
+
+	cc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_multi_command_count",
+		Help: "The number of routed gateway commands (per backend and command type).",
+	}, []string{"backend", "command"})
+
+	nrc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "backend_multi_no_route_count",
+		Help: "The number of gateway commands which could not be routed to a backend.",
+	})
+)
+
+func eventCounter(backend, event string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"backend": backend, "event": event})
+}
+
+func commandCounter(backend, command string) prometheus.Counter {
+	return cc.With(prometheus.Labels{"backend": backend, "command": command})
+}
+
+func noRouteCounter() prometheus.Counter {
+	return nrc
+}
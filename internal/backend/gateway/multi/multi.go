@@ -0,0 +1,290 @@
+// Package multi implements a gateway backend which combines multiple gateway
+// backends. Uplink, stats and ack events are received from all backends,
+// commands are routed to the backend on which the gateway was last seen.
+// The last-seen backend is stored in Redis, so that it is shared by all
+// Network Server instances and survives restarts.
+package multi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+const gatewayBackendKeyTempl = "lora:ns:gw:%s:backend"
+
+// ErrNoRoute is returned when it is unknown to which backend the command
+// must be routed.
+var ErrNoRoute = errors.New("no gateway backend known for gateway")
+
+// Backend implements a composite gateway backend.
+type Backend struct {
+	wg sync.WaitGroup
+
+	backends map[string]gateway.Gateway
+	routes   map[lorawan.EUI64]string
+	routeTTL time.Duration
+
+	// lastSeen contains the last-seen backend as stored in Redis by this
+	// instance, this avoids a Redis write for every gateway event.
+	lastSeenMux sync.RWMutex
+	lastSeen    map[lorawan.EUI64]lastSeen
+
+	uplinkFrameChan   chan gw.UplinkFrame
+	gatewayStatsChan  chan gw.GatewayStats
+	downlinkTXAckChan chan gw.DownlinkTXAck
+}
+
+type lastSeen struct {
+	backend string
+	seenAt  time.Time
+
+	// stored is set when the route has been written to Redis.
+	stored bool
+}
+
+// NewBackend creates a new Backend for the given (named) backends and static
+// routes. The backend on which a gateway was last seen is stored for the
+// given route TTL.
+func NewBackend(backends map[string]gateway.Gateway, routes []config.GatewayBackendRoute, routeTTL time.Duration) (*Backend, error) {
+	b := Backend{
+		backends:          backends,
+		routes:            make(map[lorawan.EUI64]string),
+		routeTTL:          routeTTL,
+		lastSeen:          make(map[lorawan.EUI64]lastSeen),
+		uplinkFrameChan:   make(chan gw.UplinkFrame),
+		gatewayStatsChan:  make(chan gw.GatewayStats),
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+	}
+
+	for _, r := range routes {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(r.GatewayID)); err != nil {
+			return nil, errors.Wrapf(err, "decode gateway_id error: %s", r.GatewayID)
+		}
+
+		if _, ok := backends[r.Backend]; !ok {
+			return nil, fmt.Errorf("route for gateway %s refers to unknown backend: %s", gatewayID, r.Backend)
+		}
+
+		b.routes[gatewayID] = r.Backend
+	}
+
+	for name, backend := range backends {
+		b.wg.Add(3)
+		go b.uplinkFrameLoop(name, backend)
+		go b.gatewayStatsLoop(name, backend)
+		go b.downlinkTXAckLoop(name, backend)
+	}
+
+	return &b, nil
+}
+
+// SendTXPacket sends the downlink frame using the backend of the gateway.
+func (b *Backend) SendTXPacket(pl gw.DownlinkFrame) error {
+	name, backend, err := b.getBackend(helpers.GetGatewayID(&pl))
+	if err != nil {
+		return err
+	}
+
+	commandCounter(name, "down").Inc()
+	return backend.SendTXPacket(pl)
+}
+
+// SendGatewayConfigPacket sends the gateway configuration using the backend
+// of the gateway.
+func (b *Backend) SendGatewayConfigPacket(pl gw.GatewayConfiguration) error {
+	name, backend, err := b.getBackend(helpers.GetGatewayID(&pl))
+	if err != nil {
+		return err
+	}
+
+	commandCounter(name, "config").Inc()
+	return backend.SendGatewayConfigPacket(pl)
+}
+
+// SupportsGatewayConfiguration returns true when the backend of the gateway
+// is able to send the gateway configuration to the gateway.
+func (b *Backend) SupportsGatewayConfiguration(gatewayID lorawan.EUI64) bool {
+	_, backend, err := b.getBackend(gatewayID)
+	if err != nil {
+		return false
+	}
+
+	c, ok := backend.(gateway.ConfigurationCapability)
+	return ok && c.SupportsGatewayConfiguration(gatewayID)
+}
+
+func (b *Backend) RXPacketChan() chan gw.UplinkFrame {
+	return b.uplinkFrameChan
+}
+
+func (b *Backend) StatsPacketChan() chan gw.GatewayStats {
+	return b.gatewayStatsChan
+}
+
+func (b *Backend) DownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+// Close closes all the backends. A backend which fails to close does not
+// prevent the other backends from being closed, the errors are combined.
+func (b *Backend) Close() error {
+	log.Info("gateway/multi: closing gateway backends")
+
+	var errs []string
+	for name, backend := range b.backends {
+		if err := backend.Close(); err != nil {
+			log.WithError(err).WithField("backend", name).Error("gateway/multi: close gateway backend error")
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("close gateway backends error: %s", strings.Join(errs, ", "))
+	}
+
+	// The event loops only return once all backends have been closed.
+	b.wg.Wait()
+
+	close(b.uplinkFrameChan)
+	close(b.gatewayStatsChan)
+	close(b.downlinkTXAckChan)
+
+	return nil
+}
+
+// GetBackendName returns the name of the backend to which the commands of
+// the given gateway are routed.
+func (b *Backend) GetBackendName(gatewayID lorawan.EUI64) (string, error) {
+	name, _, err := b.getBackend(gatewayID)
+	return name, err
+}
+
+func (b *Backend) getBackend(gatewayID lorawan.EUI64) (string, gateway.Gateway, error) {
+	if name, ok := b.routes[gatewayID]; ok {
+		return name, b.backends[name], nil
+	}
+
+	name, err := b.getLastSeen(gatewayID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	backend, ok := b.backends[name]
+	if !ok {
+		// the gateway was seen on a backend which is not configured
+		// (anymore) by this instance
+		noRouteCounter().Inc()
+		return "", nil, errors.Wrapf(ErrNoRoute, "%s (backend %s)", gatewayID, name)
+	}
+
+	return name, backend, nil
+}
+
+// getLastSeen returns the backend on which the gateway was last seen. In
+// case Redis is not available, this falls back to the last-seen backend as
+// known by this instance.
+func (b *Backend) getLastSeen(gatewayID lorawan.EUI64) (string, error) {
+	key := storage.GetRedisKey(gatewayBackendKeyTempl, gatewayID)
+	name, err := storage.RedisClient().Get(context.Background(), key).Result()
+	if err == nil {
+		return name, nil
+	}
+
+	if err != redis.Nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("gateway/multi: get gateway backend error")
+
+		b.lastSeenMux.RLock()
+		ls, ok := b.lastSeen[gatewayID]
+		b.lastSeenMux.RUnlock()
+
+		if ok && time.Since(ls.seenAt) < b.routeTTL {
+			return ls.backend, nil
+		}
+	}
+
+	noRouteCounter().Inc()
+	return "", errors.Wrap(ErrNoRoute, gatewayID.String())
+}
+
+// setLastSeen stores the backend on which the gateway was seen. The route is
+// only written to Redis when the gateway moved to an other backend or when
+// half of the route TTL has elapsed.
+func (b *Backend) setLastSeen(gatewayID lorawan.EUI64, name string) {
+	b.lastSeenMux.RLock()
+	prev, ok := b.lastSeen[gatewayID]
+	b.lastSeenMux.RUnlock()
+
+	if ok && prev.stored && prev.backend == name && time.Since(prev.seenAt) < b.routeTTL/2 {
+		return
+	}
+
+	ls := lastSeen{
+		backend: name,
+		seenAt:  time.Now(),
+		stored:  true,
+	}
+
+	// on error, the write is retried on the next event of the gateway
+	key := storage.GetRedisKey(gatewayBackendKeyTempl, gatewayID)
+	if err := storage.RedisClient().Set(context.Background(), key, name, b.routeTTL).Err(); err != nil {
+		log.WithError(err).WithField("gateway_id", gatewayID).Error("gateway/multi: set gateway backend error")
+		ls.stored = false
+	}
+
+	b.lastSeenMux.Lock()
+	b.lastSeen[gatewayID] = ls
+	b.lastSeenMux.Unlock()
+
+	if ok && prev.backend != name {
+		log.WithFields(log.Fields{
+			"gateway_id":   gatewayID,
+			"backend":      name,
+			"prev_backend": prev.backend,
+		}).Info("gateway/multi: gateway moved to other backend")
+	}
+}
+
+func (b *Backend) uplinkFrameLoop(name string, backend gateway.Gateway) {
+	defer b.wg.Done()
+
+	for uplinkFrame := range backend.RXPacketChan() {
+		eventCounter(name, "up").Inc()
+		b.setLastSeen(helpers.GetGatewayID(uplinkFrame.RxInfo), name)
+		b.uplinkFrameChan <- uplinkFrame
+	}
+}
+
+func (b *Backend) gatewayStatsLoop(name string, backend gateway.Gateway) {
+	defer b.wg.Done()
+
+	for stats := range backend.StatsPacketChan() {
+		eventCounter(name, "stats").Inc()
+		b.setLastSeen(helpers.GetGatewayID(&stats), name)
+		b.gatewayStatsChan <- stats
+	}
+}
+
+func (b *Backend) downlinkTXAckLoop(name string, backend gateway.Gateway) {
+	defer b.wg.Done()
+
+	for ack := range backend.DownlinkTXAckChan() {
+		eventCounter(name, "ack").Inc()
+		b.setLastSeen(helpers.GetGatewayID(&ack), name)
+		b.downlinkTXAckChan <- ack
+	}
+}
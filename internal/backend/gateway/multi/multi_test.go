@@ -0,0 +1,191 @@
+package multi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+type testBackend struct {
+	uplinkFrameChan   chan gw.UplinkFrame
+	gatewayStatsChan  chan gw.GatewayStats
+	downlinkTXAckChan chan gw.DownlinkTXAck
+
+	txPacketChan chan gw.DownlinkFrame
+	configChan   chan gw.GatewayConfiguration
+
+	closeErr error
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{
+		uplinkFrameChan:   make(chan gw.UplinkFrame),
+		gatewayStatsChan:  make(chan gw.GatewayStats),
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+		txPacketChan:      make(chan gw.DownlinkFrame, 10),
+		configChan:        make(chan gw.GatewayConfiguration, 10),
+	}
+}
+
+func (b *testBackend) SendTXPacket(pl gw.DownlinkFrame) error {
+	b.txPacketChan <- pl
+	return nil
+}
+
+func (b *testBackend) SendGatewayConfigPacket(pl gw.GatewayConfiguration) error {
+	b.configChan <- pl
+	return nil
+}
+
+func (b *testBackend) RXPacketChan() chan gw.UplinkFrame {
+	return b.uplinkFrameChan
+}
+
+func (b *testBackend) StatsPacketChan() chan gw.GatewayStats {
+	return b.gatewayStatsChan
+}
+
+func (b *testBackend) DownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+func (b *testBackend) Close() error {
+	if b.closeErr != nil {
+		return b.closeErr
+	}
+
+	close(b.uplinkFrameChan)
+	close(b.gatewayStatsChan)
+	close(b.downlinkTXAckChan)
+	return nil
+}
+
+func TestBackend(t *testing.T) {
+	assert := require.New(t)
+
+	conf := test.GetConfig()
+	assert.NoError(storage.Setup(conf))
+	assert.NoError(storage.RedisClient().FlushAll(context.Background()).Err())
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	staticGatewayID := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	mqtt := newTestBackend()
+	basicStation := newTestBackend()
+
+	_, err := NewBackend(map[string]gateway.Gateway{
+		"mqtt": mqtt,
+	}, []config.GatewayBackendRoute{
+		{GatewayID: staticGatewayID.String(), Backend: "basic_station"},
+	}, time.Hour)
+	assert.Error(err)
+
+	b, err := NewBackend(map[string]gateway.Gateway{
+		"mqtt":          mqtt,
+		"basic_station": basicStation,
+	}, []config.GatewayBackendRoute{
+		{GatewayID: staticGatewayID.String(), Backend: "basic_station"},
+	}, time.Hour)
+	assert.NoError(err)
+
+	t.Run("No route", func(t *testing.T) {
+		assert := require.New(t)
+
+		err := b.SendTXPacket(gw.DownlinkFrame{GatewayId: gatewayID[:]})
+		assert.Equal(ErrNoRoute, errors.Cause(err))
+	})
+
+	t.Run("Static route", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(b.SendGatewayConfigPacket(gw.GatewayConfiguration{GatewayId: staticGatewayID[:]}))
+		pl := <-basicStation.configChan
+		assert.Equal(staticGatewayID[:], pl.GatewayId)
+	})
+
+	t.Run("Uplink on mqtt", func(t *testing.T) {
+		assert := require.New(t)
+
+		mqtt.uplinkFrameChan <- gw.UplinkFrame{RxInfo: &gw.UplinkRXInfo{GatewayId: gatewayID[:]}}
+		up := <-b.RXPacketChan()
+		assert.Equal(gatewayID[:], up.RxInfo.GatewayId)
+
+		name, err := b.GetBackendName(gatewayID)
+		assert.NoError(err)
+		assert.Equal("mqtt", name)
+
+		assert.NoError(b.SendTXPacket(gw.DownlinkFrame{GatewayId: gatewayID[:]}))
+		pl := <-mqtt.txPacketChan
+		assert.Equal(gatewayID[:], pl.GatewayId)
+	})
+
+	t.Run("Gateway moved to basic_station", func(t *testing.T) {
+		assert := require.New(t)
+
+		basicStation.gatewayStatsChan <- gw.GatewayStats{GatewayId: gatewayID[:]}
+		<-b.StatsPacketChan()
+
+		assert.NoError(b.SendTXPacket(gw.DownlinkFrame{GatewayId: gatewayID[:]}))
+		pl := <-basicStation.txPacketChan
+		assert.Equal(gatewayID[:], pl.GatewayId)
+	})
+
+	t.Run("Static route overrides last seen", func(t *testing.T) {
+		assert := require.New(t)
+
+		mqtt.downlinkTXAckChan <- gw.DownlinkTXAck{GatewayId: staticGatewayID[:]}
+		<-b.DownlinkTXAckChan()
+
+		name, err := b.GetBackendName(staticGatewayID)
+		assert.NoError(err)
+		assert.Equal("basic_station", name)
+	})
+
+	t.Run("Route is shared with other instances", func(t *testing.T) {
+		assert := require.New(t)
+
+		other, err := NewBackend(map[string]gateway.Gateway{
+			"mqtt":          newTestBackend(),
+			"basic_station": newTestBackend(),
+		}, nil, time.Hour)
+		assert.NoError(err)
+
+		name, err := other.GetBackendName(gatewayID)
+		assert.NoError(err)
+		assert.Equal("basic_station", name)
+
+		assert.NoError(other.Close())
+	})
+
+	t.Run("Close error", func(t *testing.T) {
+		assert := require.New(t)
+
+		failing := newTestBackend()
+		failing.closeErr = errors.New("close failed")
+		closing := newTestBackend()
+
+		other, err := NewBackend(map[string]gateway.Gateway{
+			"mqtt":          failing,
+			"basic_station": closing,
+		}, nil, time.Hour)
+		assert.NoError(err)
+
+		assert.Error(other.Close())
+
+		// the other backend has been closed
+		_, ok := <-closing.uplinkFrameChan
+		assert.False(ok)
+	})
+
+	assert.NoError(b.Close())
+}
@@ -0,0 +1,524 @@
+// Package semtechudp implements a gateway backend using the Semtech UDP
+// packet-forwarder protocol, so that packet-forwarders can connect to the
+// Network Server without a ChirpStack Gateway Bridge in between.
+package semtechudp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+)
+
+const (
+	// gatewayCleanupDuration defines the duration after which a gateway
+	// is removed when no PULL_DATA was received.
+	gatewayCleanupDuration = time.Minute
+
+	// downlinkCleanupDuration defines the duration after which a pending
+	// downlink is removed when no TX_ACK was received.
+	downlinkCleanupDuration = time.Minute
+
+	cleanupInterval = 10 * time.Second
+)
+
+// Errors
+var (
+	ErrGatewayNotConnected         = errors.New("gateway is not connected")
+	ErrConfigurationNotSupported   = errors.New("gateway configuration is not supported by the Semtech UDP protocol")
+	ErrDownlinkItemsMustNotBeEmpty = errors.New("items must contain at least one item")
+)
+
+// gatewayConn contains the connection state of a gateway.
+type gatewayConn struct {
+	addr            *net.UDPAddr
+	protocolVersion uint8
+	lastSeen        time.Time
+}
+
+type downlinkKey struct {
+	gatewayID lorawan.EUI64
+	token     uint16
+}
+
+// pendingDownlink contains a downlink for which the TX_ACK is pending.
+type pendingDownlink struct {
+	frame     gw.DownlinkFrame
+	index     int
+	ackItems  []*gw.DownlinkTXAckItem
+	expiresAt time.Time
+}
+
+// Backend implements a Semtech UDP packet-forwarder backend.
+type Backend struct {
+	wg   sync.WaitGroup
+	conn *net.UDPConn
+	done chan struct{}
+
+	uplinkFrameChan   chan gw.UplinkFrame
+	gatewayStatsChan  chan gw.GatewayStats
+	downlinkTXAckChan chan gw.DownlinkTXAck
+
+	gatewaysMux sync.RWMutex
+	gateways    map[lorawan.EUI64]gatewayConn
+
+	downlinksMux sync.Mutex
+	downlinks    map[downlinkKey]*pendingDownlink
+
+	skipCRCCheck bool
+	fakeRxTime   bool
+}
+
+// NewBackend creates a new Backend.
+func NewBackend(c config.Config) (gateway.Gateway, error) {
+	conf := c.NetworkServer.Gateway.Backend.SemtechUDP
+
+	addr, err := net.ResolveUDPAddr("udp", conf.UDPBind)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway/semtech_udp: resolve udp addr error")
+	}
+
+	log.WithField("addr", addr).Info("gateway/semtech_udp: starting gateway udp listener")
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "gateway/semtech_udp: listen udp error")
+	}
+
+	b := Backend{
+		conn:              conn,
+		done:              make(chan struct{}),
+		uplinkFrameChan:   make(chan gw.UplinkFrame),
+		gatewayStatsChan:  make(chan gw.GatewayStats),
+		downlinkTXAckChan: make(chan gw.DownlinkTXAck),
+		gateways:          make(map[lorawan.EUI64]gatewayConn),
+		downlinks:         make(map[downlinkKey]*pendingDownlink),
+		skipCRCCheck:      conf.SkipCRCCheck,
+		fakeRxTime:        conf.FakeRxTime,
+	}
+
+	b.wg.Add(2)
+	go b.readPackets()
+	go b.cleanupLoop()
+
+	return &b, nil
+}
+
+// SendTXPacket sends the first item of the given downlink frame to the
+// gateway. When the gateway rejects the item, the next item is sent.
+func (b *Backend) SendTXPacket(pl gw.DownlinkFrame) error {
+	if len(pl.Items) == 0 {
+		return ErrDownlinkItemsMustNotBeEmpty
+	}
+
+	gatewayID := helpers.GetGatewayID(&pl)
+	key := downlinkKey{
+		gatewayID: gatewayID,
+		token:     uint16(pl.Token),
+	}
+
+	p := pendingDownlink{
+		frame:     pl,
+		ackItems:  make([]*gw.DownlinkTXAckItem, len(pl.Items)),
+		expiresAt: time.Now().Add(downlinkCleanupDuration),
+	}
+	for i := range p.ackItems {
+		p.ackItems[i] = &gw.DownlinkTXAckItem{
+			Status: gw.TxAckStatus_IGNORED,
+		}
+	}
+
+	// The pending downlink must be stored before sending the PULL_RESP, as
+	// the TX_ACK might be received before sendPullResp returns.
+	b.downlinksMux.Lock()
+	b.downlinks[key] = &p
+	b.downlinksMux.Unlock()
+
+	protocolVersion, err := b.sendPullResp(gatewayID, key.token, pl.Items[0])
+	if err != nil {
+		b.deletePendingDownlink(key)
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"downlink_id": helpers.GetDownlinkID(&pl),
+	}).Info("gateway/semtech_udp: downlink sent to gateway")
+
+	// Protocol version 1 does not implement the TX_ACK packet, we
+	// acknowledge the downlink directly.
+	if protocolVersion == ProtocolVersion1 {
+		b.deletePendingDownlink(key)
+		p.ackItems[0].Status = gw.TxAckStatus_OK
+		b.sendDownlinkTXAck(p)
+		return nil
+	}
+
+	return nil
+}
+
+func (b *Backend) deletePendingDownlink(key downlinkKey) {
+	b.downlinksMux.Lock()
+	delete(b.downlinks, key)
+	b.downlinksMux.Unlock()
+}
+
+// SendGatewayConfigPacket is not supported by the Semtech UDP protocol.
+func (b *Backend) SendGatewayConfigPacket(pl gw.GatewayConfiguration) error {
+	return ErrConfigurationNotSupported
+}
+
+// SupportsGatewayConfiguration returns false as the Semtech UDP protocol does
+// not define a configuration message.
+func (b *Backend) SupportsGatewayConfiguration(gatewayID lorawan.EUI64) bool {
+	return false
+}
+
+func (b *Backend) RXPacketChan() chan gw.UplinkFrame {
+	return b.uplinkFrameChan
+}
+
+func (b *Backend) StatsPacketChan() chan gw.GatewayStats {
+	return b.gatewayStatsChan
+}
+
+func (b *Backend) DownlinkTXAckChan() chan gw.DownlinkTXAck {
+	return b.downlinkTXAckChan
+}
+
+func (b *Backend) Close() error {
+	log.Info("gateway/semtech_udp: closing gateway backend")
+
+	close(b.done)
+	if err := b.conn.Close(); err != nil {
+		return errors.Wrap(err, "close udp listener error")
+	}
+	b.wg.Wait()
+
+	close(b.uplinkFrameChan)
+	close(b.gatewayStatsChan)
+	close(b.downlinkTXAckChan)
+
+	return nil
+}
+
+func (b *Backend) isClosed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Backend) readPackets() {
+	defer b.wg.Done()
+
+	buf := make([]byte, 65507) // max udp data size
+	for {
+		n, addr, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			if b.isClosed() {
+				return
+			}
+
+			log.WithError(err).Error("gateway/semtech_udp: read from udp error")
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		if err := b.handlePacket(addr, data); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"addr":        addr,
+				"data_base64": data,
+			}).Error("gateway/semtech_udp: could not handle packet")
+		}
+	}
+}
+
+func (b *Backend) handlePacket(addr *net.UDPAddr, data []byte) error {
+	pt, err := getPacketType(data)
+	if err != nil {
+		return errors.Wrap(err, "get packet-type error")
+	}
+
+	udpReceiveCounter(pt.String()).Inc()
+
+	log.WithFields(log.Fields{
+		"addr":             addr,
+		"type":             pt,
+		"protocol_version": data[0],
+	}).Debug("gateway/semtech_udp: received udp packet from gateway")
+
+	switch pt {
+	case PushData:
+		return b.handlePushData(addr, data)
+	case PullData:
+		return b.handlePullData(addr, data)
+	case TXACK:
+		return b.handleTXACK(data)
+	default:
+		return fmt.Errorf("unexpected packet type: %s", pt)
+	}
+}
+
+func (b *Backend) handlePullData(addr *net.UDPAddr, data []byte) error {
+	h, _, err := unmarshalGatewayPacket(data)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal packet error")
+	}
+
+	b.gatewaysMux.Lock()
+	_, connected := b.gateways[h.GatewayID]
+	b.gateways[h.GatewayID] = gatewayConn{
+		addr:            addr,
+		protocolVersion: h.ProtocolVersion,
+		lastSeen:        time.Now(),
+	}
+	b.gatewaysMux.Unlock()
+
+	if !connected {
+		log.WithFields(log.Fields{
+			"gateway_id": h.GatewayID,
+			"addr":       addr,
+		}).Info("gateway/semtech_udp: gateway connected")
+	}
+
+	return b.sendPacket(addr, PullACK, marshalACK(h.header, PullACK))
+}
+
+func (b *Backend) handlePushData(addr *net.UDPAddr, data []byte) error {
+	h, pl, err := unmarshalGatewayPacket(data)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal packet error")
+	}
+
+	// ack the packet before handling the payload
+	if err := b.sendPacket(addr, PushACK, marshalACK(h.header, PushACK)); err != nil {
+		return err
+	}
+
+	var payload PushDataPayload
+	if err := json.Unmarshal(pl, &payload); err != nil {
+		return errors.Wrap(err, "unmarshal json error")
+	}
+
+	if payload.Stat != nil {
+		stats, err := gatewayStatsFromStat(h.GatewayID, addr.IP.String(), *payload.Stat)
+		if err != nil {
+			return errors.Wrap(err, "get gateway stats error")
+		}
+
+		log.WithFields(log.Fields{
+			"gateway_id": h.GatewayID,
+			"stats_id":   helpers.GetStatsID(&stats),
+		}).Info("gateway/semtech_udp: stats packet received")
+
+		select {
+		case b.gatewayStatsChan <- stats:
+		case <-b.done:
+			return nil
+		}
+	}
+
+	for _, rxpk := range payload.RXPK {
+		if rxpk.Stat != 1 && !b.skipCRCCheck {
+			log.WithFields(log.Fields{
+				"gateway_id": h.GatewayID,
+				"stat":       rxpk.Stat,
+			}).Debug("gateway/semtech_udp: skipping uplink with invalid or missing crc")
+			continue
+		}
+
+		frame, err := uplinkFrameFromRXPK(h.GatewayID, rxpk, b.fakeRxTime)
+		if err != nil {
+			log.WithError(err).WithField("gateway_id", h.GatewayID).Error("gateway/semtech_udp: get uplink frame error")
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"gateway_id": h.GatewayID,
+			"uplink_id":  helpers.GetUplinkID(frame.GetRxInfo()),
+		}).Info("gateway/semtech_udp: uplink packet received")
+
+		select {
+		case b.uplinkFrameChan <- frame:
+		case <-b.done:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (b *Backend) handleTXACK(data []byte) error {
+	h, pl, err := unmarshalGatewayPacket(data)
+	if err != nil {
+		return errors.Wrap(err, "unmarshal packet error")
+	}
+
+	status, err := txAckStatusFromTXACK(pl)
+	if err != nil {
+		return errors.Wrap(err, "get tx ack status error")
+	}
+
+	key := downlinkKey{
+		gatewayID: h.GatewayID,
+		token:     h.RandomToken,
+	}
+
+	b.downlinksMux.Lock()
+	p, ok := b.downlinks[key]
+	if ok {
+		delete(b.downlinks, key)
+	}
+	b.downlinksMux.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no pending downlink for gateway %s and token %d", h.GatewayID, h.RandomToken)
+	}
+
+	p.ackItems[p.index].Status = status
+
+	// try the next item in case the gateway rejected the current item
+	if status != gw.TxAckStatus_OK && p.index+1 < len(p.frame.Items) {
+		p.index++
+
+		b.downlinksMux.Lock()
+		b.downlinks[key] = p
+		b.downlinksMux.Unlock()
+
+		if _, err := b.sendPullResp(h.GatewayID, h.RandomToken, p.frame.Items[p.index]); err != nil {
+			b.deletePendingDownlink(key)
+			log.WithError(err).WithFields(log.Fields{
+				"gateway_id":  h.GatewayID,
+				"downlink_id": helpers.GetDownlinkID(&p.frame),
+			}).Error("gateway/semtech_udp: send next downlink item error")
+		} else {
+			return nil
+		}
+	}
+
+	b.sendDownlinkTXAck(*p)
+
+	return nil
+}
+
+// sendDownlinkTXAck sends the DownlinkTXAck for the given pending downlink
+// to the Network Server.
+func (b *Backend) sendDownlinkTXAck(p pendingDownlink) {
+	ack := gw.DownlinkTXAck{
+		GatewayId:  p.frame.GatewayId,
+		Token:      p.frame.Token,
+		DownlinkId: p.frame.DownlinkId,
+		Items:      p.ackItems,
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id":  helpers.GetGatewayID(&ack),
+		"downlink_id": helpers.GetDownlinkID(&ack),
+	}).Info("gateway/semtech_udp: ack received")
+
+	select {
+	case b.downlinkTXAckChan <- ack:
+	case <-b.done:
+	}
+}
+
+// sendPullResp sends the given downlink item to the gateway. It returns the
+// protocol version of the gateway.
+func (b *Backend) sendPullResp(gatewayID lorawan.EUI64, token uint16, item *gw.DownlinkFrameItem) (uint8, error) {
+	b.gatewaysMux.RLock()
+	gwConn, ok := b.gateways[gatewayID]
+	b.gatewaysMux.RUnlock()
+
+	if !ok {
+		return 0, ErrGatewayNotConnected
+	}
+
+	txpk, err := txpkFromDownlinkFrameItem(item)
+	if err != nil {
+		return 0, errors.Wrap(err, "get txpk error")
+	}
+
+	data, err := marshalPullResp(gwConn.protocolVersion, token, txpk)
+	if err != nil {
+		return 0, errors.Wrap(err, "marshal pull resp error")
+	}
+
+	return gwConn.protocolVersion, b.sendPacket(gwConn.addr, PullResp, data)
+}
+
+func (b *Backend) sendPacket(addr *net.UDPAddr, pt PacketType, data []byte) error {
+	udpSendCounter(pt.String()).Inc()
+
+	log.WithFields(log.Fields{
+		"addr":             addr,
+		"type":             pt,
+		"protocol_version": data[0],
+	}).Debug("gateway/semtech_udp: sending udp packet to gateway")
+
+	if _, err := b.conn.WriteToUDP(data, addr); err != nil {
+		return errors.Wrap(err, "write to udp error")
+	}
+
+	return nil
+}
+
+func (b *Backend) cleanupLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.cleanup(time.Now())
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// cleanup removes the gateways from which no PULL_DATA was received and the
+// downlinks for which no TX_ACK was received within the cleanup durations.
+func (b *Backend) cleanup(now time.Time) {
+	b.gatewaysMux.Lock()
+	for gatewayID, gwConn := range b.gateways {
+		if now.Sub(gwConn.lastSeen) > gatewayCleanupDuration {
+			delete(b.gateways, gatewayID)
+
+			log.WithFields(log.Fields{
+				"gateway_id": gatewayID,
+				"addr":       gwConn.addr,
+			}).Info("gateway/semtech_udp: gateway disconnected")
+		}
+	}
+	b.gatewaysMux.Unlock()
+
+	b.downlinksMux.Lock()
+	for key, p := range b.downlinks {
+		if now.After(p.expiresAt) {
+			delete(b.downlinks, key)
+
+			log.WithFields(log.Fields{
+				"gateway_id":  key.gatewayID,
+				"downlink_id": helpers.GetDownlinkID(&p.frame),
+			}).Warning("gateway/semtech_udp: no tx ack received for downlink")
+		}
+	}
+	b.downlinksMux.Unlock()
+}
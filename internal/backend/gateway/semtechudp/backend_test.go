@@ -0,0 +1,255 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+type BackendTestSuite struct {
+	suite.Suite
+
+	gatewayID lorawan.EUI64
+	backend   *Backend
+	gwConn    *net.UDPConn
+}
+
+func (ts *BackendTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	conf := test.GetConfig()
+	conf.NetworkServer.Gateway.Backend.SemtechUDP.UDPBind = "127.0.0.1:0"
+
+	b, err := NewBackend(conf)
+	assert.NoError(err)
+	ts.backend = b.(*Backend)
+
+	ts.gwConn, err = net.DialUDP("udp", nil, ts.backend.conn.LocalAddr().(*net.UDPAddr))
+	assert.NoError(err)
+
+	ts.gatewayID = lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+}
+
+func (ts *BackendTestSuite) TearDownTest() {
+	assert := require.New(ts.T())
+	assert.NoError(ts.gwConn.Close())
+	assert.NoError(ts.backend.Close())
+}
+
+// sendPacket sends a packet as gateway and returns the response (if any).
+func (ts *BackendTestSuite) sendPacket(protocolVersion uint8, token uint16, pt PacketType, pl []byte, expectResponse bool) []byte {
+	assert := require.New(ts.T())
+
+	b := []byte{protocolVersion, 0, 0, byte(pt)}
+	binary.LittleEndian.PutUint16(b[1:3], token)
+	b = append(b, ts.gatewayID[:]...)
+	b = append(b, pl...)
+
+	_, err := ts.gwConn.Write(b)
+	assert.NoError(err)
+
+	if !expectResponse {
+		return nil
+	}
+
+	return ts.readPacket()
+}
+
+func (ts *BackendTestSuite) readPacket() []byte {
+	assert := require.New(ts.T())
+
+	buf := make([]byte, 65507)
+	assert.NoError(ts.gwConn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := ts.gwConn.Read(buf)
+	assert.NoError(err)
+
+	return buf[:n]
+}
+
+func (ts *BackendTestSuite) pullData(protocolVersion uint8) {
+	assert := require.New(ts.T())
+
+	resp := ts.sendPacket(protocolVersion, 123, PullData, nil, true)
+	assert.Equal([]byte{protocolVersion, 123, 0, byte(PullACK)}, resp)
+}
+
+func (ts *BackendTestSuite) downlinkFrame() gw.DownlinkFrame {
+	item := func(freq uint32) *gw.DownlinkFrameItem {
+		return &gw.DownlinkFrameItem{
+			PhyPayload: []byte{1, 2, 3},
+			TxInfo: &gw.DownlinkTXInfo{
+				Frequency:  freq,
+				Power:      14,
+				Modulation: common.Modulation_LORA,
+				ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+					LoraModulationInfo: &gw.LoRaModulationInfo{
+						SpreadingFactor:       12,
+						Bandwidth:             125,
+						CodeRate:              "4/5",
+						PolarizationInversion: true,
+					},
+				},
+				Timing: gw.DownlinkTiming_IMMEDIATELY,
+			},
+		}
+	}
+
+	return gw.DownlinkFrame{
+		GatewayId:  ts.gatewayID[:],
+		Token:      12345,
+		DownlinkId: []byte{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8},
+		Items:      []*gw.DownlinkFrameItem{item(868100000), item(869525000)},
+	}
+}
+
+func (ts *BackendTestSuite) TestPushData() {
+	assert := require.New(ts.T())
+
+	resp := ts.sendPacket(ProtocolVersion2, 1234, PushData, []byte(`{"rxpk":[{"tmst":1000,"chan":2,"rfch":0,"freq":868.1,"stat":1,"modu":"LORA","datr":"SF7BW125","codr":"4/5","rssi":-35,"lsnr":5.1,"size":4,"data":"AQIDBA=="},{"tmst":2000,"chan":2,"rfch":0,"freq":868.1,"stat":-1,"modu":"LORA","datr":"SF7BW125","codr":"4/5","rssi":-35,"lsnr":5.1,"size":4,"data":"BAMCAQ=="}],"stat":{"time":"2014-01-12 08:59:28 GMT","rxnb":2,"rxok":1,"rxfw":1,"ackr":100.0,"dwnb":0,"txnb":0}}`), true)
+	assert.Equal([]byte{ProtocolVersion2, 0xd2, 0x04, byte(PushACK)}, resp)
+
+	stats := <-ts.backend.StatsPacketChan()
+	assert.Equal(ts.gatewayID[:], stats.GatewayId)
+	assert.Equal("127.0.0.1", stats.Ip)
+	assert.Equal(uint32(2), stats.RxPacketsReceived)
+
+	// the uplink with the invalid crc is not forwarded
+	frame := <-ts.backend.RXPacketChan()
+	assert.Equal([]byte{1, 2, 3, 4}, frame.PhyPayload)
+	assert.Equal(ts.gatewayID[:], frame.RxInfo.GatewayId)
+
+	select {
+	case <-ts.backend.RXPacketChan():
+		assert.Fail("unexpected uplink frame")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (ts *BackendTestSuite) TestSendTXPacketGatewayNotConnected() {
+	assert := require.New(ts.T())
+	assert.Equal(ErrGatewayNotConnected, ts.backend.SendTXPacket(ts.downlinkFrame()))
+
+	// the pending downlink is removed when sending fails
+	ts.backend.downlinksMux.Lock()
+	assert.Len(ts.backend.downlinks, 0)
+	ts.backend.downlinksMux.Unlock()
+}
+
+func (ts *BackendTestSuite) TestSendGatewayConfigPacket() {
+	assert := require.New(ts.T())
+	assert.Equal(ErrConfigurationNotSupported, ts.backend.SendGatewayConfigPacket(gw.GatewayConfiguration{
+		GatewayId: ts.gatewayID[:],
+	}))
+}
+
+func (ts *BackendTestSuite) TestDownlink() {
+	ts.T().Run("ack", func(t *testing.T) {
+		assert := require.New(t)
+		ts.pullData(ProtocolVersion2)
+
+		assert.NoError(ts.backend.SendTXPacket(ts.downlinkFrame()))
+
+		resp := ts.readPacket()
+		assert.Equal([]byte{ProtocolVersion2, 0x39, 0x30, byte(PullResp)}, resp[:4])
+
+		var pl struct {
+			TXPK TXPK `json:"txpk"`
+		}
+		assert.NoError(json.Unmarshal(resp[4:], &pl))
+		assert.Equal(TXPK{
+			Imme: true,
+			Freq: 868.1,
+			Powe: 14,
+			Modu: "LORA",
+			DatR: DatR{LoRa: "SF12BW125"},
+			CodR: "4/5",
+			IPol: true,
+			Size: 3,
+			Data: []byte{1, 2, 3},
+		}, pl.TXPK)
+
+		ts.sendPacket(ProtocolVersion2, 12345, TXACK, nil, false)
+
+		ack := <-ts.backend.DownlinkTXAckChan()
+		assert.Equal(ts.gatewayID[:], ack.GatewayId)
+		assert.Equal(uint32(12345), ack.Token)
+		assert.Len(ack.Items, 2)
+		assert.Equal(gw.TxAckStatus_OK, ack.Items[0].Status)
+		assert.Equal(gw.TxAckStatus_IGNORED, ack.Items[1].Status)
+	})
+
+	ts.T().Run("nack retries next item", func(t *testing.T) {
+		assert := require.New(t)
+		ts.pullData(ProtocolVersion2)
+
+		assert.NoError(ts.backend.SendTXPacket(ts.downlinkFrame()))
+		ts.readPacket()
+
+		resp := ts.sendPacket(ProtocolVersion2, 12345, TXACK, []byte(`{"txpk_ack":{"error":"TOO_LATE"}}`), true)
+		assert.Equal(byte(PullResp), resp[3])
+
+		var pl struct {
+			TXPK TXPK `json:"txpk"`
+		}
+		assert.NoError(json.Unmarshal(resp[4:], &pl))
+		assert.Equal(869.525, pl.TXPK.Freq)
+
+		ts.sendPacket(ProtocolVersion2, 12345, TXACK, []byte(`{"txpk_ack":{"error":"NONE"}}`), false)
+
+		ack := <-ts.backend.DownlinkTXAckChan()
+		assert.Len(ack.Items, 2)
+		assert.Equal(gw.TxAckStatus_TOO_LATE, ack.Items[0].Status)
+		assert.Equal(gw.TxAckStatus_OK, ack.Items[1].Status)
+	})
+
+	ts.T().Run("protocol version 1", func(t *testing.T) {
+		assert := require.New(t)
+		ts.pullData(ProtocolVersion1)
+
+		assert.NoError(ts.backend.SendTXPacket(ts.downlinkFrame()))
+
+		resp := ts.readPacket()
+		assert.Equal([]byte{ProtocolVersion1, 0, 0, byte(PullResp)}, resp[:4])
+
+		ack := <-ts.backend.DownlinkTXAckChan()
+		assert.Equal(gw.TxAckStatus_OK, ack.Items[0].Status)
+
+		ts.backend.downlinksMux.Lock()
+		assert.Len(ts.backend.downlinks, 0)
+		ts.backend.downlinksMux.Unlock()
+	})
+}
+
+func (ts *BackendTestSuite) TestCleanup() {
+	assert := require.New(ts.T())
+	ts.pullData(ProtocolVersion2)
+
+	assert.NoError(ts.backend.SendTXPacket(ts.downlinkFrame()))
+	ts.readPacket()
+
+	ts.backend.cleanup(time.Now().Add(2 * time.Minute))
+
+	ts.backend.gatewaysMux.RLock()
+	assert.Len(ts.backend.gateways, 0)
+	ts.backend.gatewaysMux.RUnlock()
+
+	ts.backend.downlinksMux.Lock()
+	assert.Len(ts.backend.downlinks, 0)
+	ts.backend.downlinksMux.Unlock()
+
+	assert.Equal(ErrGatewayNotConnected, ts.backend.SendTXPacket(ts.downlinkFrame()))
+}
+
+func TestBackend(t *testing.T) {
+	suite.Run(t, new(BackendTestSuite))
+}
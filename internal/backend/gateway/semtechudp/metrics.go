@@ -0,0 +1,26 @@
+package semtechudp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	urc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_udp_received_count",
+		Help: "The number of UDP packets received by the Semtech UDP backend (per packet type).",
+	}, []string{"packet_type"})
+
+	usc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "backend_semtechudp_udp_sent_count",
+		Help: "The number of UDP packets sent by the Semtech UDP backend (per packet type).",
+	}, []string{"packet_type"})
+)
+
+func udpReceiveCounter(pt string) prometheus.Counter {
+	return urc.With(prometheus.Labels{"packet_type": pt})
+}
+
+func udpSendCounter(pt string) prometheus.Counter {
+	return usc.With(prometheus.Labels{"packet_type": pt})
+}
@@ -0,0 +1,493 @@
+package semtechudp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+)
+
+// PacketType defines the packet type.
+type PacketType byte
+
+// Available packet types.
+const (
+	PushData PacketType = iota
+	PushACK
+	PullData
+	PullResp
+	PullACK
+	TXACK
+)
+
+// Supported protocol versions.
+const (
+	ProtocolVersion1 uint8 = 0x01
+	ProtocolVersion2 uint8 = 0x02
+)
+
+// Errors
+var (
+	ErrInvalidProtocolVersion = errors.New("invalid protocol version")
+	ErrInvalidPacketLength    = errors.New("invalid packet length")
+)
+
+func (p PacketType) String() string {
+	switch p {
+	case PushData:
+		return "PUSH_DATA"
+	case PushACK:
+		return "PUSH_ACK"
+	case PullData:
+		return "PULL_DATA"
+	case PullResp:
+		return "PULL_RESP"
+	case PullACK:
+		return "PULL_ACK"
+	case TXACK:
+		return "TX_ACK"
+	default:
+		return fmt.Sprintf("UNKNOWN(%d)", p)
+	}
+}
+
+// header contains the fields shared by all the packet types.
+type header struct {
+	ProtocolVersion uint8
+	RandomToken     uint16
+	Type            PacketType
+}
+
+// gatewayHeader contains the header fields of the packets sent by the
+// gateway.
+type gatewayHeader struct {
+	header
+	GatewayID lorawan.EUI64
+}
+
+// getPacketType returns the packet type of the given packet.
+func getPacketType(b []byte) (PacketType, error) {
+	if len(b) < 4 {
+		return 0, ErrInvalidPacketLength
+	}
+	if b[0] != ProtocolVersion1 && b[0] != ProtocolVersion2 {
+		return 0, ErrInvalidProtocolVersion
+	}
+	return PacketType(b[3]), nil
+}
+
+// unmarshalGatewayPacket decodes the header of a PUSH_DATA, PULL_DATA or
+// TX_ACK packet and returns the (JSON) payload.
+func unmarshalGatewayPacket(b []byte) (gatewayHeader, []byte, error) {
+	var h gatewayHeader
+
+	if len(b) < 12 {
+		return h, nil, ErrInvalidPacketLength
+	}
+	if b[0] != ProtocolVersion1 && b[0] != ProtocolVersion2 {
+		return h, nil, ErrInvalidProtocolVersion
+	}
+
+	h.ProtocolVersion = b[0]
+	h.RandomToken = binary.LittleEndian.Uint16(b[1:3])
+	h.Type = PacketType(b[3])
+	copy(h.GatewayID[:], b[4:12])
+
+	return h, b[12:], nil
+}
+
+// marshalACK returns the PUSH_ACK or PULL_ACK packet for the given header.
+func marshalACK(h header, typ PacketType) []byte {
+	b := make([]byte, 4)
+	b[0] = h.ProtocolVersion
+	binary.LittleEndian.PutUint16(b[1:3], h.RandomToken)
+	b[3] = byte(typ)
+	return b
+}
+
+// marshalPullResp returns the PULL_RESP packet for the given txpk.
+func marshalPullResp(protocolVersion uint8, token uint16, txpk TXPK) ([]byte, error) {
+	pl, err := json.Marshal(struct {
+		TXPK TXPK `json:"txpk"`
+	}{txpk})
+	if err != nil {
+		return nil, errors.Wrap(err, "marshal json error")
+	}
+
+	b := make([]byte, 4, 4+len(pl))
+	b[0] = protocolVersion
+	// in protocol version 1, the token is unused (always 0)
+	if protocolVersion != ProtocolVersion1 {
+		binary.LittleEndian.PutUint16(b[1:3], token)
+	}
+	b[3] = byte(PullResp)
+
+	return append(b, pl...), nil
+}
+
+// CompactTime implements the compact ISO 8601 time format used by the
+// rxpk objects.
+type CompactTime time.Time
+
+// MarshalJSON implements the json.Marshaler interface.
+func (t CompactTime) MarshalJSON() ([]byte, error) {
+	return []byte(time.Time(t).UTC().Format(`"` + time.RFC3339Nano + `"`)), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (t *CompactTime) UnmarshalJSON(data []byte) error {
+	t2, err := time.Parse(`"`+time.RFC3339Nano+`"`, string(data))
+	if err != nil {
+		return err
+	}
+	*t = CompactTime(t2)
+	return nil
+}
+
+// ExpandedTime implements the expanded time format used by the stat
+// objects.
+type ExpandedTime time.Time
+
+const expandedTimeFormat = "2006-01-02 15:04:05 MST"
+
+// MarshalJSON implements the json.Marshaler interface.
+func (t ExpandedTime) MarshalJSON() ([]byte, error) {
+	return []byte(time.Time(t).UTC().Format(`"` + expandedTimeFormat + `"`)), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (t *ExpandedTime) UnmarshalJSON(data []byte) error {
+	t2, err := time.Parse(`"`+expandedTimeFormat+`"`, string(data))
+	if err != nil {
+		return err
+	}
+	*t = ExpandedTime(t2)
+	return nil
+}
+
+// DatR implements the data rate, which is a string for LoRa
+// (e.g. SF7BW125) and a number (bits per second) for FSK.
+type DatR struct {
+	LoRa string
+	FSK  uint32
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d DatR) MarshalJSON() ([]byte, error) {
+	if d.LoRa != "" {
+		return []byte(`"` + d.LoRa + `"`), nil
+	}
+	return []byte(strconv.FormatUint(uint64(d.FSK), 10)), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *DatR) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if strings.HasPrefix(s, `"`) {
+		d.LoRa = strings.Trim(s, `"`)
+		return nil
+	}
+
+	i, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	d.FSK = uint32(i)
+	return nil
+}
+
+// PushDataPayload contains the payload of a PUSH_DATA packet.
+type PushDataPayload struct {
+	RXPK []RXPK `json:"rxpk,omitempty"`
+	Stat *Stat  `json:"stat,omitempty"`
+}
+
+// RXPK contains a received packet.
+type RXPK struct {
+	Time *CompactTime `json:"time,omitempty"` // UTC time of pkt RX, us precision, ISO 8601 'compact' format
+	Tmms *int64       `json:"tmms,omitempty"` // GPS time of pkt RX, number of milliseconds since 06.Jan.1980
+	Tmst uint32       `json:"tmst"`           // Internal timestamp of "RX finished" event (32b unsigned)
+	Freq float64      `json:"freq"`           // RX central frequency in MHz (unsigned float, Hz precision)
+	Chan uint8        `json:"chan"`           // Concentrator "IF" channel used for RX (unsigned integer)
+	RFCh uint8        `json:"rfch"`           // Concentrator "RF chain" used for RX (unsigned integer)
+	Stat int8         `json:"stat"`           // CRC status: 1 = OK, -1 = fail, 0 = no CRC
+	Modu string       `json:"modu"`           // Modulation identifier "LORA" or "FSK"
+	DatR DatR         `json:"datr"`           // LoRa datarate identifier (eg. SF12BW500) or FSK datarate (unsigned, in bits per second)
+	CodR string       `json:"codr"`           // LoRa ECC coding rate identifier
+	RSSI int16        `json:"rssi"`           // RSSI in dBm (signed integer, 1 dB precision)
+	LSNR float64      `json:"lsnr"`           // Lora SNR ratio in dB (signed float, 0.1 dB precision)
+	Size uint16       `json:"size"`           // RF packet payload size in bytes (unsigned integer)
+	Data []byte       `json:"data"`           // Base64 encoded RF packet payload, padded
+}
+
+// Stat contains the status of the gateway.
+type Stat struct {
+	Time ExpandedTime `json:"time"`           // UTC 'system' time of the gateway, ISO 8601 'expanded' format
+	Lati *float64     `json:"lati,omitempty"` // GPS latitude of the gateway in degree (float, N is +)
+	Long *float64     `json:"long,omitempty"` // GPS latitude of the gateway in degree (float, E is +)
+	Alti *int32       `json:"alti,omitempty"` // GPS altitude of the gateway in meter RX (integer)
+	RXNb uint32       `json:"rxnb"`           // Number of radio packets received (unsigned integer)
+	RXOK uint32       `json:"rxok"`           // Number of radio packets received with a valid PHY CRC
+	RXFW uint32       `json:"rxfw"`           // Number of radio packets forwarded (unsigned integer)
+	ACKR float64      `json:"ackr"`           // Percentage of upstream datagrams that were acknowledged
+	DWNb uint32       `json:"dwnb"`           // Number of downlink datagrams received (unsigned integer)
+	TXNb uint32       `json:"txnb"`           // Number of packets emitted (unsigned integer)
+}
+
+// TXPK contains a packet to transmit.
+type TXPK struct {
+	Imme bool    `json:"imme,omitempty"` // Send packet immediately (will ignore tmst & time)
+	Tmst *uint32 `json:"tmst,omitempty"` // Send packet on a certain timestamp value (will ignore time)
+	Tmms *int64  `json:"tmms,omitempty"` // Send packet at a certain GPS time (GPS synchronization required)
+	Freq float64 `json:"freq"`           // TX central frequency in MHz (unsigned float, Hz precision)
+	RFCh uint8   `json:"rfch"`           // Concentrator "RF chain" used for TX (unsigned integer)
+	Powe uint8   `json:"powe"`           // TX output power in dBm (unsigned integer, dBm precision)
+	Modu string  `json:"modu"`           // Modulation identifier "LORA" or "FSK"
+	DatR DatR    `json:"datr"`           // LoRa datarate identifier (eg. SF12BW500) or FSK datarate (unsigned, in bits per second)
+	CodR string  `json:"codr,omitempty"` // LoRa ECC coding rate identifier
+	FDev uint16  `json:"fdev,omitempty"` // FSK frequency deviation (unsigned integer, in Hz)
+	IPol bool    `json:"ipol"`           // Lora modulation polarization inversion
+	Prea uint16  `json:"prea,omitempty"` // RF preamble size (unsigned integer)
+	Size uint16  `json:"size"`           // RF packet payload size in bytes (unsigned integer)
+	Data []byte  `json:"data"`           // Base64 encoded RF packet payload, padding optional
+	Brd  uint32  `json:"brd,omitempty"`  // Concentrator board used for TX (unsigned integer)
+	Ant  uint32  `json:"ant,omitempty"`  // Antenna number on which signal has been received
+}
+
+// TXACKPayload contains the payload of a TX_ACK packet.
+type TXACKPayload struct {
+	TXPKACK struct {
+		Error string `json:"error,omitempty"`
+		Warn  string `json:"warn,omitempty"`
+	} `json:"txpk_ack"`
+}
+
+// uplinkFrameFromRXPK returns the UplinkFrame for the given rxpk.
+func uplinkFrameFromRXPK(gatewayID lorawan.EUI64, rxpk RXPK, fakeRxTime bool) (gw.UplinkFrame, error) {
+	uplinkID, err := uuid.NewV4()
+	if err != nil {
+		return gw.UplinkFrame{}, errors.Wrap(err, "get uuid error")
+	}
+
+	frame := gw.UplinkFrame{
+		PhyPayload: rxpk.Data,
+		TxInfo: &gw.UplinkTXInfo{
+			Frequency: uint32(rxpk.Freq*1000000 + 0.5),
+		},
+		RxInfo: &gw.UplinkRXInfo{
+			GatewayId: gatewayID[:],
+			Rssi:      int32(rxpk.RSSI),
+			LoraSnr:   rxpk.LSNR,
+			Channel:   uint32(rxpk.Chan),
+			RfChain:   uint32(rxpk.RFCh),
+			Context:   make([]byte, 4),
+			UplinkId:  uplinkID[:],
+		},
+	}
+
+	// The concentrator counter is stored in the context, this is needed
+	// for scheduling the downlink relative to the uplink.
+	binary.BigEndian.PutUint32(frame.RxInfo.Context, rxpk.Tmst)
+
+	switch rxpk.Stat {
+	case 1:
+		frame.RxInfo.CrcStatus = gw.CRCStatus_CRC_OK
+	case -1:
+		frame.RxInfo.CrcStatus = gw.CRCStatus_BAD_CRC
+	default:
+		frame.RxInfo.CrcStatus = gw.CRCStatus_NO_CRC
+	}
+
+	if rxpk.Time != nil {
+		frame.RxInfo.Time, err = ptypes.TimestampProto(time.Time(*rxpk.Time))
+		if err != nil {
+			return frame, errors.Wrap(err, "timestamp proto error")
+		}
+	} else if fakeRxTime {
+		frame.RxInfo.Time = ptypes.TimestampNow()
+	}
+
+	if rxpk.Tmms != nil {
+		frame.RxInfo.TimeSinceGpsEpoch = ptypes.DurationProto(time.Duration(*rxpk.Tmms) * time.Millisecond)
+	}
+
+	switch rxpk.Modu {
+	case "LORA":
+		var sf, bw uint32
+		if _, err := fmt.Sscanf(rxpk.DatR.LoRa, "SF%dBW%d", &sf, &bw); err != nil {
+			return frame, errors.Wrapf(err, "parse datr error: %s", rxpk.DatR.LoRa)
+		}
+
+		frame.TxInfo.Modulation = common.Modulation_LORA
+		frame.TxInfo.ModulationInfo = &gw.UplinkTXInfo_LoraModulationInfo{
+			LoraModulationInfo: &gw.LoRaModulationInfo{
+				Bandwidth:       bw,
+				SpreadingFactor: sf,
+				CodeRate:        rxpk.CodR,
+			},
+		}
+	case "FSK":
+		frame.TxInfo.Modulation = common.Modulation_FSK
+		frame.TxInfo.ModulationInfo = &gw.UplinkTXInfo_FskModulationInfo{
+			FskModulationInfo: &gw.FSKModulationInfo{
+				FrequencyDeviation: rxpk.DatR.FSK / 2,
+				Datarate:           rxpk.DatR.FSK,
+			},
+		}
+	default:
+		return frame, fmt.Errorf("unexpected modulation: %s", rxpk.Modu)
+	}
+
+	return frame, nil
+}
+
+// gatewayStatsFromStat returns the GatewayStats for the given stat.
+func gatewayStatsFromStat(gatewayID lorawan.EUI64, ip string, stat Stat) (gw.GatewayStats, error) {
+	statsID, err := uuid.NewV4()
+	if err != nil {
+		return gw.GatewayStats{}, errors.Wrap(err, "get uuid error")
+	}
+
+	stats := gw.GatewayStats{
+		GatewayId:           gatewayID[:],
+		Ip:                  ip,
+		RxPacketsReceived:   stat.RXNb,
+		RxPacketsReceivedOk: stat.RXOK,
+		TxPacketsReceived:   stat.DWNb,
+		TxPacketsEmitted:    stat.TXNb,
+		StatsId:             statsID[:],
+	}
+
+	stats.Time, err = ptypes.TimestampProto(time.Time(stat.Time))
+	if err != nil {
+		return stats, errors.Wrap(err, "timestamp proto error")
+	}
+
+	if stat.Lati != nil && stat.Long != nil {
+		stats.Location = &common.Location{
+			Latitude:  *stat.Lati,
+			Longitude: *stat.Long,
+			Source:    common.LocationSource_GPS,
+		}
+		if stat.Alti != nil {
+			stats.Location.Altitude = float64(*stat.Alti)
+		}
+	}
+
+	return stats, nil
+}
+
+// txpkFromDownlinkFrameItem returns the txpk for the given downlink item.
+func txpkFromDownlinkFrameItem(item *gw.DownlinkFrameItem) (TXPK, error) {
+	txInfo := item.GetTxInfo()
+	if txInfo == nil {
+		return TXPK{}, errors.New("tx_info must not be nil")
+	}
+
+	txpk := TXPK{
+		Freq: float64(txInfo.Frequency) / 1000000,
+		Powe: uint8(txInfo.Power),
+		Size: uint16(len(item.PhyPayload)),
+		Data: item.PhyPayload,
+		Brd:  txInfo.Board,
+		Ant:  txInfo.Antenna,
+	}
+
+	switch txInfo.Modulation {
+	case common.Modulation_LORA:
+		modInfo := txInfo.GetLoraModulationInfo()
+		if modInfo == nil {
+			return txpk, errors.New("lora_modulation_info must not be nil")
+		}
+
+		txpk.Modu = "LORA"
+		txpk.DatR.LoRa = fmt.Sprintf("SF%dBW%d", modInfo.SpreadingFactor, modInfo.Bandwidth)
+		txpk.CodR = modInfo.CodeRate
+		txpk.IPol = modInfo.PolarizationInversion
+	case common.Modulation_FSK:
+		modInfo := txInfo.GetFskModulationInfo()
+		if modInfo == nil {
+			return txpk, errors.New("fsk_modulation_info must not be nil")
+		}
+
+		txpk.Modu = "FSK"
+		txpk.DatR.FSK = modInfo.Datarate
+		txpk.FDev = uint16(modInfo.FrequencyDeviation)
+	default:
+		return txpk, fmt.Errorf("unexpected modulation: %s", txInfo.Modulation)
+	}
+
+	switch txInfo.Timing {
+	case gw.DownlinkTiming_IMMEDIATELY:
+		txpk.Imme = true
+	case gw.DownlinkTiming_DELAY:
+		timingInfo := txInfo.GetDelayTimingInfo()
+		if timingInfo == nil {
+			return txpk, errors.New("delay_timing_info must not be nil")
+		}
+
+		if len(txInfo.Context) != 4 {
+			return txpk, errors.New("context must contain exactly 4 bytes")
+		}
+
+		delay, err := ptypes.Duration(timingInfo.Delay)
+		if err != nil {
+			return txpk, errors.Wrap(err, "parse delay error")
+		}
+
+		tmst := binary.BigEndian.Uint32(txInfo.Context) + uint32(delay/time.Microsecond)
+		txpk.Tmst = &tmst
+	case gw.DownlinkTiming_GPS_EPOCH:
+		timingInfo := txInfo.GetGpsEpochTimingInfo()
+		if timingInfo == nil {
+			return txpk, errors.New("gps_epoch_timing_info must not be nil")
+		}
+
+		gpsTime, err := ptypes.Duration(timingInfo.TimeSinceGpsEpoch)
+		if err != nil {
+			return txpk, errors.Wrap(err, "parse time since gps epoch error")
+		}
+
+		tmms := int64(gpsTime / time.Millisecond)
+		txpk.Tmms = &tmms
+	default:
+		return txpk, fmt.Errorf("unexpected timing: %s", txInfo.Timing)
+	}
+
+	return txpk, nil
+}
+
+// txAckStatusFromTXACK returns the TX ack status for the given TX_ACK
+// payload. An empty payload means that the packet was emitted.
+func txAckStatusFromTXACK(b []byte) (gw.TxAckStatus, error) {
+	if len(b) == 0 {
+		return gw.TxAckStatus_OK, nil
+	}
+
+	var pl TXACKPayload
+	if err := json.Unmarshal(b, &pl); err != nil {
+		return gw.TxAckStatus_IGNORED, errors.Wrap(err, "unmarshal json error")
+	}
+
+	// warnings (e.g. TX_POWER) do not prevent the packet from being emitted
+	if pl.TXPKACK.Error == "" || pl.TXPKACK.Error == "NONE" {
+		return gw.TxAckStatus_OK, nil
+	}
+
+	val, ok := gw.TxAckStatus_value[pl.TXPKACK.Error]
+	if !ok {
+		return gw.TxAckStatus_INTERNAL_ERROR, nil
+	}
+
+	return gw.TxAckStatus(val), nil
+}
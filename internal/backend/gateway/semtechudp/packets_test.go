@@ -0,0 +1,281 @@
+package semtechudp
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+)
+
+func TestGetPacketType(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		expectedType PacketType
+		expectedErr  error
+	}{
+		{
+			name:        "too short",
+			data:        []byte{2, 1, 2},
+			expectedErr: ErrInvalidPacketLength,
+		},
+		{
+			name:        "invalid protocol version",
+			data:        []byte{3, 1, 2, 0},
+			expectedErr: ErrInvalidProtocolVersion,
+		},
+		{
+			name:         "pull data",
+			data:         []byte{2, 1, 2, 2},
+			expectedType: PullData,
+		},
+		{
+			name:         "tx ack",
+			data:         []byte{1, 1, 2, 5},
+			expectedType: TXACK,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			pt, err := getPacketType(tst.data)
+			assert.Equal(tst.expectedErr, err)
+			assert.Equal(tst.expectedType, pt)
+		})
+	}
+}
+
+func TestUnmarshalGatewayPacket(t *testing.T) {
+	assert := require.New(t)
+
+	h, pl, err := unmarshalGatewayPacket([]byte{2, 0x39, 0x30, 0, 1, 2, 3, 4, 5, 6, 7, 8, '{', '}'})
+	assert.NoError(err)
+	assert.Equal(gatewayHeader{
+		header: header{
+			ProtocolVersion: ProtocolVersion2,
+			RandomToken:     12345,
+			Type:            PushData,
+		},
+		GatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	}, h)
+	assert.Equal([]byte("{}"), pl)
+
+	assert.Equal([]byte{2, 0x39, 0x30, 1}, marshalACK(h.header, PushACK))
+}
+
+func TestMarshalPullResp(t *testing.T) {
+	assert := require.New(t)
+
+	b, err := marshalPullResp(ProtocolVersion2, 12345, TXPK{Imme: true})
+	assert.NoError(err)
+	assert.Equal([]byte{2, 0x39, 0x30, 3}, b[:4])
+
+	// the token is not used by protocol version 1
+	b, err = marshalPullResp(ProtocolVersion1, 12345, TXPK{Imme: true})
+	assert.NoError(err)
+	assert.Equal([]byte{1, 0, 0, 3}, b[:4])
+}
+
+func TestUplinkFrameFromRXPK(t *testing.T) {
+	assert := require.New(t)
+
+	var pl PushDataPayload
+	assert.NoError(json.Unmarshal([]byte(`{"rxpk":[{"time":"2013-03-31T16:21:17.528002Z","tmst":3512348611,"chan":2,"rfch":0,"freq":866.349812,"stat":1,"modu":"LORA","datr":"SF7BW125","codr":"4/6","rssi":-35,"lsnr":5.1,"size":4,"data":"AQIDBA=="}]}`), &pl))
+	assert.Len(pl.RXPK, 1)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	frame, err := uplinkFrameFromRXPK(gatewayID, pl.RXPK[0], false)
+	assert.NoError(err)
+
+	assert.Equal([]byte{1, 2, 3, 4}, frame.PhyPayload)
+	assert.Equal(uint32(866349812), frame.TxInfo.Frequency)
+	assert.Equal(common.Modulation_LORA, frame.TxInfo.Modulation)
+	assert.Equal(&gw.LoRaModulationInfo{
+		Bandwidth:       125,
+		SpreadingFactor: 7,
+		CodeRate:        "4/6",
+	}, frame.TxInfo.GetLoraModulationInfo())
+
+	assert.Equal(gatewayID[:], frame.RxInfo.GatewayId)
+	assert.Equal(int32(-35), frame.RxInfo.Rssi)
+	assert.Equal(5.1, frame.RxInfo.LoraSnr)
+	assert.Equal(uint32(2), frame.RxInfo.Channel)
+	assert.Equal(gw.CRCStatus_CRC_OK, frame.RxInfo.CrcStatus)
+	assert.Equal([]byte{0xd1, 0x5a, 0x2f, 0xc3}, frame.RxInfo.Context)
+	assert.Len(frame.RxInfo.UplinkId, 16)
+
+	rxTime, err := ptypes.Timestamp(frame.RxInfo.Time)
+	assert.NoError(err)
+	assert.True(rxTime.Equal(time.Date(2013, 3, 31, 16, 21, 17, 528002000, time.UTC)))
+}
+
+func TestGatewayStatsFromStat(t *testing.T) {
+	assert := require.New(t)
+
+	var pl PushDataPayload
+	assert.NoError(json.Unmarshal([]byte(`{"stat":{"time":"2014-01-12 08:59:28 GMT","lati":46.24000,"long":3.25230,"alti":145,"rxnb":2,"rxok":2,"rxfw":2,"ackr":100.0,"dwnb":2,"txnb":1}}`), &pl))
+	assert.NotNil(pl.Stat)
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	stats, err := gatewayStatsFromStat(gatewayID, "127.0.0.1", *pl.Stat)
+	assert.NoError(err)
+
+	assert.Equal(gatewayID[:], stats.GatewayId)
+	assert.Equal("127.0.0.1", stats.Ip)
+	assert.Equal(uint32(2), stats.RxPacketsReceived)
+	assert.Equal(uint32(2), stats.RxPacketsReceivedOk)
+	assert.Equal(uint32(2), stats.TxPacketsReceived)
+	assert.Equal(uint32(1), stats.TxPacketsEmitted)
+	assert.Equal(&common.Location{
+		Latitude:  46.24,
+		Longitude: 3.2523,
+		Altitude:  145,
+		Source:    common.LocationSource_GPS,
+	}, stats.Location)
+}
+
+func TestTXPKFromDownlinkFrameItem(t *testing.T) {
+	tmst := uint32(1000000)
+	tmms := int64(5000)
+
+	tests := []struct {
+		name          string
+		item          gw.DownlinkFrameItem
+		expectedTXPK  TXPK
+		expectedError bool
+	}{
+		{
+			name: "lora delay",
+			item: gw.DownlinkFrameItem{
+				PhyPayload: []byte{1, 2, 3},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868100000,
+					Power:      14,
+					Modulation: common.Modulation_LORA,
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{
+							SpreadingFactor:       12,
+							Bandwidth:             125,
+							CodeRate:              "4/5",
+							PolarizationInversion: true,
+						},
+					},
+					Timing: gw.DownlinkTiming_DELAY,
+					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+						DelayTimingInfo: &gw.DelayTimingInfo{
+							Delay: ptypes.DurationProto(time.Second),
+						},
+					},
+					Context: []byte{0, 0, 0, 0},
+				},
+			},
+			expectedTXPK: TXPK{
+				Tmst: &tmst,
+				Freq: 868.1,
+				Powe: 14,
+				Modu: "LORA",
+				DatR: DatR{LoRa: "SF12BW125"},
+				CodR: "4/5",
+				IPol: true,
+				Size: 3,
+				Data: []byte{1, 2, 3},
+			},
+		},
+		{
+			name: "fsk gps epoch",
+			item: gw.DownlinkFrameItem{
+				PhyPayload: []byte{1, 2, 3},
+				TxInfo: &gw.DownlinkTXInfo{
+					Frequency:  868800000,
+					Power:      27,
+					Modulation: common.Modulation_FSK,
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate:           50000,
+							FrequencyDeviation: 25000,
+						},
+					},
+					Timing: gw.DownlinkTiming_GPS_EPOCH,
+					TimingInfo: &gw.DownlinkTXInfo_GpsEpochTimingInfo{
+						GpsEpochTimingInfo: &gw.GPSEpochTimingInfo{
+							TimeSinceGpsEpoch: ptypes.DurationProto(5 * time.Second),
+						},
+					},
+				},
+			},
+			expectedTXPK: TXPK{
+				Tmms: &tmms,
+				Freq: 868.8,
+				Powe: 27,
+				Modu: "FSK",
+				DatR: DatR{FSK: 50000},
+				FDev: 25000,
+				Size: 3,
+				Data: []byte{1, 2, 3},
+			},
+		},
+		{
+			name: "delay without context",
+			item: gw.DownlinkFrameItem{
+				TxInfo: &gw.DownlinkTXInfo{
+					Modulation: common.Modulation_LORA,
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{},
+					},
+					Timing: gw.DownlinkTiming_DELAY,
+					TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+						DelayTimingInfo: &gw.DelayTimingInfo{
+							Delay: ptypes.DurationProto(time.Second),
+						},
+					},
+				},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			txpk, err := txpkFromDownlinkFrameItem(&tst.item)
+			if tst.expectedError {
+				assert.Error(err)
+				return
+			}
+
+			assert.NoError(err)
+			assert.Equal(tst.expectedTXPK, txpk)
+		})
+	}
+}
+
+func TestTXAckStatusFromTXACK(t *testing.T) {
+	tests := []struct {
+		payload        string
+		expectedStatus gw.TxAckStatus
+	}{
+		{"", gw.TxAckStatus_OK},
+		{`{"txpk_ack":{"error":"NONE"}}`, gw.TxAckStatus_OK},
+		{`{"txpk_ack":{"error":"TOO_LATE"}}`, gw.TxAckStatus_TOO_LATE},
+		{`{"txpk_ack":{"error":"SOMETHING_ELSE"}}`, gw.TxAckStatus_INTERNAL_ERROR},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.payload, func(t *testing.T) {
+			assert := require.New(t)
+
+			status, err := txAckStatusFromTXACK([]byte(tst.payload))
+			assert.NoError(err)
+			assert.Equal(tst.expectedStatus, status)
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package joinserver
 
 import (
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"net"
@@ -19,14 +21,24 @@ import (
 )
 
 type serverItem struct {
-	joinEUI lorawan.EUI64
-	client  backend.Client
+	joinEUI              lorawan.EUI64
+	client               backend.Client
+	inboundAuthorization string
+	inboundRateLimit     int
 }
 
+// ErrUnauthenticated is returned when the inbound credentials of a request
+// sent by a join-server are missing or invalid.
+var ErrUnauthenticated = errors.New("join-server inbound credentials missing or invalid")
+
 var (
 	servers []serverItem
 	keks    map[string][]byte
 
+	requireAuthentication       bool
+	defaultInboundAuthorization string
+	defaultInboundRateLimit     int
+
 	netID               lorawan.NetID
 	resolveJoinEUI      bool
 	resolveDomainSuffix string
@@ -42,6 +54,7 @@ var (
 func Setup(c config.Config) error {
 	conf := c.JoinServer
 	keks = make(map[string][]byte)
+	servers = nil
 
 	netID = c.NetworkServer.NetID
 	defaultServer = c.JoinServer.Default.Server
@@ -54,6 +67,9 @@ func Setup(c config.Config) error {
 		defaultRedisClient = storage.RedisClient()
 	}
 	defaultAsyncTimeout = c.JoinServer.Default.AsyncTimeout
+	defaultInboundAuthorization = c.JoinServer.Default.InboundAuthorization
+	defaultInboundRateLimit = c.JoinServer.Default.InboundRateLimit
+	requireAuthentication = c.Roaming.API.RequireAuthentication
 
 	for _, s := range conf.Servers {
 		var joinEUI lorawan.EUI64
@@ -86,8 +102,10 @@ func Setup(c config.Config) error {
 		}
 
 		servers = append(servers, serverItem{
-			joinEUI: joinEUI,
-			client:  client,
+			joinEUI:              joinEUI,
+			client:               client,
+			inboundAuthorization: s.InboundAuthorization,
+			inboundRateLimit:     s.InboundRateLimit,
 		})
 	}
 
@@ -128,6 +146,50 @@ func GetClientForJoinEUI(joinEUI lorawan.EUI64) (backend.Client, error) {
 	return getDefaultClient(joinEUI)
 }
 
+// AuthenticateInbound authenticates a request sent by the join-server of the
+// given JoinEUI to the roaming API, using the Authorization header value and
+// the (optional) verified client-certificate of the request, of which the
+// CommonName must already be validated against the JoinEUI.
+//
+// When an inbound Authorization is configured for the join-server, it must
+// match. Else the request is accepted when it was authenticated using a
+// client-certificate, or when the roaming API does not require
+// authentication.
+func AuthenticateInbound(joinEUI lorawan.EUI64, authorization string, cert *x509.Certificate) error {
+	expected := defaultInboundAuthorization
+	for _, s := range servers {
+		if s.joinEUI == joinEUI {
+			expected = s.inboundAuthorization
+			break
+		}
+	}
+
+	if expected != "" {
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(authorization)) != 1 {
+			return ErrUnauthenticated
+		}
+		return nil
+	}
+
+	if cert == nil && requireAuthentication {
+		return ErrUnauthenticated
+	}
+
+	return nil
+}
+
+// GetInboundRateLimit returns the max. number of requests per second
+// accepted from the join-server of the given JoinEUI. It returns 0 when these
+// are not limited.
+func GetInboundRateLimit(joinEUI lorawan.EUI64) int {
+	for _, s := range servers {
+		if s.joinEUI == joinEUI {
+			return s.inboundRateLimit
+		}
+	}
+	return defaultInboundRateLimit
+}
+
 func resolveClient(joinEUI lorawan.EUI64) (backend.Client, error) {
 	server := joinEUIToServer(joinEUI, resolveDomainSuffix)
 	serverParsed, err := url.Parse(server)
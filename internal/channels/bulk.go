@@ -0,0 +1,248 @@
+package channels
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+const (
+	// bulkSetChannelsBatchSize defines the number of devices which are
+	// updated within a single transaction.
+	bulkSetChannelsBatchSize = 100
+
+	// bulkSetChannelsStaleTimeout defines the duration after which a running
+	// job which has not been updated is marked as failed. A running job is
+	// updated after every batch.
+	bulkSetChannelsStaleTimeout = 10 * time.Minute
+
+	// bulkSetChannelsStaleCheckInterval defines the interval in which the
+	// stale jobs are checked.
+	bulkSetChannelsStaleCheckInterval = time.Minute
+)
+
+// ErrNoDevicesSelected is returned when neither a device list nor a filter
+// has been given.
+var ErrNoDevicesSelected = errors.New("no devices or device filters given")
+
+// BulkSetChannelsRequest defines the request for updating the channels of
+// multiple devices. Either DevEUIs or the filters must be set. When DevEUIs
+// is set, the profile filters are ignored.
+type BulkSetChannelsRequest struct {
+	DevEUIs         []lorawan.EUI64
+	Filters         storage.DeviceFilters
+	DevAddrPrefix   *storage.DevAddrPrefix
+	EnabledChannels []int32
+	ExtraChannels   []loraband.Channel
+}
+
+// BulkSetChannels validates the given channels and creates a job which
+// updates the channels of the selected devices in the background. The
+// progress of the job can be retrieved using storage.GetDeviceChannelsJob.
+func BulkSetChannels(ctx context.Context, req BulkSetChannelsRequest) (storage.DeviceChannelsJob, error) {
+	if len(req.DevEUIs) == 0 && req.Filters.DeviceProfileID == nil && req.Filters.ServiceProfileID == nil && req.DevAddrPrefix == nil {
+		return storage.DeviceChannelsJob{}, ErrNoDevicesSelected
+	}
+
+	// validate the channels up-front, so that invalid channels are reported
+	// to the caller instead of failing for every device
+	var ec storage.DeviceExtraConfigurations
+	if err := ec.SetChannels(req.EnabledChannels, req.ExtraChannels); err != nil {
+		return storage.DeviceChannelsJob{}, err
+	}
+
+	job := storage.DeviceChannelsJob{
+		State: storage.DeviceChannelsJobRunning,
+	}
+	if err := storage.CreateDeviceChannelsJob(ctx, storage.DB(), &job); err != nil {
+		return job, errors.Wrap(err, "create device-channels job error")
+	}
+
+	// the job outlives the request context
+	jobCtx := context.WithValue(context.Background(), logging.ContextIDKey, ctx.Value(logging.ContextIDKey))
+
+	go func(job storage.DeviceChannelsJob) {
+		if err := runBulkSetChannelsJob(jobCtx, &job, req); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"job_id": job.ID,
+				"ctx_id": jobCtx.Value(logging.ContextIDKey),
+			}).Error("channels: device-channels job error")
+
+			job.State = storage.DeviceChannelsJobFailed
+			job.Error = err.Error()
+			if err := storage.UpdateDeviceChannelsJob(jobCtx, storage.DB(), &job); err != nil {
+				log.WithError(err).WithField("job_id", job.ID).Error("channels: update device-channels job error")
+			}
+		}
+	}(job)
+
+	return job, nil
+}
+
+// StaleJobsLoop marks the bulk channels update jobs as failed which were
+// interrupted, e.g. because the Network Server instance running the job was
+// restarted. The devices of an interrupted job might have been partially
+// updated, the job must be re-submitted.
+func StaleJobsLoop() {
+	for {
+		ctxID, err := uuid.NewV4()
+		if err != nil {
+			log.WithError(err).Error("channels: get new uuid error")
+		}
+
+		ctx := context.WithValue(context.Background(), logging.ContextIDKey, ctxID)
+
+		if _, err := storage.FailStaleDeviceChannelsJobs(ctx, storage.DB(), time.Now().Add(-bulkSetChannelsStaleTimeout)); err != nil {
+			log.WithError(err).WithField("ctx_id", ctxID).Error("channels: fail stale device-channels jobs error")
+		}
+
+		time.Sleep(bulkSetChannelsStaleCheckInterval)
+	}
+}
+
+func runBulkSetChannelsJob(ctx context.Context, job *storage.DeviceChannelsJob, req BulkSetChannelsRequest) error {
+	devEUIs, err := getBulkSetChannelsDevEUIs(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "get devices error")
+	}
+
+	job.DeviceCount = len(devEUIs)
+	if err := storage.UpdateDeviceChannelsJob(ctx, storage.DB(), job); err != nil {
+		return errors.Wrap(err, "update device-channels job error")
+	}
+
+	for start := 0; start < len(devEUIs); start += bulkSetChannelsBatchSize {
+		end := start + bulkSetChannelsBatchSize
+		if end > len(devEUIs) {
+			end = len(devEUIs)
+		}
+		batch := devEUIs[start:end]
+
+		var jobErrors []storage.DeviceChannelsJobError
+		var updated []lorawan.EUI64
+		err := storage.Transaction(func(tx sqlx.Ext) error {
+			jobErrors = nil
+			updated = nil
+			for _, devEUI := range batch {
+				err := setChannelsForDevice(ctx, tx, devEUI, req)
+				if err == nil {
+					updated = append(updated, devEUI)
+					continue
+				}
+
+				// a missing device does not abort the transaction
+				if errors.Cause(err) == storage.ErrDoesNotExist {
+					jobErrors = append(jobErrors, storage.DeviceChannelsJobError{
+						DevEUI: devEUI,
+						Error:  err.Error(),
+					})
+					continue
+				}
+
+				return errors.Wrapf(err, "set channels for device %s error", devEUI)
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"job_id": job.ID,
+				"ctx_id": ctx.Value(logging.ContextIDKey),
+			}).Error("channels: device-channels batch error")
+
+			// the transaction has been rolled back
+			updated = nil
+			jobErrors = nil
+			for _, devEUI := range batch {
+				jobErrors = append(jobErrors, storage.DeviceChannelsJobError{
+					DevEUI: devEUI,
+					Error:  err.Error(),
+				})
+			}
+		}
+
+		if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, updated...); err != nil {
+			return errors.Wrap(err, "delete extra-config cache error")
+		}
+
+		if err := storage.CreateDeviceChannelsJobErrors(ctx, storage.DB(), job.ID, jobErrors); err != nil {
+			return errors.Wrap(err, "create device-channels job errors error")
+		}
+
+		job.ProcessedCount += len(batch)
+		job.FailedCount += len(jobErrors)
+		if err := storage.UpdateDeviceChannelsJob(ctx, storage.DB(), job); err != nil {
+			return errors.Wrap(err, "update device-channels job error")
+		}
+	}
+
+	job.State = storage.DeviceChannelsJobCompleted
+	if err := storage.UpdateDeviceChannelsJob(ctx, storage.DB(), job); err != nil {
+		return errors.Wrap(err, "update device-channels job error")
+	}
+
+	log.WithFields(log.Fields{
+		"job_id":       job.ID,
+		"device_count": job.DeviceCount,
+		"failed_count": job.FailedCount,
+		"ctx_id":       ctx.Value(logging.ContextIDKey),
+	}).Info("channels: device-channels job completed")
+
+	return nil
+}
+
+func getBulkSetChannelsDevEUIs(ctx context.Context, req BulkSetChannelsRequest) ([]lorawan.EUI64, error) {
+	devEUIs := req.DevEUIs
+	if len(devEUIs) == 0 {
+		var err error
+		devEUIs, err = storage.GetDevEUIsForFilters(ctx, storage.DB(), req.Filters)
+		if err != nil {
+			return nil, errors.Wrap(err, "get devices for filters error")
+		}
+	}
+
+	if req.DevAddrPrefix == nil {
+		return devEUIs, nil
+	}
+
+	// the DevAddr is only stored within the device-session
+	var out []lorawan.EUI64
+	for _, devEUI := range devEUIs {
+		ds, err := storage.GetDeviceSession(ctx, devEUI)
+		if err != nil {
+			if errors.Cause(err) == storage.ErrDoesNotExist {
+				continue
+			}
+			return nil, errors.Wrap(err, "get device-session error")
+		}
+
+		if req.DevAddrPrefix.Matches(ds.DevAddr) {
+			out = append(out, devEUI)
+		}
+	}
+
+	return out, nil
+}
+
+func setChannelsForDevice(ctx context.Context, db sqlx.Ext, devEUI lorawan.EUI64, req BulkSetChannelsRequest) error {
+	ec, err := storage.GetDeviceExtraConfigurations(ctx, db, devEUI)
+	if err != nil {
+		return err
+	}
+
+	if err := ec.SetChannels(req.EnabledChannels, req.ExtraChannels); err != nil {
+		return err
+	}
+	ec.ChannelsOverride = true
+	ec.ChannelsStatus.SetPending()
+
+	return storage.UpdateDeviceExtraConfigurations(ctx, db, ec)
+}
@@ -1,6 +1,8 @@
 package channels
 
 import (
+	"github.com/pkg/errors"
+
 	"github.com/brocaar/lorawan"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -30,6 +32,12 @@ func HandleChannelReconfigure(ds storage.DeviceSession) ([]storage.MACCommandBlo
 
 	//end workaround
 
+	// Per-device extra channels are not known by the band, the channel-mask
+	// for these is handled by the device extra configuration.
+	if hasDeviceExtraChannels(ds.EnabledUplinkChannels) {
+		return nil, nil
+	}
+
 	payloads := band.Band().GetLinkADRReqPayloadsForEnabledUplinkChannelIndices(ds.EnabledUplinkChannels)
 	if len(payloads) == 0 {
 		return nil, nil
@@ -51,3 +59,62 @@ func HandleChannelReconfigure(ds storage.DeviceSession) ([]storage.MACCommandBlo
 
 	return []storage.MACCommandBlock{block}, nil
 }
+
+// GetEnabledUplinkChannelIndicesForLinkADRReqPayloads returns the enabled
+// uplink channels after applying the given LinkADRReq payloads. Unlike the
+// band implementation, this takes the per-device extra channels (using
+// channel indices after the band channels) into account.
+func GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(ds storage.DeviceSession, pls []lorawan.LinkADRReqPayload) ([]int, error) {
+	if !hasDeviceExtraChannels(ds.EnabledUplinkChannels) && len(ds.ExtraUplinkChannels) == 0 {
+		return band.Band().GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(ds.EnabledUplinkChannels, pls)
+	}
+
+	chMaskLen := len(band.Band().GetUplinkChannelIndices())
+	for i := range ds.ExtraUplinkChannels {
+		if i >= chMaskLen {
+			chMaskLen = i + 1
+		}
+	}
+
+	chMask := make([]bool, chMaskLen)
+	for _, c := range ds.EnabledUplinkChannels {
+		if c < len(chMask) {
+			chMask[c] = true
+		}
+	}
+
+	for _, pl := range pls {
+		for i, enabled := range pl.ChMask {
+			c := int(pl.Redundancy.ChMaskCntl)*16 + i
+			if c >= len(chMask) {
+				if enabled {
+					return nil, errors.New("channel does not exist")
+				}
+				continue
+			}
+
+			chMask[c] = enabled
+		}
+	}
+
+	var out []int
+	for i, enabled := range chMask {
+		if enabled {
+			out = append(out, i)
+		}
+	}
+
+	return out, nil
+}
+
+// hasDeviceExtraChannels returns true when one of the given channels is not
+// defined by the band (thus it is a per-device extra channel).
+func hasDeviceExtraChannels(channels []int) bool {
+	bandChannels := len(band.Band().GetUplinkChannelIndices())
+	for _, c := range channels {
+		if c >= bandChannels {
+			return true
+		}
+	}
+	return false
+}
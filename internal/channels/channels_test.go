@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
 	. "github.com/smartystreets/goconvey/convey"
@@ -65,3 +66,67 @@ func TestHandleChannelReconfigure(t *testing.T) {
 		}
 	})
 }
+
+func TestGetEnabledUplinkChannelIndicesForLinkADRReqPayloads(t *testing.T) {
+	_ = test.GetConfig()
+
+	Convey("Given a set of tests", t, func() {
+		tests := []struct {
+			Name          string
+			DeviceSession storage.DeviceSession
+			Payloads      []lorawan.LinkADRReqPayload
+			Expected      []int
+			ExpectedError bool
+		}{
+			{
+				Name: "band channels only",
+				DeviceSession: storage.DeviceSession{
+					EnabledUplinkChannels: []int{0, 1, 2},
+				},
+				Payloads: []lorawan.LinkADRReqPayload{
+					{ChMask: lorawan.ChMask{true, true}},
+				},
+				Expected: []int{0, 1},
+			},
+			{
+				Name: "per-device extra channels",
+				DeviceSession: storage.DeviceSession{
+					EnabledUplinkChannels: []int{0, 1, 2, 3, 4},
+					ExtraUplinkChannels: map[int]loraband.Channel{
+						3: {Frequency: 867100000, MaxDR: 5},
+						4: {Frequency: 867300000, MaxDR: 5},
+					},
+				},
+				Payloads: []lorawan.LinkADRReqPayload{
+					{ChMask: lorawan.ChMask{true, true, true, false, true}},
+				},
+				Expected: []int{0, 1, 2, 4},
+			},
+			{
+				Name: "enabling unknown channel",
+				DeviceSession: storage.DeviceSession{
+					EnabledUplinkChannels: []int{0, 1, 2, 3},
+					ExtraUplinkChannels: map[int]loraband.Channel{
+						3: {Frequency: 867100000, MaxDR: 5},
+					},
+				},
+				Payloads: []lorawan.LinkADRReqPayload{
+					{ChMask: lorawan.ChMask{true, true, true, true, true}},
+				},
+				ExpectedError: true,
+			},
+		}
+
+		for i, test := range tests {
+			Convey(fmt.Sprintf("test: %s [%d]", test.Name, i), func() {
+				chans, err := GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(test.DeviceSession, test.Payloads)
+				if test.ExpectedError {
+					So(err, ShouldNotBeNil)
+					return
+				}
+				So(err, ShouldBeNil)
+				So(chans, ShouldResemble, test.Expected)
+			})
+		}
+	})
+}
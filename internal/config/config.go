@@ -54,21 +54,22 @@ type Config struct {
 		} `mapstructure:"band"`
 
 		NetworkSettings struct {
-			InstallationMargin      float64  `mapstructure:"installation_margin"`
-			RXWindow                int      `mapstructure:"rx_window"`
-			RX1Delay                int      `mapstructure:"rx1_delay"`
-			RX1DROffset             int      `mapstructure:"rx1_dr_offset"`
-			RX2DR                   int      `mapstructure:"rx2_dr"`
-			RX2Frequency            int64    `mapstructure:"rx2_frequency"`
-			RX2PreferOnRX1DRLt      int      `mapstructure:"rx2_prefer_on_rx1_dr_lt"`
-			RX2PreferOnLinkBudget   bool     `mapstructure:"rx2_prefer_on_link_budget"`
-			GatewayPreferMinMargin  float64  `mapstructure:"gateway_prefer_min_margin"`
-			DownlinkTXPower         int      `mapstructure:"downlink_tx_power"`
-			EnabledUplinkChannels   []int    `mapstructure:"enabled_uplink_channels"`
-			DisableMACCommands      bool     `mapstructure:"disable_mac_commands"`
-			DisableADR              bool     `mapstructure:"disable_adr"`
-			MaxMACCommandErrorCount int      `mapstructure:"max_mac_command_error_count"`
-			ADRPlugins              []string `mapstructure:"adr_plugins"`
+			InstallationMargin        float64  `mapstructure:"installation_margin"`
+			RXWindow                  int      `mapstructure:"rx_window"`
+			RX1Delay                  int      `mapstructure:"rx1_delay"`
+			RX1DROffset               int      `mapstructure:"rx1_dr_offset"`
+			RX2DR                     int      `mapstructure:"rx2_dr"`
+			RX2Frequency              int64    `mapstructure:"rx2_frequency"`
+			RX2PreferOnRX1DRLt        int      `mapstructure:"rx2_prefer_on_rx1_dr_lt"`
+			RX2PreferOnLinkBudget     bool     `mapstructure:"rx2_prefer_on_link_budget"`
+			GatewayPreferMinMargin    float64  `mapstructure:"gateway_prefer_min_margin"`
+			DownlinkTXPower           int      `mapstructure:"downlink_tx_power"`
+			EnabledUplinkChannels     []int    `mapstructure:"enabled_uplink_channels"`
+			DisableMACCommands        bool     `mapstructure:"disable_mac_commands"`
+			DisableADR                bool     `mapstructure:"disable_adr"`
+			MaxMACCommandErrorCount   int      `mapstructure:"max_mac_command_error_count"`
+			RejectBelowMinGWDiversity bool     `mapstructure:"reject_below_min_gw_diversity"`
+			ADRPlugins                []string `mapstructure:"adr_plugins"`
 
 			ExtraChannels []struct {
 				Frequency uint32 `mapstructure:"frequency"`
@@ -86,6 +87,18 @@ type Config struct {
 				MaxCountN int  `mapstructure:"max_count_n"`
 				MaxTimeN  int  `mapstructure:"max_time_n"`
 			} `mapstructure:"rejoin_request"`
+
+			DutyCycle struct {
+				Enabled bool          `mapstructure:"enabled"`
+				Window  time.Duration `mapstructure:"window"`
+
+				SubBands []struct {
+					Name         string  `mapstructure:"name"`
+					MinFrequency uint32  `mapstructure:"min_frequency"`
+					MaxFrequency uint32  `mapstructure:"max_frequency"`
+					MaxDutyCycle float64 `mapstructure:"max_duty_cycle"`
+				} `mapstructure:"sub_bands"`
+			} `mapstructure:"duty_cycle"`
 		} `mapstructure:"network_settings"`
 
 		Scheduler struct {
@@ -98,6 +111,17 @@ type Config struct {
 			} `mapstructure:"class_c"`
 		} `mapstructure:"scheduler"`
 
+		Uplink struct {
+			WorkerCount    int    `mapstructure:"worker_count"`
+			QueueSize      int    `mapstructure:"queue_size"`
+			OverloadPolicy string `mapstructure:"overload_policy"`
+		} `mapstructure:"uplink"`
+
+		Geolocation struct {
+			Resolver        string `mapstructure:"resolver"`
+			MinGatewayCount int    `mapstructure:"min_gateway_count"`
+		} `mapstructure:"geolocation"`
+
 		API struct {
 			Bind    string `mapstructure:"bind"`
 			CACert  string `mapstructure:"ca_cert"`
@@ -118,9 +142,50 @@ type Config struct {
 
 			ForceGwsPrivate bool `mapstructure:"force_gws_private"`
 
+			Presence struct {
+				OfflineMultiplier    int           `mapstructure:"offline_multiplier"`
+				DefaultStatsInterval time.Duration `mapstructure:"default_stats_interval"`
+				CheckInterval        time.Duration `mapstructure:"check_interval"`
+				ExcludeOffline       bool          `mapstructure:"exclude_offline"`
+
+				EventSink struct {
+					Type string `mapstructure:"type"`
+
+					HTTP struct {
+						URL     string        `mapstructure:"url"`
+						Timeout time.Duration `mapstructure:"timeout"`
+					} `mapstructure:"http"`
+				} `mapstructure:"event_sink"`
+			} `mapstructure:"presence"`
+
+			DownlinkFallback struct {
+				Enabled     bool          `mapstructure:"enabled"`
+				Margin      time.Duration `mapstructure:"margin"`
+				MaxAttempts int           `mapstructure:"max_attempts"`
+
+				Blacklist struct {
+					ErrorCount  int           `mapstructure:"error_count"`
+					ErrorWindow time.Duration `mapstructure:"error_window"`
+					Duration    time.Duration `mapstructure:"duration"`
+				} `mapstructure:"blacklist"`
+			} `mapstructure:"downlink_fallback"`
+
+			RadioMetrics struct {
+				Enabled              bool     `mapstructure:"enabled"`
+				PrometheusGatewayIDs []string `mapstructure:"prometheus_gateway_ids"`
+			} `mapstructure:"radio_metrics"`
+
+			ConfigPush struct {
+				RetryInterval time.Duration `mapstructure:"retry_interval"`
+				MaxAttempts   int           `mapstructure:"max_attempts"`
+			} `mapstructure:"config_push"`
+
 			Backend struct {
-				Type                 string `mapstructure:"type"`
-				MultiDownlinkFeature string `mapstructure:"multi_downlink_feature"`
+				Type                 string                `mapstructure:"type"`
+				Types                []string              `mapstructure:"types"`
+				Routes               []GatewayBackendRoute `mapstructure:"routes"`
+				RouteTTL             time.Duration         `mapstructure:"route_ttl"`
+				MultiDownlinkFeature string                `mapstructure:"multi_downlink_feature"`
 
 				MQTT struct {
 					Server               string        `mapstructure:"server"`
@@ -157,6 +222,40 @@ type Config struct {
 					EventsConnectionString   string `mapstructure:"events_connection_string"`
 					CommandsConnectionString string `mapstructure:"commands_connection_string"`
 				} `mapstructure:"azure_iot_hub"`
+
+				Kafka struct {
+					Brokers              []string      `mapstructure:"brokers"`
+					TLS                  bool          `mapstructure:"tls"`
+					CACert               string        `mapstructure:"ca_cert"`
+					TLSCert              string        `mapstructure:"tls_cert"`
+					TLSKey               string        `mapstructure:"tls_key"`
+					Username             string        `mapstructure:"username"`
+					Password             string        `mapstructure:"password"`
+					ConsumerGroup        string        `mapstructure:"consumer_group"`
+					CommitInterval       time.Duration `mapstructure:"commit_interval"`
+					EventTopicTemplate   string        `mapstructure:"event_topic_template"`
+					CommandTopicTemplate string        `mapstructure:"command_topic_template"`
+				} `mapstructure:"kafka"`
+
+				SemtechUDP struct {
+					UDPBind      string `mapstructure:"udp_bind"`
+					SkipCRCCheck bool   `mapstructure:"skip_crc_check"`
+					FakeRxTime   bool   `mapstructure:"fake_rx_time"`
+				} `mapstructure:"semtech_udp"`
+
+				BasicStation struct {
+					Bind          string        `mapstructure:"bind"`
+					TLSCert       string        `mapstructure:"tls_cert"`
+					TLSKey        string        `mapstructure:"tls_key"`
+					CACert        string        `mapstructure:"ca_cert"`
+					StatsInterval time.Duration `mapstructure:"stats_interval"`
+					PingInterval  time.Duration `mapstructure:"ping_interval"`
+					ReadTimeout   time.Duration `mapstructure:"read_timeout"`
+					WriteTimeout  time.Duration `mapstructure:"write_timeout"`
+					Region        string        `mapstructure:"region"`
+					FrequencyMin  uint32        `mapstructure:"frequency_min"`
+					FrequencyMax  uint32        `mapstructure:"frequency_max"`
+				} `mapstructure:"basic_station"`
 			} `mapstructure:"backend"`
 		} `mapstructure:"gateway"`
 	} `mapstructure:"network_server"`
@@ -165,15 +264,7 @@ type Config struct {
 		ResolveJoinEUI      bool   `mapstructure:"resolve_join_eui"`
 		ResolveDomainSuffix string `mapstructure:"resolve_domain_suffix"`
 
-		Servers []struct {
-			Server       string        `mapstructure:"server"`
-			JoinEUI      string        `mapstructure:"join_eui"`
-			Async        bool          `mapstructure:"async"`
-			AsyncTimeout time.Duration `mapstructure:"async_timeout"`
-			CACert       string        `mapstructure:"ca_cert"`
-			TLSCert      string        `mapstructure:"tls_cert"`
-			TLSKey       string        `mapstructure:"tls_key"`
-		} `mapstructure:"servers"`
+		Servers []JoinServerServer `mapstructure:"servers"`
 
 		Default struct {
 			Server       string        `mapstructure:"server"`
@@ -182,6 +273,9 @@ type Config struct {
 			CACert       string        `mapstructure:"ca_cert"`
 			TLSCert      string        `mapstructure:"tls_cert"`
 			TLSKey       string        `mapstructure:"tls_key"`
+
+			InboundAuthorization string `mapstructure:"inbound_authorization"`
+			InboundRateLimit     int    `mapstructure:"inbound_rate_limit"`
 		} `mapstructure:"default"`
 
 		KEK struct {
@@ -190,13 +284,15 @@ type Config struct {
 	} `mapstructure:"join_server"`
 
 	Roaming struct {
-		ResolveNetIDDomainSuffix string `mapstructure:"resolve_netid_domain_suffix"`
+		ResolveNetIDDomainSuffix string        `mapstructure:"resolve_netid_domain_suffix"`
+		AgreementsReloadInterval time.Duration `mapstructure:"agreements_reload_interval"`
 
 		API struct {
-			Bind    string `mapstructure:"bind"`
-			CACert  string `mapstructure:"ca_cert"`
-			TLSCert string `mapstructure:"tls_cert"`
-			TLSKey  string `mapstructure:"tls_key"`
+			Bind                  string `mapstructure:"bind"`
+			CACert                string `mapstructure:"ca_cert"`
+			TLSCert               string `mapstructure:"tls_cert"`
+			TLSKey                string `mapstructure:"tls_key"`
+			RequireAuthentication bool   `mapstructure:"require_authentication"`
 		} `mapstructure:"api"`
 
 		Servers []RoamingServer      `mapstructure:"servers"`
@@ -219,6 +315,14 @@ type Config struct {
 	Metrics struct {
 		Timezone string `mapstructure:"timezone"`
 
+		Redis struct {
+			AggregationIntervals []string      `mapstructure:"aggregation_intervals"`
+			MinuteAggregationTTL time.Duration `mapstructure:"minute_aggregation_ttl"`
+			HourAggregationTTL   time.Duration `mapstructure:"hour_aggregation_ttl"`
+			DayAggregationTTL    time.Duration `mapstructure:"day_aggregation_ttl"`
+			MonthAggregationTTL  time.Duration `mapstructure:"month_aggregation_ttl"`
+		} `mapstructure:"redis"`
+
 		Prometheus struct {
 			EndpointEnabled    bool   `mapstructure:"endpoint_enabled"`
 			Bind               string `mapstructure:"bind"`
@@ -238,33 +342,64 @@ type Config struct {
 	} `mapstructure:"monitoring"`
 }
 
+// GatewayBackendRoute defines a static gateway to gateway backend route.
+type GatewayBackendRoute struct {
+	GatewayID string `mapstructure:"gateway_id"`
+	Backend   string `mapstructure:"backend"`
+}
+
+// JoinServerServer defines a join-server configuration.
+type JoinServerServer struct {
+	Server               string        `mapstructure:"server"`
+	JoinEUI              string        `mapstructure:"join_eui"`
+	Async                bool          `mapstructure:"async"`
+	AsyncTimeout         time.Duration `mapstructure:"async_timeout"`
+	CACert               string        `mapstructure:"ca_cert"`
+	TLSCert              string        `mapstructure:"tls_cert"`
+	TLSKey               string        `mapstructure:"tls_key"`
+	InboundAuthorization string        `mapstructure:"inbound_authorization"`
+	InboundRateLimit     int           `mapstructure:"inbound_rate_limit"`
+}
+
 type RoamingServer struct {
-	NetID                  lorawan.NetID
-	NetIDString            string        `mapstructure:"net_id"`
-	Async                  bool          `mapstructure:"async"`
-	AsyncTimeout           time.Duration `mapstructure:"async_timeout"`
-	PassiveRoaming         bool          `mapstructure:"passive_roaming"`
-	PassiveRoamingLifetime time.Duration `mapstructure:"passive_roaming_lifetime"`
-	PassiveRoamingKEKLabel string        `mapstructure:"passive_roaming_kek_label"`
-	Server                 string        `mapstructure:"server"`
-	CACert                 string        `mapstructure:"ca_cert"`
-	TLSCert                string        `mapstructure:"tls_cert"`
-	TLSKey                 string        `mapstructure:"tls_key"`
-	Authorization          string        `mapstructure:"authorization"`
+	NetID                    lorawan.NetID
+	NetIDString              string        `mapstructure:"net_id"`
+	Async                    bool          `mapstructure:"async"`
+	AsyncTimeout             time.Duration `mapstructure:"async_timeout"`
+	PassiveRoaming           bool          `mapstructure:"passive_roaming"`
+	PassiveRoamingLifetime   time.Duration `mapstructure:"passive_roaming_lifetime"`
+	PassiveRoamingKEKLabel   string        `mapstructure:"passive_roaming_kek_label"`
+	HandoverRoaming          bool          `mapstructure:"handover_roaming"`
+	HandoverRoamingLifetime  time.Duration `mapstructure:"handover_roaming_lifetime"`
+	HandoverRoamingKEKLabel  string        `mapstructure:"handover_roaming_kek_label"`
+	ProfileDisclosure        []string      `mapstructure:"profile_disclosure"`
+	Server                   string        `mapstructure:"server"`
+	CACert                   string        `mapstructure:"ca_cert"`
+	TLSCert                  string        `mapstructure:"tls_cert"`
+	TLSKey                   string        `mapstructure:"tls_key"`
+	Authorization            string        `mapstructure:"authorization"`
+	InboundAuthorization     string        `mapstructure:"inbound_authorization"`
+	InboundClientCertSubject string        `mapstructure:"inbound_client_cert_subject"`
+	InboundRateLimit         int           `mapstructure:"inbound_rate_limit"`
 }
 
 type DefaultRoamingServer struct {
-	Enabled                bool          `mapstructure:"enabled"`
-	Async                  bool          `mapstructure:"async"`
-	AsyncTimeout           time.Duration `mapstructure:"async_timeout"`
-	PassiveRoaming         bool          `mapstructure:"passive_roaming"`
-	PassiveRoamingLifetime time.Duration `mapstructure:"passive_roaming_lifetime"`
-	PassiveRoamingKEKLabel string        `mapstructure:"passive_roaming_kek_label"`
-	Server                 string        `mapstructure:"server"`
-	CACert                 string        `mapstructure:"ca_cert"`
-	TLSCert                string        `mapstructure:"tls_cert"`
-	TLSKey                 string        `mapstructure:"tls_key"`
-	Authorization          string        `mapstructure:"authorization"`
+	Enabled                 bool          `mapstructure:"enabled"`
+	Async                   bool          `mapstructure:"async"`
+	AsyncTimeout            time.Duration `mapstructure:"async_timeout"`
+	PassiveRoaming          bool          `mapstructure:"passive_roaming"`
+	PassiveRoamingLifetime  time.Duration `mapstructure:"passive_roaming_lifetime"`
+	PassiveRoamingKEKLabel  string        `mapstructure:"passive_roaming_kek_label"`
+	HandoverRoaming         bool          `mapstructure:"handover_roaming"`
+	HandoverRoamingLifetime time.Duration `mapstructure:"handover_roaming_lifetime"`
+	HandoverRoamingKEKLabel string        `mapstructure:"handover_roaming_kek_label"`
+	ProfileDisclosure       []string      `mapstructure:"profile_disclosure"`
+	Server                  string        `mapstructure:"server"`
+	CACert                  string        `mapstructure:"ca_cert"`
+	TLSCert                 string        `mapstructure:"tls_cert"`
+	TLSKey                  string        `mapstructure:"tls_key"`
+	Authorization           string        `mapstructure:"authorization"`
+	InboundRateLimit        int           `mapstructure:"inbound_rate_limit"`
 }
 
 type KEK struct {
@@ -19,6 +19,7 @@ import (
 	"github.com/kamicuu/chirpstack-api/go/v3/ns"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/controller"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/dutycycle"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/framelog"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
@@ -33,7 +34,14 @@ var handleDownlinkTXAckTasks = []func(*ackContext) error{
 	getToken,
 	getDownlinkFrame,
 	decodePHYPayload,
+	recordAckStatus,
 	onError(
+		forApplicationPayload(
+			fallbackToOtherGateway,
+		),
+		forMACOnlyPayload(
+			fallbackToOtherGateway,
+		),
 		forApplicationPayload(
 			sendErrorToApplicationServerOnLastFrame,
 		),
@@ -86,6 +94,7 @@ var handleDownlinkTXAckTasks = []func(*ackContext) error{
 		forMulticastPayload(
 			deleteMulticastQueueItem,
 		),
+		recordDutyCycle,
 		sendDownlinkMetaDataToNetworkController,
 		logDownlinkFrame,
 	),
@@ -105,6 +114,9 @@ type ackContext struct {
 	DeviceQueueItem     storage.DeviceQueueItem
 	MHDR                lorawan.MHDR
 	MACPayload          *lorawan.MACPayload
+
+	// PassiveRoaming is set when the downlink was sent by the fNS (as hNS).
+	PassiveRoaming bool
 }
 
 // HandleDownlinkTXAck handles the given downlink TX acknowledgement.
@@ -502,7 +514,7 @@ func sendTxAckToApplicationServer(ctx *ackContext) error {
 
 func sendErrorToApplicationServerOnLastFrame(ctx *ackContext) error {
 	// Only send an error to the AS on the last possible attempt.
-	if (len(ctx.DownlinkTXAck.Items) == 0 && len(ctx.DownlinkFrame.DownlinkFrame.Items) >= 2) || ctx.MACPayload == nil {
+	if !isLastAttempt(ctx) || ctx.MACPayload == nil {
 		return nil
 	}
 
@@ -537,6 +549,27 @@ func sendErrorToApplicationServerOnLastFrame(ctx *ackContext) error {
 	return nil
 }
 
+// recordDutyCycle adds the time-on-air of the transmitted downlink to the
+// duty-cycle ledger of the gateway. Passive-roaming downlinks are skipped as
+// these are sent by the gateways of the fNS.
+func recordDutyCycle(ctx *ackContext) error {
+	if ctx.PassiveRoaming {
+		return nil
+	}
+
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], ctx.DownlinkFrame.DownlinkFrame.GatewayId)
+
+	if err := dutycycle.Record(ctx.ctx, gatewayID, ctx.DownlinkFrameItem); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"ctx_id":     ctx.ctx.Value(logging.ContextIDKey),
+		}).Error("record duty-cycle error")
+	}
+
+	return nil
+}
+
 func sendDownlinkMetaDataToNetworkController(ctx *ackContext) error {
 	req := nc.HandleDownlinkMetaDataRequest{
 		GatewayId:           ctx.DownlinkFrame.DownlinkFrame.GatewayId,
@@ -664,14 +697,32 @@ func logDownlinkFrame(ctx *ackContext) error {
 		return err
 	}
 
+	// Include the channel reconfiguration status, so that devices stuck
+	// mid-reconfiguration can be spotted in the frame log.
+	var channelsStatus *ns.DeviceChannelsStatus
+	ec, err := storage.GetOptionalDeviceExtraConfigurations(ctx.ctx, ctx.DB, devEUI)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"ctx_id": ctx.ctx.Value(logging.ContextIDKey),
+		}).Error("get extra-config for downlink frame-log error")
+	} else if ec != nil {
+		channelsStatus, err = framelog.CreateDeviceChannelsStatus(ec.ChannelsStatus)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"ctx_id": ctx.ctx.Value(logging.ContextIDKey),
+			}).Error("create channels status for downlink frame-log error")
+		}
+	}
+
 	if err := framelog.LogDownlinkFrameForDevEUI(ctx.ctx, devEUI, ns.DownlinkFrameLog{
-		PhyPayload: phyB,
-		TxInfo:     ctx.DownlinkFrameItem.TxInfo,
-		Token:      ctx.DownlinkFrame.DownlinkFrame.Token,
-		DownlinkId: ctx.DownlinkFrame.DownlinkFrame.DownlinkId,
-		GatewayId:  ctx.DownlinkFrame.DownlinkFrame.GatewayId,
-		MType:      protoMType,
-		DevAddr:    devAddr,
+		PhyPayload:     phyB,
+		TxInfo:         ctx.DownlinkFrameItem.TxInfo,
+		Token:          ctx.DownlinkFrame.DownlinkFrame.Token,
+		DownlinkId:     ctx.DownlinkFrame.DownlinkFrame.DownlinkId,
+		GatewayId:      ctx.DownlinkFrame.DownlinkFrame.GatewayId,
+		MType:          protoMType,
+		DevAddr:        devAddr,
+		ChannelsStatus: channelsStatus,
 	}); err != nil {
 		log.WithError(err).WithFields(log.Fields{
 			"ctx_id": ctx.ctx.Value(logging.ContextIDKey),
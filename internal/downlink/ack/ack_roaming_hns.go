@@ -14,6 +14,7 @@ func HandleRoamingTxAck(ctx context.Context, txAck gw.DownlinkTXAck) error {
 		DB:                  storage.DB(),
 		DownlinkTXAck:       &txAck,
 		DownlinkTXAckStatus: gw.TxAckStatus_OK,
+		PassiveRoaming:      true,
 	}
 
 	for _, t := range handleDownlinkTXAckTasks {
@@ -0,0 +1,331 @@
+package ack
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/dutycycle"
+	dwngateway "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/presence"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+var (
+	fallbackEnabled      bool
+	fallbackMargin       time.Duration
+	fallbackMaxAttempts  int
+	blacklistErrorCount  int
+	blacklistErrorWindow time.Duration
+	blacklistDuration    time.Duration
+)
+
+// Setup configures the ack package.
+func Setup(conf config.Config) error {
+	fb := conf.NetworkServer.Gateway.DownlinkFallback
+
+	fallbackEnabled = fb.Enabled
+	fallbackMargin = fb.Margin
+	fallbackMaxAttempts = fb.MaxAttempts
+	blacklistErrorCount = fb.Blacklist.ErrorCount
+	blacklistErrorWindow = fb.Blacklist.ErrorWindow
+	blacklistDuration = fb.Blacklist.Duration
+
+	return nil
+}
+
+// recordAckStatus updates the ack error counters and blacklists the gateway
+// after repeated gateway errors.
+func recordAckStatus(ctx *ackContext) error {
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], ctx.DownlinkFrame.DownlinkFrame.GatewayId)
+
+	statuses := []gw.TxAckStatus{ctx.DownlinkTXAckStatus}
+	if len(ctx.DownlinkTXAck.Items) != 0 {
+		statuses = nil
+		for _, item := range ctx.DownlinkTXAck.Items {
+			statuses = append(statuses, item.Status)
+		}
+	}
+
+	var gatewayError bool
+	for _, status := range statuses {
+		// ignored means that the item was not used, e.g. because an
+		// earlier item was transmitted
+		if status == gw.TxAckStatus_OK || status == gw.TxAckStatus_IGNORED {
+			continue
+		}
+
+		ackErrorCounter(status).Inc()
+		if isGatewayError(status) {
+			gatewayError = true
+		}
+	}
+
+	if ctx.DownlinkTXAckStatus == gw.TxAckStatus_OK || !gatewayError || blacklistErrorCount == 0 {
+		return nil
+	}
+
+	n, err := storage.IncrGatewayAckErrorCount(ctx.ctx, gatewayID, blacklistErrorWindow)
+	if err != nil {
+		return errors.Wrap(err, "increment gateway ack error count error")
+	}
+
+	if n >= int64(blacklistErrorCount) {
+		if err := storage.BlacklistGateway(ctx.ctx, gatewayID, blacklistDuration); err != nil {
+			return errors.Wrap(err, "blacklist gateway error")
+		}
+		blacklistCounter().Inc()
+	}
+
+	return nil
+}
+
+// isGatewayError returns true when the given status indicates an issue with
+// the gateway. Timing errors (e.g. TOO_LATE caused by the network-server or
+// backhaul latency) and collisions with other scheduled downlinks are not
+// considered gateway errors.
+func isGatewayError(status gw.TxAckStatus) bool {
+	switch status {
+	case gw.TxAckStatus_TOO_LATE, gw.TxAckStatus_TOO_EARLY, gw.TxAckStatus_COLLISION_PACKET, gw.TxAckStatus_COLLISION_BEACON:
+		return false
+	default:
+		return true
+	}
+}
+
+// fallbackToOtherGateway re-plans the downlink on an other gateway that
+// received the last uplink of the device, when all items were rejected by
+// the gateway and the receive window can still be reached. On success,
+// errAbort is returned so that no error is reported to the application-server.
+func fallbackToOtherGateway(ctx *ackContext) error {
+	if !fallbackEnabled || !isLastAttempt(ctx) {
+		return nil
+	}
+
+	fb, err := storage.GetDownlinkFallback(ctx.ctx, ctx.Token)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return nil
+		}
+		return errors.Wrap(err, "get downlink fallback error")
+	}
+
+	if len(fb.TriedGatewayIDs) >= fallbackMaxAttempts {
+		fallbackCounter("max_attempts").Inc()
+		return nil
+	}
+
+	now := time.Now()
+	var items []*gw.DownlinkFrameItem
+	for _, item := range ctx.DownlinkFrame.DownlinkFrame.Items {
+		if isWindowReachable(item.GetTxInfo(), fb.UplinkReceivedAt, now) {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		fallbackCounter("too_late").Inc()
+		return nil
+	}
+
+	rxInfo, err := getFallbackGateway(ctx, fb.TriedGatewayIDs)
+	if err != nil {
+		return errors.Wrap(err, "get fallback gateway error")
+	}
+	if rxInfo == nil {
+		fallbackCounter("no_gateway").Inc()
+		return nil
+	}
+
+	maxDutyCycle, err := getMaxDutyCycle(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get max duty-cycle error")
+	}
+
+	var newItems []*gw.DownlinkFrameItem
+	for _, item := range items {
+		txInfo := proto.Clone(item.TxInfo).(*gw.DownlinkTXInfo)
+		txInfo.Board = rxInfo.Board
+		txInfo.Antenna = rxInfo.Antenna
+		txInfo.Context = rxInfo.Context
+
+		newItem := gw.DownlinkFrameItem{
+			PhyPayload: item.PhyPayload,
+			TxInfo:     txInfo,
+		}
+
+		if dutycycle.Enabled() {
+			wait, err := dutycycle.Check(ctx.ctx, rxInfo.GatewayID, &newItem, maxDutyCycle)
+			if err != nil {
+				return errors.Wrap(err, "check duty-cycle error")
+			}
+			if wait != 0 {
+				continue
+			}
+		}
+
+		newItems = append(newItems, &newItem)
+	}
+	if len(newItems) == 0 {
+		fallbackCounter("duty_cycle").Inc()
+		return nil
+	}
+
+	var devEUI, prevGatewayID lorawan.EUI64
+	copy(devEUI[:], ctx.DownlinkFrame.DevEui)
+	copy(prevGatewayID[:], ctx.DownlinkFrame.DownlinkFrame.GatewayId)
+
+	ctx.DownlinkFrame.DownlinkFrame.GatewayId = rxInfo.GatewayID[:]
+	ctx.DownlinkFrame.DownlinkFrame.Items = newItems
+	if err := storage.SaveDownlinkFrame(ctx.ctx, ctx.DownlinkFrame); err != nil {
+		return errors.Wrap(err, "save downlink-frame error")
+	}
+
+	fb.TriedGatewayIDs = append(fb.TriedGatewayIDs, rxInfo.GatewayID)
+	if err := storage.SaveDownlinkFallback(ctx.ctx, ctx.Token, fb); err != nil {
+		return errors.Wrap(err, "save downlink fallback error")
+	}
+
+	if err := gateway.Backend().SendTXPacket(gw.DownlinkFrame{
+		GatewayId:  ctx.DownlinkFrame.DownlinkFrame.GatewayId,
+		Token:      ctx.DownlinkFrame.DownlinkFrame.Token,
+		DownlinkId: ctx.DownlinkFrame.DownlinkFrame.DownlinkId,
+		Items:      newItems,
+	}); err != nil {
+		return errors.Wrap(err, "send downlink-frame to gateway error")
+	}
+
+	fallbackCounter("sent").Inc()
+
+	log.WithFields(log.Fields{
+		"dev_eui":         devEUI,
+		"prev_gateway_id": prevGatewayID,
+		"gateway_id":      rxInfo.GatewayID,
+		"ack_status":      ctx.DownlinkTXAckStatus,
+		"ctx_id":          ctx.ctx.Value(logging.ContextIDKey),
+	}).Info("downlink/ack: downlink re-planned on fallback gateway")
+
+	return errAbort
+}
+
+// getFallbackGateway returns the gateway with the best signal which received
+// the last uplink and which has not been tried yet. Offline and blacklisted
+// gateways are skipped. It returns nil when there is no such gateway.
+func getFallbackGateway(ctx *ackContext, tried []lorawan.EUI64) (*storage.DeviceGatewayRXInfo, error) {
+	var devEUI lorawan.EUI64
+	copy(devEUI[:], ctx.DownlinkFrame.DevEui)
+
+	rxInfoSet, err := storage.GetDeviceGatewayRXInfoSet(ctx.ctx, devEUI)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "get device gateway rx-info set error")
+	}
+
+	skip := make(map[lorawan.EUI64]struct{})
+	for _, id := range tried {
+		skip[id] = struct{}{}
+	}
+
+	var ids []lorawan.EUI64
+	for _, item := range rxInfoSet.Items {
+		ids = append(ids, item.GatewayID)
+	}
+
+	offline, err := presence.GetExcludedGateways(ctx.ctx, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "get excluded gateways error")
+	}
+
+	blacklisted, err := storage.GetBlacklistedGateways(ctx.ctx, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "get blacklisted gateways error")
+	}
+
+	var candidates []storage.DeviceGatewayRXInfo
+	for _, item := range rxInfoSet.Items {
+		_, isTried := skip[item.GatewayID]
+		_, isOffline := offline[item.GatewayID]
+		_, isBlacklisted := blacklisted[item.GatewayID]
+
+		if !isTried && !isOffline && !isBlacklisted {
+			candidates = append(candidates, item)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	sort.Sort(dwngateway.BySignal(candidates))
+	return &candidates[0], nil
+}
+
+// getMaxDutyCycle returns the max. duty-cycle of the device-profile of the
+// device. It returns 0 when duty-cycle tracking is disabled.
+func getMaxDutyCycle(ctx *ackContext) (int, error) {
+	if !dutycycle.Enabled() {
+		return 0, nil
+	}
+
+	var devEUI lorawan.EUI64
+	copy(devEUI[:], ctx.DownlinkFrame.DevEui)
+
+	ds, err := storage.GetDeviceSession(ctx.ctx, devEUI)
+	if err != nil {
+		return 0, errors.Wrap(err, "get device-session error")
+	}
+
+	dp, err := storage.GetAndCacheDeviceProfile(ctx.ctx, ctx.DB, ds.DeviceProfileID)
+	if err != nil {
+		return 0, errors.Wrap(err, "get device-profile error")
+	}
+
+	return dp.MaxDutyCycle, nil
+}
+
+// isLastAttempt returns true when there are no more items of the
+// downlink-frame which the gateway can try.
+func isLastAttempt(ctx *ackContext) bool {
+	return !(len(ctx.DownlinkTXAck.Items) == 0 && len(ctx.DownlinkFrame.DownlinkFrame.Items) >= 2)
+}
+
+// isWindowReachable returns true when the receive window of the given
+// tx-info can still be reached (taking the fallback margin into account).
+func isWindowReachable(txInfo *gw.DownlinkTXInfo, uplinkReceivedAt, now time.Time) bool {
+	switch txInfo.GetTiming() {
+	case gw.DownlinkTiming_IMMEDIATELY:
+		return true
+	case gw.DownlinkTiming_DELAY:
+		if uplinkReceivedAt.IsZero() {
+			return false
+		}
+
+		delay, err := ptypes.Duration(txInfo.GetDelayTimingInfo().GetDelay())
+		if err != nil {
+			return false
+		}
+
+		return now.Add(fallbackMargin).Before(uplinkReceivedAt.Add(delay))
+	case gw.DownlinkTiming_GPS_EPOCH:
+		timeSinceGPSEpoch, err := ptypes.Duration(txInfo.GetGpsEpochTimingInfo().GetTimeSinceGpsEpoch())
+		if err != nil {
+			return false
+		}
+
+		return now.Add(fallbackMargin).Before(time.Time(gps.NewFromTimeSinceGPSEpoch(timeSinceGPSEpoch)))
+	default:
+		return false
+	}
+}
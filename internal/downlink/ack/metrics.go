@@ -0,0 +1,37 @@
+package ack
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+)
+
+var (
+	aec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "downlink_ack_error_count",
+		Help: "The number of downlink tx ack errors (per status).",
+	}, []string{"status"})
+
+	fc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "downlink_ack_fallback_count",
+		Help: "The number of downlink fallback attempts (per result).",
+	}, []string{"result"})
+
+	bc = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "downlink_ack_gateway_blacklist_count",
+		Help: "The number of times a gateway was blacklisted because of repeated tx ack errors.",
+	})
+)
+
+func ackErrorCounter(status gw.TxAckStatus) prometheus.Counter {
+	return aec.With(prometheus.Labels{"status": status.String()})
+}
+
+func fallbackCounter(result string) prometheus.Counter {
+	return fc.With(prometheus.Labels{"result": result})
+}
+
+func blacklistCounter() prometheus.Counter {
+	return bc
+}
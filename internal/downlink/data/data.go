@@ -27,12 +27,15 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/channels"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/ack"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/dutycycle"
 	dwngateway "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/presence"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/maccommand"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/ratelimit"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
@@ -99,6 +102,9 @@ var (
 
 	// Prefer gateways with min uplink SNR margin
 	gatewayPreferMinMargin float64
+
+	// Re-plan the downlink on an other gateway on tx ack errors
+	downlinkFallbackEnabled bool
 )
 
 var setMACCommandsSet = setMACCommands(
@@ -122,9 +128,12 @@ var responseTasks = []func(*dataContext) error{
 	setDataTXInfo,
 	setToken,
 	getNextDeviceQueueItem,
+	checkDownlinkRateLimit,
 	setMACCommandsSet,
+	setDeviceChannelsStatusApplied,
 	stopOnNothingToSend,
 	setPHYPayloads,
+	checkDutyCycle,
 	saveDownlinkFrame,
 	saveDeviceSession,
 	isRoaming(false,
@@ -136,6 +145,8 @@ var responseTasks = []func(*dataContext) error{
 	isRoaming(true,
 		handleRoamingTxAck,
 	),
+	setDeviceChannelsStatusInProgress,
+	takeDownlinkRateLimitToken,
 }
 
 var scheduleNextQueueItemTasks = []func(*dataContext) error{
@@ -159,11 +170,14 @@ var scheduleNextQueueItemTasks = []func(*dataContext) error{
 	),
 	setToken,
 	getNextDeviceQueueItem,
+	checkDownlinkRateLimit,
 	stopOnNothingToSend,
 	setPHYPayloads,
+	checkDutyCycle,
 	saveDeviceSession,
 	saveDownlinkFrame,
 	sendDownlinkFrame,
+	takeDownlinkRateLimitToken,
 	setDeviceQueueItemRetryAfter,
 }
 
@@ -205,6 +219,7 @@ func Setup(conf config.Config) error {
 
 	maxMACCommandErrorCount = conf.NetworkServer.NetworkSettings.MaxMACCommandErrorCount
 	gatewayPreferMinMargin = conf.NetworkServer.NetworkSettings.GatewayPreferMinMargin
+	downlinkFallbackEnabled = conf.NetworkServer.Gateway.DownlinkFallback.Enabled
 
 	return nil
 }
@@ -261,6 +276,11 @@ type dataContext struct {
 	// DeviceQueueItem.
 	MoreDeviceQueueItems bool
 
+	// DeviceQueueItemIncluded defines if the DeviceQueueItem is included in
+	// (one of) the downlink frame items, e.g. it is not when it does not fit
+	// together with the mac-commands.
+	DeviceQueueItemIncluded bool
+
 	// Downlink frame.
 	DownlinkFrame gw.DownlinkFrame
 
@@ -1014,6 +1034,49 @@ func getNextDeviceQueueItem(ctx *dataContext) error {
 	}
 }
 
+// checkDownlinkRateLimit enforces the service-profile downlink rate for the
+// Mark policy. When the rate is exceeded, the device-queue item stays in the
+// queue and is retried once a token is available. The token is taken by
+// takeDownlinkRateLimitToken, once the device-queue item has been sent.
+func checkDownlinkRateLimit(ctx *dataContext) error {
+	if ctx.DeviceQueueItem == nil {
+		return nil
+	}
+
+	wait, err := ratelimit.CheckDownlinkTransmission(ctx.ctx, ctx.ServiceProfile, ctx.DeviceSession.DevEUI)
+	if err != nil {
+		return errors.Wrap(err, "check downlink rate-limit error")
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	retryAfter := time.Now().Add(wait)
+	ctx.DeviceQueueItem.RetryAfter = &retryAfter
+	if err := storage.UpdateDeviceQueueItem(ctx.ctx, ctx.DB, ctx.DeviceQueueItem); err != nil {
+		return errors.Wrap(err, "update device-queue item error")
+	}
+
+	ctx.DeviceQueueItem = nil
+	ctx.MoreDeviceQueueItems = true
+
+	return nil
+}
+
+// takeDownlinkRateLimitToken takes the service-profile downlink token for the
+// sent device-queue item.
+func takeDownlinkRateLimitToken(ctx *dataContext) error {
+	if ctx.DeviceQueueItem == nil || !ctx.DeviceQueueItemIncluded {
+		return nil
+	}
+
+	if err := ratelimit.TakeDownlinkTransmission(ctx.ctx, ctx.ServiceProfile, ctx.DeviceSession.DevEUI); err != nil {
+		return errors.Wrap(err, "take downlink rate-limit token error")
+	}
+
+	return nil
+}
+
 func filterIncompatibleMACCommands(macCommands []storage.MACCommandBlock) []storage.MACCommandBlock {
 	for _, mapping := range incompatibleMACCommands {
 		var seen bool
@@ -1116,8 +1179,13 @@ func requestCustomChannelReconfiguration(ctx *dataContext) error {
 		}
 		allowedChannels[i] = c
 	}
+	// Per-device extra channels are configured on top of the global-config
+	// channels, using the channel indices following the band channels.
+	for i, c := range ctx.DeviceExtraConfig.GetExtraUplinkChannels() {
+		allowedChannels[i] = c
+	}
 	// Set channels according to extraConfig
-	// channles are picked only from global-config allowed channels
+	// channles are picked only from global-config and per-device allowed channels
 	wantedChannels := make(map[int]loraband.Channel)
 	for _, k := range ctx.DeviceExtraConfig.EnabledChannels {
 		for j := range allowedChannels {
@@ -1191,6 +1259,63 @@ func requestCustomChannelReconfiguration(ctx *dataContext) error {
 	return nil
 }
 
+// setDeviceChannelsStatusApplied sets the status of a pending channel
+// reconfiguration to applied when nothing needs to be sent as the
+// device-session already reflects the configured channels.
+func setDeviceChannelsStatusApplied(ctx *dataContext) error {
+	status := ctx.DeviceExtraConfig.ChannelsStatus
+	if status.State != storage.DeviceChannelsPending || hasChannelReconfigurationMACCommands(ctx) || !ctx.DeviceExtraConfig.IsAppliedTo(ctx.DeviceSession) {
+		return nil
+	}
+
+	status.State = storage.DeviceChannelsApplied
+	status.UpdatedAt = time.Now()
+
+	return updateDeviceChannelsStatus(ctx, status)
+}
+
+// setDeviceChannelsStatusInProgress sets the status of a pending channel
+// reconfiguration to in-progress. This must be executed after the downlink
+// has been sent, as the NewChannelReq or LinkADRReq mac-commands are only
+// sent to the device at this point.
+func setDeviceChannelsStatusInProgress(ctx *dataContext) error {
+	status := ctx.DeviceExtraConfig.ChannelsStatus
+	if status.State != storage.DeviceChannelsPending || !hasChannelReconfigurationMACCommands(ctx) {
+		return nil
+	}
+
+	status.SetInProgress()
+
+	return updateDeviceChannelsStatus(ctx, status)
+}
+
+// hasChannelReconfigurationMACCommands returns true when the NewChannelReq or
+// LinkADRReq mac-commands are part of the downlink.
+func hasChannelReconfigurationMACCommands(ctx *dataContext) bool {
+	for _, block := range ctx.MACCommands {
+		if block.CID == lorawan.NewChannelReq || block.CID == lorawan.LinkADRReq {
+			return true
+		}
+	}
+	return false
+}
+
+func updateDeviceChannelsStatus(ctx *dataContext, status storage.DeviceChannelsStatus) error {
+	// The status is not updated within the (scheduler) transaction, as the
+	// cached configuration must be removed after the update has been
+	// committed.
+	if err := storage.UpdateDeviceChannelsStatus(ctx.ctx, storage.DB(), ctx.DeviceSession.DevEUI, status); err != nil {
+		return errors.Wrap(err, "update channels status error")
+	}
+
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx.ctx, ctx.DeviceSession.DevEUI); err != nil {
+		return errors.Wrap(err, "delete extra-config cache error")
+	}
+	ctx.DeviceExtraConfig.ChannelsStatus = status
+
+	return nil
+}
+
 func requestChannelMaskReconfiguration(ctx *dataContext) error {
 	// handle channel configuration
 	// note that this must come before ADR!
@@ -1263,6 +1388,8 @@ func requestADRChange(ctx *dataContext) error {
 		InstallationMargin: float32(conf.NetworkServer.NetworkSettings.InstallationMargin),
 		MinDR:              ctx.ServiceProfile.DRMin,
 		MaxDR:              ctx.ServiceProfile.DRMax,
+		TargetPER:          ctx.ServiceProfile.TargetPER,
+		MinGWDiversity:     ctx.ServiceProfile.MinGWDiversity,
 		UplinkHistory:      uplinkHistory,
 	}
 
@@ -1478,6 +1605,7 @@ func setPHYPayloads(ctx *dataContext) error {
 				}
 
 				ctx.DownlinkFrameItems[i].RemainingPayloadSize = ctx.DownlinkFrameItems[i].RemainingPayloadSize - len(ctx.DeviceQueueItem.FRMPayload)
+				ctx.DeviceQueueItemIncluded = true
 			} else if ctx.DeviceQueueItem != nil {
 				macPL.FHDR.FCtrl.FPending = true
 			}
@@ -1522,6 +1650,81 @@ func setPHYPayloads(ctx *dataContext) error {
 	return nil
 }
 
+// checkDutyCycle validates that the downlink does not exceed the duty-cycle
+// budget of the selected gateway. Items (receive windows) without remaining
+// budget are removed. When no item remains, the other gateways within reach
+// of the device are tried. When none of the gateways has budget left, the
+// downlink is deferred. Passive-roaming downlinks are sent by the gateways
+// of the fNS, of which the duty-cycle is accounted by the fNS.
+func checkDutyCycle(ctx *dataContext) error {
+	if !dutycycle.Enabled() || (ctx.RXPacket != nil && ctx.RXPacket.RoamingMetaData != nil) {
+		return nil
+	}
+
+	gateways := []storage.DeviceGatewayRXInfo{ctx.DownlinkGateway}
+	for _, rxInfo := range ctx.DeviceGatewayRXInfo {
+		if rxInfo.GatewayID != ctx.DownlinkGateway.GatewayID {
+			gateways = append(gateways, rxInfo)
+		}
+	}
+
+	var minWait time.Duration
+	for _, gwRXInfo := range gateways {
+		var items []*gw.DownlinkFrameItem
+		for _, item := range ctx.DownlinkFrame.Items {
+			wait, err := dutycycle.Check(ctx.ctx, gwRXInfo.GatewayID, item, ctx.DeviceProfile.MaxDutyCycle)
+			if err != nil {
+				return errors.Wrap(err, "check duty-cycle error")
+			}
+
+			if wait == 0 {
+				items = append(items, item)
+			} else if minWait == 0 || wait < minWait {
+				minWait = wait
+			}
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		if gwRXInfo.GatewayID != ctx.DownlinkGateway.GatewayID {
+			log.WithFields(log.Fields{
+				"dev_eui":    ctx.DeviceSession.DevEUI,
+				"gateway_id": gwRXInfo.GatewayID,
+				"ctx_id":     ctx.ctx.Value(logging.ContextIDKey),
+			}).Info("downlink/data: duty-cycle budget exhausted, using fallback gateway")
+
+			ctx.DownlinkGateway = gwRXInfo
+			ctx.DownlinkFrame.GatewayId = gwRXInfo.GatewayID[:]
+			for _, item := range items {
+				item.TxInfo.Board = gwRXInfo.Board
+				item.TxInfo.Antenna = gwRXInfo.Antenna
+				item.TxInfo.Context = gwRXInfo.Context
+			}
+		}
+
+		ctx.DownlinkFrame.Items = items
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": ctx.DeviceSession.DevEUI,
+		"defer":   minWait,
+		"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+	}).Warning("downlink/data: duty-cycle budget exhausted for all gateways, deferring downlink")
+
+	if ctx.DeviceQueueItem != nil {
+		retryAfter := time.Now().Add(minWait)
+		ctx.DeviceQueueItem.RetryAfter = &retryAfter
+		if err := storage.UpdateDeviceQueueItem(ctx.ctx, ctx.DB, ctx.DeviceQueueItem); err != nil {
+			return errors.Wrap(err, "update device-queue item error")
+		}
+	}
+
+	return ErrAbort
+}
+
 func sendDownlinkFrame(ctx *dataContext) error {
 	if len(ctx.DownlinkFrameItems) == 0 {
 		return nil
@@ -1612,6 +1815,13 @@ func sendDownlinkFramePassiveRoaming(ctx *dataContext) error {
 
 	log.WithFields(logFields).Info("downlink/data: forwarded downlink using passive-roaming")
 
+	roaming.RecordUsage(ctx.ctx, storage.RoamingUsage{
+		NetID:         netID,
+		Role:          storage.RoamingRoleHNS,
+		DownlinkCount: 1,
+		DownlinkBytes: len(req.PHYPayload),
+	})
+
 	return nil
 }
 
@@ -1632,11 +1842,23 @@ func getDeviceProfile(ctx *dataContext) error {
 }
 
 func getDeviceExtraConfig(ctx *dataContext) error {
-	var err error
-	ctx.DeviceExtraConfig, err = storage.GetAndCacheDeviceExtraConfigurationsCache(ctx.ctx, ctx.DB, ctx.DeviceSession.DevEUI)
+	ec, err := storage.GetOptionalDeviceExtraConfigurations(ctx.ctx, ctx.DB, ctx.DeviceSession.DevEUI)
 	if err != nil {
 		return errors.Wrap(err, "get extra-config error")
 	}
+
+	if ec != nil {
+		ctx.DeviceExtraConfig = *ec
+	} else {
+		// The current channels of the device-session are used, so that
+		// these are not reconfigured.
+		ctx.DeviceExtraConfig = storage.DeviceExtraConfigurations{
+			DevEUI: ctx.DeviceSession.DevEUI,
+		}
+		for _, i := range ctx.DeviceSession.EnabledUplinkChannels {
+			ctx.DeviceExtraConfig.EnabledChannels = append(ctx.DeviceExtraConfig.EnabledChannels, int32(i))
+		}
+	}
 	return nil
 }
 
@@ -1685,13 +1907,67 @@ func setDeviceGatewayRXInfo(ctx *dataContext) error {
 			return errors.Wrap(err, "get device gateway RXInfoSet error")
 		}
 
-		ctx.DeviceGatewayRXInfo = rxInfo.Items
+		var ids []lorawan.EUI64
+		for _, item := range rxInfo.Items {
+			ids = append(ids, item.GatewayID)
+		}
+
+		// Unlike for Class-A, there is no guarantee that the gateway is still
+		// connected.
+		excluded, err := presence.GetExcludedGateways(ctx.ctx, ids)
+		if err != nil {
+			return errors.Wrap(err, "get excluded gateways error")
+		}
+
+		for _, item := range rxInfo.Items {
+			if _, ok := excluded[item.GatewayID]; ok {
+				continue
+			}
+			ctx.DeviceGatewayRXInfo = append(ctx.DeviceGatewayRXInfo, item)
+		}
+
+		// Keep the queue-item until one of the gateways is back online.
+		if len(rxInfo.Items) != 0 && len(ctx.DeviceGatewayRXInfo) == 0 {
+			log.WithFields(log.Fields{
+				"dev_eui": ctx.DeviceSession.DevEUI,
+				"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+			}).Warning("downlink/data: all gateways of device are offline, postponing downlink")
+			return ErrAbort
+		}
 	}
 
 	if len(ctx.DeviceGatewayRXInfo) == 0 {
 		return errors.New("DeviceGatewayRXInfo, the device needs to send an uplink first")
 	}
 
+	return excludeBlacklistedGateways(ctx)
+}
+
+// excludeBlacklistedGateways removes the gateways which are blacklisted
+// because of repeated tx ack errors. When all gateways are blacklisted, the
+// list is left unchanged as it is better to try than not to send at all.
+func excludeBlacklistedGateways(ctx *dataContext) error {
+	var ids []lorawan.EUI64
+	for _, rxInfo := range ctx.DeviceGatewayRXInfo {
+		ids = append(ids, rxInfo.GatewayID)
+	}
+
+	blacklisted, err := storage.GetBlacklistedGateways(ctx.ctx, ids)
+	if err != nil {
+		return errors.Wrap(err, "get blacklisted gateways error")
+	}
+	if len(blacklisted) == 0 || len(blacklisted) == len(ids) {
+		return nil
+	}
+
+	var rxInfo []storage.DeviceGatewayRXInfo
+	for _, item := range ctx.DeviceGatewayRXInfo {
+		if _, ok := blacklisted[item.GatewayID]; !ok {
+			rxInfo = append(rxInfo, item)
+		}
+	}
+	ctx.DeviceGatewayRXInfo = rxInfo
+
 	return nil
 }
 
@@ -1760,6 +2036,19 @@ func saveDownlinkFrame(ctx *dataContext) error {
 		return errors.Wrap(err, "save downlink-frame error")
 	}
 
+	if downlinkFallbackEnabled {
+		fb := storage.DownlinkFallback{
+			TriedGatewayIDs: []lorawan.EUI64{ctx.DownlinkGateway.GatewayID},
+		}
+		if ctx.RXPacket != nil {
+			fb.UplinkReceivedAt = ctx.RXPacket.ReceivedAt
+		}
+
+		if err := storage.SaveDownlinkFallback(ctx.ctx, uint16(ctx.DownlinkFrame.Token), fb); err != nil {
+			return errors.Wrap(err, "save downlink fallback error")
+		}
+	}
+
 	return nil
 }
 
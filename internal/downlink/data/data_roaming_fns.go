@@ -12,6 +12,7 @@ import (
 	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
 
+	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/backend"
 	"github.com/kamicuu/chirpstack-api/go/v3/gw"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
@@ -101,6 +102,11 @@ func HandleRoamingFNS(ctx context.Context, pl backend.XmitDataReqPayload) error
 		downlink.Items = append(downlink.Items, &item)
 	}
 
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(pl.SenderID)); err != nil {
+		return errors.Wrap(err, "decode senderid error")
+	}
+
 	df := storage.DownlinkFrame{
 		Token:         downlink.Token,
 		DownlinkFrame: &downlink,
@@ -114,6 +120,17 @@ func HandleRoamingFNS(ctx context.Context, pl backend.XmitDataReqPayload) error
 		return errors.Wrap(err, "send downlink-frame to gateway error")
 	}
 
+	var gatewayID lorawan.EUI64
+	copy(gatewayID[:], downlink.GatewayId)
+
+	roaming.RecordUsage(ctx, storage.RoamingUsage{
+		NetID:         netID,
+		Role:          storage.RoamingRoleFNS,
+		DownlinkCount: 1,
+		DownlinkBytes: len(pl.PHYPayload),
+		GatewayIDs:    []lorawan.EUI64{gatewayID},
+	})
+
 	return nil
 }
 
@@ -17,6 +17,7 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/applicationserver"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/dutycycle"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -1925,3 +1926,36 @@ func TestSetPHYPayloads(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckDutyCyclePassiveRoaming(t *testing.T) {
+	assert := require.New(t)
+
+	conf := test.GetConfig()
+	conf.NetworkServer.NetworkSettings.DutyCycle.Enabled = true
+	conf.NetworkServer.NetworkSettings.DutyCycle.Window = time.Hour
+	assert.NoError(dutycycle.Setup(conf))
+	defer func() {
+		assert.NoError(dutycycle.Setup(test.GetConfig()))
+	}()
+
+	t.Run("No budget", func(t *testing.T) {
+		assert := require.New(t)
+		ctx := dataContext{
+			ctx:           context.Background(),
+			DownlinkFrame: gw.DownlinkFrame{},
+		}
+		assert.Equal(ErrAbort, checkDutyCycle(&ctx))
+	})
+
+	t.Run("Passive-roaming", func(t *testing.T) {
+		assert := require.New(t)
+		ctx := dataContext{
+			ctx:           context.Background(),
+			DownlinkFrame: gw.DownlinkFrame{},
+			RXPacket: &models.RXPacket{
+				RoamingMetaData: &models.RoamingMetaData{},
+			},
+		}
+		assert.NoError(checkDutyCycle(&ctx))
+	})
+}
@@ -6,7 +6,9 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/ack"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/data"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/dutycycle"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/join"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/multicast"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/proprietary"
@@ -22,6 +24,14 @@ func Setup(conf config.Config) error {
 	nsConfig := conf.NetworkServer
 	schedulerInterval = nsConfig.Scheduler.SchedulerInterval
 
+	if err := dutycycle.Setup(conf); err != nil {
+		return errors.Wrap(err, "setup downlink/dutycycle error")
+	}
+
+	if err := ack.Setup(conf); err != nil {
+		return errors.Wrap(err, "setup downlink/ack error")
+	}
+
 	if err := data.Setup(conf); err != nil {
 		return errors.Wrap(err, "setup downlink/data error")
 	}
@@ -0,0 +1,236 @@
+// Package dutycycle implements the (regulatory) duty-cycle accounting of
+// the gateway downlink transmissions. The time-on-air of each transmitted
+// downlink is stored in a ledger per gateway and sub-band, which is consulted
+// before a downlink is sent.
+package dutycycle
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/airtime"
+	loraband "github.com/brocaar/lorawan/band"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// SubBand defines a sub-band with its max. duty-cycle.
+type SubBand struct {
+	Name         string
+	MinFrequency uint32
+	MaxFrequency uint32
+
+	// MaxDutyCycle defines the max. duty-cycle in percent (e.g. 1.0 = 1%).
+	MaxDutyCycle float64
+}
+
+// eu868SubBands contains the EU868 sub-bands as defined by ETSI EN 300 220.
+var eu868SubBands = []SubBand{
+	{Name: "h1.3", MinFrequency: 863000000, MaxFrequency: 865000000, MaxDutyCycle: 0.1},
+	{Name: "h1.4", MinFrequency: 865000000, MaxFrequency: 868000000, MaxDutyCycle: 1},
+	{Name: "g1", MinFrequency: 868000000, MaxFrequency: 868600000, MaxDutyCycle: 1},
+	{Name: "g2", MinFrequency: 868700000, MaxFrequency: 869200000, MaxDutyCycle: 0.1},
+	{Name: "g3", MinFrequency: 869400000, MaxFrequency: 869650000, MaxDutyCycle: 10},
+	{Name: "g4", MinFrequency: 869700000, MaxFrequency: 870000000, MaxDutyCycle: 1},
+}
+
+var (
+	enabled  bool
+	window   time.Duration
+	subBands []SubBand
+)
+
+// Setup configures the duty-cycle package.
+func Setup(conf config.Config) error {
+	dcConf := conf.NetworkServer.NetworkSettings.DutyCycle
+
+	enabled = dcConf.Enabled
+	window = dcConf.Window
+	subBands = nil
+
+	for _, sb := range dcConf.SubBands {
+		subBands = append(subBands, SubBand{
+			Name:         sb.Name,
+			MinFrequency: sb.MinFrequency,
+			MaxFrequency: sb.MaxFrequency,
+			MaxDutyCycle: sb.MaxDutyCycle,
+		})
+	}
+
+	if len(subBands) == 0 {
+		switch conf.NetworkServer.Band.Name {
+		case loraband.EU868, loraband.EU_863_870:
+			subBands = eu868SubBands
+		}
+	}
+
+	if enabled && window == 0 {
+		return errors.New("duty-cycle window must be greater than 0")
+	}
+
+	return nil
+}
+
+// Enabled returns true when duty-cycle accounting is enabled.
+func Enabled() bool {
+	return enabled
+}
+
+// GetSubBand returns the sub-band for the given frequency.
+func GetSubBand(freq uint32) (SubBand, bool) {
+	for _, sb := range subBands {
+		if freq >= sb.MinFrequency && freq <= sb.MaxFrequency {
+			return sb, true
+		}
+	}
+
+	return SubBand{}, false
+}
+
+// GetTimeOnAir returns the time-on-air of the given downlink frame item.
+func GetTimeOnAir(item *gw.DownlinkFrameItem) (time.Duration, error) {
+	txInfo := item.GetTxInfo()
+	if txInfo == nil {
+		return 0, errors.New("tx-info must not be nil")
+	}
+
+	if modInfo := txInfo.GetLoraModulationInfo(); modInfo != nil {
+		var codeRate airtime.CodingRate
+		switch modInfo.CodeRate {
+		case "4/5":
+			codeRate = airtime.CodingRate45
+		case "4/6":
+			codeRate = airtime.CodingRate46
+		case "4/7":
+			codeRate = airtime.CodingRate47
+		case "4/8":
+			codeRate = airtime.CodingRate48
+		default:
+			return 0, fmt.Errorf("unexpected code-rate: %s", modInfo.CodeRate)
+		}
+
+		sf := int(modInfo.SpreadingFactor)
+		bw := int(modInfo.Bandwidth)
+		ldro := sf >= 11 && bw == 125
+
+		return airtime.CalculateLoRaAirtime(len(item.PhyPayload), sf, bw, 8, codeRate, true, ldro)
+	}
+
+	if modInfo := txInfo.GetFskModulationInfo(); modInfo != nil {
+		if modInfo.Datarate == 0 {
+			return 0, errors.New("fsk data-rate must not be 0")
+		}
+
+		// preamble (5) + sync-word (3) + length (1) + payload + crc (2)
+		bits := (5 + 3 + 1 + len(item.PhyPayload) + 2) * 8
+		return time.Duration(bits) * time.Second / time.Duration(modInfo.Datarate), nil
+	}
+
+	return 0, errors.New("unexpected modulation-info")
+}
+
+// Check returns the duration after which the given downlink frame item can
+// be transmitted by the given gateway without exceeding the duty-cycle of
+// the sub-band. A duration of 0 means that the item can be transmitted
+// immediately. When maxDutyCycle (percent) is > 0, it further limits the
+// duty-cycle of the sub-band.
+func Check(ctx context.Context, gatewayID lorawan.EUI64, item *gw.DownlinkFrameItem, maxDutyCycle int) (time.Duration, error) {
+	if !enabled {
+		return 0, nil
+	}
+
+	sb, ok := GetSubBand(item.GetTxInfo().GetFrequency())
+	if !ok {
+		return 0, nil
+	}
+
+	toa, err := GetTimeOnAir(item)
+	if err != nil {
+		return 0, errors.Wrap(err, "get time-on-air error")
+	}
+
+	records, err := storage.GetGatewayAirtime(ctx, gatewayID, sb.Name, window)
+	if err != nil {
+		return 0, errors.Wrap(err, "get gateway airtime error")
+	}
+
+	dc := sb.MaxDutyCycle
+	if maxDutyCycle > 0 && float64(maxDutyCycle) < dc {
+		dc = float64(maxDutyCycle)
+	}
+	budget := time.Duration(float64(window) * dc / 100)
+
+	var used time.Duration
+	for _, r := range records {
+		used += r.Airtime
+	}
+	if budget > 0 {
+		remainingBudgetHistogram(sb.Name).Observe(math.Max(0, float64(budget-used)/float64(budget)))
+	}
+
+	if used+toa <= budget {
+		return 0, nil
+	}
+
+	exhaustedCounter(sb.Name).Inc()
+
+	log.WithFields(log.Fields{
+		"gateway_id":  gatewayID,
+		"sub_band":    sb.Name,
+		"budget":      budget,
+		"used":        used,
+		"time_on_air": toa,
+		"ctx_id":      ctx.Value(logging.ContextIDKey),
+	}).Info("dutycycle: duty-cycle budget exhausted")
+
+	// Calculate when enough airtime has expired from the window. A record
+	// leaves the window one minute after its timestamp + window.
+	var freed time.Duration
+	for _, r := range records {
+		freed += r.Airtime
+		if used-freed+toa <= budget {
+			wait := time.Until(r.Time.Add(window + time.Minute))
+			if wait <= 0 {
+				wait = time.Second
+			}
+			return wait, nil
+		}
+	}
+
+	// the frame does not fit within the budget at all
+	return window, nil
+}
+
+// Record adds the time-on-air of the given (transmitted) downlink frame item
+// to the ledger of the given gateway.
+func Record(ctx context.Context, gatewayID lorawan.EUI64, item *gw.DownlinkFrameItem) error {
+	if !enabled {
+		return nil
+	}
+
+	sb, ok := GetSubBand(item.GetTxInfo().GetFrequency())
+	if !ok {
+		return nil
+	}
+
+	toa, err := GetTimeOnAir(item)
+	if err != nil {
+		return errors.Wrap(err, "get time-on-air error")
+	}
+
+	if err := storage.AddGatewayAirtime(ctx, gatewayID, sb.Name, time.Now(), toa, window); err != nil {
+		return errors.Wrap(err, "add gateway airtime error")
+	}
+
+	airtimeCounter(sb.Name).Add(toa.Seconds())
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package dutycycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+func TestGetSubBand(t *testing.T) {
+	assert := require.New(t)
+
+	conf := test.GetConfig()
+	assert.NoError(Setup(conf))
+
+	tests := []struct {
+		Frequency uint32
+		Expected  string
+		Found     bool
+	}{
+		{Frequency: 864100000, Expected: "h1.3", Found: true},
+		{Frequency: 868100000, Expected: "g1", Found: true},
+		{Frequency: 869525000, Expected: "g3", Found: true},
+		{Frequency: 869300000, Found: false},
+	}
+
+	for _, tst := range tests {
+		sb, ok := GetSubBand(tst.Frequency)
+		assert.Equal(tst.Found, ok)
+		assert.Equal(tst.Expected, sb.Name)
+	}
+}
+
+func TestGetTimeOnAir(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Item     gw.DownlinkFrameItem
+		Expected time.Duration
+	}{
+		{
+			Name: "lora sf7",
+			Item: gw.DownlinkFrameItem{
+				PhyPayload: make([]byte, 13),
+				TxInfo: &gw.DownlinkTXInfo{
+					ModulationInfo: &gw.DownlinkTXInfo_LoraModulationInfo{
+						LoraModulationInfo: &gw.LoRaModulationInfo{
+							Bandwidth:       125,
+							SpreadingFactor: 7,
+							CodeRate:        "4/5",
+						},
+					},
+				},
+			},
+			Expected: 46336 * time.Microsecond,
+		},
+		{
+			Name: "fsk",
+			Item: gw.DownlinkFrameItem{
+				PhyPayload: make([]byte, 13),
+				TxInfo: &gw.DownlinkTXInfo{
+					ModulationInfo: &gw.DownlinkTXInfo_FskModulationInfo{
+						FskModulationInfo: &gw.FSKModulationInfo{
+							Datarate: 50000,
+						},
+					},
+				},
+			},
+			Expected: 3840 * time.Microsecond,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			toa, err := GetTimeOnAir(&tst.Item)
+			assert.NoError(err)
+			assert.Equal(tst.Expected, toa)
+		})
+	}
+}
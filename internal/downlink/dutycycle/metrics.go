@@ -0,0 +1,36 @@
+package dutycycle
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rbh = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dutycycle_remaining_budget_ratio",
+		Help:    "The remaining duty-cycle budget of the gateway as ratio of the total budget, observed on every duty-cycle check (per sub-band).",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+	}, []string{"sub_band"})
+
+	ac = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dutycycle_airtime_seconds",
+		Help: "The time-on-air of the transmitted downlinks (per sub-band).",
+	}, []string{"sub_band"})
+
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dutycycle_exhausted_count",
+		Help: "The number of times a downlink could not be sent because the duty-cycle budget was exhausted (per sub-band).",
+	}, []string{"sub_band"})
+)
+
+func remainingBudgetHistogram(subBand string) prometheus.Observer {
+	return rbh.With(prometheus.Labels{"sub_band": subBand})
+}
+
+func airtimeCounter(subBand string) prometheus.Counter {
+	return ac.With(prometheus.Labels{"sub_band": subBand})
+}
+
+func exhaustedCounter(subBand string) prometheus.Counter {
+	return ec.With(prometheus.Labels{"sub_band": subBand})
+}
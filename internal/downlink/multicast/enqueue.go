@@ -7,6 +7,8 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/presence"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers/classb"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -43,6 +45,11 @@ func EnqueueQueueItem(ctx context.Context, db sqlx.Ext, qi storage.MulticastQueu
 		return errors.Wrap(err, "get device gateway rx-info set for deveuis errors")
 	}
 
+	rxInfoSets, err = excludeOfflineGateways(ctx, rxInfoSets)
+	if err != nil {
+		return errors.Wrap(err, "exclude offline gateways error")
+	}
+
 	gatewayIDs, err := GetMinimumGatewaySet(rxInfoSets)
 	if err != nil {
 		return errors.Wrap(err, "get minimum gateway set error")
@@ -109,3 +116,40 @@ func EnqueueQueueItem(ctx context.Context, db sqlx.Ext, qi storage.MulticastQueu
 
 	return nil
 }
+
+// excludeOfflineGateways removes the offline gateways from the given
+// rx-info sets, so that these are not used for the gateway selection.
+func excludeOfflineGateways(ctx context.Context, rxInfoSets []storage.DeviceGatewayRXInfoSet) ([]storage.DeviceGatewayRXInfoSet, error) {
+	var ids []lorawan.EUI64
+	seen := make(map[lorawan.EUI64]struct{})
+	for _, set := range rxInfoSets {
+		for _, item := range set.Items {
+			if _, ok := seen[item.GatewayID]; !ok {
+				seen[item.GatewayID] = struct{}{}
+				ids = append(ids, item.GatewayID)
+			}
+		}
+	}
+
+	excluded, err := presence.GetExcludedGateways(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	if len(excluded) == 0 {
+		return rxInfoSets, nil
+	}
+
+	out := make([]storage.DeviceGatewayRXInfoSet, 0, len(rxInfoSets))
+	for _, set := range rxInfoSets {
+		items := set.Items
+		set.Items = nil
+		for _, item := range items {
+			if _, ok := excluded[item.GatewayID]; !ok {
+				set.Items = append(set.Items, item)
+			}
+		}
+		out = append(out, set)
+	}
+
+	return out, nil
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/dutycycle"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -40,6 +41,7 @@ var multicastTasks = []func(*multicastContext) error{
 	validatePayloadSize,
 	setTXInfo,
 	setPHYPayload,
+	checkDutyCycle,
 	saveDownlinkFrame,
 	sendDownlinkData,
 }
@@ -211,6 +213,47 @@ func setPHYPayload(ctx *multicastContext) error {
 	return nil
 }
 
+// checkDutyCycle defers the multicast queue-item when the duty-cycle budget
+// of the gateway has been exhausted. As Class-B multicast queue-items can't
+// be shifted to a different ping-slot, these are discarded.
+func checkDutyCycle(ctx *multicastContext) error {
+	wait, err := dutycycle.Check(ctx.ctx, ctx.MulticastQueueItem.GatewayID, ctx.DownlinkFrame.Items[0], 0)
+	if err != nil {
+		return errors.Wrap(err, "check duty-cycle error")
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	if ctx.MulticastQueueItem.EmitAtTimeSinceGPSEpoch != nil {
+		log.WithFields(log.Fields{
+			"multicast_group_id": ctx.MulticastGroup.ID,
+			"gateway_id":         ctx.MulticastQueueItem.GatewayID,
+			"ctx_id":             ctx.ctx.Value(logging.ContextIDKey),
+		}).Warning("duty-cycle budget exhausted, discarding class-b multicast queue-item")
+
+		if err := storage.DeleteMulticastQueueItem(ctx.ctx, ctx.DB, ctx.MulticastQueueItem.ID); err != nil {
+			return errors.Wrap(err, "delete multicast-queue item error")
+		}
+
+		return errAbort
+	}
+
+	log.WithFields(log.Fields{
+		"multicast_group_id": ctx.MulticastGroup.ID,
+		"gateway_id":         ctx.MulticastQueueItem.GatewayID,
+		"defer":              wait,
+		"ctx_id":             ctx.ctx.Value(logging.ContextIDKey),
+	}).Info("duty-cycle budget exhausted, deferring multicast queue-item")
+
+	ctx.MulticastQueueItem.ScheduleAt = time.Now().Add(wait)
+	if err := storage.UpdateMulticastQueueItem(ctx.ctx, ctx.DB, &ctx.MulticastQueueItem); err != nil {
+		return errors.Wrap(err, "update multicast-queue item error")
+	}
+
+	return errAbort
+}
+
 func sendDownlinkData(ctx *multicastContext) error {
 	if err := gateway.Backend().SendTXPacket(ctx.DownlinkFrame); err != nil {
 		return errors.Wrap(err, "send downlink frame to gateway error")
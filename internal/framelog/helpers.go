@@ -1,12 +1,14 @@
 package framelog
 
 import (
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
 
 	"github.com/brocaar/lorawan"
 	"github.com/kamicuu/chirpstack-api/go/v3/common"
 	"github.com/kamicuu/chirpstack-api/go/v3/ns"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
 // CreateUplinkFrameLog creates a UplinkFrameLog.
@@ -37,3 +39,45 @@ func CreateUplinkFrameLog(rxPacket models.RXPacket) (ns.UplinkFrameLog, error) {
 		MType:      protoMType,
 	}, nil
 }
+
+// CreateDeviceChannelsStatus creates a DeviceChannelsStatus.
+func CreateDeviceChannelsStatus(s storage.DeviceChannelsStatus) (*ns.DeviceChannelsStatus, error) {
+	out := ns.DeviceChannelsStatus{}
+
+	switch s.State {
+	case storage.DeviceChannelsPending:
+		out.State = ns.DeviceChannelsState_PENDING
+	case storage.DeviceChannelsInProgress:
+		out.State = ns.DeviceChannelsState_IN_PROGRESS
+	case storage.DeviceChannelsApplied:
+		out.State = ns.DeviceChannelsState_APPLIED
+	case storage.DeviceChannelsRejected:
+		out.State = ns.DeviceChannelsState_REJECTED
+	}
+
+	if !s.UpdatedAt.IsZero() {
+		var err error
+		out.UpdatedAt, err = ptypes.TimestampProto(s.UpdatedAt)
+		if err != nil {
+			return nil, errors.Wrap(err, "timestamp proto error")
+		}
+	}
+
+	if s.NewChannelAns != nil {
+		out.NewChannelAns = &ns.NewChannelAnsStatus{
+			ChannelIndex:       uint32(s.NewChannelAns.ChannelIndex),
+			ChannelFrequencyOk: s.NewChannelAns.ChannelFrequencyOK,
+			DataRateRangeOk:    s.NewChannelAns.DataRateRangeOK,
+		}
+	}
+
+	if s.LinkADRAns != nil {
+		out.LinkAdrAns = &ns.LinkADRAnsStatus{
+			ChannelMaskAck: s.LinkADRAns.ChannelMaskACK,
+			DataRateAck:    s.LinkADRAns.DataRateACK,
+			PowerAck:       s.LinkADRAns.PowerACK,
+		}
+	}
+
+	return &out, nil
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/stats"
 )
 
 var (
@@ -19,6 +20,10 @@ var (
 func Setup(c config.Config) error {
 	conf := c.NetworkServer.Gateway
 
+	if err := stats.Setup(c); err != nil {
+		return errors.Wrap(err, "setup gateway stats error")
+	}
+
 	statsHandler = &StatsHandler{}
 	if err := statsHandler.Start(); err != nil {
 		return errors.Wrap(err, "start stats handler error")
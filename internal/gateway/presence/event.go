@@ -0,0 +1,120 @@
+package presence
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// Event represents a gateway online / offline event.
+type Event struct {
+	GatewayID  lorawan.EUI64        `json:"gatewayID"`
+	State      storage.GatewayState `json:"state"`
+	Source     Source               `json:"source,omitempty"`
+	LastSeenAt *time.Time           `json:"lastSeenAt,omitempty"`
+	Time       time.Time            `json:"time"`
+}
+
+// EventSink defines the interface of a gateway presence event sink.
+type EventSink interface {
+	// Send sends the given event.
+	Send(ctx context.Context, e Event) error
+}
+
+func newEventSink(c config.Config) (EventSink, error) {
+	conf := c.NetworkServer.Gateway.Presence.EventSink
+
+	switch conf.Type {
+	case "", "log":
+		return &logEventSink{}, nil
+	case "http":
+		if conf.HTTP.URL == "" {
+			return nil, errors.New("http event sink url must be set")
+		}
+		return &httpEventSink{
+			url: conf.HTTP.URL,
+			client: &http.Client{
+				Timeout: conf.HTTP.Timeout,
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown event sink type: %s", conf.Type)
+	}
+}
+
+// SetEventSink overrides the configured event sink.
+func SetEventSink(s EventSink) {
+	sink = s
+}
+
+func sendEvent(ctx context.Context, e Event) {
+	eventCounter(e.State).Inc()
+
+	if sink == nil {
+		return
+	}
+
+	if err := sink.Send(ctx, e); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": e.GatewayID,
+			"state":      e.State,
+			"ctx_id":     ctx.Value(logging.ContextIDKey),
+		}).Error("gateway/presence: send event error")
+	}
+}
+
+// logEventSink logs the events.
+type logEventSink struct{}
+
+func (s *logEventSink) Send(ctx context.Context, e Event) error {
+	log.WithFields(log.Fields{
+		"gateway_id":   e.GatewayID,
+		"state":        e.State,
+		"source":       e.Source,
+		"last_seen_at": e.LastSeenAt,
+		"ctx_id":       ctx.Value(logging.ContextIDKey),
+	}).Info("gateway/presence: gateway state event")
+	return nil
+}
+
+// httpEventSink posts the events as JSON to the configured endpoint.
+type httpEventSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpEventSink) Send(ctx context.Context, e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshal json error")
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "new request error")
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "http request error")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("expected 2xx response, got: %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package presence
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+var (
+	ec = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_presence_event_count",
+		Help: "The number of gateway online / offline events (per state).",
+	}, []string{"state"})
+)
+
+func eventCounter(state storage.GatewayState) prometheus.Counter {
+	return ec.With(prometheus.Labels{"state": string(state)})
+}
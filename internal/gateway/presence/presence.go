@@ -0,0 +1,291 @@
+// Package presence keeps track of the online / offline state of gateways.
+// A gateway is online when it has been seen (stats, uplinks or downlink
+// acknowledgements) within a multiple of the stats interval of its
+// gateway-profile.
+package presence
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// Source defines the source by which the gateway was seen.
+type Source string
+
+// Available sources.
+const (
+	SourceStats  Source = "stats"
+	SourceUplink Source = "uplink"
+	SourceTXAck  Source = "tx_ack"
+)
+
+// statsIntervalCacheTTL defines how long the stats interval of a
+// gateway-profile is cached in memory.
+const statsIntervalCacheTTL = time.Minute
+
+// seenStoreInterval defines the max. interval at which the last-seen
+// timestamp of a gateway is stored (per Network Server instance), as
+// gateways are seen for every stats, uplink and tx ack. The interval is
+// capped to half the offline deadline of the gateway.
+const seenStoreInterval = 10 * time.Second
+
+var (
+	offlineMultiplier    = 3
+	defaultStatsInterval = 30 * time.Second
+	checkInterval        time.Duration
+	excludeOffline       bool
+	sink                 EventSink
+
+	statsIntervalCacheMux sync.RWMutex
+	statsIntervalCache    = make(map[uuid.UUID]cachedStatsInterval)
+
+	seenStoredMux sync.Mutex
+	seenStored    = make(map[lorawan.EUI64]storedSeen)
+)
+
+type storedSeen struct {
+	storedAt     time.Time
+	offlineAfter time.Duration
+}
+
+type cachedStatsInterval struct {
+	interval  time.Duration
+	expiresAt time.Time
+}
+
+// Setup configures the presence package.
+func Setup(c config.Config) error {
+	conf := c.NetworkServer.Gateway.Presence
+
+	offlineMultiplier = conf.OfflineMultiplier
+	if offlineMultiplier < 1 {
+		offlineMultiplier = 1
+	}
+	defaultStatsInterval = conf.DefaultStatsInterval
+	checkInterval = conf.CheckInterval
+	excludeOffline = conf.ExcludeOffline
+
+	statsIntervalCacheMux.Lock()
+	statsIntervalCache = make(map[uuid.UUID]cachedStatsInterval)
+	statsIntervalCacheMux.Unlock()
+
+	seenStoredMux.Lock()
+	seenStored = make(map[lorawan.EUI64]storedSeen)
+	seenStoredMux.Unlock()
+
+	var err error
+	sink, err = newEventSink(c)
+	if err != nil {
+		return errors.Wrap(err, "new event sink error")
+	}
+
+	return nil
+}
+
+// CheckLoop periodically marks the gateways which have not been seen
+// within their offline deadline as offline.
+func CheckLoop() {
+	if checkInterval == 0 {
+		return
+	}
+
+	for {
+		ctxID, err := uuid.NewV4()
+		if err != nil {
+			log.WithError(err).Error("gateway/presence: get new uuid error")
+		}
+
+		ctx := context.Background()
+		ctx = context.WithValue(ctx, logging.ContextIDKey, ctxID)
+
+		if err := CheckOffline(ctx); err != nil {
+			log.WithError(err).WithField("ctx_id", ctxID).Error("gateway/presence: check offline gateways error")
+		}
+
+		time.Sleep(checkInterval)
+	}
+}
+
+// CheckOffline marks the gateways of which the offline deadline has passed
+// as offline and emits an offline event for each of these gateways.
+func CheckOffline(ctx context.Context) error {
+	ids, err := storage.PopOfflineGateways(ctx, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "pop offline gateways error")
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	items, err := storage.GetGatewaysPresence(ctx, ids)
+	if err != nil {
+		return errors.Wrap(err, "get gateways presence error")
+	}
+
+	for _, id := range ids {
+		log.WithFields(log.Fields{
+			"gateway_id": id,
+			"ctx_id":     ctx.Value(logging.ContextIDKey),
+		}).Info("gateway/presence: gateway went offline")
+
+		sendEvent(ctx, Event{
+			GatewayID:  id,
+			State:      storage.GatewayStateOffline,
+			LastSeenAt: items[id].LastSeenAt,
+			Time:       time.Now(),
+		})
+	}
+
+	return nil
+}
+
+// Seen records that the given gateway was seen. When the gateway was not
+// online before, an online event is emitted. Gateways which are not
+// provisioned are ignored. The last-seen timestamp is only stored when it
+// has not been stored within the seen store interval of the gateway.
+func Seen(ctx context.Context, gatewayID lorawan.EUI64, source Source) error {
+	now := time.Now()
+	if !shouldStoreSeen(gatewayID, now) {
+		return nil
+	}
+
+	offlineAfter, err := getOfflineAfter(ctx, gatewayID)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return nil
+		}
+		return errors.Wrap(err, "get offline after error")
+	}
+
+	cameOnline, err := storage.SetGatewayLastSeen(ctx, gatewayID, now, offlineAfter)
+	if err != nil {
+		return errors.Wrap(err, "set gateway last-seen error")
+	}
+
+	seenStoredMux.Lock()
+	seenStored[gatewayID] = storedSeen{
+		storedAt:     now,
+		offlineAfter: offlineAfter,
+	}
+	seenStoredMux.Unlock()
+
+	if cameOnline {
+		log.WithFields(log.Fields{
+			"gateway_id": gatewayID,
+			"source":     source,
+			"ctx_id":     ctx.Value(logging.ContextIDKey),
+		}).Info("gateway/presence: gateway came online")
+
+		// don't block the handling of the uplink / stats / ack
+		go sendEvent(ctx, Event{
+			GatewayID:  gatewayID,
+			State:      storage.GatewayStateOnline,
+			Source:     source,
+			LastSeenAt: &now,
+			Time:       now,
+		})
+	}
+
+	return nil
+}
+
+// GetExcludedGateways returns the gateways from the given slice which must
+// be excluded from downlink gateway selection because they are offline.
+// Gateways with an unknown state are not excluded. When the exclusion of
+// offline gateways is disabled, an empty set is returned.
+func GetExcludedGateways(ctx context.Context, ids []lorawan.EUI64) (map[lorawan.EUI64]struct{}, error) {
+	out := make(map[lorawan.EUI64]struct{})
+	if !excludeOffline || len(ids) == 0 {
+		return out, nil
+	}
+
+	items, err := storage.GetGatewaysPresence(ctx, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "get gateways presence error")
+	}
+
+	for id, p := range items {
+		if p.State == storage.GatewayStateOffline {
+			out[id] = struct{}{}
+		}
+	}
+
+	return out, nil
+}
+
+// shouldStoreSeen returns true when the last-seen timestamp of the given
+// gateway must be stored. This is the case when it has not been stored by
+// this instance within the seen store interval, capped to half the offline
+// deadline so that the gateway never goes offline while being seen.
+func shouldStoreSeen(gatewayID lorawan.EUI64, now time.Time) bool {
+	seenStoredMux.Lock()
+	defer seenStoredMux.Unlock()
+
+	s, ok := seenStored[gatewayID]
+	if !ok {
+		return true
+	}
+
+	interval := seenStoreInterval
+	if interval > s.offlineAfter/2 {
+		interval = s.offlineAfter / 2
+	}
+
+	return now.Sub(s.storedAt) >= interval
+}
+
+func getOfflineAfter(ctx context.Context, gatewayID lorawan.EUI64) (time.Duration, error) {
+	meta, err := storage.GetAndCacheGatewayMeta(ctx, storage.DB(), gatewayID)
+	if err != nil {
+		return 0, errors.Wrap(err, "get gateway meta error")
+	}
+
+	interval := defaultStatsInterval
+	if meta.GatewayProfileID != nil {
+		interval, err = getStatsInterval(ctx, *meta.GatewayProfileID)
+		if err != nil {
+			return 0, errors.Wrap(err, "get stats interval error")
+		}
+	}
+
+	return time.Duration(offlineMultiplier) * interval, nil
+}
+
+func getStatsInterval(ctx context.Context, gatewayProfileID uuid.UUID) (time.Duration, error) {
+	statsIntervalCacheMux.RLock()
+	c, ok := statsIntervalCache[gatewayProfileID]
+	statsIntervalCacheMux.RUnlock()
+
+	if ok && time.Now().Before(c.expiresAt) {
+		return c.interval, nil
+	}
+
+	gp, err := storage.GetGatewayProfile(ctx, storage.DB(), gatewayProfileID)
+	if err != nil {
+		return 0, errors.Wrap(err, "get gateway-profile error")
+	}
+
+	interval := gp.StatsInterval
+	if interval == 0 {
+		interval = defaultStatsInterval
+	}
+
+	statsIntervalCacheMux.Lock()
+	statsIntervalCache[gatewayProfileID] = cachedStatsInterval{
+		interval:  interval,
+		expiresAt: time.Now().Add(statsIntervalCacheTTL),
+	}
+	statsIntervalCacheMux.Unlock()
+
+	return interval, nil
+}
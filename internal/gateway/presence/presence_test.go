@@ -0,0 +1,184 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+type testEventSink struct {
+	events chan Event
+}
+
+func (s *testEventSink) Send(ctx context.Context, e Event) error {
+	s.events <- e
+	return nil
+}
+
+type PresenceTestSuite struct {
+	suite.Suite
+
+	sink    *testEventSink
+	gateway storage.Gateway
+}
+
+func (ts *PresenceTestSuite) SetupSuite() {
+	assert := require.New(ts.T())
+	conf := test.GetConfig()
+	assert.NoError(storage.Setup(conf))
+	assert.NoError(Setup(conf))
+}
+
+func (ts *PresenceTestSuite) SetupTest() {
+	assert := require.New(ts.T())
+
+	assert.NoError(storage.MigrateDown(storage.DB().DB))
+	assert.NoError(storage.MigrateUp(storage.DB().DB))
+	storage.RedisClient().FlushAll(context.Background())
+
+	seenStoredMux.Lock()
+	seenStored = make(map[lorawan.EUI64]storedSeen)
+	seenStoredMux.Unlock()
+
+	ts.sink = &testEventSink{events: make(chan Event, 10)}
+	SetEventSink(ts.sink)
+
+	rp := storage.RoutingProfile{}
+	assert.NoError(storage.CreateRoutingProfile(context.Background(), storage.DB(), &rp))
+
+	gp := storage.GatewayProfile{
+		StatsInterval: time.Second,
+	}
+	assert.NoError(storage.CreateGatewayProfile(context.Background(), storage.DB(), &gp))
+
+	ts.gateway = storage.Gateway{
+		GatewayID:        lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		RoutingProfileID: rp.ID,
+		GatewayProfileID: &gp.ID,
+	}
+	assert.NoError(storage.CreateGateway(context.Background(), storage.DB(), &ts.gateway))
+}
+
+func (ts *PresenceTestSuite) TestOnlineOffline() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	assert.NoError(Seen(ctx, ts.gateway.GatewayID, SourceStats))
+
+	e := <-ts.sink.events
+	assert.Equal(ts.gateway.GatewayID, e.GatewayID)
+	assert.Equal(storage.GatewayStateOnline, e.State)
+	assert.Equal(SourceStats, e.Source)
+
+	// no event, the gateway is already online
+	assert.NoError(Seen(ctx, ts.gateway.GatewayID, SourceUplink))
+	assert.NoError(CheckOffline(ctx))
+	assert.Len(ts.sink.events, 0)
+
+	excluded, err := GetExcludedGateways(ctx, []lorawan.EUI64{ts.gateway.GatewayID})
+	assert.NoError(err)
+	assert.Len(excluded, 0)
+
+	// offline after 3 x the gateway-profile stats interval
+	time.Sleep(3*time.Second + 100*time.Millisecond)
+	assert.NoError(CheckOffline(ctx))
+
+	e = <-ts.sink.events
+	assert.Equal(ts.gateway.GatewayID, e.GatewayID)
+	assert.Equal(storage.GatewayStateOffline, e.State)
+	assert.NotNil(e.LastSeenAt)
+
+	excluded, err = GetExcludedGateways(ctx, []lorawan.EUI64{ts.gateway.GatewayID})
+	assert.NoError(err)
+	assert.Len(excluded, 1)
+
+	// back online
+	assert.NoError(Seen(ctx, ts.gateway.GatewayID, SourceTXAck))
+	e = <-ts.sink.events
+	assert.Equal(storage.GatewayStateOnline, e.State)
+	assert.Equal(SourceTXAck, e.Source)
+}
+
+func (ts *PresenceTestSuite) TestSeenRateLimit() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	assert.NoError(Seen(ctx, ts.gateway.GatewayID, SourceStats))
+	<-ts.sink.events
+
+	p, err := storage.GetGatewayPresence(ctx, ts.gateway.GatewayID)
+	assert.NoError(err)
+	lastSeenAt := *p.LastSeenAt
+
+	// not stored within half the offline deadline (1.5 seconds)
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(Seen(ctx, ts.gateway.GatewayID, SourceUplink))
+
+	p, err = storage.GetGatewayPresence(ctx, ts.gateway.GatewayID)
+	assert.NoError(err)
+	assert.True(lastSeenAt.Equal(*p.LastSeenAt))
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.NoError(Seen(ctx, ts.gateway.GatewayID, SourceUplink))
+
+	p, err = storage.GetGatewayPresence(ctx, ts.gateway.GatewayID)
+	assert.NoError(err)
+	assert.True(p.LastSeenAt.After(lastSeenAt))
+	assert.Equal(storage.GatewayStateOnline, p.State)
+	assert.Len(ts.sink.events, 0)
+}
+
+func (ts *PresenceTestSuite) TestUnknownGateway() {
+	assert := require.New(ts.T())
+
+	assert.NoError(Seen(context.Background(), lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, SourceUplink))
+	assert.Len(ts.sink.events, 0)
+}
+
+func TestPresence(t *testing.T) {
+	suite.Run(t, new(PresenceTestSuite))
+}
+
+func TestHTTPEventSink(t *testing.T) {
+	assert := require.New(t)
+
+	events := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		assert.NoError(json.NewDecoder(r.Body).Decode(&e))
+		events <- e
+	}))
+	defer server.Close()
+
+	conf := test.GetConfig()
+	conf.NetworkServer.Gateway.Presence.EventSink.Type = "http"
+	conf.NetworkServer.Gateway.Presence.EventSink.HTTP.URL = server.URL
+	conf.NetworkServer.Gateway.Presence.EventSink.HTTP.Timeout = time.Second
+
+	s, err := newEventSink(conf)
+	assert.NoError(err)
+
+	assert.NoError(s.Send(context.Background(), Event{
+		GatewayID: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		State:     storage.GatewayStateOffline,
+		Time:      time.Now(),
+	}))
+
+	e := <-events
+	assert.Equal(lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}, e.GatewayID)
+	assert.Equal(storage.GatewayStateOffline, e.State)
+
+	conf.NetworkServer.Gateway.Presence.EventSink.Type = "foo"
+	_, err = newEventSink(conf)
+	assert.Error(err)
+}
@@ -0,0 +1,83 @@
+package stats
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/brocaar/lorawan"
+)
+
+var (
+	rxfc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_rx_packets_per_frequency_count",
+		Help: "The number of received packets (per gateway and frequency).",
+	}, []string{"gateway_id", "frequency"})
+
+	txfc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_tx_packets_per_frequency_count",
+		Help: "The number of transmitted packets (per gateway and frequency).",
+	}, []string{"gateway_id", "frequency"})
+
+	rxdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_rx_packets_per_dr_count",
+		Help: "The number of received packets (per gateway and data-rate).",
+	}, []string{"gateway_id", "dr"})
+
+	txdc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_tx_packets_per_dr_count",
+		Help: "The number of transmitted packets (per gateway and data-rate).",
+	}, []string{"gateway_id", "dr"})
+
+	txsc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_tx_packets_per_status_count",
+		Help: "The number of downlink requests (per gateway and tx status).",
+	}, []string{"gateway_id", "status"})
+
+	ilc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_radio_metrics_invalid_label_count",
+		Help: "The number of gateway radio counters not stored because of an invalid frequency or tx status (per label).",
+	}, []string{"label"})
+
+	cpc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_configuration_push_count",
+		Help: "The number of gateway configuration pushes (per result).",
+	}, []string{"result"})
+)
+
+func rxPerFrequencyCounter(gatewayID lorawan.EUI64, freq uint32) prometheus.Counter {
+	return rxfc.With(prometheus.Labels{"gateway_id": gatewayID.String(), "frequency": strconv.FormatUint(uint64(freq), 10)})
+}
+
+func txPerFrequencyCounter(gatewayID lorawan.EUI64, freq uint32) prometheus.Counter {
+	return txfc.With(prometheus.Labels{"gateway_id": gatewayID.String(), "frequency": strconv.FormatUint(uint64(freq), 10)})
+}
+
+func rxPerDRCounter(gatewayID lorawan.EUI64, dr uint32) prometheus.Counter {
+	return rxdc.With(prometheus.Labels{"gateway_id": gatewayID.String(), "dr": strconv.FormatUint(uint64(dr), 10)})
+}
+
+func txPerDRCounter(gatewayID lorawan.EUI64, dr uint32) prometheus.Counter {
+	return txdc.With(prometheus.Labels{"gateway_id": gatewayID.String(), "dr": strconv.FormatUint(uint64(dr), 10)})
+}
+
+func txPerStatusCounter(gatewayID lorawan.EUI64, status string) prometheus.Counter {
+	return txsc.With(prometheus.Labels{"gateway_id": gatewayID.String(), "status": status})
+}
+
+func configPushCounter(result string) prometheus.Counter {
+	return cpc.With(prometheus.Labels{"result": result})
+}
+
+func invalidLabelCounter(label string) prometheus.Counter {
+	return ilc.With(prometheus.Labels{"label": label})
+}
+
+// trackGateway returns true when the radio metrics of the given gateway
+// must be exported, which is the case for the configured
+// prometheus_gateway_ids.
+func trackGateway(gatewayID lorawan.EUI64) bool {
+	_, ok := prometheusGatewayIDs[gatewayID]
+	return ok
+}
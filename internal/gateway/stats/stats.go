@@ -2,6 +2,8 @@ package stats
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
@@ -14,6 +16,8 @@ import (
 	"github.com/kamicuu/chirpstack-api/go/v3/gw"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/gateway"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/presence"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -21,20 +25,61 @@ import (
 
 var ErrAbort = errors.New("abort")
 
+var (
+	radioMetricsEnabled  = true
+	prometheusGatewayIDs map[lorawan.EUI64]struct{}
+	frequencyRange       [2]uint32
+
+	configRetryInterval = time.Minute
+	configMaxAttempts   = 5
+)
+
 type statsContext struct {
-	ctx          context.Context
-	gatewayID    lorawan.EUI64
-	gatewayStats gw.GatewayStats
-	gatewayMeta  storage.GatewayMeta
+	ctx            context.Context
+	gatewayID      lorawan.EUI64
+	gatewayStats   gw.GatewayStats
+	gatewayMeta    storage.GatewayMeta
+	rxPacketsPerDR map[uint32]uint32
+	txPacketsPerDR map[uint32]uint32
+
+	rxPacketsPerFrequency map[uint32]uint32
+	txPacketsPerFrequency map[uint32]uint32
+	txPacketsPerStatus    map[string]uint32
 }
 
 var tasks = []func(*statsContext) error{
 	updateGatewayState,
+	updateGatewayPresence,
 	getGatewayMeta,
 	handleGatewayConfigurationUpdate,
+	setPacketsPerDR,
+	setRadioCounters,
+	saveRadioMetrics,
 	forwardGatewayStats,
 }
 
+// Setup configures the gateway stats package.
+func Setup(c config.Config) error {
+	conf := c.NetworkServer.Gateway.RadioMetrics
+
+	radioMetricsEnabled = conf.Enabled
+	frequencyRange = bandFrequencyRanges[c.NetworkServer.Band.Name]
+
+	prometheusGatewayIDs = make(map[lorawan.EUI64]struct{})
+	for _, s := range conf.PrometheusGatewayIDs {
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(s)); err != nil {
+			return errors.Wrap(err, "decode prometheus gateway id error")
+		}
+		prometheusGatewayIDs[gatewayID] = struct{}{}
+	}
+
+	configRetryInterval = c.NetworkServer.Gateway.ConfigPush.RetryInterval
+	configMaxAttempts = c.NetworkServer.Gateway.ConfigPush.MaxAttempts
+
+	return nil
+}
+
 // Handle handles the gateway stats
 func Handle(ctx context.Context, stats gw.GatewayStats) error {
 	gatewayID := helpers.GetGatewayID(&stats)
@@ -72,6 +117,14 @@ func updateGatewayState(ctx *statsContext) error {
 	return nil
 }
 
+func updateGatewayPresence(ctx *statsContext) error {
+	if err := presence.Seen(ctx.ctx, ctx.gatewayID, presence.SourceStats); err != nil {
+		return errors.Wrap(err, "update gateway presence error")
+	}
+
+	return nil
+}
+
 func getGatewayMeta(ctx *statsContext) error {
 
 	gw, err := storage.GetAndCacheGatewayMeta(ctx.ctx, storage.DB(), ctx.gatewayID)
@@ -83,7 +136,21 @@ func getGatewayMeta(ctx *statsContext) error {
 	return nil
 }
 
+// handleGatewayConfigurationUpdate pushes the gateway-profile configuration
+// to the gateway when needed. Errors are logged, so that these do not
+// prevent the stats from being stored and forwarded.
 func handleGatewayConfigurationUpdate(ctx *statsContext) error {
+	if err := updateGatewayConfiguration(ctx); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"gateway_id": ctx.gatewayID,
+			"ctx_id":     ctx.ctx.Value(logging.ContextIDKey),
+		}).Error("gateway/stats: handle gateway configuration update error")
+	}
+
+	return nil
+}
+
+func updateGatewayConfiguration(ctx *statsContext) error {
 	// no gateway-profile configured
 	if ctx.gatewayMeta.GatewayProfileID == nil {
 		log.WithFields(log.Fields{
@@ -93,32 +160,138 @@ func handleGatewayConfigurationUpdate(ctx *statsContext) error {
 		return nil
 	}
 
-	// not using concentratord
-	if ctx.gatewayStats.GetMetaData()["concentratord_version"] == "" {
-		log.WithFields(log.Fields{
-			"gateway_id": ctx.gatewayMeta.GatewayID,
-		}).Debug("gatway does not support configuration updates")
-		return nil
-	}
-
 	// get gateway-profile
 	gwProfile, err := storage.GetGatewayProfile(ctx.ctx, storage.DB(), *ctx.gatewayMeta.GatewayProfileID)
 	if err != nil {
 		return errors.Wrap(err, "get gateway-profile error")
 	}
 
+	state, err := storage.GetGatewayConfigState(ctx.ctx, ctx.gatewayID)
+	if err != nil {
+		return errors.Wrap(err, "get gateway config state error")
+	}
+
+	// the gateway-profile has been updated, reset the attempts
+	if state.DesiredVersion != gwProfile.GetVersion() {
+		state = storage.GatewayConfigState{
+			DesiredVersion: gwProfile.GetVersion(),
+		}
+	}
+
+	state.AppliedVersion = ctx.gatewayStats.ConfigVersion
+	if state.AppliedVersion == "" {
+		state.AppliedVersion = ctx.gatewayStats.GetMetaData()["config_version"]
+	}
+
 	// compare gateway-profile config version with stats config version
-	if gwProfile.GetVersion() == ctx.gatewayStats.ConfigVersion || gwProfile.GetVersion() == ctx.gatewayStats.GetMetaData()["config_version"] {
-		log.WithFields(log.Fields{
-			"gateway_id": ctx.gatewayMeta.GatewayID,
-			"version":    ctx.gatewayStats.ConfigVersion,
-			"ctx_id":     ctx.ctx.Value(logging.ContextIDKey),
-		}).Debug("gateway configuration is up-to-date")
-		return nil
+	if state.AppliedVersion == state.DesiredVersion {
+		if state.Status != storage.GatewayConfigStatusApplied && state.Attempts != 0 {
+			log.WithFields(log.Fields{
+				"gateway_id": ctx.gatewayMeta.GatewayID,
+				"version":    state.AppliedVersion,
+				"ctx_id":     ctx.ctx.Value(logging.ContextIDKey),
+			}).Info("gateway configuration applied")
+		}
+
+		state.Status = storage.GatewayConfigStatusApplied
+		state.Attempts = 0
+		return saveGatewayConfigState(ctx, state)
+	}
+
+	// The configuration can not be pushed (e.g. Semtech UDP). This is
+	// reported once per gateway-profile version, and exposed as config
+	// status by the API, as the gateway will keep using its own
+	// configuration.
+	if !supportsGatewayConfiguration(ctx) {
+		if state.Status != storage.GatewayConfigStatusNotSupported {
+			log.WithFields(log.Fields{
+				"gateway_id":      ctx.gatewayMeta.GatewayID,
+				"version":         state.AppliedVersion,
+				"desired_version": state.DesiredVersion,
+				"ctx_id":          ctx.ctx.Value(logging.ContextIDKey),
+			}).Warning("gateway does not support configuration updates, the gateway-profile configuration must be applied manually")
+			configPushCounter("not_supported").Inc()
+		}
+
+		state.Status = storage.GatewayConfigStatusNotSupported
+		return saveGatewayConfigState(ctx, state)
 	}
 
+	if state.Attempts >= configMaxAttempts {
+		if state.Status != storage.GatewayConfigStatusFailed {
+			log.WithFields(log.Fields{
+				"gateway_id":      ctx.gatewayMeta.GatewayID,
+				"version":         state.AppliedVersion,
+				"desired_version": state.DesiredVersion,
+				"attempts":        state.Attempts,
+				"ctx_id":          ctx.ctx.Value(logging.ContextIDKey),
+			}).Warning("gateway did not apply configuration, giving up")
+			configPushCounter("failed").Inc()
+		}
+
+		state.Status = storage.GatewayConfigStatusFailed
+		return saveGatewayConfigState(ctx, state)
+	}
+
+	state.Status = storage.GatewayConfigStatusPending
+
+	// wait for the gateway to report the configuration sent before
+	if state.Attempts != 0 && time.Since(state.LastSentAt) < configRetryInterval {
+		return saveGatewayConfigState(ctx, state)
+	}
+
+	configPacket, err := GetGatewayConfiguration(ctx.gatewayMeta.GatewayID, gwProfile)
+	if err != nil {
+		return errors.Wrap(err, "get gateway configuration error")
+	}
+
+	if err := gateway.Backend().SendGatewayConfigPacket(configPacket); err != nil {
+		return errors.Wrap(err, "send gateway-configuration packet error")
+	}
+
+	state.Attempts++
+	state.LastSentAt = time.Now()
+	configPushCounter("sent").Inc()
+
+	log.WithFields(log.Fields{
+		"gateway_id":      ctx.gatewayMeta.GatewayID,
+		"version":         state.AppliedVersion,
+		"desired_version": state.DesiredVersion,
+		"attempt":         state.Attempts,
+		"ctx_id":          ctx.ctx.Value(logging.ContextIDKey),
+	}).Info("gateway configuration sent")
+
+	return saveGatewayConfigState(ctx, state)
+}
+
+// supportsGatewayConfiguration returns true when the gateway configuration
+// can be sent to the gateway. This is the case when the gateway is using
+// Concentratord or when the gateway backend is able to push the
+// configuration to the gateway.
+func supportsGatewayConfiguration(ctx *statsContext) bool {
+	if ctx.gatewayStats.GetMetaData()["concentratord_version"] != "" {
+		return true
+	}
+
+	if c, ok := gateway.Backend().(gateway.ConfigurationCapability); ok {
+		return c.SupportsGatewayConfiguration(ctx.gatewayID)
+	}
+
+	return false
+}
+
+func saveGatewayConfigState(ctx *statsContext, state storage.GatewayConfigState) error {
+	if err := storage.SaveGatewayConfigState(ctx.ctx, ctx.gatewayID, state); err != nil {
+		return errors.Wrap(err, "save gateway config state error")
+	}
+	return nil
+}
+
+// GetGatewayConfiguration returns the gateway configuration for the given
+// gateway ID and gateway-profile.
+func GetGatewayConfiguration(gatewayID lorawan.EUI64, gwProfile storage.GatewayProfile) (gw.GatewayConfiguration, error) {
 	configPacket := gw.GatewayConfiguration{
-		GatewayId:     ctx.gatewayMeta.GatewayID[:],
+		GatewayId:     gatewayID[:],
 		StatsInterval: ptypes.DurationProto(gwProfile.StatsInterval),
 		Version:       gwProfile.GetVersion(),
 	}
@@ -126,7 +299,7 @@ func handleGatewayConfigurationUpdate(ctx *statsContext) error {
 	for _, i := range gwProfile.Channels {
 		c, err := band.Band().GetUplinkChannel(int(i))
 		if err != nil {
-			return errors.Wrap(err, "get channel error")
+			return configPacket, errors.Wrap(err, "get channel error")
 		}
 
 		gwC := gw.ChannelConfiguration{
@@ -139,7 +312,7 @@ func handleGatewayConfigurationUpdate(ctx *statsContext) error {
 		for drI := c.MaxDR; drI >= c.MinDR; drI-- {
 			dr, err := band.Band().GetDataRate(drI)
 			if err != nil {
-				return errors.Wrap(err, "get data-rate error")
+				return configPacket, errors.Wrap(err, "get data-rate error")
 			}
 
 			// skip non-LoRa modulations (e.g. LR-FHSS) and non 125 kHz data-rates
@@ -192,13 +365,119 @@ func handleGatewayConfigurationUpdate(ctx *statsContext) error {
 		configPacket.Channels = append(configPacket.Channels, &gwC)
 	}
 
-	if err := gateway.Backend().SendGatewayConfigPacket(configPacket); err != nil {
-		return errors.Wrap(err, "send gateway-configuration packet error")
+	return configPacket, nil
+}
+
+func setPacketsPerDR(ctx *statsContext) error {
+	ctx.rxPacketsPerDR = perModulationToPerDR(true, ctx.gatewayStats.RxPacketsPerModulation)
+	ctx.txPacketsPerDR = perModulationToPerDR(false, ctx.gatewayStats.TxPacketsPerModulation)
+	return nil
+}
+
+// setRadioCounters sets the per frequency and per tx status counters of the
+// gateway stats, skipping the invalid frequencies and tx statuses.
+func setRadioCounters(ctx *statsContext) error {
+	ctx.rxPacketsPerFrequency = make(map[uint32]uint32)
+	ctx.txPacketsPerFrequency = make(map[uint32]uint32)
+	ctx.txPacketsPerStatus = make(map[string]uint32)
+
+	for freq, count := range ctx.gatewayStats.RxPacketsPerFrequency {
+		if !isValidFrequency(freq) {
+			invalidLabelCounter("frequency").Inc()
+			continue
+		}
+		ctx.rxPacketsPerFrequency[freq] = count
+	}
+	for freq, count := range ctx.gatewayStats.TxPacketsPerFrequency {
+		if !isValidFrequency(freq) {
+			invalidLabelCounter("frequency").Inc()
+			continue
+		}
+		ctx.txPacketsPerFrequency[freq] = count
+	}
+	for status, count := range ctx.gatewayStats.TxPacketsPerStatus {
+		if !isValidTxStatus(status) {
+			invalidLabelCounter("status").Inc()
+			continue
+		}
+		ctx.txPacketsPerStatus[status] = count
 	}
 
 	return nil
 }
 
+func saveRadioMetrics(ctx *statsContext) error {
+	if !radioMetricsEnabled {
+		return nil
+	}
+
+	ts := time.Now()
+	if t, err := ptypes.Timestamp(ctx.gatewayStats.GetTime()); err == nil {
+		ts = t
+	}
+
+	metrics := storage.MetricsRecord{
+		Time: ts,
+		Metrics: map[string]float64{
+			"rx_count":    float64(ctx.gatewayStats.RxPacketsReceived),
+			"rx_ok_count": float64(ctx.gatewayStats.RxPacketsReceivedOk),
+			"tx_count":    float64(ctx.gatewayStats.TxPacketsReceived),
+			"tx_ok_count": float64(ctx.gatewayStats.TxPacketsEmitted),
+		},
+	}
+
+	for freq, count := range ctx.rxPacketsPerFrequency {
+		metrics.Metrics[fmt.Sprintf("%s%d", storage.MetricsRXPerFrequencyPrefix, freq)] = float64(count)
+	}
+	for freq, count := range ctx.txPacketsPerFrequency {
+		metrics.Metrics[fmt.Sprintf("%s%d", storage.MetricsTXPerFrequencyPrefix, freq)] = float64(count)
+	}
+	for dr, count := range ctx.rxPacketsPerDR {
+		metrics.Metrics[fmt.Sprintf("%s%d", storage.MetricsRXPerDRPrefix, dr)] = float64(count)
+	}
+	for dr, count := range ctx.txPacketsPerDR {
+		metrics.Metrics[fmt.Sprintf("%s%d", storage.MetricsTXPerDRPrefix, dr)] = float64(count)
+	}
+	for status, count := range ctx.txPacketsPerStatus {
+		metrics.Metrics[storage.MetricsTXPerStatusPrefix+status] = float64(count)
+	}
+
+	if err := storage.SaveMetrics(ctx.ctx, "gw:"+ctx.gatewayID.String(), metrics); err != nil {
+		return errors.Wrap(err, "save gateway metrics error")
+	}
+
+	exportRadioMetrics(ctx)
+
+	return nil
+}
+
+// exportRadioMetrics exposes the radio counters as Prometheus metrics. To
+// cap the number of label combinations, only the configured
+// prometheus_gateway_ids are exported.
+func exportRadioMetrics(ctx *statsContext) {
+	if !trackGateway(ctx.gatewayID) {
+		return
+	}
+
+	gatewayID := ctx.gatewayID
+
+	for freq, count := range ctx.rxPacketsPerFrequency {
+		rxPerFrequencyCounter(gatewayID, freq).Add(float64(count))
+	}
+	for freq, count := range ctx.txPacketsPerFrequency {
+		txPerFrequencyCounter(gatewayID, freq).Add(float64(count))
+	}
+	for dr, count := range ctx.rxPacketsPerDR {
+		rxPerDRCounter(gatewayID, dr).Add(float64(count))
+	}
+	for dr, count := range ctx.txPacketsPerDR {
+		txPerDRCounter(gatewayID, dr).Add(float64(count))
+	}
+	for status, count := range ctx.txPacketsPerStatus {
+		txPerStatusCounter(gatewayID, status).Add(float64(count))
+	}
+}
+
 func forwardGatewayStats(ctx *statsContext) error {
 	rp, err := storage.GetRoutingProfile(ctx.ctx, storage.DB(), ctx.gatewayMeta.RoutingProfileID)
 	if err != nil {
@@ -222,8 +501,8 @@ func forwardGatewayStats(ctx *statsContext) error {
 		Metadata:              ctx.gatewayStats.MetaData,
 		TxPacketsPerFrequency: ctx.gatewayStats.TxPacketsPerFrequency,
 		RxPacketsPerFrequency: ctx.gatewayStats.RxPacketsPerFrequency,
-		TxPacketsPerDr:        perModulationToPerDR(false, ctx.gatewayStats.TxPacketsPerModulation),
-		RxPacketsPerDr:        perModulationToPerDR(true, ctx.gatewayStats.RxPacketsPerModulation),
+		TxPacketsPerDr:        ctx.txPacketsPerDR,
+		RxPacketsPerDr:        ctx.rxPacketsPerDR,
 		TxPacketsPerStatus:    ctx.gatewayStats.TxPacketsPerStatus,
 	})
 	if err != nil {
@@ -273,3 +552,51 @@ func perModulationToPerDR(uplink bool, items []*gw.PerModulationCount) map[uint3
 
 	return out
 }
+
+// bandFrequencyRanges contains the (regional) frequency range in Hz per band.
+var bandFrequencyRanges = map[loraband.Name][2]uint32{
+	loraband.EU868:      {863000000, 870000000},
+	loraband.EU_863_870: {863000000, 870000000},
+	loraband.US915:      {902000000, 928000000},
+	loraband.US_902_928: {902000000, 928000000},
+	loraband.CN779:      {779000000, 787000000},
+	loraband.CN_779_787: {779000000, 787000000},
+	loraband.EU433:      {433050000, 434790000},
+	loraband.EU_433:     {433050000, 434790000},
+	loraband.AU915:      {915000000, 928000000},
+	loraband.AU_915_928: {915000000, 928000000},
+	loraband.CN470:      {470000000, 510000000},
+	loraband.CN_470_510: {470000000, 510000000},
+	loraband.AS923:      {915000000, 928000000},
+	loraband.AS923_2:    {915000000, 928000000},
+	loraband.AS923_3:    {915000000, 928000000},
+	loraband.AS923_4:    {915000000, 928000000},
+	loraband.AS_923:     {915000000, 928000000},
+	loraband.KR920:      {920900000, 923300000},
+	loraband.KR_920_923: {920900000, 923300000},
+	loraband.IN865:      {865000000, 867000000},
+	loraband.IN_865_867: {865000000, 867000000},
+	loraband.RU864:      {864000000, 870000000},
+	loraband.RU_864_870: {864000000, 870000000},
+	loraband.ISM2400:    {2400000000, 2500000000},
+}
+
+// isValidFrequency returns true when the given frequency is within the
+// frequency range of the configured band. As the gateway stats are reported
+// by the gateway, these are validated before using the frequency as metric
+// name or label.
+func isValidFrequency(freq uint32) bool {
+	// unknown band
+	if frequencyRange[1] == 0 {
+		return freq != 0
+	}
+
+	return freq >= frequencyRange[0] && freq <= frequencyRange[1]
+}
+
+// isValidTxStatus returns true when the given status is a known tx ack
+// status.
+func isValidTxStatus(status string) bool {
+	_, ok := gw.TxAckStatus_value[status]
+	return ok
+}
@@ -109,6 +109,10 @@ func (ts *GatewayConfigurationTestSuite) TestUpdate() {
 			}))
 
 			assert.Len(ts.backend.GatewayConfigPacketChan, 0)
+
+			state, err := storage.GetGatewayConfigState(context.Background(), ts.gateway.GatewayID)
+			assert.NoError(err)
+			assert.Equal(storage.GatewayConfigStatusNotSupported, state.Status)
 		})
 
 		t.Run("Concentratord", func(t *testing.T) {
@@ -180,11 +184,117 @@ func (ts *GatewayConfigurationTestSuite) TestUpdate() {
 					},
 				},
 			}, gwConfig)
+
+			state, err := storage.GetGatewayConfigState(context.Background(), ts.gateway.GatewayID)
+			assert.NoError(err)
+			assert.Equal(storage.GatewayConfigStatusPending, state.Status)
+			assert.Equal(gp.GetVersion(), state.DesiredVersion)
+			assert.Equal("1.2.3", state.AppliedVersion)
+			assert.Equal(1, state.Attempts)
+		})
+
+		t.Run("Retry interval not expired", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(Handle(context.Background(), gw.GatewayStats{
+				GatewayId:     ts.gateway.GatewayID[:],
+				ConfigVersion: "1.2.3",
+				MetaData: map[string]string{
+					"concentratord_version": "3.3.0",
+				},
+			}))
+
+			assert.Len(ts.backend.GatewayConfigPacketChan, 0)
+
+			state, err := storage.GetGatewayConfigState(context.Background(), ts.gateway.GatewayID)
+			assert.NoError(err)
+			assert.Equal(storage.GatewayConfigStatusPending, state.Status)
+			assert.Equal(1, state.Attempts)
+		})
+
+		t.Run("Max attempts", func(t *testing.T) {
+			assert := require.New(t)
+
+			state, err := storage.GetGatewayConfigState(context.Background(), ts.gateway.GatewayID)
+			assert.NoError(err)
+			state.Attempts = configMaxAttempts
+			assert.NoError(storage.SaveGatewayConfigState(context.Background(), ts.gateway.GatewayID, state))
+
+			assert.NoError(Handle(context.Background(), gw.GatewayStats{
+				GatewayId:     ts.gateway.GatewayID[:],
+				ConfigVersion: "1.2.3",
+				MetaData: map[string]string{
+					"concentratord_version": "3.3.0",
+				},
+			}))
+
+			assert.Len(ts.backend.GatewayConfigPacketChan, 0)
+
+			state, err = storage.GetGatewayConfigState(context.Background(), ts.gateway.GatewayID)
+			assert.NoError(err)
+			assert.Equal(storage.GatewayConfigStatusFailed, state.Status)
+		})
+
+		t.Run("Applied", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(Handle(context.Background(), gw.GatewayStats{
+				GatewayId:     ts.gateway.GatewayID[:],
+				ConfigVersion: gp.GetVersion(),
+				MetaData: map[string]string{
+					"concentratord_version": "3.3.0",
+				},
+			}))
+
+			assert.Len(ts.backend.GatewayConfigPacketChan, 0)
+
+			state, err := storage.GetGatewayConfigState(context.Background(), ts.gateway.GatewayID)
+			assert.NoError(err)
+			assert.Equal(storage.GatewayConfigState{
+				Status:         storage.GatewayConfigStatusApplied,
+				DesiredVersion: gp.GetVersion(),
+				AppliedVersion: gp.GetVersion(),
+			}, storage.GatewayConfigState{
+				Status:         state.Status,
+				DesiredVersion: state.DesiredVersion,
+				AppliedVersion: state.AppliedVersion,
+			})
 		})
 
+		t.Run("Backend capability", func(t *testing.T) {
+			assert := require.New(t)
+
+			gateway.SetBackend(&configCapableBackend{ts.backend})
+			defer gateway.SetBackend(ts.backend)
+
+			gw2 := storage.Gateway{
+				GatewayID:        lorawan.EUI64{2, 2, 3, 4, 5, 6, 7, 8},
+				RoutingProfileID: ts.gateway.RoutingProfileID,
+				GatewayProfileID: &gp.ID,
+			}
+			assert.NoError(storage.CreateGateway(context.Background(), storage.DB(), &gw2))
+
+			assert.NoError(Handle(context.Background(), gw.GatewayStats{
+				GatewayId: gw2.GatewayID[:],
+			}))
+
+			gwConfig := <-ts.backend.GatewayConfigPacketChan
+			assert.Equal(gw2.GatewayID[:], gwConfig.GatewayId)
+			assert.Equal(gp.GetVersion(), gwConfig.Version)
+		})
 	})
 }
 
+// configCapableBackend is a test gateway backend which is able to push the
+// gateway configuration to all gateways.
+type configCapableBackend struct {
+	*test.GatewayBackend
+}
+
+func (b *configCapableBackend) SupportsGatewayConfiguration(gatewayID lorawan.EUI64) bool {
+	return true
+}
+
 func TestGatewayConfigurationUpdate(t *testing.T) {
 	suite.Run(t, new(GatewayConfigurationTestSuite))
 }
@@ -203,6 +313,7 @@ func (ts *GatewayStatsTestSuite) SetupSuite() {
 	assert.NoError(storage.MigrateDown(storage.DB().DB))
 	assert.NoError(storage.MigrateUp(storage.DB().DB))
 	storage.RedisClient().FlushAll(context.Background())
+	assert.NoError(Setup(conf))
 
 	rp := storage.RoutingProfile{}
 	assert.NoError(storage.CreateRoutingProfile(context.Background(), storage.DB(), &rp))
@@ -241,6 +352,7 @@ func (ts *GatewayStatsTestSuite) TestStats() {
 		},
 		RxPacketsPerFrequency: map[uint32]uint32{
 			868300000: 9,
+			123:       1,
 		},
 		TxPacketsPerModulation: []*gw.PerModulationCount{
 			{
@@ -274,6 +386,7 @@ func (ts *GatewayStatsTestSuite) TestStats() {
 		TxPacketsPerStatus: map[string]uint32{
 			"OK":       10,
 			"TOO_LATE": 3,
+			"FOO":      1,
 		},
 		MetaData: map[string]string{
 			"foo": "bar",
@@ -297,6 +410,7 @@ func (ts *GatewayStatsTestSuite) TestStats() {
 		},
 		RxPacketsPerFrequency: map[uint32]uint32{
 			868300000: 9,
+			123:       1,
 		},
 		TxPacketsPerDr: map[uint32]uint32{
 			4: 10,
@@ -307,11 +421,61 @@ func (ts *GatewayStatsTestSuite) TestStats() {
 		TxPacketsPerStatus: map[string]uint32{
 			"OK":       10,
 			"TOO_LATE": 3,
+			"FOO":      1,
 		},
 		Metadata: map[string]string{
 			"foo": "bar",
 		},
 	}, asReq)
+
+	metrics, err := storage.GetMetrics(context.Background(), storage.AggregationMinute, "gw:"+ts.gateway.GatewayID.String(), now, now)
+	assert.NoError(err)
+	assert.Len(metrics, 1)
+	assert.Equal(map[string]float64{
+		"rx_count":           11,
+		"rx_ok_count":        9,
+		"tx_count":           13,
+		"tx_ok_count":        10,
+		"rx_freq_868300000":  9,
+		"tx_freq_868100000":  10,
+		"rx_dr_2":            9,
+		"tx_dr_4":            10,
+		"tx_status_OK":       10,
+		"tx_status_TOO_LATE": 3,
+	}, metrics[0].Metrics)
+}
+
+func (ts *GatewayStatsTestSuite) TestTrackGateway() {
+	assert := require.New(ts.T())
+
+	conf := test.GetConfig()
+	conf.NetworkServer.Gateway.RadioMetrics.PrometheusGatewayIDs = []string{"0100000000000000"}
+	assert.NoError(Setup(conf))
+	defer func() {
+		assert.NoError(Setup(test.GetConfig()))
+	}()
+
+	assert.True(trackGateway(lorawan.EUI64{1}))
+	assert.False(trackGateway(lorawan.EUI64{2}))
+
+	conf.NetworkServer.Gateway.RadioMetrics.PrometheusGatewayIDs = []string{"foo"}
+	assert.Error(Setup(conf))
+}
+
+func TestIsValidFrequency(t *testing.T) {
+	assert := require.New(t)
+
+	conf := test.GetConfig()
+	conf.NetworkServer.Band.Name = band.EU868
+	assert.NoError(Setup(conf))
+	defer func() {
+		assert.NoError(Setup(test.GetConfig()))
+	}()
+
+	assert.True(isValidFrequency(868100000))
+	assert.True(isValidFrequency(869525000))
+	assert.False(isValidFrequency(0))
+	assert.False(isValidFrequency(915000000))
 }
 
 func TestGatewayStats(t *testing.T) {
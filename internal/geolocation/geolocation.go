@@ -0,0 +1,84 @@
+// Package geolocation implements the network-side geolocation of devices,
+// based on the meta-data of the gateways receiving an uplink.
+package geolocation
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+)
+
+// ErrInsufficientData is returned when the uplink meta-data does not contain
+// enough data to resolve the location of the device.
+var ErrInsufficientData = errors.New("insufficient data to resolve location")
+
+// ResolveRequest contains the data needed for resolving the location of a
+// device.
+type ResolveRequest struct {
+	// RXInfo contains the (de-duplicated) rx-info set of the uplink. The
+	// location of each gateway must be set.
+	RXInfo []*gw.UplinkRXInfo
+
+	// ReferenceAltitude holds the device reference altitude.
+	ReferenceAltitude float64
+}
+
+// Resolver defines the geolocation resolver interface.
+type Resolver interface {
+	// ID returns the resolver ID.
+	ID() string
+
+	// Resolve resolves the location of the device. It returns
+	// ErrInsufficientData when the location can not be resolved.
+	Resolve(ctx context.Context, req ResolveRequest) (*common.Location, error)
+}
+
+var (
+	resolvers map[string]Resolver
+	resolver  Resolver
+)
+
+func init() {
+	resolvers = make(map[string]Resolver)
+	Register(&LocalResolver{MinGatewayCount: 3})
+}
+
+// Register registers the given resolver. It replaces an already registered
+// resolver with the same ID.
+func Register(r Resolver) {
+	resolvers[r.ID()] = r
+}
+
+// Setup configures the geolocation package.
+func Setup(conf config.Config) error {
+	geoConf := conf.NetworkServer.Geolocation
+
+	Register(&LocalResolver{MinGatewayCount: geoConf.MinGatewayCount})
+
+	id := geoConf.Resolver
+	if id == "" {
+		id = "local"
+	}
+
+	r, ok := resolvers[id]
+	if !ok {
+		return fmt.Errorf("unknown geolocation resolver: %s", id)
+	}
+	resolver = r
+
+	return nil
+}
+
+// Resolve resolves the location of the device using the configured resolver.
+func Resolve(ctx context.Context, req ResolveRequest) (*common.Location, error) {
+	if resolver == nil {
+		return nil, errors.New("geolocation resolver is not configured")
+	}
+
+	return resolver.Resolve(ctx, req)
+}
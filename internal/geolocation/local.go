@@ -0,0 +1,260 @@
+package geolocation
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+)
+
+const (
+	speedOfLight  = 299792458.0 // m/s
+	earthRadius   = 6378137.0   // m
+	maxIterations = 100
+)
+
+// LocalResolver implements a resolver which solves the location locally.
+// It uses TDOA when enough gateways provide a (decrypted) fine-timestamp and
+// falls back to a RSSI weighted centroid otherwise.
+type LocalResolver struct {
+	// MinGatewayCount defines the min. number of gateways needed to resolve
+	// the location. Values below 3 are handled as 3.
+	MinGatewayCount int
+}
+
+type gatewayMeta struct {
+	latitude  float64
+	longitude float64
+	altitude  float64
+	rssi      int32
+	time      *time.Time
+}
+
+type point struct {
+	x, y, z float64
+}
+
+// ID returns the resolver ID.
+func (r *LocalResolver) ID() string {
+	return "local"
+}
+
+// Resolve resolves the location of the device.
+func (r *LocalResolver) Resolve(ctx context.Context, req ResolveRequest) (*common.Location, error) {
+	minCount := r.MinGatewayCount
+	if minCount < 3 {
+		minCount = 3
+	}
+
+	var gws, tdoaGWs []gatewayMeta
+	for _, rxInfo := range req.RXInfo {
+		loc := rxInfo.GetLocation()
+		if loc == nil || (loc.Latitude == 0 && loc.Longitude == 0) {
+			continue
+		}
+
+		gwMeta := gatewayMeta{
+			latitude:  loc.Latitude,
+			longitude: loc.Longitude,
+			altitude:  loc.Altitude,
+			rssi:      rxInfo.Rssi,
+		}
+
+		if ts := rxInfo.GetPlainFineTimestamp(); ts != nil {
+			if t, err := ptypes.Timestamp(ts.GetTime()); err == nil {
+				gwMeta.time = &t
+			}
+		}
+
+		gws = append(gws, gwMeta)
+		if gwMeta.time != nil {
+			tdoaGWs = append(tdoaGWs, gwMeta)
+		}
+	}
+
+	if len(tdoaGWs) >= minCount {
+		loc, err := resolveTDOA(tdoaGWs, req.ReferenceAltitude)
+		if err == nil {
+			return loc, nil
+		}
+		if err != ErrInsufficientData {
+			return nil, err
+		}
+	}
+
+	if len(gws) >= minCount {
+		return resolveRSSI(gws, req.ReferenceAltitude), nil
+	}
+
+	return nil, ErrInsufficientData
+}
+
+// resolveTDOA solves the location using the time-difference of arrival,
+// using the Gauss-Newton method. The gateway which received the uplink first
+// is used as reference. The accuracy is the RMS of the range-difference
+// residuals.
+func resolveTDOA(gws []gatewayMeta, refAlt float64) (*common.Location, error) {
+	lat0, lon0 := getOrigin(gws)
+
+	ref := 0
+	points := make([]point, len(gws))
+	for i := range gws {
+		points[i] = toLocal(lat0, lon0, gws[i])
+		if gws[i].time.Before(*gws[ref].time) {
+			ref = i
+		}
+	}
+
+	// the initial estimate is the centroid of the gateways
+	var x, y float64
+	for _, p := range points {
+		x += p.x / float64(len(points))
+		y += p.y / float64(len(points))
+	}
+
+	residuals := func(x, y float64) ([]float64, [][2]float64) {
+		var res []float64
+		var jac [][2]float64
+		d0 := math.Sqrt(math.Pow(x-points[ref].x, 2) + math.Pow(y-points[ref].y, 2) + math.Pow(refAlt-points[ref].z, 2))
+
+		for i, p := range points {
+			if i == ref {
+				continue
+			}
+
+			di := math.Sqrt(math.Pow(x-p.x, 2) + math.Pow(y-p.y, 2) + math.Pow(refAlt-p.z, 2))
+			if di == 0 || d0 == 0 {
+				continue
+			}
+
+			tdoa := gws[i].time.Sub(*gws[ref].time).Seconds()
+			res = append(res, (di-d0)-speedOfLight*tdoa)
+			jac = append(jac, [2]float64{
+				(x-p.x)/di - (x-points[ref].x)/d0,
+				(y-p.y)/di - (y-points[ref].y)/d0,
+			})
+		}
+
+		return res, jac
+	}
+
+	for i := 0; i < maxIterations; i++ {
+		res, jac := residuals(x, y)
+
+		var a11, a12, a22, b1, b2 float64
+		for j := range res {
+			a11 += jac[j][0] * jac[j][0]
+			a12 += jac[j][0] * jac[j][1]
+			a22 += jac[j][1] * jac[j][1]
+			b1 += jac[j][0] * res[j]
+			b2 += jac[j][1] * res[j]
+		}
+
+		// e.g. in case all gateways are on a single line
+		det := a11*a22 - a12*a12
+		if det == 0 {
+			return nil, ErrInsufficientData
+		}
+
+		dx := -(a22*b1 - a12*b2) / det
+		dy := -(a11*b2 - a12*b1) / det
+		x += dx
+		y += dy
+
+		if math.IsNaN(x) || math.IsNaN(y) {
+			return nil, ErrInsufficientData
+		}
+
+		if math.Hypot(dx, dy) < 0.01 {
+			break
+		}
+	}
+
+	var sumSq float64
+	res, _ := residuals(x, y)
+	for _, r := range res {
+		sumSq += r * r
+	}
+	var accuracy float64
+	if len(res) != 0 {
+		accuracy = math.Sqrt(sumSq / float64(len(res)))
+	}
+
+	lat, lon := fromLocal(lat0, lon0, x, y)
+
+	return &common.Location{
+		Latitude:  lat,
+		Longitude: lon,
+		Altitude:  refAlt,
+		Source:    common.LocationSource_GEO_RESOLVER_TDOA,
+		Accuracy:  uint32(math.Ceil(accuracy)),
+	}, nil
+}
+
+// resolveRSSI returns the RSSI weighted centroid of the gateways. The
+// accuracy is the weighted mean distance between the centroid and the
+// gateways.
+func resolveRSSI(gws []gatewayMeta, refAlt float64) *common.Location {
+	lat0, lon0 := getOrigin(gws)
+
+	points := make([]point, len(gws))
+	weights := make([]float64, len(gws))
+	var x, y, sumW float64
+
+	for i := range gws {
+		points[i] = toLocal(lat0, lon0, gws[i])
+		weights[i] = math.Pow(10, float64(gws[i].rssi)/20)
+		x += points[i].x * weights[i]
+		y += points[i].y * weights[i]
+		sumW += weights[i]
+	}
+	x /= sumW
+	y /= sumW
+
+	var accuracy float64
+	for i, p := range points {
+		accuracy += math.Hypot(x-p.x, y-p.y) * weights[i] / sumW
+	}
+
+	lat, lon := fromLocal(lat0, lon0, x, y)
+
+	return &common.Location{
+		Latitude:  lat,
+		Longitude: lon,
+		Altitude:  refAlt,
+		Source:    common.LocationSource_GEO_RESOLVER_RSSI,
+		Accuracy:  uint32(math.Ceil(accuracy)),
+	}
+}
+
+// getOrigin returns the mean latitude and longitude of the gateways, which
+// is used as origin of the local (east, north, up) coordinate system.
+func getOrigin(gws []gatewayMeta) (float64, float64) {
+	var lat, lon float64
+	for _, gw := range gws {
+		lat += gw.latitude / float64(len(gws))
+		lon += gw.longitude / float64(len(gws))
+	}
+	return lat, lon
+}
+
+// toLocal converts the gateway location to the local coordinate system
+// (in meters), using an equirectangular projection. This is accurate enough
+// for the distances covered by the gateways receiving a single uplink.
+func toLocal(lat0, lon0 float64, gw gatewayMeta) point {
+	return point{
+		x: (gw.longitude - lon0) * math.Pi / 180 * earthRadius * math.Cos(lat0*math.Pi/180),
+		y: (gw.latitude - lat0) * math.Pi / 180 * earthRadius,
+		z: gw.altitude,
+	}
+}
+
+// fromLocal converts the local coordinates to a latitude and longitude.
+func fromLocal(lat0, lon0, x, y float64) (float64, float64) {
+	lat := lat0 + y/earthRadius*180/math.Pi
+	lon := lon0 + x/(earthRadius*math.Cos(lat0*math.Pi/180))*180/math.Pi
+	return lat, lon
+}
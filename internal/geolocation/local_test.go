@@ -0,0 +1,97 @@
+package geolocation
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/stretchr/testify/require"
+
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+)
+
+func TestLocalResolver(t *testing.T) {
+	lat0, lon0 := 52.0, 5.0
+	device := point{x: 800, y: -1200, z: 10}
+	gwPoints := []point{
+		{x: -3000, y: -2500, z: 30},
+		{x: 3500, y: -2000, z: 25},
+		{x: 500, y: 4000, z: 40},
+		{x: -2500, y: 2500, z: 20},
+	}
+	rxTime := time.Now().Truncate(time.Second)
+
+	// getRXInfo returns the rx-info set, with the first withTS gateways
+	// providing a fine-timestamp
+	getRXInfo := func(withTS int) []*gw.UplinkRXInfo {
+		var out []*gw.UplinkRXInfo
+		for i, p := range gwPoints {
+			lat, lon := fromLocal(lat0, lon0, p.x, p.y)
+			d := math.Sqrt(math.Pow(p.x-device.x, 2) + math.Pow(p.y-device.y, 2) + math.Pow(p.z-device.z, 2))
+
+			rxInfo := gw.UplinkRXInfo{
+				Rssi: int32(-40 - d/100),
+				Location: &common.Location{
+					Latitude:  lat,
+					Longitude: lon,
+					Altitude:  p.z,
+				},
+			}
+
+			if i < withTS {
+				ts, _ := ptypes.TimestampProto(rxTime.Add(time.Duration(d / speedOfLight * float64(time.Second))))
+				rxInfo.FineTimestampType = gw.FineTimestampType_PLAIN
+				rxInfo.FineTimestamp = &gw.UplinkRXInfo_PlainFineTimestamp{
+					PlainFineTimestamp: &gw.PlainFineTimestamp{
+						Time: ts,
+					},
+				}
+			}
+
+			out = append(out, &rxInfo)
+		}
+		return out
+	}
+
+	r := &LocalResolver{MinGatewayCount: 3}
+
+	t.Run("TDOA", func(t *testing.T) {
+		assert := require.New(t)
+
+		loc, err := r.Resolve(context.Background(), ResolveRequest{
+			RXInfo:            getRXInfo(4),
+			ReferenceAltitude: device.z,
+		})
+		assert.NoError(err)
+		assert.Equal(common.LocationSource_GEO_RESOLVER_TDOA, loc.Source)
+
+		p := toLocal(lat0, lon0, gatewayMeta{latitude: loc.Latitude, longitude: loc.Longitude})
+		assert.InDelta(device.x, p.x, 2)
+		assert.InDelta(device.y, p.y, 2)
+		assert.InDelta(0, loc.Accuracy, 2)
+	})
+
+	t.Run("RSSI fallback", func(t *testing.T) {
+		assert := require.New(t)
+
+		loc, err := r.Resolve(context.Background(), ResolveRequest{
+			RXInfo:            getRXInfo(2),
+			ReferenceAltitude: device.z,
+		})
+		assert.NoError(err)
+		assert.Equal(common.LocationSource_GEO_RESOLVER_RSSI, loc.Source)
+		assert.True(loc.Accuracy > 0)
+	})
+
+	t.Run("Insufficient data", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := r.Resolve(context.Background(), ResolveRequest{
+			RXInfo: getRXInfo(2)[:2],
+		})
+		assert.Equal(ErrInsufficientData, err)
+	})
+}
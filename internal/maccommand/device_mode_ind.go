@@ -20,22 +20,29 @@ func handleDeviceModeInd(ctx context.Context, ds *storage.DeviceSession, block s
 		return nil, fmt.Errorf("expected *lorawan.DeviceModeIntPayload, got: %T", block.MACCommands[0].Payload)
 	}
 
-	d, err := storage.GetDevice(ctx, storage.DB(), ds.DevEUI, false)
-	if err != nil {
-		return nil, errors.Wrap(err, "get device error")
-	}
-
+	var mode storage.DeviceMode
 	switch pl.Class {
 	case lorawan.DeviceModeClassA:
-		d.Mode = storage.DeviceModeA
+		mode = storage.DeviceModeA
 	case lorawan.DeviceModeClassC:
-		d.Mode = storage.DeviceModeC
+		mode = storage.DeviceModeC
 	default:
 		return nil, fmt.Errorf("unexpected device mode: %s", pl.Class)
 	}
 
-	if err := storage.UpdateDevice(ctx, storage.DB(), &d); err != nil {
-		return nil, errors.Wrap(err, "update device error")
+	// Devices handed over by their hNS (handover-roaming) are not
+	// provisioned on this Network Server, in which case the device mode is
+	// confirmed without updating the device.
+	d, err := storage.GetDevice(ctx, storage.DB(), ds.DevEUI, false)
+	if err != nil && errors.Cause(err) != storage.ErrDoesNotExist {
+		return nil, errors.Wrap(err, "get device error")
+	}
+
+	if err == nil {
+		d.Mode = mode
+		if err := storage.UpdateDevice(ctx, storage.DB(), &d); err != nil {
+			return nil, errors.Wrap(err, "update device error")
+		}
 	}
 
 	return []storage.MACCommandBlock{
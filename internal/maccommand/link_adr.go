@@ -5,7 +5,7 @@ import (
 	"fmt"
 
 	"github.com/brocaar/lorawan"
-	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/channels"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 	"github.com/pkg/errors"
@@ -60,7 +60,7 @@ func handleLinkADRAns(ctx context.Context, ds *storage.DeviceSession, block stor
 		// reset the error counter
 		delete(ds.MACCommandErrorCount, lorawan.LinkADRAns)
 
-		chans, err := band.Band().GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(ds.EnabledUplinkChannels, linkADRPayloads)
+		chans, err := channels.GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(*ds, linkADRPayloads)
 		if err != nil {
 			return nil, errors.Wrap(err, "get enalbed channels for link_adr_req payloads error")
 		}
@@ -87,7 +87,7 @@ func handleLinkADRAns(ctx context.Context, ds *storage.DeviceSession, block stor
 		// reset the error counter
 		delete(ds.MACCommandErrorCount, lorawan.LinkADRAns)
 
-		chans, err := band.Band().GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(ds.EnabledUplinkChannels, linkADRPayloads)
+		chans, err := channels.GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(*ds, linkADRPayloads)
 		if err != nil {
 			return nil, errors.Wrap(err, "get enalbed channels for link_adr_req payloads error")
 		}
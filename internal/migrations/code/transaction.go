@@ -7,6 +7,12 @@ import (
 
 var errRollback = errors.New("rollback")
 
+// ErrPostpone can be returned by the migration function to rollback the
+// migration without marking it as applied. It will be executed again on the
+// next Migrate call (e.g. when the schema it depends on has not been applied
+// yet).
+var ErrPostpone = errRollback
+
 // transaction wraps the given function in a transaction. In case the given
 // functions returns an error, the transaction will be rolled back.
 // Note: this is a copy of storage.Transaction, but since the storage package
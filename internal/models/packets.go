@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/backend"
 	"github.com/gofrs/uuid"
@@ -29,6 +31,12 @@ type RXPacket struct {
 
 	// RoamingMetaData holds the meta-data in case of a roaming device.
 	RoamingMetaData *RoamingMetaData
+
+	// ReceivedAt holds the earliest time the uplink was received by one of
+	// the gateways. In case the gateways do not provide a (valid) rx time,
+	// or it is later than the time the network-server received the first
+	// uplink frame, the latter is used.
+	ReceivedAt time.Time
 }
 
 // RoamingMetaData holds the Backend Interfaces roaming meta-data.
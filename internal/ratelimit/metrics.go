@@ -0,0 +1,26 @@
+package ratelimit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_uplink_count",
+		Help: "The number of uplinks exceeding the service-profile uplink rate (per action).",
+	}, []string{"action"})
+
+	dc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_downlink_count",
+		Help: "The number of device-queue downlinks exceeding the service-profile downlink rate (per action).",
+	}, []string{"action"})
+)
+
+func uplinkCounter(action string) prometheus.Counter {
+	return uc.With(prometheus.Labels{"action": action})
+}
+
+func downlinkCounter(action string) prometheus.Counter {
+	return dc.With(prometheus.Labels{"action": action})
+}
@@ -0,0 +1,140 @@
+// Package ratelimit enforces the service-profile uplink and downlink rates
+// (ULRate / DLRate) using a token-bucket per device.
+//
+// Uplinks exceeding the uplink rate are dropped or marked, depending on the
+// ULRatePolicy. For the downlink direction, the Drop policy refuses the
+// device-queue item on enqueue, the Mark policy keeps the item in the queue
+// and delays the transmission until a token is available.
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// ErrDownlinkRateExceeded is returned when a device-queue item is refused
+// because of the service-profile downlink rate.
+var ErrDownlinkRateExceeded = errors.New("downlink rate exceeded")
+
+// Action defines the action to take for rate-limited traffic.
+type Action int
+
+// Available actions.
+const (
+	Allow Action = iota
+	Drop
+	Mark
+)
+
+// CheckUplink takes an uplink token for the given device and returns the
+// action to take for the uplink.
+func CheckUplink(ctx context.Context, sp storage.ServiceProfile, devEUI lorawan.EUI64) (Action, error) {
+	if sp.ULRate == 0 {
+		return Allow, nil
+	}
+
+	ok, _, err := storage.TakeRateLimitToken(ctx, devEUI, storage.RateLimitUplink, sp.ULRate, sp.ULBucketSize)
+	if err != nil {
+		return Allow, errors.Wrap(err, "take rate-limit token error")
+	}
+	if ok {
+		return Allow, nil
+	}
+
+	action := Drop
+	if sp.ULRatePolicy == storage.Mark {
+		action = Mark
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":     devEUI,
+		"ul_rate":     sp.ULRate,
+		"rate_policy": sp.ULRatePolicy,
+		"ctx_id":      ctx.Value(logging.ContextIDKey),
+	}).Warning("ratelimit: uplink rate exceeded")
+
+	if action == Mark {
+		uplinkCounter("mark").Inc()
+	} else {
+		uplinkCounter("drop").Inc()
+	}
+
+	return action, nil
+}
+
+// CheckDownlinkEnqueue must be called before enqueueing a device-queue item.
+// For the Drop policy, it takes a downlink token and returns
+// ErrDownlinkRateExceeded when no token is available.
+func CheckDownlinkEnqueue(ctx context.Context, sp storage.ServiceProfile, devEUI lorawan.EUI64) error {
+	if sp.DLRate == 0 || sp.DLRatePolicy == storage.Mark {
+		return nil
+	}
+
+	ok, _, err := storage.TakeRateLimitToken(ctx, devEUI, storage.RateLimitDownlink, sp.DLRate, sp.DLBucketSize)
+	if err != nil {
+		return errors.Wrap(err, "take rate-limit token error")
+	}
+	if ok {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"dl_rate": sp.DLRate,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Warning("ratelimit: device-queue item refused, downlink rate exceeded")
+
+	downlinkCounter("refuse").Inc()
+
+	return ErrDownlinkRateExceeded
+}
+
+// CheckDownlinkTransmission must be called before transmitting a
+// device-queue item. For the Mark policy, it returns the duration by which
+// the transmission must be delayed when no downlink token is available. The
+// token is not taken, see TakeDownlinkTransmission.
+func CheckDownlinkTransmission(ctx context.Context, sp storage.ServiceProfile, devEUI lorawan.EUI64) (time.Duration, error) {
+	if sp.DLRate == 0 || sp.DLRatePolicy != storage.Mark {
+		return 0, nil
+	}
+
+	wait, err := storage.GetRateLimitTokenWait(ctx, devEUI, storage.RateLimitDownlink, sp.DLRate, sp.DLBucketSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "get rate-limit token wait error")
+	}
+	if wait == 0 {
+		return 0, nil
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"dl_rate": sp.DLRate,
+		"delay":   wait,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("ratelimit: device-queue item delayed, downlink rate exceeded")
+
+	downlinkCounter("delay").Inc()
+
+	return wait, nil
+}
+
+// TakeDownlinkTransmission must be called after a device-queue item has been
+// transmitted. For the Mark policy, it takes a downlink token.
+func TakeDownlinkTransmission(ctx context.Context, sp storage.ServiceProfile, devEUI lorawan.EUI64) error {
+	if sp.DLRate == 0 || sp.DLRatePolicy != storage.Mark {
+		return nil
+	}
+
+	if _, _, err := storage.TakeRateLimitToken(ctx, devEUI, storage.RateLimitDownlink, sp.DLRate, sp.DLBucketSize); err != nil {
+		return errors.Wrap(err, "take rate-limit token error")
+	}
+
+	return nil
+}
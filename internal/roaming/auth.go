@@ -0,0 +1,98 @@
+package roaming
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+var (
+	// ErrUnauthenticated is returned when the inbound credentials of a
+	// roaming API request are missing or invalid.
+	ErrUnauthenticated = errors.New("inbound credentials missing or invalid")
+
+	// ErrSenderIDMismatch is returned when the inbound credentials of a
+	// roaming API request belong to a different roaming partner than the
+	// SenderID of the request.
+	ErrSenderIDMismatch = errors.New("SenderID does not match authenticated roaming partner")
+)
+
+// AuthenticateInbound authenticates a roaming API request from the roaming
+// partner identified by senderID, using the Authorization header value and
+// the (optional) client-certificate of the request.
+//
+// When inbound credentials are configured for the roaming partner, these
+// must match. Credentials matching a different roaming partner result in
+// ErrSenderIDMismatch. When no inbound credentials are configured, the
+// request is accepted unless the roaming API requires authentication.
+func AuthenticateInbound(senderID lorawan.NetID, authorization string, cert *x509.Certificate) error {
+	var senderHasCredentials bool
+
+	for _, a := range getAgreements() {
+		if a.netID != senderID || a.disabled || !a.hasInboundCredentials() {
+			continue
+		}
+
+		if a.matchInboundCredentials(authorization, cert) {
+			return nil
+		}
+		senderHasCredentials = true
+	}
+
+	for _, a := range getAgreements() {
+		if a.netID == senderID || a.disabled || !a.hasInboundCredentials() {
+			continue
+		}
+
+		if a.matchInboundCredentials(authorization, cert) {
+			return ErrSenderIDMismatch
+		}
+	}
+
+	if senderHasCredentials || requireAuthentication {
+		return ErrUnauthenticated
+	}
+
+	return nil
+}
+
+// GetInboundRateLimit returns the max. number of requests per second
+// accepted from the given NetID. It returns 0 when these are not limited.
+func GetInboundRateLimit(netID lorawan.NetID) int {
+	for _, a := range getAgreements() {
+		if a.netID == netID {
+			return a.inboundRateLimit
+		}
+	}
+
+	if defaultEnabled {
+		return defaultInboundRateLimit
+	}
+
+	return 0
+}
+
+func (a agreement) hasInboundCredentials() bool {
+	return a.inboundAuthorization != "" || a.inboundClientCertSubject != ""
+}
+
+// matchInboundCredentials returns true when all the configured inbound
+// credentials of the agreement match.
+func (a agreement) matchInboundCredentials(authorization string, cert *x509.Certificate) bool {
+	if a.inboundAuthorization != "" {
+		if subtle.ConstantTimeCompare([]byte(a.inboundAuthorization), []byte(authorization)) != 1 {
+			return false
+		}
+	}
+
+	if a.inboundClientCertSubject != "" {
+		if cert == nil || cert.Subject.String() != a.inboundClientCertSubject {
+			return false
+		}
+	}
+
+	return true
+}
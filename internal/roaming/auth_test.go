@@ -0,0 +1,131 @@
+package roaming
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthenticateInbound(t *testing.T) {
+	assert := require.New(t)
+	conf := test.GetConfig()
+	conf.Roaming.Servers = []config.RoamingServer{
+		{
+			NetID:                lorawan.NetID{6, 6, 6},
+			InboundAuthorization: "Bearer token-666",
+			InboundRateLimit:     10,
+		},
+		{
+			NetID:                    lorawan.NetID{7, 7, 7},
+			InboundClientCertSubject: "CN=070707,O=Partner",
+		},
+		{
+			NetID: lorawan.NetID{8, 8, 8},
+		},
+	}
+	assert.NoError(Setup(conf))
+
+	cert := func(cn string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject: pkix.Name{
+				CommonName:   cn,
+				Organization: []string{"Partner"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		senderID      lorawan.NetID
+		authorization string
+		cert          *x509.Certificate
+		expectedError error
+	}{
+		{
+			name:          "valid bearer token",
+			senderID:      lorawan.NetID{6, 6, 6},
+			authorization: "Bearer token-666",
+		},
+		{
+			name:          "invalid bearer token",
+			senderID:      lorawan.NetID{6, 6, 6},
+			authorization: "Bearer invalid",
+			expectedError: ErrUnauthenticated,
+		},
+		{
+			name:          "missing bearer token",
+			senderID:      lorawan.NetID{6, 6, 6},
+			expectedError: ErrUnauthenticated,
+		},
+		{
+			name:     "valid client-certificate subject",
+			senderID: lorawan.NetID{7, 7, 7},
+			cert:     cert("070707"),
+		},
+		{
+			name:          "invalid client-certificate subject",
+			senderID:      lorawan.NetID{7, 7, 7},
+			cert:          cert("070708"),
+			expectedError: ErrUnauthenticated,
+		},
+		{
+			name:          "bearer token of other partner",
+			senderID:      lorawan.NetID{7, 7, 7},
+			authorization: "Bearer token-666",
+			expectedError: ErrSenderIDMismatch,
+		},
+		{
+			name:          "credentials of other partner, sender without credentials",
+			senderID:      lorawan.NetID{8, 8, 8},
+			authorization: "Bearer token-666",
+			expectedError: ErrSenderIDMismatch,
+		},
+		{
+			name:     "sender without credentials",
+			senderID: lorawan.NetID{8, 8, 8},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.expectedError, AuthenticateInbound(tst.senderID, tst.authorization, tst.cert))
+		})
+	}
+
+	t.Run("Authentication required", func(t *testing.T) {
+		assert := require.New(t)
+		conf.Roaming.API.RequireAuthentication = true
+		assert.NoError(Setup(conf))
+
+		assert.Equal(ErrUnauthenticated, AuthenticateInbound(lorawan.NetID{8, 8, 8}, "", nil))
+		assert.NoError(AuthenticateInbound(lorawan.NetID{6, 6, 6}, "Bearer token-666", nil))
+	})
+}
+
+func TestGetInboundRateLimit(t *testing.T) {
+	assert := require.New(t)
+	conf := test.GetConfig()
+	conf.Roaming.Servers = []config.RoamingServer{
+		{
+			NetID:            lorawan.NetID{6, 6, 6},
+			InboundRateLimit: 10,
+		},
+	}
+	assert.NoError(Setup(conf))
+
+	assert.Equal(10, GetInboundRateLimit(lorawan.NetID{6, 6, 6}))
+	assert.Equal(0, GetInboundRateLimit(lorawan.NetID{6, 6, 7}))
+
+	conf.Roaming.Default.Enabled = true
+	conf.Roaming.Default.InboundRateLimit = 5
+	assert.NoError(Setup(conf))
+
+	assert.Equal(10, GetInboundRateLimit(lorawan.NetID{6, 6, 6}))
+	assert.Equal(5, GetInboundRateLimit(lorawan.NetID{6, 6, 7}))
+}
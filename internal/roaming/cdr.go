@@ -0,0 +1,315 @@
+package roaming
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// CDR export formats.
+const (
+	CDRFormatCSV  = "csv"
+	CDRFormatJSON = "json"
+)
+
+// usageFlushInterval defines the interval at which the roaming usage
+// aggregated in memory is written to the roaming CDRs.
+const usageFlushInterval = 10 * time.Second
+
+// usageKey identifies the aggregated roaming usage. The usage is aggregated
+// per minute, so that it never spans multiple CDR intervals.
+type usageKey struct {
+	netID  lorawan.NetID
+	role   storage.RoamingRole
+	minute time.Time
+}
+
+var (
+	usageMux sync.Mutex
+	usage    = make(map[usageKey]*storage.RoamingUsage)
+)
+
+// ErrInvalidCDRFormat is returned when the requested CDR export format is
+// not supported.
+var ErrInvalidCDRFormat = errors.New("invalid cdr format")
+
+var cdrCSVHeader = []string{
+	"time",
+	"aggregation",
+	"net_id",
+	"role",
+	"uplink_count",
+	"uplink_bytes",
+	"downlink_count",
+	"downlink_bytes",
+	"gateway_count",
+	"gateway_ids",
+	"first_seen_at",
+	"last_seen_at",
+}
+
+type cdrJSON struct {
+	Time          time.Time `json:"time"`
+	Aggregation   string    `json:"aggregation"`
+	NetID         string    `json:"net_id"`
+	Role          string    `json:"role"`
+	UplinkCount   int64     `json:"uplink_count"`
+	UplinkBytes   int64     `json:"uplink_bytes"`
+	DownlinkCount int64     `json:"downlink_count"`
+	DownlinkBytes int64     `json:"downlink_bytes"`
+	GatewayCount  int       `json:"gateway_count"`
+	GatewayIDs    []string  `json:"gateway_ids"`
+	FirstSeenAt   time.Time `json:"first_seen_at"`
+	LastSeenAt    time.Time `json:"last_seen_at"`
+}
+
+// RecordUsage records the given roaming usage. The usage is aggregated in
+// memory and periodically written to the roaming CDRs by UsageFlushLoop, so
+// that recording the usage does not affect the handling of the roaming
+// traffic.
+func RecordUsage(ctx context.Context, u storage.RoamingUsage) {
+	if u.FirstSeenAt.IsZero() {
+		u.FirstSeenAt = time.Now()
+	}
+	if u.LastSeenAt.IsZero() {
+		u.LastSeenAt = u.FirstSeenAt
+	}
+
+	usageMux.Lock()
+	defer usageMux.Unlock()
+
+	addUsage(u)
+}
+
+// FlushUsage writes the roaming usage aggregated in memory to the roaming
+// CDRs, using a single transaction. On error, the usage is kept in memory so
+// that it is written on the next flush.
+func FlushUsage(ctx context.Context) error {
+	usageMux.Lock()
+	flush := usage
+	usage = make(map[usageKey]*storage.RoamingUsage)
+	usageMux.Unlock()
+
+	if len(flush) == 0 {
+		return nil
+	}
+
+	// The CDRs are updated in a consistent order, to avoid deadlocks with
+	// the other Network Server instances.
+	var items []storage.RoamingUsage
+	for _, u := range flush {
+		items = append(items, *u)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if c := bytes.Compare(items[i].NetID[:], items[j].NetID[:]); c != 0 {
+			return c < 0
+		}
+		if items[i].Role != items[j].Role {
+			return items[i].Role < items[j].Role
+		}
+		return items[i].FirstSeenAt.Before(items[j].FirstSeenAt)
+	})
+
+	err := storage.Transaction(func(tx sqlx.Ext) error {
+		for _, u := range items {
+			if err := storage.SaveRoamingUsage(ctx, tx, u); err != nil {
+				return errors.Wrap(err, "save roaming usage error")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		usageMux.Lock()
+		for _, u := range items {
+			addUsage(u)
+		}
+		usageMux.Unlock()
+
+		return err
+	}
+
+	return nil
+}
+
+// UsageFlushLoop starts an infinite loop which periodically writes the
+// aggregated roaming usage to the roaming CDRs.
+func UsageFlushLoop() {
+	for {
+		time.Sleep(usageFlushInterval)
+
+		ctxID, err := uuid.NewV4()
+		if err != nil {
+			log.WithError(err).Error("roaming: get new uuid error")
+		}
+		ctx := context.WithValue(context.Background(), logging.ContextIDKey, ctxID)
+
+		if err := FlushUsage(ctx); err != nil {
+			log.WithField("ctx_id", ctxID).WithError(err).Error("roaming: flush roaming usage error")
+		}
+	}
+}
+
+// addUsage adds the given usage to the aggregated usage. The caller must
+// hold usageMux.
+func addUsage(u storage.RoamingUsage) {
+	key := usageKey{
+		netID:  u.NetID,
+		role:   u.Role,
+		minute: u.FirstSeenAt.Truncate(time.Minute),
+	}
+
+	agg, ok := usage[key]
+	if !ok {
+		agg = &storage.RoamingUsage{
+			NetID:       u.NetID,
+			Role:        u.Role,
+			FirstSeenAt: u.FirstSeenAt,
+			LastSeenAt:  u.LastSeenAt,
+		}
+		usage[key] = agg
+	}
+
+	agg.UplinkCount += u.UplinkCount
+	agg.UplinkBytes += u.UplinkBytes
+	agg.DownlinkCount += u.DownlinkCount
+	agg.DownlinkBytes += u.DownlinkBytes
+
+	if u.FirstSeenAt.Before(agg.FirstSeenAt) {
+		agg.FirstSeenAt = u.FirstSeenAt
+	}
+	if u.LastSeenAt.After(agg.LastSeenAt) {
+		agg.LastSeenAt = u.LastSeenAt
+	}
+
+	for _, id := range u.GatewayIDs {
+		if len(agg.GatewayIDs) >= storage.RoamingCDRMaxGatewayIDs {
+			break
+		}
+
+		var exists bool
+		for _, aggID := range agg.GatewayIDs {
+			if aggID == id {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			agg.GatewayIDs = append(agg.GatewayIDs, id)
+		}
+	}
+}
+
+// GatewayIDsFromRXInfo returns the gateway IDs of the given RXInfo set.
+func GatewayIDsFromRXInfo(rxInfo []*gw.UplinkRXInfo) []lorawan.EUI64 {
+	var out []lorawan.EUI64
+	for _, rx := range rxInfo {
+		var id lorawan.EUI64
+		copy(id[:], rx.GatewayId)
+		out = append(out, id)
+	}
+	return out
+}
+
+// ExportCDRs writes the given roaming CDRs to w, using the given format.
+func ExportCDRs(w io.Writer, format string, cdrs []storage.RoamingCDR) error {
+	switch format {
+	case CDRFormatCSV:
+		return exportCDRsCSV(w, cdrs)
+	case CDRFormatJSON:
+		return exportCDRsJSON(w, cdrs)
+	default:
+		return errors.Wrap(ErrInvalidCDRFormat, format)
+	}
+}
+
+func exportCDRsCSV(w io.Writer, cdrs []storage.RoamingCDR) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(cdrCSVHeader); err != nil {
+		return errors.Wrap(err, "write csv error")
+	}
+
+	for _, cdr := range cdrs {
+		var gatewayIDs []string
+		for _, id := range cdr.GatewayIDs {
+			gatewayIDs = append(gatewayIDs, id.String())
+		}
+
+		err := cw.Write([]string{
+			cdr.Time.Format(time.RFC3339),
+			string(cdr.Aggregation),
+			cdr.NetID.String(),
+			string(cdr.Role),
+			strconv.FormatInt(cdr.UplinkCount, 10),
+			strconv.FormatInt(cdr.UplinkBytes, 10),
+			strconv.FormatInt(cdr.DownlinkCount, 10),
+			strconv.FormatInt(cdr.DownlinkBytes, 10),
+			strconv.Itoa(len(cdr.GatewayIDs)),
+			strings.Join(gatewayIDs, " "),
+			cdr.FirstSeenAt.Format(time.RFC3339),
+			cdr.LastSeenAt.Format(time.RFC3339),
+		})
+		if err != nil {
+			return errors.Wrap(err, "write csv error")
+		}
+	}
+
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return errors.Wrap(err, "flush csv error")
+	}
+
+	return nil
+}
+
+func exportCDRsJSON(w io.Writer, cdrs []storage.RoamingCDR) error {
+	out := []cdrJSON{}
+
+	for _, cdr := range cdrs {
+		item := cdrJSON{
+			Time:          cdr.Time,
+			Aggregation:   string(cdr.Aggregation),
+			NetID:         cdr.NetID.String(),
+			Role:          string(cdr.Role),
+			UplinkCount:   cdr.UplinkCount,
+			UplinkBytes:   cdr.UplinkBytes,
+			DownlinkCount: cdr.DownlinkCount,
+			DownlinkBytes: cdr.DownlinkBytes,
+			GatewayCount:  len(cdr.GatewayIDs),
+			GatewayIDs:    []string{},
+			FirstSeenAt:   cdr.FirstSeenAt,
+			LastSeenAt:    cdr.LastSeenAt,
+		}
+
+		for _, id := range cdr.GatewayIDs {
+			item.GatewayIDs = append(item.GatewayIDs, id.String())
+		}
+
+		out = append(out, item)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(out); err != nil {
+		return errors.Wrap(err, "json encode error")
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package roaming
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportCDRs(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	cdrs := []storage.RoamingCDR{
+		{
+			NetID:         lorawan.NetID{1, 2, 3},
+			Role:          storage.RoamingRoleFNS,
+			Aggregation:   storage.AggregationHour,
+			Time:          ts,
+			UplinkCount:   2,
+			UplinkBytes:   50,
+			DownlinkCount: 1,
+			DownlinkBytes: 15,
+			GatewayIDs:    []lorawan.EUI64{{1}, {2}},
+			FirstSeenAt:   ts.Add(time.Minute),
+			LastSeenAt:    ts.Add(time.Minute * 30),
+		},
+	}
+
+	t.Run("CSV", func(t *testing.T) {
+		assert := require.New(t)
+
+		var buf bytes.Buffer
+		assert.NoError(ExportCDRs(&buf, CDRFormatCSV, cdrs))
+		assert.Equal("time,aggregation,net_id,role,uplink_count,uplink_bytes,downlink_count,downlink_bytes,gateway_count,gateway_ids,first_seen_at,last_seen_at\n"+
+			"2022-01-01T10:00:00Z,HOUR,010203,FNS,2,50,1,15,2,0100000000000000 0200000000000000,2022-01-01T10:01:00Z,2022-01-01T10:30:00Z\n", buf.String())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		assert := require.New(t)
+
+		var buf bytes.Buffer
+		assert.NoError(ExportCDRs(&buf, CDRFormatJSON, cdrs))
+
+		var out []map[string]interface{}
+		assert.NoError(json.Unmarshal(buf.Bytes(), &out))
+		assert.Len(out, 1)
+		assert.Equal("010203", out[0]["net_id"])
+		assert.Equal("FNS", out[0]["role"])
+		assert.EqualValues(2, out[0]["uplink_count"])
+		assert.EqualValues(2, out[0]["gateway_count"])
+		assert.Equal([]interface{}{"0100000000000000", "0200000000000000"}, out[0]["gateway_ids"])
+	})
+
+	t.Run("Invalid format", func(t *testing.T) {
+		assert := require.New(t)
+
+		var buf bytes.Buffer
+		err := ExportCDRs(&buf, "xml", cdrs)
+		assert.Equal(ErrInvalidCDRFormat, errors.Cause(err))
+	})
+}
+
+func TestRecordUsage(t *testing.T) {
+	assert := require.New(t)
+	ctx := context.Background()
+
+	usageMux.Lock()
+	usage = make(map[usageKey]*storage.RoamingUsage)
+	usageMux.Unlock()
+
+	netID := lorawan.NetID{1, 2, 3}
+	t1 := time.Date(2022, 1, 1, 10, 15, 10, 0, time.UTC)
+	t2 := time.Date(2022, 1, 1, 10, 15, 20, 0, time.UTC)
+	t3 := time.Date(2022, 1, 1, 10, 16, 0, 0, time.UTC)
+
+	var gatewayIDs []lorawan.EUI64
+	for i := 0; i < storage.RoamingCDRMaxGatewayIDs+10; i++ {
+		gatewayIDs = append(gatewayIDs, lorawan.EUI64{byte(i)})
+	}
+
+	RecordUsage(ctx, storage.RoamingUsage{NetID: netID, Role: storage.RoamingRoleFNS, FirstSeenAt: t2, UplinkCount: 1, UplinkBytes: 20, GatewayIDs: []lorawan.EUI64{{1}}})
+	RecordUsage(ctx, storage.RoamingUsage{NetID: netID, Role: storage.RoamingRoleFNS, FirstSeenAt: t1, DownlinkCount: 1, DownlinkBytes: 15, GatewayIDs: gatewayIDs})
+	RecordUsage(ctx, storage.RoamingUsage{NetID: netID, Role: storage.RoamingRoleFNS, FirstSeenAt: t3, UplinkCount: 1, UplinkBytes: 10})
+	RecordUsage(ctx, storage.RoamingUsage{NetID: netID, Role: storage.RoamingRoleHNS, FirstSeenAt: t3, UplinkCount: 1, UplinkBytes: 10})
+
+	assert.Len(usage, 3)
+
+	u := usage[usageKey{netID: netID, role: storage.RoamingRoleFNS, minute: t1.Truncate(time.Minute)}]
+	assert.NotNil(u)
+	assert.Equal(1, u.UplinkCount)
+	assert.Equal(20, u.UplinkBytes)
+	assert.Equal(1, u.DownlinkCount)
+	assert.Equal(15, u.DownlinkBytes)
+	assert.True(u.FirstSeenAt.Equal(t1))
+	assert.True(u.LastSeenAt.Equal(t2))
+	assert.Len(u.GatewayIDs, storage.RoamingCDRMaxGatewayIDs)
+	assert.Equal(lorawan.EUI64{1}, u.GatewayIDs[0])
+}
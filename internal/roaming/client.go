@@ -0,0 +1,210 @@
+package roaming
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan/backend"
+)
+
+// Client defines the roaming API client. It extends the backend.Client with
+// the handover-roaming requests, as these are not implemented by the
+// backend package.
+type Client interface {
+	backend.Client
+
+	// HRStartReq method.
+	HRStartReq(context.Context, backend.HRStartReqPayload) (backend.HRStartAnsPayload, error)
+	// HRStopReq method.
+	HRStopReq(context.Context, backend.HRStopReqPayload) (backend.HRStopAnsPayload, error)
+}
+
+type client struct {
+	backend.Client
+
+	server        string
+	httpClient    *http.Client
+	authorization string
+	redisClient   redis.UniversalClient
+	asyncTimeout  time.Duration
+}
+
+func newClient(conf backend.ClientConfig) (Client, error) {
+	bc, err := backend.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient := http.DefaultClient
+
+	if conf.CACert != "" || conf.TLSCert != "" || conf.TLSKey != "" {
+		tlsConfig := &tls.Config{}
+
+		if conf.CACert != "" {
+			rawCACert, err := ioutil.ReadFile(conf.CACert)
+			if err != nil {
+				return nil, errors.Wrap(err, "read ca cert error")
+			}
+
+			caCertPool := x509.NewCertPool()
+			if !caCertPool.AppendCertsFromPEM(rawCACert) {
+				return nil, errors.New("append ca cert to pool error")
+			}
+
+			tlsConfig.RootCAs = caCertPool
+		}
+
+		if conf.TLSCert != "" || conf.TLSKey != "" {
+			cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+			if err != nil {
+				return nil, errors.Wrap(err, "load x509 keypair error")
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	return &client{
+		Client:        bc,
+		server:        conf.Server,
+		httpClient:    httpClient,
+		authorization: conf.Authorization,
+		redisClient:   conf.RedisClient,
+		asyncTimeout:  conf.AsyncTimeout,
+	}, nil
+}
+
+func (c *client) HRStartReq(ctx context.Context, pl backend.HRStartReqPayload) (backend.HRStartAnsPayload, error) {
+	pl.BasePayload = c.getBasePayload(backend.HRStartReq, pl.BasePayload.TransactionID)
+
+	var ans backend.HRStartAnsPayload
+	if err := c.request(ctx, pl, &ans); err != nil {
+		return ans, err
+	}
+
+	if ans.Result.ResultCode != backend.Success {
+		return ans, fmt.Errorf("response error, code: %s, description: %s", ans.Result.ResultCode, ans.Result.Description)
+	}
+
+	return ans, nil
+}
+
+func (c *client) HRStopReq(ctx context.Context, pl backend.HRStopReqPayload) (backend.HRStopAnsPayload, error) {
+	pl.BasePayload = c.getBasePayload(backend.HRStopReq, pl.BasePayload.TransactionID)
+
+	var ans backend.HRStopAnsPayload
+	if err := c.request(ctx, pl, &ans); err != nil {
+		return ans, err
+	}
+
+	return ans, nil
+}
+
+func (c *client) getBasePayload(mType backend.MessageType, transactionID uint32) backend.BasePayload {
+	if transactionID == 0 {
+		transactionID = c.GetRandomTransactionID()
+	}
+
+	return backend.BasePayload{
+		ProtocolVersion: backend.ProtocolVersion1_0,
+		SenderID:        c.GetSenderID(),
+		ReceiverID:      c.GetReceiverID(),
+		TransactionID:   transactionID,
+		MessageType:     mType,
+	}
+}
+
+// request makes the given request and decodes the (sync or async) answer
+// into ans. The async answer is published by HandleAnswer of the embedded
+// backend.Client, using the same Redis key.
+func (c *client) request(ctx context.Context, pl backend.Request, ans backend.Answer) error {
+	b, err := json.Marshal(pl)
+	if err != nil {
+		return errors.Wrap(err, "json marshal error")
+	}
+
+	responseChan := make(chan []byte, 1)
+	errorChan := make(chan error, 1)
+
+	// The subscription must be setup before making the request, as the
+	// answer might be received before the request returns.
+	if c.IsAsync() {
+		sub := c.redisClient.Subscribe(ctx, fmt.Sprintf("lora:backend:async:%d", pl.GetBasePayload().TransactionID))
+		if _, err := sub.Receive(ctx); err != nil {
+			return errors.Wrap(err, "async response subscription error")
+		}
+		ch := sub.Channel()
+
+		go func() {
+			defer sub.Close()
+
+			select {
+			case msg := <-ch:
+				responseChan <- []byte(msg.Payload)
+			case <-time.After(c.asyncTimeout):
+				errorChan <- backend.ErrAsyncTimeout
+			}
+		}()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "new request error")
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if c.authorization != "" {
+		req.Header.Add("Authorization", c.authorization)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "http post error")
+	}
+	defer resp.Body.Close()
+
+	if c.IsAsync() {
+		io.Copy(ioutil.Discard, resp.Body)
+	} else {
+		bb, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "read body error")
+		}
+		responseChan <- bb
+	}
+
+	select {
+	case err := <-errorChan:
+		return err
+	case bb := <-responseChan:
+		if err := json.Unmarshal(bb, ans); err != nil {
+			return errors.Wrap(err, "unmarshal response error")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"sender_id":      pl.GetBasePayload().SenderID,
+		"receiver_id":    pl.GetBasePayload().ReceiverID,
+		"transaction_id": pl.GetBasePayload().TransactionID,
+		"message_type":   pl.GetBasePayload().MessageType,
+		"result_code":    ans.GetBasePayload().Result.ResultCode,
+	}).Info("roaming: finished backend api call")
+
+	return nil
+}
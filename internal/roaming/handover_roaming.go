@@ -0,0 +1,527 @@
+package roaming
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	loraband "github.com/brocaar/lorawan/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// ErrMalformedRequest is returned when the roaming request is missing
+// mandatory fields.
+var ErrMalformedRequest = errors.New("malformed request")
+
+// ErrDeviceExists is returned when the MAC-layer control of a device can not
+// be taken over, as the device is provisioned on this Network Server or has a
+// session which was not handed over by the hNS.
+var ErrDeviceExists = errors.New("device already exists")
+
+const hrStopReqTimeout = 10 * time.Second
+
+// StartHandoverRoaming takes over the MAC-layer control of the given device
+// from the hNS identified by the given NetID, using the HRStartReq sent by
+// this Network Server (sNS) and the HRStartAns returned by the hNS. It creates
+// a local device-session using the handed-over session-keys, the
+// device-profile and service-profile are stored under an ID scoped to the hNS
+// NetID.
+func StartHandoverRoaming(ctx context.Context, netID lorawan.NetID, devEUI, joinEUI lorawan.EUI64, req backend.HRStartReqPayload, ans backend.HRStartAnsPayload) (storage.DeviceSession, error) {
+	var ds storage.DeviceSession
+
+	if !IsHandoverRoamingAllowed(netID) {
+		return ds, ErrNoAgreement
+	}
+
+	if ans.ServiceProfile == nil {
+		return ds, errors.Wrap(ErrMalformedRequest, "ServiceProfile is missing")
+	}
+
+	if err := validateHandoverDevice(ctx, netID, devEUI); err != nil {
+		return ds, err
+	}
+
+	dp := handoverDeviceProfile(netID, req)
+	if err := saveHandoverDeviceProfile(ctx, &dp); err != nil {
+		return ds, errors.Wrap(err, "save device-profile error")
+	}
+
+	sp := handoverServiceProfile(netID, *ans.ServiceProfile)
+	if err := saveHandoverServiceProfile(ctx, &sp); err != nil {
+		return ds, errors.Wrap(err, "save service-profile error")
+	}
+
+	ds = storage.DeviceSession{
+		DeviceProfileID:       dp.ID,
+		ServiceProfileID:      sp.ID,
+		MACVersion:            dp.MACVersion,
+		DevAddr:               req.DevAddr,
+		DevEUI:                devEUI,
+		JoinEUI:               joinEUI,
+		RXWindow:              storage.RX1,
+		RXDelay:               uint8(req.RxDelay),
+		RX1DROffset:           req.DLSettings.RX1DROffset,
+		RX2DR:                 req.DLSettings.RX2DataRate,
+		RX2Frequency:          band.Band().GetDefaults().RX2Frequency,
+		EnabledUplinkChannels: band.Band().GetStandardUplinkChannelIndices(),
+		ExtraUplinkChannels:   make(map[int]loraband.Channel),
+		PingSlotDR:            dp.PingSlotDR,
+		PingSlotFrequency:     dp.PingSlotFreq,
+		NbTrans:               1,
+	}
+
+	if dp.PingSlotPeriod != 0 {
+		ds.PingSlotNb = (1 << 12) / dp.PingSlotPeriod
+	}
+
+	if err := setHandoverSessionKeys(&ds, ans); err != nil {
+		return ds, err
+	}
+
+	if len(req.CFList) != 0 {
+		if err := setHandoverCFListChannels(&ds, req.CFList); err != nil {
+			return ds, errors.Wrap(err, "set cflist channels error")
+		}
+	}
+
+	// The lifetime returned by the hNS is capped by the configured lifetime.
+	lifetime := GetHandoverRoamingLifetime(netID)
+	if ans.Lifetime != nil && *ans.Lifetime != 0 {
+		if l := time.Duration(*ans.Lifetime) * time.Second; lifetime == 0 || l < lifetime {
+			lifetime = l
+		}
+	}
+
+	hr := storage.HandoverRoamingDeviceSession{
+		DevEUI:           devEUI,
+		NetID:            netID,
+		DeviceProfileID:  dp.ID,
+		ServiceProfileID: sp.ID,
+	}
+	if lifetime != 0 {
+		hr.Lifetime = time.Now().Add(lifetime)
+	}
+
+	if err := storage.SaveDeviceSession(ctx, ds); err != nil {
+		return ds, errors.Wrap(err, "save device-session error")
+	}
+
+	if err := storage.FlushMACCommandQueue(ctx, ds.DevEUI); err != nil {
+		return ds, errors.Wrap(err, "flush mac-command queue error")
+	}
+
+	if err := storage.SaveHandoverRoamingDeviceSession(ctx, hr); err != nil {
+		return ds, errors.Wrap(err, "save handover-roaming device-session error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":  devEUI,
+		"dev_addr": ds.DevAddr,
+		"net_id":   netID,
+		"ctx_id":   ctx.Value(logging.ContextIDKey),
+	}).Info("roaming: handover-roaming session started")
+
+	return ds, nil
+}
+
+// StopHandoverRoaming stops the handover-roaming session of the given DevEUI.
+// Only the hNS that started the session is allowed to stop it.
+func StopHandoverRoaming(ctx context.Context, netID lorawan.NetID, devEUI lorawan.EUI64) error {
+	hr, err := storage.GetHandoverRoamingDeviceSession(ctx, devEUI)
+	if err != nil {
+		return errors.Wrap(err, "get handover-roaming device-session error")
+	}
+
+	if hr.NetID != netID {
+		return errors.Wrap(storage.ErrDoesNotExist, "handover-roaming session was started by a different NetID")
+	}
+
+	if err := DeleteHandoverRoamingDeviceSession(ctx, hr); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"net_id":  netID,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("roaming: handover-roaming session stopped")
+
+	return nil
+}
+
+// DeleteHandoverRoamingDeviceSession deletes the given handover-roaming
+// session (and device-session). The device-profile and service-profile that
+// were created for the session are deleted when these are no longer
+// referenced by other handover-roaming sessions.
+func DeleteHandoverRoamingDeviceSession(ctx context.Context, hr storage.HandoverRoamingDeviceSession) error {
+	if err := storage.DeleteHandoverRoamingDeviceSession(ctx, hr.DevEUI); err != nil {
+		return errors.Wrap(err, "delete handover-roaming device-session error")
+	}
+
+	if hr.DeviceProfileID != uuid.Nil {
+		if err := deleteHandoverProfile(ctx, hr.DeviceProfileID, storage.DeleteDeviceProfile, storage.FlushDeviceProfileCache); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"device_profile_id": hr.DeviceProfileID,
+				"ctx_id":            ctx.Value(logging.ContextIDKey),
+			}).Error("roaming: delete handover-roaming device-profile error")
+		}
+	}
+
+	if hr.ServiceProfileID != uuid.Nil {
+		if err := deleteHandoverProfile(ctx, hr.ServiceProfileID, storage.DeleteServiceProfile, storage.FlushServiceProfileCache); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"service_profile_id": hr.ServiceProfileID,
+				"ctx_id":             ctx.Value(logging.ContextIDKey),
+			}).Error("roaming: delete handover-roaming service-profile error")
+		}
+	}
+
+	return nil
+}
+
+// deleteHandoverProfile deletes the given profile (and its cache) when it is
+// no longer referenced by any handover-roaming session.
+func deleteHandoverProfile(ctx context.Context, id uuid.UUID, deleteFunc func(context.Context, sqlx.Execer, uuid.UUID) error, flushCacheFunc func(context.Context, uuid.UUID) error) error {
+	count, err := storage.GetHandoverRoamingProfileDevEUICount(ctx, id)
+	if err != nil {
+		return errors.Wrap(err, "get profile deveui count error")
+	}
+	if count != 0 {
+		return nil
+	}
+
+	if err := deleteFunc(ctx, storage.DB(), id); err != nil && errors.Cause(err) != storage.ErrDoesNotExist {
+		return errors.Wrap(err, "delete profile error")
+	}
+
+	return flushCacheFunc(ctx, id)
+}
+
+// StopHandoverRoamingHNS stops the handover-roaming session (as hNS) of the
+// given DevEUI and sends a HRStopReq to the sNS, unless the session was
+// handed over to one of the excluded NetIDs. The request is sent
+// asynchronously, errors are logged.
+func StopHandoverRoamingHNS(ctx context.Context, devEUI lorawan.EUI64, exclude ...lorawan.NetID) error {
+	hr, err := storage.GetHandoverRoamingHNSDeviceSession(ctx, devEUI)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return nil
+		}
+		return errors.Wrap(err, "get handover-roaming hns device-session error")
+	}
+
+	for _, netID := range exclude {
+		if hr.NetID == netID {
+			return nil
+		}
+	}
+
+	if err := storage.DeleteHandoverRoamingHNSDeviceSession(ctx, devEUI); err != nil {
+		return errors.Wrap(err, "delete handover-roaming hns device-session error")
+	}
+
+	go func(ctx context.Context, netID lorawan.NetID) {
+		ctx, cancel := context.WithTimeout(ctx, hrStopReqTimeout)
+		defer cancel()
+
+		if err := sendHRStopReq(ctx, devEUI, netID); err != nil {
+			log.WithFields(log.Fields{
+				"dev_eui": devEUI,
+				"net_id":  netID,
+				"ctx_id":  ctx.Value(logging.ContextIDKey),
+			}).WithError(err).Error("roaming: stop handover-roaming session error")
+		}
+	}(context.WithValue(context.Background(), logging.ContextIDKey, ctx.Value(logging.ContextIDKey)), hr.NetID)
+
+	return nil
+}
+
+func sendHRStopReq(ctx context.Context, devEUI lorawan.EUI64, netID lorawan.NetID) error {
+	client, err := GetClientForNetID(netID)
+	if err != nil {
+		return errors.Wrap(err, "get client for netid error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"net_id":  netID,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("roaming: stopping handover-roaming session")
+
+	ans, err := client.HRStopReq(ctx, backend.HRStopReqPayload{
+		DevEUI: devEUI,
+	})
+	if err != nil {
+		return errors.Wrap(err, "request error")
+	}
+
+	// UnknownDevEUI means that the session already expired
+	if ans.Result.ResultCode != backend.Success && ans.Result.ResultCode != backend.UnknownDevEUI {
+		return fmt.Errorf("expected: %s, got: %s (%s)", backend.Success, ans.Result.ResultCode, ans.Result.Description)
+	}
+
+	return nil
+}
+
+// GetServiceProfileForHandover returns the service-profile as it is handed
+// over to the sNS.
+func GetServiceProfileForHandover(sp storage.ServiceProfile) backend.ServiceProfile {
+	return backend.ServiceProfile{
+		ServiceProfileID:       sp.ID.String(),
+		ULRate:                 sp.ULRate,
+		ULBucketSize:           sp.ULBucketSize,
+		ULRatePolicy:           backend.RatePolicy(sp.ULRatePolicy),
+		DLRate:                 sp.DLRate,
+		DLBucketSize:           sp.DLBucketSize,
+		DLRatePolicy:           backend.RatePolicy(sp.DLRatePolicy),
+		AddGWMetadata:          sp.AddGWMetadata,
+		DevStatusReqFreq:       sp.DevStatusReqFreq,
+		ReportDevStatusBattery: sp.ReportDevStatusBattery,
+		ReportDevStatusMargin:  sp.ReportDevStatusMargin,
+		DRMin:                  sp.DRMin,
+		DRMax:                  sp.DRMax,
+		ChannelMask:            backend.HEXBytes(sp.ChannelMask),
+		PRAllowed:              sp.PRAllowed,
+		HRAllowed:              sp.HRAllowed,
+		RAAllowed:              sp.RAAllowed,
+		NwkGeoLoc:              sp.NwkGeoLoc,
+		TargetPER:              backend.Percentage(sp.TargetPER),
+		MinGWDiversity:         sp.MinGWDiversity,
+	}
+}
+
+// validateHandoverDevice returns ErrDeviceExists when the given device is
+// provisioned on this Network Server, or when it has a device-session which
+// was not handed over by the given NetID. A session handed over by the same
+// NetID is replaced, e.g. when the device re-joins.
+func validateHandoverDevice(ctx context.Context, netID lorawan.NetID, devEUI lorawan.EUI64) error {
+	_, err := storage.GetDevice(ctx, storage.DB(), devEUI, false)
+	if err == nil {
+		return errors.Wrap(ErrDeviceExists, "device is provisioned on this network-server")
+	}
+	if errors.Cause(err) != storage.ErrDoesNotExist {
+		return errors.Wrap(err, "get device error")
+	}
+
+	_, err = storage.GetDeviceSession(ctx, devEUI)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return nil
+		}
+		return errors.Wrap(err, "get device-session error")
+	}
+
+	hr, err := storage.GetHandoverRoamingDeviceSession(ctx, devEUI)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return errors.Wrap(ErrDeviceExists, "device has a device-session which was not handed over")
+		}
+		return errors.Wrap(err, "get handover-roaming device-session error")
+	}
+
+	if hr.NetID != netID {
+		return errors.Wrap(ErrDeviceExists, "device-session was handed over by a different NetID")
+	}
+
+	return nil
+}
+
+// handoverProfileID returns the local ID for the given profile ID of the
+// hNS. This avoids collisions with the IDs of local profiles and of the
+// profiles of other roaming partners.
+func handoverProfileID(netID lorawan.NetID, id string) uuid.UUID {
+	return uuid.NewV5(uuid.NamespaceURL, fmt.Sprintf("%s/%s", netID, id))
+}
+
+func handoverDeviceProfile(netID lorawan.NetID, pl backend.HRStartReqPayload) storage.DeviceProfile {
+	in := pl.DeviceProfile
+
+	dp := storage.DeviceProfile{
+		ID:                handoverProfileID(netID, in.DeviceProfileID),
+		SupportsClassB:    in.SupportsClassB,
+		ClassBTimeout:     in.ClassBTimeout,
+		PingSlotPeriod:    in.PingSlotPeriod,
+		PingSlotDR:        in.PingSlotDR,
+		PingSlotFreq:      uint32(in.PingSlotFreq),
+		SupportsClassC:    in.SupportsClassC,
+		ClassCTimeout:     in.ClassCTimeout,
+		MACVersion:        in.MACVersion,
+		RegParamsRevision: in.RegParamsRevision,
+		RXDelay1:          pl.RxDelay,
+		RXDROffset1:       int(pl.DLSettings.RX1DROffset),
+		RXDataRate2:       int(pl.DLSettings.RX2DataRate),
+		RXFreq2:           uint32(in.RXFreq2),
+		MaxEIRP:           in.MaxEIRP,
+		MaxDutyCycle:      int(in.MaxDutyCycle),
+		SupportsJoin:      in.SupportsJoin,
+		RFRegion:          in.RFRegion,
+		Supports32bitFCnt: in.Supports32bitFCnt,
+		ADRAlgorithmID:    "default",
+	}
+
+	for _, f := range in.FactoryPresetFreqs {
+		dp.FactoryPresetFreqs = append(dp.FactoryPresetFreqs, uint32(f))
+	}
+
+	if dp.MACVersion == "" {
+		dp.MACVersion = pl.MACVersion
+	}
+
+	return dp
+}
+
+func handoverServiceProfile(netID lorawan.NetID, in backend.ServiceProfile) storage.ServiceProfile {
+	return storage.ServiceProfile{
+		ID:             handoverProfileID(netID, in.ServiceProfileID),
+		ULRate:         in.ULRate,
+		ULBucketSize:   in.ULBucketSize,
+		ULRatePolicy:   storage.RatePolicy(in.ULRatePolicy),
+		DLRate:         in.DLRate,
+		DLBucketSize:   in.DLBucketSize,
+		DLRatePolicy:   storage.RatePolicy(in.DLRatePolicy),
+		AddGWMetadata:  in.AddGWMetadata,
+		DRMin:          in.DRMin,
+		DRMax:          in.DRMax,
+		ChannelMask:    in.ChannelMask,
+		HRAllowed:      in.HRAllowed,
+		TargetPER:      int(in.TargetPER),
+		MinGWDiversity: in.MinGWDiversity,
+
+		// The device-status is reported to the application-server, which
+		// is not connected to this Network Server for handed-over devices.
+		DevStatusReqFreq:       0,
+		ReportDevStatusBattery: false,
+		ReportDevStatusMargin:  false,
+	}
+}
+
+func saveHandoverDeviceProfile(ctx context.Context, dp *storage.DeviceProfile) error {
+	_, err := storage.GetDeviceProfile(ctx, storage.DB(), dp.ID)
+	if err != nil {
+		if errors.Cause(err) != storage.ErrDoesNotExist {
+			return errors.Wrap(err, "get device-profile error")
+		}
+		return storage.CreateDeviceProfile(ctx, storage.DB(), dp)
+	}
+
+	if err := storage.UpdateDeviceProfile(ctx, storage.DB(), dp); err != nil {
+		return err
+	}
+
+	return storage.FlushDeviceProfileCache(ctx, dp.ID)
+}
+
+func saveHandoverServiceProfile(ctx context.Context, sp *storage.ServiceProfile) error {
+	_, err := storage.GetServiceProfile(ctx, storage.DB(), sp.ID)
+	if err != nil {
+		if errors.Cause(err) != storage.ErrDoesNotExist {
+			return errors.Wrap(err, "get service-profile error")
+		}
+		return storage.CreateServiceProfile(ctx, storage.DB(), sp)
+	}
+
+	if err := storage.UpdateServiceProfile(ctx, storage.DB(), sp); err != nil {
+		return err
+	}
+
+	return storage.FlushServiceProfileCache(ctx, sp.ID)
+}
+
+func setHandoverSessionKeys(ds *storage.DeviceSession, ans backend.HRStartAnsPayload) error {
+	// LoRaWAN 1.0.x
+	if ans.NwkSKey != nil {
+		key, err := unwrapKeyEnvelope(ans.NwkSKey)
+		if err != nil {
+			return errors.Wrap(err, "unwrap NwkSKey error")
+		}
+
+		ds.SNwkSIntKey = key
+		ds.FNwkSIntKey = key
+		ds.NwkSEncKey = key
+		return nil
+	}
+
+	// LoRaWAN 1.1
+	if ans.SNwkSIntKey == nil || ans.FNwkSIntKey == nil || ans.NwkSEncKey == nil {
+		return errors.Wrap(ErrMalformedRequest, "session-keys are missing")
+	}
+
+	var err error
+	if ds.SNwkSIntKey, err = unwrapKeyEnvelope(ans.SNwkSIntKey); err != nil {
+		return errors.Wrap(err, "unwrap SNwkSIntKey error")
+	}
+	if ds.FNwkSIntKey, err = unwrapKeyEnvelope(ans.FNwkSIntKey); err != nil {
+		return errors.Wrap(err, "unwrap FNwkSIntKey error")
+	}
+	if ds.NwkSEncKey, err = unwrapKeyEnvelope(ans.NwkSEncKey); err != nil {
+		return errors.Wrap(err, "unwrap NwkSEncKey error")
+	}
+
+	return nil
+}
+
+// setHandoverCFListChannels adds the channels of the given CFList to the
+// enabled uplink channels of the device-session.
+func setHandoverCFListChannels(ds *storage.DeviceSession, b []byte) error {
+	var cFList lorawan.CFList
+	if err := cFList.UnmarshalBinary(b); err != nil {
+		return errors.Wrap(err, "unmarshal cflist error")
+	}
+
+	pl, ok := cFList.Payload.(*lorawan.CFListChannelPayload)
+	if !ok {
+		// the channel-mask CFList type only applies to the standard channels
+		return nil
+	}
+
+	for _, f := range pl.Channels {
+		if f == 0 {
+			continue
+		}
+
+		i, err := band.Band().GetUplinkChannelIndex(f, false)
+		if err != nil {
+			continue
+		}
+
+		c, err := band.Band().GetUplinkChannel(i)
+		if err != nil {
+			continue
+		}
+
+		ds.EnabledUplinkChannels = append(ds.EnabledUplinkChannels, i)
+		ds.ExtraUplinkChannels[i] = c
+	}
+
+	return nil
+}
+
+// unwrapKeyEnvelope returns the decrypted key from the given KeyEnvelope.
+func unwrapKeyEnvelope(ke *backend.KeyEnvelope) (lorawan.AES128Key, error) {
+	if ke.KEKLabel == "" {
+		var key lorawan.AES128Key
+		copy(key[:], ke.AESKey[:])
+		return key, nil
+	}
+
+	kek, err := GetKEKKey(ke.KEKLabel)
+	if err != nil {
+		return lorawan.AES128Key{}, err
+	}
+
+	key, err := ke.Unwrap(kek)
+	if err != nil {
+		return lorawan.AES128Key{}, errors.Wrap(err, "unwrap error")
+	}
+
+	return key, nil
+}
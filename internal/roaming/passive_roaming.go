@@ -0,0 +1,82 @@
+package roaming
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+const prStopReqTimeout = 10 * time.Second
+
+// StopPassiveRoaming sends a PRStopReq to each fNS with which a stateful
+// passive-roaming session was started for the given DevEUI (as hNS), except
+// for the given excluded NetIDs. The requests are sent asynchronously, errors
+// are logged.
+func StopPassiveRoaming(ctx context.Context, devEUI lorawan.EUI64, exclude ...lorawan.NetID) error {
+	netIDs, err := storage.GetAndDeletePassiveRoamingNetIDsForDevEUI(ctx, devEUI)
+	if err != nil {
+		return errors.Wrap(err, "get passive-roaming netids error")
+	}
+
+	for _, netID := range netIDs {
+		var excluded bool
+		for _, id := range exclude {
+			if id == netID {
+				excluded = true
+			}
+		}
+		if excluded {
+			continue
+		}
+
+		go func(ctx context.Context, netID lorawan.NetID) {
+			ctx, cancel := context.WithTimeout(ctx, prStopReqTimeout)
+			defer cancel()
+
+			if err := sendPRStopReq(ctx, devEUI, netID); err != nil {
+				log.WithFields(log.Fields{
+					"dev_eui": devEUI,
+					"net_id":  netID,
+					"ctx_id":  ctx.Value(logging.ContextIDKey),
+				}).WithError(err).Error("roaming: stop passive-roaming session error")
+			}
+		}(context.WithValue(context.Background(), logging.ContextIDKey, ctx.Value(logging.ContextIDKey)), netID)
+	}
+
+	return nil
+}
+
+func sendPRStopReq(ctx context.Context, devEUI lorawan.EUI64, netID lorawan.NetID) error {
+	client, err := GetClientForNetID(netID)
+	if err != nil {
+		return errors.Wrap(err, "get client for netid error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"net_id":  netID,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("roaming: stopping passive-roaming session")
+
+	ans, err := client.PRStopReq(ctx, backend.PRStopReqPayload{
+		DevEUI: devEUI,
+	})
+	if err != nil {
+		return errors.Wrap(err, "request error")
+	}
+
+	// UnknownDevEUI means that the session already expired
+	if ans.Result.ResultCode != backend.Success && ans.Result.ResultCode != backend.UnknownDevEUI {
+		return fmt.Errorf("expected: %s, got: %s (%s)", backend.Success, ans.Result.ResultCode, ans.Result.Description)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package roaming
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+// ErrProfileDisclosureDisabled is returned when no device-profile fields
+// may be disclosed to the requesting NetID.
+var ErrProfileDisclosureDisabled = errors.New("profile disclosure is disabled")
+
+// Device-profile field groups which can be disclosed to roaming partners.
+const (
+	ProfileDisclosureMAC    = "mac"
+	ProfileDisclosureClassB = "class_b"
+	ProfileDisclosureClassC = "class_c"
+	ProfileDisclosureRX     = "rx"
+	ProfileDisclosureRadio  = "radio"
+	ProfileDisclosureAll    = "all"
+)
+
+func validateProfileDisclosure(groups []string) error {
+	for _, g := range groups {
+		switch g {
+		case ProfileDisclosureMAC, ProfileDisclosureClassB, ProfileDisclosureClassC,
+			ProfileDisclosureRX, ProfileDisclosureRadio, ProfileDisclosureAll:
+		default:
+			return fmt.Errorf("invalid profile disclosure: %s", g)
+		}
+	}
+	return nil
+}
+
+// GetProfileDisclosure returns the device-profile field groups that may be
+// disclosed to the given NetID.
+func GetProfileDisclosure(netID lorawan.NetID) []string {
+	for _, a := range getAgreements() {
+		if a.netID == netID {
+			return a.profileDisclosure
+		}
+	}
+
+	if defaultEnabled {
+		return defaultProfileDisclosure
+	}
+
+	return nil
+}
+
+// GetDeviceProfileForNetID returns the device-profile as it may be disclosed
+// to the given NetID. When a device-session is given, the RX parameters are
+// taken from the device-session as these reflect the parameters currently
+// in use by the device. The DeviceProfileID is always included.
+func GetDeviceProfileForNetID(netID lorawan.NetID, dp storage.DeviceProfile, ds *storage.DeviceSession) (backend.DeviceProfile, error) {
+	groups := make(map[string]bool)
+	for _, g := range GetProfileDisclosure(netID) {
+		if g == ProfileDisclosureAll {
+			for _, g := range []string{ProfileDisclosureMAC, ProfileDisclosureClassB, ProfileDisclosureClassC, ProfileDisclosureRX, ProfileDisclosureRadio} {
+				groups[g] = true
+			}
+		}
+		groups[g] = true
+	}
+
+	if len(groups) == 0 {
+		return backend.DeviceProfile{}, ErrProfileDisclosureDisabled
+	}
+
+	out := backend.DeviceProfile{
+		DeviceProfileID: dp.ID.String(),
+	}
+
+	if groups[ProfileDisclosureMAC] {
+		out.MACVersion = dp.MACVersion
+		out.RegParamsRevision = dp.RegParamsRevision
+		out.RFRegion = dp.RFRegion
+		out.SupportsJoin = dp.SupportsJoin
+		out.Supports32bitFCnt = dp.Supports32bitFCnt
+
+		if ds != nil && ds.MACVersion != "" {
+			out.MACVersion = ds.MACVersion
+		}
+	}
+
+	if groups[ProfileDisclosureClassB] {
+		out.SupportsClassB = dp.SupportsClassB
+		out.ClassBTimeout = dp.ClassBTimeout
+		out.PingSlotPeriod = dp.PingSlotPeriod
+		out.PingSlotDR = dp.PingSlotDR
+		out.PingSlotFreq = backend.Frequency(dp.PingSlotFreq)
+	}
+
+	if groups[ProfileDisclosureClassC] {
+		out.SupportsClassC = dp.SupportsClassC
+		out.ClassCTimeout = dp.ClassCTimeout
+	}
+
+	if groups[ProfileDisclosureRX] {
+		out.RXDelay1 = dp.RXDelay1
+		out.RXDROffset1 = dp.RXDROffset1
+		out.RXDataRate2 = dp.RXDataRate2
+		out.RXFreq2 = backend.Frequency(dp.RXFreq2)
+
+		if ds != nil {
+			out.RXDelay1 = int(ds.RXDelay)
+			out.RXDROffset1 = int(ds.RX1DROffset)
+			out.RXDataRate2 = int(ds.RX2DR)
+			out.RXFreq2 = backend.Frequency(ds.RX2Frequency)
+		}
+	}
+
+	if groups[ProfileDisclosureRadio] {
+		for _, f := range dp.FactoryPresetFreqs {
+			out.FactoryPresetFreqs = append(out.FactoryPresetFreqs, backend.Frequency(f))
+		}
+		out.MaxEIRP = dp.MaxEIRP
+		out.MaxDutyCycle = backend.Percentage(dp.MaxDutyCycle)
+	}
+
+	return out, nil
+}
+
+// GetProfile requests the device-profile of the given DevEUI from the
+// roaming partner with the given NetID.
+func GetProfile(ctx context.Context, netID lorawan.NetID, devEUI lorawan.EUI64) (backend.ProfileAnsPayload, error) {
+	client, err := GetClientForNetID(netID)
+	if err != nil {
+		return backend.ProfileAnsPayload{}, errors.Wrap(err, "get client for netid error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"net_id":  netID,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("roaming: requesting device-profile")
+
+	ans, err := client.ProfileReq(ctx, backend.ProfileReqPayload{
+		DevEUI: devEUI,
+	})
+	if err != nil {
+		return backend.ProfileAnsPayload{}, errors.Wrap(err, "request error")
+	}
+
+	if ans.Result.ResultCode != backend.Success {
+		return backend.ProfileAnsPayload{}, fmt.Errorf("expected: %s, got: %s (%s)", backend.Success, ans.Result.ResultCode, ans.Result.Description)
+	}
+
+	return ans, nil
+}
@@ -1,17 +1,21 @@
 package roaming
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/backend"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
@@ -19,12 +23,21 @@ import (
 var ErrNoAgreement = errors.New("agreement not found")
 
 type agreement struct {
-	netID                  lorawan.NetID
-	passiveRoaming         bool
-	passiveRoamingLifetime time.Duration
-	passiveRoamingKEKLabel string
-	server                 string
-	client                 backend.Client
+	netID                   lorawan.NetID
+	disabled                bool
+	passiveRoaming          bool
+	passiveRoamingLifetime  time.Duration
+	passiveRoamingKEKLabel  string
+	handoverRoaming         bool
+	handoverRoamingLifetime time.Duration
+	handoverRoamingKEKLabel string
+	profileDisclosure       []string
+	server                  string
+	client                  Client
+
+	inboundAuthorization     string
+	inboundClientCertSubject string
+	inboundRateLimit         int
 }
 
 var (
@@ -32,32 +45,51 @@ var (
 	roamingEnabled           bool
 	netID                    lorawan.NetID
 	agreements               []agreement
+	staticAgreements         []agreement
+	agreementsVersion        int64
+	agreementsReloadInterval time.Duration
+	agreementsMux            sync.RWMutex
 	keks                     map[string][]byte
 
-	defaultEnabled                bool
-	defaultPassiveRoaming         bool
-	defaultPassiveRoamingLifetime time.Duration
-	defaultPassiveRoamingKEKLabel string
-	defaultAsync                  bool
-	defaultAsyncTimeout           time.Duration
-	defaultServer                 string
-	defaultCACert                 string
-	defaultTLSCert                string
-	defaultTLSKey                 string
-	defaultAuthorization          string
+	defaultEnabled                 bool
+	defaultPassiveRoaming          bool
+	defaultPassiveRoamingLifetime  time.Duration
+	defaultPassiveRoamingKEKLabel  string
+	defaultHandoverRoaming         bool
+	defaultHandoverRoamingLifetime time.Duration
+	defaultHandoverRoamingKEKLabel string
+	defaultProfileDisclosure       []string
+	defaultAsync                   bool
+	defaultAsyncTimeout            time.Duration
+	defaultServer                  string
+	defaultCACert                  string
+	defaultTLSCert                 string
+	defaultTLSKey                  string
+	defaultAuthorization           string
+	defaultInboundRateLimit        int
+
+	requireAuthentication bool
 )
 
-// Setup configures the roaming package.
+// Setup configures the roaming package. The roaming agreements from the
+// configuration file are configured by Setup, the roaming agreements stored
+// in the database are loaded by LoadAgreements.
 func Setup(c config.Config) error {
 	resolveNetIDDomainSuffix = c.Roaming.ResolveNetIDDomainSuffix
 	netID = c.NetworkServer.NetID
 	keks = make(map[string][]byte)
-	agreements = []agreement{}
+	staticAgreements = []agreement{}
+	agreementsVersion = 0
+	agreementsReloadInterval = c.Roaming.AgreementsReloadInterval
 
 	defaultEnabled = c.Roaming.Default.Enabled
 	defaultPassiveRoaming = c.Roaming.Default.PassiveRoaming
 	defaultPassiveRoamingLifetime = c.Roaming.Default.PassiveRoamingLifetime
 	defaultPassiveRoamingKEKLabel = c.Roaming.Default.PassiveRoamingKEKLabel
+	defaultHandoverRoaming = c.Roaming.Default.HandoverRoaming
+	defaultHandoverRoamingLifetime = c.Roaming.Default.HandoverRoamingLifetime
+	defaultHandoverRoamingKEKLabel = c.Roaming.Default.HandoverRoamingKEKLabel
+	defaultProfileDisclosure = c.Roaming.Default.ProfileDisclosure
 	defaultAsync = c.Roaming.Default.Async
 	defaultAsyncTimeout = c.Roaming.Default.AsyncTimeout
 	defaultServer = c.Roaming.Default.Server
@@ -65,88 +97,319 @@ func Setup(c config.Config) error {
 	defaultTLSCert = c.Roaming.Default.TLSCert
 	defaultTLSKey = c.Roaming.Default.TLSKey
 	defaultAuthorization = c.Roaming.Default.Authorization
+	defaultInboundRateLimit = c.Roaming.Default.InboundRateLimit
+	requireAuthentication = c.Roaming.API.RequireAuthentication
 
-	if defaultEnabled {
-		roamingEnabled = true
+	if err := validateProfileDisclosure(defaultProfileDisclosure); err != nil {
+		return errors.Wrap(err, "validate default profile_disclosure error")
+	}
+
+	for _, k := range c.Roaming.KEK.Set {
+		kek, err := hex.DecodeString(k.KEK)
+		if err != nil {
+			return errors.Wrap(err, "decode kek error")
+		}
+
+		keks[k.Label] = kek
 	}
 
 	for _, server := range c.Roaming.Servers {
-		roamingEnabled = true
+		if err := validateProfileDisclosure(server.ProfileDisclosure); err != nil {
+			return errors.Wrapf(err, "validate profile_disclosure error for netid: %s", server.NetID)
+		}
 
-		if server.Server == "" {
-			server.Server = fmt.Sprintf("https://%s%s", server.NetID.String(), resolveNetIDDomainSuffix)
+		a, err := newAgreement(storage.RoamingAgreement{
+			NetID:                   server.NetID,
+			Enabled:                 true,
+			PassiveRoaming:          server.PassiveRoaming,
+			PassiveRoamingLifetime:  server.PassiveRoamingLifetime,
+			PassiveRoamingKEKLabel:  server.PassiveRoamingKEKLabel,
+			HandoverRoaming:         server.HandoverRoaming,
+			HandoverRoamingLifetime: server.HandoverRoamingLifetime,
+			HandoverRoamingKEKLabel: server.HandoverRoamingKEKLabel,
+			ProfileDisclosure:       server.ProfileDisclosure,
+			Server:                  server.Server,
+			Async:                   server.Async,
+			AsyncTimeout:            server.AsyncTimeout,
+			CACert:                  server.CACert,
+			TLSCert:                 server.TLSCert,
+			TLSKey:                  server.TLSKey,
+			Authorization:           server.Authorization,
+
+			InboundAuthorization:     server.InboundAuthorization,
+			InboundClientCertSubject: server.InboundClientCertSubject,
+			InboundRateLimit:         server.InboundRateLimit,
+		})
+		if err != nil {
+			return err
 		}
 
-		log.WithFields(log.Fields{
-			"net_id":                   server.NetID,
-			"passive_roaming":          server.PassiveRoaming,
-			"passive_roaming_lifetime": server.PassiveRoamingLifetime,
-			"server":                   server.Server,
-			"async":                    server.Async,
-			"async_timeout":            server.AsyncTimeout,
-		}).Info("roaming: configuring roaming agreement")
+		staticAgreements = append(staticAgreements, a)
+	}
 
-		var redisClient redis.UniversalClient
-		if server.Async {
-			redisClient = storage.RedisClient()
+	setAgreements(nil)
+
+	return nil
+}
+
+// LoadAgreements (re)loads the roaming agreements from the database. A
+// roaming agreement stored in the database takes precedence over the
+// roaming agreement configured in the configuration file for the same NetID.
+func LoadAgreements(ctx context.Context) error {
+	version, err := storage.GetRoamingAgreementsVersion(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get roaming agreements version error")
+	}
+
+	items, err := storage.GetRoamingAgreements(ctx, storage.DB())
+	if err != nil {
+		return errors.Wrap(err, "get roaming agreements error")
+	}
+
+	var dbAgreements []agreement
+	for _, item := range items {
+		if !item.Enabled {
+			log.WithFields(log.Fields{
+				"net_id": item.NetID,
+				"ctx_id": ctx.Value(logging.ContextIDKey),
+			}).Info("roaming: roaming agreement is disabled")
+
+			dbAgreements = append(dbAgreements, agreement{netID: item.NetID, disabled: true})
+			continue
 		}
 
-		client, err := backend.NewClient(backend.ClientConfig{
-			Logger:        log.StandardLogger(),
-			SenderID:      netID.String(),
-			ReceiverID:    server.NetID.String(),
-			Server:        server.Server,
-			CACert:        server.CACert,
-			TLSCert:       server.TLSCert,
-			TLSKey:        server.TLSKey,
-			Authorization: server.Authorization,
-			AsyncTimeout:  server.AsyncTimeout,
-			RedisClient:   redisClient,
-		})
+		a, err := newAgreement(item)
 		if err != nil {
-			return errors.Wrapf(err, "new roaming client error for netid: %s", server.NetID)
+			// a single invalid agreement must not block the other
+			// agreements from being (re)loaded
+			log.WithFields(log.Fields{
+				"net_id": item.NetID,
+				"ctx_id": ctx.Value(logging.ContextIDKey),
+			}).WithError(err).Error("roaming: configure roaming agreement error, disabling agreement")
+
+			dbAgreements = append(dbAgreements, agreement{netID: item.NetID, disabled: true})
+			continue
 		}
 
-		agreements = append(agreements, agreement{
-			netID:                  server.NetID,
-			passiveRoaming:         server.PassiveRoaming,
-			passiveRoamingLifetime: server.PassiveRoamingLifetime,
-			passiveRoamingKEKLabel: server.PassiveRoamingKEKLabel,
-			client:                 client,
-			server:                 server.Server,
-		})
+		dbAgreements = append(dbAgreements, a)
 	}
 
-	for _, k := range c.Roaming.KEK.Set {
-		kek, err := hex.DecodeString(k.KEK)
+	setAgreements(dbAgreements)
+
+	agreementsMux.Lock()
+	agreementsVersion = version
+	agreementsMux.Unlock()
+
+	return nil
+}
+
+// NotifyAgreementsChanged must be called after the roaming agreements in the
+// database have been changed. It increments the roaming agreements version
+// so that the other Network Server instances reload the agreements and it
+// reloads the agreements of this instance.
+func NotifyAgreementsChanged(ctx context.Context) error {
+	if _, err := storage.IncrRoamingAgreementsVersion(ctx); err != nil {
+		return errors.Wrap(err, "increment roaming agreements version error")
+	}
+
+	return LoadAgreements(ctx)
+}
+
+// AgreementsReloadLoop starts an infinite loop which reloads the roaming
+// agreements when these have been changed by any of the Network Server
+// instances.
+func AgreementsReloadLoop() {
+	for {
+		time.Sleep(agreementsReloadInterval)
+
+		ctxID, err := uuid.NewV4()
 		if err != nil {
-			return errors.Wrap(err, "decode kek error")
+			log.WithError(err).Error("get new uuid error")
 		}
+		ctx := context.WithValue(context.Background(), logging.ContextIDKey, ctxID)
 
-		keks[k.Label] = kek
+		version, err := storage.GetRoamingAgreementsVersion(ctx)
+		if err != nil {
+			log.WithField("ctx_id", ctxID).WithError(err).Error("roaming: get roaming agreements version error")
+			continue
+		}
+
+		agreementsMux.RLock()
+		changed := version != agreementsVersion
+		agreementsMux.RUnlock()
+
+		if !changed {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"version": version,
+			"ctx_id":  ctxID,
+		}).Info("roaming: roaming agreements changed, reloading")
+
+		if err := LoadAgreements(ctx); err != nil {
+			log.WithField("ctx_id", ctxID).WithError(err).Error("roaming: load roaming agreements error")
+		}
+	}
+}
+
+// ValidateAgreement validates the given roaming agreement.
+func ValidateAgreement(a storage.RoamingAgreement) error {
+	if err := validateProfileDisclosure(a.ProfileDisclosure); err != nil {
+		return err
+	}
+
+	if a.PassiveRoamingKEKLabel != "" {
+		if _, err := GetKEKKey(a.PassiveRoamingKEKLabel); err != nil {
+			return err
+		}
+	}
+
+	if a.HandoverRoamingKEKLabel != "" {
+		if _, err := GetKEKKey(a.HandoverRoamingKEKLabel); err != nil {
+			return err
+		}
+	}
+
+	if (a.TLSCert == "") != (a.TLSKey == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+
+	if a.PassiveRoamingLifetime < 0 || a.HandoverRoamingLifetime < 0 || a.AsyncTimeout < 0 {
+		return errors.New("lifetime and timeout values must not be negative")
+	}
+
+	if a.InboundRateLimit < 0 {
+		return errors.New("inbound_rate_limit must not be negative")
 	}
 
 	return nil
 }
 
+// newAgreement returns the agreement, including the API client, for the
+// given roaming agreement.
+func newAgreement(a storage.RoamingAgreement) (agreement, error) {
+	if a.Server == "" {
+		a.Server = fmt.Sprintf("https://%s%s", a.NetID.String(), resolveNetIDDomainSuffix)
+	}
+
+	log.WithFields(log.Fields{
+		"net_id":                    a.NetID,
+		"passive_roaming":           a.PassiveRoaming,
+		"passive_roaming_lifetime":  a.PassiveRoamingLifetime,
+		"handover_roaming":          a.HandoverRoaming,
+		"handover_roaming_lifetime": a.HandoverRoamingLifetime,
+		"server":                    a.Server,
+		"async":                     a.Async,
+		"async_timeout":             a.AsyncTimeout,
+		"profile_disclosure":        a.ProfileDisclosure,
+		"inbound_authorization":     a.InboundAuthorization != "",
+		"inbound_client_cert":       a.InboundClientCertSubject,
+		"inbound_rate_limit":        a.InboundRateLimit,
+	}).Info("roaming: configuring roaming agreement")
+
+	var redisClient redis.UniversalClient
+	if a.Async {
+		redisClient = storage.RedisClient()
+	}
+
+	client, err := newClient(backend.ClientConfig{
+		Logger:        log.StandardLogger(),
+		SenderID:      netID.String(),
+		ReceiverID:    a.NetID.String(),
+		Server:        a.Server,
+		CACert:        a.CACert,
+		TLSCert:       a.TLSCert,
+		TLSKey:        a.TLSKey,
+		Authorization: a.Authorization,
+		AsyncTimeout:  a.AsyncTimeout,
+		RedisClient:   redisClient,
+	})
+	if err != nil {
+		return agreement{}, errors.Wrapf(err, "new roaming client error for netid: %s", a.NetID)
+	}
+
+	return agreement{
+		netID:                   a.NetID,
+		passiveRoaming:          a.PassiveRoaming,
+		passiveRoamingLifetime:  a.PassiveRoamingLifetime,
+		passiveRoamingKEKLabel:  a.PassiveRoamingKEKLabel,
+		handoverRoaming:         a.HandoverRoaming,
+		handoverRoamingLifetime: a.HandoverRoamingLifetime,
+		handoverRoamingKEKLabel: a.HandoverRoamingKEKLabel,
+		profileDisclosure:       a.ProfileDisclosure,
+		server:                  a.Server,
+		client:                  client,
+
+		inboundAuthorization:     a.InboundAuthorization,
+		inboundClientCertSubject: a.InboundClientCertSubject,
+		inboundRateLimit:         a.InboundRateLimit,
+	}, nil
+}
+
+// setAgreements sets the active agreements, the given (database) agreements
+// take precedence over the static agreements.
+func setAgreements(dbAgreements []agreement) {
+	out := append([]agreement{}, dbAgreements...)
+	enabled := defaultEnabled
+
+	for _, a := range dbAgreements {
+		if !a.disabled {
+			enabled = true
+		}
+	}
+
+	for _, sa := range staticAgreements {
+		overridden := false
+		for _, a := range dbAgreements {
+			if a.netID == sa.netID {
+				overridden = true
+			}
+		}
+
+		if !overridden {
+			out = append(out, sa)
+			enabled = true
+		}
+	}
+
+	agreementsMux.Lock()
+	agreements = out
+	roamingEnabled = enabled
+	agreementsMux.Unlock()
+}
+
+// getAgreements returns the active agreements. The returned slice is never
+// modified as it is replaced as a whole on reload.
+func getAgreements() []agreement {
+	agreementsMux.RLock()
+	defer agreementsMux.RUnlock()
+	return agreements
+}
+
 // IsRoamingDevAddr returns true when the DevAddr does not match the NetID of
 // the ChirpStack Network Server configuration. In case roaming is disabled,
 // this will always return false.
 // Note that enabling roaming -and- using ABP devices can be problematic when
 // the ABP DevAddr does not match the NetID.
 func IsRoamingDevAddr(devAddr lorawan.DevAddr) bool {
-	return roamingEnabled && !devAddr.IsNetID(netID)
+	return IsRoamingEnabled() && !devAddr.IsNetID(netID)
 }
 
 // IsRoamingEnabled returns if roaming is enabled.
 func IsRoamingEnabled() bool {
+	agreementsMux.RLock()
+	defer agreementsMux.RUnlock()
 	return roamingEnabled
 }
 
 // GetClientForNetID returns the API client for the given NetID.
-func GetClientForNetID(clientNetID lorawan.NetID) (backend.Client, error) {
-	for _, a := range agreements {
+func GetClientForNetID(clientNetID lorawan.NetID) (Client, error) {
+	for _, a := range getAgreements() {
 		if a.netID == clientNetID {
+			if a.disabled {
+				return nil, ErrNoAgreement
+			}
 			return a.client, nil
 		}
 	}
@@ -173,7 +436,7 @@ func GetClientForNetID(clientNetID lorawan.NetID) (backend.Client, error) {
 			redisClient = storage.RedisClient()
 		}
 
-		client, err := backend.NewClient(backend.ClientConfig{
+		client, err := newClient(backend.ClientConfig{
 			Logger:        log.StandardLogger(),
 			SenderID:      netID.String(),
 			ReceiverID:    clientNetID.String(),
@@ -197,7 +460,7 @@ func GetClientForNetID(clientNetID lorawan.NetID) (backend.Client, error) {
 // GetPassiveRoamingLifetime returns the passive-roaming lifetime for the
 // given NetID.
 func GetPassiveRoamingLifetime(netID lorawan.NetID) time.Duration {
-	for _, a := range agreements {
+	for _, a := range getAgreements() {
 		if a.netID == netID {
 			return a.passiveRoamingLifetime
 		}
@@ -210,6 +473,54 @@ func GetPassiveRoamingLifetime(netID lorawan.NetID) time.Duration {
 	return 0
 }
 
+// IsHandoverRoamingAllowed returns if handover-roaming is allowed for the
+// given NetID.
+func IsHandoverRoamingAllowed(netID lorawan.NetID) bool {
+	for _, a := range getAgreements() {
+		if a.netID == netID {
+			return a.handoverRoaming
+		}
+	}
+
+	if defaultEnabled {
+		return defaultHandoverRoaming
+	}
+
+	return false
+}
+
+// GetHandoverRoamingLifetime returns the handover-roaming lifetime for the
+// given NetID.
+func GetHandoverRoamingLifetime(netID lorawan.NetID) time.Duration {
+	for _, a := range getAgreements() {
+		if a.netID == netID {
+			return a.handoverRoamingLifetime
+		}
+	}
+
+	if defaultEnabled {
+		return defaultHandoverRoamingLifetime
+	}
+
+	return 0
+}
+
+// GetHandoverRoamingKEKLabel returns the KEK label for the given NetID or an
+// empty string.
+func GetHandoverRoamingKEKLabel(netID lorawan.NetID) string {
+	for _, a := range getAgreements() {
+		if a.netID == netID {
+			return a.handoverRoamingKEKLabel
+		}
+	}
+
+	if defaultEnabled {
+		return defaultHandoverRoamingKEKLabel
+	}
+
+	return ""
+}
+
 // GetKEKKey returns the KEK key for the given label.
 func GetKEKKey(label string) ([]byte, error) {
 	kek, ok := keks[label]
@@ -221,7 +532,7 @@ func GetKEKKey(label string) ([]byte, error) {
 
 // GetPassiveRoamingKEKLabel returns the KEK label for the given NetID or an empty string.
 func GetPassiveRoamingKEKLabel(netID lorawan.NetID) string {
-	for _, a := range agreements {
+	for _, a := range getAgreements() {
 		if a.netID == netID {
 			return a.passiveRoamingKEKLabel
 		}
@@ -238,8 +549,7 @@ func GetPassiveRoamingKEKLabel(netID lorawan.NetID) string {
 func GetNetIDsForDevAddr(devAddr lorawan.DevAddr) []lorawan.NetID {
 	var out []lorawan.NetID
 
-	for i := range agreements {
-		a := agreements[i]
+	for _, a := range getAgreements() {
 		if devAddr.IsNetID(a.netID) && a.passiveRoaming {
 			out = append(out, a.netID)
 		}
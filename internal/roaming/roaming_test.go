@@ -5,7 +5,10 @@ import (
 	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	"github.com/gofrs/uuid"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
@@ -194,3 +197,61 @@ func TestGetNetIDsForDevAddr(t *testing.T) {
 		assert.Len(GetNetIDsForDevAddr(devAddr), 0)
 	})
 }
+
+func TestGetDeviceProfileForNetID(t *testing.T) {
+	assert := require.New(t)
+	conf := test.GetConfig()
+	conf.Roaming.Servers = []config.RoamingServer{
+		{
+			NetID:             lorawan.NetID{6, 6, 6},
+			PassiveRoaming:    true,
+			ProfileDisclosure: []string{"class_c", "radio"},
+		},
+		{
+			NetID:          lorawan.NetID{6, 6, 7},
+			PassiveRoaming: true,
+		},
+	}
+	assert.NoError(Setup(conf))
+
+	dp := storage.DeviceProfile{
+		ID:                 uuid.Must(uuid.NewV4()),
+		MACVersion:         "1.0.3",
+		SupportsClassC:     true,
+		ClassCTimeout:      10,
+		RXDelay1:           1,
+		FactoryPresetFreqs: []uint32{868100000},
+		MaxEIRP:            14,
+		MaxDutyCycle:       10,
+	}
+
+	t.Run("Disclosure policy", func(t *testing.T) {
+		assert := require.New(t)
+
+		out, err := GetDeviceProfileForNetID(lorawan.NetID{6, 6, 6}, dp, nil)
+		assert.NoError(err)
+		assert.Equal(backend.DeviceProfile{
+			DeviceProfileID:    dp.ID.String(),
+			SupportsClassC:     true,
+			ClassCTimeout:      10,
+			FactoryPresetFreqs: []backend.Frequency{868100000},
+			MaxEIRP:            14,
+			MaxDutyCycle:       10,
+		}, out)
+	})
+
+	t.Run("No disclosure policy", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := GetDeviceProfileForNetID(lorawan.NetID{6, 6, 7}, dp, nil)
+		assert.Equal(ErrProfileDisclosureDisabled, err)
+	})
+
+	t.Run("Invalid disclosure policy", func(t *testing.T) {
+		assert := require.New(t)
+
+		conf := test.GetConfig()
+		conf.Roaming.Default.ProfileDisclosure = []string{"keys"}
+		assert.Error(Setup(conf))
+	})
+}
@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+)
+
+// channelPlanDevicesQuery selects the devices (without channels override)
+// and their effective channel-plan. The channel-plan of the device-profile
+// takes precedence over the channel-plan of the service-profile.
+const channelPlanDevicesQuery = `
+	select
+		d.dev_eui,
+		coalesce(dp.channel_plan_id, sp.channel_plan_id) as channel_plan_id
+	from device d
+	inner join device_extra_configs ec
+		on ec.dev_eui = d.dev_eui
+	inner join device_profile dp
+		on dp.device_profile_id = d.device_profile_id
+	inner join service_profile sp
+		on sp.service_profile_id = d.service_profile_id
+	where
+		not ec.channels_override
+		and %s`
+
+// ChannelPlan defines a named set of enabled channels and extra channels,
+// which can be assigned to device-profiles and service-profiles.
+type ChannelPlan struct {
+	ID              uuid.UUID            `db:"channel_plan_id"`
+	CreatedAt       time.Time            `db:"created_at"`
+	UpdatedAt       time.Time            `db:"updated_at"`
+	Name            string               `db:"name"`
+	EnabledChannels []int32              `db:"enabled_channels"`
+	ExtraChannels   []DeviceExtraChannel `db:"-"`
+}
+
+// SetChannels validates and sets the enabled channels and extra channels.
+// See DeviceExtraConfigurations.SetChannels for the validation rules.
+func (c *ChannelPlan) SetChannels(enabledChannels []int32, extraChannels []loraband.Channel) error {
+	enabled, extra, err := validateChannels(enabledChannels, extraChannels)
+	if err != nil {
+		return err
+	}
+
+	c.EnabledChannels = enabled
+	c.ExtraChannels = extra
+
+	return nil
+}
+
+// CreateChannelPlan creates the given channel-plan.
+// As this will execute multiple SQL statements, it is recommended to perform
+// this within a transaction.
+func CreateChannelPlan(ctx context.Context, db sqlx.Execer, c *ChannelPlan) error {
+	now := time.Now()
+	c.CreatedAt = now
+	c.UpdatedAt = now
+
+	if c.ID == uuid.Nil {
+		var err error
+		c.ID, err = uuid.NewV4()
+		if err != nil {
+			return errors.Wrap(err, "new uuid v4 error")
+		}
+	}
+
+	_, err := db.Exec(`
+		insert into channel_plan (
+			channel_plan_id,
+			created_at,
+			updated_at,
+			name,
+			enabled_channels
+		) values ($1, $2, $3, $4, $5)`,
+		c.ID,
+		c.CreatedAt,
+		c.UpdatedAt,
+		c.Name,
+		pq.Array(c.EnabledChannels),
+	)
+	if err != nil {
+		return handlePSQLError(err, "insert error")
+	}
+
+	if err := createChannelPlanChannels(db, *c); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"id":     c.ID,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("channel-plan created")
+
+	return nil
+}
+
+// GetChannelPlan returns the channel-plan matching the given ID.
+func GetChannelPlan(ctx context.Context, db sqlx.Queryer, id uuid.UUID) (ChannelPlan, error) {
+	var c ChannelPlan
+	err := db.QueryRowx(`
+		select
+			channel_plan_id,
+			created_at,
+			updated_at,
+			name,
+			enabled_channels
+		from channel_plan
+		where
+			channel_plan_id = $1`,
+		id,
+	).Scan(
+		&c.ID,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+		&c.Name,
+		pq.Array(&c.EnabledChannels),
+	)
+	if err != nil {
+		return c, handlePSQLError(err, "select error")
+	}
+
+	err = sqlx.Select(db, &c.ExtraChannels, `
+		select
+			channel_index,
+			frequency,
+			min_dr,
+			max_dr
+		from channel_plan_channel
+		where
+			channel_plan_id = $1
+		order by
+			channel_index`,
+		id,
+	)
+	if err != nil {
+		return c, handlePSQLError(err, "select error")
+	}
+
+	return c, nil
+}
+
+// UpdateChannelPlan updates the given channel-plan and re-applies it to all
+// the devices using this channel-plan. It returns the DevEUIs of the updated
+// devices, of which the cached configuration must be removed after the
+// transaction has been committed.
+// As this will execute multiple SQL statements, it is recommended to perform
+// this within a transaction.
+func UpdateChannelPlan(ctx context.Context, db sqlx.Ext, c *ChannelPlan) ([]lorawan.EUI64, error) {
+	c.UpdatedAt = time.Now()
+	res, err := db.Exec(`
+		update channel_plan
+		set
+			updated_at = $2,
+			name = $3,
+			enabled_channels = $4
+		where
+			channel_plan_id = $1`,
+		c.ID,
+		c.UpdatedAt,
+		c.Name,
+		pq.Array(c.EnabledChannels),
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "update error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return nil, handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
+		return nil, ErrDoesNotExist
+	}
+
+	_, err = db.Exec(`
+		delete from channel_plan_channel
+		where
+			channel_plan_id = $1`,
+		c.ID,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "delete error")
+	}
+
+	if err := createChannelPlanChannels(db, *c); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"id":     c.ID,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("channel-plan updated")
+
+	devEUIs, err := applyChannelPlansForDevices(ctx, db, "coalesce(dp.channel_plan_id, sp.channel_plan_id) = $1", c.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "apply channel-plan error")
+	}
+
+	return devEUIs, nil
+}
+
+// DeleteChannelPlan deletes the channel-plan matching the given ID. The
+// devices using this channel-plan fall back to the channel-plan of the
+// service-profile or to the default channels. It returns the DevEUIs of the
+// updated devices, of which the cached configuration must be removed after
+// the transaction has been committed.
+// As this will execute multiple SQL statements, it is recommended to perform
+// this within a transaction.
+func DeleteChannelPlan(ctx context.Context, db sqlx.Ext, id uuid.UUID) ([]lorawan.EUI64, error) {
+	var dpIDs, spIDs []uuid.UUID
+
+	err := sqlx.Select(db, &dpIDs, `
+		update device_profile
+		set
+			channel_plan_id = null
+		where
+			channel_plan_id = $1
+		returning device_profile_id`,
+		id,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "update error")
+	}
+
+	err = sqlx.Select(db, &spIDs, `
+		update service_profile
+		set
+			channel_plan_id = null
+		where
+			channel_plan_id = $1
+		returning service_profile_id`,
+		id,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "update error")
+	}
+
+	res, err := db.Exec("delete from channel_plan where channel_plan_id = $1", id)
+	if err != nil {
+		return nil, handlePSQLError(err, "delete error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return nil, handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
+		return nil, ErrDoesNotExist
+	}
+
+	var devEUIs []lorawan.EUI64
+	for _, dpID := range dpIDs {
+		if err := FlushDeviceProfileCache(ctx, dpID); err != nil {
+			return nil, errors.Wrap(err, "flush device-profile cache error")
+		}
+
+		updated, err := ApplyChannelPlanForDeviceProfile(ctx, db, dpID)
+		if err != nil {
+			return nil, err
+		}
+		devEUIs = append(devEUIs, updated...)
+	}
+
+	for _, spID := range spIDs {
+		if err := FlushServiceProfileCache(ctx, spID); err != nil {
+			return nil, errors.Wrap(err, "flush service-profile cache error")
+		}
+
+		updated, err := ApplyChannelPlanForServiceProfile(ctx, db, spID)
+		if err != nil {
+			return nil, err
+		}
+		devEUIs = append(devEUIs, updated...)
+	}
+
+	log.WithFields(log.Fields{
+		"id":     id,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("channel-plan deleted")
+
+	return devEUIs, nil
+}
+
+// ApplyChannelPlanForDeviceProfile applies the effective channel-plan to all
+// the devices (without channels override) using the given device-profile.
+// This must be called after the channel-plan of the device-profile has been
+// changed. It returns the DevEUIs of the updated devices, of which the cached
+// configuration must be removed after the transaction has been committed.
+func ApplyChannelPlanForDeviceProfile(ctx context.Context, db sqlx.Ext, id uuid.UUID) ([]lorawan.EUI64, error) {
+	devEUIs, err := applyChannelPlansForDevices(ctx, db, "d.device_profile_id = $1", id)
+	if err != nil {
+		return nil, errors.Wrap(err, "apply channel-plan error")
+	}
+	return devEUIs, nil
+}
+
+// ApplyChannelPlanForServiceProfile applies the effective channel-plan to
+// all the devices (without channels override) using the given
+// service-profile. This must be called after the channel-plan of the
+// service-profile has been changed. It returns the DevEUIs of the updated
+// devices, of which the cached configuration must be removed after the
+// transaction has been committed.
+func ApplyChannelPlanForServiceProfile(ctx context.Context, db sqlx.Ext, id uuid.UUID) ([]lorawan.EUI64, error) {
+	devEUIs, err := applyChannelPlansForDevices(ctx, db, "d.service_profile_id = $1", id)
+	if err != nil {
+		return nil, errors.Wrap(err, "apply channel-plan error")
+	}
+	return devEUIs, nil
+}
+
+// ApplyChannelPlanForDevice applies the effective channel-plan to the given
+// device, in case it does not have a channels override. This must be called
+// after the device-profile or service-profile of the device has been changed
+// or when the channels override has been removed. The cached configuration
+// must be removed after the transaction has been committed.
+func ApplyChannelPlanForDevice(ctx context.Context, db sqlx.Execer, devEUI lorawan.EUI64) error {
+	if _, err := applyChannelPlans(db, "d.dev_eui = $1", devEUI[:]); err != nil {
+		return errors.Wrap(err, "apply channel-plan error")
+	}
+
+	return nil
+}
+
+// applyChannelPlanForNewDevice applies the channel-plan (if any) to the
+// given newly created device. It returns true when a channel-plan has been
+// applied.
+func applyChannelPlanForNewDevice(db sqlx.Execer, devEUI lorawan.EUI64) (bool, error) {
+	ra, err := applyChannelPlans(db, "d.dev_eui = $1 and coalesce(dp.channel_plan_id, sp.channel_plan_id) is not null", devEUI[:])
+	if err != nil {
+		return false, errors.Wrap(err, "apply channel-plan error")
+	}
+	return ra != 0, nil
+}
+
+// applyChannelPlansForDevices applies the effective channel-plan to the
+// devices matching the given condition and returns their DevEUIs.
+func applyChannelPlansForDevices(ctx context.Context, db sqlx.Ext, condition string, arg interface{}) ([]lorawan.EUI64, error) {
+	var devEUIs []lorawan.EUI64
+	err := sqlx.Select(db, &devEUIs, "select dev_eui from ("+fmt.Sprintf(channelPlanDevicesQuery, condition)+") devices", arg)
+	if err != nil {
+		return nil, handlePSQLError(err, "select error")
+	}
+
+	if len(devEUIs) == 0 {
+		return nil, nil
+	}
+
+	if _, err := applyChannelPlans(db, condition, arg); err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"device_count": len(devEUIs),
+		"ctx_id":       ctx.Value(logging.ContextIDKey),
+	}).Info("channel-plan applied to devices")
+
+	return devEUIs, nil
+}
+
+// applyChannelPlans replaces the enabled channels and extra channels of the
+// devices matching the given condition by the channels of their effective
+// channel-plan, or by the default channels in case there is none. The
+// channel reconfiguration status is set to pending. It returns the number
+// of updated devices.
+func applyChannelPlans(db sqlx.Execer, condition string, arg interface{}) (int64, error) {
+	devices := "with devices as (" + fmt.Sprintf(channelPlanDevicesQuery, condition) + ")"
+
+	_, err := db.Exec(devices+`
+		delete from device_extra_config_channel
+		where
+			dev_eui in (select dev_eui from devices)`,
+		arg,
+	)
+	if err != nil {
+		return 0, handlePSQLError(err, "delete error")
+	}
+
+	res, err := db.Exec(devices+`
+		update device_extra_configs ec
+		set
+			enabled_channels = coalesce(cp.enabled_channels, $2),
+			channels_state = $3,
+			channels_state_updated_at = $4,
+			new_channel_ans_channel_index = null,
+			new_channel_ans_channel_frequency_ok = null,
+			new_channel_ans_data_rate_range_ok = null,
+			link_adr_ans_channel_mask_ack = null,
+			link_adr_ans_data_rate_ack = null,
+			link_adr_ans_power_ack = null
+		from devices
+		left join channel_plan cp
+			on cp.channel_plan_id = devices.channel_plan_id
+		where
+			ec.dev_eui = devices.dev_eui`,
+		arg,
+		pq.Array(defaultEnabledChannels()),
+		DeviceChannelsPending,
+		time.Now(),
+	)
+	if err != nil {
+		return 0, handlePSQLError(err, "update error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return 0, handlePSQLError(err, "get rows affected error")
+	}
+
+	_, err = db.Exec(devices+`
+		insert into device_extra_config_channel (
+			dev_eui,
+			channel_index,
+			frequency,
+			min_dr,
+			max_dr
+		)
+		select
+			devices.dev_eui,
+			c.channel_index,
+			c.frequency,
+			c.min_dr,
+			c.max_dr
+		from devices
+		inner join channel_plan_channel c
+			on c.channel_plan_id = devices.channel_plan_id`,
+		arg,
+	)
+	if err != nil {
+		return 0, handlePSQLError(err, "insert error")
+	}
+
+	return ra, nil
+}
+
+func createChannelPlanChannels(db sqlx.Execer, c ChannelPlan) error {
+	for _, ec := range c.ExtraChannels {
+		_, err := db.Exec(`
+			insert into channel_plan_channel (
+				channel_plan_id,
+				channel_index,
+				frequency,
+				min_dr,
+				max_dr
+			) values ($1, $2, $3, $4, $5)`,
+			c.ID,
+			ec.ChannelIndex,
+			ec.Frequency,
+			ec.MinDR,
+			ec.MaxDR,
+		)
+		if err != nil {
+			return handlePSQLError(err, "insert error")
+		}
+	}
+
+	return nil
+}
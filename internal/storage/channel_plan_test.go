@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+func (ts *StorageTestSuite) TestChannelPlan() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	cp := ChannelPlan{
+		Name: "test-plan",
+	}
+	assert.NoError(cp.SetChannels([]int32{0, 1}, []loraband.Channel{
+		{Frequency: 867100000, MinDR: 0, MaxDR: 5},
+	}))
+
+	ts.T().Run("Create", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(CreateChannelPlan(ctx, ts.Tx(), &cp))
+
+		cpGet, err := GetChannelPlan(ctx, ts.Tx(), cp.ID)
+		assert.NoError(err)
+		assert.Equal(cp.Name, cpGet.Name)
+		assert.Equal([]int32{0, 1, 3}, cpGet.EnabledChannels)
+		assert.Equal(cp.ExtraChannels, cpGet.ExtraChannels)
+	})
+
+	sp := ServiceProfile{}
+	dp := DeviceProfile{
+		ChannelPlanID: &cp.ID,
+	}
+	rp := RoutingProfile{}
+	assert.NoError(CreateServiceProfile(ctx, ts.Tx(), &sp))
+	assert.NoError(CreateDeviceProfile(ctx, ts.Tx(), &dp))
+	assert.NoError(CreateRoutingProfile(ctx, ts.Tx(), &rp))
+
+	d := Device{
+		DevEUI:           lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		ServiceProfileID: sp.ID,
+		DeviceProfileID:  dp.ID,
+		RoutingProfileID: rp.ID,
+	}
+
+	ts.T().Run("New device uses channel-plan", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(CreateDevice(ctx, ts.Tx(), &d))
+
+		ec, err := GetAndCacheDeviceExtraConfigurationsCache(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal([]int32{0, 1, 3}, ec.EnabledChannels)
+		assert.Equal(cp.ExtraChannels, ec.ExtraChannels)
+		assert.Equal(DeviceChannelsPending, ec.ChannelsStatus.State)
+	})
+
+	ts.T().Run("Update", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(cp.SetChannels([]int32{0, 1, 2}, nil))
+		devEUIs, err := UpdateChannelPlan(ctx, ts.Tx(), &cp)
+		assert.NoError(err)
+		assert.Equal([]lorawan.EUI64{d.DevEUI}, devEUIs)
+
+		// the cache is removed by the caller, after the commit
+		_, err = GetDeviceExtraConfigurationsCache(ctx, d.DevEUI)
+		assert.NoError(err)
+		assert.NoError(DeleteDeviceExtraConfigurationsCache(ctx, devEUIs...))
+		_, err = GetDeviceExtraConfigurationsCache(ctx, d.DevEUI)
+		assert.Equal(ErrDoesNotExist, err)
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal([]int32{0, 1, 2}, ec.EnabledChannels)
+		assert.Len(ec.ExtraChannels, 0)
+	})
+
+	ts.T().Run("Device override takes precedence", func(t *testing.T) {
+		assert := require.New(t)
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.NoError(ec.SetChannels([]int32{0}, nil))
+		ec.ChannelsOverride = true
+		assert.NoError(UpdateDeviceExtraConfigurations(ctx, ts.Tx(), ec))
+
+		assert.NoError(cp.SetChannels([]int32{1, 2}, nil))
+		devEUIs, err := UpdateChannelPlan(ctx, ts.Tx(), &cp)
+		assert.NoError(err)
+		assert.Len(devEUIs, 0)
+
+		ec, err = GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal([]int32{0}, ec.EnabledChannels)
+
+		ec.ChannelsOverride = false
+		assert.NoError(UpdateDeviceExtraConfigurations(ctx, ts.Tx(), ec))
+		assert.NoError(ApplyChannelPlanForDevice(ctx, ts.Tx(), d.DevEUI))
+
+		ec, err = GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal([]int32{1, 2}, ec.EnabledChannels)
+	})
+
+	ts.T().Run("Delete", func(t *testing.T) {
+		assert := require.New(t)
+		devEUIs, err := DeleteChannelPlan(ctx, ts.Tx(), cp.ID)
+		assert.NoError(err)
+		assert.Equal([]lorawan.EUI64{d.DevEUI}, devEUIs)
+
+		_, err = GetChannelPlan(ctx, ts.Tx(), cp.ID)
+		assert.Equal(ErrDoesNotExist, err)
+
+		dpGet, err := GetDeviceProfile(ctx, ts.Tx(), dp.ID)
+		assert.NoError(err)
+		assert.Nil(dpGet.ChannelPlanID)
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal(defaultEnabledChannels(), ec.EnabledChannels)
+	})
+}
+
+func TestChannelPlanSetChannels(t *testing.T) {
+	assert := require.New(t)
+	_ = test.GetConfig()
+
+	var cp ChannelPlan
+	err := cp.SetChannels([]int32{0, 1, 5}, nil)
+	assert.Equal(ErrInvalidChannel, errors.Cause(err))
+}
@@ -174,6 +174,15 @@ func DeleteDevice(ctx context.Context, db sqlx.Execer, devEUI lorawan.EUI64) err
 		return ErrDoesNotExist
 	}
 
+	// The device_extra_configs row is removed by the foreign-key cascade,
+	// the cached copy must be removed by hand.
+	if err := DeleteDeviceExtraConfigurationsCache(ctx, devEUI); err != nil {
+		log.WithFields(log.Fields{
+			"dev_eui": devEUI,
+			"ctx_id":  ctx.Value(logging.ContextIDKey),
+		}).WithError(err).Error("delete device extra-config cache error")
+	}
+
 	log.WithFields(log.Fields{
 		"dev_eui": devEUI,
 		"ctx_id":  ctx.Value(logging.ContextIDKey),
@@ -317,3 +326,33 @@ func ClearDeviceNoncesForDevice(ctx context.Context, db sqlx.Execer, devEUI lora
 	}).Info("device dev-nonce deleted")
 	return nil
 }
+
+// DeviceFilters provides filters for selecting devices.
+type DeviceFilters struct {
+	DeviceProfileID  *uuid.UUID
+	ServiceProfileID *uuid.UUID
+}
+
+// GetDevEUIsForFilters returns the DevEUIs of the devices matching the given
+// filters. Filters which are not set are ignored.
+func GetDevEUIsForFilters(ctx context.Context, db sqlx.Queryer, filters DeviceFilters) ([]lorawan.EUI64, error) {
+	var out []lorawan.EUI64
+	err := sqlx.Select(db, &out, `
+		select
+			dev_eui
+		from
+			device
+		where
+			($1::uuid is null or device_profile_id = $1)
+			and ($2::uuid is null or service_profile_id = $2)
+		order by
+			dev_eui`,
+		filters.DeviceProfileID,
+		filters.ServiceProfileID,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "select error")
+	}
+
+	return out, nil
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+)
+
+// DeviceChannelsJobState defines the state of a bulk channels update job.
+type DeviceChannelsJobState string
+
+// Available bulk channels update job states.
+const (
+	DeviceChannelsJobRunning   DeviceChannelsJobState = "RUNNING"
+	DeviceChannelsJobCompleted DeviceChannelsJobState = "COMPLETED"
+	DeviceChannelsJobFailed    DeviceChannelsJobState = "FAILED"
+)
+
+// DeviceChannelsJob defines a job updating the channels of multiple devices.
+type DeviceChannelsJob struct {
+	ID             uuid.UUID              `db:"job_id"`
+	CreatedAt      time.Time              `db:"created_at"`
+	UpdatedAt      time.Time              `db:"updated_at"`
+	State          DeviceChannelsJobState `db:"state"`
+	DeviceCount    int                    `db:"device_count"`
+	ProcessedCount int                    `db:"processed_count"`
+	FailedCount    int                    `db:"failed_count"`
+	Error          string                 `db:"error"`
+}
+
+// DeviceChannelsJobError defines the error for a single device of a bulk
+// channels update job.
+type DeviceChannelsJobError struct {
+	DevEUI lorawan.EUI64 `db:"dev_eui"`
+	Error  string        `db:"error"`
+}
+
+// CreateDeviceChannelsJob creates the given bulk channels update job.
+func CreateDeviceChannelsJob(ctx context.Context, db sqlx.Execer, j *DeviceChannelsJob) error {
+	now := time.Now()
+	j.CreatedAt = now
+	j.UpdatedAt = now
+
+	if j.ID == uuid.Nil {
+		var err error
+		j.ID, err = uuid.NewV4()
+		if err != nil {
+			return errors.Wrap(err, "new uuid v4 error")
+		}
+	}
+
+	_, err := db.Exec(`
+		insert into device_channels_job (
+			job_id,
+			created_at,
+			updated_at,
+			state,
+			device_count,
+			processed_count,
+			failed_count,
+			error
+		) values ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		j.ID,
+		j.CreatedAt,
+		j.UpdatedAt,
+		j.State,
+		j.DeviceCount,
+		j.ProcessedCount,
+		j.FailedCount,
+		j.Error,
+	)
+	if err != nil {
+		return handlePSQLError(err, "insert error")
+	}
+
+	log.WithFields(log.Fields{
+		"job_id": j.ID,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("device-channels job created")
+
+	return nil
+}
+
+// GetDeviceChannelsJob returns the bulk channels update job matching the
+// given ID.
+func GetDeviceChannelsJob(ctx context.Context, db sqlx.Queryer, id uuid.UUID) (DeviceChannelsJob, error) {
+	var j DeviceChannelsJob
+	err := sqlx.Get(db, &j, "select * from device_channels_job where job_id = $1", id)
+	if err != nil {
+		return j, handlePSQLError(err, "select error")
+	}
+
+	return j, nil
+}
+
+// UpdateDeviceChannelsJob updates the given bulk channels update job. Only
+// running jobs can be updated, ErrDoesNotExist is returned when the job has
+// already been completed or failed (e.g. marked as stale).
+func UpdateDeviceChannelsJob(ctx context.Context, db sqlx.Execer, j *DeviceChannelsJob) error {
+	j.UpdatedAt = time.Now()
+
+	res, err := db.Exec(`
+		update device_channels_job
+		set
+			updated_at = $2,
+			state = $3,
+			device_count = $4,
+			processed_count = $5,
+			failed_count = $6,
+			error = $7
+		where
+			job_id = $1
+			and state = $8`,
+		j.ID,
+		j.UpdatedAt,
+		j.State,
+		j.DeviceCount,
+		j.ProcessedCount,
+		j.FailedCount,
+		j.Error,
+		DeviceChannelsJobRunning,
+	)
+	if err != nil {
+		return handlePSQLError(err, "update error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
+		return ErrDoesNotExist
+	}
+
+	return nil
+}
+
+// FailStaleDeviceChannelsJobs marks the running bulk channels update jobs
+// which have not been updated since the given time as failed. This is the
+// case when the Network Server instance running the job was stopped. It
+// returns the IDs of the failed jobs.
+func FailStaleDeviceChannelsJobs(ctx context.Context, db sqlx.Queryer, updatedBefore time.Time) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := sqlx.Select(db, &ids, `
+		update device_channels_job
+		set
+			updated_at = $1,
+			state = $2,
+			error = $3
+		where
+			state = $4
+			and updated_at < $5
+		returning job_id`,
+		time.Now(),
+		DeviceChannelsJobFailed,
+		"job was interrupted",
+		DeviceChannelsJobRunning,
+		updatedBefore,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "update error")
+	}
+
+	for _, id := range ids {
+		log.WithFields(log.Fields{
+			"job_id": id,
+			"ctx_id": ctx.Value(logging.ContextIDKey),
+		}).Warning("stale device-channels job marked as failed")
+	}
+
+	return ids, nil
+}
+
+// CreateDeviceChannelsJobErrors stores the given per-device errors for the
+// given bulk channels update job.
+func CreateDeviceChannelsJobErrors(ctx context.Context, db sqlx.Execer, jobID uuid.UUID, jobErrors []DeviceChannelsJobError) error {
+	for _, e := range jobErrors {
+		_, err := db.Exec(`
+			insert into device_channels_job_error (
+				job_id,
+				dev_eui,
+				error
+			) values ($1, $2, $3)
+			on conflict (job_id, dev_eui) do update
+			set
+				error = excluded.error`,
+			jobID,
+			e.DevEUI[:],
+			e.Error,
+		)
+		if err != nil {
+			return handlePSQLError(err, "insert error")
+		}
+	}
+
+	return nil
+}
+
+// GetDeviceChannelsJobErrors returns a slice of per-device errors for the
+// given bulk channels update job.
+func GetDeviceChannelsJobErrors(ctx context.Context, db sqlx.Queryer, jobID uuid.UUID, limit, offset int) ([]DeviceChannelsJobError, error) {
+	var out []DeviceChannelsJobError
+	err := sqlx.Select(db, &out, `
+		select
+			dev_eui,
+			error
+		from device_channels_job_error
+		where
+			job_id = $1
+		order by
+			dev_eui
+		limit $2
+		offset $3`,
+		jobID,
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "select error")
+	}
+
+	return out, nil
+}
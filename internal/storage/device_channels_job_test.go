@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func (ts *StorageTestSuite) TestDeviceChannelsJob() {
+	ctx := context.Background()
+
+	job := DeviceChannelsJob{
+		State: DeviceChannelsJobRunning,
+	}
+
+	ts.T().Run("Create", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(CreateDeviceChannelsJob(ctx, ts.Tx(), &job))
+		assert.NotEqual(uuid.Nil, job.ID)
+
+		jobGet, err := GetDeviceChannelsJob(ctx, ts.Tx(), job.ID)
+		assert.NoError(err)
+		assert.Equal(DeviceChannelsJobRunning, jobGet.State)
+		assert.Equal(0, jobGet.DeviceCount)
+	})
+
+	ts.T().Run("Update", func(t *testing.T) {
+		assert := require.New(t)
+
+		job.State = DeviceChannelsJobCompleted
+		job.DeviceCount = 3
+		job.ProcessedCount = 3
+		job.FailedCount = 1
+		assert.NoError(UpdateDeviceChannelsJob(ctx, ts.Tx(), &job))
+
+		jobGet, err := GetDeviceChannelsJob(ctx, ts.Tx(), job.ID)
+		assert.NoError(err)
+		assert.Equal(DeviceChannelsJobCompleted, jobGet.State)
+		assert.Equal(3, jobGet.DeviceCount)
+		assert.Equal(3, jobGet.ProcessedCount)
+		assert.Equal(1, jobGet.FailedCount)
+	})
+
+	ts.T().Run("Update completed job", func(t *testing.T) {
+		assert := require.New(t)
+
+		job.State = DeviceChannelsJobFailed
+		assert.Equal(ErrDoesNotExist, UpdateDeviceChannelsJob(ctx, ts.Tx(), &job))
+		job.State = DeviceChannelsJobCompleted
+	})
+
+	ts.T().Run("Fail stale jobs", func(t *testing.T) {
+		assert := require.New(t)
+
+		running := DeviceChannelsJob{
+			State: DeviceChannelsJobRunning,
+		}
+		assert.NoError(CreateDeviceChannelsJob(ctx, ts.Tx(), &running))
+
+		ids, err := FailStaleDeviceChannelsJobs(ctx, ts.Tx(), running.UpdatedAt.Add(-time.Minute))
+		assert.NoError(err)
+		assert.Len(ids, 0)
+
+		ids, err = FailStaleDeviceChannelsJobs(ctx, ts.Tx(), running.UpdatedAt.Add(time.Minute))
+		assert.NoError(err)
+		assert.Equal([]uuid.UUID{running.ID}, ids)
+
+		jobGet, err := GetDeviceChannelsJob(ctx, ts.Tx(), running.ID)
+		assert.NoError(err)
+		assert.Equal(DeviceChannelsJobFailed, jobGet.State)
+		assert.Equal("job was interrupted", jobGet.Error)
+
+		// the completed job is not affected
+		jobGet, err = GetDeviceChannelsJob(ctx, ts.Tx(), job.ID)
+		assert.NoError(err)
+		assert.Equal(DeviceChannelsJobCompleted, jobGet.State)
+	})
+
+	ts.T().Run("Errors", func(t *testing.T) {
+		assert := require.New(t)
+
+		jobErrors := []DeviceChannelsJobError{
+			{DevEUI: lorawan.EUI64{2}, Error: "object does not exist"},
+			{DevEUI: lorawan.EUI64{1}, Error: "object does not exist"},
+		}
+		assert.NoError(CreateDeviceChannelsJobErrors(ctx, ts.Tx(), job.ID, jobErrors))
+
+		out, err := GetDeviceChannelsJobErrors(ctx, ts.Tx(), job.ID, 10, 0)
+		assert.NoError(err)
+		assert.Equal([]DeviceChannelsJobError{jobErrors[1], jobErrors[0]}, out)
+
+		out, err = GetDeviceChannelsJobErrors(ctx, ts.Tx(), job.ID, 10, 1)
+		assert.NoError(err)
+		assert.Equal([]DeviceChannelsJobError{jobErrors[0]}, out)
+	})
+
+	ts.T().Run("Get does not exist", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := GetDeviceChannelsJob(ctx, ts.Tx(), uuid.Must(uuid.NewV4()))
+		assert.Equal(ErrDoesNotExist, err)
+	})
+}
+
+func (ts *StorageTestSuite) TestGetDevEUIsForFilters() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	sp1 := ServiceProfile{}
+	sp2 := ServiceProfile{}
+	dp1 := DeviceProfile{}
+	dp2 := DeviceProfile{}
+	rp := RoutingProfile{}
+	assert.NoError(CreateServiceProfile(ctx, ts.Tx(), &sp1))
+	assert.NoError(CreateServiceProfile(ctx, ts.Tx(), &sp2))
+	assert.NoError(CreateDeviceProfile(ctx, ts.Tx(), &dp1))
+	assert.NoError(CreateDeviceProfile(ctx, ts.Tx(), &dp2))
+	assert.NoError(CreateRoutingProfile(ctx, ts.Tx(), &rp))
+
+	devices := []Device{
+		{DevEUI: lorawan.EUI64{1}, ServiceProfileID: sp1.ID, DeviceProfileID: dp1.ID, RoutingProfileID: rp.ID},
+		{DevEUI: lorawan.EUI64{2}, ServiceProfileID: sp1.ID, DeviceProfileID: dp2.ID, RoutingProfileID: rp.ID},
+		{DevEUI: lorawan.EUI64{3}, ServiceProfileID: sp2.ID, DeviceProfileID: dp2.ID, RoutingProfileID: rp.ID},
+	}
+	for i := range devices {
+		assert.NoError(CreateDevice(ctx, ts.Tx(), &devices[i]))
+	}
+
+	tests := []struct {
+		Name     string
+		Filters  DeviceFilters
+		Expected []lorawan.EUI64
+	}{
+		{
+			Name:     "no filters",
+			Expected: []lorawan.EUI64{{1}, {2}, {3}},
+		},
+		{
+			Name:     "device-profile",
+			Filters:  DeviceFilters{DeviceProfileID: &dp2.ID},
+			Expected: []lorawan.EUI64{{2}, {3}},
+		},
+		{
+			Name:     "service-profile",
+			Filters:  DeviceFilters{ServiceProfileID: &sp1.ID},
+			Expected: []lorawan.EUI64{{1}, {2}},
+		},
+		{
+			Name:     "device-profile and service-profile",
+			Filters:  DeviceFilters{DeviceProfileID: &dp2.ID, ServiceProfileID: &sp1.ID},
+			Expected: []lorawan.EUI64{{2}},
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.Name, func(t *testing.T) {
+			assert := require.New(t)
+
+			out, err := GetDevEUIsForFilters(ctx, ts.Tx(), tst.Filters)
+			assert.NoError(err)
+			assert.Equal(tst.Expected, out)
+		})
+	}
+}
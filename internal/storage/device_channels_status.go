@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+)
+
+// DeviceChannelsState defines the state of the channel reconfiguration of a
+// device.
+type DeviceChannelsState string
+
+// Available channel reconfiguration states.
+const (
+	// The channels have been updated, but the reconfiguration has not yet
+	// been sent to the device.
+	DeviceChannelsPending DeviceChannelsState = "PENDING"
+
+	// The NewChannelReq and / or LinkADRReq mac-commands have been sent to
+	// the device and (not all) answers have been received.
+	DeviceChannelsInProgress DeviceChannelsState = "IN_PROGRESS"
+
+	// The device session reflects the configured channels.
+	DeviceChannelsApplied DeviceChannelsState = "APPLIED"
+
+	// The device rejected one of the NewChannelReq or LinkADRReq
+	// mac-commands.
+	DeviceChannelsRejected DeviceChannelsState = "REJECTED"
+)
+
+// NewChannelAnsStatus contains the status bits of the last received
+// NewChannelAns.
+type NewChannelAnsStatus struct {
+	ChannelIndex       int
+	ChannelFrequencyOK bool
+	DataRateRangeOK    bool
+}
+
+// LinkADRAnsStatus contains the status bits of the last received LinkADRAns.
+type LinkADRAnsStatus struct {
+	ChannelMaskACK bool
+	DataRateACK    bool
+	PowerACK       bool
+}
+
+// DeviceChannelsStatus contains the channel reconfiguration status of a
+// device.
+type DeviceChannelsStatus struct {
+	State         DeviceChannelsState
+	UpdatedAt     time.Time
+	NewChannelAns *NewChannelAnsStatus
+	LinkADRAns    *LinkADRAnsStatus
+}
+
+// SetPending resets the status to pending. This must be called after the
+// channels of the device have been updated.
+func (s *DeviceChannelsStatus) SetPending() {
+	*s = DeviceChannelsStatus{
+		State:     DeviceChannelsPending,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// SetInProgress marks a pending reconfiguration as in-progress.
+func (s *DeviceChannelsStatus) SetInProgress() {
+	if s.State != DeviceChannelsPending {
+		return
+	}
+
+	s.State = DeviceChannelsInProgress
+	s.UpdatedAt = time.Now()
+}
+
+// SetNewChannelAns sets the NewChannelAns status bits. In case the device
+// did not acknowledge the channel, the state is set to rejected.
+func (s *DeviceChannelsStatus) SetNewChannelAns(chIndex int, channelFrequencyOK, dataRateRangeOK bool) {
+	s.NewChannelAns = &NewChannelAnsStatus{
+		ChannelIndex:       chIndex,
+		ChannelFrequencyOK: channelFrequencyOK,
+		DataRateRangeOK:    dataRateRangeOK,
+	}
+	s.setAnsState(channelFrequencyOK && dataRateRangeOK)
+}
+
+// SetLinkADRAns sets the LinkADRAns status bits. In case the device did
+// not acknowledge the channel-mask, the state is set to rejected.
+func (s *DeviceChannelsStatus) SetLinkADRAns(channelMaskACK, dataRateACK, powerACK bool) {
+	s.LinkADRAns = &LinkADRAnsStatus{
+		ChannelMaskACK: channelMaskACK,
+		DataRateACK:    dataRateACK,
+		PowerACK:       powerACK,
+	}
+	s.setAnsState(channelMaskACK)
+}
+
+// setAnsState updates the state using the received answer. A rejected
+// reconfiguration stays rejected until the channels are updated again
+// (SetPending), as a later acknowledgement (e.g. of a retransmission) does
+// not mean that the rejected part has been applied.
+func (s *DeviceChannelsStatus) setAnsState(ack bool) {
+	if s.State == DeviceChannelsRejected {
+		return
+	}
+
+	if ack {
+		s.State = DeviceChannelsInProgress
+	} else {
+		s.State = DeviceChannelsRejected
+	}
+	s.UpdatedAt = time.Now()
+}
+
+// IsTracked returns true when the reconfiguration has not yet been applied.
+func (s DeviceChannelsStatus) IsTracked() bool {
+	return s.State == DeviceChannelsPending || s.State == DeviceChannelsInProgress || s.State == DeviceChannelsRejected
+}
+
+// IsAppliedTo returns true when the enabled channels and per-device extra
+// channels match the channels of the given device-session.
+func (c DeviceExtraConfigurations) IsAppliedTo(ds DeviceSession) bool {
+	if len(c.EnabledChannels) != len(ds.EnabledUplinkChannels) {
+		return false
+	}
+
+	enabled := make(map[int]struct{})
+	for _, i := range ds.EnabledUplinkChannels {
+		enabled[i] = struct{}{}
+	}
+	for _, i := range c.EnabledChannels {
+		if _, ok := enabled[int(i)]; !ok {
+			return false
+		}
+	}
+
+	for _, ec := range c.ExtraChannels {
+		ch, ok := ds.ExtraUplinkChannels[ec.ChannelIndex]
+		if !ok || ch.Frequency != ec.Frequency || ch.MinDR != ec.MinDR || ch.MaxDR != ec.MaxDR {
+			return false
+		}
+	}
+
+	return true
+}
+
+// UpdateDeviceChannelsStatus updates the channel reconfiguration status of
+// the given device. The cached configuration must be removed after the
+// transaction (if any) has been committed.
+func UpdateDeviceChannelsStatus(ctx context.Context, db sqlx.Execer, devEUI lorawan.EUI64, s DeviceChannelsStatus) error {
+	var newChannelAnsChIndex sql.NullInt64
+	var newChannelAnsFreqOK, newChannelAnsDROK sql.NullBool
+	if s.NewChannelAns != nil {
+		newChannelAnsChIndex = sql.NullInt64{Int64: int64(s.NewChannelAns.ChannelIndex), Valid: true}
+		newChannelAnsFreqOK = sql.NullBool{Bool: s.NewChannelAns.ChannelFrequencyOK, Valid: true}
+		newChannelAnsDROK = sql.NullBool{Bool: s.NewChannelAns.DataRateRangeOK, Valid: true}
+	}
+
+	var linkADRAnsChMaskACK, linkADRAnsDRACK, linkADRAnsPowerACK sql.NullBool
+	if s.LinkADRAns != nil {
+		linkADRAnsChMaskACK = sql.NullBool{Bool: s.LinkADRAns.ChannelMaskACK, Valid: true}
+		linkADRAnsDRACK = sql.NullBool{Bool: s.LinkADRAns.DataRateACK, Valid: true}
+		linkADRAnsPowerACK = sql.NullBool{Bool: s.LinkADRAns.PowerACK, Valid: true}
+	}
+
+	var updatedAt *time.Time
+	if !s.UpdatedAt.IsZero() {
+		updatedAt = &s.UpdatedAt
+	}
+
+	res, err := db.Exec(`
+		update device_extra_configs set
+			channels_state = $2,
+			channels_state_updated_at = $3,
+			new_channel_ans_channel_index = $4,
+			new_channel_ans_channel_frequency_ok = $5,
+			new_channel_ans_data_rate_range_ok = $6,
+			link_adr_ans_channel_mask_ack = $7,
+			link_adr_ans_data_rate_ack = $8,
+			link_adr_ans_power_ack = $9
+		where
+			dev_eui = $1`,
+		devEUI[:],
+		s.State,
+		updatedAt,
+		newChannelAnsChIndex,
+		newChannelAnsFreqOK,
+		newChannelAnsDROK,
+		linkADRAnsChMaskACK,
+		linkADRAnsDRACK,
+		linkADRAnsPowerACK,
+	)
+	if err != nil {
+		return handlePSQLError(err, "update error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
+		return ErrDoesNotExist
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":        devEUI,
+		"channels_state": s.State,
+		"ctx_id":         ctx.Value(logging.ContextIDKey),
+	}).Info("device channels status updated")
+
+	return nil
+}
@@ -3,9 +3,12 @@ package storage
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/gob"
+	"time"
 
 	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
 	"github.com/go-redis/redis/v8"
 	"github.com/jmoiron/sqlx"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
@@ -16,14 +19,134 @@ import (
 )
 
 type DeviceExtraConfigurations struct {
-	DevEUI          lorawan.EUI64 `db:"dev_eui"`
-	EnabledChannels []int32       `db:"enabled_channels"`
+	DevEUI          lorawan.EUI64        `db:"dev_eui"`
+	EnabledChannels []int32              `db:"enabled_channels"`
+	ExtraChannels   []DeviceExtraChannel `db:"-"`
+	ChannelsStatus  DeviceChannelsStatus `db:"-"`
+
+	// ChannelsOverride is set when the channels have been configured for
+	// this device, in which case the channel-plan of the device-profile or
+	// service-profile is not applied.
+	ChannelsOverride bool `db:"channels_override"`
+}
+
+// DeviceExtraChannel defines an uplink channel which is only configured for
+// a single device (using the NewChannelReq mac-command). The channel index
+// is the index of the channel on the device.
+type DeviceExtraChannel struct {
+	ChannelIndex int    `db:"channel_index"`
+	Frequency    uint32 `db:"frequency"`
+	MinDR        int    `db:"min_dr"`
+	MaxDR        int    `db:"max_dr"`
 }
 
 const (
 	ExtraConfigurationKeyTempl = "lora:ns:ec:%s"
+
+	// maxDeviceChannels defines the max. number of uplink channels a device
+	// implementing a dynamic channel-plan supports.
+	maxDeviceChannels = 16
 )
 
+// GetExtraUplinkChannels returns the per-device extra channels, indexed by
+// channel index.
+func (c DeviceExtraConfigurations) GetExtraUplinkChannels() map[int]loraband.Channel {
+	out := make(map[int]loraband.Channel)
+	for _, ec := range c.ExtraChannels {
+		out[ec.ChannelIndex] = loraband.Channel{
+			Frequency: ec.Frequency,
+			MinDR:     ec.MinDR,
+			MaxDR:     ec.MaxDR,
+		}
+	}
+	return out
+}
+
+// SetChannels validates and sets the enabled channels and the per-device
+// extra channels. The per-device extra channels are assigned the channel
+// indices following the uplink channels of the band and are always enabled.
+// The enabled channels must either refer to an uplink channel of the band
+// or to one of the per-device extra channels.
+func (c *DeviceExtraConfigurations) SetChannels(enabledChannels []int32, extraChannels []loraband.Channel) error {
+	enabled, extra, err := validateChannels(enabledChannels, extraChannels)
+	if err != nil {
+		return err
+	}
+
+	c.EnabledChannels = enabled
+	c.ExtraChannels = extra
+
+	return nil
+}
+
+// validateChannels validates the given enabled and extra channels and
+// returns the de-duplicated enabled channels (including the extra channels)
+// and the extra channels with their channel index.
+func validateChannels(enabledChannels []int32, extraChannels []loraband.Channel) ([]int32, []DeviceExtraChannel, error) {
+	bandChannels := band.Band().GetUplinkChannelIndices()
+
+	if len(extraChannels) != 0 {
+		// Per-device channels can only be added for regions with a dynamic
+		// channel-plan (NewChannelReq). Fixed channel-plan regions (e.g. US915)
+		// define more channels than a dynamic channel-plan device supports.
+		if len(band.Band().GetStandardUplinkChannelIndices()) > maxDeviceChannels {
+			return nil, nil, errors.Wrap(ErrInvalidChannel, "extra channels are not supported by the configured band")
+		}
+
+		if len(bandChannels)+len(extraChannels) > maxDeviceChannels {
+			return nil, nil, errors.Wrapf(ErrInvalidChannel, "max %d extra channels can be configured", maxDeviceChannels-len(bandChannels))
+		}
+	}
+
+	var extra []DeviceExtraChannel
+	for i, ch := range extraChannels {
+		if ch.Frequency == 0 {
+			return nil, nil, errors.Wrap(ErrInvalidChannel, "frequency must be set")
+		}
+		if ch.MinDR > ch.MaxDR {
+			return nil, nil, errors.Wrap(ErrInvalidChannel, "min_dr must be less than or equal to max_dr")
+		}
+		if _, err := band.Band().GetDataRate(ch.MaxDR); err != nil {
+			return nil, nil, errors.Wrapf(ErrInvalidChannel, "invalid max_dr: %s", err)
+		}
+
+		extra = append(extra, DeviceExtraChannel{
+			ChannelIndex: len(bandChannels) + i,
+			Frequency:    ch.Frequency,
+			MinDR:        ch.MinDR,
+			MaxDR:        ch.MaxDR,
+		})
+	}
+
+	validIndices := make(map[int32]struct{})
+	for _, i := range bandChannels {
+		validIndices[int32(i)] = struct{}{}
+	}
+	for _, ec := range extra {
+		validIndices[int32(ec.ChannelIndex)] = struct{}{}
+	}
+
+	enabled := make([]int32, 0, len(enabledChannels)+len(extra))
+	seen := make(map[int32]struct{})
+	for _, i := range enabledChannels {
+		if _, ok := validIndices[i]; !ok {
+			return nil, nil, errors.Wrapf(ErrInvalidChannel, "channel %d does not exist", i)
+		}
+		if _, ok := seen[i]; ok {
+			continue
+		}
+		seen[i] = struct{}{}
+		enabled = append(enabled, i)
+	}
+	for _, ec := range extra {
+		if _, ok := seen[int32(ec.ChannelIndex)]; !ok {
+			enabled = append(enabled, int32(ec.ChannelIndex))
+		}
+	}
+
+	return enabled, extra, nil
+}
+
 // Gets channels that are available for given device - on this channels device will send data.
 func GetAvailableChannels(ctx context.Context, db sqlx.Queryer, devEUI lorawan.EUI64) ([]int32, error) {
 	var res []int32
@@ -65,46 +188,170 @@ func SetAvailableChannels(ctx context.Context, db sqlx.Execer, devEUI lorawan.EU
 		return handlePSQLError(err, "get rows affected error")
 	}
 
-	if ra != 0 {
-		val, err := GetDeviceExtraConfigurationsCache(ctx, devEUI)
+	if ra == 0 {
+		return ErrDoesNotExist
+	}
 
-		//No config in cache, create default, change channels and save to cache
-		if err != nil {
-			extraConf := createDefaultConfig(devEUI)
-			extraConf.EnabledChannels = channels
+	// The cached configuration is re-created on the next read.
+	if err := DeleteDeviceExtraConfigurationsCache(ctx, devEUI); err != nil {
+		return errors.Wrap(err, "delete extra-config cache error")
+	}
 
-			SetDeviceExtraConfigurationsCache(ctx, val)
-		} else {
-			val.EnabledChannels = channels
-			SetDeviceExtraConfigurationsCache(ctx, val)
-		}
+	log.WithFields(log.Fields{
+		"dev_eui":   devEUI,
+		"channels:": channels[:],
+		"ctx_id":    ctx.Value(logging.ContextIDKey),
+	}).Info("device extra config updated - channels set")
 
-		log.WithFields(log.Fields{
-			"dev_eui":   devEUI,
-			"channels:": channels[:],
-			"ctx_id":    ctx.Value(logging.ContextIDKey),
-		}).Info("device extra config updated - channels set")
+	return nil
+}
 
-		return nil
-	} else {
+// UpdateDeviceExtraConfigurations updates the enabled channels and replaces
+// the per-device extra channels of the given configuration. As this will
+// execute multiple SQL statements, it is recommended to perform this within
+// a transaction. The channels status is updated. The cached configuration
+// must be removed after the transaction has been committed.
+func UpdateDeviceExtraConfigurations(ctx context.Context, db sqlx.Execer, c DeviceExtraConfigurations) error {
+	res, err := db.Exec(`
+		update device_extra_configs set
+			enabled_channels = $2,
+			channels_override = $3
+		where
+			dev_eui = $1`,
+		c.DevEUI[:],
+		pq.Array(c.EnabledChannels),
+		c.ChannelsOverride,
+	)
+	if err != nil {
+		return handlePSQLError(err, "update error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
 		return ErrDoesNotExist
 	}
+
+	// As with the gateway-profile extra channels, the channels are re-created
+	// on every update as they are not likely to change often.
+	_, err = db.Exec(`
+		delete from device_extra_config_channel
+		where
+			dev_eui = $1`,
+		c.DevEUI[:],
+	)
+	if err != nil {
+		return handlePSQLError(err, "delete error")
+	}
+
+	for _, ec := range c.ExtraChannels {
+		_, err := db.Exec(`
+			insert into device_extra_config_channel (
+				dev_eui,
+				channel_index,
+				frequency,
+				min_dr,
+				max_dr
+			) values ($1, $2, $3, $4, $5)`,
+			c.DevEUI[:],
+			ec.ChannelIndex,
+			ec.Frequency,
+			ec.MinDR,
+			ec.MaxDR,
+		)
+		if err != nil {
+			return handlePSQLError(err, "insert error")
+		}
+	}
+
+	if err := UpdateDeviceChannelsStatus(ctx, db, c.DevEUI, c.ChannelsStatus); err != nil {
+		return errors.Wrap(err, "update channels status error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":          c.DevEUI,
+		"enabled_channels": c.EnabledChannels,
+		"extra_channels":   len(c.ExtraChannels),
+		"ctx_id":           ctx.Value(logging.ContextIDKey),
+	}).Info("device extra config updated")
+
+	return nil
 }
 
 // Gets Extra config options for devie from Postgress DB
 func GetDeviceExtraConfigurations(ctx context.Context, db sqlx.Queryer, devEUI lorawan.EUI64) (DeviceExtraConfigurations, error) {
 	var c DeviceExtraConfigurations
+	var updatedAt *time.Time
+	var newChannelAnsChIndex sql.NullInt64
+	var newChannelAnsFreqOK, newChannelAnsDROK sql.NullBool
+	var linkADRAnsChMaskACK, linkADRAnsDRACK, linkADRAnsPowerACK sql.NullBool
 
 	err := db.QueryRowx(`
-		select * 
-		from device_extra_configs 
+		select
+			dev_eui,
+			enabled_channels,
+			channels_override,
+			channels_state,
+			channels_state_updated_at,
+			new_channel_ans_channel_index,
+			new_channel_ans_channel_frequency_ok,
+			new_channel_ans_data_rate_range_ok,
+			link_adr_ans_channel_mask_ack,
+			link_adr_ans_data_rate_ack,
+			link_adr_ans_power_ack
+		from device_extra_configs
 		where dev_eui = $1`,
 		devEUI[:],
 	).Scan(
 		&c.DevEUI,
 		pq.Array(&c.EnabledChannels),
+		&c.ChannelsOverride,
+		&c.ChannelsStatus.State,
+		&updatedAt,
+		&newChannelAnsChIndex,
+		&newChannelAnsFreqOK,
+		&newChannelAnsDROK,
+		&linkADRAnsChMaskACK,
+		&linkADRAnsDRACK,
+		&linkADRAnsPowerACK,
 	)
+	if err != nil {
+		return c, handlePSQLError(err, "select error")
+	}
 
+	if updatedAt != nil {
+		c.ChannelsStatus.UpdatedAt = *updatedAt
+	}
+	if newChannelAnsChIndex.Valid {
+		c.ChannelsStatus.NewChannelAns = &NewChannelAnsStatus{
+			ChannelIndex:       int(newChannelAnsChIndex.Int64),
+			ChannelFrequencyOK: newChannelAnsFreqOK.Bool,
+			DataRateRangeOK:    newChannelAnsDROK.Bool,
+		}
+	}
+	if linkADRAnsChMaskACK.Valid {
+		c.ChannelsStatus.LinkADRAns = &LinkADRAnsStatus{
+			ChannelMaskACK: linkADRAnsChMaskACK.Bool,
+			DataRateACK:    linkADRAnsDRACK.Bool,
+			PowerACK:       linkADRAnsPowerACK.Bool,
+		}
+	}
+
+	err = sqlx.Select(db, &c.ExtraChannels, `
+		select
+			channel_index,
+			frequency,
+			min_dr,
+			max_dr
+		from device_extra_config_channel
+		where
+			dev_eui = $1
+		order by
+			channel_index`,
+		devEUI[:],
+	)
 	if err != nil {
 		return c, handlePSQLError(err, "select error")
 	}
@@ -179,6 +426,42 @@ func GetAndCacheDeviceExtraConfigurationsCache(ctx context.Context, db sqlx.Quer
 	return extraConfig, nil
 }
 
+// GetOptionalDeviceExtraConfigurations returns the (cached) extra
+// configurations of the given device, or nil when the device does not have
+// extra configurations. This is the case for devices handed over by their hNS
+// (handover-roaming), as these are not provisioned on this Network Server.
+func GetOptionalDeviceExtraConfigurations(ctx context.Context, db sqlx.Queryer, devEUI lorawan.EUI64) (*DeviceExtraConfigurations, error) {
+	extraConfig, err := GetAndCacheDeviceExtraConfigurationsCache(ctx, db, devEUI)
+	if err != nil {
+		if errors.Cause(err) == ErrDoesNotExist {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &extraConfig, nil
+}
+
+// DeleteDeviceExtraConfigurationsCache removes the extra configurations of
+// the given devices from the Redis cache. When the configurations have been
+// updated within a transaction, this must be called after the transaction
+// has been committed, as else the old configuration could be cached again.
+func DeleteDeviceExtraConfigurationsCache(ctx context.Context, devEUIs ...lorawan.EUI64) error {
+	if len(devEUIs) == 0 {
+		return nil
+	}
+
+	pipe := RedisClient().Pipeline()
+	for _, devEUI := range devEUIs {
+		pipe.Del(ctx, GetRedisKey(ExtraConfigurationKeyTempl, devEUI))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "delete error")
+	}
+
+	return nil
+}
+
 // Function creates default configuration for newly added device
 func CreateDefaultConfigForDeviceAndSaveToDbAndCache(ctx context.Context, db sqlx.Execer, devEUI lorawan.EUI64) error {
 	extraConfig := createDefaultConfig(devEUI)
@@ -196,6 +479,16 @@ func CreateDefaultConfigForDeviceAndSaveToDbAndCache(ctx context.Context, db sql
 		return handlePSQLError(err, "insert error")
 	}
 
+	// In case the device-profile or service-profile has a channel-plan, the
+	// configuration is loaded into the cache on the next read.
+	applied, err := applyChannelPlanForNewDevice(db, devEUI)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
 	SetDeviceExtraConfigurationsCache(ctx, extraConfig)
 
 	return nil
@@ -204,8 +497,16 @@ func CreateDefaultConfigForDeviceAndSaveToDbAndCache(ctx context.Context, db sql
 func createDefaultConfig(devEUI lorawan.EUI64) DeviceExtraConfigurations {
 	var extraConfig DeviceExtraConfigurations
 	extraConfig.DevEUI = devEUI
+	extraConfig.EnabledChannels = defaultEnabledChannels()
+	extraConfig.ChannelsStatus.State = DeviceChannelsApplied
+
+	return extraConfig
+}
 
-	//Adding channels
+// defaultEnabledChannels returns the channels which are enabled by default
+// for a device: all the standard and custom (extra) uplink channels of the
+// configured band.
+func defaultEnabledChannels() []int32 {
 	indices := append(band.Band().GetStandardUplinkChannelIndices(), band.Band().GetCustomUplinkChannelIndices()...)
 
 	channels := make([]int32, len(indices))
@@ -213,7 +514,5 @@ func createDefaultConfig(devEUI lorawan.EUI64) DeviceExtraConfigurations {
 		channels[i] = int32(val)
 	}
 
-	extraConfig.EnabledChannels = channels
-
-	return extraConfig
+	return channels
 }
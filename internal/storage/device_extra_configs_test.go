@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+	loraband "github.com/brocaar/lorawan/band"
+	codemig "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage/migrations/code"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+func (ts *StorageTestSuite) TestDeviceExtraConfigurations() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	sp := ServiceProfile{}
+	dp := DeviceProfile{}
+	rp := RoutingProfile{}
+
+	assert.NoError(CreateServiceProfile(ctx, ts.Tx(), &sp))
+	assert.NoError(CreateDeviceProfile(ctx, ts.Tx(), &dp))
+	assert.NoError(CreateRoutingProfile(ctx, ts.Tx(), &rp))
+
+	d := Device{
+		DevEUI:           lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+		ServiceProfileID: sp.ID,
+		DeviceProfileID:  dp.ID,
+		RoutingProfileID: rp.ID,
+	}
+	assert.NoError(CreateDevice(ctx, ts.Tx(), &d))
+
+	ts.T().Run("Default configuration is created", func(t *testing.T) {
+		assert := require.New(t)
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal(d.DevEUI, ec.DevEUI)
+		assert.Equal(defaultEnabledChannels(), ec.EnabledChannels)
+
+		ec, err = GetDeviceExtraConfigurationsCache(ctx, d.DevEUI)
+		assert.NoError(err)
+		assert.Equal(defaultEnabledChannels(), ec.EnabledChannels)
+	})
+
+	ts.T().Run("Get optional", func(t *testing.T) {
+		assert := require.New(t)
+
+		ec, err := GetOptionalDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.NotNil(ec)
+		assert.Equal(d.DevEUI, ec.DevEUI)
+
+		ec, err = GetOptionalDeviceExtraConfigurations(ctx, ts.Tx(), lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1})
+		assert.NoError(err)
+		assert.Nil(ec)
+	})
+
+	ts.T().Run("Set channels", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(SetAvailableChannels(ctx, ts.Tx(), d.DevEUI, []int32{0, 1}))
+
+		channels, err := GetAvailableChannels(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal([]int32{0, 1}, channels)
+	})
+
+	ts.T().Run("Update with extra channels", func(t *testing.T) {
+		assert := require.New(t)
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.NoError(ec.SetChannels([]int32{0, 1, 2}, []loraband.Channel{
+			{Frequency: 867100000, MinDR: 0, MaxDR: 5},
+		}))
+		assert.NoError(UpdateDeviceExtraConfigurations(ctx, ts.Tx(), ec))
+
+		ecGet, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal(ec, ecGet)
+
+		_, err = GetDeviceExtraConfigurationsCache(ctx, d.DevEUI)
+		assert.Equal(ErrDoesNotExist, err)
+	})
+
+	ts.T().Run("Update channels status", func(t *testing.T) {
+		assert := require.New(t)
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal(DeviceChannelsApplied, ec.ChannelsStatus.State)
+
+		ec.ChannelsStatus.SetPending()
+		ec.ChannelsStatus.SetInProgress()
+		ec.ChannelsStatus.SetNewChannelAns(3, true, false)
+		ec.ChannelsStatus.UpdatedAt = ec.ChannelsStatus.UpdatedAt.Round(time.Second).UTC()
+		assert.NoError(UpdateDeviceChannelsStatus(ctx, ts.Tx(), d.DevEUI, ec.ChannelsStatus))
+
+		ecGet, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		ecGet.ChannelsStatus.UpdatedAt = ecGet.ChannelsStatus.UpdatedAt.UTC()
+		assert.Equal(DeviceChannelsStatus{
+			State:     DeviceChannelsRejected,
+			UpdatedAt: ec.ChannelsStatus.UpdatedAt,
+			NewChannelAns: &NewChannelAnsStatus{
+				ChannelIndex:       3,
+				ChannelFrequencyOK: true,
+				DataRateRangeOK:    false,
+			},
+		}, ecGet.ChannelsStatus)
+	})
+
+	ts.T().Run("Backfill", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := ts.Tx().Exec("delete from device_extra_configs where dev_eui = $1", d.DevEUI[:])
+		assert.NoError(err)
+
+		_, err = GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.Equal(ErrDoesNotExist, err)
+
+		assert.NoError(codemig.BackfillDeviceExtraConfigs(ts.Tx(), defaultEnabledChannels()))
+
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.Equal(defaultEnabledChannels(), ec.EnabledChannels)
+	})
+
+	ts.T().Run("Backfill channels override", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(codemig.BackfillChannelsOverride(ts.Tx(), defaultEnabledChannels()))
+		ec, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.False(ec.ChannelsOverride)
+
+		assert.NoError(SetAvailableChannels(ctx, ts.Tx(), d.DevEUI, []int32{0, 1}))
+		assert.NoError(codemig.BackfillChannelsOverride(ts.Tx(), defaultEnabledChannels()))
+		ec, err = GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.NoError(err)
+		assert.True(ec.ChannelsOverride)
+	})
+
+	ts.T().Run("Delete device", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(DeleteDevice(ctx, ts.Tx(), d.DevEUI))
+
+		_, err := GetDeviceExtraConfigurations(ctx, ts.Tx(), d.DevEUI)
+		assert.Equal(ErrDoesNotExist, err)
+
+		_, err = GetDeviceExtraConfigurationsCache(ctx, d.DevEUI)
+		assert.Equal(ErrDoesNotExist, err)
+	})
+}
+
+func TestDeviceExtraConfigurationsSetChannels(t *testing.T) {
+	_ = test.GetConfig()
+
+	tests := []struct {
+		name            string
+		enabledChannels []int32
+		extraChannels   []loraband.Channel
+		expected        DeviceExtraConfigurations
+		expectedErr     error
+	}{
+		{
+			name:            "band channels only",
+			enabledChannels: []int32{0, 1, 1},
+			expected: DeviceExtraConfigurations{
+				EnabledChannels: []int32{0, 1},
+			},
+		},
+		{
+			name:            "per-device extra channels are enabled",
+			enabledChannels: []int32{0, 1, 2},
+			extraChannels: []loraband.Channel{
+				{Frequency: 867100000, MinDR: 0, MaxDR: 5},
+				{Frequency: 867300000, MinDR: 0, MaxDR: 5},
+			},
+			expected: DeviceExtraConfigurations{
+				EnabledChannels: []int32{0, 1, 2, 3, 4},
+				ExtraChannels: []DeviceExtraChannel{
+					{ChannelIndex: 3, Frequency: 867100000, MinDR: 0, MaxDR: 5},
+					{ChannelIndex: 4, Frequency: 867300000, MinDR: 0, MaxDR: 5},
+				},
+			},
+		},
+		{
+			name:            "unknown channel",
+			enabledChannels: []int32{0, 1, 2, 3},
+			expectedErr:     ErrInvalidChannel,
+		},
+		{
+			name: "invalid data-rate range",
+			extraChannels: []loraband.Channel{
+				{Frequency: 867100000, MinDR: 5, MaxDR: 0},
+			},
+			expectedErr: ErrInvalidChannel,
+		},
+		{
+			name: "missing frequency",
+			extraChannels: []loraband.Channel{
+				{MinDR: 0, MaxDR: 5},
+			},
+			expectedErr: ErrInvalidChannel,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			var ec DeviceExtraConfigurations
+			err := ec.SetChannels(tst.enabledChannels, tst.extraChannels)
+			assert.Equal(tst.expectedErr, errors.Cause(err))
+			if err != nil {
+				return
+			}
+
+			assert.Equal(tst.expected, ec)
+		})
+	}
+}
+
+func TestDeviceExtraConfigurationsIsAppliedTo(t *testing.T) {
+	ec := DeviceExtraConfigurations{
+		EnabledChannels: []int32{0, 1, 2, 3},
+		ExtraChannels: []DeviceExtraChannel{
+			{ChannelIndex: 3, Frequency: 867100000, MinDR: 0, MaxDR: 5},
+		},
+	}
+
+	tests := []struct {
+		name          string
+		deviceSession DeviceSession
+		expected      bool
+	}{
+		{
+			name: "applied",
+			deviceSession: DeviceSession{
+				EnabledUplinkChannels: []int{3, 2, 1, 0},
+				ExtraUplinkChannels: map[int]loraband.Channel{
+					3: {Frequency: 867100000, MinDR: 0, MaxDR: 5},
+				},
+			},
+			expected: true,
+		},
+		{
+			name: "channel not enabled",
+			deviceSession: DeviceSession{
+				EnabledUplinkChannels: []int{0, 1, 2},
+			},
+		},
+		{
+			name: "extra channel frequency differs",
+			deviceSession: DeviceSession{
+				EnabledUplinkChannels: []int{0, 1, 2, 3},
+				ExtraUplinkChannels: map[int]loraband.Channel{
+					3: {Frequency: 867300000, MinDR: 0, MaxDR: 5},
+				},
+			},
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			assert.Equal(tst.expected, ec.IsAppliedTo(tst.deviceSession))
+		})
+	}
+}
+
+func TestDeviceChannelsStatusRejected(t *testing.T) {
+	assert := require.New(t)
+
+	var s DeviceChannelsStatus
+	s.SetPending()
+	s.SetInProgress()
+
+	s.SetNewChannelAns(3, true, false)
+	assert.Equal(DeviceChannelsRejected, s.State)
+
+	// a later acknowledgement does not reset the rejected state
+	s.SetLinkADRAns(true, true, true)
+	assert.Equal(DeviceChannelsRejected, s.State)
+
+	// until the channels are updated again
+	s.SetPending()
+	s.SetInProgress()
+	s.SetLinkADRAns(true, true, true)
+	assert.Equal(DeviceChannelsInProgress, s.State)
+}
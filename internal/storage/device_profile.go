@@ -45,6 +45,10 @@ type DeviceProfile struct {
 	RFRegion           string    `db:"rf_region"`
 	Supports32bitFCnt  bool      `db:"supports_32bit_fcnt"`
 	ADRAlgorithmID     string    `db:"adr_algorithm_id"`
+
+	// ChannelPlanID defines the (optional) channel-plan for the devices
+	// using this device-profile.
+	ChannelPlanID *uuid.UUID `db:"channel_plan_id"`
 }
 
 // CreateDeviceProfile creates the given device-profile.
@@ -87,8 +91,9 @@ func CreateDeviceProfile(ctx context.Context, db sqlx.Execer, dp *DeviceProfile)
             supports_join,
             rf_region,
             supports_32bit_fcnt,
-			adr_algorithm_id
-        ) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
+			adr_algorithm_id,
+			channel_plan_id
+        ) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)`,
 		dp.CreatedAt,
 		dp.UpdatedAt,
 		dp.ID,
@@ -112,6 +117,7 @@ func CreateDeviceProfile(ctx context.Context, db sqlx.Execer, dp *DeviceProfile)
 		dp.RFRegion,
 		dp.Supports32bitFCnt,
 		dp.ADRAlgorithmID,
+		dp.ChannelPlanID,
 	)
 	if err != nil {
 		return handlePSQLError(err, "insert error")
@@ -236,7 +242,8 @@ func GetDeviceProfile(ctx context.Context, db sqlx.Queryer, id uuid.UUID) (Devic
             supports_join,
             rf_region,
             supports_32bit_fcnt,
-			adr_algorithm_id
+			adr_algorithm_id,
+			channel_plan_id
         from device_profile
         where
             device_profile_id = $1
@@ -268,6 +275,7 @@ func GetDeviceProfile(ctx context.Context, db sqlx.Queryer, id uuid.UUID) (Devic
 		&dp.RFRegion,
 		&dp.Supports32bitFCnt,
 		&dp.ADRAlgorithmID,
+		&dp.ChannelPlanID,
 	)
 	if err != nil {
 		return dp, handlePSQLError(err, "select error")
@@ -307,7 +315,8 @@ func UpdateDeviceProfile(ctx context.Context, db sqlx.Execer, dp *DeviceProfile)
             supports_join = $19,
             rf_region = $20,
             supports_32bit_fcnt = $21,
-			adr_algorithm_id = $22
+			adr_algorithm_id = $22,
+			channel_plan_id = $23
         where
             device_profile_id = $1`,
 		dp.ID,
@@ -332,6 +341,7 @@ func UpdateDeviceProfile(ctx context.Context, db sqlx.Execer, dp *DeviceProfile)
 		dp.RFRegion,
 		dp.Supports32bitFCnt,
 		dp.ADRAlgorithmID,
+		dp.ChannelPlanID,
 	)
 	if err != nil {
 		return handlePSQLError(err, "update error")
@@ -5,6 +5,7 @@ package storage
 import (
 	"context"
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"strings"
 	"time"
@@ -225,6 +226,21 @@ func (s DeviceSession) GetPacketLossPercentage() float64 {
 	return float64(lostPackets) / float64(len(s.UplinkHistory)) * 100
 }
 
+// GetGatewayDiversity returns the average number of gateways receiving an
+// uplink over the records stored in UplinkHistory.
+func (s DeviceSession) GetGatewayDiversity() float64 {
+	if len(s.UplinkHistory) == 0 {
+		return 0
+	}
+
+	var gwCount int
+	for _, uh := range s.UplinkHistory {
+		gwCount += uh.GatewayCount
+	}
+
+	return float64(gwCount) / float64(len(s.UplinkHistory))
+}
+
 // GetMACVersion returns the LoRaWAN mac version.
 func (s DeviceSession) GetMACVersion() lorawan.MACVersion {
 	if strings.HasPrefix(s.MACVersion, "1.1") {
@@ -296,6 +312,25 @@ func GetRandomDevAddr(netID lorawan.NetID) (lorawan.DevAddr, error) {
 	return d, nil
 }
 
+// DevAddrPrefix defines a DevAddr prefix, e.g. 01020000/16.
+type DevAddrPrefix struct {
+	DevAddr lorawan.DevAddr
+	Length  int
+}
+
+// Matches returns true when the given DevAddr starts with the prefix.
+func (p DevAddrPrefix) Matches(devAddr lorawan.DevAddr) bool {
+	if p.Length <= 0 {
+		return true
+	}
+	if p.Length > 32 {
+		return false
+	}
+
+	mask := ^uint32(0) << uint(32-p.Length)
+	return binary.BigEndian.Uint32(devAddr[:])&mask == binary.BigEndian.Uint32(p.DevAddr[:])&mask
+}
+
 // GetFullFCntUp returns the full 32bit frame-counter, given the fCntUp which
 // has been truncated to the last 16 LSB.
 // Notes:
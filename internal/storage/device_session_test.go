@@ -357,6 +357,27 @@ func TestGetFullFCntUp(t *testing.T) {
 	}
 }
 
+func TestDevAddrPrefixMatches(t *testing.T) {
+	assert := require.New(t)
+
+	tests := []struct {
+		Prefix  DevAddrPrefix
+		DevAddr lorawan.DevAddr
+		Matches bool
+	}{
+		{DevAddrPrefix{lorawan.DevAddr{1, 2, 0, 0}, 16}, lorawan.DevAddr{1, 2, 3, 4}, true},
+		{DevAddrPrefix{lorawan.DevAddr{1, 2, 0, 0}, 16}, lorawan.DevAddr{1, 3, 3, 4}, false},
+		{DevAddrPrefix{lorawan.DevAddr{0xfe, 0, 0, 0}, 7}, lorawan.DevAddr{0xff, 1, 2, 3}, true},
+		{DevAddrPrefix{lorawan.DevAddr{0xfe, 0, 0, 0}, 8}, lorawan.DevAddr{0xff, 1, 2, 3}, false},
+		{DevAddrPrefix{lorawan.DevAddr{1, 2, 3, 4}, 32}, lorawan.DevAddr{1, 2, 3, 4}, true},
+		{DevAddrPrefix{}, lorawan.DevAddr{1, 2, 3, 4}, true},
+	}
+
+	for i, test := range tests {
+		assert.Equalf(test.Matches, test.Prefix.Matches(test.DevAddr), "Test %d", i)
+	}
+}
+
 func TestGetDeviceSessionsForDevAddr(t *testing.T) {
 	assert := require.New(t)
 	conf := test.GetConfig()
@@ -3,7 +3,9 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/gob"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -11,11 +13,13 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/brocaar/lorawan"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 )
 
 const downlinkFrameTTL = time.Second * 10
 const downlinkFrameKeyTempl = "lora:ns:frame:%d"
+const downlinkFallbackKeyTempl = "lora:ns:frame:%d:fallback"
 
 // SaveDownlinkFrame saves the given downlink-frame.
 func SaveDownlinkFrame(ctx context.Context, frame *DownlinkFrame) error {
@@ -59,3 +63,54 @@ func GetDownlinkFrame(ctx context.Context, token uint16) (*DownlinkFrame, error)
 
 	return &df, nil
 }
+
+// DownlinkFallback holds the state needed to re-plan a downlink on an other
+// gateway, in case all items of the downlink-frame were rejected by the
+// gateway.
+type DownlinkFallback struct {
+	// UplinkReceivedAt holds the time the uplink was received. The Class-A
+	// receive windows are relative to this timestamp. It is zero for
+	// Class-B and Class-C downlinks.
+	UplinkReceivedAt time.Time
+
+	// TriedGatewayIDs contains the gateways that were used for the downlink.
+	TriedGatewayIDs []lorawan.EUI64
+}
+
+// SaveDownlinkFallback saves the fallback state for the downlink-frame
+// matching the given token.
+func SaveDownlinkFallback(ctx context.Context, token uint16, fb DownlinkFallback) error {
+	key := GetRedisKey(downlinkFallbackKeyTempl, token)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(fb); err != nil {
+		return errors.Wrap(err, "gob encode downlink fallback error")
+	}
+
+	if err := RedisClient().Set(ctx, key, buf.Bytes(), downlinkFrameTTL).Err(); err != nil {
+		return errors.Wrap(err, "save downlink fallback error")
+	}
+
+	return nil
+}
+
+// GetDownlinkFallback returns the fallback state for the downlink-frame
+// matching the given token.
+func GetDownlinkFallback(ctx context.Context, token uint16) (DownlinkFallback, error) {
+	var fb DownlinkFallback
+	key := GetRedisKey(downlinkFallbackKeyTempl, token)
+
+	val, err := RedisClient().Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return fb, ErrDoesNotExist
+		}
+		return fb, errors.Wrap(err, "get downlink fallback error")
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&fb); err != nil {
+		return fb, errors.Wrap(err, "gob decode error")
+	}
+
+	return fb, nil
+}
@@ -3,9 +3,12 @@ package storage
 import (
 	"context"
 	"testing"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
 )
 
 func (ts *StorageTestSuite) TestDownlinkFrame() {
@@ -35,3 +38,31 @@ func (ts *StorageTestSuite) TestDownlinkFrame() {
 		})
 	})
 }
+
+func (ts *StorageTestSuite) TestDownlinkFallback() {
+	fb := DownlinkFallback{
+		UplinkReceivedAt: time.Now(),
+		TriedGatewayIDs:  []lorawan.EUI64{{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+
+	ts.T().Run("Does not exist", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := GetDownlinkFallback(context.Background(), 1234)
+		assert.Equal(ErrDoesNotExist, err)
+	})
+
+	ts.T().Run("Save", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(SaveDownlinkFallback(context.Background(), 1234, fb))
+
+		t.Run("Get", func(t *testing.T) {
+			assert := require.New(t)
+
+			fbGet, err := GetDownlinkFallback(context.Background(), 1234)
+			assert.NoError(err)
+			assert.True(fb.UplinkReceivedAt.Equal(fbGet.UplinkReceivedAt))
+			assert.Equal(fb.TriedGatewayIDs, fbGet.TriedGatewayIDs)
+		})
+	})
+}
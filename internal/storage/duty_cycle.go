@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+const (
+	// Contains the time-on-air (in µs) per minute for a gateway and sub-band.
+	// The gateway ID is used as hash tag so that all keys of a gateway are on
+	// the same shard when using Redis Cluster.
+	gatewayDutyCycleKeyTempl = "lora:ns:gw:{%s}:dc:%s"
+)
+
+// GatewayAirtime holds the time-on-air of a gateway within a single minute.
+type GatewayAirtime struct {
+	Time    time.Time
+	Airtime time.Duration
+}
+
+// AddGatewayAirtime adds the given time-on-air to the duty-cycle ledger of
+// the given gateway and sub-band. The ledger expires after the given window.
+func AddGatewayAirtime(ctx context.Context, gatewayID lorawan.EUI64, subBand string, ts time.Time, airtime, window time.Duration) error {
+	key := GetRedisKey(gatewayDutyCycleKeyTempl, gatewayID, subBand)
+	field := strconv.FormatInt(ts.Truncate(time.Minute).Unix(), 10)
+
+	pipe := RedisClient().TxPipeline()
+	pipe.HIncrBy(ctx, key, field, airtime.Microseconds())
+	pipe.PExpire(ctx, key, window+time.Minute)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "redis exec error")
+	}
+
+	return nil
+}
+
+// GetGatewayAirtime returns the time-on-air per minute of the given gateway
+// and sub-band, within the given window. The items are sorted by time
+// (oldest first).
+func GetGatewayAirtime(ctx context.Context, gatewayID lorawan.EUI64, subBand string, window time.Duration) ([]GatewayAirtime, error) {
+	key := GetRedisKey(gatewayDutyCycleKeyTempl, gatewayID, subBand)
+	vals, err := RedisClient().HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "hgetall error")
+	}
+
+	start := time.Now().Add(-window).Truncate(time.Minute)
+
+	var out []GatewayAirtime
+	var expired []string
+	for k, v := range vals {
+		sec, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse timestamp error")
+		}
+		us, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse airtime error")
+		}
+
+		ts := time.Unix(sec, 0)
+		if ts.Before(start) {
+			expired = append(expired, k)
+			continue
+		}
+
+		out = append(out, GatewayAirtime{
+			Time:    ts,
+			Airtime: time.Duration(us) * time.Microsecond,
+		})
+	}
+
+	if len(expired) != 0 {
+		if err := RedisClient().HDel(ctx, key, expired...).Err(); err != nil {
+			return nil, errors.Wrap(err, "hdel error")
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Time.Before(out[j].Time)
+	})
+
+	return out, nil
+}
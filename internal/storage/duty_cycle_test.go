@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func (ts *StorageTestSuite) TestGatewayAirtime() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	now := time.Now()
+
+	assert.NoError(AddGatewayAirtime(ctx, gatewayID, "g1", now.Add(-2*time.Hour), time.Second, 3*time.Hour))
+	assert.NoError(AddGatewayAirtime(ctx, gatewayID, "g1", now.Add(-10*time.Minute), 100*time.Millisecond, time.Hour))
+	assert.NoError(AddGatewayAirtime(ctx, gatewayID, "g1", now, 200*time.Millisecond, time.Hour))
+	assert.NoError(AddGatewayAirtime(ctx, gatewayID, "g1", now, 50*time.Millisecond, time.Hour))
+	assert.NoError(AddGatewayAirtime(ctx, gatewayID, "g3", now, time.Second, time.Hour))
+
+	out, err := GetGatewayAirtime(ctx, gatewayID, "g1", time.Hour)
+	assert.NoError(err)
+	assert.Equal([]GatewayAirtime{
+		{Time: now.Add(-10 * time.Minute).Truncate(time.Minute), Airtime: 100 * time.Millisecond},
+		{Time: now.Truncate(time.Minute), Airtime: 250 * time.Millisecond},
+	}, out)
+
+	// the expired record has been removed from the ledger
+	vals, err := RedisClient().HGetAll(ctx, GetRedisKey(gatewayDutyCycleKeyTempl, gatewayID, "g1")).Result()
+	assert.NoError(err)
+	assert.Len(vals, 2)
+}
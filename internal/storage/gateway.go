@@ -436,6 +436,14 @@ func DeleteGateway(ctx context.Context, db sqlx.Execer, id lorawan.EUI64) error
 		return errors.Wrap(err, "flush gateway cache error")
 	}
 
+	if err := DeleteGatewayPresence(ctx, id); err != nil {
+		return errors.Wrap(err, "delete gateway presence error")
+	}
+
+	if err := DeleteGatewayConfigState(ctx, id); err != nil {
+		return errors.Wrap(err, "delete gateway config state error")
+	}
+
 	log.WithFields(log.Fields{
 		"gateway_id": id,
 		"ctx_id":     ctx.Value(logging.ContextIDKey),
@@ -468,6 +476,39 @@ func GetGatewaysForIDs(ctx context.Context, db sqlx.Queryer, ids []lorawan.EUI64
 	return out, nil
 }
 
+// GetGatewayCount returns the total number of gateways.
+func GetGatewayCount(ctx context.Context, db sqlx.Queryer) (int, error) {
+	var count int
+	err := sqlx.Get(db, &count, "select count(*) from gateway")
+	if err != nil {
+		return 0, handlePSQLError(err, "select error")
+	}
+
+	return count, nil
+}
+
+// GetGateways returns a slice of gateways, ordered by gateway ID.
+func GetGateways(ctx context.Context, db sqlx.Queryer, limit, offset int) ([]Gateway, error) {
+	var gws []Gateway
+	err := sqlx.Select(db, &gws, `
+		select
+			*
+		from
+			gateway
+		order by
+			gateway_id
+		limit $1
+		offset $2`,
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "select error")
+	}
+
+	return gws, nil
+}
+
 // GetGatewayMeta returns the GatewayMeta object for the given gateway ID.
 func GetGatewayMeta(ctx context.Context, db sqlx.Queryer, id lorawan.EUI64) (GatewayMeta, error) {
 	var gw GatewayMeta
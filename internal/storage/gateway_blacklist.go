@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+)
+
+const (
+	gatewayAckErrorsKeyTempl = "lora:ns:gw:%s:ack_errors" // contains the number of tx ack errors within the error window
+	gatewayBlacklistKeyTempl = "lora:ns:gw:%s:blacklist"  // set when the gateway is blacklisted for downlinks
+)
+
+// IncrGatewayAckErrorCount increments the tx ack error counter of the given
+// gateway and returns the new value. The counter expires after the given
+// window, counted from the first error.
+func IncrGatewayAckErrorCount(ctx context.Context, gatewayID lorawan.EUI64, window time.Duration) (int64, error) {
+	key := GetRedisKey(gatewayAckErrorsKeyTempl, gatewayID)
+
+	n, err := RedisClient().Incr(ctx, key).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "incr error")
+	}
+
+	if n == 1 {
+		if err := RedisClient().PExpire(ctx, key, window).Err(); err != nil {
+			return 0, errors.Wrap(err, "pexpire error")
+		}
+	}
+
+	return n, nil
+}
+
+// BlacklistGateway blacklists the given gateway for downlinks for the given
+// duration. This also resets the tx ack error counter.
+func BlacklistGateway(ctx context.Context, gatewayID lorawan.EUI64, duration time.Duration) error {
+	pipe := RedisClient().TxPipeline()
+	pipe.Set(ctx, GetRedisKey(gatewayBlacklistKeyTempl, gatewayID), "blacklisted", duration)
+	pipe.Del(ctx, GetRedisKey(gatewayAckErrorsKeyTempl, gatewayID))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	log.WithFields(log.Fields{
+		"gateway_id": gatewayID,
+		"duration":   duration,
+		"ctx_id":     ctx.Value(logging.ContextIDKey),
+	}).Warning("storage: gateway blacklisted for downlinks")
+
+	return nil
+}
+
+// GetBlacklistedGateways returns the gateways from the given slice which
+// are currently blacklisted.
+func GetBlacklistedGateways(ctx context.Context, ids []lorawan.EUI64) (map[lorawan.EUI64]struct{}, error) {
+	out := make(map[lorawan.EUI64]struct{})
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	cmds := make([]*redis.IntCmd, len(ids))
+	pipe := RedisClient().Pipeline()
+	for i, id := range ids {
+		cmds[i] = pipe.Exists(ctx, GetRedisKey(gatewayBlacklistKeyTempl, id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	for i, id := range ids {
+		if cmds[i].Val() == 1 {
+			out[id] = struct{}{}
+		}
+	}
+
+	return out, nil
+}
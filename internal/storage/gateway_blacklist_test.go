@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func (ts *StorageTestSuite) TestGatewayBlacklist() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	otherID := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	for i := 1; i <= 3; i++ {
+		n, err := IncrGatewayAckErrorCount(ctx, gatewayID, time.Minute)
+		assert.NoError(err)
+		assert.EqualValues(i, n)
+	}
+
+	bl, err := GetBlacklistedGateways(ctx, []lorawan.EUI64{gatewayID, otherID})
+	assert.NoError(err)
+	assert.Len(bl, 0)
+
+	assert.NoError(BlacklistGateway(ctx, gatewayID, time.Minute))
+
+	bl, err = GetBlacklistedGateways(ctx, []lorawan.EUI64{gatewayID, otherID})
+	assert.NoError(err)
+	assert.Equal(map[lorawan.EUI64]struct{}{gatewayID: {}}, bl)
+
+	// blacklisting resets the error counter
+	n, err := IncrGatewayAckErrorCount(ctx, gatewayID, time.Minute)
+	assert.NoError(err)
+	assert.EqualValues(1, n)
+}
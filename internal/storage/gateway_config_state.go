@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+// GatewayConfigStatus defines the status of the gateway configuration push.
+type GatewayConfigStatus string
+
+// Available gateway configuration statuses.
+const (
+	GatewayConfigStatusUnknown      GatewayConfigStatus = "UNKNOWN"
+	GatewayConfigStatusNotSupported GatewayConfigStatus = "NOT_SUPPORTED"
+	GatewayConfigStatusPending      GatewayConfigStatus = "PENDING"
+	GatewayConfigStatusApplied      GatewayConfigStatus = "APPLIED"
+	GatewayConfigStatusFailed       GatewayConfigStatus = "FAILED"
+)
+
+const gatewayConfigStateKeyTempl = "lora:ns:gw:%s:config_state"
+
+// GatewayConfigState contains the configuration push state of a gateway.
+type GatewayConfigState struct {
+	Status GatewayConfigStatus
+
+	// DesiredVersion holds the configuration version of the gateway-profile.
+	DesiredVersion string
+
+	// AppliedVersion holds the configuration version reported by the gateway.
+	AppliedVersion string
+
+	// Attempts holds the number of times the desired configuration was sent.
+	Attempts int
+
+	// LastSentAt holds the time the configuration was last sent.
+	LastSentAt time.Time
+}
+
+// SaveGatewayConfigState saves the configuration push state of the given
+// gateway.
+func SaveGatewayConfigState(ctx context.Context, gatewayID lorawan.EUI64, s GatewayConfigState) error {
+	key := GetRedisKey(gatewayConfigStateKeyTempl, gatewayID)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return errors.Wrap(err, "gob encode gateway config state error")
+	}
+
+	if err := RedisClient().Set(ctx, key, buf.Bytes(), deviceSessionTTL).Err(); err != nil {
+		return errors.Wrap(err, "save gateway config state error")
+	}
+
+	return nil
+}
+
+// GetGatewayConfigState returns the configuration push state of the given
+// gateway. When no state exists, the UNKNOWN status is returned.
+func GetGatewayConfigState(ctx context.Context, gatewayID lorawan.EUI64) (GatewayConfigState, error) {
+	s := GatewayConfigState{
+		Status: GatewayConfigStatusUnknown,
+	}
+	key := GetRedisKey(gatewayConfigStateKeyTempl, gatewayID)
+
+	val, err := RedisClient().Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return s, nil
+		}
+		return s, errors.Wrap(err, "get gateway config state error")
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&s); err != nil {
+		return s, errors.Wrap(err, "gob decode error")
+	}
+
+	return s, nil
+}
+
+// DeleteGatewayConfigState deletes the configuration push state of the given
+// gateway.
+func DeleteGatewayConfigState(ctx context.Context, gatewayID lorawan.EUI64) error {
+	if err := RedisClient().Del(ctx, GetRedisKey(gatewayConfigStateKeyTempl, gatewayID)).Err(); err != nil {
+		return errors.Wrap(err, "delete gateway config state error")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func (ts *StorageTestSuite) TestGatewayConfigState() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	s, err := GetGatewayConfigState(ctx, gatewayID)
+	assert.NoError(err)
+	assert.Equal(GatewayConfigState{Status: GatewayConfigStatusUnknown}, s)
+
+	s = GatewayConfigState{
+		Status:         GatewayConfigStatusPending,
+		DesiredVersion: "2",
+		AppliedVersion: "1",
+		Attempts:       1,
+		LastSentAt:     time.Now().Round(time.Second).UTC(),
+	}
+	assert.NoError(SaveGatewayConfigState(ctx, gatewayID, s))
+
+	sGet, err := GetGatewayConfigState(ctx, gatewayID)
+	assert.NoError(err)
+	assert.Equal(s, sGet)
+
+	assert.NoError(DeleteGatewayConfigState(ctx, gatewayID))
+	sGet, err = GetGatewayConfigState(ctx, gatewayID)
+	assert.NoError(err)
+	assert.Equal(GatewayConfigStatusUnknown, sGet.Status)
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+// GatewayState defines the online / offline state of a gateway.
+type GatewayState string
+
+// Available gateway states.
+const (
+	GatewayStateUnknown GatewayState = "UNKNOWN"
+	GatewayStateOnline  GatewayState = "ONLINE"
+	GatewayStateOffline GatewayState = "OFFLINE"
+)
+
+const (
+	gatewayPresenceOnlineKey = "lora:ns:gw:presence:online" // sorted-set of online gateways, scored by the offline deadline (ms)
+	gatewayLastSeenKeyTempl  = "lora:ns:gw:%s:last_seen"    // contains the last-seen timestamp (ms) of a gateway
+)
+
+// GatewayPresence contains the presence state of a gateway.
+type GatewayPresence struct {
+	GatewayID  lorawan.EUI64
+	State      GatewayState
+	LastSeenAt *time.Time
+}
+
+// SetGatewayLastSeen stores the last-seen timestamp of the given gateway and
+// marks the gateway as online until ts + offlineAfter. It returns true when
+// the gateway was not marked as online before (e.g. it came back online).
+func SetGatewayLastSeen(ctx context.Context, gatewayID lorawan.EUI64, ts time.Time, offlineAfter time.Duration) (bool, error) {
+	lastSeenKey := GetRedisKey(gatewayLastSeenKeyTempl, gatewayID)
+	onlineKey := GetRedisKey(gatewayPresenceOnlineKey)
+
+	pipe := RedisClient().TxPipeline()
+	pipe.Set(ctx, lastSeenKey, toMillis(ts), deviceSessionTTL)
+	zadd := pipe.ZAdd(ctx, onlineKey, &redis.Z{
+		Score:  float64(toMillis(ts.Add(offlineAfter))),
+		Member: gatewayID.String(),
+	})
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, errors.Wrap(err, "exec error")
+	}
+
+	return zadd.Val() == 1, nil
+}
+
+// popOfflineGatewaysScript returns and removes the members of the online
+// sorted-set of which the offline deadline has passed. As this is atomic,
+// a gateway that is seen again between getting and removing the members
+// is not removed.
+var popOfflineGatewaysScript = redis.NewScript(`
+local members = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+if #members > 0 then
+	redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+end
+return members
+`)
+
+// PopOfflineGateways removes and returns the gateways of which the offline
+// deadline has passed. A gateway is only returned once, also when called by
+// multiple instances at the same time.
+func PopOfflineGateways(ctx context.Context, now time.Time) ([]lorawan.EUI64, error) {
+	onlineKey := GetRedisKey(gatewayPresenceOnlineKey)
+
+	res, err := popOfflineGatewaysScript.Run(ctx, RedisClient(), []string{onlineKey}, strconv.FormatInt(toMillis(now), 10)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "run pop offline gateways script error")
+	}
+
+	members, ok := res.([]interface{})
+	if !ok {
+		return nil, errors.New("unexpected pop offline gateways script result")
+	}
+
+	var out []lorawan.EUI64
+	for _, m := range members {
+		id, _ := m.(string)
+
+		var gatewayID lorawan.EUI64
+		if err := gatewayID.UnmarshalText([]byte(id)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal gateway id error")
+		}
+		out = append(out, gatewayID)
+	}
+
+	return out, nil
+}
+
+// GetGatewayPresence returns the presence state of the given gateway.
+func GetGatewayPresence(ctx context.Context, gatewayID lorawan.EUI64) (GatewayPresence, error) {
+	items, err := GetGatewaysPresence(ctx, []lorawan.EUI64{gatewayID})
+	if err != nil {
+		return GatewayPresence{}, err
+	}
+	return items[gatewayID], nil
+}
+
+// GetGatewaysPresence returns the presence state of the given gateways.
+// Gateways which have never been seen are returned with the unknown state.
+func GetGatewaysPresence(ctx context.Context, ids []lorawan.EUI64) (map[lorawan.EUI64]GatewayPresence, error) {
+	out := make(map[lorawan.EUI64]GatewayPresence, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+
+	onlineKey := GetRedisKey(gatewayPresenceOnlineKey)
+	lastSeenCmds := make([]*redis.StringCmd, len(ids))
+	scoreCmds := make([]*redis.FloatCmd, len(ids))
+
+	pipe := RedisClient().Pipeline()
+	for i, id := range ids {
+		lastSeenCmds[i] = pipe.Get(ctx, GetRedisKey(gatewayLastSeenKeyTempl, id))
+		scoreCmds[i] = pipe.ZScore(ctx, onlineKey, id.String())
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	now := toMillis(time.Now())
+
+	for i, id := range ids {
+		p := GatewayPresence{
+			GatewayID: id,
+			State:     GatewayStateUnknown,
+		}
+
+		lastSeen, err := lastSeenCmds[i].Int64()
+		if err != nil {
+			if err != redis.Nil {
+				return nil, errors.Wrap(err, "get last-seen error")
+			}
+			out[id] = p
+			continue
+		}
+		ts := time.Unix(0, lastSeen*int64(time.Millisecond))
+		p.LastSeenAt = &ts
+
+		score, err := scoreCmds[i].Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrap(err, "get score error")
+		}
+
+		// the deadline might have passed without the offline check having
+		// run yet
+		if err == nil && int64(score) > now {
+			p.State = GatewayStateOnline
+		} else {
+			p.State = GatewayStateOffline
+		}
+
+		out[id] = p
+	}
+
+	return out, nil
+}
+
+// DeleteGatewayPresence removes the presence state of the given gateway.
+func DeleteGatewayPresence(ctx context.Context, gatewayID lorawan.EUI64) error {
+	pipe := RedisClient().TxPipeline()
+	pipe.Del(ctx, GetRedisKey(gatewayLastSeenKeyTempl, gatewayID))
+	pipe.ZRem(ctx, GetRedisKey(gatewayPresenceOnlineKey), gatewayID.String())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+	return nil
+}
+
+func toMillis(ts time.Time) int64 {
+	return ts.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func (ts *StorageTestSuite) TestGatewayPresence() {
+	ctx := context.Background()
+	gatewayID := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	otherID := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	ts.T().Run("Unknown", func(t *testing.T) {
+		assert := require.New(t)
+
+		p, err := GetGatewayPresence(ctx, gatewayID)
+		assert.NoError(err)
+		assert.Equal(GatewayStateUnknown, p.State)
+		assert.Nil(p.LastSeenAt)
+	})
+
+	now := time.Now()
+
+	ts.T().Run("Online", func(t *testing.T) {
+		assert := require.New(t)
+
+		cameOnline, err := SetGatewayLastSeen(ctx, gatewayID, now, time.Minute)
+		assert.NoError(err)
+		assert.True(cameOnline)
+
+		cameOnline, err = SetGatewayLastSeen(ctx, gatewayID, now, time.Minute)
+		assert.NoError(err)
+		assert.False(cameOnline)
+
+		items, err := GetGatewaysPresence(ctx, []lorawan.EUI64{gatewayID, otherID})
+		assert.NoError(err)
+		assert.Equal(GatewayStateOnline, items[gatewayID].State)
+		assert.NotNil(items[gatewayID].LastSeenAt)
+		assert.Equal(now.Truncate(time.Millisecond).UnixNano(), items[gatewayID].LastSeenAt.UnixNano())
+		assert.Equal(GatewayStateUnknown, items[otherID].State)
+	})
+
+	ts.T().Run("Offline", func(t *testing.T) {
+		assert := require.New(t)
+
+		ids, err := PopOfflineGateways(ctx, now)
+		assert.NoError(err)
+		assert.Len(ids, 0)
+
+		_, err = SetGatewayLastSeen(ctx, otherID, now, 2*time.Minute)
+		assert.NoError(err)
+
+		ids, err = PopOfflineGateways(ctx, now.Add(time.Minute))
+		assert.NoError(err)
+		assert.Equal([]lorawan.EUI64{gatewayID}, ids)
+
+		// the deadline of the other gateway has not passed yet
+		p, err := GetGatewayPresence(ctx, otherID)
+		assert.NoError(err)
+		assert.Equal(GatewayStateOnline, p.State)
+		assert.NoError(DeleteGatewayPresence(ctx, otherID))
+
+		// only returned once
+		ids, err = PopOfflineGateways(ctx, now.Add(time.Minute))
+		assert.NoError(err)
+		assert.Len(ids, 0)
+
+		p, err = GetGatewayPresence(ctx, gatewayID)
+		assert.NoError(err)
+		assert.Equal(GatewayStateOffline, p.State)
+	})
+
+	ts.T().Run("Delete", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(DeleteGatewayPresence(ctx, gatewayID))
+
+		p, err := GetGatewayPresence(ctx, gatewayID)
+		assert.NoError(err)
+		assert.Equal(GatewayStateUnknown, p.State)
+	})
+
+}
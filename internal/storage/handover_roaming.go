@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+)
+
+const (
+	hrDeviceSessionKeyTempl    = "lora:ns:hr:deveui:%s"
+	hrHNSDeviceSessionKeyTempl = "lora:ns:hr:hns:deveui:%s"
+	hrProfileDevEUIsKeyTempl   = "lora:ns:hr:profile:%s:deveui"
+)
+
+// HandoverRoamingDeviceSession defines the handover-roaming session of a
+// device for which this Network Server (sNS) has taken over the MAC-layer
+// control from the hNS. The MAC-layer state itself is stored in the
+// (regular) DeviceSession.
+type HandoverRoamingDeviceSession struct {
+	DevEUI lorawan.EUI64
+	NetID  lorawan.NetID
+
+	// DeviceProfileID and ServiceProfileID hold the IDs of the profiles
+	// that were created for the handed-over device. As these profiles can
+	// be shared by multiple devices, the DevEUIs referencing each profile
+	// are tracked (see GetHandoverRoamingProfileDevEUICount).
+	DeviceProfileID  uuid.UUID
+	ServiceProfileID uuid.UUID
+
+	// Lifetime of the session. When zero, the session does not expire and
+	// must be stopped by the hNS.
+	Lifetime time.Time
+}
+
+// IsExpired returns true when the lifetime of the session has expired.
+func (s HandoverRoamingDeviceSession) IsExpired() bool {
+	return !s.Lifetime.IsZero() && s.Lifetime.Before(time.Now())
+}
+
+// SaveHandoverRoamingDeviceSession saves the handover-roaming device-session.
+// The TTL is the same as that of the device-sessions.
+func SaveHandoverRoamingDeviceSession(ctx context.Context, s HandoverRoamingDeviceSession) error {
+	key := GetRedisKey(hrDeviceSessionKeyTempl, s.DevEUI)
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return errors.Wrap(err, "gob encode handover-roaming device-session error")
+	}
+
+	if err := RedisClient().Set(ctx, key, buf.Bytes(), deviceSessionTTL).Err(); err != nil {
+		return errors.Wrap(err, "set error")
+	}
+
+	// Note that this must be executed separately in order to support Redis
+	// Cluster, as it can not be guaranteed that the profile keys are on the
+	// same shard.
+	for _, id := range []uuid.UUID{s.DeviceProfileID, s.ServiceProfileID} {
+		if id == uuid.Nil {
+			continue
+		}
+
+		profileKey := GetRedisKey(hrProfileDevEUIsKeyTempl, id)
+		pipe := RedisClient().TxPipeline()
+		pipe.SAdd(ctx, profileKey, s.DevEUI[:])
+		pipe.PExpire(ctx, profileKey, deviceSessionTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return errors.Wrap(err, "add deveui to profile set error")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":  s.DevEUI,
+		"net_id":   s.NetID,
+		"lifetime": s.Lifetime,
+		"ctx_id":   ctx.Value(logging.ContextIDKey),
+	}).Debug("storage: handover-roaming device-session saved")
+
+	return nil
+}
+
+// GetHandoverRoamingDeviceSession returns the handover-roaming device-session
+// for the given DevEUI.
+func GetHandoverRoamingDeviceSession(ctx context.Context, devEUI lorawan.EUI64) (HandoverRoamingDeviceSession, error) {
+	var s HandoverRoamingDeviceSession
+	key := GetRedisKey(hrDeviceSessionKeyTempl, devEUI)
+
+	val, err := RedisClient().Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return s, ErrDoesNotExist
+		}
+		return s, errors.Wrap(err, "get error")
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&s); err != nil {
+		return s, errors.Wrap(err, "gob decode error")
+	}
+
+	return s, nil
+}
+
+// DeleteHandoverRoamingDeviceSession deletes the handover-roaming
+// device-session and the device-session for the given DevEUI. The DevEUI is
+// removed from the DevEUIs referencing the profiles of the session.
+func DeleteHandoverRoamingDeviceSession(ctx context.Context, devEUI lorawan.EUI64) error {
+	hr, err := GetHandoverRoamingDeviceSession(ctx, devEUI)
+	if err != nil {
+		return err
+	}
+
+	ds, err := GetDeviceSession(ctx, devEUI)
+	if err != nil && errors.Cause(err) != ErrDoesNotExist {
+		return errors.Wrap(err, "get device-session error")
+	}
+	dsExists := err == nil
+
+	pipe := RedisClient().TxPipeline()
+	hrDel := pipe.Del(ctx, GetRedisKey(hrDeviceSessionKeyTempl, devEUI))
+	pipe.Del(ctx, GetRedisKey(deviceSessionKeyTempl, devEUI))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+	if hrDel.Val() == 0 {
+		return ErrDoesNotExist
+	}
+
+	// Note that this must be executed separately in order to support Redis
+	// Cluster, as it can not be guaranteed that the DevAddr key is on the
+	// same shard.
+	if dsExists {
+		if err := RedisClient().SRem(ctx, GetRedisKey(devAddrKeyTempl, ds.DevAddr), devEUI[:]).Err(); err != nil {
+			return errors.Wrap(err, "remove deveui from devaddr set error")
+		}
+	}
+
+	for _, id := range []uuid.UUID{hr.DeviceProfileID, hr.ServiceProfileID} {
+		if id == uuid.Nil {
+			continue
+		}
+
+		if err := RedisClient().SRem(ctx, GetRedisKey(hrProfileDevEUIsKeyTempl, id), devEUI[:]).Err(); err != nil {
+			return errors.Wrap(err, "remove deveui from profile set error")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("storage: handover-roaming device-session deleted")
+
+	return nil
+}
+
+// GetHandoverRoamingProfileDevEUICount returns the number of DevEUIs of which
+// the handover-roaming device-session references the given (device or
+// service) profile ID.
+func GetHandoverRoamingProfileDevEUICount(ctx context.Context, id uuid.UUID) (int, error) {
+	count, err := RedisClient().SCard(ctx, GetRedisKey(hrProfileDevEUIsKeyTempl, id)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "scard error")
+	}
+
+	return int(count), nil
+}
+
+// HandoverRoamingHNSDeviceSession defines the handover-roaming session of a
+// device for which this Network Server (hNS) has handed over the MAC-layer
+// control to the sNS identified by NetID.
+type HandoverRoamingHNSDeviceSession struct {
+	DevEUI  lorawan.EUI64
+	JoinEUI lorawan.EUI64
+	DevAddr lorawan.DevAddr
+	NetID   lorawan.NetID
+
+	// AppSKeyEnvelope holds the AppSKey as returned by the join-server. It
+	// is forwarded to the application-server together with the first
+	// uplink, after which it is removed.
+	AppSKeyEnvelope *KeyEnvelope
+
+	// Lifetime of the session. When zero, the session does not expire.
+	Lifetime time.Time
+}
+
+// IsExpired returns true when the lifetime of the session has expired.
+func (s HandoverRoamingHNSDeviceSession) IsExpired() bool {
+	return !s.Lifetime.IsZero() && s.Lifetime.Before(time.Now())
+}
+
+// SaveHandoverRoamingHNSDeviceSession saves the handover-roaming
+// device-session (as hNS). The session expires at its lifetime, or after
+// the device-session TTL when it does not have a lifetime.
+func SaveHandoverRoamingHNSDeviceSession(ctx context.Context, s HandoverRoamingHNSDeviceSession) error {
+	key := GetRedisKey(hrHNSDeviceSessionKeyTempl, s.DevEUI)
+
+	ttl := deviceSessionTTL
+	if !s.Lifetime.IsZero() {
+		ttl = time.Until(s.Lifetime)
+		if ttl <= 0 {
+			return errors.New("lifetime must be in the future")
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return errors.Wrap(err, "gob encode handover-roaming hns device-session error")
+	}
+
+	if err := RedisClient().Set(ctx, key, buf.Bytes(), ttl).Err(); err != nil {
+		return errors.Wrap(err, "set error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":  s.DevEUI,
+		"dev_addr": s.DevAddr,
+		"net_id":   s.NetID,
+		"lifetime": s.Lifetime,
+		"ctx_id":   ctx.Value(logging.ContextIDKey),
+	}).Debug("storage: handover-roaming hns device-session saved")
+
+	return nil
+}
+
+// GetHandoverRoamingHNSDeviceSession returns the handover-roaming
+// device-session (as hNS) for the given DevEUI.
+func GetHandoverRoamingHNSDeviceSession(ctx context.Context, devEUI lorawan.EUI64) (HandoverRoamingHNSDeviceSession, error) {
+	var s HandoverRoamingHNSDeviceSession
+	key := GetRedisKey(hrHNSDeviceSessionKeyTempl, devEUI)
+
+	val, err := RedisClient().Get(ctx, key).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return s, ErrDoesNotExist
+		}
+		return s, errors.Wrap(err, "get error")
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&s); err != nil {
+		return s, errors.Wrap(err, "gob decode error")
+	}
+
+	return s, nil
+}
+
+// DeleteHandoverRoamingHNSDeviceSession deletes the handover-roaming
+// device-session (as hNS) for the given DevEUI.
+func DeleteHandoverRoamingHNSDeviceSession(ctx context.Context, devEUI lorawan.EUI64) error {
+	val, err := RedisClient().Del(ctx, GetRedisKey(hrHNSDeviceSessionKeyTempl, devEUI)).Result()
+	if err != nil {
+		return errors.Wrap(err, "delete error")
+	}
+	if val == 0 {
+		return ErrDoesNotExist
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui": devEUI,
+		"ctx_id":  ctx.Value(logging.ContextIDKey),
+	}).Info("storage: handover-roaming hns device-session deleted")
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func (ts *StorageTestSuite) TestHandoverRoaming() {
+	ts.T().Run("Get does not exist", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := GetHandoverRoamingDeviceSession(context.Background(), lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+		assert.Equal(ErrDoesNotExist, err)
+	})
+
+	ts.T().Run("Save", func(t *testing.T) {
+		assert := require.New(t)
+
+		hr := HandoverRoamingDeviceSession{
+			DevEUI:           lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			NetID:            lorawan.NetID{1, 2, 3},
+			DeviceProfileID:  uuid.Must(uuid.NewV4()),
+			ServiceProfileID: uuid.Must(uuid.NewV4()),
+			Lifetime:         time.Now().Add(time.Minute).UTC(),
+		}
+		assert.NoError(SaveHandoverRoamingDeviceSession(context.Background(), hr))
+		assert.NoError(SaveDeviceSession(context.Background(), DeviceSession{
+			DevEUI:  hr.DevEUI,
+			DevAddr: lorawan.DevAddr{1, 2, 3, 4},
+		}))
+
+		t.Run("Get", func(t *testing.T) {
+			assert := require.New(t)
+
+			hrGet, err := GetHandoverRoamingDeviceSession(context.Background(), hr.DevEUI)
+			assert.NoError(err)
+			assert.Equal(hr, hrGet)
+			assert.False(hrGet.IsExpired())
+		})
+
+		t.Run("GetHandoverRoamingProfileDevEUICount", func(t *testing.T) {
+			assert := require.New(t)
+
+			count, err := GetHandoverRoamingProfileDevEUICount(context.Background(), hr.DeviceProfileID)
+			assert.NoError(err)
+			assert.Equal(1, count)
+
+			count, err = GetHandoverRoamingProfileDevEUICount(context.Background(), hr.ServiceProfileID)
+			assert.NoError(err)
+			assert.Equal(1, count)
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(DeleteHandoverRoamingDeviceSession(context.Background(), hr.DevEUI))
+			assert.Equal(ErrDoesNotExist, DeleteHandoverRoamingDeviceSession(context.Background(), hr.DevEUI))
+
+			_, err := GetHandoverRoamingDeviceSession(context.Background(), hr.DevEUI)
+			assert.Equal(ErrDoesNotExist, err)
+
+			_, err = GetDeviceSession(context.Background(), hr.DevEUI)
+			assert.Equal(ErrDoesNotExist, err)
+
+			devEUIs, err := GetDevEUIsForDevAddr(context.Background(), lorawan.DevAddr{1, 2, 3, 4})
+			assert.NoError(err)
+			assert.Len(devEUIs, 0)
+
+			count, err := GetHandoverRoamingProfileDevEUICount(context.Background(), hr.DeviceProfileID)
+			assert.NoError(err)
+			assert.Equal(0, count)
+		})
+	})
+
+	ts.T().Run("IsExpired", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.False(HandoverRoamingDeviceSession{}.IsExpired())
+		assert.True(HandoverRoamingDeviceSession{Lifetime: time.Now().Add(-time.Second)}.IsExpired())
+	})
+}
+
+func (ts *StorageTestSuite) TestHandoverRoamingHNS() {
+	ts.T().Run("Get does not exist", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := GetHandoverRoamingHNSDeviceSession(context.Background(), lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8})
+		assert.Equal(ErrDoesNotExist, err)
+	})
+
+	ts.T().Run("Save", func(t *testing.T) {
+		assert := require.New(t)
+
+		hr := HandoverRoamingHNSDeviceSession{
+			DevEUI:  lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			JoinEUI: lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+			DevAddr: lorawan.DevAddr{1, 2, 3, 4},
+			NetID:   lorawan.NetID{1, 2, 3},
+			AppSKeyEnvelope: &KeyEnvelope{
+				KEKLabel: "kek",
+				AESKey:   []byte{1, 2, 3, 4},
+			},
+			Lifetime: time.Now().Add(time.Minute).UTC(),
+		}
+		assert.NoError(SaveHandoverRoamingHNSDeviceSession(context.Background(), hr))
+
+		t.Run("Get", func(t *testing.T) {
+			assert := require.New(t)
+
+			hrGet, err := GetHandoverRoamingHNSDeviceSession(context.Background(), hr.DevEUI)
+			assert.NoError(err)
+			assert.Equal(hr, hrGet)
+		})
+
+		t.Run("Delete", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(DeleteHandoverRoamingHNSDeviceSession(context.Background(), hr.DevEUI))
+			assert.Equal(ErrDoesNotExist, DeleteHandoverRoamingHNSDeviceSession(context.Background(), hr.DevEUI))
+
+			_, err := GetHandoverRoamingHNSDeviceSession(context.Background(), hr.DevEUI)
+			assert.Equal(ErrDoesNotExist, err)
+		})
+	})
+
+	ts.T().Run("Save expired", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.Error(SaveHandoverRoamingHNSDeviceSession(context.Background(), HandoverRoamingHNSDeviceSession{
+			DevEUI:   lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+			Lifetime: time.Now().Add(-time.Second),
+		}))
+	})
+}
@@ -8,6 +8,8 @@ import (
 
 	"github.com/go-redis/redis/v8"
 	"github.com/pkg/errors"
+
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
 )
 
 // AggregationInterval defines the aggregation type.
@@ -28,8 +30,25 @@ const (
 	metricsKeyTempl = "lora:ns:metrics:{%s}:%s:%d"
 )
 
+// Metrics name prefixes of the gateway radio metrics. The prefix is followed
+// by the frequency, data-rate or tx status.
+const (
+	MetricsRXPerFrequencyPrefix = "rx_freq_"
+	MetricsTXPerFrequencyPrefix = "tx_freq_"
+	MetricsRXPerDRPrefix        = "rx_dr_"
+	MetricsTXPerDRPrefix        = "tx_dr_"
+	MetricsTXPerStatusPrefix    = "tx_status_"
+)
+
 var (
-	timeLocation = time.Local
+	timeLocation         = time.Local
+	aggregationIntervals = []AggregationInterval{AggregationMinute, AggregationHour, AggregationDay, AggregationMonth}
+	metricsTTL           = map[AggregationInterval]time.Duration{
+		AggregationMinute: time.Hour * 2,
+		AggregationHour:   time.Hour * 48,
+		AggregationDay:    time.Hour * 24 * 90,
+		AggregationMonth:  time.Hour * 24 * 730,
+	}
 )
 
 // MetricsRecord holds a single metrics record.
@@ -48,6 +67,77 @@ func SetTimeLocation(name string) error {
 	return nil
 }
 
+// setMetricsAggregation sets the aggregation intervals and TTLs used by
+// SaveMetrics.
+func setMetricsAggregation(c config.Config) error {
+	conf := c.Metrics.Redis
+
+	if len(conf.AggregationIntervals) != 0 {
+		aggregationIntervals = nil
+		for _, agg := range conf.AggregationIntervals {
+			switch AggregationInterval(agg) {
+			case AggregationMinute, AggregationHour, AggregationDay, AggregationMonth:
+				aggregationIntervals = append(aggregationIntervals, AggregationInterval(agg))
+			default:
+				return fmt.Errorf("unexepcted aggregation interval: %s", agg)
+			}
+		}
+	}
+
+	for agg, ttl := range map[AggregationInterval]time.Duration{
+		AggregationMinute: conf.MinuteAggregationTTL,
+		AggregationHour:   conf.HourAggregationTTL,
+		AggregationDay:    conf.DayAggregationTTL,
+		AggregationMonth:  conf.MonthAggregationTTL,
+	} {
+		if ttl != 0 {
+			metricsTTL[agg] = ttl
+		}
+	}
+
+	return nil
+}
+
+// SaveMetrics increments the given metrics for each configured aggregation
+// interval.
+func SaveMetrics(ctx context.Context, name string, metrics MetricsRecord) error {
+	if len(metrics.Metrics) == 0 {
+		return nil
+	}
+
+	pipe := RedisClient().TxPipeline()
+	for _, agg := range aggregationIntervals {
+		key := GetRedisKey(metricsKeyTempl, name, agg, truncateMetricsTime(agg, metrics.Time).Unix())
+		for k, v := range metrics.Metrics {
+			pipe.HIncrByFloat(ctx, key, k, v)
+		}
+		pipe.PExpire(ctx, key, metricsTTL[agg])
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "hincrbyfloat error")
+	}
+
+	return nil
+}
+
+// truncateMetricsTime returns the start of the aggregation interval of the
+// given timestamp.
+func truncateMetricsTime(agg AggregationInterval, ts time.Time) time.Time {
+	ts = ts.In(timeLocation)
+
+	switch agg {
+	case AggregationMinute:
+		return time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), 0, 0, timeLocation)
+	case AggregationHour:
+		return time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), 0, 0, 0, timeLocation)
+	case AggregationDay:
+		return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, timeLocation)
+	default:
+		return time.Date(ts.Year(), ts.Month(), 1, 0, 0, 0, 0, timeLocation)
+	}
+}
+
 // GetMetrics returns the metrics for the requested aggregation interval.
 func GetMetrics(ctx context.Context, agg AggregationInterval, name string, start, end time.Time) ([]MetricsRecord, error) {
 	var keys []string
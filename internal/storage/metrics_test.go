@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (ts *StorageTestSuite) TestMetrics() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+	now := time.Now()
+
+	assert.NoError(SaveMetrics(ctx, "test", MetricsRecord{
+		Time: now,
+		Metrics: map[string]float64{
+			"foo": 1,
+			"bar": 2.5,
+		},
+	}))
+	assert.NoError(SaveMetrics(ctx, "test", MetricsRecord{
+		Time: now,
+		Metrics: map[string]float64{
+			"foo": 2,
+		},
+	}))
+
+	for _, agg := range []AggregationInterval{AggregationMinute, AggregationHour, AggregationDay, AggregationMonth} {
+		ts.T().Run(string(agg), func(t *testing.T) {
+			assert := require.New(t)
+
+			metrics, err := GetMetrics(ctx, agg, "test", now, now)
+			assert.NoError(err)
+			assert.Len(metrics, 1)
+			assert.Equal(truncateMetricsTime(agg, now), metrics[0].Time)
+			assert.Equal(map[string]float64{
+				"foo": 3,
+				"bar": 2.5,
+			}, metrics[0].Metrics)
+		})
+	}
+}
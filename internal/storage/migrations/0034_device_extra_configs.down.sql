@@ -0,0 +1,22 @@
+-- Only revert the changes made by the up migration, a table which existed
+-- before is not dropped. Note that the deleted rows (without device) can not
+-- be restored.
+do $$
+begin
+    if to_regclass('device_extra_configs') is null then
+        return;
+    end if;
+
+    if obj_description('device_extra_configs'::regclass, 'pg_class') = 'created by migration 0034' then
+        drop table device_extra_configs;
+        return;
+    end if;
+
+    alter table device_extra_configs
+        drop constraint if exists device_extra_configs_0034_dev_eui_fkey,
+        drop constraint if exists device_extra_configs_0034_pkey;
+
+    if exists (select 1 from pg_attribute where attrelid = 'device_extra_configs'::regclass and attname = 'enabled_channels' and col_description(attrelid, attnum) = 'added by migration 0034') then
+        alter table device_extra_configs drop column enabled_channels;
+    end if;
+end $$;
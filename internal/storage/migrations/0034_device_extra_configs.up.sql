@@ -0,0 +1,50 @@
+-- Installations running a previous version of the network-server might have
+-- created this table manually. In that case, the table is reconciled with the
+-- schema below. The changes made by this migration are marked (using comments
+-- and constraint names), so that the down migration only reverts these.
+do $$
+declare
+    orphans bigint;
+begin
+    if to_regclass('device_extra_configs') is null then
+        create table device_extra_configs (
+            dev_eui bytea primary key references device on delete cascade,
+            enabled_channels integer[] not null default '{}'
+        );
+
+        comment on table device_extra_configs is 'created by migration 0034';
+        return;
+    end if;
+
+    if not exists (select 1 from information_schema.columns where table_name = 'device_extra_configs' and column_name = 'enabled_channels') then
+        alter table device_extra_configs add column enabled_channels integer[];
+        comment on column device_extra_configs.enabled_channels is 'added by migration 0034';
+    end if;
+
+    update device_extra_configs
+    set
+        enabled_channels = '{}'
+    where
+        enabled_channels is null;
+
+    alter table device_extra_configs
+        alter column enabled_channels set default '{}',
+        alter column enabled_channels set not null;
+
+    delete from device_extra_configs ec
+    where
+        not exists (select 1 from device d where d.dev_eui = ec.dev_eui);
+
+    get diagnostics orphans = row_count;
+    if orphans > 0 then
+        raise warning 'deleted % device_extra_configs rows without device', orphans;
+    end if;
+
+    if not exists (select 1 from pg_constraint where conrelid = 'device_extra_configs'::regclass and contype = 'p') then
+        alter table device_extra_configs add constraint device_extra_configs_0034_pkey primary key (dev_eui);
+    end if;
+
+    if not exists (select 1 from pg_constraint where conrelid = 'device_extra_configs'::regclass and contype = 'f') then
+        alter table device_extra_configs add constraint device_extra_configs_0034_dev_eui_fkey foreign key (dev_eui) references device on delete cascade;
+    end if;
+end $$;
@@ -0,0 +1 @@
+drop table device_extra_config_channel;
@@ -0,0 +1,9 @@
+create table device_extra_config_channel (
+    dev_eui bytea not null references device_extra_configs on delete cascade,
+    channel_index smallint not null,
+    frequency bigint not null,
+    min_dr smallint not null,
+    max_dr smallint not null,
+
+    primary key (dev_eui, channel_index)
+);
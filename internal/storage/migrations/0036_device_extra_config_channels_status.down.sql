@@ -0,0 +1,9 @@
+alter table device_extra_configs
+    drop column link_adr_ans_power_ack,
+    drop column link_adr_ans_data_rate_ack,
+    drop column link_adr_ans_channel_mask_ack,
+    drop column new_channel_ans_data_rate_range_ok,
+    drop column new_channel_ans_channel_frequency_ok,
+    drop column new_channel_ans_channel_index,
+    drop column channels_state_updated_at,
+    drop column channels_state;
@@ -0,0 +1,9 @@
+alter table device_extra_configs
+    add column channels_state varchar(20) not null default 'APPLIED',
+    add column channels_state_updated_at timestamp with time zone null,
+    add column new_channel_ans_channel_index smallint null,
+    add column new_channel_ans_channel_frequency_ok boolean null,
+    add column new_channel_ans_data_rate_range_ok boolean null,
+    add column link_adr_ans_channel_mask_ack boolean null,
+    add column link_adr_ans_data_rate_ack boolean null,
+    add column link_adr_ans_power_ack boolean null;
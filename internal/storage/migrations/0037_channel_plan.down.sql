@@ -0,0 +1,14 @@
+alter table device_extra_configs
+    drop column channels_override;
+
+drop index idx_service_profile_channel_plan_id;
+drop index idx_device_profile_channel_plan_id;
+
+alter table service_profile
+    drop column channel_plan_id;
+
+alter table device_profile
+    drop column channel_plan_id;
+
+drop table channel_plan_channel;
+drop table channel_plan;
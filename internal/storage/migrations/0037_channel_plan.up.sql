@@ -0,0 +1,29 @@
+create table channel_plan (
+    channel_plan_id uuid primary key,
+    created_at timestamp with time zone not null,
+    updated_at timestamp with time zone not null,
+    name varchar(100) not null,
+    enabled_channels integer[] not null default '{}'
+);
+
+create table channel_plan_channel (
+    channel_plan_id uuid not null references channel_plan on delete cascade,
+    channel_index smallint not null,
+    frequency bigint not null,
+    min_dr smallint not null,
+    max_dr smallint not null,
+
+    primary key (channel_plan_id, channel_index)
+);
+
+alter table device_profile
+    add column channel_plan_id uuid null references channel_plan on delete set null;
+
+alter table service_profile
+    add column channel_plan_id uuid null references channel_plan on delete set null;
+
+create index idx_device_profile_channel_plan_id on device_profile (channel_plan_id);
+create index idx_service_profile_channel_plan_id on service_profile (channel_plan_id);
+
+alter table device_extra_configs
+    add column channels_override boolean not null default false;
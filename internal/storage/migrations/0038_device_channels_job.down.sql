@@ -0,0 +1,3 @@
+drop table device_channels_job_error;
+drop index idx_device_channels_job_created_at;
+drop table device_channels_job;
@@ -0,0 +1,20 @@
+create table device_channels_job (
+    job_id uuid primary key,
+    created_at timestamp with time zone not null,
+    updated_at timestamp with time zone not null,
+    state varchar(20) not null,
+    device_count integer not null default 0,
+    processed_count integer not null default 0,
+    failed_count integer not null default 0,
+    error text not null default ''
+);
+
+create index idx_device_channels_job_created_at on device_channels_job (created_at);
+
+create table device_channels_job_error (
+    job_id uuid not null references device_channels_job on delete cascade,
+    dev_eui bytea not null,
+    error text not null,
+
+    primary key (job_id, dev_eui)
+);
@@ -0,0 +1 @@
+drop table roaming_agreement;
@@ -0,0 +1,19 @@
+create table roaming_agreement (
+    net_id bytea primary key,
+    created_at timestamp with time zone not null,
+    updated_at timestamp with time zone not null,
+    enabled boolean not null default true,
+    passive_roaming boolean not null default false,
+    passive_roaming_lifetime bigint not null default 0,
+    passive_roaming_kek_label varchar(100) not null default '',
+    handover_roaming boolean not null default false,
+    handover_roaming_lifetime bigint not null default 0,
+    profile_disclosure varchar(20)[] not null default '{}',
+    server varchar(255) not null default '',
+    async boolean not null default false,
+    async_timeout bigint not null default 0,
+    ca_cert text not null default '',
+    tls_cert text not null default '',
+    tls_key text not null default '',
+    authorization_header text not null default ''
+);
@@ -0,0 +1,2 @@
+drop index idx_roaming_cdr_aggregation_time;
+drop table roaming_cdr;
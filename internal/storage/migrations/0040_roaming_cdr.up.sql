@@ -0,0 +1,17 @@
+create table roaming_cdr (
+    net_id bytea not null,
+    role varchar(3) not null,
+    aggregation varchar(5) not null,
+    "time" timestamp with time zone not null,
+    uplink_count bigint not null default 0,
+    uplink_bytes bigint not null default 0,
+    downlink_count bigint not null default 0,
+    downlink_bytes bigint not null default 0,
+    gateway_ids bytea[] not null default '{}',
+    first_seen_at timestamp with time zone not null,
+    last_seen_at timestamp with time zone not null,
+
+    primary key (net_id, role, aggregation, "time")
+);
+
+create index idx_roaming_cdr_aggregation_time on roaming_cdr (aggregation, "time");
@@ -0,0 +1,4 @@
+alter table roaming_agreement
+    drop column inbound_rate_limit,
+    drop column inbound_client_cert_subject,
+    drop column inbound_authorization_header;
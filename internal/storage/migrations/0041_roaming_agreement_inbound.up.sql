@@ -0,0 +1,4 @@
+alter table roaming_agreement
+    add column inbound_authorization_header text not null default '',
+    add column inbound_client_cert_subject text not null default '',
+    add column inbound_rate_limit integer not null default 0;
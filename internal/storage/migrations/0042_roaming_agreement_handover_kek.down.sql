@@ -0,0 +1,2 @@
+alter table roaming_agreement
+    drop column handover_roaming_kek_label;
@@ -0,0 +1,2 @@
+alter table roaming_agreement
+    add column handover_roaming_kek_label varchar(100) not null default '';
@@ -0,0 +1,75 @@
+package code
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/migrations/code"
+)
+
+// BackfillChannelsOverride sets channels_override for every device of which
+// the channels have been configured before the channel-plans were
+// introduced, so that these are not overwritten by the channel-plan of the
+// device-profile or service-profile. A device has configured channels when
+// it has per-device extra channels or when its enabled channels differ from
+// the given default enabled channels. In case the channels_override column
+// does not exist yet (the schema migrations have not been applied), the
+// migration is postponed.
+func BackfillChannelsOverride(db sqlx.Ext, defaultEnabledChannels []int32) error {
+	var exists bool
+	err := sqlx.Get(db, &exists, `
+		select exists (
+			select 1
+			from information_schema.columns
+			where
+				table_name = 'device_extra_configs'
+				and column_name = 'channels_override'
+		)`)
+	if err != nil {
+		return errors.Wrap(err, "check channels_override column error")
+	}
+
+	if !exists {
+		log.Warning("migrations/code: channels_override column does not exist, postponing backfill")
+		return code.ErrPostpone
+	}
+
+	// Devices using a profile with a channel-plan are skipped, as their
+	// enabled channels are set by the channel-plan.
+	res, err := db.Exec(`
+		update device_extra_configs ec
+		set
+			channels_override = true
+		from
+			device d
+		inner join device_profile dp
+			on dp.device_profile_id = d.device_profile_id
+		inner join service_profile sp
+			on sp.service_profile_id = d.service_profile_id
+		where
+			d.dev_eui = ec.dev_eui
+			and not ec.channels_override
+			and dp.channel_plan_id is null
+			and sp.channel_plan_id is null
+			and (
+				exists (select 1 from device_extra_config_channel ecc where ecc.dev_eui = ec.dev_eui)
+				or not (ec.enabled_channels @> $1 and ec.enabled_channels <@ $1)
+			)
+	`, pq.Array(defaultEnabledChannels))
+	if err != nil {
+		return errors.Wrap(err, "update device_extra_configs error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "get rows affected error")
+	}
+
+	log.WithFields(log.Fields{
+		"devices": ra,
+	}).Info("migrations/code: device_extra_configs channels_override backfilled")
+
+	return nil
+}
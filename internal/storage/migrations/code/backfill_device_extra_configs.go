@@ -0,0 +1,56 @@
+package code
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/migrations/code"
+)
+
+// BackfillDeviceExtraConfigs creates the default device_extra_configs row,
+// using the given enabled channels, for every device that does not have one.
+// In case the device_extra_configs table does not exist yet (the schema
+// migrations have not been applied), the migration is postponed.
+func BackfillDeviceExtraConfigs(db sqlx.Ext, enabledChannels []int32) error {
+	var exists bool
+	err := sqlx.Get(db, &exists, `select to_regclass('device_extra_configs') is not null`)
+	if err != nil {
+		return errors.Wrap(err, "check device_extra_configs table error")
+	}
+
+	if !exists {
+		log.Warning("migrations/code: device_extra_configs table does not exist, postponing backfill")
+		return code.ErrPostpone
+	}
+
+	res, err := db.Exec(`
+		insert into device_extra_configs (
+			dev_eui,
+			enabled_channels
+		)
+		select
+			d.dev_eui,
+			$1
+		from
+			device d
+		where
+			not exists (select 1 from device_extra_configs ec where ec.dev_eui = d.dev_eui)
+	`, pq.Array(enabledChannels))
+	if err != nil {
+		return errors.Wrap(err, "insert device_extra_configs error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "get rows affected error")
+	}
+
+	log.WithFields(log.Fields{
+		"devices":          ra,
+		"enabled_channels": enabledChannels,
+	}).Info("migrations/code: device_extra_configs backfilled")
+
+	return nil
+}
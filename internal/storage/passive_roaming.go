@@ -20,8 +20,23 @@ const (
 	prDevAddrKeyTempl       = "lora:ns:pr:devaddr:%s" // pointer from DevAddr to set of session IDs (DevAddr are not guaranteed to be unique)
 	prDevEUIKeyTempl        = "lora:ns:pr:deveui:%s"  // pointer from DevEUI to set of session IDs (PRStartAns DevEUI is optional, so it can't be used as main identifier)
 	prDeviceSessionKeyTempl = "lora:ns:pr:sess:%s"
+	prHNSNetIDsKeyTempl     = "lora:ns:pr:hns:deveui:%s:netids" // set of NetIDs with which a passive-roaming session was started as hNS
 )
 
+// addPassiveRoamingNetIDScript adds the NetID to the set and only extends the
+// expiration of the set, so that a session with a shorter lifetime does not
+// expire the NetIDs of the sessions with a longer lifetime.
+var addPassiveRoamingNetIDScript = redis.NewScript(`
+local key = KEYS[1]
+local ttl = tonumber(ARGV[2])
+
+redis.call("SADD", key, ARGV[1])
+if redis.call("PTTL", key) < ttl then
+	redis.call("PEXPIRE", key, ttl)
+end
+return 1
+`)
+
 // PassiveRoamingDeviceSession defines the passive-roaming session.
 type PassiveRoamingDeviceSession struct {
 	SessionID   uuid.UUID
@@ -206,6 +221,122 @@ func GetPassiveRoamingIDsForDevAddr(ctx context.Context, devAddr lorawan.DevAddr
 	return out, nil
 }
 
+// GetPassiveRoamingDeviceSessionsForDevEUI returns a slice of passive-roaming
+// device-sessions matching the given DevEUI. When no sessions match, an empty
+// slice is returned.
+func GetPassiveRoamingDeviceSessionsForDevEUI(ctx context.Context, devEUI lorawan.EUI64) ([]PassiveRoamingDeviceSession, error) {
+	var items []PassiveRoamingDeviceSession
+
+	ids, err := GetPassiveRoamingIDsForDevEUI(ctx, devEUI)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		ds, err := GetPassiveRoamingDeviceSession(ctx, id)
+		if err != nil {
+			if errors.Cause(err) != ErrDoesNotExist {
+				log.WithError(err).WithFields(log.Fields{
+					"dev_eui": devEUI,
+					"id":      id,
+					"ctx_id":  ctx.Value(logging.ContextIDKey),
+				}).Warning("storage: get passive-roaming device-session error")
+			}
+			continue
+		}
+
+		items = append(items, ds)
+	}
+
+	return items, nil
+}
+
+// GetPassiveRoamingIDsForDevEUI returns the passive-roaming session IDs for
+// the given DevEUI.
+func GetPassiveRoamingIDsForDevEUI(ctx context.Context, devEUI lorawan.EUI64) ([]uuid.UUID, error) {
+	key := GetRedisKey(prDevEUIKeyTempl, devEUI)
+
+	val, err := RedisClient().SMembers(ctx, key).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "get passive-roaming session ids for deveui error")
+	}
+
+	var out []uuid.UUID
+	for i := range val {
+		var id uuid.UUID
+		copy(id[:], []byte(val[i]))
+		out = append(out, id)
+	}
+
+	return out, nil
+}
+
+// DeletePassiveRoamingDeviceSession deletes the given passive-roaming
+// device-session, including the DevAddr and DevEUI pointers.
+func DeletePassiveRoamingDeviceSession(ctx context.Context, ds PassiveRoamingDeviceSession) error {
+	devAddrKey := GetRedisKey(prDevAddrKeyTempl, ds.DevAddr)
+	devEUIKey := GetRedisKey(prDevEUIKeyTempl, ds.DevEUI)
+	sessKey := GetRedisKey(prDeviceSessionKeyTempl, ds.SessionID)
+
+	pipe := RedisClient().TxPipeline()
+	pipe.Del(ctx, sessKey)
+	pipe.SRem(ctx, devAddrKey, ds.SessionID[:])
+	pipe.SRem(ctx, devEUIKey, ds.SessionID[:])
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errors.Wrap(err, "exec error")
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":    ds.DevEUI,
+		"dev_addr":   ds.DevAddr,
+		"session_id": ds.SessionID,
+		"ctx_id":     ctx.Value(logging.ContextIDKey),
+	}).Info("storage: passive-roaming device-session deleted")
+
+	return nil
+}
+
+// AddPassiveRoamingNetIDForDevEUI stores the NetID of the fNS with which a
+// stateful passive-roaming session was started for the given DevEUI (as
+// hNS). This is used to stop these sessions, e.g. on de-activation.
+func AddPassiveRoamingNetIDForDevEUI(ctx context.Context, devEUI lorawan.EUI64, netID lorawan.NetID, lifetime time.Duration) error {
+	key := GetRedisKey(prHNSNetIDsKeyTempl, devEUI)
+
+	if err := addPassiveRoamingNetIDScript.Run(ctx, RedisClient(), []string{key}, netID.String(), lifetime.Milliseconds()).Err(); err != nil {
+		return errors.Wrap(err, "run add passive-roaming netid script error")
+	}
+
+	return nil
+}
+
+// GetAndDeletePassiveRoamingNetIDsForDevEUI returns and deletes the NetIDs
+// of the fNSs with which a stateful passive-roaming session was started for
+// the given DevEUI (as hNS).
+func GetAndDeletePassiveRoamingNetIDsForDevEUI(ctx context.Context, devEUI lorawan.EUI64) ([]lorawan.NetID, error) {
+	key := GetRedisKey(prHNSNetIDsKeyTempl, devEUI)
+
+	pipe := RedisClient().TxPipeline()
+	members := pipe.SMembers(ctx, key)
+	pipe.Del(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "exec error")
+	}
+
+	var out []lorawan.NetID
+	for _, m := range members.Val() {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(m)); err != nil {
+			return nil, errors.Wrap(err, "unmarshal netid error")
+		}
+		out = append(out, netID)
+	}
+
+	return out, nil
+}
+
 // GetPassiveRoamingDeviceSession returns the passive-roaming device-session.
 func GetPassiveRoamingDeviceSession(ctx context.Context, id uuid.UUID) (PassiveRoamingDeviceSession, error) {
 	key := GetRedisKey(prDeviceSessionKeyTempl, id)
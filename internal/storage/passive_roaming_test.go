@@ -316,4 +316,61 @@ func (ts *StorageTestSuite) TestPassiveRoaming() {
 			})
 		}
 	})
+
+	ts.T().Run("Get for DevEUI and delete", func(t *testing.T) {
+		assert := require.New(t)
+
+		ds := PassiveRoamingDeviceSession{
+			NetID:    lorawan.NetID{1, 2, 3},
+			DevAddr:  lorawan.DevAddr{2, 2, 3, 4},
+			DevEUI:   lorawan.EUI64{2, 2, 3, 4, 5, 6, 7, 8},
+			Lifetime: time.Now().Add(time.Minute).UTC(),
+		}
+		assert.NoError(SavePassiveRoamingDeviceSession(context.Background(), &ds))
+
+		sessions, err := GetPassiveRoamingDeviceSessionsForDevEUI(context.Background(), ds.DevEUI)
+		assert.NoError(err)
+		assert.Equal([]PassiveRoamingDeviceSession{ds}, sessions)
+
+		assert.NoError(DeletePassiveRoamingDeviceSession(context.Background(), ds))
+
+		sessions, err = GetPassiveRoamingDeviceSessionsForDevEUI(context.Background(), ds.DevEUI)
+		assert.NoError(err)
+		assert.Len(sessions, 0)
+
+		ids, err := GetPassiveRoamingIDsForDevAddr(context.Background(), ds.DevAddr)
+		assert.NoError(err)
+		assert.Len(ids, 0)
+	})
+
+	ts.T().Run("hNS NetIDs", func(t *testing.T) {
+		assert := require.New(t)
+		devEUI := lorawan.EUI64{3, 2, 3, 4, 5, 6, 7, 8}
+
+		assert.NoError(AddPassiveRoamingNetIDForDevEUI(context.Background(), devEUI, lorawan.NetID{1, 2, 3}, time.Minute))
+		assert.NoError(AddPassiveRoamingNetIDForDevEUI(context.Background(), devEUI, lorawan.NetID{1, 2, 3}, time.Minute))
+
+		netIDs, err := GetAndDeletePassiveRoamingNetIDsForDevEUI(context.Background(), devEUI)
+		assert.NoError(err)
+		assert.Equal([]lorawan.NetID{{1, 2, 3}}, netIDs)
+
+		netIDs, err = GetAndDeletePassiveRoamingNetIDsForDevEUI(context.Background(), devEUI)
+		assert.NoError(err)
+		assert.Len(netIDs, 0)
+
+		t.Run("Shorter lifetime does not shorten the expiration", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(AddPassiveRoamingNetIDForDevEUI(context.Background(), devEUI, lorawan.NetID{1, 2, 3}, time.Hour))
+			assert.NoError(AddPassiveRoamingNetIDForDevEUI(context.Background(), devEUI, lorawan.NetID{3, 2, 1}, time.Minute))
+
+			ttl, err := RedisClient().PTTL(context.Background(), GetRedisKey(prHNSNetIDsKeyTempl, devEUI)).Result()
+			assert.NoError(err)
+			assert.True(ttl > time.Minute)
+
+			netIDs, err := GetAndDeletePassiveRoamingNetIDsForDevEUI(context.Background(), devEUI)
+			assert.NoError(err)
+			assert.Len(netIDs, 2)
+		})
+	})
 }
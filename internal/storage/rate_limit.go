@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lorawan"
+)
+
+// RateLimitDirection defines the direction of the rate-limited traffic.
+type RateLimitDirection string
+
+// Available rate-limit directions.
+const (
+	RateLimitUplink   RateLimitDirection = "up"
+	RateLimitDownlink RateLimitDirection = "down"
+)
+
+const (
+	rateLimitKeyTempl        = "lora:ns:device:%s:ratelimit:%s" // contains the token-bucket state of a DevEUI
+	roamingRateLimitKeyTempl = "lora:ns:roaming:%s:ratelimit"   // contains the token-bucket state of a roaming partner (NetID)
+	jsRateLimitKeyTempl      = "lora:ns:js:%s:ratelimit"        // contains the token-bucket state of a join-server (JoinEUI)
+)
+
+// rateLimitScript implements a token-bucket. The bucket is refilled based on
+// the elapsed time since the last call. It returns 1 when a token is
+// available (the token is only taken when take is 1), or 0 and the number of
+// milliseconds until the next token is available.
+var rateLimitScript = redis.NewScript(`
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local size = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+local take = tonumber(ARGV[5])
+
+local state = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = size
+	ts = now
+end
+
+if now > ts then
+	tokens = math.min(size, tokens + (now - ts) * rate / 1000)
+end
+
+local taken = 0
+local wait = 0
+if tokens >= 1 then
+	if take == 1 then
+		tokens = tokens - 1
+	end
+	taken = 1
+else
+	wait = math.ceil((1 - tokens) * 1000 / rate)
+end
+
+redis.call("HMSET", key, "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", key, ttl)
+
+return {taken, wait}
+`)
+
+// TakeRateLimitToken takes a token from the token-bucket of the given device
+// and direction. The rate is expressed in tokens per hour, the bucket-size
+// defines the max. burst (a bucket-size < 1 is handled as 1). It returns true
+// when a token was taken, else it returns the duration after which the next
+// token will be available.
+func TakeRateLimitToken(ctx context.Context, devEUI lorawan.EUI64, dir RateLimitDirection, ratePerHour, bucketSize int) (bool, time.Duration, error) {
+	if ratePerHour <= 0 {
+		return false, 0, errors.New("rate must be greater than 0")
+	}
+
+	key := GetRedisKey(rateLimitKeyTempl, devEUI, dir)
+	return runRateLimitScript(ctx, key, float64(ratePerHour)/3600, bucketSize, true)
+}
+
+// GetRateLimitTokenWait returns the duration after which a token of the
+// token-bucket of the given device and direction is available, without
+// taking the token. It returns 0 when a token is available. See
+// TakeRateLimitToken for the rate and bucket-size.
+func GetRateLimitTokenWait(ctx context.Context, devEUI lorawan.EUI64, dir RateLimitDirection, ratePerHour, bucketSize int) (time.Duration, error) {
+	if ratePerHour <= 0 {
+		return 0, errors.New("rate must be greater than 0")
+	}
+
+	key := GetRedisKey(rateLimitKeyTempl, devEUI, dir)
+	ok, wait, err := runRateLimitScript(ctx, key, float64(ratePerHour)/3600, bucketSize, false)
+	if err != nil || ok {
+		return 0, err
+	}
+
+	return wait, nil
+}
+
+// TakeRoamingRateLimitToken takes a token from the token-bucket of the given
+// roaming partner. The rate is expressed in tokens per second, the
+// bucket-size defines the max. burst (a bucket-size < 1 is handled as 1).
+// It returns true when a token was taken, else it returns the duration
+// after which the next token will be available.
+func TakeRoamingRateLimitToken(ctx context.Context, netID lorawan.NetID, ratePerSecond, bucketSize int) (bool, time.Duration, error) {
+	if ratePerSecond <= 0 {
+		return false, 0, errors.New("rate must be greater than 0")
+	}
+
+	key := GetRedisKey(roamingRateLimitKeyTempl, netID)
+	return runRateLimitScript(ctx, key, float64(ratePerSecond), bucketSize, true)
+}
+
+// TakeJoinServerRateLimitToken takes a token from the token-bucket of the
+// join-server of the given JoinEUI. See TakeRoamingRateLimitToken.
+func TakeJoinServerRateLimitToken(ctx context.Context, joinEUI lorawan.EUI64, ratePerSecond, bucketSize int) (bool, time.Duration, error) {
+	if ratePerSecond <= 0 {
+		return false, 0, errors.New("rate must be greater than 0")
+	}
+
+	key := GetRedisKey(jsRateLimitKeyTempl, joinEUI)
+	return runRateLimitScript(ctx, key, float64(ratePerSecond), bucketSize, true)
+}
+
+func runRateLimitScript(ctx context.Context, key string, ratePerSecond float64, bucketSize int, take bool) (bool, time.Duration, error) {
+	if bucketSize < 1 {
+		bucketSize = 1
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	// the bucket is full again after this duration, there is no need to keep
+	// the state for longer
+	ttl := time.Duration(float64(bucketSize)/ratePerSecond*float64(time.Second)) + time.Second
+
+	var takeArg int
+	if take {
+		takeArg = 1
+	}
+
+	res, err := rateLimitScript.Run(ctx, RedisClient(), []string{key}, ratePerSecond, bucketSize, now, ttl.Milliseconds(), takeArg).Result()
+	if err != nil {
+		return false, 0, errors.Wrap(err, "run rate-limit script error")
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return false, 0, errors.New("unexpected rate-limit script result")
+	}
+	taken, _ := vals[0].(int64)
+	wait, _ := vals[1].(int64)
+
+	return taken == 1, time.Duration(wait) * time.Millisecond, nil
+}
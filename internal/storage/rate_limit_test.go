@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brocaar/lorawan"
+)
+
+func (ts *StorageTestSuite) TestTakeRateLimitToken() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+	devEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+
+	// 3600 tokens / hour = 1 token / second, burst of 2
+	for i := 0; i < 2; i++ {
+		ok, _, err := TakeRateLimitToken(ctx, devEUI, RateLimitUplink, 3600, 2)
+		assert.NoError(err)
+		assert.True(ok)
+	}
+
+	ok, wait, err := TakeRateLimitToken(ctx, devEUI, RateLimitUplink, 3600, 2)
+	assert.NoError(err)
+	assert.False(ok)
+	assert.True(wait > 0 && wait <= time.Second)
+
+	// the downlink direction uses its own bucket
+	ok, _, err = TakeRateLimitToken(ctx, devEUI, RateLimitDownlink, 3600, 2)
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, _, err = TakeRateLimitToken(ctx, devEUI, RateLimitUplink, 0, 2)
+	assert.Error(err)
+}
+
+func (ts *StorageTestSuite) TestGetRateLimitTokenWait() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+	devEUI := lorawan.EUI64{2, 2, 3, 4, 5, 6, 7, 8}
+
+	// checking does not take the token
+	for i := 0; i < 3; i++ {
+		wait, err := GetRateLimitTokenWait(ctx, devEUI, RateLimitDownlink, 3600, 1)
+		assert.NoError(err)
+		assert.Equal(time.Duration(0), wait)
+	}
+
+	ok, _, err := TakeRateLimitToken(ctx, devEUI, RateLimitDownlink, 3600, 1)
+	assert.NoError(err)
+	assert.True(ok)
+
+	wait, err := GetRateLimitTokenWait(ctx, devEUI, RateLimitDownlink, 3600, 1)
+	assert.NoError(err)
+	assert.True(wait > 0 && wait <= time.Second)
+
+	_, err = GetRateLimitTokenWait(ctx, devEUI, RateLimitDownlink, 0, 1)
+	assert.Error(err)
+}
+
+func (ts *StorageTestSuite) TestTakeRoamingRateLimitToken() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+	netID := lorawan.NetID{1, 2, 3}
+
+	// 1 token / second, burst of 2
+	for i := 0; i < 2; i++ {
+		ok, _, err := TakeRoamingRateLimitToken(ctx, netID, 1, 2)
+		assert.NoError(err)
+		assert.True(ok)
+	}
+
+	ok, wait, err := TakeRoamingRateLimitToken(ctx, netID, 1, 2)
+	assert.NoError(err)
+	assert.False(ok)
+	assert.True(wait > 0 && wait <= time.Second)
+
+	// each roaming partner uses its own bucket
+	ok, _, err = TakeRoamingRateLimitToken(ctx, lorawan.NetID{3, 2, 1}, 1, 2)
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, _, err = TakeRoamingRateLimitToken(ctx, netID, 0, 2)
+	assert.Error(err)
+}
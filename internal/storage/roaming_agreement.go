@@ -0,0 +1,333 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+)
+
+const (
+	roamingAgreementsVersionKey = "lora:ns:roaming:agreements:version"
+)
+
+const roamingAgreementSelectQuery = `
+	select
+		net_id,
+		created_at,
+		updated_at,
+		enabled,
+		passive_roaming,
+		passive_roaming_lifetime,
+		passive_roaming_kek_label,
+		handover_roaming,
+		handover_roaming_lifetime,
+		handover_roaming_kek_label,
+		profile_disclosure,
+		server,
+		async,
+		async_timeout,
+		ca_cert,
+		tls_cert,
+		tls_key,
+		authorization_header,
+		inbound_authorization_header,
+		inbound_client_cert_subject,
+		inbound_rate_limit
+	from roaming_agreement`
+
+// RoamingAgreement defines a roaming agreement with the roaming partner
+// identified by its NetID.
+type RoamingAgreement struct {
+	NetID                   lorawan.NetID
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+	Enabled                 bool
+	PassiveRoaming          bool
+	PassiveRoamingLifetime  time.Duration
+	PassiveRoamingKEKLabel  string
+	HandoverRoaming         bool
+	HandoverRoamingLifetime time.Duration
+	HandoverRoamingKEKLabel string
+	ProfileDisclosure       []string
+	Server                  string
+	Async                   bool
+	AsyncTimeout            time.Duration
+	CACert                  string
+	TLSCert                 string
+	TLSKey                  string
+	Authorization           string
+
+	// Inbound credentials and rate limit of the roaming partner, used to
+	// authenticate the requests made by the partner to the roaming API.
+	InboundAuthorization     string
+	InboundClientCertSubject string
+	InboundRateLimit         int
+}
+
+// CreateRoamingAgreement creates the given roaming agreement.
+func CreateRoamingAgreement(ctx context.Context, db sqlx.Execer, a *RoamingAgreement) error {
+	now := time.Now()
+	a.CreatedAt = now
+	a.UpdatedAt = now
+
+	_, err := db.Exec(`
+		insert into roaming_agreement (
+			net_id,
+			created_at,
+			updated_at,
+			enabled,
+			passive_roaming,
+			passive_roaming_lifetime,
+			passive_roaming_kek_label,
+			handover_roaming,
+			handover_roaming_lifetime,
+			handover_roaming_kek_label,
+			profile_disclosure,
+			server,
+			async,
+			async_timeout,
+			ca_cert,
+			tls_cert,
+			tls_key,
+			authorization_header,
+			inbound_authorization_header,
+			inbound_client_cert_subject,
+			inbound_rate_limit
+		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)`,
+		a.NetID[:],
+		a.CreatedAt,
+		a.UpdatedAt,
+		a.Enabled,
+		a.PassiveRoaming,
+		a.PassiveRoamingLifetime,
+		a.PassiveRoamingKEKLabel,
+		a.HandoverRoaming,
+		a.HandoverRoamingLifetime,
+		a.HandoverRoamingKEKLabel,
+		pq.Array(a.ProfileDisclosure),
+		a.Server,
+		a.Async,
+		a.AsyncTimeout,
+		a.CACert,
+		a.TLSCert,
+		a.TLSKey,
+		a.Authorization,
+		a.InboundAuthorization,
+		a.InboundClientCertSubject,
+		a.InboundRateLimit,
+	)
+	if err != nil {
+		return handlePSQLError(err, "insert error")
+	}
+
+	log.WithFields(log.Fields{
+		"net_id": a.NetID,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("roaming-agreement created")
+
+	return nil
+}
+
+// GetRoamingAgreement returns the roaming agreement for the given NetID.
+func GetRoamingAgreement(ctx context.Context, db sqlx.Queryer, netID lorawan.NetID) (RoamingAgreement, error) {
+	row := db.QueryRowx(roamingAgreementSelectQuery+`
+		where
+			net_id = $1`,
+		netID[:],
+	)
+
+	a, err := scanRoamingAgreement(row)
+	if err != nil {
+		return a, handlePSQLError(err, "select error")
+	}
+
+	return a, nil
+}
+
+// GetRoamingAgreements returns all the roaming agreements, ordered by NetID.
+func GetRoamingAgreements(ctx context.Context, db sqlx.Queryer) ([]RoamingAgreement, error) {
+	rows, err := db.Queryx(roamingAgreementSelectQuery + `
+		order by
+			net_id`,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "select error")
+	}
+	defer rows.Close()
+
+	var out []RoamingAgreement
+	for rows.Next() {
+		a, err := scanRoamingAgreement(rows)
+		if err != nil {
+			return nil, handlePSQLError(err, "scan error")
+		}
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+// UpdateRoamingAgreement updates the given roaming agreement.
+func UpdateRoamingAgreement(ctx context.Context, db sqlx.Execer, a *RoamingAgreement) error {
+	a.UpdatedAt = time.Now()
+
+	res, err := db.Exec(`
+		update roaming_agreement
+		set
+			updated_at = $2,
+			enabled = $3,
+			passive_roaming = $4,
+			passive_roaming_lifetime = $5,
+			passive_roaming_kek_label = $6,
+			handover_roaming = $7,
+			handover_roaming_lifetime = $8,
+			handover_roaming_kek_label = $9,
+			profile_disclosure = $10,
+			server = $11,
+			async = $12,
+			async_timeout = $13,
+			ca_cert = $14,
+			tls_cert = $15,
+			tls_key = $16,
+			authorization_header = $17,
+			inbound_authorization_header = $18,
+			inbound_client_cert_subject = $19,
+			inbound_rate_limit = $20
+		where
+			net_id = $1`,
+		a.NetID[:],
+		a.UpdatedAt,
+		a.Enabled,
+		a.PassiveRoaming,
+		a.PassiveRoamingLifetime,
+		a.PassiveRoamingKEKLabel,
+		a.HandoverRoaming,
+		a.HandoverRoamingLifetime,
+		a.HandoverRoamingKEKLabel,
+		pq.Array(a.ProfileDisclosure),
+		a.Server,
+		a.Async,
+		a.AsyncTimeout,
+		a.CACert,
+		a.TLSCert,
+		a.TLSKey,
+		a.Authorization,
+		a.InboundAuthorization,
+		a.InboundClientCertSubject,
+		a.InboundRateLimit,
+	)
+	if err != nil {
+		return handlePSQLError(err, "update error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
+		return ErrDoesNotExist
+	}
+
+	log.WithFields(log.Fields{
+		"net_id": a.NetID,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("roaming-agreement updated")
+
+	return nil
+}
+
+// DeleteRoamingAgreement deletes the roaming agreement for the given NetID.
+func DeleteRoamingAgreement(ctx context.Context, db sqlx.Execer, netID lorawan.NetID) error {
+	res, err := db.Exec(`
+		delete from roaming_agreement
+		where
+			net_id = $1`,
+		netID[:],
+	)
+	if err != nil {
+		return handlePSQLError(err, "delete error")
+	}
+
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return handlePSQLError(err, "get rows affected error")
+	}
+	if ra == 0 {
+		return ErrDoesNotExist
+	}
+
+	log.WithFields(log.Fields{
+		"net_id": netID,
+		"ctx_id": ctx.Value(logging.ContextIDKey),
+	}).Info("roaming-agreement deleted")
+
+	return nil
+}
+
+// IncrRoamingAgreementsVersion increments the version of the roaming
+// agreements. This must be called after the roaming agreements have been
+// changed, so that all Network Server instances reload the agreements.
+func IncrRoamingAgreementsVersion(ctx context.Context) (int64, error) {
+	v, err := RedisClient().Incr(ctx, GetRedisKey(roamingAgreementsVersionKey)).Result()
+	if err != nil {
+		return 0, errors.Wrap(err, "incr error")
+	}
+	return v, nil
+}
+
+// GetRoamingAgreementsVersion returns the version of the roaming agreements.
+// It returns 0 when the roaming agreements have never been changed.
+func GetRoamingAgreementsVersion(ctx context.Context) (int64, error) {
+	v, err := RedisClient().Get(ctx, GetRedisKey(roamingAgreementsVersionKey)).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "get error")
+	}
+	return v, nil
+}
+
+func scanRoamingAgreement(row sqlx.ColScanner) (RoamingAgreement, error) {
+	var a RoamingAgreement
+	var netID []byte
+
+	err := row.Scan(
+		&netID,
+		&a.CreatedAt,
+		&a.UpdatedAt,
+		&a.Enabled,
+		&a.PassiveRoaming,
+		&a.PassiveRoamingLifetime,
+		&a.PassiveRoamingKEKLabel,
+		&a.HandoverRoaming,
+		&a.HandoverRoamingLifetime,
+		&a.HandoverRoamingKEKLabel,
+		pq.Array(&a.ProfileDisclosure),
+		&a.Server,
+		&a.Async,
+		&a.AsyncTimeout,
+		&a.CACert,
+		&a.TLSCert,
+		&a.TLSKey,
+		&a.Authorization,
+		&a.InboundAuthorization,
+		&a.InboundClientCertSubject,
+		&a.InboundRateLimit,
+	)
+	if err != nil {
+		return a, err
+	}
+
+	copy(a.NetID[:], netID)
+
+	return a, nil
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/stretchr/testify/require"
+)
+
+func (ts *StorageTestSuite) TestRoamingAgreement() {
+	ra := RoamingAgreement{
+		NetID:                   lorawan.NetID{1, 2, 3},
+		Enabled:                 true,
+		PassiveRoaming:          true,
+		PassiveRoamingLifetime:  time.Minute,
+		PassiveRoamingKEKLabel:  "kek-label",
+		HandoverRoamingKEKLabel: "hr-kek-label",
+		ProfileDisclosure:       []string{"mac", "rx"},
+		Server:                  "https://example.com",
+		Authorization:           "Bearer token",
+
+		InboundAuthorization:     "Bearer inbound",
+		InboundClientCertSubject: "CN=010203,O=Example",
+		InboundRateLimit:         10,
+	}
+
+	ts.T().Run("Create", func(t *testing.T) {
+		assert := require.New(t)
+		assert.NoError(CreateRoamingAgreement(context.Background(), ts.Tx(), &ra))
+
+		ra.CreatedAt = ra.CreatedAt.Round(time.Second).UTC()
+		ra.UpdatedAt = ra.UpdatedAt.Round(time.Second).UTC()
+	})
+
+	ts.T().Run("Get", func(t *testing.T) {
+		assert := require.New(t)
+
+		raGet, err := GetRoamingAgreement(context.Background(), ts.Tx(), ra.NetID)
+		assert.NoError(err)
+
+		raGet.CreatedAt = raGet.CreatedAt.Round(time.Second).UTC()
+		raGet.UpdatedAt = raGet.UpdatedAt.Round(time.Second).UTC()
+		assert.Equal(ra, raGet)
+
+		_, err = GetRoamingAgreement(context.Background(), ts.Tx(), lorawan.NetID{3, 2, 1})
+		assert.Equal(ErrDoesNotExist, err)
+	})
+
+	ts.T().Run("Update", func(t *testing.T) {
+		assert := require.New(t)
+
+		ra.Enabled = false
+		ra.HandoverRoaming = true
+		ra.HandoverRoamingLifetime = time.Hour
+		ra.Authorization = "Bearer rotated"
+		ra.InboundRateLimit = 20
+		assert.NoError(UpdateRoamingAgreement(context.Background(), ts.Tx(), &ra))
+
+		raGet, err := GetRoamingAgreement(context.Background(), ts.Tx(), ra.NetID)
+		assert.NoError(err)
+		assert.False(raGet.Enabled)
+		assert.True(raGet.HandoverRoaming)
+		assert.Equal(time.Hour, raGet.HandoverRoamingLifetime)
+		assert.Equal("Bearer rotated", raGet.Authorization)
+		assert.Equal(20, raGet.InboundRateLimit)
+	})
+
+	ts.T().Run("List", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(CreateRoamingAgreement(context.Background(), ts.Tx(), &RoamingAgreement{NetID: lorawan.NetID{0, 0, 1}}))
+
+		items, err := GetRoamingAgreements(context.Background(), ts.Tx())
+		assert.NoError(err)
+		assert.Len(items, 2)
+		assert.Equal(lorawan.NetID{0, 0, 1}, items[0].NetID)
+		assert.Equal(ra.NetID, items[1].NetID)
+	})
+
+	ts.T().Run("Delete", func(t *testing.T) {
+		assert := require.New(t)
+
+		assert.NoError(DeleteRoamingAgreement(context.Background(), ts.Tx(), ra.NetID))
+		assert.Equal(ErrDoesNotExist, DeleteRoamingAgreement(context.Background(), ts.Tx(), ra.NetID))
+	})
+
+	ts.T().Run("Version", func(t *testing.T) {
+		assert := require.New(t)
+
+		v, err := GetRoamingAgreementsVersion(context.Background())
+		assert.NoError(err)
+		assert.EqualValues(0, v)
+
+		v, err = IncrRoamingAgreementsVersion(context.Background())
+		assert.NoError(err)
+		assert.EqualValues(1, v)
+
+		v, err = GetRoamingAgreementsVersion(context.Background())
+		assert.NoError(err)
+		assert.EqualValues(1, v)
+	})
+}
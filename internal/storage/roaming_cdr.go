@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/brocaar/lorawan"
+)
+
+// RoamingRole defines the role of this Network Server for the roaming
+// traffic.
+type RoamingRole string
+
+// Roaming roles.
+const (
+	// RoamingRoleFNS is used for traffic of devices of a roaming partner
+	// (hNS), handled by the gateways of this Network Server.
+	RoamingRoleFNS RoamingRole = "FNS"
+
+	// RoamingRoleHNS is used for traffic of devices of this Network Server,
+	// handled by the gateways of a roaming partner (fNS).
+	RoamingRoleHNS RoamingRole = "HNS"
+)
+
+// RoamingCDRMaxGatewayIDs defines the max. number of gateway IDs stored per
+// roaming CDR. Additional gateways are not added to the CDR.
+const RoamingCDRMaxGatewayIDs = 100
+
+// RoamingUsage defines the roaming usage of a roaming partner, e.g. the
+// uplinks that were forwarded to a roaming partner, between FirstSeenAt and
+// LastSeenAt. Both timestamps must be within the same hour.
+type RoamingUsage struct {
+	NetID         lorawan.NetID
+	Role          RoamingRole
+	UplinkCount   int
+	UplinkBytes   int
+	DownlinkCount int
+	DownlinkBytes int
+	GatewayIDs    []lorawan.EUI64
+	FirstSeenAt   time.Time
+	LastSeenAt    time.Time
+}
+
+// RoamingCDR defines an aggregated roaming usage record (Call Detail
+// Record) for a roaming partner.
+type RoamingCDR struct {
+	NetID         lorawan.NetID
+	Role          RoamingRole
+	Aggregation   AggregationInterval
+	Time          time.Time
+	UplinkCount   int64
+	UplinkBytes   int64
+	DownlinkCount int64
+	DownlinkBytes int64
+	GatewayIDs    []lorawan.EUI64
+	FirstSeenAt   time.Time
+	LastSeenAt    time.Time
+}
+
+// RoamingCDRFilters provides filters for retrieving the roaming CDRs.
+type RoamingCDRFilters struct {
+	NetID       *lorawan.NetID
+	Role        RoamingRole
+	Aggregation AggregationInterval
+	Start       time.Time
+	End         time.Time
+}
+
+// SaveRoamingUsage adds the given usage to the hourly and daily aggregated
+// roaming CDRs.
+func SaveRoamingUsage(ctx context.Context, db sqlx.Execer, u RoamingUsage) error {
+	if u.FirstSeenAt.IsZero() {
+		u.FirstSeenAt = time.Now()
+	}
+	if u.LastSeenAt.IsZero() {
+		u.LastSeenAt = u.FirstSeenAt
+	}
+
+	var gatewayIDs pq.ByteaArray
+	for i := range u.GatewayIDs {
+		if i == RoamingCDRMaxGatewayIDs {
+			break
+		}
+		gatewayIDs = append(gatewayIDs, u.GatewayIDs[i][:])
+	}
+
+	for _, agg := range []AggregationInterval{AggregationHour, AggregationDay} {
+		ts, err := roamingCDRTime(agg, u.FirstSeenAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(`
+			insert into roaming_cdr (
+				net_id,
+				role,
+				aggregation,
+				"time",
+				uplink_count,
+				uplink_bytes,
+				downlink_count,
+				downlink_bytes,
+				gateway_ids,
+				first_seen_at,
+				last_seen_at
+			) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			on conflict (net_id, role, aggregation, "time")
+				do update set
+					uplink_count = roaming_cdr.uplink_count + excluded.uplink_count,
+					uplink_bytes = roaming_cdr.uplink_bytes + excluded.uplink_bytes,
+					downlink_count = roaming_cdr.downlink_count + excluded.downlink_count,
+					downlink_bytes = roaming_cdr.downlink_bytes + excluded.downlink_bytes,
+					gateway_ids = array(
+						select distinct id
+						from unnest(roaming_cdr.gateway_ids || excluded.gateway_ids) id
+						order by id
+						limit $12
+					),
+					first_seen_at = least(roaming_cdr.first_seen_at, excluded.first_seen_at),
+					last_seen_at = greatest(roaming_cdr.last_seen_at, excluded.last_seen_at)`,
+			u.NetID[:],
+			u.Role,
+			agg,
+			ts,
+			u.UplinkCount,
+			u.UplinkBytes,
+			u.DownlinkCount,
+			u.DownlinkBytes,
+			gatewayIDs,
+			u.FirstSeenAt,
+			u.LastSeenAt,
+			RoamingCDRMaxGatewayIDs,
+		)
+		if err != nil {
+			return handlePSQLError(err, "insert error")
+		}
+	}
+
+	return nil
+}
+
+// GetRoamingCDRs returns the roaming CDRs matching the given filters,
+// ordered by time, NetID and role.
+func GetRoamingCDRs(ctx context.Context, db sqlx.Queryer, filters RoamingCDRFilters) ([]RoamingCDR, error) {
+	if filters.Aggregation != AggregationHour && filters.Aggregation != AggregationDay {
+		return nil, ErrInvalidAggregationInterval
+	}
+
+	var netID []byte
+	if filters.NetID != nil {
+		netID = filters.NetID[:]
+	}
+
+	rows, err := db.Queryx(`
+		select
+			net_id,
+			role,
+			aggregation,
+			"time",
+			uplink_count,
+			uplink_bytes,
+			downlink_count,
+			downlink_bytes,
+			gateway_ids,
+			first_seen_at,
+			last_seen_at
+		from roaming_cdr
+		where
+			aggregation = $1
+			and "time" >= $2
+			and "time" <= $3
+			and ($4::bytea is null or net_id = $4)
+			and ($5 = '' or role = $5)
+		order by
+			"time",
+			net_id,
+			role`,
+		filters.Aggregation,
+		filters.Start,
+		filters.End,
+		netID,
+		filters.Role,
+	)
+	if err != nil {
+		return nil, handlePSQLError(err, "select error")
+	}
+	defer rows.Close()
+
+	var out []RoamingCDR
+	for rows.Next() {
+		var cdr RoamingCDR
+		var netID []byte
+		var gatewayIDs pq.ByteaArray
+
+		err := rows.Scan(
+			&netID,
+			&cdr.Role,
+			&cdr.Aggregation,
+			&cdr.Time,
+			&cdr.UplinkCount,
+			&cdr.UplinkBytes,
+			&cdr.DownlinkCount,
+			&cdr.DownlinkBytes,
+			&gatewayIDs,
+			&cdr.FirstSeenAt,
+			&cdr.LastSeenAt,
+		)
+		if err != nil {
+			return nil, handlePSQLError(err, "scan error")
+		}
+
+		copy(cdr.NetID[:], netID)
+		for _, b := range gatewayIDs {
+			var id lorawan.EUI64
+			copy(id[:], b)
+			cdr.GatewayIDs = append(cdr.GatewayIDs, id)
+		}
+
+		out = append(out, cdr)
+	}
+
+	return out, rows.Err()
+}
+
+// roamingCDRTime returns the start of the aggregation interval for the
+// given time, using the metrics time location.
+func roamingCDRTime(agg AggregationInterval, t time.Time) (time.Time, error) {
+	t = t.In(timeLocation)
+
+	switch agg {
+	case AggregationHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, timeLocation), nil
+	case AggregationDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, timeLocation), nil
+	default:
+		return time.Time{}, fmt.Errorf("unexpected aggregation interval: %s", agg)
+	}
+}
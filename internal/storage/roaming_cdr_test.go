@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/stretchr/testify/require"
+)
+
+func (ts *StorageTestSuite) TestRoamingCDR() {
+	assert := require.New(ts.T())
+	ctx := context.Background()
+
+	netID := lorawan.NetID{1, 2, 3}
+	t1 := time.Date(2022, 1, 1, 10, 15, 0, 0, timeLocation)
+	t2 := time.Date(2022, 1, 1, 10, 45, 0, 0, timeLocation)
+	t3 := time.Date(2022, 1, 1, 11, 5, 0, 0, timeLocation)
+
+	for _, u := range []RoamingUsage{
+		{NetID: netID, Role: RoamingRoleFNS, FirstSeenAt: t1, UplinkCount: 1, UplinkBytes: 20, GatewayIDs: []lorawan.EUI64{{2}, {1}}},
+		{NetID: netID, Role: RoamingRoleFNS, FirstSeenAt: t2, UplinkCount: 1, UplinkBytes: 30, GatewayIDs: []lorawan.EUI64{{1}}},
+		{NetID: netID, Role: RoamingRoleFNS, FirstSeenAt: t3, DownlinkCount: 1, DownlinkBytes: 15, GatewayIDs: []lorawan.EUI64{{3}}},
+		{NetID: netID, Role: RoamingRoleHNS, FirstSeenAt: t3, LastSeenAt: t3.Add(time.Minute), UplinkCount: 2, UplinkBytes: 10},
+	} {
+		assert.NoError(SaveRoamingUsage(ctx, ts.Tx(), u))
+	}
+
+	ts.T().Run("Invalid aggregation", func(t *testing.T) {
+		assert := require.New(t)
+
+		_, err := GetRoamingCDRs(ctx, ts.Tx(), RoamingCDRFilters{
+			Aggregation: AggregationMinute,
+		})
+		assert.Equal(ErrInvalidAggregationInterval, err)
+	})
+
+	ts.T().Run("Hour", func(t *testing.T) {
+		assert := require.New(t)
+
+		cdrs, err := GetRoamingCDRs(ctx, ts.Tx(), RoamingCDRFilters{
+			NetID:       &netID,
+			Role:        RoamingRoleFNS,
+			Aggregation: AggregationHour,
+			Start:       t1.Add(-time.Hour),
+			End:         t3,
+		})
+		assert.NoError(err)
+		assert.Len(cdrs, 2)
+
+		assert.True(cdrs[0].Time.Equal(time.Date(2022, 1, 1, 10, 0, 0, 0, timeLocation)))
+		assert.EqualValues(2, cdrs[0].UplinkCount)
+		assert.EqualValues(50, cdrs[0].UplinkBytes)
+		assert.EqualValues(0, cdrs[0].DownlinkCount)
+		assert.Equal([]lorawan.EUI64{{1}, {2}}, cdrs[0].GatewayIDs)
+		assert.True(cdrs[0].FirstSeenAt.Equal(t1))
+		assert.True(cdrs[0].LastSeenAt.Equal(t2))
+
+		assert.True(cdrs[1].Time.Equal(time.Date(2022, 1, 1, 11, 0, 0, 0, timeLocation)))
+		assert.EqualValues(1, cdrs[1].DownlinkCount)
+		assert.EqualValues(15, cdrs[1].DownlinkBytes)
+	})
+
+	ts.T().Run("Day", func(t *testing.T) {
+		assert := require.New(t)
+
+		cdrs, err := GetRoamingCDRs(ctx, ts.Tx(), RoamingCDRFilters{
+			Aggregation: AggregationDay,
+			Start:       time.Date(2022, 1, 1, 0, 0, 0, 0, timeLocation),
+			End:         time.Date(2022, 1, 2, 0, 0, 0, 0, timeLocation),
+		})
+		assert.NoError(err)
+		assert.Len(cdrs, 2)
+
+		assert.Equal(RoamingRoleFNS, cdrs[0].Role)
+		assert.EqualValues(2, cdrs[0].UplinkCount)
+		assert.EqualValues(1, cdrs[0].DownlinkCount)
+		assert.Equal([]lorawan.EUI64{{1}, {2}, {3}}, cdrs[0].GatewayIDs)
+
+		assert.Equal(RoamingRoleHNS, cdrs[1].Role)
+		assert.EqualValues(2, cdrs[1].UplinkCount)
+		assert.Len(cdrs[1].GatewayIDs, 0)
+		assert.True(cdrs[1].FirstSeenAt.Equal(t3))
+		assert.True(cdrs[1].LastSeenAt.Equal(t3.Add(time.Minute)))
+	})
+
+	ts.T().Run("Max gateway IDs", func(t *testing.T) {
+		assert := require.New(t)
+		t4 := time.Date(2022, 1, 2, 10, 0, 0, 0, timeLocation)
+
+		for i := 0; i < 2; i++ {
+			var ids []lorawan.EUI64
+			for j := 0; j < RoamingCDRMaxGatewayIDs; j++ {
+				ids = append(ids, lorawan.EUI64{byte(i), byte(j)})
+			}
+
+			assert.NoError(SaveRoamingUsage(ctx, ts.Tx(), RoamingUsage{
+				NetID:       netID,
+				Role:        RoamingRoleFNS,
+				FirstSeenAt: t4,
+				UplinkCount: 1,
+				GatewayIDs:  ids,
+			}))
+		}
+
+		cdrs, err := GetRoamingCDRs(ctx, ts.Tx(), RoamingCDRFilters{
+			Aggregation: AggregationHour,
+			Start:       t4,
+			End:         t4,
+		})
+		assert.NoError(err)
+		assert.Len(cdrs, 1)
+		assert.Len(cdrs[0].GatewayIDs, RoamingCDRMaxGatewayIDs)
+	})
+}
@@ -54,6 +54,11 @@ type ServiceProfile struct {
 	TargetPER              int        `db:"target_per"` // Example: 10 indicates 10%
 	MinGWDiversity         int        `db:"min_gw_diversity"`
 	GwsPrivate             bool       `db:"gws_private"`
+
+	// ChannelPlanID defines the (optional) channel-plan for the devices
+	// using this service-profile. The channel-plan of the device-profile
+	// takes precedence.
+	ChannelPlanID *uuid.UUID `db:"channel_plan_id"`
 }
 
 // CreateServiceProfile creates the given service-profile.
@@ -96,8 +101,9 @@ func CreateServiceProfile(ctx context.Context, db sqlx.Execer, sp *ServiceProfil
 			nwk_geo_loc,
 			target_per,
 			min_gw_diversity,
-			gws_private
-		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)`,
+			gws_private,
+			channel_plan_id
+		) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24)`,
 		sp.CreatedAt,
 		sp.UpdatedAt,
 		sp.ID,
@@ -121,6 +127,7 @@ func CreateServiceProfile(ctx context.Context, db sqlx.Execer, sp *ServiceProfil
 		sp.TargetPER,
 		sp.MinGWDiversity,
 		sp.GwsPrivate,
+		sp.ChannelPlanID,
 	)
 	if err != nil {
 		return handlePSQLError(err, "insert error")
@@ -265,7 +272,8 @@ func UpdateServiceProfile(ctx context.Context, db sqlx.Execer, sp *ServiceProfil
 			nwk_geo_loc = $19,
 			target_per = $20,
 			min_gw_diversity = $21,
-			gws_private = $22
+			gws_private = $22,
+			channel_plan_id = $23
 		where
 			service_profile_id = $1`,
 		sp.ID,
@@ -290,6 +298,7 @@ func UpdateServiceProfile(ctx context.Context, db sqlx.Execer, sp *ServiceProfil
 		sp.TargetPER,
 		sp.MinGWDiversity,
 		sp.GwsPrivate,
+		sp.ChannelPlanID,
 	)
 	if err != nil {
 		return handlePSQLError(err, "update error")
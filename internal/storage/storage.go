@@ -43,6 +43,10 @@ func Setup(c config.Config) error {
 	schedulerInterval = c.NetworkServer.Scheduler.SchedulerInterval
 	keyPrefix = c.Redis.KeyPrefix
 
+	if err := setMetricsAggregation(c); err != nil {
+		return errors.Wrap(err, "set metrics aggregation error")
+	}
+
 	log.Info("storage: setting up Redis client")
 	if len(c.Redis.Servers) == 0 {
 		return errors.New("at least one redis server must be configured")
@@ -118,6 +122,18 @@ func Setup(c config.Config) error {
 		}
 	}
 
+	if err := code.Migrate(db.DB, "backfill_device_extra_configs", func(db sqlx.Ext) error {
+		return codemig.BackfillDeviceExtraConfigs(db, defaultEnabledChannels())
+	}); err != nil {
+		return err
+	}
+
+	if err := code.Migrate(db.DB, "backfill_channels_override", func(db sqlx.Ext) error {
+		return codemig.BackfillChannelsOverride(db, defaultEnabledChannels())
+	}); err != nil {
+		return err
+	}
+
 	return nil
 }
 
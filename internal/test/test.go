@@ -47,6 +47,20 @@ func GetConfig() config.Config {
 	c.NetworkServer.Scheduler.ClassC.DeviceDownlinkLockDuration = time.Second * 3
 	c.NetworkServer.Scheduler.ClassC.GatewayDownlinkLockDuration = time.Second * 3
 
+	c.NetworkServer.Gateway.Presence.OfflineMultiplier = 3
+	c.NetworkServer.Gateway.Presence.DefaultStatsInterval = 30 * time.Second
+	c.NetworkServer.Gateway.Presence.CheckInterval = 10 * time.Second
+	c.NetworkServer.Gateway.Presence.ExcludeOffline = true
+	c.NetworkServer.Gateway.Presence.EventSink.Type = "log"
+	c.NetworkServer.Gateway.DownlinkFallback.Enabled = true
+	c.NetworkServer.Gateway.DownlinkFallback.Margin = 300 * time.Millisecond
+	c.NetworkServer.Gateway.DownlinkFallback.MaxAttempts = 2
+	c.NetworkServer.Gateway.DownlinkFallback.Blacklist.ErrorCount = 5
+	c.NetworkServer.Gateway.DownlinkFallback.Blacklist.ErrorWindow = time.Minute
+	c.NetworkServer.Gateway.DownlinkFallback.Blacklist.Duration = 5 * time.Minute
+	c.NetworkServer.Gateway.RadioMetrics.Enabled = true
+	c.NetworkServer.Gateway.ConfigPush.RetryInterval = time.Minute
+	c.NetworkServer.Gateway.ConfigPush.MaxAttempts = 5
 	c.NetworkServer.Gateway.Backend.MultiDownlinkFeature = "multi_only"
 	c.NetworkServer.Gateway.Backend.MQTT.Server = "tcp://127.0.0.1:1883"
 	c.NetworkServer.Gateway.Backend.MQTT.CleanSession = true
@@ -57,6 +71,19 @@ func GetConfig() config.Config {
 	c.NetworkServer.Gateway.Backend.AMQP.EventRoutingKey = "gateway.*.event.*"
 	c.NetworkServer.Gateway.Backend.AMQP.CommandRoutingKeyTemplate = "gateway.{{ .GatewayID }}.command.{{ .CommandType }}"
 
+	c.NetworkServer.Gateway.Backend.Kafka.ConsumerGroup = "chirpstack-network-server"
+	c.NetworkServer.Gateway.Backend.Kafka.CommitInterval = time.Second
+	c.NetworkServer.Gateway.Backend.Kafka.EventTopicTemplate = "gateway.event.{{ .EventType }}"
+	c.NetworkServer.Gateway.Backend.Kafka.CommandTopicTemplate = "gateway.command.{{ .CommandType }}"
+
+	c.NetworkServer.Gateway.Backend.BasicStation.Bind = "127.0.0.1:0"
+	c.NetworkServer.Gateway.Backend.BasicStation.StatsInterval = 30 * time.Second
+	c.NetworkServer.Gateway.Backend.BasicStation.PingInterval = time.Minute
+	c.NetworkServer.Gateway.Backend.BasicStation.ReadTimeout = time.Minute + 5*time.Second
+	c.NetworkServer.Gateway.Backend.BasicStation.WriteTimeout = time.Second
+	c.NetworkServer.Gateway.Backend.BasicStation.FrequencyMin = 863000000
+	c.NetworkServer.Gateway.Backend.BasicStation.FrequencyMax = 870000000
+
 	if v := os.Getenv("TEST_REDIS_SERVERS"); v != "" {
 		c.Redis.Servers = strings.Split(v, ",")
 	}
@@ -6,9 +6,11 @@ import (
 	"time"
 
 	"github.com/brocaar/lorawan"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/kamicuu/chirpstack-api/go/v3/as"
 	"github.com/kamicuu/chirpstack-api/go/v3/gw"
 	"github.com/kamicuu/chirpstack-api/go/v3/nc"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/ack"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -1055,6 +1057,193 @@ func (ts *DownlinkTXAckTestSuite) TestDownlinkTXAck() {
 	})
 }
 
+func (ts *DownlinkTXAckTestSuite) TestDownlinkTXAckFallback() {
+	ts.CreateDevice(storage.Device{
+		DevEUI: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+
+	ts.CreateGateway(storage.Gateway{
+		GatewayID: lorawan.EUI64{2, 2, 2, 2, 2, 2, 2, 2},
+	})
+	fallbackGateway := *ts.Gateway
+
+	ts.CreateGateway(storage.Gateway{
+		GatewayID: lorawan.EUI64{1, 1, 1, 1, 1, 1, 1, 1},
+	})
+
+	ds := storage.DeviceSession{
+		DevAddr:          lorawan.DevAddr{1, 2, 3, 4},
+		DevEUI:           ts.Device.DevEUI,
+		DeviceProfileID:  ts.DeviceProfile.ID,
+		ServiceProfileID: ts.ServiceProfile.ID,
+		RoutingProfileID: ts.RoutingProfile.ID,
+		MACVersion:       "1.0.3",
+		NFCntDown:        10,
+	}
+
+	fPort2 := uint8(2)
+	phyPayload := ts.getPHYPayload(lorawan.UnconfirmedDataDown, &fPort2, nil, []lorawan.Payload{
+		&lorawan.DataPayload{Bytes: []byte{1, 2, 3}},
+	})
+
+	downlinkFrame := func() *storage.DownlinkFrame {
+		return &storage.DownlinkFrame{
+			Token:            123,
+			DevEui:           ts.Device.DevEUI[:],
+			RoutingProfileId: ts.RoutingProfile.ID[:],
+			DownlinkFrame: &gw.DownlinkFrame{
+				Token:     123,
+				GatewayId: ts.Gateway.GatewayID[:],
+				Items: []*gw.DownlinkFrameItem{
+					{
+						PhyPayload: phyPayload,
+						TxInfo: &gw.DownlinkTXInfo{
+							Frequency: 868100000,
+							Context:   []byte{1, 1, 1, 1},
+							Timing:    gw.DownlinkTiming_DELAY,
+							TimingInfo: &gw.DownlinkTXInfo_DelayTimingInfo{
+								DelayTimingInfo: &gw.DelayTimingInfo{
+									Delay: ptypes.DurationProto(time.Second),
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	nack := &gw.DownlinkTXAck{
+		Token: 123,
+		Items: []*gw.DownlinkTXAckItem{
+			{
+				Status: gw.TxAckStatus_COLLISION_PACKET,
+			},
+		},
+	}
+
+	rxInfoSet := storage.DeviceGatewayRXInfoSet{
+		DevEUI: ts.Device.DevEUI,
+		Items: []storage.DeviceGatewayRXInfo{
+			{GatewayID: ts.Gateway.GatewayID, LoRaSNR: 10, Context: []byte{1, 1, 1, 1}},
+			{GatewayID: fallbackGateway.GatewayID, LoRaSNR: 5, Context: []byte{2, 2, 2, 2}},
+		},
+	}
+
+	ts.T().Run("Fallback gateway", func(t *testing.T) {
+		assert := require.New(t)
+		storage.RedisClient().FlushAll(context.Background())
+
+		assert.NoError(storage.SaveDeviceSession(context.Background(), ds))
+		assert.NoError(storage.SaveDeviceGatewayRXInfoSet(context.Background(), rxInfoSet))
+		assert.NoError(storage.SaveDownlinkFrame(context.Background(), downlinkFrame()))
+		assert.NoError(storage.SaveDownlinkFallback(context.Background(), 123, storage.DownlinkFallback{
+			UplinkReceivedAt: time.Now(),
+			TriedGatewayIDs:  []lorawan.EUI64{ts.Gateway.GatewayID},
+		}))
+
+		assert.NoError(ack.HandleDownlinkTXAck(context.Background(), nack))
+
+		frame := <-ts.GWBackend.TXPacketChan
+		assert.Equal(fallbackGateway.GatewayID[:], frame.GatewayId)
+		assert.EqualValues(123, frame.Token)
+		assert.Len(frame.Items, 1)
+		assert.Equal([]byte{2, 2, 2, 2}, frame.Items[0].TxInfo.Context)
+		assert.Equal(phyPayload, frame.Items[0].PhyPayload)
+
+		df, err := storage.GetDownlinkFrame(context.Background(), 123)
+		assert.NoError(err)
+		assert.Equal(fallbackGateway.GatewayID[:], df.DownlinkFrame.GatewayId)
+
+		AssertASNoHandleErrorRequest()(assert, &ts.IntegrationTestSuite)
+
+		t.Run("Max attempts", func(t *testing.T) {
+			assert := require.New(t)
+
+			assert.NoError(ack.HandleDownlinkTXAck(context.Background(), nack))
+			AssertNoDownlinkFrame(assert, &ts.IntegrationTestSuite)
+			AssertASHandleErrorRequest(as.HandleErrorRequest{
+				DevEui: ts.Device.DevEUI[:],
+				Type:   as.ErrorType_DATA_DOWN_GATEWAY,
+				Error:  "COLLISION_PACKET",
+			})(assert, &ts.IntegrationTestSuite)
+		})
+	})
+
+	ts.T().Run("Receive window passed", func(t *testing.T) {
+		assert := require.New(t)
+		storage.RedisClient().FlushAll(context.Background())
+
+		assert.NoError(storage.SaveDeviceSession(context.Background(), ds))
+		assert.NoError(storage.SaveDeviceGatewayRXInfoSet(context.Background(), rxInfoSet))
+		assert.NoError(storage.SaveDownlinkFrame(context.Background(), downlinkFrame()))
+		assert.NoError(storage.SaveDownlinkFallback(context.Background(), 123, storage.DownlinkFallback{
+			UplinkReceivedAt: time.Now().Add(-time.Second),
+			TriedGatewayIDs:  []lorawan.EUI64{ts.Gateway.GatewayID},
+		}))
+
+		assert.NoError(ack.HandleDownlinkTXAck(context.Background(), nack))
+		AssertNoDownlinkFrame(assert, &ts.IntegrationTestSuite)
+		AssertASHandleErrorRequest(as.HandleErrorRequest{
+			DevEui: ts.Device.DevEUI[:],
+			Type:   as.ErrorType_DATA_DOWN_GATEWAY,
+			Error:  "COLLISION_PACKET",
+		})(assert, &ts.IntegrationTestSuite)
+	})
+
+	blacklistTests := []struct {
+		name        string
+		status      gw.TxAckStatus
+		blacklisted map[lorawan.EUI64]struct{}
+	}{
+		{
+			name:        "Blacklist after repeated gateway errors",
+			status:      gw.TxAckStatus_INTERNAL_ERROR,
+			blacklisted: map[lorawan.EUI64]struct{}{ts.Gateway.GatewayID: {}},
+		},
+		{
+			name:        "Timing errors do not blacklist",
+			status:      gw.TxAckStatus_TOO_LATE,
+			blacklisted: map[lorawan.EUI64]struct{}{},
+		},
+		{
+			name:        "Collisions do not blacklist",
+			status:      gw.TxAckStatus_COLLISION_PACKET,
+			blacklisted: map[lorawan.EUI64]struct{}{},
+		},
+	}
+
+	for _, tst := range blacklistTests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			storage.RedisClient().FlushAll(context.Background())
+
+			assert.NoError(storage.SaveDeviceSession(context.Background(), ds))
+
+			for i := 0; i < 5; i++ {
+				assert.NoError(storage.SaveDownlinkFrame(context.Background(), downlinkFrame()))
+				assert.NoError(ack.HandleDownlinkTXAck(context.Background(), &gw.DownlinkTXAck{
+					Token: 123,
+					Items: []*gw.DownlinkTXAckItem{
+						{
+							Status: tst.status,
+						},
+					},
+				}))
+				AssertASHandleErrorRequest(as.HandleErrorRequest{
+					DevEui: ts.Device.DevEUI[:],
+					Type:   as.ErrorType_DATA_DOWN_GATEWAY,
+					Error:  tst.status.String(),
+				})(assert, &ts.IntegrationTestSuite)
+			}
+
+			bl, err := storage.GetBlacklistedGateways(context.Background(), []lorawan.EUI64{ts.Gateway.GatewayID, fallbackGateway.GatewayID})
+			assert.NoError(err)
+			assert.Equal(tst.blacklisted, bl)
+		})
+	}
+}
+
 func TestDownlinkTXAck(t *testing.T) {
 	suite.Run(t, new(DownlinkTXAckTestSuite))
 }
@@ -0,0 +1,713 @@
+package testsuite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-api/go/v3/ns"
+	roamingapi "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/api/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/joinserver"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/uplink"
+)
+
+// postRoamingRequest posts the given payload to the given roaming API
+// endpoint and decodes the (synchronous) answer into ans.
+func postRoamingRequest(t *testing.T, url string, pl interface{}, ans interface{}) {
+	assert := require.New(t)
+
+	b, err := json.Marshal(pl)
+	assert.NoError(err)
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	assert.NoError(err)
+	defer resp.Body.Close()
+
+	assert.NoError(json.NewDecoder(resp.Body).Decode(ans))
+}
+
+// HandoverRoamingSNSTestSuite contains the tests for handover-roaming, with
+// this Network Server acting as sNS. This tests the join of a device which is
+// not known to this Network Server, after which the MAC-layer is handled by
+// this Network Server and the application payloads are forwarded to the hNS.
+type HandoverRoamingSNSTestSuite struct {
+	IntegrationTestSuite
+
+	hnsServer   *httptest.Server
+	hnsRequest  chan []byte
+	hnsResponse [][]byte
+
+	jsServer   *httptest.Server
+	jsRequest  chan []byte
+	jsResponse [][]byte
+
+	// sNS roaming API endpoint
+	snsServer *httptest.Server
+
+	rxInfo gw.UplinkRXInfo
+	txInfo gw.UplinkTXInfo
+}
+
+func (ts *HandoverRoamingSNSTestSuite) SetupTest() {
+	ts.IntegrationTestSuite.SetupTest()
+
+	ts.hnsRequest = make(chan []byte, 10)
+	ts.hnsResponse = nil
+	ts.jsRequest = make(chan []byte, 10)
+	ts.jsResponse = nil
+}
+
+func (ts *HandoverRoamingSNSTestSuite) SetupSuite() {
+	ts.IntegrationTestSuite.SetupSuite()
+
+	assert := require.New(ts.T())
+
+	ts.CreateGateway(storage.Gateway{
+		GatewayID: lorawan.EUI64{1, 2, 1, 2, 1, 2, 1, 2},
+	})
+
+	ts.rxInfo = gw.UplinkRXInfo{
+		GatewayId: ts.Gateway.GatewayID[:],
+		LoraSnr:   7,
+		Rssi:      6,
+		Context:   []byte{1, 2, 3, 4},
+	}
+
+	ts.txInfo = gw.UplinkTXInfo{
+		Frequency: 868100000,
+	}
+	assert.NoError(helpers.SetUplinkTXInfoDataRate(&ts.txInfo, 1, band.Band()))
+
+	// setup hNS endpoint
+	ts.hnsServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		ts.hnsRequest <- b
+		w.Write(ts.hnsResponse[0])
+		ts.hnsResponse = ts.hnsResponse[1:]
+	}))
+
+	// setup JS endpoint
+	ts.jsServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		ts.jsRequest <- b
+		w.Write(ts.jsResponse[0])
+	}))
+
+	// configure default JS
+	conf := test.GetConfig()
+	conf.JoinServer.Default.Server = ts.jsServer.URL
+	assert.NoError(joinserver.Setup(conf))
+
+	// configure sNS API
+	api := roamingapi.NewAPI(conf.NetworkServer.NetID)
+	ts.snsServer = httptest.NewServer(api)
+
+	// configure handover-roaming agreement
+	conf.Roaming.Servers = []config.RoamingServer{
+		{
+			NetID:                   lorawan.NetID{6, 6, 6},
+			Async:                   false,
+			PassiveRoaming:          true,
+			PassiveRoamingLifetime:  time.Minute,
+			HandoverRoaming:         true,
+			HandoverRoamingLifetime: time.Hour,
+			Server:                  ts.hnsServer.URL,
+		},
+	}
+	assert.NoError(roaming.Setup(conf))
+}
+
+func (ts *HandoverRoamingSNSTestSuite) TearDownSuite() {
+	ts.jsServer.Close()
+	ts.hnsServer.Close()
+	ts.snsServer.Close()
+}
+
+func (ts *HandoverRoamingSNSTestSuite) TestHandoverRoaming() {
+	assert := require.New(ts.T())
+	conf := test.GetConfig()
+
+	devEUI := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+	joinEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	nwkSKey := lorawan.AES128Key{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	lifetime := 60
+	handover := backend.Handover
+
+	// join-request phypayload
+	phy := lorawan.PHYPayload{
+		MHDR: lorawan.MHDR{
+			MType: lorawan.JoinRequest,
+			Major: lorawan.LoRaWANR1,
+		},
+		MACPayload: &lorawan.JoinRequestPayload{
+			JoinEUI:  joinEUI,
+			DevEUI:   devEUI,
+			DevNonce: 123,
+		},
+	}
+	phyB, err := phy.MarshalBinary()
+	assert.NoError(err)
+
+	success := backend.BasePayloadResult{
+		Result: backend.Result{
+			ResultCode: backend.Success,
+		},
+	}
+
+	// JS HomeNSAns
+	homeNSAnsB, err := json.Marshal(backend.HomeNSAnsPayload{
+		BasePayloadResult: success,
+		HNetID:            lorawan.NetID{6, 6, 6},
+	})
+	assert.NoError(err)
+
+	// hNS ProfileAns
+	profileAnsB, err := json.Marshal(backend.ProfileAnsPayload{
+		BasePayloadResult: success,
+		DeviceProfile: &backend.DeviceProfile{
+			DeviceProfileID: "dp-1",
+			MACVersion:      "1.0.3",
+			RFRegion:        "EU868",
+			SupportsJoin:    true,
+		},
+		RoamingActivationType: &handover,
+	})
+	assert.NoError(err)
+
+	// hNS HRStartAns
+	hrStartAnsB, err := json.Marshal(backend.HRStartAnsPayload{
+		BasePayloadResult: success,
+		PHYPayload:        backend.HEXBytes{1, 2, 3, 4},
+		Lifetime:          &lifetime,
+		NwkSKey: &backend.KeyEnvelope{
+			AESKey: backend.HEXBytes(nwkSKey[:]),
+		},
+		ServiceProfile: &backend.ServiceProfile{
+			ServiceProfileID: "sp-1",
+			DRMax:            5,
+		},
+	})
+	assert.NoError(err)
+
+	// hNS XmitDataAns
+	xmitDataAnsB, err := json.Marshal(backend.XmitDataAnsPayload{
+		BasePayloadResult: success,
+	})
+	assert.NoError(err)
+
+	var hrStartReq backend.HRStartReqPayload
+
+	ts.T().Run("join", func(t *testing.T) {
+		assert := require.New(t)
+
+		ts.jsResponse = [][]byte{homeNSAnsB}
+		ts.hnsResponse = [][]byte{profileAnsB, hrStartAnsB}
+
+		// "send" uplink
+		assert.NoError(uplink.HandleUplinkFrame(context.Background(), gw.UplinkFrame{
+			RxInfo:     &ts.rxInfo,
+			TxInfo:     &ts.txInfo,
+			PhyPayload: phyB,
+		}))
+
+		// validate JS HomeNSReq
+		var homeNSReq backend.HomeNSReqPayload
+		assert.NoError(json.Unmarshal(<-ts.jsRequest, &homeNSReq))
+		assert.Equal(backend.HomeNSReq, homeNSReq.MessageType)
+		assert.Equal(devEUI, homeNSReq.DevEUI)
+
+		// validate hNS ProfileReq
+		var profileReq backend.ProfileReqPayload
+		assert.NoError(json.Unmarshal(<-ts.hnsRequest, &profileReq))
+		assert.Equal(backend.ProfileReq, profileReq.MessageType)
+		assert.Equal(devEUI, profileReq.DevEUI)
+
+		// validate hNS HRStartReq, the DevAddr is allocated by the sNS
+		assert.NoError(json.Unmarshal(<-ts.hnsRequest, &hrStartReq))
+		assert.Equal(backend.HRStartReq, hrStartReq.MessageType)
+		assert.Equal("060606", hrStartReq.ReceiverID)
+		assert.Equal("1.0.3", hrStartReq.MACVersion)
+		assert.Equal(backend.HEXBytes(phyB), hrStartReq.PHYPayload)
+		assert.True(hrStartReq.DevAddr.IsNetID(conf.NetworkServer.NetID))
+		assert.Equal(lorawan.DLSettings{
+			RX2DataRate: uint8(conf.NetworkServer.NetworkSettings.RX2DR),
+			RX1DROffset: uint8(conf.NetworkServer.NetworkSettings.RX1DROffset),
+		}, hrStartReq.DLSettings)
+		assert.Equal(conf.NetworkServer.NetworkSettings.RX1Delay, hrStartReq.RxDelay)
+		assert.Equal(devEUI, *hrStartReq.ULMetaData.DevEUI)
+
+		// validate join-accept downlink
+		downlinkFrame := <-ts.GWBackend.TXPacketChan
+		assert.Equal(ts.Gateway.GatewayID[:], downlinkFrame.GetGatewayId())
+		assert.Equal([]byte{1, 2, 3, 4}, downlinkFrame.Items[0].PhyPayload)
+
+		// validate device-session
+		ds, err := storage.GetDeviceSession(context.Background(), devEUI)
+		assert.NoError(err)
+		assert.Equal(hrStartReq.DevAddr, ds.DevAddr)
+		assert.Equal(joinEUI, ds.JoinEUI)
+		assert.Equal(nwkSKey, ds.FNwkSIntKey)
+		assert.Equal(nwkSKey, ds.SNwkSIntKey)
+		assert.Equal(nwkSKey, ds.NwkSEncKey)
+
+		sp, err := storage.GetServiceProfile(context.Background(), storage.DB(), ds.ServiceProfileID)
+		assert.NoError(err)
+		assert.Equal(5, sp.DRMax)
+
+		// validate handover-roaming session
+		hr, err := storage.GetHandoverRoamingDeviceSession(context.Background(), devEUI)
+		assert.NoError(err)
+		assert.Equal(lorawan.NetID{6, 6, 6}, hr.NetID)
+		assert.Equal(ds.DeviceProfileID, hr.DeviceProfileID)
+		assert.Equal(ds.ServiceProfileID, hr.ServiceProfileID)
+		assert.InDelta(time.Duration(lifetime)*time.Second, time.Until(hr.Lifetime), float64(time.Second))
+	})
+
+	ts.T().Run("uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		ds, err := storage.GetDeviceSession(context.Background(), devEUI)
+		assert.NoError(err)
+		ts.DeviceSession = &ds
+
+		ts.hnsResponse = [][]byte{xmitDataAnsB}
+
+		// "send" confirmed uplink
+		assert.NoError(uplink.HandleUplinkFrame(context.Background(), ts.GetUplinkFrameForFRMPayload(ts.rxInfo, ts.txInfo, lorawan.ConfirmedDataUp, 10, []byte{1, 2, 3, 4})))
+
+		// the application payload is forwarded to the hNS
+		var xmitDataReq backend.XmitDataReqPayload
+		assert.NoError(json.Unmarshal(<-ts.hnsRequest, &xmitDataReq))
+		assert.Equal(backend.XmitDataReq, xmitDataReq.MessageType)
+		assert.Len(xmitDataReq.FRMPayload, 4)
+		assert.Equal(devEUI, *xmitDataReq.ULMetaData.DevEUI)
+		assert.Equal(uint8(10), *xmitDataReq.ULMetaData.FPort)
+		assert.Equal(uint32(0), *xmitDataReq.ULMetaData.FCntUp)
+		assert.True(xmitDataReq.ULMetaData.Confirmed)
+
+		// the uplink is acknowledged by the sNS
+		downlinkFrame := <-ts.GWBackend.TXPacketChan
+		assert.Equal(ts.Gateway.GatewayID[:], downlinkFrame.GetGatewayId())
+
+		var downPHY lorawan.PHYPayload
+		assert.NoError(downPHY.UnmarshalBinary(downlinkFrame.Items[0].PhyPayload))
+		assert.Equal(lorawan.UnconfirmedDataDown, downPHY.MHDR.MType)
+		macPL, ok := downPHY.MACPayload.(*lorawan.MACPayload)
+		assert.True(ok)
+		assert.Equal(ds.DevAddr, macPL.FHDR.DevAddr)
+		assert.True(macPL.FHDR.FCtrl.ACK)
+
+		ds, err = storage.GetDeviceSession(context.Background(), devEUI)
+		assert.NoError(err)
+		assert.Equal(uint32(1), ds.FCntUp)
+	})
+
+	ts.T().Run("HRStopReq", func(t *testing.T) {
+		assert := require.New(t)
+
+		basePL := func(senderID string) backend.BasePayload {
+			return backend.BasePayload{
+				ProtocolVersion: backend.ProtocolVersion1_0,
+				SenderID:        senderID,
+				ReceiverID:      conf.NetworkServer.NetID.String(),
+				TransactionID:   1234,
+				MessageType:     backend.HRStopReq,
+			}
+		}
+
+		hr, err := storage.GetHandoverRoamingDeviceSession(context.Background(), devEUI)
+		assert.NoError(err)
+
+		var ans backend.HRStopAnsPayload
+		postRoamingRequest(t, ts.snsServer.URL, backend.HRStopReqPayload{
+			BasePayload: basePL("060606"),
+			DevEUI:      devEUI,
+		}, &ans)
+		assert.Equal(backend.Success, ans.Result.ResultCode)
+
+		_, err = storage.GetDeviceSession(context.Background(), devEUI)
+		assert.Equal(storage.ErrDoesNotExist, err)
+
+		_, err = storage.GetHandoverRoamingDeviceSession(context.Background(), devEUI)
+		assert.Equal(storage.ErrDoesNotExist, err)
+
+		// the profiles are no longer referenced
+		_, err = storage.GetDeviceProfile(context.Background(), storage.DB(), hr.DeviceProfileID)
+		assert.Equal(storage.ErrDoesNotExist, errors.Cause(err))
+
+		_, err = storage.GetServiceProfile(context.Background(), storage.DB(), hr.ServiceProfileID)
+		assert.Equal(storage.ErrDoesNotExist, errors.Cause(err))
+
+		postRoamingRequest(t, ts.snsServer.URL, backend.HRStopReqPayload{
+			BasePayload: basePL("060606"),
+			DevEUI:      devEUI,
+		}, &ans)
+		assert.Equal(backend.UnknownDevEUI, ans.Result.ResultCode)
+	})
+}
+
+// HandoverRoamingHNSTestSuite contains the tests for handover-roaming, with
+// this Network Server acting as hNS.
+type HandoverRoamingHNSTestSuite struct {
+	IntegrationTestSuite
+
+	// hNS roaming API endpoint
+	hnsServer *httptest.Server
+
+	snsServer  *httptest.Server
+	snsRequest chan []byte
+}
+
+func (ts *HandoverRoamingHNSTestSuite) SetupTest() {
+	ts.IntegrationTestSuite.SetupTest()
+
+	ts.snsRequest = make(chan []byte, 10)
+}
+
+func (ts *HandoverRoamingHNSTestSuite) SetupSuite() {
+	ts.IntegrationTestSuite.SetupSuite()
+	assert := require.New(ts.T())
+
+	conf := test.GetConfig()
+
+	// configure hNS API
+	api := roamingapi.NewAPI(conf.NetworkServer.NetID)
+	ts.hnsServer = httptest.NewServer(api)
+
+	// setup sNS endpoint
+	ts.snsServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		ts.snsRequest <- b
+
+		ansB, _ := json.Marshal(backend.HRStopAnsPayload{
+			BasePayloadResult: backend.BasePayloadResult{
+				Result: backend.Result{
+					ResultCode: backend.Success,
+				},
+			},
+		})
+		w.Write(ansB)
+	}))
+
+	// configure a handover-roaming agreement with 060606 and a
+	// passive-roaming agreement with 070707
+	conf.Roaming.Servers = []config.RoamingServer{
+		{
+			NetID:                   lorawan.NetID{6, 6, 6},
+			Async:                   false,
+			HandoverRoaming:         true,
+			HandoverRoamingLifetime: time.Hour,
+			Server:                  ts.snsServer.URL,
+		},
+		{
+			NetID:          lorawan.NetID{7, 7, 7},
+			Async:          false,
+			PassiveRoaming: true,
+			Server:         "http://localhost:1234",
+		},
+	}
+	assert.NoError(roaming.Setup(conf))
+
+	// create test device
+	ts.CreateServiceProfile(storage.ServiceProfile{
+		DRMax:     5,
+		HRAllowed: true,
+	})
+	ts.CreateDeviceProfile(storage.DeviceProfile{
+		MACVersion:   "1.0.3",
+		SupportsJoin: true,
+	})
+	ts.CreateDevice(storage.Device{
+		DevEUI: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+}
+
+func (ts *HandoverRoamingHNSTestSuite) TearDownSuite() {
+	ts.hnsServer.Close()
+	ts.snsServer.Close()
+}
+
+func (ts *HandoverRoamingHNSTestSuite) basePayload(senderID string, mType backend.MessageType) backend.BasePayload {
+	return backend.BasePayload{
+		ProtocolVersion: backend.ProtocolVersion1_0,
+		SenderID:        senderID,
+		ReceiverID:      test.GetConfig().NetworkServer.NetID.String(),
+		TransactionID:   1234,
+		MessageType:     mType,
+	}
+}
+
+func (ts *HandoverRoamingHNSTestSuite) TestHRStartReq() {
+	assert := require.New(ts.T())
+
+	nwkSKey := lorawan.AES128Key{1, 2, 3, 4, 5, 6, 7, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	appSKey := lorawan.AES128Key{8, 7, 6, 5, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1}
+
+	// DevAddr allocated by the sNS
+	devAddr := lorawan.DevAddr{1, 2, 3, 4}
+	devAddr.SetAddrPrefix(lorawan.NetID{6, 6, 6})
+
+	ulFreq := 868.1
+	dataRate := 3
+	gwCnt := 1
+
+	hrStartReq := func(senderID string, devAddr lorawan.DevAddr, devNonce lorawan.DevNonce) backend.HRStartReqPayload {
+		phy := lorawan.PHYPayload{
+			MHDR: lorawan.MHDR{
+				MType: lorawan.JoinRequest,
+				Major: lorawan.LoRaWANR1,
+			},
+			MACPayload: &lorawan.JoinRequestPayload{
+				JoinEUI:  lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+				DevEUI:   ts.Device.DevEUI,
+				DevNonce: devNonce,
+			},
+		}
+		phyB, err := phy.MarshalBinary()
+		assert.NoError(err)
+
+		return backend.HRStartReqPayload{
+			BasePayload: ts.basePayload(senderID, backend.HRStartReq),
+			MACVersion:  "1.0.3",
+			PHYPayload:  backend.HEXBytes(phyB),
+			DevAddr:     devAddr,
+			ULMetaData: backend.ULMetaData{
+				DevEUI:   &ts.Device.DevEUI,
+				ULFreq:   &ulFreq,
+				DataRate: &dataRate,
+				RecvTime: backend.ISO8601Time(time.Now().Round(time.Second)),
+				RFRegion: "EU868",
+				GWCnt:    &gwCnt,
+				GWInfo: []backend.GWInfoElement{
+					{
+						ID:        backend.HEXBytes{1, 2, 3, 4},
+						ULToken:   backend.HEXBytes{5, 6, 7, 8},
+						DLAllowed: true,
+					},
+				},
+			},
+			DLSettings: lorawan.DLSettings{
+				RX2DataRate: 3,
+				RX1DROffset: 1,
+			},
+			RxDelay: 2,
+		}
+	}
+
+	ts.T().Run("no agreement", func(t *testing.T) {
+		assert := require.New(t)
+
+		var ans backend.HRStartAnsPayload
+		postRoamingRequest(t, ts.hnsServer.URL, hrStartReq("070707", devAddr, 1), &ans)
+		assert.Equal(backend.NoRoamingAgreement, ans.Result.ResultCode)
+	})
+
+	ts.T().Run("DevAddr does not match sender NetID", func(t *testing.T) {
+		assert := require.New(t)
+
+		devAddr := lorawan.DevAddr{1, 2, 3, 4}
+		devAddr.SetAddrPrefix(test.GetConfig().NetworkServer.NetID)
+
+		var ans backend.HRStartAnsPayload
+		postRoamingRequest(t, ts.hnsServer.URL, hrStartReq("060606", devAddr, 2), &ans)
+		assert.Equal(backend.MalformedRequest, ans.Result.ResultCode)
+	})
+
+	ts.T().Run("success", func(t *testing.T) {
+		assert := require.New(t)
+
+		// previous device-session
+		ts.CreateDeviceSession(storage.DeviceSession{
+			DevAddr:               lorawan.DevAddr{1, 1, 1, 1},
+			EnabledUplinkChannels: []int{0, 1, 2},
+		})
+
+		ts.backendAPIResponse = backend.JoinAnsPayload{
+			BasePayloadResult: backend.BasePayloadResult{
+				Result: backend.Result{
+					ResultCode: backend.Success,
+				},
+			},
+			PHYPayload: backend.HEXBytes{1, 2, 3, 4},
+			NwkSKey: &backend.KeyEnvelope{
+				AESKey: backend.HEXBytes(nwkSKey[:]),
+			},
+			AppSKey: &backend.KeyEnvelope{
+				AESKey: backend.HEXBytes(appSKey[:]),
+			},
+		}
+
+		var ans backend.HRStartAnsPayload
+		postRoamingRequest(t, ts.hnsServer.URL, hrStartReq("060606", devAddr, 3), &ans)
+		assert.Equal(backend.Success, ans.Result.ResultCode)
+		assert.Equal(backend.HRStartAns, ans.MessageType)
+		assert.Equal(backend.HEXBytes{1, 2, 3, 4}, ans.PHYPayload)
+		assert.Equal(3600, *ans.Lifetime)
+		assert.Equal(backend.HEXBytes(nwkSKey[:]), ans.NwkSKey.AESKey)
+		assert.Nil(ans.FNwkSIntKey)
+		assert.Equal(5, ans.ServiceProfile.DRMax)
+		assert.True(ans.ServiceProfile.HRAllowed)
+		assert.Equal(backend.HEXBytes{5, 6, 7, 8}, ans.DLMetaData.GWInfo[0].ULToken)
+
+		// the join-request is forwarded to the JS using the DevAddr and
+		// radio parameters of the sNS
+		var joinReq backend.JoinReqPayload
+		assert.NoError(json.Unmarshal(<-ts.backendAPIRequest, &joinReq))
+		assert.Equal(devAddr, joinReq.DevAddr)
+		assert.Equal(lorawan.DLSettings{
+			RX2DataRate: 3,
+			RX1DROffset: 1,
+		}, joinReq.DLSettings)
+		assert.Equal(2, joinReq.RxDelay)
+
+		// the MAC-layer is handled by the sNS
+		_, err := storage.GetDeviceSession(context.Background(), ts.Device.DevEUI)
+		assert.Equal(storage.ErrDoesNotExist, err)
+
+		hr, err := storage.GetHandoverRoamingHNSDeviceSession(context.Background(), ts.Device.DevEUI)
+		assert.NoError(err)
+		assert.Equal(lorawan.NetID{6, 6, 6}, hr.NetID)
+		assert.Equal(devAddr, hr.DevAddr)
+		assert.Equal(lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}, hr.JoinEUI)
+		assert.Equal(appSKey[:], hr.AppSKeyEnvelope.AESKey)
+	})
+}
+
+func (ts *HandoverRoamingHNSTestSuite) TestXmitDataReq() {
+	assert := require.New(ts.T())
+
+	devAddr := lorawan.DevAddr{1, 2, 3, 4}
+	devAddr.SetAddrPrefix(lorawan.NetID{6, 6, 6})
+	joinEUI := lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1}
+
+	assert.NoError(storage.SaveHandoverRoamingHNSDeviceSession(context.Background(), storage.HandoverRoamingHNSDeviceSession{
+		DevEUI:  ts.Device.DevEUI,
+		JoinEUI: joinEUI,
+		DevAddr: devAddr,
+		NetID:   lorawan.NetID{6, 6, 6},
+		AppSKeyEnvelope: &storage.KeyEnvelope{
+			AESKey: []byte{8, 7, 6, 5, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1},
+		},
+		Lifetime: time.Now().Add(time.Hour),
+	}))
+
+	fPort := uint8(10)
+	fCntUp := uint32(5)
+	ulFreq := 868.1
+	dataRate := 3
+	gwCnt := 1
+
+	xmitDataReq := func(senderID string) backend.XmitDataReqPayload {
+		return backend.XmitDataReqPayload{
+			BasePayload: ts.basePayload(senderID, backend.XmitDataReq),
+			FRMPayload:  backend.HEXBytes{1, 2, 3},
+			ULMetaData: &backend.ULMetaData{
+				DevEUI:   &ts.Device.DevEUI,
+				DevAddr:  &devAddr,
+				FPort:    &fPort,
+				FCntUp:   &fCntUp,
+				ULFreq:   &ulFreq,
+				DataRate: &dataRate,
+				RecvTime: backend.ISO8601Time(time.Now().Round(time.Second)),
+				RFRegion: "EU868",
+				GWCnt:    &gwCnt,
+			},
+		}
+	}
+
+	ts.T().Run("sender NetID does not match", func(t *testing.T) {
+		assert := require.New(t)
+
+		var ans backend.XmitDataAnsPayload
+		postRoamingRequest(t, ts.hnsServer.URL, xmitDataReq("070707"), &ans)
+		assert.Equal(backend.UnknownDevAddr, ans.Result.ResultCode)
+		assert.Len(ts.ASClient.HandleDataUpChan, 0)
+	})
+
+	ts.T().Run("first uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		var ans backend.XmitDataAnsPayload
+		postRoamingRequest(t, ts.hnsServer.URL, xmitDataReq("060606"), &ans)
+		assert.Equal(backend.Success, ans.Result.ResultCode)
+
+		asReq := <-ts.ASClient.HandleDataUpChan
+		assert.Equal(ts.Device.DevEUI[:], asReq.DevEui)
+		assert.Equal(joinEUI[:], asReq.JoinEui)
+		assert.Equal(uint32(5), asReq.FCnt)
+		assert.Equal(uint32(10), asReq.FPort)
+		assert.Equal([]byte{1, 2, 3}, asReq.Data)
+		assert.Equal(&common.KeyEnvelope{
+			AesKey: []byte{8, 7, 6, 5, 4, 3, 2, 1, 8, 7, 6, 5, 4, 3, 2, 1},
+		}, asReq.DeviceActivationContext.AppSKey)
+		assert.Equal(devAddr[:], asReq.DeviceActivationContext.DevAddr)
+
+		hr, err := storage.GetHandoverRoamingHNSDeviceSession(context.Background(), ts.Device.DevEUI)
+		assert.NoError(err)
+		assert.Nil(hr.AppSKeyEnvelope)
+	})
+
+	ts.T().Run("next uplink", func(t *testing.T) {
+		assert := require.New(t)
+
+		var ans backend.XmitDataAnsPayload
+		postRoamingRequest(t, ts.hnsServer.URL, xmitDataReq("060606"), &ans)
+		assert.Equal(backend.Success, ans.Result.ResultCode)
+
+		asReq := <-ts.ASClient.HandleDataUpChan
+		assert.Nil(asReq.DeviceActivationContext)
+	})
+}
+
+func (ts *HandoverRoamingHNSTestSuite) TestDeactivateDevice() {
+	assert := require.New(ts.T())
+
+	ts.CreateDeviceSession(storage.DeviceSession{
+		DevEUI: ts.Device.DevEUI,
+	})
+	assert.NoError(storage.SaveHandoverRoamingHNSDeviceSession(context.Background(), storage.HandoverRoamingHNSDeviceSession{
+		DevEUI:   ts.Device.DevEUI,
+		NetID:    lorawan.NetID{6, 6, 6},
+		Lifetime: time.Now().Add(time.Hour),
+	}))
+
+	_, err := ts.NSAPI.DeactivateDevice(context.Background(), &ns.DeactivateDeviceRequest{
+		DevEui: ts.Device.DevEUI[:],
+	})
+	assert.NoError(err)
+
+	_, err = storage.GetHandoverRoamingHNSDeviceSession(context.Background(), ts.Device.DevEUI)
+	assert.Equal(storage.ErrDoesNotExist, errors.Cause(err))
+
+	var hrStopReq backend.HRStopReqPayload
+	assert.NoError(json.Unmarshal(<-ts.snsRequest, &hrStopReq))
+	assert.Equal(backend.HRStopReq, hrStopReq.MessageType)
+	assert.Equal(ts.Device.DevEUI, hrStopReq.DevEUI)
+}
+
+func TestHandoverRoamingSNS(t *testing.T) {
+	suite.Run(t, new(HandoverRoamingSNSTestSuite))
+}
+
+func TestHandoverRoamingHNS(t *testing.T) {
+	suite.Run(t, new(HandoverRoamingHNSTestSuite))
+}
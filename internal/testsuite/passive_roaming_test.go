@@ -1,6 +1,7 @@
 package testsuite
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -13,6 +14,7 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 
@@ -713,6 +715,139 @@ func (ts *PassiveRoamingFNSTestSuite) TestDownlink() {
 	}, &frame))
 }
 
+func (ts *PassiveRoamingFNSTestSuite) TestPRStopReq() {
+	config := test.GetConfig()
+	api := roamingapi.NewAPI(config.NetworkServer.NetID)
+
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	devEUI := lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8}
+	devAddr := lorawan.DevAddr{1, 2, 3, 4}
+	lifetime := 60
+
+	tests := []struct {
+		name     string
+		session  storage.PassiveRoamingDeviceSession
+		senderID string
+		devEUI   lorawan.EUI64
+		devAddr  *lorawan.DevAddr
+		lifetime *int
+
+		expectedResultCode backend.ResultCode
+		expectedSession    bool
+		expectedLifetime   time.Duration
+	}{
+		{
+			name: "stop session",
+			session: storage.PassiveRoamingDeviceSession{
+				NetID:   lorawan.NetID{6, 6, 6},
+				DevEUI:  devEUI,
+				DevAddr: devAddr,
+			},
+			senderID:           "060606",
+			devEUI:             devEUI,
+			expectedResultCode: backend.Success,
+		},
+		{
+			name: "netid mismatch",
+			session: storage.PassiveRoamingDeviceSession{
+				NetID:   lorawan.NetID{7, 7, 7},
+				DevEUI:  devEUI,
+				DevAddr: devAddr,
+			},
+			senderID:           "060606",
+			devEUI:             devEUI,
+			expectedResultCode: backend.UnknownDevEUI,
+			expectedSession:    true,
+			expectedLifetime:   time.Hour,
+		},
+		{
+			name: "stop session with lifetime",
+			session: storage.PassiveRoamingDeviceSession{
+				NetID:   lorawan.NetID{6, 6, 6},
+				DevEUI:  devEUI,
+				DevAddr: devAddr,
+			},
+			senderID:           "060606",
+			devEUI:             devEUI,
+			lifetime:           &lifetime,
+			expectedResultCode: backend.Success,
+			expectedSession:    true,
+			expectedLifetime:   time.Minute,
+		},
+		{
+			name: "stop session by devaddr",
+			session: storage.PassiveRoamingDeviceSession{
+				NetID:   lorawan.NetID{6, 6, 6},
+				DevAddr: devAddr,
+			},
+			senderID:           "060606",
+			devEUI:             devEUI,
+			devAddr:            &devAddr,
+			expectedResultCode: backend.Success,
+		},
+		{
+			name: "unknown devaddr",
+			session: storage.PassiveRoamingDeviceSession{
+				NetID:   lorawan.NetID{6, 6, 6},
+				DevAddr: devAddr,
+			},
+			senderID:           "060606",
+			devEUI:             devEUI,
+			devAddr:            &lorawan.DevAddr{4, 3, 2, 1},
+			expectedResultCode: backend.UnknownDevEUI,
+			expectedSession:    true,
+			expectedLifetime:   time.Hour,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+			storage.RedisClient().FlushAll(context.Background())
+
+			tst.session.Lifetime = time.Now().Add(time.Hour)
+			assert.NoError(storage.SavePassiveRoamingDeviceSession(context.Background(), &tst.session))
+
+			b, err := json.Marshal(struct {
+				backend.PRStopReqPayload
+				DevAddr *lorawan.DevAddr `json:"DevAddr,omitempty"`
+			}{
+				PRStopReqPayload: backend.PRStopReqPayload{
+					BasePayload: backend.BasePayload{
+						ProtocolVersion: backend.ProtocolVersion1_0,
+						SenderID:        tst.senderID,
+						ReceiverID:      config.NetworkServer.NetID.String(),
+						TransactionID:   1234,
+						MessageType:     backend.PRStopReq,
+					},
+					DevEUI:   tst.devEUI,
+					Lifetime: tst.lifetime,
+				},
+				DevAddr: tst.devAddr,
+			})
+			assert.NoError(err)
+
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(b))
+			assert.NoError(err)
+			defer resp.Body.Close()
+
+			var ans backend.PRStopAnsPayload
+			assert.NoError(json.NewDecoder(resp.Body).Decode(&ans))
+			assert.Equal(tst.expectedResultCode, ans.Result.ResultCode)
+
+			ds, err := storage.GetPassiveRoamingDeviceSession(context.Background(), tst.session.SessionID)
+			if !tst.expectedSession {
+				assert.Equal(storage.ErrDoesNotExist, errors.Cause(err))
+				return
+			}
+			assert.NoError(err)
+			assert.InDelta(tst.expectedLifetime, time.Until(ds.Lifetime), float64(time.Second))
+		})
+	}
+}
+
 // PassiveRoamingSNSTestSuite contains the tests from the hNS POV.
 // This tests uplinks received from a fNS (through the roaming API) and
 // forwarding these uplinks to the application-server. It also tests sending
@@ -1293,6 +1428,103 @@ func (ts *PassiveRoamingSNSTestSuite) TestXmitDataReqUplinkDownlink() {
 	}, fNSReq)
 }
 
+func (ts *PassiveRoamingSNSTestSuite) TestProfileReq() {
+	assert := require.New(ts.T())
+
+	conf := test.GetConfig()
+
+	client, err := backend.NewClient(backend.ClientConfig{
+		SenderID:   "060606",
+		ReceiverID: conf.NetworkServer.NetID.String(),
+		Server:     ts.hnsServer.URL,
+	})
+	assert.NoError(err)
+
+	ts.CreateDeviceSession(storage.DeviceSession{
+		MACVersion:   "1.0.3",
+		RXDelay:      3,
+		RX1DROffset:  1,
+		RX2DR:        3,
+		RX2Frequency: 869525000,
+	})
+
+	setAgreement := func(disclosure []string) {
+		conf.Roaming.Servers = []config.RoamingServer{
+			{
+				NetID:             lorawan.NetID{6, 6, 6},
+				PassiveRoaming:    true,
+				ProfileDisclosure: disclosure,
+				Server:            ts.fnsServer.URL,
+			},
+		}
+		assert.NoError(roaming.Setup(conf))
+	}
+
+	setRoaming := func(prAllowed bool) {
+		ts.ServiceProfile.PRAllowed = prAllowed
+		assert.NoError(storage.UpdateServiceProfile(context.Background(), storage.DB(), ts.ServiceProfile))
+	}
+
+	ts.T().Run("Unknown DevEUI", func(t *testing.T) {
+		assert := require.New(t)
+		setAgreement([]string{"all"})
+
+		resp, err := client.ProfileReq(context.Background(), backend.ProfileReqPayload{
+			DevEUI: lorawan.EUI64{8, 7, 6, 5, 4, 3, 2, 1},
+		})
+		assert.NoError(err)
+		assert.Equal(backend.UnknownDevEUI, resp.Result.ResultCode)
+	})
+
+	ts.T().Run("Roaming not allowed", func(t *testing.T) {
+		assert := require.New(t)
+		setAgreement([]string{"all"})
+		setRoaming(false)
+
+		resp, err := client.ProfileReq(context.Background(), backend.ProfileReqPayload{
+			DevEUI: ts.Device.DevEUI,
+		})
+		assert.NoError(err)
+		assert.Equal(backend.DevRoamingDisallowed, resp.Result.ResultCode)
+	})
+
+	ts.T().Run("Profile disclosure disabled", func(t *testing.T) {
+		assert := require.New(t)
+		setAgreement(nil)
+		setRoaming(true)
+
+		resp, err := client.ProfileReq(context.Background(), backend.ProfileReqPayload{
+			DevEUI: ts.Device.DevEUI,
+		})
+		assert.NoError(err)
+		assert.Equal(backend.NoRoamingAgreement, resp.Result.ResultCode)
+	})
+
+	ts.T().Run("Profile disclosed", func(t *testing.T) {
+		assert := require.New(t)
+		setAgreement([]string{"mac", "rx"})
+		setRoaming(true)
+
+		resp, err := client.ProfileReq(context.Background(), backend.ProfileReqPayload{
+			DevEUI: ts.Device.DevEUI,
+		})
+		assert.NoError(err)
+		assert.Equal(backend.Success, resp.Result.ResultCode)
+		assert.Equal(backend.Passive, *resp.RoamingActivationType)
+		assert.NotNil(resp.DeviceProfileTimestamp)
+		assert.Equal(&backend.DeviceProfile{
+			DeviceProfileID: ts.DeviceProfile.ID.String(),
+			MACVersion:      "1.0.3",
+			RXDelay1:        3,
+			RXDROffset1:     1,
+			RXDataRate2:     3,
+			RXFreq2:         869525000,
+		}, resp.DeviceProfile)
+	})
+
+	setRoaming(false)
+}
+
 // TestPassiveRoamingFNS tests the passive-roaming from the fNS POV.
 func TestPassiveRoamingFNS(t *testing.T) {
 	suite.Run(t, new(PassiveRoamingFNSTestSuite))
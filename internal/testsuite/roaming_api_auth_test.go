@@ -0,0 +1,194 @@
+package testsuite
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	roamingapi "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/api/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/joinserver"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/test"
+)
+
+// RoamingAPIAuthTestSuite contains the tests for the authentication and
+// rate limiting of inbound roaming API requests.
+type RoamingAPIAuthTestSuite struct {
+	IntegrationTestSuite
+
+	apiServer *httptest.Server
+}
+
+func (ts *RoamingAPIAuthTestSuite) SetupSuite() {
+	ts.IntegrationTestSuite.SetupSuite()
+
+	conf := test.GetConfig()
+	ts.apiServer = httptest.NewServer(roamingapi.NewAPI(conf.NetworkServer.NetID))
+}
+
+func (ts *RoamingAPIAuthTestSuite) TearDownSuite() {
+	ts.apiServer.Close()
+}
+
+func (ts *RoamingAPIAuthTestSuite) TestInboundAuthentication() {
+	assert := require.New(ts.T())
+	conf := test.GetConfig()
+	conf.Roaming.Servers = []config.RoamingServer{
+		{
+			NetID:                lorawan.NetID{6, 6, 6},
+			Server:               "http://localhost:1234",
+			HandoverRoaming:      true,
+			InboundAuthorization: "Bearer token-666",
+			InboundRateLimit:     1,
+		},
+		{
+			NetID:                lorawan.NetID{7, 7, 7},
+			Server:               "http://localhost:1234",
+			InboundAuthorization: "Bearer token-777",
+		},
+	}
+	assert.NoError(roaming.Setup(conf))
+
+	b, err := json.Marshal(backend.HRStopReqPayload{
+		BasePayload: backend.BasePayload{
+			ProtocolVersion: backend.ProtocolVersion1_0,
+			SenderID:        "060606",
+			ReceiverID:      conf.NetworkServer.NetID.String(),
+			TransactionID:   1234,
+			MessageType:     backend.HRStopReq,
+		},
+		DevEUI: lorawan.EUI64{1, 2, 3, 4, 5, 6, 7, 8},
+	})
+	assert.NoError(err)
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "missing credentials",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "credentials of other partner",
+			authorization:  "Bearer token-777",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "valid credentials",
+			authorization:  "Bearer token-666",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "rate limited",
+			authorization:  "Bearer token-666",
+			expectedStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			req, err := http.NewRequest("POST", ts.apiServer.URL, bytes.NewReader(b))
+			assert.NoError(err)
+			if tst.authorization != "" {
+				req.Header.Set("Authorization", tst.authorization)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(err)
+			resp.Body.Close()
+
+			assert.Equal(tst.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func (ts *RoamingAPIAuthTestSuite) TestJoinServerAuthentication() {
+	assert := require.New(ts.T())
+	conf := test.GetConfig()
+	conf.Roaming.API.RequireAuthentication = true
+	conf.JoinServer.Servers = append(conf.JoinServer.Servers, config.JoinServerServer{
+		Server:               "http://localhost:1234",
+		JoinEUI:              "0102030405060708",
+		InboundAuthorization: "Bearer js-token",
+	})
+	assert.NoError(joinserver.Setup(conf))
+	defer func() {
+		assert.NoError(joinserver.Setup(test.GetConfig()))
+	}()
+
+	newRequest := func(mt backend.MessageType) []byte {
+		b, err := json.Marshal(backend.BasePayload{
+			ProtocolVersion: backend.ProtocolVersion1_0,
+			SenderID:        "0102030405060708",
+			ReceiverID:      conf.NetworkServer.NetID.String(),
+			TransactionID:   1234,
+			MessageType:     mt,
+		})
+		assert.NoError(err)
+		return b
+	}
+
+	tests := []struct {
+		name           string
+		messageType    backend.MessageType
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "missing credentials",
+			messageType:    backend.HomeNSAns,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "invalid credentials",
+			messageType:    backend.HomeNSAns,
+			authorization:  "Bearer token-666",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "unexpected message-type",
+			messageType:    backend.XmitDataReq,
+			authorization:  "Bearer js-token",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unexpected message-type without credentials",
+			messageType:    backend.HRStartReq,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tst := range tests {
+		ts.T().Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			req, err := http.NewRequest("POST", ts.apiServer.URL, bytes.NewReader(newRequest(tst.messageType)))
+			assert.NoError(err)
+			if tst.authorization != "" {
+				req.Header.Set("Authorization", tst.authorization)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(err)
+			resp.Body.Close()
+
+			assert.Equal(tst.expectedStatus, resp.StatusCode)
+		})
+	}
+}
+
+func TestRoamingAPIAuth(t *testing.T) {
+	suite.Run(t, new(RoamingAPIAuthTestSuite))
+}
@@ -7,12 +7,14 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/brocaar/lorawan"
 	"github.com/kamicuu/chirpstack-api/go/v3/gw"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -33,10 +35,28 @@ const (
 // Since the underlying storage type is a set, the result will always be a
 // unique set per gateway MAC and packet MIC.
 func collectAndCallOnce(rxPacket gw.UplinkFrame, callback func(packet models.RXPacket) error) error {
+	call, err := collectOnce(rxPacket, callback)
+	if err != nil || call == nil {
+		return err
+	}
+
+	// wait the configured amount of time, more packets might be received
+	// from other gateways
+	time.Sleep(deduplicationDelay)
+
+	return call()
+}
+
+// collectOnce collects the package. For the first collector of the package,
+// it returns the function that must be called after the de-duplication
+// delay, which collects all packets from the set and calls the callback.
+// For the other collectors, it returns nil.
+func collectOnce(rxPacket gw.UplinkFrame, callback func(packet models.RXPacket) error) (func() error, error) {
+	receivedAt := time.Now()
 	phyKey := hex.EncodeToString(rxPacket.PhyPayload)
 	txInfoB, err := proto.Marshal(rxPacket.TxInfo)
 	if err != nil {
-		return errors.Wrap(err, "marshal protobuf error")
+		return nil, errors.Wrap(err, "marshal protobuf error")
 	}
 	txInfoHEX := hex.EncodeToString(txInfoB)
 
@@ -51,18 +71,21 @@ func collectAndCallOnce(rxPacket gw.UplinkFrame, callback func(packet models.RXP
 	}
 
 	if err := collectAndCallOncePut(key, deduplicationTTL, rxPacket); err != nil {
-		return err
+		return nil, err
 	}
 
 	if locked, err := collectAndCallOnceLocked(lockKey, deduplicationTTL); err != nil || locked {
 		// when locked == true, err == nil
-		return err
+		return nil, err
 	}
 
-	// wait the configured amount of time, more packets might be received
-	// from other gateways
-	time.Sleep(deduplicationDelay)
+	return func() error {
+		return collectAndCall(key, receivedAt, callback)
+	}, nil
+}
 
+// collectAndCall collects all packets from the set and calls the callback.
+func collectAndCall(key string, receivedAt time.Time, callback func(packet models.RXPacket) error) error {
 	// collect all packets from the set
 	payloads, err := collectAndCallOnceCollect(key)
 	if err != nil {
@@ -72,7 +95,9 @@ func collectAndCallOnce(rxPacket gw.UplinkFrame, callback func(packet models.RXP
 		return errors.New("zero items in collect set")
 	}
 
-	var out models.RXPacket
+	out := models.RXPacket{
+		ReceivedAt: receivedAt,
+	}
 	for i, b := range payloads {
 		var uplinkFrame gw.UplinkFrame
 		if err := proto.Unmarshal(b, &uplinkFrame); err != nil {
@@ -104,6 +129,10 @@ func collectAndCallOnce(rxPacket gw.UplinkFrame, callback func(packet models.RXP
 			out.DR = dr
 		}
 
+		if rxTime, ok := getGatewayRXTime(uplinkFrame.RxInfo); ok && rxTime.Before(out.ReceivedAt) {
+			out.ReceivedAt = rxTime
+		}
+
 		out.TXInfo = uplinkFrame.TxInfo
 		out.RXInfoSet = append(out.RXInfoSet, uplinkFrame.RxInfo)
 		out.GatewayIsPrivate = make(map[lorawan.EUI64]bool)
@@ -113,6 +142,27 @@ func collectAndCallOnce(rxPacket gw.UplinkFrame, callback func(packet models.RXP
 	return callback(out)
 }
 
+// getGatewayRXTime returns the time the uplink was received by the gateway.
+// The GPS time is used when available, as it is more accurate than the
+// gateway system time.
+func getGatewayRXTime(rxInfo *gw.UplinkRXInfo) (time.Time, bool) {
+	if rxInfo.GetTimeSinceGpsEpoch() != nil {
+		timeSinceGPSEpoch, err := ptypes.Duration(rxInfo.GetTimeSinceGpsEpoch())
+		if err == nil {
+			return time.Time(gps.NewFromTimeSinceGPSEpoch(timeSinceGPSEpoch)), true
+		}
+	}
+
+	if rxInfo.GetTime() != nil {
+		t, err := ptypes.Timestamp(rxInfo.GetTime())
+		if err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
 func collectAndCallOncePut(key string, ttl time.Duration, rxPacket gw.UplinkFrame) error {
 	b, err := proto.Marshal(&rxPacket)
 	if err != nil {
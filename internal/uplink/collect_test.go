@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -16,6 +17,7 @@ import (
 	"github.com/kamicuu/chirpstack-api/go/v3/nc"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/controller"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gps"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
@@ -179,6 +181,52 @@ func (ts *CollectTestSuite) TestDeduplication() {
 	}
 }
 
+func TestGetGatewayRXTime(t *testing.T) {
+	now := time.Now().Truncate(time.Second).UTC()
+	gpsTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	nowPB, _ := ptypes.TimestampProto(now)
+
+	tests := []struct {
+		name     string
+		rxInfo   *gw.UplinkRXInfo
+		expected time.Time
+		ok       bool
+	}{
+		{
+			name:   "no time",
+			rxInfo: &gw.UplinkRXInfo{},
+		},
+		{
+			name: "time",
+			rxInfo: &gw.UplinkRXInfo{
+				Time: nowPB,
+			},
+			expected: now,
+			ok:       true,
+		},
+		{
+			name: "gps time is preferred",
+			rxInfo: &gw.UplinkRXInfo{
+				Time:              nowPB,
+				TimeSinceGpsEpoch: ptypes.DurationProto(gps.Time(gpsTime).TimeSinceGPSEpoch()),
+			},
+			expected: gpsTime,
+			ok:       true,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			assert := require.New(t)
+
+			rxTime, ok := getGatewayRXTime(tst.rxInfo)
+			assert.Equal(tst.ok, ok)
+			assert.True(tst.expected.Equal(rxTime))
+		})
+	}
+}
+
 func TestCollect(t *testing.T) {
 	suite.Run(t, new(CollectTestSuite))
 }
@@ -16,13 +16,16 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/applicationserver"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/controller"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/channels"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/config"
 	datadown "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/data"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/framelog"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/geolocation"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/maccommand"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/ratelimit"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
@@ -40,14 +43,19 @@ var tasks = []func(*dataContext) error{
 	handlePassiveRoamingDevice,
 	getDeviceSessionForPHYPayload,
 	abortOnDeviceIsDisabled,
+	getHandoverRoamingDeviceSession,
 	getDeviceProfile,
 	getServiceProfile,
+	checkUplinkRateLimit,
 	setDownlinkDeviceLock,
 	filterRxInfoByServiceProfile,
+	checkMinGWDiversity,
 	decryptFOptsMACCommands,
 	decryptFRMPayloadMACCommands,
 	logUplinkFrame,
-	getApplicationServerClientForDataUp,
+	isHandoverRoaming(false,
+		getApplicationServerClientForDataUp,
+	),
 	setADR,
 	setUplinkDataRate,
 	setBeaconLocked,
@@ -56,10 +64,21 @@ var tasks = []func(*dataContext) error{
 	handleFRMPayloadMACCommands,
 	storeDeviceGatewayRXInfoSet,
 	appendMetaDataToUplinkHistory,
-	sendFRMPayloadToApplicationServer,
+	isHandoverRoaming(false,
+		sendFRMPayloadToApplicationServer,
+		resolveDeviceLocation,
+	),
+	isHandoverRoaming(true,
+		sendFRMPayloadToHomeNS,
+	),
 	syncUplinkFCnt,
 	saveDeviceSession,
-	handleUplinkACK,
+	isHandoverRoaming(false,
+		handleUplinkACK,
+	),
+	isHandoverRoaming(true,
+		saveHandoverRoamingDeviceSession,
+	),
 	isRoaming(false,
 		handleDownlink,
 	),
@@ -72,6 +91,7 @@ var (
 	getDownlinkDataDelay       time.Duration
 	disableMACCommands         bool
 	classCDownlinkLockDuration time.Duration
+	rejectBelowMinGWDiversity  bool
 )
 
 // Setup configures the package.
@@ -79,6 +99,7 @@ func Setup(conf config.Config) error {
 	getDownlinkDataDelay = conf.NetworkServer.GetDownlinkDataDelay
 	disableMACCommands = conf.NetworkServer.NetworkSettings.DisableMACCommands
 	classCDownlinkLockDuration = conf.NetworkServer.Scheduler.ClassC.DeviceDownlinkLockDuration
+	rejectBelowMinGWDiversity = conf.NetworkServer.NetworkSettings.RejectBelowMinGWDiversity
 
 	return nil
 }
@@ -94,6 +115,18 @@ type dataContext struct {
 	ApplicationServerClient as.ApplicationServerServiceClient
 	MACCommandResponses     []storage.MACCommandBlock
 	MustSendDownlink        bool
+
+	// RateLimited is set when the uplink exceeds the service-profile
+	// uplink rate and the rate policy is Mark.
+	RateLimited bool
+
+	// BelowMinGWDiversity is set when the uplink was received by fewer
+	// gateways than the service-profile min. gateway diversity.
+	BelowMinGWDiversity bool
+
+	// HandoverRoamingDeviceSession is set when the MAC-layer control of the
+	// device has been handed over to this Network Server by the hNS.
+	HandoverRoamingDeviceSession *storage.HandoverRoamingDeviceSession
 }
 
 func isRoaming(r bool, tasks ...func(*dataContext) error) func(*dataContext) error {
@@ -110,6 +143,20 @@ func isRoaming(r bool, tasks ...func(*dataContext) error) func(*dataContext) err
 	}
 }
 
+func isHandoverRoaming(hr bool, tasks ...func(*dataContext) error) func(*dataContext) error {
+	return func(ctx *dataContext) error {
+		if hr == (ctx.HandoverRoamingDeviceSession != nil) {
+			for _, f := range tasks {
+				if err := f(ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
 // Handle handles an uplink data frame
 func Handle(ctx context.Context, rxPacket models.RXPacket) error {
 	dctx := dataContext{
@@ -160,10 +207,36 @@ func handlePassiveRoamingDevice(ctx *dataContext) error {
 	return nil
 }
 
+// getDeviceExtraUplinkChannelIndex returns the channel index of the
+// per-device extra channel matching the given frequency and data-rate, for
+// one of the device-sessions using the given DevAddr.
+func getDeviceExtraUplinkChannelIndex(ctx context.Context, devAddr lorawan.DevAddr, freq uint32, dr int) (int, error) {
+	deviceSessions, err := storage.GetDeviceSessionsForDevAddr(ctx, devAddr)
+	if err != nil {
+		return 0, errors.Wrap(err, "get device-sessions for devaddr error")
+	}
+
+	for _, ds := range deviceSessions {
+		for i, c := range ds.ExtraUplinkChannels {
+			if c.Frequency == freq && dr >= c.MinDR && dr <= c.MaxDR {
+				return i, nil
+			}
+		}
+	}
+
+	return 0, storage.ErrDoesNotExist
+}
+
 func getDeviceSessionForPHYPayload(ctx *dataContext) error {
 	txCh, err := band.Band().GetUplinkChannelIndexForFrequencyDR(ctx.RXPacket.TXInfo.Frequency, ctx.RXPacket.DR)
 	if err != nil {
-		return errors.Wrap(err, "get channel error")
+		// The uplink might have been sent on a per-device extra channel,
+		// which is not part of the band configuration.
+		var extraErr error
+		txCh, extraErr = getDeviceExtraUplinkChannelIndex(ctx.ctx, ctx.MACPayload.FHDR.DevAddr, ctx.RXPacket.TXInfo.Frequency, ctx.RXPacket.DR)
+		if extraErr != nil {
+			return errors.Wrap(err, "get channel error")
+		}
 	}
 
 	ds, err := storage.GetDeviceSessionForPHYPayload(ctx.ctx, ctx.RXPacket.PHYPayload, ctx.RXPacket.DR, txCh)
@@ -226,6 +299,20 @@ func logUplinkFrame(ctx *dataContext) error {
 
 	uplinkFrameLog.DevAddr = ctx.DeviceSession.DevAddr[:]
 	uplinkFrameLog.DevEui = ctx.DeviceSession.DevEUI[:]
+	uplinkFrameLog.RateLimited = ctx.RateLimited
+	uplinkFrameLog.BelowMinGwDiversity = ctx.BelowMinGWDiversity
+
+	// Include the channel reconfiguration status, so that devices stuck
+	// mid-reconfiguration can be spotted in the frame log.
+	ec, err := storage.GetOptionalDeviceExtraConfigurations(ctx.ctx, storage.DB(), ctx.DeviceSession.DevEUI)
+	if err != nil {
+		log.WithError(err).Error("get extra-config for uplink frame-log error")
+	} else if ec != nil {
+		uplinkFrameLog.ChannelsStatus, err = framelog.CreateDeviceChannelsStatus(ec.ChannelsStatus)
+		if err != nil {
+			log.WithError(err).Error("create channels status for uplink frame-log error")
+		}
+	}
 
 	if err := framelog.LogUplinkFrameForDevEUI(ctx.ctx, ctx.DeviceSession.DevEUI, uplinkFrameLog); err != nil {
 		log.WithError(err).Error("log uplink frame for device error")
@@ -254,6 +341,24 @@ func getServiceProfile(ctx *dataContext) error {
 	return nil
 }
 
+// checkUplinkRateLimit enforces the service-profile uplink rate. Depending on
+// the rate policy, an uplink exceeding the rate is dropped or marked.
+func checkUplinkRateLimit(ctx *dataContext) error {
+	action, err := ratelimit.CheckUplink(ctx.ctx, ctx.ServiceProfile, ctx.DeviceSession.DevEUI)
+	if err != nil {
+		return errors.Wrap(err, "check uplink rate-limit error")
+	}
+
+	switch action {
+	case ratelimit.Drop:
+		return ErrAbort
+	case ratelimit.Mark:
+		ctx.RateLimited = true
+	}
+
+	return nil
+}
+
 // setDownlinkDeviceLock sets a downlink device lock in case of a Class-C
 // device. This to make sure that the Class-C scheduler does not schedule
 // a downlink that might collide with a Class-A receive-window.
@@ -291,6 +396,36 @@ func filterRxInfoByServiceProfile(ctx *dataContext) error {
 	return nil
 }
 
+// checkMinGWDiversity validates that the uplink was received by at least the
+// number of gateways defined by the service-profile min. gateway diversity.
+// Depending on the configuration, an uplink below this minimum is flagged or
+// rejected.
+func checkMinGWDiversity(ctx *dataContext) error {
+	gwCount := len(ctx.RXPacket.RXInfoSet)
+	gatewayDiversityHistogram().Observe(float64(gwCount))
+
+	if ctx.ServiceProfile.MinGWDiversity == 0 || gwCount >= ctx.ServiceProfile.MinGWDiversity {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"dev_eui":          ctx.DeviceSession.DevEUI,
+		"gateway_count":    gwCount,
+		"min_gw_diversity": ctx.ServiceProfile.MinGWDiversity,
+		"ctx_id":           ctx.ctx.Value(logging.ContextIDKey),
+	}).Warning("uplink/data: uplink received by fewer gateways than the min. gateway diversity")
+
+	if rejectBelowMinGWDiversity {
+		belowMinGWDiversityCounter("reject").Inc()
+		return ErrAbort
+	}
+
+	belowMinGWDiversityCounter("flag").Inc()
+	ctx.BelowMinGWDiversity = true
+
+	return nil
+}
+
 func setADR(ctx *dataContext) error {
 	ctx.DeviceSession.ADR = ctx.MACPayload.FHDR.FCtrl.ADR
 	return nil
@@ -410,6 +545,12 @@ func setBeaconLocked(ctx *dataContext) error {
 
 	ctx.DeviceSession.BeaconLocked = ctx.MACPayload.FHDR.FCtrl.ClassB
 
+	// Devices handed over by their hNS are not provisioned on this Network
+	// Server, only the device-session is updated.
+	if ctx.HandoverRoamingDeviceSession != nil {
+		return nil
+	}
+
 	if ctx.DeviceSession.BeaconLocked {
 		d, err := storage.GetDevice(ctx.ctx, storage.DB(), ctx.DeviceSession.DevEUI, false)
 		if err != nil {
@@ -597,6 +738,8 @@ func sendFRMPayloadToApplicationServer(ctx *dataContext) error {
 		Adr:             ctx.MACPayload.FHDR.FCtrl.ADR,
 		TxInfo:          ctx.RXPacket.TXInfo,
 		ConfirmedUplink: ctx.RXPacket.PHYPayload.MHDR.MType == lorawan.ConfirmedDataUp,
+
+		BelowMinGwDiversity: ctx.BelowMinGWDiversity,
 	}
 
 	publishDataUpReq.Dr = uint32(ctx.RXPacket.DR)
@@ -644,6 +787,56 @@ func sendFRMPayloadToApplicationServer(ctx *dataContext) error {
 	return nil
 }
 
+// resolveDeviceLocation resolves the location of the device when network
+// geolocation is enabled by the service-profile. The resolved location is
+// sent to the application-server.
+func resolveDeviceLocation(ctx *dataContext) error {
+	if !ctx.ServiceProfile.NwkGeoLoc {
+		return nil
+	}
+
+	loc, err := geolocation.Resolve(ctx.ctx, geolocation.ResolveRequest{
+		RXInfo:            ctx.RXPacket.RXInfoSet,
+		ReferenceAltitude: ctx.DeviceSession.ReferenceAltitude,
+	})
+	if err != nil {
+		if err == geolocation.ErrInsufficientData {
+			log.WithFields(log.Fields{
+				"dev_eui": ctx.DeviceSession.DevEUI,
+				"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+			}).Debug("uplink/data: insufficient data to resolve device location")
+			return nil
+		}
+
+		log.WithFields(log.Fields{
+			"dev_eui": ctx.DeviceSession.DevEUI,
+			"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+		}).WithError(err).Error("uplink/data: resolve device location error")
+		return nil
+	}
+
+	req := as.SetDeviceLocationRequest{
+		DevEui:   ctx.DeviceSession.DevEUI[:],
+		Location: loc,
+	}
+	for _, rxInfo := range ctx.RXPacket.RXInfoSet {
+		req.UplinkIds = append(req.UplinkIds, rxInfo.UplinkId)
+	}
+
+	go func(ctx context.Context, asClient as.ApplicationServerServiceClient, req as.SetDeviceLocationRequest) {
+		ctxTimeout, cancel := context.WithTimeout(ctx, applicationClientTimeout)
+		defer cancel()
+
+		if _, err := asClient.SetDeviceLocation(ctxTimeout, &req); err != nil {
+			log.WithFields(log.Fields{
+				"ctx_id": ctx.Value(logging.ContextIDKey),
+			}).WithError(err).Error("send device location to application-server error")
+		}
+	}(ctx.ctx, ctx.ApplicationServerClient, req)
+
+	return nil
+}
+
 func syncUplinkFCnt(ctx *dataContext) error {
 	// sync counter with that of the device + 1
 	ctx.DeviceSession.FCntUp = ctx.MACPayload.FHDR.FCnt + 1
@@ -811,6 +1004,10 @@ func handleUplinkMACCommands(ctx context.Context, ds *storage.DeviceSession, dp
 					log.WithFields(logFields).Errorf("handle mac-command block error: %s", err)
 				} else {
 					out = append(out, responseBlocks...)
+
+					if err := updateDeviceChannelsStatus(ctx, *ds, block, pending); err != nil {
+						log.WithFields(logFields).Errorf("update device channels status error: %s", err)
+					}
 				}
 			}
 		}
@@ -844,3 +1041,113 @@ func handleUplinkMACCommands(ctx context.Context, ds *storage.DeviceSession, dp
 
 	return out, mustRespondWithDownlink, nil
 }
+
+// updateDeviceChannelsStatus updates the channel reconfiguration status of
+// the device, using the NewChannelAns or LinkADRAns mac-command answers.
+// The status is only updated when a reconfiguration has been requested
+// through the API.
+func updateDeviceChannelsStatus(ctx context.Context, ds storage.DeviceSession, block storage.MACCommandBlock, pending *storage.MACCommandBlock) error {
+	if block.CID != lorawan.NewChannelAns && block.CID != lorawan.LinkADRAns {
+		return nil
+	}
+
+	ec, err := storage.GetOptionalDeviceExtraConfigurations(ctx, storage.DB(), ds.DevEUI)
+	if err != nil {
+		return errors.Wrap(err, "get extra-config error")
+	}
+
+	if ec == nil || !ec.ChannelsStatus.IsTracked() {
+		return nil
+	}
+
+	switch block.CID {
+	case lorawan.NewChannelAns:
+		if pending == nil || len(pending.MACCommands) != len(block.MACCommands) {
+			return nil
+		}
+
+		for i := range block.MACCommands {
+			pl, ok := block.MACCommands[i].Payload.(*lorawan.NewChannelAnsPayload)
+			if !ok {
+				return fmt.Errorf("expected *lorawan.NewChannelAnsPayload, got %T", block.MACCommands[i].Payload)
+			}
+			pendingPL, ok := pending.MACCommands[i].Payload.(*lorawan.NewChannelReqPayload)
+			if !ok {
+				return fmt.Errorf("expected *lorawan.NewChannelReqPayload, got %T", pending.MACCommands[i].Payload)
+			}
+
+			ec.ChannelsStatus.SetNewChannelAns(int(pendingPL.ChIndex), pl.ChannelFrequencyOK, pl.DataRateRangeOK)
+			if ec.ChannelsStatus.State == storage.DeviceChannelsRejected {
+				break
+			}
+		}
+	case lorawan.LinkADRAns:
+		// only the LinkADRReq of the channel reconfiguration is tracked,
+		// not the LinkADRReq sent by the ADR engine
+		if !isChannelReconfigurationLinkADRReq(ds, *ec, pending) {
+			return nil
+		}
+
+		chMaskACK, drACK, powerACK := true, true, true
+		for i := range block.MACCommands {
+			pl, ok := block.MACCommands[i].Payload.(*lorawan.LinkADRAnsPayload)
+			if !ok {
+				return fmt.Errorf("expected *lorawan.LinkADRAnsPayload, got %T", block.MACCommands[i].Payload)
+			}
+			chMaskACK = chMaskACK && pl.ChannelMaskACK
+			drACK = drACK && pl.DataRateACK
+			powerACK = powerACK && pl.PowerACK
+		}
+
+		ec.ChannelsStatus.SetLinkADRAns(chMaskACK, drACK, powerACK)
+	}
+
+	if ec.ChannelsStatus.State != storage.DeviceChannelsRejected && ec.IsAppliedTo(ds) {
+		ec.ChannelsStatus.State = storage.DeviceChannelsApplied
+	}
+
+	if err := storage.UpdateDeviceChannelsStatus(ctx, storage.DB(), ds.DevEUI, ec.ChannelsStatus); err != nil {
+		return errors.Wrap(err, "update channels status error")
+	}
+
+	if err := storage.DeleteDeviceExtraConfigurationsCache(ctx, ds.DevEUI); err != nil {
+		return errors.Wrap(err, "delete extra-config cache error")
+	}
+
+	return nil
+}
+
+// isChannelReconfigurationLinkADRReq returns true when the channel-mask of
+// the given pending LinkADRReq mac-command results in the configured
+// channels.
+func isChannelReconfigurationLinkADRReq(ds storage.DeviceSession, ec storage.DeviceExtraConfigurations, pending *storage.MACCommandBlock) bool {
+	if pending == nil || len(pending.MACCommands) == 0 {
+		return false
+	}
+
+	var pls []lorawan.LinkADRReqPayload
+	for i := range pending.MACCommands {
+		pl, ok := pending.MACCommands[i].Payload.(*lorawan.LinkADRReqPayload)
+		if !ok {
+			return false
+		}
+		pls = append(pls, *pl)
+	}
+
+	chans, err := channels.GetEnabledUplinkChannelIndicesForLinkADRReqPayloads(ds, pls)
+	if err != nil || len(chans) != len(ec.EnabledChannels) {
+		return false
+	}
+
+	configured := make(map[int]struct{})
+	for _, i := range ec.EnabledChannels {
+		configured[int(i)] = struct{}{}
+	}
+	for _, i := range chans {
+		if _, ok := configured[i]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -25,6 +25,9 @@ type roamingDataContext struct {
 	macPayload *lorawan.MACPayload
 
 	prDeviceSessions []storage.PassiveRoamingDeviceSession
+
+	// NetIDs to which the uplink has been forwarded
+	forwardedNetIDs []lorawan.NetID
 }
 
 // HandleRoamingFNS handles an uplink as a fNS.
@@ -41,6 +44,7 @@ func HandleRoamingFNS(ctx context.Context, rxPacket models.RXPacket, macPL *lora
 		cctx.startPassiveRoamingSessions,
 		cctx.forwardUplinkMessageForSessions,
 		cctx.saveSessions,
+		cctx.saveRoamingUsage,
 	} {
 		if err := f(); err != nil {
 			if err == ErrAbort {
@@ -109,6 +113,9 @@ func (ctx *roamingDataContext) startPassiveRoamingSessions() error {
 			continue
 		}
 
+		// the PRStartReq contains the uplink
+		ctx.addForwardedNetID(netID)
+
 		// No need to store the device-session or call XmitDataReq when
 		// lifetime is not set (stateless passive-roaming).
 		var nullTime time.Time
@@ -144,6 +151,8 @@ func (ctx *roamingDataContext) forwardUplinkMessageForSessions() error {
 			continue
 		}
 
+		ctx.addForwardedNetID(ds.NetID)
+
 		log.WithFields(log.Fields{
 			"dev_addr":                          ctx.macPayload.FHDR.DevAddr,
 			"net_id":                            ds.NetID,
@@ -170,6 +179,42 @@ func (ctx *roamingDataContext) saveSessions() error {
 	return nil
 }
 
+func (ctx *roamingDataContext) saveRoamingUsage() error {
+	if len(ctx.forwardedNetIDs) == 0 {
+		return nil
+	}
+
+	b, err := ctx.rxPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshal phypayload error")
+	}
+
+	gatewayIDs := roaming.GatewayIDsFromRXInfo(ctx.rxPacket.RXInfoSet)
+
+	for _, netID := range ctx.forwardedNetIDs {
+		roaming.RecordUsage(ctx.ctx, storage.RoamingUsage{
+			NetID:       netID,
+			Role:        storage.RoamingRoleFNS,
+			UplinkCount: 1,
+			UplinkBytes: len(b),
+			GatewayIDs:  gatewayIDs,
+		})
+	}
+
+	return nil
+}
+
+// addForwardedNetID adds the given NetID to the NetIDs to which the uplink
+// has been forwarded. An uplink is counted only once per NetID.
+func (ctx *roamingDataContext) addForwardedNetID(netID lorawan.NetID) {
+	for _, id := range ctx.forwardedNetIDs {
+		if id == netID {
+			return
+		}
+	}
+	ctx.forwardedNetIDs = append(ctx.forwardedNetIDs, netID)
+}
+
 func (ctx *roamingDataContext) startPassiveRoamingSession(netID lorawan.NetID) (storage.PassiveRoamingDeviceSession, error) {
 	var out storage.PassiveRoamingDeviceSession
 
@@ -7,8 +7,12 @@ import (
 
 	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/backend"
+	"github.com/kamicuu/chirpstack-api/go/v3/as"
+	"github.com/kamicuu/chirpstack-api/go/v3/common"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
 // HandleRoamingHNS handles an uplink as a hNS.
@@ -43,10 +47,118 @@ func HandleRoamingHNS(ctx context.Context, phyPayload []byte, basePL backend.Bas
 		rxPacket.DR = *ulMetaData.DataRate
 	}
 
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(basePL.SenderID)); err != nil {
+		return errors.Wrap(err, "decode senderid error")
+	}
+
 	// Start the uplink data flow
 	if err := Handle(ctx, rxPacket); err != nil {
 		return errors.Wrap(err, "handle uplink error")
 	}
 
+	roaming.RecordUsage(ctx, storage.RoamingUsage{
+		NetID:       netID,
+		Role:        storage.RoamingRoleHNS,
+		UplinkCount: 1,
+		UplinkBytes: len(phyPayload),
+		GatewayIDs:  roaming.GatewayIDsFromRXInfo(rxInfo),
+	})
+
+	return nil
+}
+
+// HandleHandoverRoamingHNS handles an application payload forwarded by the
+// sNS to which the MAC-layer control of the device has been handed over.
+// As the sNS has already handled the MAC-layer, the payload is forwarded to
+// the application-server as-is. Only the sNS identified by the given NetID
+// to which the device was handed over is allowed to forward payloads.
+func HandleHandoverRoamingHNS(ctx context.Context, netID lorawan.NetID, frmPayload []byte, ulMetaData backend.ULMetaData) error {
+	if ulMetaData.DevEUI == nil || ulMetaData.FPort == nil || ulMetaData.FCntUp == nil {
+		return errors.Wrap(roaming.ErrMalformedRequest, "DevEUI, FPort and FCntUp are required")
+	}
+
+	hr, err := storage.GetHandoverRoamingHNSDeviceSession(ctx, *ulMetaData.DevEUI)
+	if err != nil {
+		return errors.Wrap(err, "get handover-roaming hns device-session error")
+	}
+
+	if hr.NetID != netID {
+		return errors.Wrap(storage.ErrDoesNotExist, "device was not handed over to the sender NetID")
+	}
+
+	d, err := storage.GetDevice(ctx, storage.DB(), hr.DevEUI, false)
+	if err != nil {
+		return errors.Wrap(err, "get device error")
+	}
+
+	sp, err := storage.GetAndCacheServiceProfile(ctx, storage.DB(), d.ServiceProfileID)
+	if err != nil {
+		return errors.Wrap(err, "get service-profile error")
+	}
+
+	asClient, err := helpers.GetASClientForRoutingProfileID(ctx, d.RoutingProfileID)
+	if err != nil {
+		return errors.Wrap(err, "get application-server client error")
+	}
+
+	txInfo, err := roaming.ULMetaDataToTXInfo(ulMetaData)
+	if err != nil {
+		return errors.Wrap(err, "ul meta-data to txinfo error")
+	}
+	rxInfo, err := roaming.ULMetaDataToRXInfo(ulMetaData)
+	if err != nil {
+		return errors.Wrap(err, "ul meta-data to rxinfo error")
+	}
+
+	req := as.HandleUplinkDataRequest{
+		DevEui:          hr.DevEUI[:],
+		JoinEui:         hr.JoinEUI[:],
+		FCnt:            *ulMetaData.FCntUp,
+		FPort:           uint32(*ulMetaData.FPort),
+		TxInfo:          txInfo,
+		ConfirmedUplink: ulMetaData.Confirmed,
+		Data:            frmPayload,
+	}
+
+	if ulMetaData.DataRate != nil {
+		req.Dr = uint32(*ulMetaData.DataRate)
+	}
+
+	// The AppSKey is sent to the application-server with the first uplink
+	// after the activation.
+	if hr.AppSKeyEnvelope != nil {
+		req.DeviceActivationContext = &as.DeviceActivationContext{
+			DevAddr: hr.DevAddr[:],
+			AppSKey: &common.KeyEnvelope{
+				KekLabel: hr.AppSKeyEnvelope.KEKLabel,
+				AesKey:   hr.AppSKeyEnvelope.AESKey,
+			},
+		}
+	}
+
+	if sp.AddGWMetadata {
+		req.RxInfo = rxInfo
+	}
+
+	if _, err := asClient.HandleUplinkData(ctx, &req); err != nil {
+		return errors.Wrap(err, "publish uplink data to application-server error")
+	}
+
+	if hr.AppSKeyEnvelope != nil {
+		hr.AppSKeyEnvelope = nil
+		if err := storage.SaveHandoverRoamingHNSDeviceSession(ctx, hr); err != nil {
+			return errors.Wrap(err, "save handover-roaming hns device-session error")
+		}
+	}
+
+	roaming.RecordUsage(ctx, storage.RoamingUsage{
+		NetID:       netID,
+		Role:        storage.RoamingRoleHNS,
+		UplinkCount: 1,
+		UplinkBytes: len(frmPayload),
+		GatewayIDs:  roaming.GatewayIDsFromRXInfo(rxInfo),
+	})
+
 	return nil
 }
@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/brocaar/lorawan"
+	"github.com/brocaar/lorawan/backend"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
+)
+
+const homeNSClientTimeout = 5 * time.Second
+
+// getHandoverRoamingDeviceSession sets the handover-roaming device-session
+// in case the MAC-layer control of the device has been handed over to this
+// Network Server (sNS). An expired session is deleted.
+func getHandoverRoamingDeviceSession(ctx *dataContext) error {
+	if !roaming.IsRoamingEnabled() {
+		return nil
+	}
+
+	hr, err := storage.GetHandoverRoamingDeviceSession(ctx.ctx, ctx.DeviceSession.DevEUI)
+	if err != nil {
+		if errors.Cause(err) == storage.ErrDoesNotExist {
+			return nil
+		}
+		return errors.Wrap(err, "get handover-roaming device-session error")
+	}
+
+	if hr.IsExpired() {
+		log.WithFields(log.Fields{
+			"dev_eui": hr.DevEUI,
+			"net_id":  hr.NetID,
+			"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+		}).Info("uplink/data: handover-roaming session expired")
+
+		if err := roaming.DeleteHandoverRoamingDeviceSession(ctx.ctx, hr); err != nil {
+			return err
+		}
+
+		return ErrAbort
+	}
+
+	ctx.HandoverRoamingDeviceSession = &hr
+	return nil
+}
+
+// sendFRMPayloadToHomeNS forwards the (encrypted) application payload to the
+// hNS of the handed-over device using a XmitDataReq.
+func sendFRMPayloadToHomeNS(ctx *dataContext) error {
+	// mac-commands are handled by the sNS
+	if ctx.MACPayload.FPort == nil || *ctx.MACPayload.FPort == 0 || len(ctx.MACPayload.FRMPayload) != 1 {
+		return nil
+	}
+
+	dataPL, ok := ctx.MACPayload.FRMPayload[0].(*lorawan.DataPayload)
+	if !ok {
+		return fmt.Errorf("expected type *lorawan.DataPayload, got %T", ctx.MACPayload.FRMPayload[0])
+	}
+
+	client, err := roaming.GetClientForNetID(ctx.HandoverRoamingDeviceSession.NetID)
+	if err != nil {
+		return errors.Wrap(err, "get roaming client error")
+	}
+
+	devEUI := ctx.DeviceSession.DevEUI
+	devAddr := ctx.DeviceSession.DevAddr
+	fPort := *ctx.MACPayload.FPort
+	fCnt := ctx.MACPayload.FHDR.FCnt
+	dr := ctx.RXPacket.DR
+	ulFreq := float64(ctx.RXPacket.TXInfo.Frequency) / 1000000
+	gwCnt := len(ctx.RXPacket.RXInfoSet)
+
+	req := backend.XmitDataReqPayload{
+		FRMPayload: backend.HEXBytes(dataPL.Bytes),
+		ULMetaData: &backend.ULMetaData{
+			DevEUI:    &devEUI,
+			DevAddr:   &devAddr,
+			FPort:     &fPort,
+			FCntUp:    &fCnt,
+			Confirmed: ctx.RXPacket.PHYPayload.MHDR.MType == lorawan.ConfirmedDataUp,
+			DataRate:  &dr,
+			ULFreq:    &ulFreq,
+			RecvTime:  roaming.RecvTimeFromRXInfo(ctx.RXPacket.RXInfoSet),
+			RFRegion:  band.Band().Name(),
+			GWCnt:     &gwCnt,
+		},
+	}
+
+	if ctx.ServiceProfile.AddGWMetadata {
+		gwInfo, err := roaming.RXInfoToGWInfo(ctx.RXPacket.RXInfoSet)
+		if err != nil {
+			return errors.Wrap(err, "rxinfo to gwinfo error")
+		}
+		req.ULMetaData.GWInfo = gwInfo
+	}
+
+	usage := storage.RoamingUsage{
+		NetID:       ctx.HandoverRoamingDeviceSession.NetID,
+		Role:        storage.RoamingRoleFNS,
+		UplinkCount: 1,
+		UplinkBytes: len(dataPL.Bytes),
+		GatewayIDs:  roaming.GatewayIDsFromRXInfo(ctx.RXPacket.RXInfoSet),
+	}
+
+	go func(ctx context.Context, client backend.Client, req backend.XmitDataReqPayload) {
+		ctxTimeout, cancel := context.WithTimeout(ctx, homeNSClientTimeout)
+		defer cancel()
+
+		resp, err := client.XmitDataReq(ctxTimeout, req)
+		if err == nil && resp.Result.ResultCode != backend.Success {
+			err = fmt.Errorf("expected: %s, got: %s (%s)", backend.Success, resp.Result.ResultCode, resp.Result.Description)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"dev_eui": req.ULMetaData.DevEUI,
+				"ctx_id":  ctx.Value(logging.ContextIDKey),
+			}).WithError(err).Error("uplink/data: forward uplink to hNS error")
+			return
+		}
+
+		roaming.RecordUsage(ctx, usage)
+	}(context.WithValue(context.Background(), logging.ContextIDKey, ctx.ctx.Value(logging.ContextIDKey)), client, req)
+
+	return nil
+}
+
+// saveHandoverRoamingDeviceSession saves the handover-roaming device-session,
+// so that its TTL is in line with the TTL of the device-session.
+func saveHandoverRoamingDeviceSession(ctx *dataContext) error {
+	if err := storage.SaveHandoverRoamingDeviceSession(ctx.ctx, *ctx.HandoverRoamingDeviceSession); err != nil {
+		return errors.Wrap(err, "save handover-roaming device-session error")
+	}
+	return nil
+}
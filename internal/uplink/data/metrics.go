@@ -0,0 +1,30 @@
+package data
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// The gateway diversity is aggregated over all devices, as a per-device
+	// label would result in an unbounded number of series. The per-device
+	// gateway diversity is returned by the GetDeviceActivation API.
+	gdh = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "uplink_data_gateway_diversity",
+		Help:    "The number of gateways receiving a data uplink (over all devices).",
+		Buckets: []float64{1, 2, 3, 4, 5, 10},
+	})
+
+	bmc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "uplink_data_below_min_gw_diversity_count",
+		Help: "The number of data uplinks received by fewer gateways than the service-profile min. gateway diversity (per action).",
+	}, []string{"action"})
+)
+
+func gatewayDiversityHistogram() prometheus.Observer {
+	return gdh
+}
+
+func belowMinGWDiversityCounter(action string) prometheus.Counter {
+	return bmc.With(prometheus.Labels{"action": action})
+}
@@ -50,6 +50,8 @@ type joinContext struct {
 
 	PRStartReqPayload *backend.PRStartReqPayload
 	PRStartAnsPayload *backend.PRStartAnsPayload
+	HRStartReqPayload *backend.HRStartReqPayload
+	HRStartAnsPayload *backend.HRStartAnsPayload
 }
 
 var (
@@ -103,6 +105,8 @@ func Handle(ctx context.Context, rxPacket models.RXPacket) error {
 			jctx.getJoinAcceptFromAS,
 			jctx.sendUplinkMetaDataToNetworkController,
 			jctx.flushDeviceQueue,
+			jctx.stopPassiveRoamingSessions,
+			jctx.stopHandoverRoamingSession,
 			jctx.createDeviceSession,
 			jctx.createDeviceActivation,
 			jctx.setDeviceMode,
@@ -152,14 +156,16 @@ func (ctx *joinContext) getDeviceOrTryRoaming() error {
 	var err error
 	ctx.Device, err = storage.GetDevice(ctx.ctx, ctx.tx, ctx.JoinRequestPayload.DevEUI, true)
 	if err != nil {
-		if errors.Cause(err) == storage.ErrDoesNotExist && roaming.IsRoamingEnabled() {
+		// Roaming is only initiated for join-requests received by our own
+		// gateways, not for join-requests forwarded by a roaming partner.
+		if errors.Cause(err) == storage.ErrDoesNotExist && roaming.IsRoamingEnabled() && ctx.PRStartReqPayload == nil && ctx.HRStartReqPayload == nil {
 			log.WithFields(log.Fields{
 				"ctx_id":   ctx.ctx.Value(logging.ContextIDKey),
 				"dev_eui":  ctx.JoinRequestPayload.DevEUI,
 				"join_eui": ctx.JoinRequestPayload.JoinEUI,
-			}).Info("uplink/join: unknown device, try passive-roaming activation")
+			}).Info("uplink/join: unknown device, try roaming activation")
 
-			if err := StartPRFNS(ctx.ctx, ctx.RXPacket, ctx.JoinRequestPayload); err != nil {
+			if err := StartRoamingFNS(ctx.ctx, ctx.RXPacket, ctx.JoinRequestPayload); err != nil {
 				return err
 			}
 
@@ -255,6 +261,12 @@ func (ctx *joinContext) validateNonce() error {
 }
 
 func (ctx *joinContext) getRandomDevAddr() error {
+	// With handover-roaming, the DevAddr is allocated by the sNS.
+	if ctx.HRStartReqPayload != nil {
+		ctx.DevAddr = ctx.HRStartReqPayload.DevAddr
+		return nil
+	}
+
 	devAddr, err := storage.GetRandomDevAddr(netID)
 	if err != nil {
 		return errors.Wrap(err, "get random DevAddr error")
@@ -286,6 +298,19 @@ func (ctx *joinContext) getJoinAcceptFromAS() error {
 		}
 	}
 
+	// With handover-roaming, the device is served by the sNS, thus the
+	// radio parameters of the sNS must be used.
+	dlSettings := lorawan.DLSettings{
+		RX2DataRate: uint8(rx2DR),
+		RX1DROffset: uint8(rx1DROffset),
+	}
+	rxDelay := rx1Delay
+	if ctx.HRStartReqPayload != nil {
+		dlSettings = ctx.HRStartReqPayload.DLSettings
+		rxDelay = ctx.HRStartReqPayload.RxDelay
+		cFListB = ctx.HRStartReqPayload.CFList[:]
+	}
+
 	// note about the OptNeg field:
 	// it must only be set to true for devices != 1.0.x as it will indicate to
 	// the join-server and device how to derive the session-keys and how to
@@ -305,10 +330,10 @@ func (ctx *joinContext) getJoinAcceptFromAS() error {
 		DevAddr:    ctx.DevAddr,
 		DLSettings: lorawan.DLSettings{
 			OptNeg:      !strings.HasPrefix(ctx.DeviceProfile.MACVersion, "1.0"), // must be set to true for != "1.0" devices
-			RX2DataRate: uint8(rx2DR),
-			RX1DROffset: uint8(rx1DROffset),
+			RX2DataRate: dlSettings.RX2DataRate,
+			RX1DROffset: dlSettings.RX1DROffset,
 		},
-		RxDelay: rx1Delay,
+		RxDelay: rxDelay,
 		CFList:  backend.HEXBytes(cFListB),
 	}
 
@@ -393,7 +418,73 @@ func (ctx *joinContext) flushDeviceQueue() error {
 	return nil
 }
 
+// stopPassiveRoamingSessions stops the passive-roaming sessions that were
+// started (as hNS) for the previous device-session. In case the join-request
+// was received through passive-roaming, the session with the requesting fNS
+// is replaced by the PRStartAns and is not stopped.
+func (ctx *joinContext) stopPassiveRoamingSessions() error {
+	var exclude []lorawan.NetID
+	if ctx.PRStartReqPayload != nil {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(ctx.PRStartReqPayload.BasePayload.SenderID)); err != nil {
+			return errors.Wrap(err, "decode netid error")
+		}
+		exclude = append(exclude, netID)
+	}
+
+	if err := roaming.StopPassiveRoaming(ctx.ctx, ctx.Device.DevEUI, exclude...); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"dev_eui": ctx.Device.DevEUI,
+			"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+		}).Error("uplink/join: stop passive-roaming sessions error")
+	}
+
+	return nil
+}
+
+// stopHandoverRoamingSession stops the handover-roaming session that was
+// started (as hNS) for the previous device-session. In case the join-request
+// was received through handover-roaming, the session with the requesting
+// sNS is replaced by the HRStartAns and is not stopped.
+func (ctx *joinContext) stopHandoverRoamingSession() error {
+	var exclude []lorawan.NetID
+	if ctx.HRStartReqPayload != nil {
+		var netID lorawan.NetID
+		if err := netID.UnmarshalText([]byte(ctx.HRStartReqPayload.BasePayload.SenderID)); err != nil {
+			return errors.Wrap(err, "decode netid error")
+		}
+		exclude = append(exclude, netID)
+	}
+
+	if err := roaming.StopHandoverRoamingHNS(ctx.ctx, ctx.Device.DevEUI, exclude...); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"dev_eui": ctx.Device.DevEUI,
+			"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+		}).Error("uplink/join: stop handover-roaming session error")
+	}
+
+	return nil
+}
+
 func (ctx *joinContext) createDeviceSession() error {
+	if err := ctx.setDeviceSession(); err != nil {
+		return err
+	}
+
+	if err := storage.SaveDeviceSession(ctx.ctx, ctx.DeviceSession); err != nil {
+		return errors.Wrap(err, "save node-session error")
+	}
+
+	if err := storage.FlushMACCommandQueue(ctx.ctx, ctx.DeviceSession.DevEUI); err != nil {
+		return fmt.Errorf("flush mac-command queue error: %s", err)
+	}
+
+	return nil
+}
+
+// setDeviceSession sets the device-session, using the session-keys
+// returned by the join-server. It does not store the device-session.
+func (ctx *joinContext) setDeviceSession() error {
 	ds := storage.DeviceSession{
 		DeviceProfileID:  ctx.Device.DeviceProfileID,
 		ServiceProfileID: ctx.Device.ServiceProfileID,
@@ -501,14 +592,6 @@ func (ctx *joinContext) createDeviceSession() error {
 
 	ctx.DeviceSession = ds
 
-	if err := storage.SaveDeviceSession(ctx.ctx, ctx.DeviceSession); err != nil {
-		return errors.Wrap(err, "save node-session error")
-	}
-
-	if err := storage.FlushMACCommandQueue(ctx.ctx, ctx.DeviceSession.DevEUI); err != nil {
-		return fmt.Errorf("flush mac-command queue error: %s", err)
-	}
-
 	return nil
 }
 
@@ -568,6 +651,13 @@ func (ctx *joinContext) setPRStartAnsPayload() error {
 	lifetime := int(roaming.GetPassiveRoamingLifetime(netID) / time.Second)
 	fCntUp := uint32(0)
 
+	// keep track of the fNS, so that the session can be stopped
+	if lifetime != 0 {
+		if err := storage.AddPassiveRoamingNetIDForDevEUI(ctx.ctx, ctx.Device.DevEUI, netID, time.Duration(lifetime)*time.Second); err != nil {
+			return errors.Wrap(err, "add passive-roaming netid error")
+		}
+	}
+
 	// sess keys
 	kekLabel := roaming.GetPassiveRoamingKEKLabel(netID)
 	var kekKey []byte
@@ -592,19 +682,10 @@ func (ctx *joinContext) setPRStartAnsPayload() error {
 		}
 	}
 
-	classA := "A"
-	rxDelay1 := int(band.Band().GetDefaults().JoinAcceptDelay1 / time.Second)
-	rx1DR, err := band.Band().GetRX1DataRateIndex(ctx.RXPacket.DR, 0)
+	dlMetaData, err := ctx.getJoinAcceptDLMetaData(ctx.PRStartReqPayload.ULMetaData)
 	if err != nil {
-		return errors.Wrap(err, "get rx1 data-rate error")
-	}
-	rx2DR := band.Band().GetDefaults().RX2DataRate
-	dlFreq1, err := band.Band().GetRX1FrequencyForUplinkFrequency(ctx.RXPacket.TXInfo.Frequency)
-	if err != nil {
-		return errors.Wrap(err, "get rx1 frequency error")
+		return err
 	}
-	dlFreq1Mhz := float64(dlFreq1) / 1000000
-	dlFreq2Mhz := float64(band.Band().GetDefaults().RX2Frequency) / 1000000
 
 	ctx.PRStartAnsPayload = &backend.PRStartAnsPayload{
 		PHYPayload:  ctx.JoinAnsPayload.PHYPayload,
@@ -614,23 +695,7 @@ func (ctx *joinContext) setPRStartAnsPayload() error {
 		FNwkSIntKey: fNwkSIntKey,
 		NwkSKey:     nwkSKey,
 		FCntUp:      &fCntUp,
-		DLMetaData: &backend.DLMetaData{
-			DevEUI:     &ctx.DeviceSession.DevEUI,
-			DLFreq1:    &dlFreq1Mhz,
-			DLFreq2:    &dlFreq2Mhz,
-			RXDelay1:   &rxDelay1,
-			ClassMode:  &classA,
-			DataRate1:  &rx1DR,
-			DataRate2:  &rx2DR,
-			FNSULToken: ctx.PRStartReqPayload.ULMetaData.FNSULToken,
-		},
-	}
-
-	for i := range ctx.PRStartReqPayload.ULMetaData.GWInfo {
-		gwInfo := ctx.PRStartReqPayload.ULMetaData.GWInfo[i]
-		ctx.PRStartAnsPayload.DLMetaData.GWInfo = append(ctx.PRStartAnsPayload.DLMetaData.GWInfo, backend.GWInfoElement{
-			ULToken: gwInfo.ULToken,
-		})
+		DLMetaData:  dlMetaData,
 	}
 
 	return nil
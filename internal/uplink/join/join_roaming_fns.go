@@ -2,6 +2,7 @@ package join
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -12,6 +13,7 @@ import (
 	"github.com/brocaar/lorawan/backend"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/backend/joinserver"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/join"
 	dlroaming "github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
@@ -20,28 +22,36 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
-type startPRFNSContext struct {
+type startRoamingFNSContext struct {
 	ctx                context.Context
 	rxPacket           models.RXPacket
 	joinRequestPayload *lorawan.JoinRequestPayload
 	homeNetID          lorawan.NetID
-	nsClient           backend.Client
+	nsClient           roaming.Client
+	profileAns         backend.ProfileAnsPayload
+	activationType     backend.RoamingType
 	prStartAns         backend.PRStartAnsPayload
 }
 
-// StartPRFNS initiates the passive-roaming OTAA as a fNS.
-func StartPRFNS(ctx context.Context, rxPacket models.RXPacket, jrPL *lorawan.JoinRequestPayload) error {
-	cctx := startPRFNSContext{
+// StartRoamingFNS initiates the roaming OTAA of a device which is not known
+// to this Network Server. When the hNS allows handover-roaming for the
+// device, this Network Server takes over the MAC-layer control as sNS,
+// else it initiates the passive-roaming OTAA as a fNS.
+func StartRoamingFNS(ctx context.Context, rxPacket models.RXPacket, jrPL *lorawan.JoinRequestPayload) error {
+	cctx := startRoamingFNSContext{
 		ctx:                ctx,
 		rxPacket:           rxPacket,
 		joinRequestPayload: jrPL,
+		activationType:     backend.Passive,
 	}
 
 	for _, f := range []func() error{
 		cctx.filterRxInfoByPublicOnly,
 		cctx.getHomeNetID,
 		cctx.getNSClient,
-		cctx.startRoaming,
+		cctx.getRoamingActivationType,
+		cctx.startHandoverRoaming,
+		cctx.startPassiveRoaming,
 		cctx.saveRoamingSession,
 	} {
 		if err := f(); err != nil {
@@ -56,7 +66,7 @@ func StartPRFNS(ctx context.Context, rxPacket models.RXPacket, jrPL *lorawan.Joi
 	return nil
 }
 
-func (ctx *startPRFNSContext) filterRxInfoByPublicOnly() error {
+func (ctx *startRoamingFNSContext) filterRxInfoByPublicOnly() error {
 	err := helpers.FilterRxInfoByPublicOnly(&ctx.rxPacket)
 	if err != nil {
 		if err == helpers.ErrNoElements {
@@ -71,7 +81,7 @@ func (ctx *startPRFNSContext) filterRxInfoByPublicOnly() error {
 	return nil
 }
 
-func (ctx *startPRFNSContext) getHomeNetID() error {
+func (ctx *startRoamingFNSContext) getHomeNetID() error {
 	jsClient, err := joinserver.GetClientForJoinEUI(ctx.joinRequestPayload.JoinEUI)
 	if err != nil {
 		return errors.Wrap(err, "get js client for joineui error")
@@ -97,7 +107,7 @@ func (ctx *startPRFNSContext) getHomeNetID() error {
 	return nil
 }
 
-func (ctx *startPRFNSContext) getNSClient() error {
+func (ctx *startRoamingFNSContext) getNSClient() error {
 	client, err := roaming.GetClientForNetID(ctx.homeNetID)
 	if err != nil {
 		if err == roaming.ErrNoAgreement {
@@ -116,31 +126,136 @@ func (ctx *startPRFNSContext) getNSClient() error {
 	return nil
 }
 
-func (ctx *startPRFNSContext) startRoaming() error {
+// getRoamingActivationType requests the device-profile and the roaming
+// activation type from the hNS. This is only done when handover-roaming is
+// allowed by the roaming agreement, else passive-roaming is used.
+func (ctx *startRoamingFNSContext) getRoamingActivationType() error {
+	if !roaming.IsHandoverRoamingAllowed(ctx.homeNetID) {
+		return nil
+	}
+
+	ans, err := ctx.nsClient.ProfileReq(ctx.ctx, backend.ProfileReqPayload{
+		DevEUI: ctx.joinRequestPayload.DevEUI,
+	})
+	if err != nil {
+		// The hNS might not implement the ProfileReq, in which case the
+		// passive-roaming activation is still possible.
+		log.WithError(err).WithFields(log.Fields{
+			"net_id":  ctx.homeNetID,
+			"dev_eui": ctx.joinRequestPayload.DevEUI,
+			"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+		}).Warning("uplink/join: ProfileReq error, falling back to passive-roaming")
+		return nil
+	}
+
+	if ans.RoamingActivationType != nil && *ans.RoamingActivationType == backend.Handover {
+		// The MACVersion is needed to construct the HRStartReq, it might
+		// not be disclosed by the hNS.
+		if ans.DeviceProfile == nil || ans.DeviceProfile.MACVersion == "" {
+			log.WithFields(log.Fields{
+				"net_id":  ctx.homeNetID,
+				"dev_eui": ctx.joinRequestPayload.DevEUI,
+				"ctx_id":  ctx.ctx.Value(logging.ContextIDKey),
+			}).Warning("uplink/join: ProfileAns does not contain MACVersion, falling back to passive-roaming")
+			return nil
+		}
+
+		ctx.profileAns = ans
+		ctx.activationType = backend.Handover
+	}
+
+	return nil
+}
+
+// startHandoverRoaming sends the HRStartReq to the hNS, using a DevAddr
+// allocated by this Network Server (sNS). On success, the device-session
+// is created using the session-keys returned by the hNS and the join-accept
+// is sent to the device.
+func (ctx *startRoamingFNSContext) startHandoverRoaming() error {
+	if ctx.activationType != backend.Handover {
+		return nil
+	}
+
+	devAddr, err := storage.GetRandomDevAddr(netID)
+	if err != nil {
+		return errors.Wrap(err, "get random DevAddr error")
+	}
+
 	phyB, err := ctx.rxPacket.PHYPayload.MarshalBinary()
 	if err != nil {
 		return errors.Wrap(err, "marshal phypayload error")
 	}
 
-	gwCnt := len(ctx.rxPacket.RXInfoSet)
-	gwInfo, err := roaming.RXInfoToGWInfo(ctx.rxPacket.RXInfoSet)
+	ulMetaData, err := ctx.getULMetaData()
 	if err != nil {
-		return errors.Wrap(err, "rxinfo to gwinfo error")
+		return err
 	}
 
-	ulFreq := float64(ctx.rxPacket.TXInfo.Frequency) / 1000000
+	dp := *ctx.profileAns.DeviceProfile
+	macVersion := dp.MACVersion
+
+	var cFListB []byte
+	if cFList := band.Band().GetCFList(macVersion); cFList != nil {
+		cFListB, err = cFList.MarshalBinary()
+		if err != nil {
+			return errors.Wrap(err, "marshal cflist error")
+		}
+	}
+
+	hrReq := backend.HRStartReqPayload{
+		MACVersion:    macVersion,
+		PHYPayload:    backend.HEXBytes(phyB),
+		DevAddr:       devAddr,
+		DeviceProfile: dp,
+		ULMetaData:    ulMetaData,
+		DLSettings: lorawan.DLSettings{
+			OptNeg:      !strings.HasPrefix(macVersion, "1.0"), // must be set to true for != "1.0" devices
+			RX2DataRate: uint8(rx2DR),
+			RX1DROffset: uint8(rx1DROffset),
+		},
+		RxDelay: rx1Delay,
+		CFList:  backend.HEXBytes(cFListB),
+	}
+	if ctx.profileAns.DeviceProfileTimestamp != nil {
+		hrReq.DeviceProfileTimestamp = *ctx.profileAns.DeviceProfileTimestamp
+	}
+
+	hrAns, err := ctx.nsClient.HRStartReq(ctx.ctx, hrReq)
+	if err != nil {
+		return errors.Wrap(err, "HRStartReq error")
+	}
+
+	ds, err := roaming.StartHandoverRoaming(ctx.ctx, ctx.homeNetID, ctx.joinRequestPayload.DevEUI, ctx.joinRequestPayload.JoinEUI, hrReq, hrAns)
+	if err != nil {
+		return errors.Wrap(err, "start handover-roaming error")
+	}
+
+	var phy lorawan.PHYPayload
+	if err := phy.UnmarshalBinary(hrAns.PHYPayload[:]); err != nil {
+		return errors.Wrap(err, "unmarshal downlink phypayload error")
+	}
+
+	if err := join.Handle(ctx.ctx, ds, ctx.rxPacket, phy); err != nil {
+		return errors.Wrap(err, "run join-response flow error")
+	}
+
+	return ErrAbort
+}
+
+func (ctx *startRoamingFNSContext) startPassiveRoaming() error {
+	phyB, err := ctx.rxPacket.PHYPayload.MarshalBinary()
+	if err != nil {
+		return errors.Wrap(err, "marshal phypayload error")
+	}
+
+	ulMetaData, err := ctx.getULMetaData()
+	if err != nil {
+		return err
+	}
 
 	prReq := backend.PRStartReqPayload{
 		PHYPayload: backend.HEXBytes(phyB),
-		ULMetaData: backend.ULMetaData{
-			DevEUI:   &ctx.joinRequestPayload.DevEUI,
-			ULFreq:   &ulFreq,
-			DataRate: &ctx.rxPacket.DR,
-			RecvTime: roaming.RecvTimeFromRXInfo(ctx.rxPacket.RXInfoSet),
-			RFRegion: band.Band().Name(),
-			GWCnt:    &gwCnt,
-			GWInfo:   gwInfo,
-		},
+		ULMetaData: ulMetaData,
 	}
 
 	ctx.prStartAns, err = ctx.nsClient.PRStartReq(ctx.ctx, prReq)
@@ -159,7 +274,27 @@ func (ctx *startPRFNSContext) startRoaming() error {
 	return nil
 }
 
-func (ctx *startPRFNSContext) saveRoamingSession() error {
+func (ctx *startRoamingFNSContext) getULMetaData() (backend.ULMetaData, error) {
+	gwCnt := len(ctx.rxPacket.RXInfoSet)
+	gwInfo, err := roaming.RXInfoToGWInfo(ctx.rxPacket.RXInfoSet)
+	if err != nil {
+		return backend.ULMetaData{}, errors.Wrap(err, "rxinfo to gwinfo error")
+	}
+
+	ulFreq := float64(ctx.rxPacket.TXInfo.Frequency) / 1000000
+
+	return backend.ULMetaData{
+		DevEUI:   &ctx.joinRequestPayload.DevEUI,
+		ULFreq:   &ulFreq,
+		DataRate: &ctx.rxPacket.DR,
+		RecvTime: roaming.RecvTimeFromRXInfo(ctx.rxPacket.RXInfoSet),
+		RFRegion: band.Band().Name(),
+		GWCnt:    &gwCnt,
+		GWInfo:   gwInfo,
+	}, nil
+}
+
+func (ctx *startRoamingFNSContext) saveRoamingSession() error {
 	if ctx.prStartAns.DevAddr == nil || ctx.prStartAns.Lifetime == nil || *ctx.prStartAns.Lifetime == 0 {
 		return nil
 	}
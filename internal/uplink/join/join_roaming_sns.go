@@ -2,11 +2,15 @@ package join
 
 import (
 	"context"
+	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/brocaar/lorawan"
 	"github.com/brocaar/lorawan/backend"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/band"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/roaming"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/storage"
 )
 
@@ -32,6 +36,8 @@ func HandleStartPRHNS(ctx context.Context, prStartPL backend.PRStartReqPayload,
 		jctx.getJoinAcceptFromAS,
 		jctx.sendUplinkMetaDataToNetworkController,
 		jctx.flushDeviceQueue,
+		jctx.stopPassiveRoamingSessions,
+		jctx.stopHandoverRoamingSession,
 		jctx.createDeviceSession,
 		jctx.createDeviceActivation,
 		jctx.setDeviceMode,
@@ -48,3 +54,200 @@ func HandleStartPRHNS(ctx context.Context, prStartPL backend.PRStartReqPayload,
 
 	return backend.PRStartAnsPayload{}, errors.New("PRStartAnsPayload is not set")
 }
+
+// HandleStartHRHNS handles starting a handover-roaming OTAA activation as
+// the hNS. The join-request is forwarded to the join-server using the
+// DevAddr and radio parameters of the sNS, after which the MAC-layer control
+// is handed over to the sNS. This Network Server keeps the application-layer
+// control, it does not keep a device-session.
+func HandleStartHRHNS(ctx context.Context, hrStartPL backend.HRStartReqPayload, rxPacket models.RXPacket) (backend.HRStartAnsPayload, error) {
+	jctx := joinContext{
+		ctx:               ctx,
+		tx:                storage.DB(),
+		RXPacket:          rxPacket,
+		HRStartReqPayload: &hrStartPL,
+	}
+
+	for _, f := range []func() error{
+		jctx.setContextFromJoinRequestPHYPayload,
+		jctx.validateHRDevAddr,
+		jctx.logJoinRequestFramesCollected,
+		jctx.getDeviceOrTryRoaming,
+		jctx.getDeviceProfile,
+		jctx.getServiceProfile,
+		jctx.abortOnDeviceIsDisabled,
+		jctx.validateNonce,
+		jctx.getRandomDevAddr,
+		jctx.getJoinAcceptFromAS,
+		jctx.sendUplinkMetaDataToNetworkController,
+		jctx.flushDeviceQueue,
+		jctx.stopPassiveRoamingSessions,
+		jctx.stopHandoverRoamingSession,
+		jctx.setDeviceSession,
+		jctx.deleteDeviceSession,
+		jctx.createDeviceActivation,
+		jctx.setDeviceMode,
+		jctx.saveHandoverRoamingSession,
+		jctx.setHRStartAnsPayload,
+	} {
+		if err := f(); err != nil {
+			return backend.HRStartAnsPayload{}, err
+		}
+	}
+
+	if jctx.HRStartAnsPayload != nil {
+		return *jctx.HRStartAnsPayload, nil
+	}
+
+	return backend.HRStartAnsPayload{}, errors.New("HRStartAnsPayload is not set")
+}
+
+// validateHRDevAddr validates that the DevAddr allocated by the sNS belongs
+// to the NetID of the sNS.
+func (ctx *joinContext) validateHRDevAddr() error {
+	netID, err := ctx.getHRSenderNetID()
+	if err != nil {
+		return err
+	}
+
+	if !ctx.HRStartReqPayload.DevAddr.IsNetID(netID) {
+		return errors.Wrap(roaming.ErrMalformedRequest, "DevAddr does not match sender NetID")
+	}
+
+	return nil
+}
+
+// deleteDeviceSession deletes the device-session of the previous
+// activation, as the MAC-layer control is handed over to the sNS.
+func (ctx *joinContext) deleteDeviceSession() error {
+	if err := storage.DeleteDeviceSession(ctx.ctx, ctx.Device.DevEUI); err != nil && errors.Cause(err) != storage.ErrDoesNotExist {
+		return errors.Wrap(err, "delete device-session error")
+	}
+
+	return nil
+}
+
+func (ctx *joinContext) saveHandoverRoamingSession() error {
+	netID, err := ctx.getHRSenderNetID()
+	if err != nil {
+		return err
+	}
+
+	sess := storage.HandoverRoamingHNSDeviceSession{
+		DevEUI:          ctx.DeviceSession.DevEUI,
+		JoinEUI:         ctx.DeviceSession.JoinEUI,
+		DevAddr:         ctx.DeviceSession.DevAddr,
+		NetID:           netID,
+		AppSKeyEnvelope: ctx.DeviceSession.AppSKeyEvelope,
+	}
+
+	if lifetime := roaming.GetHandoverRoamingLifetime(netID); lifetime != 0 {
+		sess.Lifetime = time.Now().Add(lifetime)
+	}
+
+	if err := storage.SaveHandoverRoamingHNSDeviceSession(ctx.ctx, sess); err != nil {
+		return errors.Wrap(err, "save handover-roaming hns device-session error")
+	}
+
+	return nil
+}
+
+func (ctx *joinContext) setHRStartAnsPayload() error {
+	netID, err := ctx.getHRSenderNetID()
+	if err != nil {
+		return err
+	}
+
+	lifetime := int(roaming.GetHandoverRoamingLifetime(netID) / time.Second)
+
+	// sess keys
+	kekLabel := roaming.GetHandoverRoamingKEKLabel(netID)
+	var kekKey []byte
+	if kekLabel != "" {
+		kekKey, err = roaming.GetKEKKey(kekLabel)
+		if err != nil {
+			return errors.Wrap(err, "get kek key error")
+		}
+	}
+
+	dlMetaData, err := ctx.getJoinAcceptDLMetaData(ctx.HRStartReqPayload.ULMetaData)
+	if err != nil {
+		return err
+	}
+
+	sp := roaming.GetServiceProfileForHandover(ctx.ServiceProfile)
+
+	ctx.HRStartAnsPayload = &backend.HRStartAnsPayload{
+		PHYPayload:     ctx.JoinAnsPayload.PHYPayload,
+		Lifetime:       &lifetime,
+		ServiceProfile: &sp,
+		DLMetaData:     dlMetaData,
+	}
+
+	if ctx.DeviceSession.GetMACVersion() == lorawan.LoRaWAN1_0 {
+		ctx.HRStartAnsPayload.NwkSKey, err = backend.NewKeyEnvelope(kekLabel, kekKey, ctx.DeviceSession.NwkSEncKey)
+		if err != nil {
+			return errors.Wrap(err, "new key envelope error")
+		}
+	} else {
+		ctx.HRStartAnsPayload.SNwkSIntKey, err = backend.NewKeyEnvelope(kekLabel, kekKey, ctx.DeviceSession.SNwkSIntKey)
+		if err != nil {
+			return errors.Wrap(err, "new key envelope error")
+		}
+		ctx.HRStartAnsPayload.FNwkSIntKey, err = backend.NewKeyEnvelope(kekLabel, kekKey, ctx.DeviceSession.FNwkSIntKey)
+		if err != nil {
+			return errors.Wrap(err, "new key envelope error")
+		}
+		ctx.HRStartAnsPayload.NwkSEncKey, err = backend.NewKeyEnvelope(kekLabel, kekKey, ctx.DeviceSession.NwkSEncKey)
+		if err != nil {
+			return errors.Wrap(err, "new key envelope error")
+		}
+	}
+
+	return nil
+}
+
+func (ctx *joinContext) getHRSenderNetID() (lorawan.NetID, error) {
+	var netID lorawan.NetID
+	if err := netID.UnmarshalText([]byte(ctx.HRStartReqPayload.BasePayload.SenderID)); err != nil {
+		return netID, errors.Wrap(err, "decode netid error")
+	}
+	return netID, nil
+}
+
+// getJoinAcceptDLMetaData returns the DLMetaData for sending the
+// join-accept through the gateways of the roaming partner.
+func (ctx *joinContext) getJoinAcceptDLMetaData(ulMetaData backend.ULMetaData) (*backend.DLMetaData, error) {
+	classA := "A"
+	rxDelay1 := int(band.Band().GetDefaults().JoinAcceptDelay1 / time.Second)
+	rx1DR, err := band.Band().GetRX1DataRateIndex(ctx.RXPacket.DR, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "get rx1 data-rate error")
+	}
+	rx2DR := band.Band().GetDefaults().RX2DataRate
+	dlFreq1, err := band.Band().GetRX1FrequencyForUplinkFrequency(ctx.RXPacket.TXInfo.Frequency)
+	if err != nil {
+		return nil, errors.Wrap(err, "get rx1 frequency error")
+	}
+	dlFreq1Mhz := float64(dlFreq1) / 1000000
+	dlFreq2Mhz := float64(band.Band().GetDefaults().RX2Frequency) / 1000000
+
+	dlMetaData := backend.DLMetaData{
+		DevEUI:     &ctx.DeviceSession.DevEUI,
+		DLFreq1:    &dlFreq1Mhz,
+		DLFreq2:    &dlFreq2Mhz,
+		RXDelay1:   &rxDelay1,
+		ClassMode:  &classA,
+		DataRate1:  &rx1DR,
+		DataRate2:  &rx2DR,
+		FNSULToken: ulMetaData.FNSULToken,
+	}
+
+	for i := range ulMetaData.GWInfo {
+		dlMetaData.GWInfo = append(dlMetaData.GWInfo, backend.GWInfoElement{
+			ULToken: ulMetaData.GWInfo[i].ULToken,
+		})
+	}
+
+	return &dlMetaData, nil
+}
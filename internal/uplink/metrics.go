@@ -10,8 +10,35 @@ var (
 		Name: "uplink_counter",
 		Help: "The number of handled uplink frames by the Server (per message type).",
 	}, []string{"mType"})
+
+	qd = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "uplink_queue_depth",
+		Help: "The number of uplink frames waiting in the queue for a worker.",
+	})
+
+	wb = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "uplink_workers_busy",
+		Help: "The number of uplink workers handling an uplink frame.",
+	})
+
+	dc = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "uplink_dropped_count",
+		Help: "The number of uplink frames dropped because the uplink queue was full (per overload policy).",
+	}, []string{"policy"})
 )
 
 func uplinkFrameCounter(e string) prometheus.Counter {
 	return uc.With(prometheus.Labels{"mType": e})
 }
+
+func uplinkQueueDepthGauge() prometheus.Gauge {
+	return qd
+}
+
+func uplinkWorkersBusyGauge() prometheus.Gauge {
+	return wb
+}
+
+func uplinkDroppedCounter(policy string) prometheus.Counter {
+	return dc.With(prometheus.Labels{"policy": policy})
+}
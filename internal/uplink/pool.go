@@ -0,0 +1,210 @@
+package uplink
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/brocaar/lorawan"
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
+)
+
+// OverloadPolicy defines the policy applied when the uplink queue is full.
+type OverloadPolicy string
+
+// Available overload policies.
+const (
+	// DropOldest drops the oldest frame of the gateway with the most queued
+	// frames, so that a single bursting gateway does not starve the others.
+	DropOldest OverloadPolicy = "drop_oldest"
+
+	// DropNewest drops the received frame.
+	DropNewest OverloadPolicy = "drop_newest"
+
+	// Block blocks reading from the gateway backend until there is space in
+	// the queue.
+	Block OverloadPolicy = "block"
+)
+
+// uplinkJob contains either a received uplink frame or a scheduled task.
+type uplinkJob struct {
+	frame *gw.UplinkFrame
+	task  func()
+}
+
+// uplinkQueue implements a bounded queue of uplink frames. Frames are queued
+// per gateway and dequeued round-robin over the gateways, so that each
+// gateway gets a fair share of the workers. Besides frames, the queue
+// contains the tasks scheduled by the workers (e.g. handling the collected
+// frames after the de-duplication delay).
+type uplinkQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	policy  OverloadPolicy
+	maxSize int
+	size    int
+	closed  bool
+
+	frames map[lorawan.EUI64][]gw.UplinkFrame
+	order  []lorawan.EUI64
+
+	tasks   []func()
+	pending int
+}
+
+func newUplinkQueue(maxSize int, policy OverloadPolicy) (*uplinkQueue, error) {
+	switch policy {
+	case DropOldest, DropNewest, Block:
+	default:
+		return nil, fmt.Errorf("invalid overload policy: %s", policy)
+	}
+
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("queue size must be greater than 0")
+	}
+
+	q := uplinkQueue{
+		policy:  policy,
+		maxSize: maxSize,
+		frames:  make(map[lorawan.EUI64][]gw.UplinkFrame),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	return &q, nil
+}
+
+// push adds the given frame to the queue. When the queue is full, the
+// overload policy is applied.
+func (q *uplinkQueue) push(frame gw.UplinkFrame) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size >= q.maxSize && !q.closed {
+		switch q.policy {
+		case DropNewest:
+			uplinkDroppedCounter(string(q.policy)).Inc()
+			return
+		case DropOldest:
+			q.dropOldest()
+			uplinkDroppedCounter(string(q.policy)).Inc()
+		case Block:
+			q.cond.Wait()
+		}
+	}
+
+	if q.closed {
+		return
+	}
+
+	gatewayID := helpers.GetGatewayID(frame.GetRxInfo())
+	if len(q.frames[gatewayID]) == 0 {
+		q.order = append(q.order, gatewayID)
+	}
+	q.frames[gatewayID] = append(q.frames[gatewayID], frame)
+	q.size++
+	uplinkQueueDepthGauge().Set(float64(q.size))
+
+	q.cond.Broadcast()
+}
+
+// schedule adds the given task to the queue after the given delay. Tasks
+// are returned before the queued frames and are not subject to the max.
+// queue size, as these belong to frames that have already been accepted.
+func (q *uplinkQueue) schedule(delay time.Duration, task func()) {
+	q.mu.Lock()
+	q.pending++
+	q.mu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		q.pending--
+		q.tasks = append(q.tasks, task)
+		q.cond.Broadcast()
+	})
+}
+
+// pop returns the next task or frame from the queue. It blocks until one is
+// available. It returns false when the queue has been closed and all frames
+// and (scheduled) tasks have been consumed.
+func (q *uplinkQueue) pop() (uplinkJob, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size == 0 && len(q.tasks) == 0 && (!q.closed || q.pending > 0) {
+		q.cond.Wait()
+	}
+
+	if len(q.tasks) != 0 {
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		return uplinkJob{task: task}, true
+	}
+
+	if q.size == 0 {
+		return uplinkJob{}, false
+	}
+
+	gatewayID := q.order[0]
+	q.order = q.order[1:]
+
+	frames := q.frames[gatewayID]
+	frame := frames[0]
+	if len(frames) == 1 {
+		delete(q.frames, gatewayID)
+	} else {
+		q.frames[gatewayID] = frames[1:]
+		q.order = append(q.order, gatewayID)
+	}
+
+	q.size--
+	uplinkQueueDepthGauge().Set(float64(q.size))
+
+	q.cond.Broadcast()
+
+	return uplinkJob{frame: &frame}, true
+}
+
+// close closes the queue. Blocked push calls return and pending frames and
+// (scheduled) tasks can still be consumed using pop.
+func (q *uplinkQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// dropOldest drops the oldest frame of the gateway with the most queued
+// frames. It must be called with the lock held.
+func (q *uplinkQueue) dropOldest() {
+	var gatewayID lorawan.EUI64
+	var max int
+	for _, id := range q.order {
+		if n := len(q.frames[id]); n > max {
+			gatewayID = id
+			max = n
+		}
+	}
+
+	if max == 0 {
+		return
+	}
+
+	if max == 1 {
+		delete(q.frames, gatewayID)
+		for i, id := range q.order {
+			if id == gatewayID {
+				q.order = append(q.order[:i], q.order[i+1:]...)
+				break
+			}
+		}
+	} else {
+		q.frames[gatewayID] = q.frames[gatewayID][1:]
+	}
+
+	q.size--
+}
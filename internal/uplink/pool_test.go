@@ -0,0 +1,133 @@
+package uplink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/kamicuu/chirpstack-api/go/v3/gw"
+)
+
+func TestUplinkQueue(t *testing.T) {
+	frame := func(gatewayID byte, b byte) gw.UplinkFrame {
+		return gw.UplinkFrame{
+			PhyPayload: []byte{b},
+			RxInfo: &gw.UplinkRXInfo{
+				GatewayId: []byte{gatewayID, 0, 0, 0, 0, 0, 0, 0},
+			},
+		}
+	}
+
+	popAll := func(q *uplinkQueue) []byte {
+		q.close()
+
+		var out []byte
+		for {
+			job, ok := q.pop()
+			if !ok {
+				return out
+			}
+			out = append(out, job.frame.PhyPayload[0])
+		}
+	}
+
+	t.Run("Invalid policy", func(t *testing.T) {
+		assert := require.New(t)
+		_, err := newUplinkQueue(10, OverloadPolicy("foo"))
+		assert.Error(err)
+	})
+
+	t.Run("Round-robin over gateways", func(t *testing.T) {
+		assert := require.New(t)
+		q, err := newUplinkQueue(10, DropNewest)
+		assert.NoError(err)
+
+		q.push(frame(1, 1))
+		q.push(frame(1, 2))
+		q.push(frame(1, 3))
+		q.push(frame(2, 4))
+
+		assert.Equal([]byte{1, 4, 2, 3}, popAll(q))
+	})
+
+	t.Run("Drop newest", func(t *testing.T) {
+		assert := require.New(t)
+		q, err := newUplinkQueue(2, DropNewest)
+		assert.NoError(err)
+
+		q.push(frame(1, 1))
+		q.push(frame(2, 2))
+		q.push(frame(2, 3))
+
+		assert.Equal([]byte{1, 2}, popAll(q))
+	})
+
+	t.Run("Drop oldest", func(t *testing.T) {
+		assert := require.New(t)
+		q, err := newUplinkQueue(3, DropOldest)
+		assert.NoError(err)
+
+		q.push(frame(1, 1))
+		q.push(frame(1, 2))
+		q.push(frame(2, 3))
+		q.push(frame(2, 4))
+
+		assert.Equal([]byte{2, 3, 4}, popAll(q))
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		assert := require.New(t)
+		q, err := newUplinkQueue(1, Block)
+		assert.NoError(err)
+
+		q.push(frame(1, 1))
+
+		done := make(chan struct{})
+		go func() {
+			q.push(frame(1, 2))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			t.Fatal("push should block")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		job, ok := q.pop()
+		assert.True(ok)
+		assert.Equal([]byte{1}, job.frame.PhyPayload)
+		<-done
+
+		assert.Equal([]byte{2}, popAll(q))
+	})
+	t.Run("Scheduled task", func(t *testing.T) {
+		assert := require.New(t)
+		q, err := newUplinkQueue(10, DropNewest)
+		assert.NoError(err)
+
+		q.push(frame(1, 1))
+
+		var called bool
+		q.schedule(10*time.Millisecond, func() {
+			called = true
+		})
+		q.close()
+
+		// the frame is returned first, as the task is not yet due
+		job, ok := q.pop()
+		assert.True(ok)
+		assert.Equal([]byte{1}, job.frame.PhyPayload)
+
+		// the closed queue still returns the scheduled task
+		job, ok = q.pop()
+		assert.True(ok)
+		assert.Nil(job.frame)
+		job.task()
+		assert.True(called)
+
+		_, ok = q.pop()
+		assert.False(ok)
+	})
+}
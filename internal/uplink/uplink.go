@@ -22,6 +22,8 @@ import (
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/downlink/ack"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/framelog"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/gateway/presence"
+	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/geolocation"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/helpers"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/logging"
 	"github.com/kamicuu/chirpstack-network-server-ext/v3/internal/models"
@@ -34,10 +36,16 @@ import (
 
 var (
 	deduplicationDelay time.Duration
+	workerCount        int
+	uplinkFrameQueue   *uplinkQueue
 )
 
 // Setup configures the package.
 func Setup(conf config.Config) error {
+	if err := geolocation.Setup(conf); err != nil {
+		return errors.Wrap(err, "configure geolocation error")
+	}
+
 	if err := data.Setup(conf); err != nil {
 		return errors.Wrap(err, "configure uplink/data error")
 	}
@@ -51,6 +59,16 @@ func Setup(conf config.Config) error {
 	}
 
 	deduplicationDelay = conf.NetworkServer.DeduplicationDelay
+	workerCount = conf.NetworkServer.Uplink.WorkerCount
+	uplinkFrameQueue = nil
+
+	if workerCount > 0 {
+		queue, err := newUplinkQueue(conf.NetworkServer.Uplink.QueueSize, OverloadPolicy(conf.NetworkServer.Uplink.OverloadPolicy))
+		if err != nil {
+			return errors.Wrap(err, "new uplink queue error")
+		}
+		uplinkFrameQueue = queue
+	}
 
 	return nil
 }
@@ -93,36 +111,106 @@ func (s *Server) Stop() error {
 }
 
 // HandleUplinkFrames consumes received packets by the gateway and handles them
-// in a separate go-routine. Errors are logged.
+// using the configured number of workers. When no worker count is configured,
+// each packet is handled in a separate go-routine. Errors are logged.
 func HandleUplinkFrames(wg *sync.WaitGroup) {
-	for uplinkFrame := range gwbackend.Backend().RXPacketChan() {
-		go func(uplinkFrame gw.UplinkFrame) {
-			wg.Add(1)
+	if uplinkFrameQueue == nil {
+		for uplinkFrame := range gwbackend.Backend().RXPacketChan() {
+			go func(uplinkFrame gw.UplinkFrame) {
+				wg.Add(1)
+				defer wg.Done()
+
+				handleUplinkFrameWithContext(nil, uplinkFrame)
+			}(uplinkFrame)
+		}
+		return
+	}
+
+	queue := uplinkFrameQueue
+
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
 			defer wg.Done()
 
-			// The ctxID will be available as context value "ctx_id" so that
-			// this can be used when writing logs. This makes it easier to
-			// group multiple log-lines to the same context.
-			ctxID, err := uuid.NewV4()
-			if err != nil {
-				log.WithError(err).Error("uplink: get new uuid error")
+			for {
+				job, ok := queue.pop()
+				if !ok {
+					return
+				}
+
+				uplinkWorkersBusyGauge().Inc()
+				if job.task != nil {
+					job.task()
+				} else {
+					handleUplinkFrameWithContext(queue, *job.frame)
+				}
+				uplinkWorkersBusyGauge().Dec()
 			}
+		}()
+	}
 
-			ctx := context.Background()
-			ctx = context.WithValue(ctx, logging.ContextIDKey, ctxID)
+	for uplinkFrame := range gwbackend.Backend().RXPacketChan() {
+		queue.push(uplinkFrame)
+	}
 
-			if err := HandleUplinkFrame(ctx, uplinkFrame); err != nil {
-				log.WithFields(log.Fields{
-					"ctx_id": ctxID,
-				}).WithError(err).Error("uplink: processing uplink frame error")
-			}
-		}(uplinkFrame)
+	// the workers will handle the pending frames before returning
+	queue.close()
+}
+
+func handleUplinkFrameWithContext(queue *uplinkQueue, uplinkFrame gw.UplinkFrame) {
+	// The ctxID will be available as context value "ctx_id" so that
+	// this can be used when writing logs. This makes it easier to
+	// group multiple log-lines to the same context.
+	ctxID, err := uuid.NewV4()
+	if err != nil {
+		log.WithError(err).Error("uplink: get new uuid error")
+	}
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, logging.ContextIDKey, ctxID)
+
+	if err := handleUplinkFrame(ctx, queue, uplinkFrame); err != nil {
+		log.WithFields(log.Fields{
+			"ctx_id": ctxID,
+		}).WithError(err).Error("uplink: processing uplink frame error")
 	}
 }
 
 // HandleUplinkFrame handles a single uplink frame.
 func HandleUplinkFrame(ctx context.Context, uplinkFrame gw.UplinkFrame) error {
-	return collectUplinkFrames(ctx, uplinkFrame)
+	return handleUplinkFrame(ctx, nil, uplinkFrame)
+}
+
+// handleUplinkFrame handles a single uplink frame. When a queue is given,
+// the collected frames are handled by a worker of the queue once the
+// de-duplication delay has expired, instead of blocking the current worker
+// for the duration of the delay.
+func handleUplinkFrame(ctx context.Context, queue *uplinkQueue, uplinkFrame gw.UplinkFrame) error {
+	if err := presence.Seen(ctx, helpers.GetGatewayID(uplinkFrame.RxInfo), presence.SourceUplink); err != nil {
+		log.WithFields(log.Fields{
+			"ctx_id": ctx.Value(logging.ContextIDKey),
+		}).WithError(err).Error("uplink: update gateway presence error")
+	}
+
+	if queue == nil {
+		return collectUplinkFrames(ctx, uplinkFrame)
+	}
+
+	call, err := collectOnce(uplinkFrame, collectedUplinkCallback(ctx, uplinkFrame))
+	if err != nil || call == nil {
+		return err
+	}
+
+	queue.schedule(deduplicationDelay, func() {
+		if err := call(); err != nil {
+			log.WithFields(log.Fields{
+				"ctx_id": ctx.Value(logging.ContextIDKey),
+			}).WithError(err).Error("uplink: processing uplink frame error")
+		}
+	})
+
+	return nil
 }
 
 // HandleDownlinkTXAcks consumes received downlink tx acknowledgements from
@@ -144,6 +232,13 @@ func HandleDownlinkTXAcks(wg *sync.WaitGroup) {
 			ctx := context.Background()
 			ctx = context.WithValue(ctx, logging.ContextIDKey, ctxID)
 
+			if err := presence.Seen(ctx, helpers.GetGatewayID(&downlinkTXAck), presence.SourceTXAck); err != nil {
+				log.WithFields(log.Fields{
+					"gateway_id": hex.EncodeToString(downlinkTXAck.GatewayId),
+					"ctx_id":     ctxID,
+				}).WithError(err).Error("uplink: update gateway presence error")
+			}
+
 			if err := ack.HandleDownlinkTXAck(ctx, &downlinkTXAck); err != nil {
 				log.WithFields(log.Fields{
 					"gateway_id": hex.EncodeToString(downlinkTXAck.GatewayId),
@@ -157,7 +252,13 @@ func HandleDownlinkTXAcks(wg *sync.WaitGroup) {
 }
 
 func collectUplinkFrames(ctx context.Context, uplinkFrame gw.UplinkFrame) error {
-	return collectAndCallOnce(uplinkFrame, func(rxPacket models.RXPacket) error {
+	return collectAndCallOnce(uplinkFrame, collectedUplinkCallback(ctx, uplinkFrame))
+}
+
+// collectedUplinkCallback returns the callback handling the collected uplink
+// frames.
+func collectedUplinkCallback(ctx context.Context, uplinkFrame gw.UplinkFrame) func(rxPacket models.RXPacket) error {
+	return func(rxPacket models.RXPacket) error {
 		err := handleCollectedUplink(ctx, uplinkFrame, rxPacket)
 		if err != nil {
 			cause := errors.Cause(err)
@@ -175,7 +276,7 @@ func collectUplinkFrames(ctx context.Context, uplinkFrame gw.UplinkFrame) error
 		}
 
 		return err
-	})
+	}
 }
 func runHandlerWithMetric(err error, mt lorawan.MType) error {
 	mts := mt.String()